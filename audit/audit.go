@@ -0,0 +1,96 @@
+// Package audit records the operations which modify a shnorky state directory (e.g. creating or
+// removing components, building them, and executing flows) in an audit log stored in the state
+// database. The audit log records who performed each operation, when, with which arguments, and
+// whether it succeeded, which helps when several people share a state directory.
+package audit
+
+import (
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// Actions which are recorded in the audit log
+var (
+	ActionComponentCreate  = "components.create"
+	ActionComponentRemove  = "components.remove"
+	ActionComponentBuild   = "components.build"
+	ActionComponentRun     = "components.execute"
+	ActionComponentRefresh = "components.refresh"
+	ActionFlowCreate       = "flows.create"
+	ActionFlowBuild        = "flows.build"
+	ActionFlowRun          = "flows.execute"
+	ActionFlowSubmit       = "flows.submit"
+	ActionFlowApprove      = "flows.approve"
+	ActionFlowPause        = "flows.pause"
+	ActionFlowResume       = "flows.resume"
+	ActionFlowUp           = "flows.up"
+	ActionFlowDown         = "flows.down"
+	ActionTokenCreate      = "tokens.create"
+	ActionTokenRevoke      = "tokens.revoke"
+	ActionBundleImport     = "bundles.import"
+	ActionWorkspaceSync    = "workspace.sync"
+)
+
+// ResultSucceeded is the result of operations which succeeded
+var ResultSucceeded = "succeeded"
+
+// ResultFailed is the result of operations which failed
+var ResultFailed = "failed"
+
+// Entry - a record of an operation which modified the state directory
+type Entry struct {
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	// Actor is the user who performed the operation. Operations performed through the API server
+	// are attributed to "api:<role>".
+	Actor     string            `json:"actor"`
+	Arguments map[string]string `json:"arguments"`
+	Result    string            `json:"result"`
+	Error     string            `json:"error,omitempty"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// Filter - restricts the entries returned by List. Empty members do not restrict the entries.
+type Filter = state.AuditFilter
+
+// Record adds an entry for the given action to the audit log in the given state database. The
+// result of the action is determined by actionErr: nil means the action succeeded.
+func Record(store state.Store, action, actor string, arguments map[string]string, actionErr error) (Entry, error) {
+	entryID, err := uuid.NewRandom()
+	if err != nil {
+		return Entry{}, err
+	}
+	if arguments == nil {
+		arguments = map[string]string{}
+	}
+	entry := Entry{
+		ID:        entryID.String(),
+		Action:    action,
+		Actor:     actor,
+		Arguments: arguments,
+		Result:    ResultSucceeded,
+		CreatedAt: time.Now(),
+	}
+	if actionErr != nil {
+		entry.Result = ResultFailed
+		entry.Error = actionErr.Error()
+	}
+
+	err = store.InsertAuditEntry(state.AuditEntryRecord(entry))
+	return entry, err
+}
+
+// List returns the entries in the audit log of the given state database which match the given
+// filter, most recent first
+// This is the handler for `shn audit list`
+func List(store state.Store, filter Filter) ([]Entry, error) {
+	records, err := store.SelectAuditEntries(filter)
+	entries := make([]Entry, len(records))
+	for i, record := range records {
+		entries[i] = Entry(record)
+	}
+	return entries, err
+}
@@ -0,0 +1,94 @@
+package audit
+
+import (
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestRecordAndList(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-audit-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+	defer os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Error creating state directory: %s", err.Error())
+	}
+
+	db, err := sql.Open("sqlite3", path.Join(stateDir, state.DBFileName))
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	_, err = Record(store, ActionComponentCreate, "alice", map[string]string{"id": "extractor"}, nil)
+	if err != nil {
+		t.Fatalf("Could not record entry: %s", err.Error())
+	}
+	_, err = Record(store, ActionComponentRemove, "bob", map[string]string{"id": "extractor"}, nil)
+	if err != nil {
+		t.Fatalf("Could not record entry: %s", err.Error())
+	}
+	_, err = Record(store, ActionFlowRun, "alice", nil, errors.New("step failed"))
+	if err != nil {
+		t.Fatalf("Could not record entry: %s", err.Error())
+	}
+
+	type listTest struct {
+		filter          Filter
+		expectedActions []string
+	}
+
+	tests := []listTest{
+		{Filter{}, []string{ActionFlowRun, ActionComponentRemove, ActionComponentCreate}},
+		{Filter{Limit: 2}, []string{ActionFlowRun, ActionComponentRemove}},
+		{Filter{Actor: "alice"}, []string{ActionFlowRun, ActionComponentCreate}},
+		{Filter{Action: ActionComponentRemove}, []string{ActionComponentRemove}},
+		{Filter{Actor: "bob", Action: ActionFlowRun}, []string{}},
+		{Filter{Since: time.Now().Add(time.Hour)}, []string{}},
+	}
+
+	for i, test := range tests {
+		entries, err := List(store, test.filter)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not list entries: %s", i, err.Error())
+		}
+		if len(entries) != len(test.expectedActions) {
+			t.Errorf("[Test %d] Unexpected number of entries: expected %d, got %d", i, len(test.expectedActions), len(entries))
+			continue
+		}
+		for j, entry := range entries {
+			if entry.Action != test.expectedActions[j] {
+				t.Errorf("[Test %d] Unexpected action for entry %d: expected %s, got %s", i, j, test.expectedActions[j], entry.Action)
+			}
+		}
+	}
+
+	entries, err := List(store, Filter{Action: ActionFlowRun})
+	if err != nil {
+		t.Fatalf("Could not list entries: %s", err.Error())
+	}
+	if entries[0].Result != ResultFailed || entries[0].Error != "step failed" || len(entries[0].Arguments) != 0 {
+		t.Errorf("Unexpected failed entry: %v", entries[0])
+	}
+	entries, err = List(store, Filter{Action: ActionComponentCreate})
+	if err != nil {
+		t.Fatalf("Could not list entries: %s", err.Error())
+	}
+	if entries[0].Result != ResultSucceeded || entries[0].Actor != "alice" || entries[0].Arguments["id"] != "extractor" {
+		t.Errorf("Unexpected successful entry: %v", entries[0])
+	}
+}
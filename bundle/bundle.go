@@ -0,0 +1,370 @@
+// Package bundle exports registered flows, along with the components that they use, into portable
+// archives (gzipped tarballs), and imports such archives into other state directories. A bundle
+// contains the flow specification (with its includes merged into it), the specification and the
+// directory of each component, the labels of the flow and its components, and a manifest which
+// describes the contents of the bundle.
+// This package implements `shn export` and `shn import`.
+package bundle
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/flows"
+	"github.com/simiotics/shnorky/state"
+)
+
+// FormatVersion is the version of the bundle format written by Export. Import refuses bundles with
+// other versions.
+var FormatVersion = 1
+
+// Paths of the members of a bundle
+var (
+	ManifestPath          = "manifest.json"
+	FlowSpecificationPath = "flow.json"
+	ComponentsDir         = "components"
+)
+
+// ErrDestinationNotEmpty signifies that a caller attempted to import a bundle into a directory
+// which already has contents
+var ErrDestinationNotEmpty = errors.New("Bundles may only be imported into directories which are empty or do not exist")
+
+// Manifest - describes the contents of a bundle
+type Manifest struct {
+	Version    int              `json:"version"`
+	Flow       FlowEntry        `json:"flow"`
+	Components []ComponentEntry `json:"components"`
+	CreatedAt  time.Time        `json:"created_at"`
+	CreatedBy  string           `json:"created_by"`
+}
+
+// FlowEntry - describes the flow in a bundle
+type FlowEntry struct {
+	ID     string            `json:"id"`
+	Labels map[string]string `json:"labels,omitempty"`
+	// Specification is the path of the flow specification in the bundle
+	Specification string `json:"specification"`
+}
+
+// ComponentEntry - describes a component in a bundle
+type ComponentEntry struct {
+	ID            string            `json:"id"`
+	ComponentType string            `json:"component_type"`
+	Labels        map[string]string `json:"labels,omitempty"`
+	// Directory is the path in the bundle of the directory in which the component is defined
+	Directory string `json:"directory"`
+	// Specification is the path of the component specification in the bundle
+	Specification string `json:"specification"`
+}
+
+// Export writes a bundle containing the flow with the given ID and the components that it uses
+// (as steps or as hooks) to w. Built-in components are not included, as they are registered
+// automatically wherever they are used, and neither are components embedded in the flow
+// specification, which travel with it.
+// This is the handler for `shn export`
+func Export(store state.Store, flowID string, w io.Writer) (Manifest, error) {
+	flow, err := flows.SelectFlowByID(store, flowID)
+	if err != nil {
+		return Manifest{}, err
+	}
+	specification, err := flows.ReadFlowSpecification(store, flowID)
+	if err != nil {
+		return Manifest{}, err
+	}
+	specificationDocument, err := flows.ReadSpecificationDocument(flow.SpecificationPath)
+	if err != nil {
+		return Manifest{}, err
+	}
+	flowLabels, err := components.Labels(store, components.LabelledFlow, flowID)
+	if err != nil {
+		return Manifest{}, err
+	}
+	for name, embeddedComponent := range specification.Components {
+		if embeddedComponent.Path != "" {
+			return Manifest{}, fmt.Errorf("Embedded component (%s) refers to a directory (%s), so it cannot be exported - use an inline Dockerfile or register it as a separate component", name, embeddedComponent.Path)
+		}
+	}
+
+	componentIDs := flows.HookComponents(specification)
+	for _, componentID := range specification.Steps {
+		componentIDs = append(componentIDs, componentID)
+	}
+	sort.Strings(componentIDs)
+
+	manifest := Manifest{
+		Version:    FormatVersion,
+		Flow:       FlowEntry{ID: flowID, Labels: flowLabels, Specification: FlowSpecificationPath},
+		Components: []ComponentEntry{},
+		CreatedAt:  time.Now(),
+		CreatedBy:  state.CurrentUser(),
+	}
+
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	exported := map[string]bool{}
+	for _, componentID := range componentIDs {
+		if exported[componentID] || components.IsBuiltinComponent(componentID) || flows.IsEmbeddedComponent(componentID) {
+			continue
+		}
+		exported[componentID] = true
+
+		component, err := components.SelectComponentByID(store, componentID)
+		if err != nil {
+			return manifest, fmt.Errorf("Error reading component (%s): %w", componentID, err)
+		}
+		labels, err := components.Labels(store, components.LabelledComponent, componentID)
+		if err != nil {
+			return manifest, err
+		}
+		componentDir := path.Join(ComponentsDir, fmt.Sprintf("%d", len(manifest.Components)))
+		entry := ComponentEntry{
+			ID:            componentID,
+			ComponentType: component.ComponentType,
+			Labels:        labels,
+			Directory:     path.Join(componentDir, "context"),
+			Specification: path.Join(componentDir, "specification.json"),
+		}
+
+		componentSpecification, err := ioutil.ReadFile(component.SpecificationPath)
+		if err != nil {
+			return manifest, fmt.Errorf("Error reading specification of component (%s): %w", componentID, err)
+		}
+		err = writeFile(tarWriter, entry.Specification, componentSpecification)
+		if err != nil {
+			return manifest, err
+		}
+		err = writeDirectory(tarWriter, component.ComponentPath, entry.Directory)
+		if err != nil {
+			return manifest, fmt.Errorf("Error exporting directory of component (%s): %w", componentID, err)
+		}
+		manifest.Components = append(manifest.Components, entry)
+	}
+
+	err = writeFile(tarWriter, FlowSpecificationPath, specificationDocument)
+	if err != nil {
+		return manifest, err
+	}
+	marshalledManifest, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return manifest, err
+	}
+	err = writeFile(tarWriter, ManifestPath, marshalledManifest)
+	if err != nil {
+		return manifest, err
+	}
+
+	err = tarWriter.Close()
+	if err != nil {
+		return manifest, err
+	}
+	return manifest, gzipWriter.Close()
+}
+
+// Import extracts the bundle read from r into the given destination directory (which must be empty
+// or not exist yet) and registers the components and the flow that it contains, along with their
+// labels, against the given state database. The registered components and flow refer to their
+// extracted specifications and directories, so the destination directory must be kept for as long
+// as they are registered. If any of the components or the flow is already registered, nothing is
+// registered.
+// This is the handler for `shn import`
+func Import(store state.Store, r io.Reader, destination string) (Manifest, error) {
+	entries, err := ioutil.ReadDir(destination)
+	if err == nil && len(entries) > 0 {
+		return Manifest{}, ErrDestinationNotEmpty
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return Manifest{}, err
+	}
+
+	err = extract(r, destination)
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	manifestBytes, err := ioutil.ReadFile(filepath.Join(destination, ManifestPath))
+	if err != nil {
+		return Manifest{}, fmt.Errorf("Error reading bundle manifest: %w", err)
+	}
+	var manifest Manifest
+	err = json.Unmarshal(manifestBytes, &manifest)
+	if err != nil {
+		return manifest, fmt.Errorf("Error decoding bundle manifest: %w", err)
+	}
+	if manifest.Version != FormatVersion {
+		return manifest, fmt.Errorf("Unsupported bundle version: expected=%d, actual=%d", FormatVersion, manifest.Version)
+	}
+
+	_, err = flows.SelectFlowByID(store, manifest.Flow.ID)
+	if err == nil {
+		return manifest, fmt.Errorf("Flow (%s) is already registered", manifest.Flow.ID)
+	} else if err != flows.ErrFlowNotFound {
+		return manifest, err
+	}
+	for _, entry := range manifest.Components {
+		_, err = components.SelectComponentByID(store, entry.ID)
+		if err == nil {
+			return manifest, fmt.Errorf("Component (%s) is already registered", entry.ID)
+		} else if err != components.ErrComponentNotFound {
+			return manifest, err
+		}
+	}
+
+	registered := []string{}
+	rollback := func() {
+		for _, componentID := range registered {
+			components.RemoveComponent(store, componentID)
+		}
+	}
+	for _, entry := range manifest.Components {
+		componentPath := filepath.Join(destination, filepath.FromSlash(entry.Directory))
+		specificationPath := filepath.Join(destination, filepath.FromSlash(entry.Specification))
+		_, err = components.AddComponent(store, entry.ID, entry.ComponentType, componentPath, specificationPath)
+		if err != nil {
+			rollback()
+			return manifest, fmt.Errorf("Error registering component (%s): %w", entry.ID, err)
+		}
+		registered = append(registered, entry.ID)
+		err = components.SetLabels(store, components.LabelledComponent, entry.ID, entry.Labels)
+		if err != nil {
+			rollback()
+			return manifest, err
+		}
+	}
+
+	_, err = flows.AddFlow(store, manifest.Flow.ID, filepath.Join(destination, filepath.FromSlash(manifest.Flow.Specification)))
+	if err != nil {
+		rollback()
+		return manifest, fmt.Errorf("Error registering flow (%s): %w", manifest.Flow.ID, err)
+	}
+	err = components.SetLabels(store, components.LabelledFlow, manifest.Flow.ID, manifest.Flow.Labels)
+	if err != nil {
+		return manifest, err
+	}
+
+	return manifest, nil
+}
+
+// writeFile writes a regular file with the given name and contents to the given archive
+func writeFile(tarWriter *tar.Writer, name string, contents []byte) error {
+	header := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(contents)),
+		ModTime:  time.Now(),
+	}
+	err := tarWriter.WriteHeader(header)
+	if err != nil {
+		return err
+	}
+	_, err = tarWriter.Write(contents)
+	return err
+}
+
+// writeDirectory writes the contents of the given directory to the given archive under the given
+// name. Only directories and regular files are supported.
+func writeDirectory(tarWriter *tar.Writer, sourceDir, name string) error {
+	return filepath.Walk(sourceDir, func(sourcePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(sourceDir, sourcePath)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return fmt.Errorf("Only directories and regular files can be exported: %s", sourcePath)
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = path.Join(name, filepath.ToSlash(relativePath))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		err = tarWriter.WriteHeader(header)
+		if err != nil || info.IsDir() {
+			return err
+		}
+
+		sourceFile, err := os.Open(sourcePath)
+		if err != nil {
+			return err
+		}
+		defer sourceFile.Close()
+		_, err = io.Copy(tarWriter, sourceFile)
+		return err
+	})
+}
+
+// extract extracts the gzipped tarball read from r into the given destination directory. Members
+// which are not directories or regular files, and members whose paths would escape the destination
+// directory, are rejected.
+func extract(r io.Reader, destination string) error {
+	gzipReader, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("Error reading bundle: %w", err)
+	}
+	defer gzipReader.Close()
+
+	err = os.MkdirAll(destination, 0755)
+	if err != nil {
+		return err
+	}
+
+	tarReader := tar.NewReader(gzipReader)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Error reading bundle: %w", err)
+		}
+
+		name := path.Clean(header.Name)
+		if path.IsAbs(name) || name == ".." || strings.HasPrefix(name, "../") {
+			return fmt.Errorf("Invalid path in bundle: %s", header.Name)
+		}
+		targetPath := filepath.Join(destination, filepath.FromSlash(name))
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(targetPath, 0755)
+			if err != nil {
+				return err
+			}
+		case tar.TypeReg, tar.TypeRegA:
+			err = os.MkdirAll(filepath.Dir(targetPath), 0755)
+			if err != nil {
+				return err
+			}
+			targetFile, err := os.OpenFile(targetPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, os.FileMode(header.Mode).Perm())
+			if err != nil {
+				return err
+			}
+			_, err = io.Copy(targetFile, tarReader)
+			targetFile.Close()
+			if err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("Unsupported member in bundle (only directories and regular files are supported): %s", header.Name)
+		}
+	}
+}
@@ -0,0 +1,154 @@
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/flows"
+	"github.com/simiotics/shnorky/state"
+)
+
+func initStateDB(t *testing.T, prefix string) (string, *sql.DB) {
+	stateDir, err := ioutil.TempDir("", prefix)
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+
+	db, err := sql.Open("sqlite3", path.Join(stateDir, state.DBFileName))
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	return stateDir, db
+}
+
+func TestExportImport(t *testing.T) {
+	sourceDir, sourceDB := initStateDB(t, "shnorky-bundle-source-tests-")
+	defer os.RemoveAll(sourceDir)
+	defer sourceDB.Close()
+	sourceStore := state.NewSQLiteStore(sourceDB)
+
+	componentPath := "../examples/components/single-task"
+	_, err := components.AddComponent(sourceStore, "single-task", components.Task, componentPath, path.Join(componentPath, "component.json"))
+	if err != nil {
+		t.Fatalf("Error adding component: %s", err.Error())
+	}
+	componentLabels := map[string]string{"team": "data"}
+	err = components.SetLabels(sourceStore, components.LabelledComponent, "single-task", componentLabels)
+	if err != nil {
+		t.Fatalf("Error setting component labels: %s", err.Error())
+	}
+	_, err = flows.AddFlow(sourceStore, "single-task-twice", "../examples/flows/single-task-twice.json")
+	if err != nil {
+		t.Fatalf("Error adding flow: %s", err.Error())
+	}
+	flowLabels := map[string]string{"env": "test"}
+	err = components.SetLabels(sourceStore, components.LabelledFlow, "single-task-twice", flowLabels)
+	if err != nil {
+		t.Fatalf("Error setting flow labels: %s", err.Error())
+	}
+
+	var buffer bytes.Buffer
+	manifest, err := Export(sourceStore, "single-task-twice", &buffer)
+	if err != nil {
+		t.Fatalf("Error exporting flow: %s", err.Error())
+	}
+	if len(manifest.Components) != 1 || manifest.Components[0].ID != "single-task" {
+		t.Fatalf("Unexpected components in manifest: %v", manifest.Components)
+	}
+	bundleBytes := buffer.Bytes()
+
+	targetDir, targetDB := initStateDB(t, "shnorky-bundle-target-tests-")
+	defer os.RemoveAll(targetDir)
+	defer targetDB.Close()
+	targetStore := state.NewSQLiteStore(targetDB)
+
+	destination := path.Join(targetDir, state.ImportsDirName, "single-task-twice")
+	importedManifest, err := Import(targetStore, bytes.NewReader(bundleBytes), destination)
+	if err != nil {
+		t.Fatalf("Error importing bundle: %s", err.Error())
+	}
+	if importedManifest.Flow.ID != "single-task-twice" {
+		t.Errorf("Unexpected flow in imported manifest: expected=%s, actual=%s", "single-task-twice", importedManifest.Flow.ID)
+	}
+
+	component, err := components.SelectComponentByID(targetStore, "single-task")
+	if err != nil {
+		t.Fatalf("Error selecting imported component: %s", err.Error())
+	}
+	expectedComponentPath := filepath.Join(destination, filepath.FromSlash(manifest.Components[0].Directory))
+	if component.ComponentPath != expectedComponentPath {
+		t.Errorf("Unexpected component path: expected=%s, actual=%s", expectedComponentPath, component.ComponentPath)
+	}
+	for _, name := range []string{"Dockerfile", "component.json"} {
+		if _, err := os.Stat(filepath.Join(component.ComponentPath, name)); err != nil {
+			t.Errorf("Could not find %s in imported component directory: %s", name, err.Error())
+		}
+	}
+	if _, err := components.ReadComponentSpecification(targetStore, "single-task"); err != nil {
+		t.Errorf("Could not read imported component specification: %s", err.Error())
+	}
+	labels, err := components.Labels(targetStore, components.LabelledComponent, "single-task")
+	if err != nil || !reflect.DeepEqual(labels, componentLabels) {
+		t.Errorf("Unexpected labels on imported component: expected=%v, actual=%v (error: %v)", componentLabels, labels, err)
+	}
+
+	specification, err := flows.ReadFlowSpecification(targetStore, "single-task-twice")
+	if err != nil {
+		t.Fatalf("Error reading imported flow specification: %s", err.Error())
+	}
+	if specification.Steps["first"] != "single-task" || specification.Steps["second"] != "single-task" {
+		t.Errorf("Unexpected steps in imported flow: %v", specification.Steps)
+	}
+	labels, err = components.Labels(targetStore, components.LabelledFlow, "single-task-twice")
+	if err != nil || !reflect.DeepEqual(labels, flowLabels) {
+		t.Errorf("Unexpected labels on imported flow: expected=%v, actual=%v (error: %v)", flowLabels, labels, err)
+	}
+
+	_, err = Import(targetStore, bytes.NewReader(bundleBytes), destination)
+	if err != ErrDestinationNotEmpty {
+		t.Errorf("Unexpected error importing into non-empty directory: expected=%v, actual=%v", ErrDestinationNotEmpty, err)
+	}
+	_, err = Import(targetStore, bytes.NewReader(bundleBytes), path.Join(targetDir, state.ImportsDirName, "again"))
+	if err == nil {
+		t.Error("Expected error importing bundle whose flow is already registered")
+	}
+}
+
+func TestExtractRejectsEscapingPaths(t *testing.T) {
+	for i, name := range []string{"../outside.txt", "/absolute.txt", "components/../../outside.txt"} {
+		var buffer bytes.Buffer
+		gzipWriter := gzip.NewWriter(&buffer)
+		tarWriter := tar.NewWriter(gzipWriter)
+		err := writeFile(tarWriter, name, []byte("contents"))
+		if err != nil {
+			t.Fatalf("[Test %d] Error writing archive: %s", i, err.Error())
+		}
+		tarWriter.Close()
+		gzipWriter.Close()
+
+		destination, err := ioutil.TempDir("", "shnorky-bundle-extract-tests-")
+		if err != nil {
+			t.Fatalf("[Test %d] Could not create temporary directory: %s", i, err.Error())
+		}
+		err = extract(&buffer, destination)
+		os.RemoveAll(destination)
+		if err == nil {
+			t.Errorf("[Test %d] Expected error extracting member: %s", i, name)
+		}
+	}
+}
@@ -3,20 +3,38 @@ package main
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	stdlog "log"
+	"net/http"
 	"os"
+	"os/signal"
 	"os/user"
 	"path"
+	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
+	"time"
 
+	docker "github.com/docker/docker/client"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 
+	"github.com/simiotics/shnorky/audit"
+	"github.com/simiotics/shnorky/bundle"
 	"github.com/simiotics/shnorky/components"
 	"github.com/simiotics/shnorky/flows"
 	"github.com/simiotics/shnorky/internal"
+	"github.com/simiotics/shnorky/internal/diskusage"
+	"github.com/simiotics/shnorky/internal/doctor"
+	"github.com/simiotics/shnorky/internal/tui"
+	"github.com/simiotics/shnorky/server"
 	"github.com/simiotics/shnorky/state"
+	"github.com/simiotics/shnorky/tracing"
+	"github.com/simiotics/shnorky/workspace"
 )
 
 // Version denotes the current version of the shnorky tool and library
@@ -25,6 +43,9 @@ var Version = "0.1.0-dev"
 var log = internal.GenerateLogger()
 
 func main() {
+	// Everything that commands write to stdout has sensitive values (see components.Redact) masked
+	stdout := components.NewRedactingWriter(os.Stdout)
+
 	defaultStateDir := ".shn"
 	currentUser, err := user.Current()
 	if err != nil {
@@ -34,23 +55,95 @@ func main() {
 		defaultStateDir = path.Join(currentUser.HomeDir, defaultStateDir)
 	}
 
-	var id, componentType, componentPath, specificationPath, stateDir, mountConfig string
+	var id, componentType, componentPath, specificationPath, stateDir, mountConfig, workdir string
+	var attachStdin, outputJSON, mine, assumeYes, ephemeral bool
+	var rawLabels []string
+	var window int
+	var page components.Page
+	var buildOptions components.BuildOptions
+	var bundleFlowID, importDir string
+	var mountsPath string
+	var logLevel, logFormat string
+	var componentDirs []string
 
 	shnorkyCommand := &cobra.Command{
-		Use:              "shn",
-		Short:            "Shnorky: Single-machine data processing flows using docker",
-		Long:             "shnorky lets you define data processing flows and then execute them using docker. It runs on a single machine.",
+		Use:   "shn",
+		Short: "Shnorky: Single-machine data processing flows using docker",
+		Long: `shnorky lets you define data processing flows and then execute them using docker. It runs on a single machine.
+
+Exit codes:
+  1  any failure not listed below
+  2  unknown command, flag, or arguments
+  3  invalid component or flow specification
+  4  a component image failed to build
+  5  a container exited with a non-zero code
+  6  an operation timed out
+  7  the state database could not be read or written`,
 		TraverseChildren: true,
 	}
 
 	shnorkyCommand.PersistentFlags().StringVarP(&stateDir, "statedir", "S", defaultStateDir, "Path to shnorky state directory")
+	shnorkyCommand.PersistentFlags().BoolVar(&ephemeral, "ephemeral", false, "Use an in-memory state database and a temporary state directory (ignoring --statedir) which are discarded when the command exits; docker objects are labelled with "+components.EphemeralLabel+" for later cleanup")
+	shnorkyCommand.PersistentFlags().StringVar(&logLevel, "log-level", internal.EnvironmentLogLevel(), "Minimum level of log messages (one of TRACE, DEBUG, INFO, WARN, ERROR, FATAL, PANIC); defaults to the LOG_LEVEL environment variable")
+	shnorkyCommand.PersistentFlags().StringVar(&logFormat, "log-format", internal.EnvironmentLogFormat(), "Format of log messages (one of text, json); defaults to the LOG_FORMAT environment variable")
+	shnorkyCommand.PersistentPreRun = func(cmd *cobra.Command, args []string) {
+		err := internal.ConfigureLogger(log, logLevel, logFormat)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		components.Log = log
+
+		exporter, err := tracing.NewOTLPExporterFromEnv()
+		if err != nil {
+			log.WithField("error", err).Fatal("Invalid tracing configuration")
+		}
+		if exporter != nil {
+			tracing.Exporter = exporter
+			tracing.ErrorHandler = func(err error) {
+				log.WithField("error", err).Warn("Could not export trace spans")
+			}
+			logrus.RegisterExitHandler(func() { tracing.Flush() })
+		}
+
+		if ephemeral {
+			ephemeralStateDir, db, err := state.InitEphemeral()
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not initialize ephemeral state")
+			}
+			stateDir = ephemeralStateDir
+			internal.EphemeralStateDB = db
+			components.DockerLabels[components.EphemeralLabel] = "true"
+			logrus.RegisterExitHandler(func() { os.RemoveAll(ephemeralStateDir) })
+			log.WithField("stateDir", stateDir).Debug("Using ephemeral state")
+		}
+
+		// The environment policy fails closed: if the state configuration cannot be read, no
+		// specification may read any environment variable
+		config, err := state.ReadConfig(stateDir)
+		if err != nil {
+			log.WithField("error", err).Warn("Could not read state configuration; specifications may not read environment variables")
+			config.Environment = state.EnvironmentConfiguration{Deny: []string{"*"}}
+		}
+		components.EnvironmentPolicy = config.Environment
+	}
+	shnorkyCommand.PersistentPostRun = func(cmd *cobra.Command, args []string) {
+		err := tracing.Flush()
+		if err != nil {
+			log.WithField("error", err).Warn("Could not export trace spans")
+		}
+		if ephemeral {
+			os.RemoveAll(stateDir)
+		}
+	}
+	shnorkyCommand.PersistentFlags().IntVar(&components.DefaultDockerRetryPolicy.Attempts, "docker-retries", components.DefaultDockerRetryPolicy.Attempts, "Maximum number of attempts at each docker API call which fails with a transient error (flows may override this with docker_retries)")
+	shnorkyCommand.PersistentFlags().DurationVar(&components.DefaultDockerRetryPolicy.Interval, "docker-retry-interval", components.DefaultDockerRetryPolicy.Interval, "Time to wait before retrying a docker API call which failed with a transient error (doubles with each retry)")
 
 	// shnorky version
 	versionCommand := &cobra.Command{
 		Use:   "version",
 		Short: "shnorky version number",
 		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Println(Version)
+			fmt.Fprintln(stdout, Version)
 		},
 	}
 
@@ -93,11 +186,38 @@ If you are using bash and want command completion for the shnorky CLI, run (ommi
 				logger.WithField("error", err).Fatal("Initialization failed")
 			}
 			logger.Info("Done")
-			fmt.Println(stateDir)
+			fmt.Fprintln(stdout, stateDir)
+		},
+	}
+
+	migrateCommand := &cobra.Command{
+		Use:   "migrate",
+		Short: "Brings the schema of a shnorky state database up to date",
+		Long: `Brings the schema of a shnorky state database up to date
+
+State directories created by older versions of shn may be missing tables, columns, or indices, or
+may store timestamps as text. This command makes the changes necessary to use such a state directory
+with this version of shn, and prints a description of each of them. If any change fails, the state
+database is left as it was.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+
+			changes, err := state.Migrate(db)
+			if err != nil {
+				log.WithField("error", err).Fatal("Migration failed")
+			}
+			if len(changes) == 0 {
+				fmt.Fprintln(stdout, "State database is up to date")
+			}
+			for _, change := range changes {
+				fmt.Fprintln(stdout, change)
+			}
 		},
 	}
 
-	stateCommand.AddCommand(initCommand)
+	stateCommand.AddCommand(initCommand, migrateCommand)
 
 	// shnorky components
 	componentsCommand := &cobra.Command{
@@ -111,10 +231,17 @@ unwanted components from your shnorky state, and build and execute components).
 `,
 	}
 
+	var gitURL, gitRef string
 	createComponentCommand := &cobra.Command{
 		Use:   "create",
 		Short: "Add a component to shnorky",
-		Long:  "Adds a new component to shnorky and makes it available in the state database",
+		Long: `Adds a new component to shnorky and makes it available in the state database
+
+With --git, the component is registered from a git repository: the repository is cloned into (or
+updated in) the state directory, the given --ref is checked out, and --path (or --component) and
+--spec are taken to be relative to the root of the repository. The URL, ref, and commit are recorded
+as the source of the component so that it can later be updated with "shn components refresh".
+`,
 		Run: func(cmd *cobra.Command, args []string) {
 			logger := log.WithFields(
 				logrus.Fields{
@@ -129,9 +256,35 @@ unwanted components from your shnorky state, and build and execute components).
 			logger.Debug("Opening state database")
 			db := internal.OpenStateDB(stateDir, log)
 			defer db.Close()
+			store := state.NewSQLiteStore(db)
 
-			logger.Debug("Adding component to state database")
-			component, err := components.AddComponent(db, id, componentType, componentPath, specificationPath)
+			labels, err := components.ParseLabels(rawLabels)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Invalid labels")
+			}
+
+			var component components.ComponentMetadata
+			auditArgs := map[string]string{"id": id, "type": componentType, "component": componentPath, "spec": specificationPath, "labels": components.FormatLabels(labels)}
+			if gitURL != "" {
+				logger.Debug("Adding component from git repository to state database")
+				component, err = components.AddGitComponent(context.Background(), store, path.Join(stateDir, state.GitDirName), id, componentType, gitURL, gitRef, componentPath, specificationPath)
+				if component.ID != "" {
+					auditArgs["id"] = component.ID
+				}
+				auditArgs["git"] = gitURL
+				auditArgs["ref"] = gitRef
+				if component.Source != nil {
+					auditArgs["commit"] = component.Source.Commit
+				}
+			} else {
+				logger.Debug("Adding component to state database")
+				component, err = components.AddComponent(store, id, componentType, componentPath, specificationPath)
+			}
+			if err == nil && len(labels) > 0 {
+				err = components.SetLabels(store, components.LabelledComponent, component.ID, labels)
+				component.Labels = labels
+			}
+			internal.RecordAudit(store, log, audit.ActionComponentCreate, auditArgs, err)
 			if err != nil {
 				logger.WithField("error", err).Fatal("Failed to add component")
 			}
@@ -141,12 +294,13 @@ unwanted components from your shnorky state, and build and execute components).
 			if err != nil {
 				logger.Fatal("Failed to marshall added component")
 			}
-			fmt.Println(string(marshalledComponent))
+			fmt.Fprintln(stdout, string(marshalledComponent))
 		},
 	}
 
 	createComponentCommand.Flags().StringVarP(&id, "id", "i", "", "ID for the component being added")
 
+	var idPrefix string
 	componentTypesHelp := fmt.Sprintf("Type of component being added (one of: %s)", strings.Join([]string{components.Service, components.Task}, ","))
 	createComponentCommand.Flags().StringVarP(&componentType, "type", "t", "", componentTypesHelp)
 
@@ -154,6 +308,82 @@ unwanted components from your shnorky state, and build and execute components).
 
 	createComponentCommand.Flags().StringVarP(&specificationPath, "spec", "s", "", "Path to component specification")
 
+	createComponentCommand.Flags().StringArrayVarP(&rawLabels, "label", "l", []string{}, "Label (key=value) to attach to the component (may be given several times)")
+
+	createComponentCommand.Flags().StringVar(&gitURL, "git", "", "URL of a git repository to register the component from (--component and --spec are then paths inside the repository)")
+	createComponentCommand.Flags().StringVar(&gitRef, "ref", "", "Tag, branch, or commit of the git repository to register the component from (defaults to the default branch)")
+	createComponentCommand.Flags().StringVar(&componentPath, "path", "", "Subdirectory of the git repository in which the component is defined (alias for --component)")
+
+	var dryRun bool
+	discoverComponentsCommand := &cobra.Command{
+		Use:   "discover <root>",
+		Short: "Find and register all the components under a directory",
+		Long: `Find and register all the components under a directory
+
+Walks the directory tree under the given root (skipping hidden directories) and registers every
+directory containing a component.json specification as a component. The ID of each component is the
+name of its directory (with an optional prefix). Components which are already registered with the
+same directory are left alone, while IDs which are registered with a different directory or which
+are inferred for several directories are reported as conflicts and skipped. With --dry-run, the
+components are listed without being registered. Exits with a non-zero code if any component could
+not be registered.
+`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithField("root", args[0])
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			labels, err := components.ParseLabels(rawLabels)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Invalid labels")
+			}
+			if !components.ComponentTypes[componentType] {
+				logger.WithField("componentType", componentType).Fatal("Invalid component type")
+			}
+
+			discovered, err := components.DiscoverComponents(store, args[0], idPrefix)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not discover components")
+			}
+
+			if !dryRun {
+				discovered = components.RegisterDiscoveredComponents(store, discovered, componentType, labels, func(component components.DiscoveredComponent, err error) {
+					internal.RecordAudit(store, log, audit.ActionComponentCreate, map[string]string{"id": component.ID, "type": componentType, "component": component.ComponentPath, "spec": component.SpecificationPath, "labels": components.FormatLabels(labels)}, err)
+				})
+			}
+
+			if outputJSON {
+				enc := json.NewEncoder(stdout)
+				for _, component := range discovered {
+					err = enc.Encode(component)
+					if err != nil {
+						logger.WithField("component", component.ID).WithField("error", err).Error("Error marshalling component")
+					}
+				}
+			} else {
+				err = components.WriteDiscoveryTable(stdout, discovered)
+				if err != nil {
+					logger.WithField("error", err).Error("Could not write discovered components")
+				}
+			}
+
+			if components.DiscoveryHasProblems(discovered) {
+				db.Close()
+				os.Exit(internal.ExitCodeValidation)
+			}
+		},
+	}
+
+	discoverComponentsCommand.Flags().StringVarP(&componentType, "type", "t", components.Task, componentTypesHelp)
+	discoverComponentsCommand.Flags().StringVar(&idPrefix, "prefix", "", "Prefix for the IDs inferred from the names of component directories")
+	discoverComponentsCommand.Flags().StringArrayVarP(&rawLabels, "label", "l", []string{}, "Label (key=value) to attach to each registered component (may be given several times)")
+	discoverComponentsCommand.Flags().BoolVar(&dryRun, "dry-run", false, "List the components that would be registered without registering them")
+	discoverComponentsCommand.Flags().BoolVar(&outputJSON, "json", false, "Output the discovered components as JSON lines")
+
+	var createdAfter string
 	listComponentsCommand := &cobra.Command{
 		Use:   "list",
 		Short: "List all components registered against the state database",
@@ -163,12 +393,13 @@ unwanted components from your shnorky state, and build and execute components).
 			componentsChan := make(chan components.ComponentMetadata)
 			db := internal.OpenStateDB(stateDir, log)
 			defer db.Close()
+			store := state.NewSQLiteStore(db)
 
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
 				for {
-					enc := json.NewEncoder(os.Stdout)
+					enc := json.NewEncoder(stdout)
 					component, ok := <-componentsChan
 					if !ok {
 						return
@@ -180,7 +411,24 @@ unwanted components from your shnorky state, and build and execute components).
 				}
 			}()
 
-			err := components.ListComponents(db, componentsChan)
+			labels, err := components.ParseLabels(rawLabels)
+			if err != nil {
+				log.WithField("error", err).Fatal("Invalid labels")
+			}
+			filter := components.ComponentFilter{ComponentType: componentType, IDPrefix: idPrefix, IDPattern: id, Labels: labels}
+			if mine {
+				filter.CreatedBy = state.CurrentUser()
+			}
+			if createdAfter != "" {
+				filter.CreatedAfter, err = time.Parse(time.RFC3339, createdAfter)
+				if err != nil {
+					filter.CreatedAfter, err = time.ParseInLocation("2006-01-02", createdAfter, time.Local)
+				}
+				if err != nil {
+					log.Fatalf("Invalid --created-after (expected an RFC3339 timestamp or a date like 2006-01-02): %s", createdAfter)
+				}
+			}
+			err = components.ListComponents(context.Background(), store, componentsChan, filter, page)
 			if err != nil {
 				log.WithField("error", err).Fatal("Could not list components")
 			}
@@ -190,50 +438,104 @@ unwanted components from your shnorky state, and build and execute components).
 		},
 	}
 
+	listComponentsCommand.Flags().StringVarP(&id, "id", "i", "", "Only list components whose IDs match the given glob pattern (e.g. \"etl-*\")")
+	listComponentsCommand.Flags().BoolVar(&mine, "mine", false, "Only list components created by the current user")
+	listComponentsCommand.Flags().StringVarP(&componentType, "type", "t", "", fmt.Sprintf("Only list components of the given type (one of: %s)", strings.Join([]string{components.Service, components.Task}, ",")))
+	listComponentsCommand.Flags().StringVar(&createdAfter, "created-after", "", "Only list components created after the given time (an RFC3339 timestamp, e.g. 2020-01-01T00:00:00Z, or a date, e.g. 2020-01-01)")
+	listComponentsCommand.Flags().StringVar(&idPrefix, "id-prefix", "", "Only list components whose IDs start with the given prefix")
+	listComponentsCommand.Flags().StringArrayVarP(&rawLabels, "label", "l", []string{}, "Only list components with the given label (key=value; may be given several times)")
+	listComponentsCommand.Flags().IntVar(&page.Limit, "limit", 0, "Maximum number of components to list (0 lists all of them)")
+	listComponentsCommand.Flags().IntVar(&page.Offset, "offset", 0, "Number of components to skip (in the order in which they were created) before listing")
+
 	removeComponentCommand := &cobra.Command{
 		Use:   "remove",
 		Short: "Remove a component from shnorky",
-		Long:  "Removes a component registered against shnorky from the state database",
+		Long:  "Removes a component (or, given a glob pattern, every matching component) registered against shnorky from the state database",
 		Run: func(cmd *cobra.Command, args []string) {
 			db := internal.OpenStateDB(stateDir, log)
 			defer db.Close()
-			err := components.RemoveComponent(db, id)
-			if err != nil {
-				log.WithField("error", err).Errorf("Error removing component: %s", err.Error())
+			store := state.NewSQLiteStore(db)
+			for _, componentID := range internal.ResolveComponentIDs(store, log, id, "Remove", assumeYes, os.Stdin, os.Stderr) {
+				err := components.RemoveComponent(store, componentID)
+				internal.RecordAudit(store, log, audit.ActionComponentRemove, map[string]string{"id": componentID}, err)
+				if err != nil {
+					log.WithField("error", err).Errorf("Error removing component: %s", err.Error())
+				}
+				fmt.Fprintln(stdout, componentID)
 			}
-			fmt.Println(id)
 			log.Info("RemoveComponent done")
 		},
 	}
 
-	removeComponentCommand.Flags().StringVarP(&id, "id", "i", "", "ID for the component being removed")
+	removeComponentCommand.Flags().StringVarP(&id, "id", "i", "", "ID for the component being removed (may be a glob pattern, e.g. \"etl-*\", to remove several components)")
+	removeComponentCommand.Flags().BoolVarP(&assumeYes, "yes", "y", false, "Do not ask for confirmation when removing components matching a pattern")
+
+	specComponentCommand := &cobra.Command{
+		Use:   "spec",
+		Short: "Print the registered specification of a component",
+		Long:  "Prints the specification of a component as it was when the component was registered, even if the specification file has since been edited or deleted",
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithField("id", id)
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			component, err := components.SelectComponentByID(store, id)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not find component")
+			}
+			if component.SpecificationSnapshot == "" {
+				logger.Fatal("No snapshot of the specification was stored when the component was registered")
+			}
+			fmt.Fprint(stdout, component.SpecificationSnapshot)
+		},
+	}
+
+	specComponentCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the component")
 
 	createBuildCommand := &cobra.Command{
 		Use:   "build",
 		Short: "Create a build for a specific component",
-		Long:  "Creates an image for the specified component using its current state on the filesystem",
+		Long:  "Creates an image for the specified component (or, given a glob pattern, for every matching component) using its current state on the filesystem",
 		Run: func(cmd *cobra.Command, args []string) {
 			db := internal.OpenStateDB(stateDir, log)
 			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			componentIDs := internal.ResolveComponentIDs(store, log, id, "Build", assumeYes, os.Stdin, os.Stderr)
 
 			dockerClient := internal.GenerateDockerClient(log)
 
 			ctx := context.Background()
 
-			buildMetadata, err := components.CreateBuild(ctx, db, dockerClient, os.Stdout, id)
-			if err != nil {
-				log.WithField("error", err).Fatal("Could not create build")
+			exitCode := 0
+			for _, componentID := range componentIDs {
+				buildMetadata, err := components.CreateBuild(ctx, store, dockerClient, stdout, path.Join(stateDir, state.BuildLogsDirName), componentID, buildOptions)
+				internal.RecordAudit(store, log, audit.ActionComponentBuild, map[string]string{"id": componentID, "build": buildMetadata.ID}, err)
+				if err != nil {
+					log.WithFields(logrus.Fields{"error": err, "component": componentID, "build": buildMetadata.ID}).Error("Could not create build")
+					exitCode = internal.ExitCode(err)
+					continue
+				}
+				fmt.Fprintln(stdout, "Build succeeded:", buildMetadata.ID)
+			}
+			if exitCode != 0 {
+				os.Exit(exitCode)
 			}
-			fmt.Println("Build succeeded:", buildMetadata.ID)
 		},
 	}
 
-	createBuildCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the component for which build is being created")
+	createBuildCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the component for which build is being created (may be a glob pattern, e.g. \"etl-*\", to build several components)")
+	createBuildCommand.Flags().BoolVarP(&assumeYes, "yes", "y", false, "Do not ask for confirmation when building components matching a pattern")
+	createBuildCommand.Flags().BoolVar(&buildOptions.NoCache, "no-cache", false, "Do not use the build cache (every step of each Dockerfile is run afresh)")
+	createBuildCommand.Flags().BoolVar(&buildOptions.Pull, "pull", false, "Pull newer versions of the base images of each Dockerfile")
+	createBuildCommand.Flags().StringVar(&buildOptions.Target, "target", "", "Stage of each (multi-stage) Dockerfile to build")
 
 	listBuildsCommand := &cobra.Command{
 		Use:   "list-builds",
 		Short: "List builds registered against the state database",
-		Long:  "Lists builds that have previously been added to the state database (allows listing by component ID)",
+		Long:  "Lists builds that have previously been added to the state database (allows listing by component ID), warning about components whose source has changed since their latest build",
 		Run: func(cmd *cobra.Command, args []string) {
 			logger := log.WithField("component", id)
 
@@ -241,16 +543,23 @@ unwanted components from your shnorky state, and build and execute components).
 			buildsChan := make(chan components.BuildMetadata)
 			db := internal.OpenStateDB(stateDir, log)
 			defer db.Close()
+			store := state.NewSQLiteStore(db)
 
+			builtComponents := []string{}
 			wg.Add(1)
 			go func() {
 				defer wg.Done()
+				seen := map[string]bool{}
 				for {
-					enc := json.NewEncoder(os.Stdout)
+					enc := json.NewEncoder(stdout)
 					build, ok := <-buildsChan
 					if !ok {
 						return
 					}
+					if !seen[build.ComponentID] {
+						seen[build.ComponentID] = true
+						builtComponents = append(builtComponents, build.ComponentID)
+					}
 					err := enc.Encode(build)
 					if err != nil {
 						logger.WithField("build", build).WithField("error", err).Error("Error marshalling build")
@@ -258,17 +567,52 @@ unwanted components from your shnorky state, and build and execute components).
 				}
 			}()
 
-			err := components.ListBuilds(db, buildsChan, id)
+			createdBy := ""
+			if mine {
+				createdBy = state.CurrentUser()
+			}
+			err := components.ListBuilds(context.Background(), store, buildsChan, id, createdBy, page)
 			if err != nil {
 				logger.WithField("error", err).Fatal("Could not list builds")
 			}
 			wg.Wait()
 
+			staleComponents, err := components.StaleComponents(store, builtComponents)
+			if err != nil {
+				logger.WithField("error", err).Warn("Could not check for stale builds")
+			}
+			for _, componentID := range staleComponents {
+				logger.WithField("component", componentID).Warn("Component source has changed since its latest build")
+			}
+
 			logger.Info("ListBuilds done")
 		},
 	}
 
-	listBuildsCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the component for which builds are being listed (optional; if not set, lists all builds)")
+	listBuildsCommand.Flags().StringVarP(&id, "id", "i", "", "ID (or glob pattern matching the IDs) of the components for which builds are being listed (optional; if not set, lists all builds)")
+	listBuildsCommand.Flags().BoolVar(&mine, "mine", false, "Only list builds created by the current user")
+	listBuildsCommand.Flags().IntVar(&page.Limit, "limit", 0, "Maximum number of builds to list (0 lists all of them)")
+	listBuildsCommand.Flags().IntVar(&page.Offset, "offset", 0, "Number of builds to skip (in the order in which they were created) before listing")
+
+	buildLogsCommand := &cobra.Command{
+		Use:   "build-logs",
+		Short: "Show the output of a build",
+		Long:  "Prints the docker build output which was stored for the given build (whether or not the build succeeded)",
+		Run: func(cmd *cobra.Command, args []string) {
+			buildLog, err := components.OpenBuildLog(path.Join(stateDir, state.BuildLogsDirName), id)
+			if err != nil {
+				log.WithField("error", err).Fatalf("Could not open log for build (%s)", id)
+			}
+			defer buildLog.Close()
+
+			_, err = io.Copy(stdout, buildLog)
+			if err != nil {
+				log.WithField("error", err).Fatal("Error reading build log")
+			}
+		},
+	}
+
+	buildLogsCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the build whose output should be shown")
 
 	createExecutionCommand := &cobra.Command{
 		Use:   "execute",
@@ -277,8 +621,10 @@ unwanted components from your shnorky state, and build and execute components).
 		Run: func(cmd *cobra.Command, args []string) {
 			db := internal.OpenStateDB(stateDir, log)
 			defer db.Close()
+			store := state.NewSQLiteStore(db)
 
 			dockerClient := internal.GenerateDockerClient(log)
+			internal.ReconcileExecutions(store, dockerClient, log)
 
 			ctx := context.Background()
 
@@ -287,25 +633,194 @@ unwanted components from your shnorky state, and build and execute components).
 				log.WithField("error", err).Fatal("Error reading mount configuration")
 			}
 
-			executionMetadata, err := components.Execute(ctx, db, dockerClient, id, "", mounts, map[string]string{})
+			var stdin io.Reader
+			if attachStdin {
+				stdin = os.Stdin
+			}
+
+			executionMetadata, err := components.ExecuteWithOptions(ctx, store, dockerClient, components.WithBuild(id), components.WithMounts(mounts...), components.WithWorkdir(workdir), components.WithStdin(stdin))
+			internal.RecordAudit(store, log, audit.ActionComponentRun, map[string]string{"build": id, "mounts": mountConfig, "workdir": workdir, "execution": executionMetadata.ID}, err)
 			if err != nil {
 				log.WithField("error", err).Fatal("Could not execute build")
 			}
 
-			fmt.Println(executionMetadata.ID)
+			fmt.Fprintln(stdout, executionMetadata.ID)
 		},
 	}
 
 	createExecutionCommand.Flags().StringVarP(&id, "build", "b", "", "ID of the build being executed")
 	createExecutionCommand.Flags().StringVarP(&mountConfig, "mounts", "m", "", "JSON string specifying mount configuration for execution")
+	createExecutionCommand.Flags().StringVarP(&workdir, "workdir", "w", "", "Working directory for the execution container (overrides the component specification)")
+	createExecutionCommand.Flags().BoolVar(&attachStdin, "stdin", false, "Pipe the standard input of this command into the execution container")
+
+	listArtifactsCommand := &cobra.Command{
+		Use:   "list-artifacts",
+		Short: "List artifacts registered against the state database",
+		Long:  "Lists artifacts that executions have stored in the artifact store (allows listing by execution ID)",
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithField("execution", id)
+
+			var wg sync.WaitGroup
+			artifactsChan := make(chan components.ArtifactMetadata)
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for {
+					enc := json.NewEncoder(stdout)
+					artifact, ok := <-artifactsChan
+					if !ok {
+						return
+					}
+					err := enc.Encode(artifact)
+					if err != nil {
+						logger.WithField("artifact", artifact).WithField("error", err).Error("Error marshalling artifact")
+					}
+				}
+			}()
+
+			err := components.ListArtifacts(context.Background(), store, artifactsChan, id)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not list artifacts")
+			}
+			wg.Wait()
+
+			logger.Info("ListArtifacts done")
+		},
+	}
+
+	listArtifactsCommand.Flags().StringVarP(&id, "execution", "e", "", "ID of the execution for which artifacts are being listed (optional; if not set, lists all artifacts)")
+
+	runComponentCommand := &cobra.Command{
+		Use:   "run",
+		Short: "Build and execute a component in one step",
+		Long: `Build and execute a component in one step
+
+Registers the component with the given specification (unless it is already registered), builds it
+if it has not been built since it was last modified, executes the build, and waits for the
+execution to finish, streaming the output of the build and of the execution. The component is
+registered under the name of its directory unless --id is given, and its directory defaults to the
+directory containing the specification. Combine with --ephemeral to leave no trace in the state
+directory. Exits with the exit code of the execution container.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if componentPath == "" {
+				componentPath = path.Dir(specificationPath)
+			}
+			if id == "" {
+				absoluteComponentPath, err := filepath.Abs(componentPath)
+				if err != nil {
+					log.WithField("error", err).Fatal("Could not resolve component directory")
+				}
+				id = filepath.Base(absoluteComponentPath)
+			}
+			logger := log.WithFields(logrus.Fields{"id": id, "component": componentPath, "spec": specificationPath})
+
+			mounts, err := components.ReadMountConfiguration(strings.NewReader(mountConfig))
+			if err != nil {
+				logger.WithField("error", err).Fatal("Error reading mount configuration")
+			}
+
+			var stdin io.Reader
+			if attachStdin {
+				stdin = os.Stdin
+			}
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			dockerClient := internal.GenerateDockerClient(log)
+			internal.ReconcileExecutions(store, dockerClient, log)
+
+			ctx := context.Background()
+
+			executionMetadata, err := components.Run(ctx, store, dockerClient, stdout, path.Join(stateDir, state.BuildLogsDirName), id, componentType, componentPath, specificationPath, mounts, workdir, stdin)
+			internal.RecordAudit(store, log, audit.ActionComponentRun, map[string]string{"id": id, "spec": specificationPath, "mounts": mountConfig, "workdir": workdir, "execution": executionMetadata.ID}, err)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not run component")
+			}
+
+			marshalledExecution, err := json.Marshal(executionMetadata)
+			if err != nil {
+				logger.Fatal("Failed to marshall execution")
+			}
+			fmt.Fprintln(stdout, string(marshalledExecution))
+
+			if executionMetadata.ExitCode != nil && *executionMetadata.ExitCode != 0 {
+				db.Close()
+				os.Exit(internal.ExitCodeStepFailure)
+			}
+		},
+	}
+
+	runComponentCommand.Flags().StringVarP(&specificationPath, "spec", "s", "", "Path to component specification")
+	runComponentCommand.Flags().StringVarP(&componentPath, "component", "c", "", "Directory in which the component is defined (defaults to the directory containing the specification)")
+	runComponentCommand.Flags().StringVarP(&id, "id", "i", "", "ID under which to register the component (defaults to the name of its directory)")
+	runComponentCommand.Flags().StringVarP(&componentType, "type", "t", components.Task, componentTypesHelp)
+	runComponentCommand.Flags().StringVarP(&mountConfig, "mounts", "m", "", "JSON string specifying mount configuration for execution")
+	runComponentCommand.Flags().StringVarP(&workdir, "workdir", "w", "", "Working directory for the execution container (overrides the component specification)")
+	runComponentCommand.Flags().BoolVar(&attachStdin, "stdin", false, "Pipe the standard input of this command into the execution container")
+	runComponentCommand.MarkFlagRequired("spec")
+
+	listBuiltinComponentsCommand := &cobra.Command{
+		Use:   "builtins",
+		Short: "List the built-in components that ship with shnorky",
+		Long:  "Lists the built-in components which can be used in flows without being registered - they are built on demand",
+		Run: func(cmd *cobra.Command, args []string) {
+			for _, componentID := range components.BuiltinComponentIDs() {
+				description, _ := components.BuiltinComponentDescription(componentID)
+				fmt.Fprintf(stdout, "%s\t%s\n", componentID, description)
+			}
+		},
+	}
+
+	refreshComponentCommand := &cobra.Command{
+		Use:   "refresh",
+		Short: "Update a component registered from a git repository",
+		Long:  "Fetches the ref that a component was registered from (with \"shn components create --git\") again and points the component at the commit it now resolves to",
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			component, err := components.RefreshGitComponent(context.Background(), store, path.Join(stateDir, state.GitDirName), id)
+			auditArgs := map[string]string{"id": id}
+			if component.Source != nil {
+				auditArgs["commit"] = component.Source.Commit
+			}
+			internal.RecordAudit(store, log, audit.ActionComponentRefresh, auditArgs, err)
+			if err != nil {
+				log.WithField("error", err).Fatal("Failed to refresh component")
+			}
+
+			marshalledComponent, err := json.Marshal(component)
+			if err != nil {
+				log.Fatal("Failed to marshall refreshed component")
+			}
+			fmt.Fprintln(stdout, string(marshalledComponent))
+		},
+	}
+
+	refreshComponentCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the component to refresh")
 
 	componentsCommand.AddCommand(
 		createComponentCommand,
+		discoverComponentsCommand,
+		refreshComponentCommand,
 		listComponentsCommand,
+		listBuiltinComponentsCommand,
 		removeComponentCommand,
+		specComponentCommand,
 		createBuildCommand,
 		listBuildsCommand,
+		buildLogsCommand,
 		createExecutionCommand,
+		runComponentCommand,
+		listArtifactsCommand,
 	)
 
 	// shnorky flows
@@ -336,19 +851,37 @@ and build and execute flows).
 			logger.Debug("Opening state database")
 			db := internal.OpenStateDB(stateDir, log)
 			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			labels, err := components.ParseLabels(rawLabels)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Invalid labels")
+			}
 
 			logger.Debug("Adding component to state database")
-			flow, err := flows.AddFlow(db, id, specificationPath)
+			flow, err := flows.AddFlow(store, id, specificationPath)
+			if err == nil && len(labels) > 0 {
+				err = components.SetLabels(store, components.LabelledFlow, flow.ID, labels)
+				flow.Labels = labels
+			}
+			internal.RecordAudit(store, log, audit.ActionFlowCreate, map[string]string{"id": id, "spec": specificationPath, "labels": components.FormatLabels(labels)}, err)
 			if err != nil {
 				logger.WithField("error", err).Fatal("Failed to add flow")
 			}
 			logger.Info("Flow added successfully")
 
+			specification, err := flows.ReadFlowSpecification(store, flow.ID)
+			if err == nil {
+				for _, warning := range specification.Warnings {
+					logger.Warn(warning)
+				}
+			}
+
 			marshalledFlow, err := json.Marshal(flow)
 			if err != nil {
 				logger.Fatal("Failed to marshall added flow")
 			}
-			fmt.Println(string(marshalledFlow))
+			fmt.Fprintln(stdout, string(marshalledFlow))
 		},
 	}
 
@@ -356,6 +889,8 @@ and build and execute flows).
 
 	createFlowCommand.Flags().StringVarP(&specificationPath, "spec", "s", "", "Path to flow specification")
 
+	createFlowCommand.Flags().StringArrayVarP(&rawLabels, "label", "l", []string{}, "Label (key=value) to attach to the flow (may be given several times)")
+
 	buildFlowCommand := &cobra.Command{
 		Use:   "build",
 		Short: "Build all components in a flow",
@@ -363,55 +898,1658 @@ and build and execute flows).
 		Run: func(cmd *cobra.Command, args []string) {
 			db := internal.OpenStateDB(stateDir, log)
 			defer db.Close()
+			store := state.NewSQLiteStore(db)
 
 			dockerClient := internal.GenerateDockerClient(log)
 
 			ctx := context.Background()
 
-			buildsMetadata, err := flows.Build(ctx, db, dockerClient, os.Stdout, id)
+			buildsMetadata, err := flows.Build(ctx, store, dockerClient, stdout, stateDir, id, buildOptions)
+			internal.RecordAudit(store, log, audit.ActionFlowBuild, map[string]string{"id": id}, err)
 			if err != nil {
 				log.WithField("error", err).Fatal("Could not build components")
 			}
 
-			fmt.Println("Builds:")
+			fmt.Fprintln(stdout, "Builds:")
 			for component, buildMetadata := range buildsMetadata {
-				fmt.Printf("  - %s: %s\n", component, buildMetadata.ID)
+				fmt.Fprintf(stdout, "  - %s: %s\n", component, buildMetadata.ID)
 			}
 		},
 	}
 
 	buildFlowCommand.Flags().StringVarP(&id, "id", "i", "", "ID for the flow to build")
+	buildFlowCommand.Flags().BoolVar(&buildOptions.NoCache, "no-cache", false, "Do not use the build cache (every step of each Dockerfile is run afresh)")
+	buildFlowCommand.Flags().BoolVar(&buildOptions.Pull, "pull", false, "Pull newer versions of the base images of each Dockerfile")
+	buildFlowCommand.Flags().StringVar(&buildOptions.Target, "target", "", "Stage of each (multi-stage) Dockerfile to build")
 
+	var priority, parallelism int
+	var matrixPath string
+	var autoBuild, wait bool
 	executeFlowCommand := &cobra.Command{
 		Use:   "execute",
 		Short: "Execute a shnorky flow",
-		Long:  "Executes a shnorky flow",
+		Long: `Executes a shnorky flow
+
+With --matrix, executes one run of the flow for each combination of the values of the parameters in
+the given matrix file, which maps parameter names to lists of values (as JSON or YAML, for example
+"region: [us, eu]"). Each run receives its parameters as environment variables in the containers of
+its steps, and as "{{<parameter>}}" placeholders in its mounts, inputs, and outputs. A summary of
+the combinations which succeeded is printed once all the runs have finished, and the command exits
+with a non-zero code if any of them failed.
+
+Each flow allows only max_concurrent_runs (by default 1) unfinished runs at a time. If it already
+has that many, the command fails - with --wait, it waits for one of them to finish instead. Matrix
+runs always wait.
+
+Before executing, warns about components of the flow whose source has changed since their latest
+build (so that the run would use outdated images). With --auto-build, such components are rebuilt
+instead.
+`,
 		Run: func(cmd *cobra.Command, args []string) {
 			db := internal.OpenStateDB(stateDir, log)
 			defer db.Close()
+			store := state.NewSQLiteStore(db)
 
 			dockerClient := internal.GenerateDockerClient(log)
+			internal.ReconcileExecutions(store, dockerClient, log)
+
+			// The first interrupt cancels the run (or runs), which stop their steps and are recorded as
+			// failed; a second interrupt exits immediately
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			interrupts := make(chan os.Signal, 1)
+			signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-interrupts
+				signal.Stop(interrupts)
+				log.Warn("Interrupted; cancelling flow execution (interrupt again to exit immediately)")
+				cancel()
+			}()
+			if wait {
+				ctx = flows.WithQuotaWait(ctx)
+			}
 
-			ctx := context.Background()
+			if autoBuild {
+				builds, err := flows.BuildStaleComponents(ctx, store, dockerClient, stdout, stateDir, id)
+				for componentID, build := range builds {
+					internal.RecordAudit(store, log, audit.ActionComponentBuild, map[string]string{"id": componentID, "build": build.ID}, nil)
+				}
+				if err != nil {
+					log.WithField("error", err).Fatal("Could not rebuild stale components")
+				}
+			} else {
+				staleComponents, err := flows.StaleComponents(store, id)
+				if err != nil {
+					log.WithField("error", err).Warn("Could not check for stale builds")
+				}
+				for _, componentID := range staleComponents {
+					log.WithField("component", componentID).Warn("Component source has changed since its latest build; executing the outdated build (use --auto-build to rebuild it)")
+				}
+			}
+
+			if matrixPath != "" {
+				logger := log.WithFields(logrus.Fields{"id": id, "matrix": matrixPath})
+				matrixFile, err := os.Open(matrixPath)
+				if err != nil {
+					logger.WithField("error", err).Fatal("Could not open matrix file")
+				}
+				matrix, err := flows.ReadMatrix(matrixFile)
+				matrixFile.Close()
+				if err != nil {
+					logger.WithField("error", err).Fatal("Could not read matrix file")
+				}
+
+				results := flows.ExecuteMatrix(ctx, store, dockerClient, stdout, stateDir, id, matrix, parallelism, priority)
+				failed := false
+				for _, result := range results {
+					var runErr error
+					if result.Error != "" {
+						runErr = errors.New(result.Error)
+					}
+					internal.RecordAudit(store, log, audit.ActionFlowRun, map[string]string{"id": id, "run": result.RunID, "priority": strconv.Itoa(priority), "matrix": matrixPath}, runErr)
+					failed = failed || !result.Succeeded
+				}
+
+				if outputJSON {
+					marshalledResults, err := json.Marshal(results)
+					if err != nil {
+						logger.Fatal("Failed to marshall matrix results")
+					}
+					fmt.Fprintln(stdout, string(marshalledResults))
+				} else {
+					err = flows.WriteMatrixSummaryTable(stdout, results)
+					if err != nil {
+						logger.WithField("error", err).Fatal("Could not write matrix summary")
+					}
+				}
+
+				if failed {
+					db.Close()
+					os.Exit(internal.ExitCodeFailure)
+				}
+				return
+			}
 
-			executions, err := flows.Execute(ctx, db, dockerClient, id)
+			run, err := flows.GenerateFlowRunMetadata(id)
 			if err != nil {
-				log.WithField("error", err).Fatal("Could not execute flow")
+				log.WithField("error", err).Fatal("Could not generate flow run metadata")
 			}
+			run.Priority = priority
 
-			fmt.Println(executions)
+			run, executions, err := flows.ExecuteRun(ctx, store, dockerClient, stdout, stateDir, run)
+			internal.RecordAudit(store, log, audit.ActionFlowRun, map[string]string{"id": id, "run": run.ID, "priority": strconv.Itoa(run.Priority)}, err)
+			if err != nil {
+				log.WithFields(logrus.Fields{"error": err, "run": run.ID}).Fatal("Could not execute flow")
+			}
+
+			fmt.Fprintln(stdout, "Run:", run.ID)
+			fmt.Fprintln(stdout, executions)
 		},
 	}
 
 	executeFlowCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the flow being executed")
+	executeFlowCommand.Flags().IntVarP(&priority, "priority", "p", 0, "Priority of the run if it is queued (higher priorities start first; 0 uses the priority in the flow specification)")
+	executeFlowCommand.Flags().StringVarP(&matrixPath, "matrix", "x", "", "Path to a parameter matrix; executes one run for each combination of parameters")
+	executeFlowCommand.Flags().IntVar(&parallelism, "parallelism", 1, "Maximum number of matrix runs to execute at a time (0 executes all of them at once)")
+	executeFlowCommand.Flags().BoolVar(&outputJSON, "json", false, "Output the summary of a matrix execution as JSON instead of a table")
+	executeFlowCommand.Flags().BoolVar(&autoBuild, "auto-build", false, "Rebuild the components of the flow whose source has changed since their latest build before executing it")
+	executeFlowCommand.Flags().BoolVar(&wait, "wait", false, "If the flow already has as many unfinished runs as it allows (max_concurrent_runs), wait for one of them to finish instead of failing")
+
+	submitFlowCommand := &cobra.Command{
+		Use:   "submit",
+		Short: "Submit a shnorky flow for execution in the background",
+		Long: `Submit a shnorky flow for execution in the background
+
+Records a run of the flow and returns immediately, without waiting for the run to start. Submitted
+runs are executed by the workers of "shn serve" in queue order (see "shn queue list"). Once a
+submitted run has finished, summarize it with "shn flows report".
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			run, err := flows.Submit(store, id, priority)
+			internal.RecordAudit(store, log, audit.ActionFlowSubmit, map[string]string{"id": id, "run": run.ID, "priority": strconv.Itoa(run.Priority)}, err)
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not submit flow")
+			}
+
+			fmt.Fprintln(stdout, "Run:", run.ID)
+		},
+	}
+
+	submitFlowCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the flow being submitted")
+	submitFlowCommand.Flags().IntVarP(&priority, "priority", "p", 0, "Priority of the run (higher priorities start first; 0 uses the priority in the flow specification)")
+
+	var criticalPath bool
+	reportFlowCommand := &cobra.Command{
+		Use:   "report",
+		Short: "Summarize a flow run",
+		Long: `Summarize a flow run
+
+Shows the duration, exit code, and resource usage of each step in a flow run, along with totals for
+the run. Steps which were retried are shown once, with the number of retries, and their durations
+and resource usage cover every attempt. The BUILD column shows whether the image that each step ran
+was "cached" (built before the run started) or "built" for the run. With --critical-path, also
+shows the chain of dependent steps which determined the wall-clock duration of the run, and the
+share of that duration taken up by each of them.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithField("run", id)
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			report, err := flows.GenerateRunReport(store, id)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not generate report for flow run")
+			}
+			if criticalPath {
+				err = flows.AnalyzeCriticalPath(store, &report)
+				if err != nil {
+					logger.WithField("error", err).Fatal("Could not calculate critical path of flow run")
+				}
+			}
+
+			if outputJSON {
+				marshalledReport, err := json.Marshal(report)
+				if err != nil {
+					logger.Fatal("Failed to marshall report")
+				}
+				fmt.Fprintln(stdout, string(marshalledReport))
+				return
+			}
+
+			err = flows.WriteRunReportTable(stdout, report)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not write report")
+			}
+		},
+	}
+
+	reportFlowCommand.Flags().StringVarP(&id, "run", "r", "", "ID of the flow run being summarized")
+	reportFlowCommand.Flags().BoolVar(&outputJSON, "json", false, "Output the report as JSON instead of a table")
+	reportFlowCommand.Flags().BoolVar(&criticalPath, "critical-path", false, "Also show the critical path of the run")
+
+	diffRunsCommand := &cobra.Command{
+		Use:   "diff-runs <run-a> <run-b>",
+		Short: "Compare two flow runs",
+		Long: `Compare two flow runs
+
+Shows, for each step of the two flow runs, how much longer (or shorter) it took in the second run
+than in the first, and whether its exit code, image, environment variables, or mounts differed
+between the runs. Values of environment variables are not shown, only which of them changed.
+`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithFields(logrus.Fields{"runA": args[0], "runB": args[1]})
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			comparison, err := flows.CompareRuns(store, args[0], args[1])
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not compare flow runs")
+			}
+
+			if outputJSON {
+				marshalledComparison, err := json.Marshal(comparison)
+				if err != nil {
+					logger.Fatal("Failed to marshall comparison")
+				}
+				fmt.Fprintln(stdout, string(marshalledComparison))
+				return
+			}
+
+			err = flows.WriteRunComparison(stdout, comparison)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not write comparison")
+			}
+		},
+	}
+
+	diffRunsCommand.Flags().BoolVar(&outputJSON, "json", false, "Output the comparison as JSON instead of a table")
+
+	statsFlowCommand := &cobra.Command{
+		Use:   "stats",
+		Short: "Show historical step durations for a flow",
+		Long:  "Shows rolling duration statistics for each step of a flow, calculated from its most recent successful executions",
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithField("flow", id)
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			statistics, err := flows.StepDurationStatistics(store, id, window)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not calculate statistics for flow")
+			}
+
+			if outputJSON {
+				marshalledStatistics, err := json.Marshal(statistics)
+				if err != nil {
+					logger.Fatal("Failed to marshall statistics")
+				}
+				fmt.Fprintln(stdout, string(marshalledStatistics))
+				return
+			}
+
+			err = flows.WriteDurationStatisticsTable(stdout, statistics)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not write statistics")
+			}
+		},
+	}
+
+	statsFlowCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the flow")
+	statsFlowCommand.Flags().IntVarP(&window, "window", "n", flows.DefaultStatisticsWindow, "Number of most recent successful executions of each step to use")
+	statsFlowCommand.Flags().BoolVar(&outputJSON, "json", false, "Output the statistics as JSON instead of a table")
+
+	planFlowCommand := &cobra.Command{
+		Use:   "plan",
+		Short: "Show the stages of a flow with their estimated durations",
+		Long: `Show the stages of a flow with their estimated durations
+
+Prints the stages in which the steps of a flow are executed, annotated with the mean durations of
+their most recent successful executions, along with the critical path of the flow - the chain of
+dependent steps which takes the longest. Speeding up (or splitting) steps on the critical path is
+what shortens runs of the flow.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithField("flow", id)
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			plan, err := flows.PlanFlow(store, id, window)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not plan flow")
+			}
+
+			if outputJSON {
+				marshalledPlan, err := json.Marshal(plan)
+				if err != nil {
+					logger.Fatal("Failed to marshall plan")
+				}
+				fmt.Fprintln(stdout, string(marshalledPlan))
+				return
+			}
+
+			err = flows.WritePlan(stdout, plan)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not write plan")
+			}
+		},
+	}
+
+	planFlowCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the flow")
+	planFlowCommand.Flags().IntVarP(&window, "window", "n", flows.DefaultStatisticsWindow, "Number of most recent successful executions of each step to use")
+	planFlowCommand.Flags().BoolVar(&outputJSON, "json", false, "Output the plan as JSON instead of a table")
+
+	var iterations int
+	benchFlowCommand := &cobra.Command{
+		Use:   "bench",
+		Short: "Benchmark a flow",
+		Long: `Benchmark a flow
+
+Executes the flow the given number of times, one run after another, and reports the mean, minimum,
+median (p50), 95th percentile (p95), and maximum durations of each of its steps and of whole runs.
+Stops at the first run which fails, reporting statistics for the runs which completed.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithFields(logrus.Fields{"id": id, "iterations": iterations})
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			dockerClient := internal.GenerateDockerClient(log)
+			internal.ReconcileExecutions(store, dockerClient, log)
+
+			ctx := context.Background()
+
+			result, err := flows.Benchmark(ctx, store, dockerClient, os.Stderr, stateDir, id, iterations)
+			internal.RecordAudit(store, log, audit.ActionFlowRun, map[string]string{"id": id, "runs": strings.Join(result.RunIDs, ","), "iterations": strconv.Itoa(iterations)}, err)
+			if err != nil {
+				logger.WithField("error", err).Error("Benchmark did not complete")
+			}
+
+			if outputJSON {
+				marshalledResult, marshalErr := json.Marshal(result)
+				if marshalErr != nil {
+					logger.Fatal("Failed to marshall benchmark results")
+				}
+				fmt.Fprintln(stdout, string(marshalledResult))
+			} else {
+				writeErr := flows.WriteBenchmarkTable(stdout, result)
+				if writeErr != nil {
+					logger.WithField("error", writeErr).Fatal("Could not write benchmark results")
+				}
+			}
+
+			if err != nil {
+				db.Close()
+				os.Exit(internal.ExitCode(err))
+			}
+		},
+	}
+
+	benchFlowCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the flow to benchmark")
+	benchFlowCommand.Flags().IntVarP(&iterations, "iterations", "n", 10, "Number of runs to execute")
+	benchFlowCommand.Flags().BoolVar(&outputJSON, "json", false, "Output the results as JSON instead of a table")
+
+	var fixturesDir string
+	testFlowCommand := &cobra.Command{
+		Use:   "test",
+		Short: "Test a flow against golden outputs",
+		Long: `Test a flow against golden outputs
+
+Executes the flow against the fixture inputs in the fixtures directory and compares the outputs it
+produces against the golden outputs stored there. The fixtures directory contains:
+  inputs/<input>    - replaces the path of the flow input with the given name
+  expected/<output> - the golden file (or directory) for the flow output with the given name
+  test.json         - (optional) comparators for outputs and parameters for the run, e.g.:
+                      {"comparators": {"report": {"type": "numeric", "tolerance": 0.001}}}
+
+Comparators are "exact" (the default), "csv-unordered" (same header and rows in any order), and
+"numeric" (numbers may differ by up to the tolerance). Exits with a non-zero code unless every
+output matches its golden output.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithFields(logrus.Fields{"id": id, "fixtures": fixturesDir})
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			dockerClient := internal.GenerateDockerClient(log)
+			internal.ReconcileExecutions(store, dockerClient, log)
+
+			ctx := context.Background()
+
+			result, err := flows.RunGoldenTest(ctx, store, dockerClient, os.Stderr, stateDir, id, fixturesDir)
+			runErr := err
+			if runErr == nil && result.Error != "" {
+				runErr = errors.New(result.Error)
+			}
+			internal.RecordAudit(store, log, audit.ActionFlowRun, map[string]string{"id": id, "run": result.RunID, "fixtures": fixturesDir}, runErr)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not test flow")
+			}
+
+			if outputJSON {
+				marshalledResult, marshalErr := json.Marshal(result)
+				if marshalErr != nil {
+					logger.Fatal("Failed to marshall test results")
+				}
+				fmt.Fprintln(stdout, string(marshalledResult))
+			} else {
+				writeErr := flows.WriteGoldenTestTable(stdout, result)
+				if writeErr != nil {
+					logger.WithField("error", writeErr).Fatal("Could not write test results")
+				}
+			}
+
+			if !result.Passed {
+				db.Close()
+				os.Exit(internal.ExitCodeFailure)
+			}
+		},
+	}
+
+	testFlowCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the flow to test")
+	testFlowCommand.Flags().StringVar(&fixturesDir, "fixtures", "", "Path to the fixtures directory")
+	testFlowCommand.MarkFlagRequired("fixtures")
+	testFlowCommand.Flags().BoolVar(&outputJSON, "json", false, "Output the results as JSON instead of a table")
+
+	graphFlowCommand := &cobra.Command{
+		Use:   "graph",
+		Short: "Draw the steps of a flow",
+		Long:  "Draws the stages of a flow, along with the component and dependencies of each step, as a graph in the terminal",
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithField("flow", id)
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			specification, err := flows.ReadFlowSpecification(store, id)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not read flow specification")
+			}
+			for _, warning := range specification.Warnings {
+				logger.Warn(warning)
+			}
+
+			err = flows.WriteGraph(stdout, specification)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not draw flow")
+			}
+		},
+	}
+
+	graphFlowCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the flow")
+
+	diffFlowCommand := &cobra.Command{
+		Use:   "diff",
+		Short: "Compare a registered flow with its specification on disk",
+		Long: `Compare a registered flow with its specification on disk
+
+Shows a unified diff from the specification of a flow as it was when the flow was registered to
+its specification file as it is now (with includes merged into both), so that you can tell whether
+the flow needs to be registered again. Exits with status 1 if the specification has changed.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithField("flow", id)
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			specificationDiff, err := flows.DiffFlowSpecification(store, id)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not compare flow with its specification")
+			}
+
+			if outputJSON {
+				marshalledDiff, err := json.Marshal(specificationDiff)
+				if err != nil {
+					logger.Fatal("Failed to marshall diff")
+				}
+				fmt.Fprintln(stdout, string(marshalledDiff))
+			} else if specificationDiff.Diff != "" {
+				fmt.Fprint(stdout, specificationDiff.Diff)
+			} else if specificationDiff.ChecksumChanged {
+				logger.Info("Specification file has been reformatted since the flow was registered, but its contents are unchanged")
+			} else {
+				logger.Info("Specification is unchanged since the flow was registered")
+			}
+
+			if specificationDiff.Diff != "" {
+				db.Close()
+				os.Exit(internal.ExitCodeFailure)
+			}
+		},
+	}
+
+	diffFlowCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the flow")
+	diffFlowCommand.Flags().BoolVar(&outputJSON, "json", false, "Output the diff as JSON")
+
+	specFlowCommand := &cobra.Command{
+		Use:   "spec",
+		Short: "Print the registered specification of a flow",
+		Long:  "Prints the specification of a flow (with its includes merged in) as it was when the flow was registered, even if the specification file has since been edited or deleted",
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithField("flow", id)
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			flow, err := flows.SelectFlowByID(store, id)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not find flow")
+			}
+			if flow.SpecificationSnapshot == "" {
+				logger.WithField("error", flows.ErrNoSpecificationSnapshot).Fatal("Could not print specification of flow")
+			}
+			fmt.Fprintln(stdout, flow.SpecificationSnapshot)
+		},
+	}
+
+	specFlowCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the flow")
+
+	listFlowsCommand := &cobra.Command{
+		Use:   "list",
+		Short: "List all flows registered against the state database",
+		Long:  "Lists all flows that have previously been added to the state database",
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			labels, err := components.ParseLabels(rawLabels)
+			if err != nil {
+				log.WithField("error", err).Fatal("Invalid labels")
+			}
+			createdBy := ""
+			if mine {
+				createdBy = state.CurrentUser()
+			}
+
+			var wg sync.WaitGroup
+			flowsChan := make(chan flows.FlowMetadata)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				enc := json.NewEncoder(stdout)
+				for flow := range flowsChan {
+					err := enc.Encode(flow)
+					if err != nil {
+						log.WithField("flow", flow).WithField("error", err).Error("Error marshalling flow")
+					}
+				}
+			}()
+
+			err = flows.ListFlows(context.Background(), store, flowsChan, createdBy, labels)
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not list flows")
+			}
+			wg.Wait()
+		},
+	}
+
+	listFlowsCommand.Flags().BoolVar(&mine, "mine", false, "Only list flows created by the current user")
+	listFlowsCommand.Flags().StringArrayVarP(&rawLabels, "label", "l", []string{}, "Only list flows with the given label (key=value; may be given several times)")
+
+	var runID, step, comment string
+	var reject, includeDecided, pauseContainers bool
+	approveFlowCommand := &cobra.Command{
+		Use:   "approve",
+		Short: "Approve (or reject) a gate step in a flow run",
+		Long: `Approve (or reject) a gate step in a flow run
+
+Gate steps (which use the shnorky:gate component) pause their flow runs until someone approves
+them. Approving a gate lets the run continue, while rejecting it fails the step.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			err := flows.DecideApproval(store, runID, step, !reject, state.CurrentUser(), comment)
+			internal.RecordAudit(store, log, audit.ActionFlowApprove, map[string]string{"run": runID, "step": step, "approved": strconv.FormatBool(!reject), "comment": comment}, err)
+			if err != nil {
+				log.WithFields(logrus.Fields{"run": runID, "step": step, "error": err}).Fatal("Could not decide approval")
+			}
+		},
+	}
+
+	approveFlowCommand.Flags().StringVarP(&runID, "run", "r", "", "ID of the flow run")
+	approveFlowCommand.Flags().StringVarP(&step, "step", "s", "", "Name of the gate step")
+	approveFlowCommand.Flags().BoolVar(&reject, "reject", false, "Reject the gate (failing the step) instead of approving it")
+	approveFlowCommand.Flags().StringVarP(&comment, "comment", "c", "", "Comment to record with the decision")
+
+	listApprovalsCommand := &cobra.Command{
+		Use:   "approvals",
+		Short: "List gate steps waiting for approval",
+		Long:  "Lists the gate steps in flow runs which are waiting for approval (or, with --all, every approval)",
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			status := flows.ApprovalStatusPending
+			if includeDecided {
+				status = ""
+			}
+			approvals, err := flows.ListApprovals(store, runID, status)
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not list approvals")
+			}
+			enc := json.NewEncoder(stdout)
+			for _, approval := range approvals {
+				err = enc.Encode(approval)
+				if err != nil {
+					log.WithField("approval", approval.ExecutionID).WithField("error", err).Error("Error marshalling approval")
+				}
+			}
+		},
+	}
+
+	listApprovalsCommand.Flags().StringVarP(&runID, "run", "r", "", "Only list approvals for this flow run")
+	listApprovalsCommand.Flags().BoolVar(&includeDecided, "all", false, "Also list approvals which have been decided")
+
+	pauseFlowCommand := &cobra.Command{
+		Use:   "pause",
+		Short: "Pause an in-progress flow run",
+		Long: `Pause an in-progress flow run
+
+A paused flow run does not start any more stages until it is resumed (with "shn flows resume"). Steps
+which are already running are left to finish, unless --containers is specified, in which case their
+containers are paused too.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			var dockerClient *docker.Client
+			if pauseContainers {
+				dockerClient = internal.GenerateDockerClient(log)
+			}
+
+			paused, err := flows.PauseRun(context.Background(), store, dockerClient, runID, pauseContainers)
+			internal.RecordAudit(store, log, audit.ActionFlowPause, map[string]string{"run": runID, "containers": strconv.FormatBool(pauseContainers)}, err)
+			if err != nil {
+				log.WithFields(logrus.Fields{"run": runID, "error": err}).Fatal("Could not pause flow run")
+			}
+			for _, executionID := range paused {
+				fmt.Fprintln(stdout, "Paused container:", executionID)
+			}
+		},
+	}
+
+	pauseFlowCommand.Flags().StringVarP(&runID, "run", "r", "", "ID of the flow run to pause")
+	pauseFlowCommand.Flags().BoolVar(&pauseContainers, "containers", false, "Also pause the containers of steps which are running")
+
+	resumeFlowCommand := &cobra.Command{
+		Use:   "resume",
+		Short: "Resume a paused flow run",
+		Long:  "Resumes a paused flow run (unpausing any of its containers which were paused), which continues from the stage at which it was paused",
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			dockerClient := internal.GenerateDockerClient(log)
+
+			unpaused, err := flows.ResumeRun(context.Background(), store, dockerClient, runID)
+			internal.RecordAudit(store, log, audit.ActionFlowResume, map[string]string{"run": runID}, err)
+			if err != nil {
+				log.WithFields(logrus.Fields{"run": runID, "error": err}).Fatal("Could not resume flow run")
+			}
+			for _, executionID := range unpaused {
+				fmt.Fprintln(stdout, "Unpaused container:", executionID)
+			}
+		},
+	}
+
+	resumeFlowCommand.Flags().StringVarP(&runID, "run", "r", "", "ID of the flow run to resume")
+
+	flowsCommand.AddCommand(approveFlowCommand, listApprovalsCommand, pauseFlowCommand, resumeFlowCommand, listFlowsCommand, createFlowCommand, buildFlowCommand, executeFlowCommand, submitFlowCommand, reportFlowCommand, diffRunsCommand, statsFlowCommand, planFlowCommand, benchFlowCommand, testFlowCommand, graphFlowCommand, diffFlowCommand, specFlowCommand)
+
+	// shnorky executions
+	executionsCommand := &cobra.Command{
+		Use:   "executions",
+		Short: "Interact with shnorky executions",
+		Long: `Interact with shnorky executions
+
+shnorky executions represent runs of component builds (either individually or as steps in a flow).
+This command allows you to inspect the executions registered in your shnorky state.
+`,
+	}
+
+	inspectExecutionCommand := &cobra.Command{
+		Use:   "inspect <id>",
+		Short: "Inspect an execution",
+		Long:  "Shows the state of an execution, including its exit code, whether it was OOM-killed, and any error message reported by docker",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithField("execution", args[0])
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			dockerClient := internal.GenerateDockerClient(log)
+
+			ctx := context.Background()
+
+			executionMetadata, err := components.InspectExecution(ctx, store, dockerClient, args[0])
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not inspect execution")
+			}
+
+			marshalledExecution, err := json.Marshal(executionMetadata)
+			if err != nil {
+				logger.Fatal("Failed to marshall execution")
+			}
+			fmt.Fprintln(stdout, string(marshalledExecution))
+		},
+	}
+
+	reconcileExecutionsCommand := &cobra.Command{
+		Use:   "reconcile",
+		Short: "Reconcile executions with the docker daemon",
+		Long: `Reconcile executions with the docker daemon
+
+Records the results of unfinished executions whose containers have exited (e.g. because the shn
+process executing them was killed), records unfinished executions whose containers no longer exist
+as failed, and lists containers labelled by shnorky which have no corresponding execution. Flow runs
+whose processes have stopped recording heartbeats (for 2 minutes) and which have no running
+executions are recorded as failed, so that they no longer count towards the limits on concurrent
+runs. This also happens automatically when "shn serve" starts and before components or flows are
+executed.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			dockerClient := internal.GenerateDockerClient(log)
+
+			reconciliation, err := components.ReconcileExecutions(context.Background(), store, dockerClient)
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not reconcile executions")
+			}
+			abandonedRuns, err := flows.ReconcileRuns(store)
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not reconcile flow runs")
+			}
+
+			marshalledReconciliation, err := json.Marshal(struct {
+				components.Reconciliation
+				AbandonedRuns []flows.FlowRunMetadata `json:"abandoned_runs"`
+			}{reconciliation, abandonedRuns})
+			if err != nil {
+				log.Fatal("Failed to marshall reconciliation")
+			}
+			fmt.Fprintln(stdout, string(marshalledReconciliation))
+		},
+	}
+
+	listExecutionsCommand := &cobra.Command{
+		Use:   "list",
+		Short: "List executions registered against the state database",
+		Long:  "Lists executions (in the order in which they were created) from the state database, optionally only those of a given component or flow run",
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			var wg sync.WaitGroup
+			executionsChan := make(chan components.ExecutionMetadata)
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				enc := json.NewEncoder(stdout)
+				for execution := range executionsChan {
+					err := enc.Encode(execution)
+					if err != nil {
+						log.WithField("execution", execution.ID).WithField("error", err).Error("Error marshalling execution")
+					}
+				}
+			}()
+
+			err := components.ListExecutions(context.Background(), store, executionsChan, id, runID, page)
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not list executions")
+			}
+			wg.Wait()
+		},
+	}
+
+	listExecutionsCommand.Flags().StringVarP(&id, "component", "c", "", "ID of the component whose executions should be listed (optional)")
+	listExecutionsCommand.Flags().StringVarP(&runID, "run", "r", "", "ID of the flow run whose executions should be listed (optional)")
+	listExecutionsCommand.Flags().IntVar(&page.Limit, "limit", 0, "Maximum number of executions to list (0 lists all of them)")
+	listExecutionsCommand.Flags().IntVar(&page.Offset, "offset", 0, "Number of executions to skip (in the order in which they were created) before listing")
+
+	executionsCommand.AddCommand(inspectExecutionCommand, listExecutionsCommand, reconcileExecutionsCommand)
+
+	// shnorky ui
+	uiCommand := &cobra.Command{
+		Use:   "ui",
+		Short: "Open a terminal dashboard",
+		Long: `Open a terminal dashboard
+
+The dashboard shows the flows registered in your shnorky state, their recent runs, the status of
+each step in a run, and the logs of each step. It updates live as containers start and stop.
+Use tab to switch between panes, the arrow keys (or j and k) to move, enter to view the logs of a
+step, escape to return from the logs, and q to quit.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			dockerClient := internal.GenerateDockerClient(log)
+
+			err := tui.Run(context.Background(), store, dockerClient, os.Stdin, stdout)
+			if err != nil {
+				log.WithField("error", err).Fatal("Error running dashboard")
+			}
+		},
+	}
+
+	// shnorky serve
+	var address string
+	var workers int
+	serveCommand := &cobra.Command{
+		Use:   "serve",
+		Short: "Serve the shnorky API and web dashboard",
+		Long: `Serve the shnorky API and web dashboard
+
+Serves a JSON API for the flows registered in your shnorky state, along with a web dashboard which
+lets you list flows, trigger runs, follow the statuses of the steps in a run, and tail their logs.
+By default, the server only listens on the local machine.
+
+API requests must present a bearer token bound to a role (viewer, operator, or admin). Tokens are
+created with "shn tokens create", and may also be listed in the "server" section of your state
+configuration. Viewers may browse flows, runs, and logs, operators may also trigger flow runs, and
+admins may also register components and flows.
+
+The server also runs workers which execute the flow runs submitted with "shn flows submit".
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			dockerClient := internal.GenerateDockerClient(log)
+			internal.ReconcileExecutions(store, dockerClient, log)
+
+			config, err := state.ReadConfig(stateDir)
+			if err != nil {
+				log.WithField("error", err).Fatal("Error reading state configuration")
+			}
+			configAuthenticator, err := server.NewConfigAuthenticator(config.Server)
+			if err != nil {
+				log.WithField("error", err).Fatal("Invalid server configuration")
+			}
+			authenticator := server.ChainAuthenticator{configAuthenticator, server.NewDBAuthenticator(store)}
+			tokens, err := server.ListTokens(store, false)
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not list API tokens")
+			}
+			if configAuthenticator == nil && len(tokens) == 0 {
+				log.Warn("No API tokens exist, so no API requests will be authorized; create one with \"shn tokens create\"")
+			}
+
+			httpServer := &http.Server{
+				Addr:     address,
+				Handler:  server.New(store, dockerClient, stateDir, stdout, authenticator).Handler(),
+				ErrorLog: stdlog.New(log.WriterLevel(logrus.ErrorLevel), "", 0),
+			}
+
+			workersCtx, stopWorkers := context.WithCancel(context.Background())
+			workersDone := make(chan struct{})
+			go func() {
+				flows.RunWorkers(workersCtx, store, dockerClient, stdout, stateDir, workers)
+				close(workersDone)
+			}()
+
+			interrupts := make(chan os.Signal, 1)
+			signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-interrupts
+				stopWorkers()
+				httpServer.Shutdown(context.Background())
+			}()
+
+			log.WithField("address", address).Info("Serving shnorky")
+			fmt.Fprintf(stdout, "Dashboard: http://%s/\n", address)
+			err = httpServer.ListenAndServe()
+			if err != nil && err != http.ErrServerClosed {
+				log.WithField("error", err).Fatal("Error serving shnorky")
+			}
+			stopWorkers()
+			<-workersDone
+		},
+	}
+
+	serveCommand.Flags().StringVarP(&address, "address", "a", server.DefaultAddress, "Address (host:port) to listen on")
+	serveCommand.Flags().IntVarP(&workers, "workers", "w", 1, "Number of workers executing submitted flow runs (0 disables them)")
+
+	// shnorky tokens
+	var role, description string
+	var includeRevoked bool
+	tokensCommand := &cobra.Command{
+		Use:   "tokens",
+		Short: "Manage the API tokens accepted by shn serve",
+		Long: `Manage the API tokens accepted by shn serve
+
+Each API token is bound to a role: viewers may browse flows, runs, and logs, operators may also
+trigger flow runs, and admins may also register components and flows. Only hashes of the tokens are
+stored in your shnorky state, so a token is only shown when it is created.
+`,
+	}
+
+	createTokenCommand := &cobra.Command{
+		Use:   "create",
+		Short: "Create an API token",
+		Long:  "Creates an API token bound to the given role and prints it (along with its ID)",
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			token, err := server.CreateToken(store, role, description)
+			internal.RecordAudit(store, log, audit.ActionTokenCreate, map[string]string{"id": token.ID, "role": role, "description": description}, err)
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not create API token")
+			}
+			marshalledToken, err := json.Marshal(token)
+			if err != nil {
+				log.WithField("error", err).Fatal("Failed to marshal created API token")
+			}
+			fmt.Fprintln(stdout, string(marshalledToken))
+		},
+	}
+
+	rolesHelp := fmt.Sprintf("Role bound to the token (one of: %s)", strings.Join([]string{server.RoleViewer, server.RoleOperator, server.RoleAdmin}, ","))
+	createTokenCommand.Flags().StringVarP(&role, "role", "r", server.RoleViewer, rolesHelp)
+	createTokenCommand.Flags().StringVarP(&description, "description", "d", "", "Description of what the token is used for")
+
+	listTokensCommand := &cobra.Command{
+		Use:   "list",
+		Short: "List API tokens",
+		Long:  "Lists the API tokens stored in the state database (without the tokens themselves)",
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			tokens, err := server.ListTokens(store, includeRevoked)
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not list API tokens")
+			}
+			enc := json.NewEncoder(stdout)
+			for _, token := range tokens {
+				err = enc.Encode(token)
+				if err != nil {
+					log.WithField("token", token.ID).WithField("error", err).Error("Error marshalling API token")
+				}
+			}
+		},
+	}
+
+	listTokensCommand.Flags().BoolVar(&includeRevoked, "revoked", false, "Also list revoked tokens")
+
+	revokeTokenCommand := &cobra.Command{
+		Use:   "revoke",
+		Short: "Revoke an API token",
+		Long:  "Revokes the API token with the given ID, after which shn serve no longer accepts it",
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			err := server.RevokeToken(store, id)
+			internal.RecordAudit(store, log, audit.ActionTokenRevoke, map[string]string{"id": id}, err)
+			if err != nil {
+				log.WithField("error", err).Fatalf("Error revoking API token: %s", id)
+			}
+			fmt.Fprintln(stdout, id)
+		},
+	}
+
+	revokeTokenCommand.Flags().StringVarP(&id, "id", "i", "", "ID of the token being revoked")
+
+	tokensCommand.AddCommand(createTokenCommand, listTokensCommand, revokeTokenCommand)
+
+	// shnorky audit
+	var actor, action, since string
+	var limit int
+	auditCommand := &cobra.Command{
+		Use:   "audit",
+		Short: "Inspect the audit log of your shnorky state",
+		Long: `Inspect the audit log of your shnorky state
+
+Operations which modify your shnorky state (creating, removing, building, and executing components
+and flows, as well as managing API tokens) are recorded in an audit log along with who performed
+them, when, with which arguments, and whether they succeeded.
+`,
+	}
+
+	listAuditCommand := &cobra.Command{
+		Use:   "list",
+		Short: "List audit log entries",
+		Long:  "Lists the entries in the audit log, most recent first",
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			filter := audit.Filter{Actor: actor, Action: action, Limit: limit}
+			if mine {
+				filter.Actor = state.CurrentUser()
+			}
+			if since != "" {
+				sinceDuration, err := time.ParseDuration(since)
+				if err != nil {
+					log.WithField("error", err).Fatal("Invalid value for --since")
+				}
+				filter.Since = time.Now().Add(-sinceDuration)
+			}
+
+			entries, err := audit.List(store, filter)
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not list audit log entries")
+			}
+			enc := json.NewEncoder(stdout)
+			for _, entry := range entries {
+				err = enc.Encode(entry)
+				if err != nil {
+					log.WithField("entry", entry.ID).WithField("error", err).Error("Error marshalling audit log entry")
+				}
+			}
+		},
+	}
+
+	listAuditCommand.Flags().StringVar(&actor, "actor", "", "Only list entries for actions performed by this user")
+	listAuditCommand.Flags().BoolVar(&mine, "mine", false, "Only list entries for actions performed by the current user")
+	listAuditCommand.Flags().StringVar(&action, "action", "", "Only list entries for this action (e.g. components.remove)")
+	listAuditCommand.Flags().StringVar(&since, "since", "", "Only list entries from this long ago (e.g. 24h)")
+	listAuditCommand.Flags().IntVarP(&limit, "limit", "n", 100, "Maximum number of entries to list (0 lists all of them)")
+
+	auditCommand.AddCommand(listAuditCommand)
+
+	// shnorky queue
+	queueCommand := &cobra.Command{
+		Use:   "queue",
+		Short: "Inspect flow runs waiting to start",
+		Long: `Inspect flow runs waiting to start
+
+If the "runs" section of your state configuration sets "max_concurrent", flow runs which are
+started while that many runs are in progress are queued. Runs submitted with "shn flows submit" are
+also queued until a worker picks them up. Queued runs start in priority order (highest first, and
+oldest first among runs with the same priority) as the runs in progress finish.
+`,
+	}
+
+	listQueueCommand := &cobra.Command{
+		Use:   "list",
+		Short: "List queued flow runs",
+		Long:  "Lists the flow runs which are waiting to start, in the order in which they will start",
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			runs, err := flows.QueuedRuns(store)
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not list queued flow runs")
+			}
+			enc := json.NewEncoder(stdout)
+			for _, run := range runs {
+				err = enc.Encode(run)
+				if err != nil {
+					log.WithField("run", run.ID).WithField("error", err).Error("Error marshalling flow run")
+				}
+			}
+		},
+	}
+
+	queueCommand.AddCommand(listQueueCommand)
+
+	// shnorky run
+	runCommand := &cobra.Command{
+		Use:   "run",
+		Short: "Register, build, and execute a flow in one step",
+		Long: `Register, build, and execute a flow in one step
+
+Registers the flow at the given specification path (reusing its registration if it has already been
+registered from the same path), registers the components given with --component which have not been
+registered yet, builds every component of the flow which has not been built since it was last
+modified, and executes the flow. Components embedded in the flow specification are registered and
+built automatically. The mounts in the file given with --mounts (a JSON object mapping steps to
+mount configurations) replace the mounts that the flow specification gives for those steps.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			flowID := id
+			if flowID == "" {
+				flowID = strings.TrimSuffix(path.Base(specificationPath), path.Ext(specificationPath))
+			}
+			logger := log.WithFields(logrus.Fields{"flow": flowID, "spec": specificationPath})
+
+			componentPaths := map[string]string{}
+			for _, componentDir := range componentDirs {
+				idPath := strings.SplitN(componentDir, "=", 2)
+				if len(idPath) != 2 || idPath[0] == "" || idPath[1] == "" {
+					logger.WithField("component", componentDir).Fatal("Invalid component (expected <id>=<directory>)")
+				}
+				componentPaths[idPath[0]] = idPath[1]
+			}
+
+			mounts := map[string][]components.MountConfiguration{}
+			if mountsPath != "" {
+				mountsFile, err := os.Open(mountsPath)
+				if err != nil {
+					logger.WithField("error", err).Fatal("Could not open mount configuration file")
+				}
+				mounts, err = flows.ReadMountConfiguration(mountsFile)
+				mountsFile.Close()
+				if err != nil {
+					logger.WithField("error", err).Fatal("Error reading mount configuration")
+				}
+			}
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			dockerClient := internal.GenerateDockerClient(log)
+			internal.ReconcileExecutions(store, dockerClient, log)
+
+			ctx := context.Background()
+
+			run, executions, err := flows.RunSpecification(ctx, store, dockerClient, stdout, stateDir, flowID, specificationPath, componentPaths, mounts)
+			internal.RecordAudit(store, log, audit.ActionFlowRun, map[string]string{"id": flowID, "spec": specificationPath, "mounts": mountsPath, "run": run.ID}, err)
+			if err != nil {
+				logger.WithFields(logrus.Fields{"error": err, "run": run.ID}).Fatal("Could not run flow")
+			}
+
+			fmt.Fprintln(stdout, "Run:", run.ID)
+			fmt.Fprintln(stdout, executions)
+		},
+	}
+
+	runCommand.Flags().StringVarP(&specificationPath, "spec", "s", "", "Path to flow specification")
+	runCommand.Flags().StringVarP(&mountsPath, "mounts", "m", "", "Path to a JSON file mapping steps to mount configurations which replace those in the flow specification")
+	runCommand.Flags().StringVarP(&id, "id", "i", "", "ID under which to register the flow (defaults to the name of the specification file without its extension)")
+	runCommand.Flags().StringArrayVarP(&componentDirs, "component", "c", []string{}, "Component to register if it is not registered yet, as <id>=<directory> (may be given several times)")
+	runCommand.MarkFlagRequired("spec")
+
+	// shnorky dev
+	var devFlowID, devComponentID string
+	var devInterval time.Duration
+	devCommand := &cobra.Command{
+		Use:   "dev",
+		Short: "Rebuild and re-execute a flow (or reload a service) whenever its components change",
+		Long: `Rebuild and re-execute a flow (or reload a service) whenever its components change
+
+With --flow, executes the given flow (building its stale components first) and then watches the
+directories of the components of its steps. Whenever the contents of a component change, the
+component is rebuilt and the steps which run it are executed again along with every step downstream
+of them; steps upstream of the change are not executed again, so their outputs from earlier runs
+are reused. Changes to the flow specification cause the whole flow to be executed again.
+
+With --component, starts the given service component with its source bind-mounted at the mountpoint
+given in the "dev" section of its specification, and restarts (or signals) the service whenever its
+source changes instead of rebuilding its image. The image is only rebuilt when the specification or
+the files listed under "rebuild" (by default, the Dockerfile) change.
+
+Runs until interrupted.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			if (devFlowID == "") == (devComponentID == "") {
+				log.Fatal("Exactly one of --flow and --component must be given")
+			}
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			dockerClient := internal.GenerateDockerClient(log)
+			internal.ReconcileExecutions(store, dockerClient, log)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			interrupts := make(chan os.Signal, 1)
+			signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-interrupts
+				cancel()
+			}()
+
+			if devComponentID != "" {
+				logger := log.WithField("component", devComponentID)
+				logger.Info("Watching service source for changes")
+				err := components.DevelopService(ctx, store, dockerClient, stdout, path.Join(stateDir, state.BuildLogsDirName), devComponentID, devInterval, func(event components.ServiceDevEvent) {
+					if event.Built {
+						var buildErr error
+						if event.Error != "" {
+							buildErr = errors.New(event.Error)
+						}
+						internal.RecordAudit(store, log, audit.ActionComponentBuild, map[string]string{"id": devComponentID, "build": event.BuildID}, buildErr)
+					}
+					eventLogger := logger.WithFields(logrus.Fields{"action": event.Action, "build": event.BuildID, "execution": event.ExecutionID})
+					if event.Error != "" {
+						eventLogger.WithField("error", event.Error).Error("Could not update service")
+					} else {
+						eventLogger.Info("Service updated")
+					}
+				})
+				if err != nil && err != context.Canceled {
+					logger.WithField("error", err).Fatal("Stopped watching service")
+				}
+				return
+			}
+
+			logger := log.WithField("flow", devFlowID)
+			logger.Info("Watching flow components for changes")
+			err := flows.Develop(ctx, store, dockerClient, stdout, stateDir, devFlowID, devInterval, func(iteration flows.DevIteration) {
+				var runErr error
+				if iteration.Error != "" {
+					runErr = errors.New(iteration.Error)
+				}
+				for componentID, build := range iteration.Builds {
+					internal.RecordAudit(store, log, audit.ActionComponentBuild, map[string]string{"id": componentID, "build": build.ID}, nil)
+				}
+				if iteration.RunID != "" {
+					internal.RecordAudit(store, log, audit.ActionFlowRun, map[string]string{"id": devFlowID, "run": iteration.RunID, "steps": strings.Join(iteration.Steps, ",")}, runErr)
+				}
+
+				iterationLogger := logger.WithFields(logrus.Fields{"changed": strings.Join(iteration.Changed, ","), "steps": strings.Join(iteration.Steps, ","), "run": iteration.RunID})
+				if runErr != nil {
+					iterationLogger.WithField("error", runErr).Error("Iteration failed")
+				} else {
+					iterationLogger.Info("Iteration succeeded")
+				}
+			})
+			if err != nil && err != context.Canceled {
+				logger.WithField("error", err).Fatal("Stopped watching flow")
+			}
+		},
+	}
+
+	devCommand.Flags().StringVarP(&devFlowID, "flow", "f", "", "ID of the flow to develop")
+	devCommand.Flags().DurationVar(&devInterval, "interval", flows.DevPollInterval, "How often to check the components of the flow for changes")
+	devCommand.Flags().StringVarP(&devComponentID, "component", "c", "", "ID of the service component to develop with hot reloading")
+
+	// shnorky up
+	var upFlowID string
+	upCommand := &cobra.Command{
+		Use:   "up",
+		Short: "Start the service steps of a flow and keep them running",
+		Long: `Start the service steps of a flow and keep them running
+
+Builds the service components of the given flow whose builds are stale and starts each of its service
+steps (with the mounts, env, and workdirs given for them in the flow specification) on a docker
+network of their own, where they can reach each other by their step names. Services are started
+stage by stage, and each stage waits for the services before it to become healthy. The ports and
+healthchecks of the services are taken from their component specifications.
+
+The services keep running until "shn down" is run for the flow. Runs of the flow in the meantime
+use the standing services instead of starting their own service steps.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			dockerClient := internal.GenerateDockerClient(log)
+			internal.ReconcileExecutions(store, dockerClient, log)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			interrupts := make(chan os.Signal, 1)
+			signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+			go func() {
+				<-interrupts
+				cancel()
+			}()
+
+			logger := log.WithField("flow", upFlowID)
+			standing, err := flows.Up(ctx, store, dockerClient, stdout, stateDir, upFlowID)
+			internal.RecordAudit(store, log, audit.ActionFlowUp, map[string]string{"id": upFlowID}, err)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not bring up services")
+			}
+
+			enc := json.NewEncoder(stdout)
+			for _, service := range standing {
+				err = enc.Encode(service)
+				if err != nil {
+					logger.WithFields(logrus.Fields{"step": service.Step, "error": err}).Error("Error marshalling standing service")
+				}
+			}
+		},
+	}
+
+	upCommand.Flags().StringVarP(&upFlowID, "flow", "f", "", "ID of the flow whose services to start")
+	upCommand.MarkFlagRequired("flow")
+
+	// shnorky down
+	var downFlowID string
+	downCommand := &cobra.Command{
+		Use:   "down",
+		Short: "Stop the services of a flow started by shn up",
+		Long: `Stop the services of a flow started by shn up
+
+Stops the standing services of the given flow, records their results, and removes their network.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			dockerClient := internal.GenerateDockerClient(log)
+
+			logger := log.WithField("flow", downFlowID)
+			executions, err := flows.Down(context.Background(), store, dockerClient, downFlowID)
+			internal.RecordAudit(store, log, audit.ActionFlowDown, map[string]string{"id": downFlowID}, err)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not bring down services")
+			}
+
+			enc := json.NewEncoder(stdout)
+			for _, execution := range executions {
+				err = enc.Encode(execution)
+				if err != nil {
+					logger.WithFields(logrus.Fields{"execution": execution.ID, "error": err}).Error("Error marshalling execution")
+				}
+			}
+		},
+	}
+
+	downCommand.Flags().StringVarP(&downFlowID, "flow", "f", "", "ID of the flow whose services to stop")
+	downCommand.MarkFlagRequired("flow")
+
+	// shnorky export
+	exportCommand := &cobra.Command{
+		Use:   "export <bundle.tar.gz>",
+		Short: "Export a flow and its components into a bundle",
+		Long: `Export a flow and its components into a bundle
+
+Writes a gzipped tarball containing the flow specification (with its includes merged into it), the
+specification and the directory (including the Dockerfile and build context) of each component that
+the flow uses, and their labels. The bundle can be registered in another state directory, e.g. on
+another machine, with "shn import".
+`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithFields(logrus.Fields{"flow": bundleFlowID, "bundle": args[0]})
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			bundleFile, err := os.Create(args[0])
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not create bundle file")
+			}
+
+			manifest, err := bundle.Export(store, bundleFlowID, bundleFile)
+			closeErr := bundleFile.Close()
+			if err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(args[0])
+				logger.WithField("error", err).Fatal("Failed to export flow")
+			}
+			logger.WithField("components", len(manifest.Components)).Info("Flow exported successfully")
+		},
+	}
+
+	exportCommand.Flags().StringVarP(&bundleFlowID, "flow", "f", "", "ID of the flow to export")
+	exportCommand.MarkFlagRequired("flow")
+
+	// shnorky import
+	importCommand := &cobra.Command{
+		Use:   "import <bundle.tar.gz>",
+		Short: "Register the flow and components in a bundle",
+		Long: `Register the flow and components in a bundle
+
+Extracts a bundle created by "shn export" and registers the components and the flow that it
+contains, along with their labels. The bundle is extracted into the imports directory of the state
+directory unless --dir is given; the registered components and flow refer to the extracted files, so
+they must be kept. Nothing is registered if any of the components or the flow is already registered.
+`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithField("bundle", args[0])
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			destination := importDir
+			if destination == "" {
+				bundleName := strings.TrimSuffix(strings.TrimSuffix(path.Base(args[0]), ".gz"), ".tar")
+				destination = path.Join(stateDir, state.ImportsDirName, fmt.Sprintf("%s-%d", bundleName, time.Now().Unix()))
+			}
+			logger = logger.WithField("dir", destination)
+
+			bundleFile, err := os.Open(args[0])
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not open bundle file")
+			}
+			defer bundleFile.Close()
+
+			manifest, err := bundle.Import(store, bundleFile, destination)
+			internal.RecordAudit(store, log, audit.ActionBundleImport, map[string]string{"bundle": args[0], "dir": destination, "flow": manifest.Flow.ID}, err)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Failed to import bundle")
+			}
+			logger.WithFields(logrus.Fields{"flow": manifest.Flow.ID, "components": len(manifest.Components)}).Info("Bundle imported successfully")
+
+			marshalledManifest, err := json.Marshal(manifest)
+			if err != nil {
+				logger.Fatal("Failed to marshall bundle manifest")
+			}
+			fmt.Fprintln(stdout, string(marshalledManifest))
+		},
+	}
+
+	importCommand.Flags().StringVar(&importDir, "dir", "", "Directory to extract the bundle into (must be empty or not exist; defaults to a new directory under the imports directory of the state directory)")
+
+	// shnorky workspace
+	workspaceCommand := &cobra.Command{
+		Use:   "workspace",
+		Short: "Manage the components and flows of a project as a workspace",
+		Long: `Manage the components and flows of a project as a workspace
+
+A workspace is a project with a shnorky.workspace manifest at its root, which lists the components
+and flows of the project by their paths relative to it.
+`,
+	}
+
+	var workspaceDir string
+	syncWorkspaceCommand := &cobra.Command{
+		Use:   "sync",
+		Short: "Register the components and flows of a workspace and update drifted registrations",
+		Long: `Register the components and flows of a workspace and update drifted registrations
+
+Finds the shnorky.workspace manifest in the workspace directory (or the closest of its ancestors),
+registers each component and flow that it lists which is not registered yet, and updates the
+registrations of those whose type, directory, specification, or labels differ from the manifest, or
+whose flow specifications have changed since they were registered. Each difference is reported as
+drift. With --dry-run, nothing is registered or updated. Exits with a non-zero code if any entry
+could not be synced.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			logger := log.WithField("dir", workspaceDir)
+
+			manifestPath, err := workspace.FindManifest(workspaceDir)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Could not find workspace manifest")
+			}
+			logger = logger.WithField("manifest", manifestPath)
+			manifest, err := workspace.ReadManifest(manifestPath)
+			if err != nil {
+				logger.WithField("error", err).Fatal("Invalid workspace manifest")
+			}
+
+			db := internal.OpenStateDB(stateDir, log)
+			defer db.Close()
+			store := state.NewSQLiteStore(db)
+
+			changes := workspace.Sync(store, manifest, dryRun)
+			if !dryRun {
+				applied := 0
+				for _, change := range changes {
+					if change.Applied {
+						applied++
+					}
+				}
+				var syncErr error
+				if workspace.Failed(changes) {
+					syncErr = errors.New("Some entries of the workspace manifest could not be synced")
+				}
+				internal.RecordAudit(store, log, audit.ActionWorkspaceSync, map[string]string{"manifest": manifestPath, "applied": strconv.Itoa(applied)}, syncErr)
+			}
+
+			if outputJSON {
+				enc := json.NewEncoder(stdout)
+				for _, change := range changes {
+					err = enc.Encode(change)
+					if err != nil {
+						logger.WithField("id", change.ID).WithField("error", err).Error("Error marshalling change")
+					}
+				}
+			} else {
+				err = workspace.WriteSyncTable(stdout, changes)
+				if err != nil {
+					logger.WithField("error", err).Error("Could not write changes")
+				}
+			}
+
+			if workspace.Failed(changes) {
+				db.Close()
+				os.Exit(internal.ExitCodeFailure)
+			}
+		},
+	}
+
+	syncWorkspaceCommand.Flags().StringVarP(&workspaceDir, "dir", "d", ".", "Directory in the workspace (the manifest is searched for in it and its ancestors)")
+	syncWorkspaceCommand.Flags().BoolVar(&dryRun, "dry-run", false, "Report what would be registered or updated without changing anything")
+	syncWorkspaceCommand.Flags().BoolVar(&outputJSON, "json", false, "Output the changes as JSON lines")
+
+	workspaceCommand.AddCommand(syncWorkspaceCommand)
+
+	// shnorky doctor
+	doctorCommand := &cobra.Command{
+		Use:   "doctor",
+		Short: "Diagnose problems with your shnorky environment",
+		Long: `Diagnose problems with your shnorky environment
+
+Checks that the docker daemon is reachable and recent enough, that the state database is accessible
+and its schema is up to date, that there is enough free disk space in the state directory, and that
+the state configuration and the specifications of registered components and flows are valid. Each
+problem is reported along with a hint on how to fix it. Exits with a non-zero code if any check
+fails.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			checks := doctor.Run(context.Background(), stateDir)
+
+			if outputJSON {
+				enc := json.NewEncoder(stdout)
+				for _, check := range checks {
+					err := enc.Encode(check)
+					if err != nil {
+						log.WithField("check", check.Name).WithField("error", err).Error("Error marshalling check")
+					}
+				}
+			} else {
+				for _, check := range checks {
+					fmt.Fprintf(stdout, "[%s] %s: %s\n", check.Status, check.Name, check.Message)
+					if check.Hint != "" {
+						fmt.Fprintf(stdout, "    hint: %s\n", check.Hint)
+					}
+				}
+			}
+
+			if doctor.Failed(checks) {
+				os.Exit(internal.ExitCodeFailure)
+			}
+		},
+	}
+
+	doctorCommand.Flags().BoolVar(&outputJSON, "json", false, "Output the results of the checks as JSON lines")
+
+	// shnorky system
+	systemCommand := &cobra.Command{
+		Use:   "system",
+		Short: "Manage the resources that shnorky uses",
+	}
+
+	dfCommand := &cobra.Command{
+		Use:   "df",
+		Short: "Show the disk space used by shnorky",
+		Long: `Show the disk space used by shnorky
+
+Reports the disk space used by the docker images built for each component (largest first), and by
+the build logs, artifacts, scratch directories, and database in the state directory. Images share
+layers (e.g. their base images), so shared layers are counted once for each image which uses them.
+If the docker daemon cannot be reached, only the state directory is reported.
+`,
+		Run: func(cmd *cobra.Command, args []string) {
+			stateUsage, err := diskusage.State(stateDir)
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not measure state directory")
+			}
+
+			dockerClient := internal.GenerateDockerClient(log)
+			images, err := diskusage.Images(context.Background(), dockerClient)
+			if err != nil {
+				log.WithField("error", err).Warn("Could not measure images")
+			}
+			usage := diskusage.NewUsage(images, stateUsage)
+
+			if outputJSON {
+				marshalledUsage, err := json.Marshal(usage)
+				if err != nil {
+					log.Fatal("Failed to marshall disk usage")
+				}
+				fmt.Fprintln(stdout, string(marshalledUsage))
+				return
+			}
+			err = diskusage.WriteUsageTable(stdout, usage)
+			if err != nil {
+				log.WithField("error", err).Fatal("Could not write disk usage")
+			}
+		},
+	}
+
+	dfCommand.Flags().BoolVar(&outputJSON, "json", false, "Output the disk usage as JSON instead of a table")
 
-	flowsCommand.AddCommand(createFlowCommand, buildFlowCommand, executeFlowCommand)
+	systemCommand.AddCommand(dfCommand)
 
-	shnorkyCommand.AddCommand(versionCommand, completionCommand, stateCommand, componentsCommand, flowsCommand)
+	shnorkyCommand.AddCommand(versionCommand, completionCommand, stateCommand, componentsCommand, flowsCommand, executionsCommand, uiCommand, serveCommand, tokensCommand, auditCommand, queueCommand, runCommand, devCommand, upCommand, downCommand, exportCommand, importCommand, workspaceCommand, doctorCommand, systemCommand)
 
 	err = shnorkyCommand.Execute()
 	if err != nil {
-		fmt.Println(err)
-		os.Exit(1)
+		fmt.Fprintln(stdout, err)
+		os.Exit(internal.ExitCodeUsage)
 	}
 }
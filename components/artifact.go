@@ -0,0 +1,128 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"github.com/google/uuid"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// ErrEmptyExecutionID signifies that a caller attempted to create artifact metadata in which the
+// ExecutionID string was the empty string
+var ErrEmptyExecutionID = errors.New("ExecutionID must be a non-empty string")
+
+// ErrInvalidArtifactName signifies that a caller attempted to create an artifact with a name which
+// cannot be used as a file name in the artifact store
+var ErrInvalidArtifactName = errors.New("Artifact name must be a non-empty string which is a valid file name")
+
+// ArtifactMetadata - the metadata about an execution artifact that gets stored in the state
+// database
+type ArtifactMetadata struct {
+	ID           string    `json:"id"`
+	ExecutionID  string    `json:"execution_id"`
+	Name         string    `json:"name"`
+	ArtifactPath string    `json:"artifact_path"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// ValidateArtifactName returns ErrInvalidArtifactName if the given artifact name cannot be used as
+// a file name in the artifact store, and nil otherwise.
+func ValidateArtifactName(name string) error {
+	if name == "" || name == "." || name == ".." || filepath.Base(name) != name {
+		return ErrInvalidArtifactName
+	}
+	return nil
+}
+
+// GenerateArtifactMetadata creates an ArtifactMetadata instance representing an artifact with the
+// given name produced by the execution with the given executionID. The artifact file lives in a
+// directory named after the execution under the given artifacts directory.
+func GenerateArtifactMetadata(artifactsDir, executionID, name string) (ArtifactMetadata, error) {
+	if executionID == "" {
+		return ArtifactMetadata{}, ErrEmptyExecutionID
+	}
+	err := ValidateArtifactName(name)
+	if err != nil {
+		return ArtifactMetadata{}, err
+	}
+
+	artifactID, err := uuid.NewRandom()
+	if err != nil {
+		return ArtifactMetadata{}, err
+	}
+
+	return ArtifactMetadata{
+		ID:           artifactID.String(),
+		ExecutionID:  executionID,
+		Name:         name,
+		ArtifactPath: filepath.Join(artifactsDir, executionID, name),
+		CreatedAt:    time.Now(),
+	}, nil
+}
+
+// CaptureStdoutArtifact writes the standard output of the container for the execution with the
+// given executionID into the artifact store (rooted at artifactsDir) under the given name, and
+// registers the resulting artifact in the state database. The container should have finished
+// running before this function is called.
+func CaptureStdoutArtifact(ctx context.Context, store state.Store, dockerClient *docker.Client, artifactsDir, executionID, name string) (ArtifactMetadata, error) {
+	artifactMetadata, err := GenerateArtifactMetadata(artifactsDir, executionID, name)
+	if err != nil {
+		return artifactMetadata, err
+	}
+
+	err = os.MkdirAll(filepath.Dir(artifactMetadata.ArtifactPath), 0744)
+	if err != nil {
+		return artifactMetadata, fmt.Errorf("Could not create artifact directory for execution (%s): %w", executionID, err)
+	}
+
+	artifactFile, err := os.Create(artifactMetadata.ArtifactPath)
+	if err != nil {
+		return artifactMetadata, fmt.Errorf("Could not create artifact file (%s): %w", artifactMetadata.ArtifactPath, err)
+	}
+	defer artifactFile.Close()
+
+	logs, err := dockerClient.ContainerLogs(ctx, executionID, dockerTypes.ContainerLogsOptions{ShowStdout: true})
+	if err != nil {
+		return artifactMetadata, fmt.Errorf("Could not retrieve standard output for container (%s): %w", executionID, err)
+	}
+	defer logs.Close()
+
+	_, err = stdcopy.StdCopy(artifactFile, ioutil.Discard, logs)
+	if err != nil {
+		return artifactMetadata, fmt.Errorf("Could not write standard output for container (%s) to artifact file (%s): %w", executionID, artifactMetadata.ArtifactPath, err)
+	}
+
+	err = InsertArtifact(store, artifactMetadata)
+	if err != nil {
+		return artifactMetadata, fmt.Errorf("Error inserting artifact metadata into state database: %w", err)
+	}
+
+	return artifactMetadata, nil
+}
+
+// ListArtifacts streams artifacts one by one from the given state database into the given
+// artifacts channel. If executionID is non-empty, only artifacts produced by that execution are
+// listed. This function closes the artifacts channel when it is finished. If the given context is
+// cancelled, it stops listing and returns the context's error, so consumers may stop reading early.
+func ListArtifacts(ctx context.Context, store state.Store, artifacts chan<- ArtifactMetadata, executionID string) error {
+	defer close(artifacts)
+
+	return store.ListArtifacts(ctx, executionID, func(record state.ArtifactRecord) error {
+		select {
+		case artifacts <- ArtifactMetadata(record):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
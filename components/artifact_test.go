@@ -0,0 +1,123 @@
+package components
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// TestGenerateArtifactMetadata tests that artifact metadata validation behaves as expected and
+// that artifacts are placed in per-execution directories in the artifact store
+func TestGenerateArtifactMetadata(t *testing.T) {
+	type GenerateArtifactMetadataTest struct {
+		executionID          string
+		name                 string
+		expectedArtifactPath string
+		expectedError        error
+	}
+
+	tests := []GenerateArtifactMetadataTest{
+		{
+			executionID:          "execution",
+			name:                 "stdout.txt",
+			expectedArtifactPath: "/tmp/artifacts/execution/stdout.txt",
+		},
+		{
+			name:          "stdout.txt",
+			expectedError: ErrEmptyExecutionID,
+		},
+		{
+			executionID:   "execution",
+			expectedError: ErrInvalidArtifactName,
+		},
+		{
+			executionID:   "execution",
+			name:          "..",
+			expectedError: ErrInvalidArtifactName,
+		},
+		{
+			executionID:   "execution",
+			name:          "../stdout.txt",
+			expectedError: ErrInvalidArtifactName,
+		},
+	}
+
+	for i, test := range tests {
+		metadata, err := GenerateArtifactMetadata("/tmp/artifacts", test.executionID, test.name)
+		if err != test.expectedError {
+			t.Errorf("[Test %d] Unexpected error: expected=%v, actual=%v", i, test.expectedError, err)
+			continue
+		}
+		if metadata.ArtifactPath != test.expectedArtifactPath {
+			t.Errorf("[Test %d] Unexpected ArtifactPath: expected=%s, actual=%s", i, test.expectedArtifactPath, metadata.ArtifactPath)
+		}
+		if err == nil && metadata.ID == "" {
+			t.Errorf("[Test %d] Artifact metadata was generated with an empty ID", i)
+		}
+	}
+}
+
+// TestListArtifacts inserts artifacts for multiple executions into a temporary state database and
+// checks that ListArtifacts returns all of them (or only those for a given execution)
+func TestListArtifacts(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-list-artifacts-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Error creating state directory: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	artifactsDir := path.Join(stateDir, state.ArtifactsDirName)
+	executionIDs := []string{"execution-a", "execution-a", "execution-b"}
+	for i, executionID := range executionIDs {
+		artifact, err := GenerateArtifactMetadata(artifactsDir, executionID, "stdout.txt")
+		if err != nil {
+			t.Fatalf("[Artifact %d] Error generating artifact metadata: %s", i, err.Error())
+		}
+		err = InsertArtifact(store, artifact)
+		if err != nil {
+			t.Fatalf("[Artifact %d] Error inserting artifact into state database: %s", i, err.Error())
+		}
+	}
+
+	expectedCounts := map[string]int{"": 3, "execution-a": 2, "execution-b": 1, "execution-c": 0}
+	for executionID, expectedCount := range expectedCounts {
+		artifactsChan := make(chan ArtifactMetadata)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- ListArtifacts(context.Background(), store, artifactsChan, executionID)
+		}()
+
+		count := 0
+		for artifact := range artifactsChan {
+			if executionID != "" && artifact.ExecutionID != executionID {
+				t.Errorf("[Execution %s] Unexpected artifact for execution: %s", executionID, artifact.ExecutionID)
+			}
+			count++
+		}
+		if listErr := <-errChan; listErr != nil {
+			t.Errorf("[Execution %s] Error listing artifacts: %s", executionID, listErr.Error())
+		}
+		if count != expectedCount {
+			t.Errorf("[Execution %s] Unexpected number of artifacts: expected=%d, actual=%d", executionID, expectedCount, count)
+		}
+	}
+}
@@ -2,7 +2,6 @@ package components
 
 import (
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
 	"io"
@@ -15,6 +14,10 @@ import (
 	"github.com/docker/docker/builder/dockerignore"
 	docker "github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/archive"
+	"github.com/sirupsen/logrus"
+
+	"github.com/simiotics/shnorky/state"
+	"github.com/simiotics/shnorky/tracing"
 )
 
 // DockerImagePrefix is the prefix that shnorky attaches to each docker image name
@@ -24,11 +27,38 @@ var DockerImagePrefix = "shnorky/"
 // which the ComponentID string was the empty string
 var ErrEmptyComponentID = errors.New("ComponentID must be a non-empty string")
 
+// BuildFailureExcerptLines is the number of lines from the end of the output of a failed build
+// which are included in its BuildFailedError
+var BuildFailureExcerptLines = 20
+
+// BuildFailedError - signifies that the docker daemon reported an error while building the image for
+// a component (e.g. because a command in its Dockerfile failed). Failed builds are not recorded in
+// the state database.
+type BuildFailedError struct {
+	ComponentID string
+	BuildID     string
+	// Message is the error reported by the docker daemon
+	Message string
+	// LogExcerpt is the end of the (rendered) output of the build
+	LogExcerpt string
+}
+
+func (err *BuildFailedError) Error() string {
+	return fmt.Sprintf("Build (%s) of component (%s) failed: %s", err.BuildID, err.ComponentID, err.Message)
+}
+
 // BuildMetadata - the metadata about a component build that gets stored in the state database
 type BuildMetadata struct {
 	ID          string    `json:"id"`
 	ComponentID string    `json:"component_id"`
 	CreatedAt   time.Time `json:"created_at"`
+	CreatedBy   string    `json:"created_by"`
+	// SourceHash is the SourceHash of the component at the time it was built. It is empty for
+	// builds which were recorded before source hashes were.
+	SourceHash string `json:"source_hash,omitempty"`
+	// Target is the Dockerfile stage that the build was made for, if it overrode the stage given by
+	// the component specification (see BuildOptions)
+	Target string `json:"target,omitempty"`
 }
 
 // GenerateBuildMetadata creates a BuildMetadata instance representing a fresh (as yet unbuilt)
@@ -38,13 +68,42 @@ func GenerateBuildMetadata(componentID string) (BuildMetadata, error) {
 		return BuildMetadata{}, ErrEmptyComponentID
 	}
 	createdAt := time.Now()
-	buildID := fmt.Sprintf("%s%s:%d", DockerImagePrefix, componentID, createdAt.Unix())
-	return BuildMetadata{ID: buildID, ComponentID: componentID, CreatedAt: createdAt}, nil
+	// Colons (e.g. in the IDs of built-in components) are not allowed in docker image names
+	imageName := strings.Replace(componentID, ":", "-", -1)
+	buildID := fmt.Sprintf("%s%s:%d", DockerImagePrefix, imageName, createdAt.Unix())
+	return BuildMetadata{ID: buildID, ComponentID: componentID, CreatedAt: createdAt, CreatedBy: state.CurrentUser()}, nil
+}
+
+// BuildOptions - configures how CreateBuild builds the image for a component. The zero value builds
+// with the docker daemon's defaults.
+type BuildOptions struct {
+	// NoCache disables the build cache, so that every step of the Dockerfile is run afresh
+	NoCache bool
+	// Pull refreshes the base images of the Dockerfile, even if they are already present locally
+	Pull bool
+	// Target, if non-empty, is the stage of a multi-stage Dockerfile which is built, overriding the
+	// target in the component specification. It is recorded on the build (see BuildMetadata), so
+	// that the most recent build for each target can be selected.
+	Target string
+}
+
+// CreateBuild creates a new build for the component with the given componentID, configured by the
+// given options. The image build is retried on transient docker errors according to the retry
+// policy carried by ctx (see WithDockerRetryPolicy). The output of the build is streamed to
+// outstream and, if buildLogsDir is non-empty, also stored (whether or not the build succeeds) in a
+// log file under buildLogsDir (see BuildLogPath). The build is traced (see the tracing package) as
+// a "build" span.
+func CreateBuild(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, buildLogsDir, componentID string, options BuildOptions) (BuildMetadata, error) {
+	ctx, span := tracing.Start(ctx, "build", map[string]string{LogFieldComponentID: componentID})
+	buildMetadata, err := createBuild(ctx, store, dockerClient, outstream, buildLogsDir, componentID, options)
+	span.SetAttribute(LogFieldBuildID, buildMetadata.ID)
+	span.End(err)
+	return buildMetadata, err
 }
 
-// CreateBuild creates a new build for the component with the given componentID
-func CreateBuild(ctx context.Context, db *sql.DB, dockerClient *docker.Client, outstream io.Writer, componentID string) (BuildMetadata, error) {
-	componentMetadata, err := SelectComponentByID(db, componentID)
+// createBuild implements CreateBuild
+func createBuild(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, buildLogsDir, componentID string, options BuildOptions) (BuildMetadata, error) {
+	componentMetadata, err := SelectComponentByID(store, componentID)
 	if err != nil {
 		return BuildMetadata{}, err
 	}
@@ -53,16 +112,26 @@ func CreateBuild(ctx context.Context, db *sql.DB, dockerClient *docker.Client, o
 	if err != nil {
 		return BuildMetadata{}, err
 	}
+	buildMetadata.Target = options.Target
+	logger := Logger(ctx).WithFields(logrus.Fields{LogFieldComponentID: componentMetadata.ID, LogFieldBuildID: buildMetadata.ID})
+	logger.Info("Building image")
 
-	specFile, err := os.Open(componentMetadata.SpecificationPath)
+	specFile, err := OpenComponentSpecification(componentMetadata)
 	if err != nil {
-		return buildMetadata, fmt.Errorf("Could not open specification file (%s): %s", componentMetadata.SpecificationPath, err.Error())
+		return buildMetadata, fmt.Errorf("Could not open specification file (%s): %w", componentMetadata.SpecificationPath, err)
 	}
 	defer specFile.Close()
 
 	specification, err := ReadSingleSpecification(specFile)
 	if err != nil {
-		return buildMetadata, fmt.Errorf("Could not parse specification from specification file (%s): %s", componentMetadata.SpecificationPath, err.Error())
+		return buildMetadata, fmt.Errorf("Could not parse specification from specification file (%s): %w", componentMetadata.SpecificationPath, err)
+	}
+
+	// The source is hashed before it is archived so that changes made during the build are
+	// detected by BuildIsStale
+	sourceHash, err := SourceHash(componentMetadata)
+	if err != nil {
+		return buildMetadata, fmt.Errorf("Could not hash source of component (%s): %w", componentMetadata.ID, err)
 	}
 
 	context := filepath.Join(componentMetadata.ComponentPath, specification.Build.Context)
@@ -74,31 +143,25 @@ func CreateBuild(ctx context.Context, db *sql.DB, dockerClient *docker.Client, o
 	dockerignoreInfo, dockerignoreErr := os.Stat(dockerignoreFilePath)
 	if !os.IsNotExist(dockerignoreErr) {
 		if dockerignoreErr != nil {
-			return buildMetadata, fmt.Errorf("Error checking dockerignore file (%s): %s", dockerignoreFilePath, err.Error())
+			return buildMetadata, fmt.Errorf("Error checking dockerignore file (%s): %w", dockerignoreFilePath, err)
 		}
 
 		if !dockerignoreInfo.IsDir() {
 			dockerignoreFile, err := os.Open(dockerignoreFilePath)
 			if err != nil {
-				return buildMetadata, fmt.Errorf("Error opening dockerignore file (%s): %s", dockerignoreFilePath, err.Error())
+				return buildMetadata, fmt.Errorf("Error opening dockerignore file (%s): %w", dockerignoreFilePath, err)
 			}
 			defer dockerignoreFile.Close()
 
 			excludePatterns, err := dockerignore.ReadAll(dockerignoreFile)
 			if err != nil {
-				return buildMetadata, fmt.Errorf("Could not read exclude patterns from dockerignore file (%s): %s", dockerignoreFilePath, err.Error())
+				return buildMetadata, fmt.Errorf("Could not read exclude patterns from dockerignore file (%s): %w", dockerignoreFilePath, err)
 			}
 
 			tarOptions.ExcludePatterns = excludePatterns
 		}
 	}
 
-	buildContext, err := archive.TarWithOptions(context, &tarOptions)
-	if err != nil {
-		return buildMetadata, fmt.Errorf("Could not archive context: %s", err.Error())
-	}
-	defer buildContext.Close()
-
 	tags := []string{buildMetadata.ID}
 	imageIDComponents := strings.Split(buildMetadata.ID, ":")
 	if len(imageIDComponents) > 1 {
@@ -108,58 +171,78 @@ func CreateBuild(ctx context.Context, db *sql.DB, dockerClient *docker.Client, o
 	buildOptions := dockerTypes.ImageBuildOptions{
 		Tags:       tags,
 		Dockerfile: specification.Build.Dockerfile,
+		Labels:     WithDockerLabels(map[string]string{ComponentIDLabel: componentMetadata.ID}),
 		// Setting Remove to true means that intermediate containers for the build will be removed
 		// on a successful build.
-		Remove: true,
+		Remove:      true,
+		NoCache:     options.NoCache,
+		PullParent:  options.Pull,
+		Target:      specification.Build.Target,
+		NetworkMode: specification.Build.Network,
+		ExtraHosts:  specification.Build.ExtraHosts,
 	}
+	if options.Target != "" {
+		buildOptions.Target = options.Target
+	}
+
+	// The build context is consumed by each attempt to build the image, so it is archived afresh
+	// for each of them
+	var response dockerTypes.ImageBuildResponse
+	err = retryDocker(ctx, func() error {
+		buildContext, archiveErr := archive.TarWithOptions(context, &tarOptions)
+		if archiveErr != nil {
+			return fmt.Errorf("Could not archive context: %w", archiveErr)
+		}
+		defer buildContext.Close()
 
-	response, err := dockerClient.ImageBuild(ctx, buildContext, buildOptions)
+		var buildErr error
+		response, buildErr = dockerClient.ImageBuild(ctx, buildContext, buildOptions)
+		return buildErr
+	})
 	if err != nil {
-		return buildMetadata, fmt.Errorf("Error building image: %s", err.Error())
+		return buildMetadata, fmt.Errorf("Error building image: %w", err)
 	}
 	defer response.Body.Close()
-	io.Copy(outstream, response.Body)
 
-	err = InsertBuild(db, buildMetadata)
+	excerpt := &outputTail{maxLines: BuildFailureExcerptLines}
+	var buildError string
+	if buildLogsDir == "" {
+		buildError, err = renderBuildOutput(excerpt, io.TeeReader(response.Body, outstream))
+	} else {
+		buildError, err = writeBuildLog(buildLogsDir, buildMetadata.ID, io.TeeReader(response.Body, outstream), excerpt)
+	}
 	if err != nil {
-		return buildMetadata, fmt.Errorf("Error inserting build metadata into state database: %s", err.Error())
+		return buildMetadata, err
+	}
+	if buildError != "" {
+		return buildMetadata, &BuildFailedError{ComponentID: componentMetadata.ID, BuildID: buildMetadata.ID, Message: buildError, LogExcerpt: excerpt.String()}
 	}
 
+	buildMetadata.SourceHash = sourceHash
+	err = InsertBuild(store, buildMetadata)
+	if err != nil {
+		return buildMetadata, fmt.Errorf("Error inserting build metadata into state database: %w", err)
+	}
+	logger.Info("Built image")
+
 	return buildMetadata, nil
 }
 
 // ListBuilds streams builds one by one from the given state database into the given builds channel.
-// This function closes the builds channel when it is finished.
-func ListBuilds(db *sql.DB, builds chan<- BuildMetadata, componentID string) error {
+// If componentID is non-empty, only the builds of that component are listed (componentID may also
+// be a pattern matching several components - see IsIDPattern). If createdBy is non-empty, only the
+// builds created by that user are listed. Only the given page of the builds is listed. This
+// function closes the builds channel when it is finished. If the given context is cancelled, it
+// stops listing and returns the context's error, so consumers may stop reading early.
+func ListBuilds(ctx context.Context, store state.Store, builds chan<- BuildMetadata, componentID, createdBy string, page Page) error {
 	defer close(builds)
 
-	var rows *sql.Rows
-	var err error
-	if componentID != "" {
-		rows, err = db.Query(selectBuildsByComponentID, componentID)
-	} else {
-		rows, err = db.Query(selectBuilds)
-	}
-	if err != nil {
-		return err
-	}
-	defer rows.Close()
-
-	var id, rowComponentID string
-	var createdAt int64
-
-	for rows.Next() {
-		err = rows.Scan(&id, &rowComponentID, &createdAt)
-		if err != nil {
-			return err
+	return store.ListBuilds(ctx, componentID, createdBy, page, func(record state.BuildRecord) error {
+		select {
+		case builds <- BuildMetadata(record):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
 		}
-
-		builds <- BuildMetadata{
-			ID:          id,
-			ComponentID: rowComponentID,
-			CreatedAt:   time.Unix(createdAt, 0),
-		}
-	}
-
-	return nil
+	})
 }
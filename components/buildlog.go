@@ -0,0 +1,134 @@
+package components
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrBuildLogNotFound signifies that no log was stored for the requested build
+var ErrBuildLogNotFound = errors.New("No log found for the given build")
+
+// buildLogNameReplacer replaces the characters in build IDs (which are docker image names) which
+// should not appear in file names
+var buildLogNameReplacer = strings.NewReplacer("/", "_", ":", "_")
+
+// buildMessage - a message in the JSON stream with which the docker daemon responds to image build
+// requests
+type buildMessage struct {
+	Stream   string `json:"stream"`
+	Status   string `json:"status"`
+	Progress string `json:"progress"`
+	ID       string `json:"id"`
+	Error    string `json:"error"`
+}
+
+// BuildLogPath returns the path of the log file for the build with the given buildID under the
+// given build logs directory
+func BuildLogPath(buildLogsDir, buildID string) string {
+	return filepath.Join(buildLogsDir, buildLogNameReplacer.Replace(buildID)+".log")
+}
+
+// OpenBuildLog opens the log file for the build with the given buildID under the given build logs
+// directory. It returns ErrBuildLogNotFound if no log was stored for the build. The caller is
+// responsible for closing the returned file.
+func OpenBuildLog(buildLogsDir, buildID string) (*os.File, error) {
+	logFile, err := os.Open(BuildLogPath(buildLogsDir, buildID))
+	if os.IsNotExist(err) {
+		return nil, ErrBuildLogNotFound
+	}
+	return logFile, err
+}
+
+// writeBuildLog renders the output of the build with the given buildID (as streamed by the docker
+// daemon) into its log file under the given build logs directory, and also into the given excerpt
+// writer. It returns the error reported by the docker daemon, if the build failed.
+func writeBuildLog(buildLogsDir, buildID string, output io.Reader, excerpt io.Writer) (string, error) {
+	err := os.MkdirAll(buildLogsDir, 0744)
+	if err != nil {
+		return "", fmt.Errorf("Error creating build logs directory (%s): %w", buildLogsDir, err)
+	}
+
+	logPath := BuildLogPath(buildLogsDir, buildID)
+	logFile, err := os.Create(logPath)
+	if err != nil {
+		return "", fmt.Errorf("Error creating build log (%s): %w", logPath, err)
+	}
+	defer logFile.Close()
+
+	buildError, err := renderBuildOutput(io.MultiWriter(logFile, excerpt), output)
+	if err != nil {
+		return buildError, fmt.Errorf("Error writing build log (%s): %w", logPath, err)
+	}
+	return buildError, nil
+}
+
+// renderBuildOutput writes the JSON messages which the docker daemon streams in response to image
+// build requests to the given writer as plain text. Progress updates (e.g. of base image pulls) are
+// skipped. If the output stops being a stream of JSON messages, the rest of it is copied verbatim.
+// It returns the (last) error reported by the docker daemon in the stream, if the build failed.
+func renderBuildOutput(w io.Writer, output io.Reader) (string, error) {
+	buildError := ""
+	dec := json.NewDecoder(output)
+	for {
+		var message buildMessage
+		err := dec.Decode(&message)
+		if err == io.EOF {
+			return buildError, nil
+		}
+		if err != nil {
+			_, err = io.Copy(w, io.MultiReader(dec.Buffered(), output))
+			return buildError, err
+		}
+
+		var line string
+		switch {
+		case message.Error != "":
+			buildError = message.Error
+			line = fmt.Sprintf("ERROR: %s\n", message.Error)
+		case message.Stream != "":
+			line = message.Stream
+		case message.Status != "" && message.Progress == "":
+			line = message.Status + "\n"
+			if message.ID != "" {
+				line = fmt.Sprintf("%s: %s\n", message.ID, message.Status)
+			}
+		}
+		_, err = io.WriteString(w, line)
+		if err != nil {
+			return buildError, err
+		}
+	}
+}
+
+// outputTail - an io.Writer which keeps the last lines written to it
+type outputTail struct {
+	lines    []string
+	maxLines int
+	partial  string
+}
+
+// Write appends the complete lines in p (along with any partial line left over from the previous
+// write) to the tail, dropping the oldest lines beyond its maximum
+func (tail *outputTail) Write(p []byte) (int, error) {
+	lines := strings.Split(tail.partial+string(p), "\n")
+	tail.partial = lines[len(lines)-1]
+	tail.lines = append(tail.lines, lines[:len(lines)-1]...)
+	if len(tail.lines) > tail.maxLines {
+		tail.lines = tail.lines[len(tail.lines)-tail.maxLines:]
+	}
+	return len(p), nil
+}
+
+// String returns the lines kept by the tail, including any final line which is not terminated
+func (tail *outputTail) String() string {
+	lines := tail.lines
+	if tail.partial != "" {
+		lines = append(append([]string{}, lines...), tail.partial)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,72 @@
+package components
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestBuildLog(t *testing.T) {
+	buildLogsDir, err := ioutil.TempDir("", "shnorky-build-log-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(buildLogsDir)
+
+	buildID := "shnorky/test-component:1577836800"
+	_, err = OpenBuildLog(buildLogsDir, buildID)
+	if err != ErrBuildLogNotFound {
+		t.Fatalf("Unexpected error opening log for build without one: expected=%v, actual=%v", ErrBuildLogNotFound, err)
+	}
+
+	output := strings.Join([]string{
+		`{"stream":"Step 1/2 : FROM alpine:3.10\n"}`,
+		`{"status":"Pulling from library/alpine","id":"3.10"}`,
+		`{"status":"Downloading","progressDetail":{"current":1,"total":2},"progress":"[=====>     ]","id":"89d9c30c1d48"}`,
+		`{"stream":"Step 2/2 : RUN false\n"}`,
+		`{"errorDetail":{"code":1,"message":"The command '/bin/sh -c false' returned a non-zero code: 1"},"error":"The command '/bin/sh -c false' returned a non-zero code: 1"}`,
+	}, "\r\n")
+	excerpt := &outputTail{maxLines: 2}
+	buildError, err := writeBuildLog(buildLogsDir, buildID, strings.NewReader(output), excerpt)
+	if err != nil {
+		t.Fatalf("Error writing build log: %s", err.Error())
+	}
+	expectedBuildError := "The command '/bin/sh -c false' returned a non-zero code: 1"
+	if buildError != expectedBuildError {
+		t.Errorf("Unexpected build error: expected=%q, actual=%q", expectedBuildError, buildError)
+	}
+	expectedExcerpt := "Step 2/2 : RUN false\nERROR: The command '/bin/sh -c false' returned a non-zero code: 1"
+	if excerpt.String() != expectedExcerpt {
+		t.Errorf("Unexpected build log excerpt: expected=%q, actual=%q", expectedExcerpt, excerpt.String())
+	}
+
+	buildLog, err := OpenBuildLog(buildLogsDir, buildID)
+	if err != nil {
+		t.Fatalf("Error opening build log: %s", err.Error())
+	}
+	defer buildLog.Close()
+	contents, err := ioutil.ReadAll(buildLog)
+	if err != nil {
+		t.Fatalf("Error reading build log: %s", err.Error())
+	}
+
+	expected := "Step 1/2 : FROM alpine:3.10\n3.10: Pulling from library/alpine\nStep 2/2 : RUN false\nERROR: The command '/bin/sh -c false' returned a non-zero code: 1\n"
+	if string(contents) != expected {
+		t.Errorf("Unexpected build log: expected=%q, actual=%q", expected, string(contents))
+	}
+}
+
+func TestRenderBuildOutputVerbatim(t *testing.T) {
+	var rendered strings.Builder
+	buildError, err := renderBuildOutput(&rendered, strings.NewReader("not a JSON stream\n"))
+	if err != nil {
+		t.Fatalf("Error rendering build output: %s", err.Error())
+	}
+	if buildError != "" {
+		t.Errorf("Unexpected build error: %q", buildError)
+	}
+	if rendered.String() != "not a JSON stream\n" {
+		t.Errorf("Unexpected rendered output: %q", rendered.String())
+	}
+}
@@ -0,0 +1,456 @@
+package components
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// BuiltinComponentPrefix is the prefix of the IDs of components which ship with shnorky. Built-in
+// components can be referenced (e.g. in flow specifications) without being registered - they are
+// registered and built on demand.
+var BuiltinComponentPrefix = "builtin:"
+
+// builtinComponent - the embedded implementation of a built-in component. Files maps the names of
+// any files (other than the Dockerfile) in the component's build context to their contents.
+type builtinComponent struct {
+	Description   string
+	Dockerfile    string
+	Files         map[string]string
+	Specification ComponentSpecification
+}
+
+// builtinComponents maps the names of built-in components (i.e. their IDs without the
+// BuiltinComponentPrefix) to their implementations
+var builtinComponents = map[string]builtinComponent{
+	"http-fetch": {
+		Description: "Downloads the resource at URL into the /shnorky/output directory (as FILENAME, default \"download\")",
+		Dockerfile: `FROM alpine:3.11.2
+
+RUN apk add --no-cache ca-certificates curl
+
+ENTRYPOINT ["sh", "-c", "set -e; curl -fsSL --retry 3 \"$URL\" -o \"/shnorky/output/${FILENAME:-download}\""]
+`,
+		Specification: ComponentSpecification{
+			Build: BuildSpecification{Dockerfile: "Dockerfile"},
+			Run: RunSpecification{
+				Env: map[string]string{"URL": "", "FILENAME": "download"},
+				Mountpoints: []MountSpecification{
+					{MountType: "dir", Mountpoint: "/shnorky/output", Required: true},
+				},
+			},
+		},
+	},
+	"unzip": {
+		Description: "Extracts the zip archive mounted at /shnorky/input.zip into the /shnorky/output directory",
+		Dockerfile: `FROM alpine:3.11.2
+
+RUN apk add --no-cache unzip
+
+ENTRYPOINT ["unzip", "-o", "/shnorky/input.zip", "-d", "/shnorky/output"]
+`,
+		Specification: ComponentSpecification{
+			Build: BuildSpecification{Dockerfile: "Dockerfile"},
+			Run: RunSpecification{
+				Mountpoints: []MountSpecification{
+					{MountType: "file", Mountpoint: "/shnorky/input.zip", ReadOnly: true, Required: true},
+					{MountType: "dir", Mountpoint: "/shnorky/output", Required: true},
+				},
+			},
+		},
+	},
+	"s3-sync": {
+		Description: "Runs \"aws s3 sync SOURCE DESTINATION\", where local paths should be under the /shnorky/data directory",
+		Dockerfile: `FROM amazon/aws-cli:2.0.6
+
+ENTRYPOINT ["sh", "-c", "set -e; aws s3 sync \"$SOURCE\" \"$DESTINATION\""]
+`,
+		Specification: ComponentSpecification{
+			Build: BuildSpecification{Dockerfile: "Dockerfile"},
+			Run: RunSpecification{
+				Env: map[string]string{
+					"SOURCE":                "",
+					"DESTINATION":           "",
+					"AWS_ACCESS_KEY_ID":     "env:AWS_ACCESS_KEY_ID",
+					"AWS_SECRET_ACCESS_KEY": "env:AWS_SECRET_ACCESS_KEY",
+					"AWS_SESSION_TOKEN":     "env:AWS_SESSION_TOKEN",
+					"AWS_DEFAULT_REGION":    "env:AWS_DEFAULT_REGION",
+				},
+				Sensitive: []string{"AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"},
+				Mountpoints: []MountSpecification{
+					{MountType: "dir", Mountpoint: "/shnorky/data", Required: true},
+				},
+			},
+		},
+	},
+	"sqlite-query": {
+		Description: "Runs QUERY against the SQLite database mounted at /shnorky/db.sqlite and writes the results (as CSV) to stdout",
+		Dockerfile: `FROM alpine:3.11.2
+
+RUN apk add --no-cache sqlite
+
+ENTRYPOINT ["sh", "-c", "set -e; sqlite3 -header -csv /shnorky/db.sqlite \"$QUERY\""]
+`,
+		Specification: ComponentSpecification{
+			Build: BuildSpecification{Dockerfile: "Dockerfile"},
+			Run: RunSpecification{
+				Env: map[string]string{"QUERY": ""},
+				Mountpoints: []MountSpecification{
+					{MountType: "file", Mountpoint: "/shnorky/db.sqlite", Required: true},
+				},
+			},
+		},
+	},
+	"sql-extract": {
+		Description: "Runs QUERY (with named parameters, e.g. %(since)s, taken from the JSON object PARAMS) against the Postgres or MySQL database at DATABASE_URL and writes the results as FORMAT (csv or parquet) into the /shnorky/output directory (as FILENAME, default \"extract.<FORMAT>\")",
+		Dockerfile: `FROM python:3.8-slim
+
+RUN pip install --no-cache-dir psycopg2-binary==2.8.5 PyMySQL==0.9.3 pyarrow==0.17.1
+
+COPY extract.py /usr/local/bin/extract.py
+
+ENTRYPOINT ["python", "/usr/local/bin/extract.py"]
+`,
+		Files: map[string]string{
+			"extract.py": `import csv
+import json
+import os
+import sys
+from urllib.parse import unquote, urlparse
+
+BATCH_SIZE = 10000
+
+
+def connect(database_url):
+    parsed = urlparse(database_url)
+    if parsed.scheme in ("postgres", "postgresql"):
+        import psycopg2
+
+        return psycopg2.connect(database_url)
+    if parsed.scheme == "mysql":
+        import pymysql
+
+        return pymysql.connect(
+            host=parsed.hostname,
+            port=parsed.port or 3306,
+            user=unquote(parsed.username or ""),
+            password=unquote(parsed.password or ""),
+            database=parsed.path.lstrip("/"),
+        )
+    sys.exit("Unsupported database URL scheme: {}".format(parsed.scheme))
+
+
+def write_csv(cursor, columns, output_path):
+    with open(output_path, "w", newline="") as output_file:
+        writer = csv.writer(output_file)
+        writer.writerow(columns)
+        while True:
+            rows = cursor.fetchmany(BATCH_SIZE)
+            if not rows:
+                break
+            writer.writerows(rows)
+
+
+def write_parquet(cursor, columns, output_path):
+    import pyarrow
+    import pyarrow.parquet
+
+    rows = cursor.fetchall()
+    data = {column: [row[i] for row in rows] for i, column in enumerate(columns)}
+    pyarrow.parquet.write_table(pyarrow.Table.from_pydict(data), output_path)
+
+
+def main():
+    query = os.environ.get("QUERY", "")
+    if not query:
+        sys.exit("QUERY must be set")
+    params = json.loads(os.environ.get("PARAMS") or "{}")
+    output_format = os.environ.get("FORMAT") or "csv"
+    writers = {"csv": write_csv, "parquet": write_parquet}
+    if output_format not in writers:
+        sys.exit("Unsupported FORMAT: {}".format(output_format))
+    filename = os.environ.get("FILENAME") or "extract.{}".format(output_format)
+    output_path = os.path.join("/shnorky/output", filename)
+
+    connection = connect(os.environ.get("DATABASE_URL", ""))
+    try:
+        cursor = connection.cursor()
+        cursor.execute(query, params or None)
+        columns = [description[0] for description in cursor.description]
+        writers[output_format](cursor, columns, output_path)
+    finally:
+        connection.close()
+
+
+if __name__ == "__main__":
+    main()
+`,
+		},
+		Specification: ComponentSpecification{
+			Build: BuildSpecification{Dockerfile: "Dockerfile"},
+			Run: RunSpecification{
+				Env:       map[string]string{"DATABASE_URL": "", "QUERY": "", "PARAMS": "{}", "FORMAT": "csv", "FILENAME": ""},
+				Sensitive: []string{"DATABASE_URL"},
+				Mountpoints: []MountSpecification{
+					{MountType: "dir", Mountpoint: "/shnorky/output", Required: true},
+				},
+			},
+		},
+	},
+	"notify": {
+		Description: "Posts MESSAGE (as the \"text\" of a JSON payload) to WEBHOOK_URL",
+		Dockerfile: `FROM alpine:3.11.2
+
+RUN apk add --no-cache ca-certificates curl jq
+
+ENTRYPOINT ["sh", "-c", "set -e; jq -n --arg text \"$MESSAGE\" '{text: $text}' | curl -fsS -X POST -H 'Content-Type: application/json' --data @- \"$WEBHOOK_URL\""]
+`,
+		Specification: ComponentSpecification{
+			Build: BuildSpecification{Dockerfile: "Dockerfile"},
+			Run: RunSpecification{
+				Env:       map[string]string{"WEBHOOK_URL": "", "MESSAGE": ""},
+				Sensitive: []string{"WEBHOOK_URL"},
+			},
+		},
+	},
+	"load-test": {
+		Description: "Sends RPS requests per second to ENDPOINT (e.g. a service step on the flow network, as http://<step>:<port>/) for DURATION seconds and writes a JSON summary of the results (request counts, error rate, and latency percentiles) to stdout, exiting with a non-zero code if the error rate exceeds MAX_ERROR_RATE or the 95th percentile latency exceeds MAX_P95_MS",
+		Dockerfile: `FROM python:3.8-slim
+
+COPY loadtest.py /usr/local/bin/loadtest.py
+
+ENTRYPOINT ["python", "/usr/local/bin/loadtest.py"]
+`,
+		Files: map[string]string{
+			"loadtest.py": `import json
+import math
+import os
+import sys
+import threading
+import time
+import urllib.error
+import urllib.request
+from concurrent.futures import ThreadPoolExecutor
+
+MAX_WORKERS = 256
+
+
+def log(message):
+    print(message, file=sys.stderr, flush=True)
+
+
+def send(endpoint, method, body, headers, timeout):
+    request = urllib.request.Request(endpoint, data=body, headers=headers, method=method)
+    started = time.monotonic()
+    try:
+        with urllib.request.urlopen(request, timeout=timeout) as response:
+            response.read()
+            status = response.status
+    except urllib.error.HTTPError as e:
+        status = e.code
+    except Exception:
+        status = None
+    return status, time.monotonic() - started
+
+
+def wait_until_ready(endpoint, method, body, headers, ready_timeout):
+    deadline = time.monotonic() + ready_timeout
+    while True:
+        status, _ = send(endpoint, method, body, headers, 5)
+        if status is not None:
+            return
+        if time.monotonic() >= deadline:
+            sys.exit("Endpoint did not respond within {} seconds: {}".format(ready_timeout, endpoint))
+        time.sleep(1)
+
+
+def percentile(latencies, p):
+    if not latencies:
+        return None
+    rank = max(1, int(math.ceil(p / 100 * len(latencies))))
+    return round(latencies[rank - 1] * 1000, 3)
+
+
+def main():
+    endpoint = os.environ.get("ENDPOINT", "")
+    if not endpoint:
+        sys.exit("ENDPOINT must be set")
+    method = os.environ.get("METHOD") or "GET"
+    body = os.environ.get("BODY", "").encode() or None
+    headers = json.loads(os.environ.get("HEADERS") or "{}")
+    rps = float(os.environ.get("RPS") or "10")
+    duration = float(os.environ.get("DURATION") or "30")
+    timeout = float(os.environ.get("TIMEOUT") or "10")
+    ready_timeout = float(os.environ.get("READY_TIMEOUT") or "60")
+    if rps <= 0 or duration <= 0:
+        sys.exit("RPS and DURATION must be positive")
+
+    wait_until_ready(endpoint, method, body, headers, ready_timeout)
+    log("Sending {} requests per second to {} for {} seconds".format(rps, endpoint, duration))
+
+    results = []
+    lock = threading.Lock()
+
+    def record(future):
+        with lock:
+            results.append(future.result())
+
+    total = int(rps * duration)
+    started = time.monotonic()
+    with ThreadPoolExecutor(max_workers=min(MAX_WORKERS, max(1, int(rps * timeout)))) as executor:
+        for i in range(total):
+            delay = started + i / rps - time.monotonic()
+            if delay > 0:
+                time.sleep(delay)
+            executor.submit(send, endpoint, method, body, headers, timeout).add_done_callback(record)
+    elapsed = time.monotonic() - started
+
+    statuses = {}
+    errors = 0
+    latencies = []
+    for status, latency in results:
+        key = str(status) if status is not None else "error"
+        statuses[key] = statuses.get(key, 0) + 1
+        if status is None or status >= 400:
+            errors += 1
+        else:
+            latencies.append(latency)
+    latencies.sort()
+
+    summary = {
+        "endpoint": endpoint,
+        "method": method,
+        "target_rps": rps,
+        "duration_seconds": duration,
+        "requests": len(results),
+        "errors": errors,
+        "error_rate": errors / len(results) if results else 0,
+        "achieved_rps": round(len(results) / elapsed, 3) if elapsed > 0 else 0,
+        "statuses": statuses,
+        "latency_ms": {
+            "p50": percentile(latencies, 50),
+            "p95": percentile(latencies, 95),
+            "p99": percentile(latencies, 99),
+            "max": percentile(latencies, 100),
+        },
+    }
+    print(json.dumps(summary, indent=2, sort_keys=True))
+
+    failures = []
+    max_error_rate = os.environ.get("MAX_ERROR_RATE", "")
+    if max_error_rate and summary["error_rate"] > float(max_error_rate):
+        failures.append("error rate {} exceeds {}".format(summary["error_rate"], max_error_rate))
+    max_p95_ms = os.environ.get("MAX_P95_MS", "")
+    p95 = summary["latency_ms"]["p95"]
+    if max_p95_ms and (p95 is None or p95 > float(max_p95_ms)):
+        failures.append("95th percentile latency {} ms exceeds {} ms".format(p95, max_p95_ms))
+    if failures:
+        sys.exit("Load test failed: {}".format("; ".join(failures)))
+
+
+if __name__ == "__main__":
+    main()
+`,
+		},
+		Specification: ComponentSpecification{
+			Build: BuildSpecification{Dockerfile: "Dockerfile"},
+			Run: RunSpecification{
+				Env: map[string]string{
+					"ENDPOINT":       "",
+					"METHOD":         "GET",
+					"BODY":           "",
+					"HEADERS":        "{}",
+					"RPS":            "10",
+					"DURATION":       "30",
+					"TIMEOUT":        "10",
+					"READY_TIMEOUT":  "60",
+					"MAX_ERROR_RATE": "",
+					"MAX_P95_MS":     "",
+				},
+			},
+		},
+	},
+}
+
+// IsBuiltinComponent returns true if the given component ID refers to a built-in component
+func IsBuiltinComponent(componentID string) bool {
+	return strings.HasPrefix(componentID, BuiltinComponentPrefix)
+}
+
+// BuiltinComponentIDs returns the IDs (in lexicographic order) of the built-in components which
+// are implemented as containers
+func BuiltinComponentIDs() []string {
+	componentIDs := make([]string, 0, len(builtinComponents))
+	for name := range builtinComponents {
+		componentIDs = append(componentIDs, BuiltinComponentPrefix+name)
+	}
+	sort.Strings(componentIDs)
+	return componentIDs
+}
+
+// BuiltinComponentDescription returns a description of the built-in component with the given ID
+func BuiltinComponentDescription(componentID string) (string, error) {
+	component, ok := builtinComponents[strings.TrimPrefix(componentID, BuiltinComponentPrefix)]
+	if !IsBuiltinComponent(componentID) || !ok {
+		return "", fmt.Errorf("Unknown built-in component: %s", componentID)
+	}
+	return component.Description, nil
+}
+
+// BuiltinComponentSpecification returns the specification of the built-in component with the given
+// ID
+func BuiltinComponentSpecification(componentID string) (ComponentSpecification, error) {
+	component, ok := builtinComponents[strings.TrimPrefix(componentID, BuiltinComponentPrefix)]
+	if !IsBuiltinComponent(componentID) || !ok {
+		return ComponentSpecification{}, fmt.Errorf("Unknown built-in component: %s", componentID)
+	}
+	return component.Specification, nil
+}
+
+// EnsureBuiltinComponent writes the implementation of the built-in component with the given ID
+// into a directory under builtinDir and registers the component against the given state database
+// (if it has not already been registered). The implementation is rewritten on every call so that
+// new builds pick up changes that ship with new versions of shnorky.
+func EnsureBuiltinComponent(store state.Store, builtinDir, componentID string) (ComponentMetadata, error) {
+	name := strings.TrimPrefix(componentID, BuiltinComponentPrefix)
+	component, ok := builtinComponents[name]
+	if !IsBuiltinComponent(componentID) || !ok {
+		return ComponentMetadata{}, fmt.Errorf("Unknown built-in component: %s", componentID)
+	}
+
+	componentPath := filepath.Join(builtinDir, name)
+	err := os.MkdirAll(componentPath, 0755)
+	if err != nil {
+		return ComponentMetadata{}, fmt.Errorf("Could not create directory for built-in component (%s): %w", componentID, err)
+	}
+	err = ioutil.WriteFile(filepath.Join(componentPath, component.Specification.Build.Dockerfile), []byte(component.Dockerfile), 0644)
+	if err != nil {
+		return ComponentMetadata{}, fmt.Errorf("Could not write Dockerfile for built-in component (%s): %w", componentID, err)
+	}
+	for filename, contents := range component.Files {
+		err = ioutil.WriteFile(filepath.Join(componentPath, filename), []byte(contents), 0644)
+		if err != nil {
+			return ComponentMetadata{}, fmt.Errorf("Could not write %s for built-in component (%s): %w", filename, componentID, err)
+		}
+	}
+	specificationBytes, err := json.MarshalIndent(component.Specification, "", "    ")
+	if err != nil {
+		return ComponentMetadata{}, err
+	}
+	err = ioutil.WriteFile(filepath.Join(componentPath, DefaultSpecificationFileName), specificationBytes, 0644)
+	if err != nil {
+		return ComponentMetadata{}, fmt.Errorf("Could not write specification for built-in component (%s): %w", componentID, err)
+	}
+
+	metadata, err := SelectComponentByID(store, componentID)
+	if err != ErrComponentNotFound {
+		return metadata, err
+	}
+	return AddComponent(store, componentID, Task, componentPath, "")
+}
@@ -0,0 +1,97 @@
+package components
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestEnsureBuiltinComponent(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-builtin-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	// Built-in components which take secrets must not leak them into logs or command output
+	expectedSensitive := map[string][]string{
+		"builtin:s3-sync":     {"AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN"},
+		"builtin:sql-extract": {"DATABASE_URL"},
+		"builtin:notify":      {"WEBHOOK_URL"},
+	}
+
+	builtinDir := path.Join(stateDir, state.BuiltinDirName)
+	for _, componentID := range BuiltinComponentIDs() {
+		metadata, err := EnsureBuiltinComponent(store, builtinDir, componentID)
+		if err != nil {
+			t.Fatalf("[%s] Could not ensure built-in component: %s", componentID, err.Error())
+		}
+
+		specFile, err := os.Open(metadata.SpecificationPath)
+		if err != nil {
+			t.Fatalf("[%s] Could not open specification: %s", componentID, err.Error())
+		}
+		specification, err := ReadSingleSpecification(specFile)
+		specFile.Close()
+		if err != nil {
+			t.Errorf("[%s] Invalid specification: %s", componentID, err.Error())
+		}
+		for _, key := range specification.Run.Sensitive {
+			if _, ok := specification.Run.Env[key]; !ok {
+				t.Errorf("[%s] Sensitive environment variable (%s) is not in env", componentID, key)
+			}
+		}
+		if !reflect.DeepEqual(specification.Run.Sensitive, expectedSensitive[componentID]) {
+			t.Errorf("[%s] Unexpected sensitive environment variables: expected=%v, actual=%v", componentID, expectedSensitive[componentID], specification.Run.Sensitive)
+		}
+
+		for filename := range builtinComponents[strings.TrimPrefix(componentID, BuiltinComponentPrefix)].Files {
+			_, err = os.Stat(path.Join(metadata.ComponentPath, filename))
+			if err != nil {
+				t.Errorf("[%s] Could not find file (%s) in build context: %s", componentID, filename, err.Error())
+			}
+		}
+
+		_, err = EnsureBuiltinComponent(store, builtinDir, componentID)
+		if err != nil {
+			t.Errorf("[%s] Expected built-in component to be ensured more than once: %s", componentID, err.Error())
+		}
+
+		buildMetadata, err := GenerateBuildMetadata(componentID)
+		if err != nil {
+			t.Fatalf("[%s] Could not generate build metadata: %s", componentID, err.Error())
+		}
+		if strings.Count(buildMetadata.ID, ":") != 1 {
+			t.Errorf("[%s] Invalid image name for build: %s", componentID, buildMetadata.ID)
+		}
+	}
+
+	_, err = EnsureBuiltinComponent(store, builtinDir, "builtin:unknown")
+	if err == nil {
+		t.Errorf("Expected error ensuring unknown built-in component")
+	}
+	_, err = EnsureBuiltinComponent(store, builtinDir, "http-fetch")
+	if err == nil {
+		t.Errorf("Expected error ensuring built-in component without prefix")
+	}
+}
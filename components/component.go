@@ -1,11 +1,15 @@
 package components
 
 import (
-	"database/sql"
+	"context"
 	"errors"
+	"fmt"
 	"path"
 	"path/filepath"
+	"strings"
 	"time"
+
+	"github.com/simiotics/shnorky/state"
 )
 
 // Service is a component type which represents a long-running service that must be available as
@@ -41,6 +45,16 @@ type ComponentMetadata struct {
 	ComponentPath     string    `json:"component_path"`
 	SpecificationPath string    `json:"specification_path"`
 	CreatedAt         time.Time `json:"created_at"`
+	CreatedBy         string    `json:"created_by"`
+	// Labels are only populated by ListComponents
+	Labels map[string]string `json:"labels,omitempty"`
+	// Source is only populated by AddGitComponent and RefreshGitComponent
+	Source *ComponentSource `json:"source,omitempty"`
+	// SpecificationChecksum is the hex-encoded SHA256 digest of the specification file when the
+	// component was registered, and SpecificationSnapshot is its contents at that time (see
+	// OpenComponentSpecification). Both are empty if the file could not be read.
+	SpecificationChecksum string `json:"specification_checksum,omitempty"`
+	SpecificationSnapshot string `json:"-"`
 }
 
 // DefaultSpecificationFileName - this is the name of the file inside the component directory
@@ -79,14 +93,16 @@ func GenerateComponentMetadata(id, componentType, componentPath, specificationPa
 		ComponentPath:     componentPath,
 		SpecificationPath: specificationPath,
 		CreatedAt:         createdAt,
+		CreatedBy:         state.CurrentUser(),
 	}
 	return metadata, nil
 }
 
 // AddComponent registers a component (by metadata) against a shnorky state database. It applies
-// reasonable defaults where possible (e.g. on SpecificationPath).
+// reasonable defaults where possible (e.g. on SpecificationPath), and stores a snapshot of the
+// specification alongside the component.
 // This is the handler for `shnorky components add`
-func AddComponent(db *sql.DB, id, componentType, componentPath, specificationPath string) (ComponentMetadata, error) {
+func AddComponent(store state.Store, id, componentType, componentPath, specificationPath string) (ComponentMetadata, error) {
 	absoluteComponentPath, err := filepath.Abs(componentPath)
 	if err != nil {
 		return ComponentMetadata{}, err
@@ -102,49 +118,108 @@ func AddComponent(db *sql.DB, id, componentType, componentPath, specificationPat
 	if err != nil {
 		return metadata, err
 	}
+	metadata.SpecificationChecksum, metadata.SpecificationSnapshot = SnapshotSpecification(metadata.SpecificationPath)
 
-	err = InsertComponent(db, metadata)
+	err = InsertComponent(store, metadata)
 
 	return metadata, err
 }
 
-// ListComponents streams components one by one from the given state database into the given
-// components channel. This function closes the components channel when it is finished.
-func ListComponents(db *sql.DB, components chan<- ComponentMetadata) error {
-	defer close(components)
-
-	rows, err := db.Query(selectComponents)
+// EnsureComponent returns the metadata of the component with the given ID, registering the
+// component (as AddComponent does) if it has not been registered yet. It returns an error if the
+// component is registered with a different component directory or specification.
+func EnsureComponent(store state.Store, id, componentType, componentPath, specificationPath string) (ComponentMetadata, error) {
+	absoluteComponentPath, err := filepath.Abs(componentPath)
 	if err != nil {
-		return err
+		return ComponentMetadata{}, err
+	}
+	if specificationPath == "" {
+		specificationPath = filepath.Join(absoluteComponentPath, DefaultSpecificationFileName)
+	}
+	absoluteSpecificationPath, err := filepath.Abs(specificationPath)
+	if err != nil {
+		return ComponentMetadata{}, err
 	}
-	defer rows.Close()
 
-	var id, componentType, componentPath, specificationPath string
-	var createdAt int64
+	metadata, err := SelectComponentByID(store, id)
+	if err == ErrComponentNotFound {
+		return AddComponent(store, id, componentType, absoluteComponentPath, absoluteSpecificationPath)
+	}
+	if err == nil && metadata.ComponentPath != absoluteComponentPath {
+		err = fmt.Errorf("Component (%s) is already registered with a different directory (%s)", id, metadata.ComponentPath)
+	} else if err == nil && metadata.SpecificationPath != absoluteSpecificationPath {
+		err = fmt.Errorf("Component (%s) is already registered with a different specification (%s)", id, metadata.SpecificationPath)
+	}
+	return metadata, err
+}
 
-	for rows.Next() {
-		err = rows.Scan(&id, &componentType, &componentPath, &specificationPath, &createdAt)
-		if err != nil {
-			return err
-		}
+// ComponentFilter - restricts the components listed by ListComponents. Empty members do not
+// restrict the components.
+type ComponentFilter struct {
+	CreatedBy     string
+	ComponentType string
+	// CreatedAfter restricts the listing to components which were created strictly after it
+	CreatedAfter time.Time
+	IDPrefix     string
+	// IDPattern restricts the listing to components whose IDs match it (see IsIDPattern)
+	IDPattern string
+	// Labels restricts the listing to components which have all of these labels
+	Labels map[string]string
+}
 
-		components <- ComponentMetadata{
-			ID:                id,
-			ComponentType:     componentType,
-			ComponentPath:     componentPath,
-			SpecificationPath: specificationPath,
-			CreatedAt:         time.Unix(createdAt, 0),
-		}
-	}
+// IsIDPattern returns true if the given ID is a glob pattern rather than a literal ID, i.e. if it
+// contains any of the wildcards "*" (matching any sequence of characters), "?" (matching any single
+// character), or "[" (opening a character class such as "[0-9]")
+func IsIDPattern(id string) bool {
+	return strings.ContainsAny(id, "*?[")
+}
 
-	return nil
+// ListComponents streams the components which match the given filter one by one from the given
+// state database into the given components channel. Only the given page of the matching components
+// is listed. This function closes the components channel when it is finished. If the given context
+// is cancelled, it stops listing and returns the context's error, so consumers may stop reading
+// early.
+func ListComponents(ctx context.Context, store state.Store, components chan<- ComponentMetadata, filter ComponentFilter, page Page) error {
+	defer close(components)
+
+	if filter.ComponentType != "" && !ComponentTypes[filter.ComponentType] {
+		return ErrInvalidComponentType
+	}
+	return store.ListComponents(ctx, state.ComponentFilter(filter), page, func(record state.ComponentRecord, labels map[string]string) error {
+		component := ComponentMetadata{
+			ID:                    record.ID,
+			ComponentType:         record.ComponentType,
+			ComponentPath:         record.ComponentPath,
+			SpecificationPath:     record.SpecificationPath,
+			CreatedAt:             record.CreatedAt,
+			CreatedBy:             record.CreatedBy,
+			Labels:                labels,
+			SpecificationChecksum: record.SpecificationChecksum,
+			SpecificationSnapshot: record.SpecificationSnapshot,
+		}
+		select {
+		case components <- component:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
 }
 
 // RemoveComponent removes the component with the given id from the given state database
-func RemoveComponent(db *sql.DB, id string) error {
+func RemoveComponent(store state.Store, id string) error {
 	// TODO(nkashy1): Right now, this is simply calling DeleteComponentByID, but it should be doing
 	// a whole lot more once the build and flow story is better defined - it should also remove
 	// builds associated with the given component and should error out if there are any flows that
 	// make use of the specified component, for example.
-	return DeleteComponentByID(db, id)
+	err := DeleteComponentByID(store, id)
+	if err != nil {
+		return err
+	}
+
+	err = store.DeleteLabels(LabelledComponent, id)
+	if err != nil {
+		return err
+	}
+	return store.DeleteComponentSource(id)
 }
@@ -100,3 +100,25 @@ func TestGenerateComponentMetadata(t *testing.T) {
 		}
 	}
 }
+
+func TestIsIDPattern(t *testing.T) {
+	type isIDPatternTest struct {
+		id       string
+		expected bool
+	}
+
+	tests := []isIDPatternTest{
+		{id: "etl-extract", expected: false},
+		{id: "builtin:validate", expected: false},
+		{id: "etl-*", expected: true},
+		{id: "etl-?", expected: true},
+		{id: "etl-[0-9]", expected: true},
+	}
+
+	for i, test := range tests {
+		actual := IsIDPattern(test.id)
+		if actual != test.expected {
+			t.Errorf("[Test %d] Unexpected result for ID (%s): expected=%t, actual=%t", i, test.id, test.expected, actual)
+		}
+	}
+}
@@ -3,8 +3,10 @@ package components
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"path/filepath"
+	"strings"
 
 	dockerMount "github.com/docker/docker/api/types/mount"
 )
@@ -13,13 +15,19 @@ import (
 // configuration. It indicates that the value for the Method member was invalid.
 var ErrInvalidMountMethod = errors.New("Invalid mount method in component mount configuration: must be one of \"bind\", \"volume\", \"tmpfs\"")
 
-// MountConfiguration - describes the run-time mount configuration for a shnorky component
+// MountConfiguration - describes the run-time mount configuration for a shnorky component. When
+// the component is executed as part of a flow run, sources and targets may contain placeholders
+// (e.g. "{{run_id}}") which are rendered using RenderMountTemplates.
 type MountConfiguration struct {
 	Source string `json:"source"`
 	Target string `json:"target"`
 	Method string `json:"method"`
 }
 
+// ScratchMountpoint is a reserved mountpoint at which the scratch directory of a flow run is mounted
+// into the containers of its steps. Components need not declare it in their mountpoints.
+var ScratchMountpoint = "/shnorky/scratch"
+
 // ValidMountMethods defines the values for the MountConfiguration Method member
 var ValidMountMethods = map[string]dockerMount.Type{
 	"bind":   dockerMount.TypeBind,
@@ -27,14 +35,32 @@ var ValidMountMethods = map[string]dockerMount.Type{
 	"tmpfs":  dockerMount.TypeTmpfs,
 }
 
+// RemoteSourceScheme returns the scheme of the given mount source (e.g. "s3") if the source is a
+// URI referring to a remote object store rather than a path on the host
+func RemoteSourceScheme(source string) (string, bool) {
+	separator := strings.Index(source, "://")
+	if separator <= 0 {
+		return "", false
+	}
+	return source[:separator], true
+}
+
 // MaterializeMountConfiguration validates the members of its input mount configuration, applies
 // the required substitutions, and returns the resulting values in a new MountConfiguration struct.
+// Sources which are paths on the host are resolved to absolute paths, while remote sources (e.g.
+// "s3://bucket/key") are left as they are.
 func MaterializeMountConfiguration(rawConfig MountConfiguration) (MountConfiguration, error) {
-	materializedSource := MaterializeEnv(rawConfig.Source)
-	absoluteSource, err := filepath.Abs(materializedSource)
+	materializedSource, err := MaterializeEnv(rawConfig.Source)
 	if err != nil {
 		return MountConfiguration{}, err
 	}
+	absoluteSource := materializedSource
+	if _, ok := RemoteSourceScheme(materializedSource); !ok {
+		absoluteSource, err = filepath.Abs(materializedSource)
+		if err != nil {
+			return MountConfiguration{}, err
+		}
+	}
 
 	materializedConfig := MountConfiguration{
 		Source: absoluteSource,
@@ -73,3 +99,29 @@ func ReadMountConfiguration(reader io.Reader) ([]MountConfiguration, error) {
 
 	return mountConfigurations, nil
 }
+
+// RenderMountTemplates returns copies of the given mount configurations in which placeholders of
+// the form "{{<name>}}" in sources and targets have been replaced by the values of the
+// corresponding variables. Placeholders which do not correspond to any of the given variables are
+// left as they are.
+func RenderMountTemplates(mounts []MountConfiguration, variables map[string]string) []MountConfiguration {
+	renderedMounts := make([]MountConfiguration, len(mounts))
+	for i, mount := range mounts {
+		renderedMounts[i] = MountConfiguration{
+			Source: RenderTemplate(mount.Source, variables),
+			Target: RenderTemplate(mount.Target, variables),
+			Method: mount.Method,
+		}
+	}
+	return renderedMounts
+}
+
+// RenderTemplate replaces placeholders of the form "{{<name>}}" in the given string with the values
+// of the corresponding variables
+func RenderTemplate(template string, variables map[string]string) string {
+	rendered := template
+	for name, value := range variables {
+		rendered = strings.Replace(rendered, fmt.Sprintf("{{%s}}", name), value, -1)
+	}
+	return rendered
+}
@@ -0,0 +1,262 @@
+package components
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"time"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// ErrNoHotReload - signifies that a component cannot be developed with DevelopService, since it is
+// not a service or does not specify a dev mountpoint (see DevSpecification)
+var ErrNoHotReload = errors.New("Only service components with a dev mountpoint in their specification can be hot-reloaded")
+
+// DevStopTimeout is the amount of time that a service in development is given to shut down
+// gracefully (when it is replaced by a rebuilt one, or when DevelopService returns) before it is
+// killed
+var DevStopTimeout = 10 * time.Second
+
+// DefaultDevSignal is the signal sent to services which are reloaded with ReloadSignal if their
+// specification does not give one
+var DefaultDevSignal = "SIGHUP"
+
+// Actions which DevelopService reports in its events
+var (
+	// DevStarted - the service was started
+	DevStarted = "started"
+	// DevReloaded - the source of the service changed and the service was reloaded
+	DevReloaded = "reloaded"
+	// DevRebuilt - the image of the service was rebuilt and the service replaced by a new container
+	DevRebuilt = "rebuilt"
+)
+
+// ServiceDevEvent - something that DevelopService did (or failed to do) in response to a change.
+// Built is true if a new image was built (or attempted) for the event.
+type ServiceDevEvent struct {
+	Action      string `json:"action"`
+	Built       bool   `json:"built"`
+	BuildID     string `json:"build_id,omitempty"`
+	ExecutionID string `json:"execution_id,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// serviceDev holds the state of a service in development
+type serviceDev struct {
+	store        state.Store
+	dockerClient *docker.Client
+	outstream    io.Writer
+	buildLogsDir string
+	component    ComponentMetadata
+	dev          DevSpecification
+	sourcePath   string
+	rebuildPaths []string
+	execution    ExecutionMetadata
+}
+
+// DevelopService builds (if its build is stale) and starts the service component with the given
+// ID, with its source bind-mounted into its container at the dev mountpoint from its specification
+// (see DevSpecification), and then checks its source for changes every pollInterval. When the
+// source changes, the service is restarted (or signalled, for ReloadSignal) rather than rebuilt,
+// since its container already sees the changed files. When its specification or any of the paths
+// which require a rebuild change, the image is rebuilt and the service replaced by a container
+// running the new image (the old one keeps running if the build fails). The logs of the service are
+// written to outstream, and the given callback is called for each start, reload, and rebuild. It
+// runs until the given context is cancelled, at which point the service is stopped and the
+// context's error is returned.
+// This is the handler for `shn dev --component`
+func DevelopService(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	outstream io.Writer,
+	buildLogsDir string,
+	componentID string,
+	pollInterval time.Duration,
+	reported func(ServiceDevEvent),
+) error {
+	if outstream == nil {
+		outstream = ioutil.Discard
+	}
+	if reported == nil {
+		reported = func(ServiceDevEvent) {}
+	}
+
+	component, err := SelectComponentByID(store, componentID)
+	if err != nil {
+		return err
+	}
+	specification, err := ReadComponentSpecification(store, componentID)
+	if err != nil {
+		return err
+	}
+	if component.ComponentType != Service || specification.Dev.Mountpoint == "" {
+		return ErrNoHotReload
+	}
+
+	service := serviceDev{
+		store:        store,
+		dockerClient: dockerClient,
+		outstream:    outstream,
+		buildLogsDir: buildLogsDir,
+		component:    component,
+		dev:          specification.Dev,
+		sourcePath:   filepath.Join(component.ComponentPath, specification.Dev.Source),
+		rebuildPaths: []string{component.SpecificationPath},
+	}
+	if len(service.dev.Rebuild) == 0 {
+		dockerfile := specification.Build.Dockerfile
+		if dockerfile == "" {
+			dockerfile = "Dockerfile"
+		}
+		service.rebuildPaths = append(service.rebuildPaths, filepath.Join(component.ComponentPath, specification.Build.Context, dockerfile))
+	}
+	for _, rebuildPath := range service.dev.Rebuild {
+		service.rebuildPaths = append(service.rebuildPaths, filepath.Join(component.ComponentPath, rebuildPath))
+	}
+
+	sourceHash, err := hashPaths(service.sourcePath)
+	if err != nil {
+		return fmt.Errorf("Could not hash source of component (%s): %w", componentID, err)
+	}
+	rebuildHash, err := hashPaths(service.rebuildPaths...)
+	if err != nil {
+		return fmt.Errorf("Could not hash build inputs of component (%s): %w", componentID, err)
+	}
+
+	stale, err := BuildIsStale(store, componentID)
+	if err != nil {
+		return err
+	}
+	event := ServiceDevEvent{Action: DevStarted}
+	err = service.start(ctx, stale, &event)
+	reported(event)
+	if err != nil {
+		return err
+	}
+	defer service.stop()
+
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+
+		currentRebuildHash, err := hashPaths(service.rebuildPaths...)
+		if err != nil {
+			// Files may briefly be missing while they are being saved, so this is retried on the
+			// next poll
+			continue
+		}
+		currentSourceHash, err := hashPaths(service.sourcePath)
+		if err != nil {
+			continue
+		}
+
+		if currentRebuildHash != rebuildHash {
+			event := ServiceDevEvent{Action: DevRebuilt}
+			previous := service.execution
+			err = service.start(ctx, true, &event)
+			if err == nil {
+				service.stopExecution(previous)
+			} else {
+				event.Error = err.Error()
+			}
+			reported(event)
+		} else if currentSourceHash != sourceHash {
+			event := ServiceDevEvent{Action: DevReloaded, BuildID: service.execution.BuildID, ExecutionID: service.execution.ID}
+			err = service.reload(ctx)
+			if err != nil {
+				event.Error = err.Error()
+			}
+			reported(event)
+		}
+		rebuildHash = currentRebuildHash
+		sourceHash = currentSourceHash
+	}
+}
+
+// start starts a container for the service (building its image first if build is true), records
+// the build and execution in the given event, and follows the logs of the container
+func (service *serviceDev) start(ctx context.Context, build bool, event *ServiceDevEvent) error {
+	var buildMetadata BuildMetadata
+	var err error
+	event.Built = build
+	if build {
+		buildMetadata, err = CreateBuild(ctx, service.store, service.dockerClient, service.outstream, service.buildLogsDir, service.component.ID, BuildOptions{})
+	} else {
+		buildMetadata, err = SelectMostRecentBuildForComponent(service.store, service.component.ID)
+	}
+	if err != nil {
+		return err
+	}
+	event.BuildID = buildMetadata.ID
+
+	mounts := []MountConfiguration{{Source: service.sourcePath, Target: service.dev.Mountpoint, Method: "bind"}}
+	execution, err := ExecuteWithOptions(ctx, service.store, service.dockerClient, WithBuild(buildMetadata.ID), WithMounts(mounts...))
+	if err != nil {
+		return err
+	}
+	service.execution = execution
+	event.ExecutionID = execution.ID
+	go FollowExecutionLogs(ctx, service.dockerClient, execution.ID, -1, service.outstream)
+	return nil
+}
+
+// reload restarts (or signals) the container of the service
+func (service *serviceDev) reload(ctx context.Context) error {
+	if service.dev.Reload == ReloadSignal {
+		signal := service.dev.Signal
+		if signal == "" {
+			signal = DefaultDevSignal
+		}
+		return service.dockerClient.ContainerKill(ctx, service.execution.ID, signal)
+	}
+
+	timeout := DevStopTimeout
+	err := service.dockerClient.ContainerRestart(ctx, service.execution.ID, &timeout)
+	if err != nil {
+		return err
+	}
+	// Following the logs stops when the container stops, so only the logs of the restarted
+	// container remain to be followed
+	go FollowExecutionLogs(ctx, service.dockerClient, service.execution.ID, 0, service.outstream)
+	return nil
+}
+
+// stop stops the current container of the service
+func (service *serviceDev) stop() {
+	service.stopExecution(service.execution)
+}
+
+// stopExecution stops the container for the given execution of the service and records its result.
+// The context of DevelopService may already be cancelled, so this is not done under it.
+func (service *serviceDev) stopExecution(execution ExecutionMetadata) {
+	timeout := DevStopTimeout
+	service.dockerClient.ContainerStop(context.Background(), execution.ID, &timeout)
+	WaitForExecution(context.Background(), service.store, service.dockerClient, execution.ID)
+}
+
+// hashPaths returns a hash of the contents of the files (and directories) at the given paths
+func hashPaths(paths ...string) (string, error) {
+	hash := sha256.New()
+	for _, path := range paths {
+		fmt.Fprintf(hash, "%s\x00", path)
+		err := hashTree(hash, path)
+		if err != nil {
+			return "", err
+		}
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
@@ -0,0 +1,52 @@
+package components
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestDevelopServiceRequiresHotReload(t *testing.T) {
+	stateDir, db, err := state.InitEphemeral()
+	if err != nil {
+		t.Fatalf("Could not initialize ephemeral state: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	specifications := map[string]string{
+		"task":    `{"build": {}, "run": {}, "dev": {"mountpoint": "/app"}}`,
+		"service": `{"build": {}, "run": {}}`,
+	}
+	for componentID, specification := range specifications {
+		componentPath := path.Join(stateDir, componentID)
+		err = os.MkdirAll(componentPath, 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path.Join(componentPath, DefaultSpecificationFileName), []byte(specification), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Could not write component (%s): %s", componentID, err.Error())
+		}
+		componentType := Service
+		if componentID == "task" {
+			componentType = Task
+		}
+		_, err = AddComponent(store, componentID, componentType, componentPath, "")
+		if err != nil {
+			t.Fatalf("Could not register component (%s): %s", componentID, err.Error())
+		}
+	}
+
+	for _, componentID := range []string{"task", "service"} {
+		err = DevelopService(context.Background(), store, nil, nil, "", componentID, time.Millisecond, nil)
+		if err != ErrNoHotReload {
+			t.Errorf("Unexpected error developing component (%s): expected=%v, actual=%v", componentID, ErrNoHotReload, err)
+		}
+	}
+}
@@ -0,0 +1,173 @@
+package components
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// Statuses of components found by DiscoverComponents (and registered by
+// RegisterDiscoveredComponents)
+var (
+	// DiscoveryNew - the component is not registered yet
+	DiscoveryNew = "new"
+	// DiscoveryRegistered - the component is already registered with the same directory and
+	// specification
+	DiscoveryRegistered = "registered"
+	// DiscoveryConflict - the ID inferred for the component is already registered with a different
+	// directory or specification, or was inferred for several directories
+	DiscoveryConflict = "conflict"
+	// DiscoveryInvalid - the specification of the component could not be read
+	DiscoveryInvalid = "invalid"
+	// DiscoveryAdded - the component was registered by RegisterDiscoveredComponents
+	DiscoveryAdded = "added"
+	// DiscoveryFailed - RegisterDiscoveredComponents could not register the component
+	DiscoveryFailed = "failed"
+)
+
+// DiscoveredComponent - a component directory found by DiscoverComponents
+type DiscoveredComponent struct {
+	ID                string `json:"id"`
+	ComponentPath     string `json:"component_path"`
+	SpecificationPath string `json:"specification_path"`
+	Status            string `json:"status"`
+	Error             string `json:"error,omitempty"`
+}
+
+// DiscoverComponents walks the directory tree under the given root and returns a
+// DiscoveredComponent for each directory containing a component specification (a file named
+// DefaultSpecificationFileName), in lexicographic order of their paths. Hidden directories (whose
+// names start with ".") are not searched. The ID of each component is inferred from the name of its
+// directory, prefixed with the given idPrefix. The status of each component describes whether it
+// can be registered against the given state database.
+func DiscoverComponents(store state.Store, root, idPrefix string) ([]DiscoveredComponent, error) {
+	absoluteRoot, err := filepath.Abs(root)
+	if err != nil {
+		return []DiscoveredComponent{}, err
+	}
+
+	discovered := []DiscoveredComponent{}
+	err = filepath.Walk(absoluteRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if path != absoluteRoot && strings.HasPrefix(info.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Name() != DefaultSpecificationFileName || !info.Mode().IsRegular() {
+			return nil
+		}
+		componentPath := filepath.Dir(path)
+		discovered = append(discovered, DiscoveredComponent{
+			ID:                idPrefix + filepath.Base(componentPath),
+			ComponentPath:     componentPath,
+			SpecificationPath: path,
+			Status:            DiscoveryNew,
+		})
+		return nil
+	})
+	if err != nil {
+		return discovered, fmt.Errorf("Could not search directory (%s): %w", absoluteRoot, err)
+	}
+	sort.Slice(discovered, func(i, j int) bool { return discovered[i].ComponentPath < discovered[j].ComponentPath })
+
+	pathsByID := map[string][]string{}
+	for _, component := range discovered {
+		pathsByID[component.ID] = append(pathsByID[component.ID], component.ComponentPath)
+	}
+
+	for i, component := range discovered {
+		if paths := pathsByID[component.ID]; len(paths) > 1 {
+			discovered[i].Status = DiscoveryConflict
+			discovered[i].Error = fmt.Sprintf("The same ID was inferred for several directories: %s", strings.Join(paths, ", "))
+			continue
+		}
+
+		specificationFile, err := os.Open(component.SpecificationPath)
+		if err == nil {
+			_, err = ReadSingleSpecification(specificationFile)
+			specificationFile.Close()
+		}
+		if err != nil {
+			discovered[i].Status = DiscoveryInvalid
+			discovered[i].Error = fmt.Sprintf("Could not read specification: %s", err.Error())
+			continue
+		}
+
+		registered, err := SelectComponentByID(store, component.ID)
+		if err == ErrComponentNotFound {
+			continue
+		}
+		if err != nil {
+			return discovered, err
+		}
+		if registered.ComponentPath != component.ComponentPath || registered.SpecificationPath != component.SpecificationPath {
+			discovered[i].Status = DiscoveryConflict
+			discovered[i].Error = fmt.Sprintf("Already registered with a different directory (%s)", registered.ComponentPath)
+			continue
+		}
+		discovered[i].Status = DiscoveryRegistered
+	}
+
+	return discovered, nil
+}
+
+// RegisterDiscoveredComponents registers each of the given discovered components which is not
+// registered yet (i.e. has status DiscoveryNew) against the given state database with the given
+// component type and labels, and returns the components with updated statuses. The registered
+// callback (if non-nil) is called after each attempted registration, e.g. to record it in the audit
+// log.
+func RegisterDiscoveredComponents(store state.Store, discovered []DiscoveredComponent, componentType string, labels map[string]string, registered func(DiscoveredComponent, error)) []DiscoveredComponent {
+	result := make([]DiscoveredComponent, len(discovered))
+	for i, component := range discovered {
+		result[i] = component
+		if component.Status != DiscoveryNew {
+			continue
+		}
+
+		_, err := AddComponent(store, component.ID, componentType, component.ComponentPath, component.SpecificationPath)
+		if err == nil && len(labels) > 0 {
+			err = SetLabels(store, LabelledComponent, component.ID, labels)
+		}
+		if err != nil {
+			result[i].Status = DiscoveryFailed
+			result[i].Error = err.Error()
+		} else {
+			result[i].Status = DiscoveryAdded
+		}
+		if registered != nil {
+			registered(result[i], err)
+		}
+	}
+	return result
+}
+
+// DiscoveryHasProblems returns true if any of the given discovered components could not be (or was
+// not) registered because of a conflict, an invalid specification, or an error during registration
+func DiscoveryHasProblems(discovered []DiscoveredComponent) bool {
+	for _, component := range discovered {
+		if component.Status == DiscoveryConflict || component.Status == DiscoveryInvalid || component.Status == DiscoveryFailed {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteDiscoveryTable writes the given discovered components to w as a human-readable table
+func WriteDiscoveryTable(w io.Writer, discovered []DiscoveredComponent) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tSTATUS\tDIRECTORY\tERROR")
+	for _, component := range discovered {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", component.ID, component.Status, component.ComponentPath, component.Error)
+	}
+	return tw.Flush()
+}
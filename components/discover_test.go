@@ -0,0 +1,127 @@
+package components
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestDiscoverComponents(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "shnorky-discover-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+
+	stateDir := path.Join(tempDir, "state")
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", err.Error())
+	}
+	db, err := sql.Open("sqlite3", path.Join(stateDir, state.DBFileName))
+	if err != nil {
+		t.Fatalf("Error opening state database: %s", err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	root := filepath.Join(tempDir, "repo")
+	specifications := map[string]string{
+		"services/api/component.json":     `{"build": {}, "run": {}}`,
+		"jobs/extract/component.json":     `{"build": {}, "run": {}}`,
+		"jobs/broken/component.json":      `{"unknown": true}`,
+		"jobs/dup/component.json":         `{"build": {}, "run": {}}`,
+		"legacy/dup/component.json":       `{"build": {}, "run": {}}`,
+		"jobs/moved/component.json":       `{"build": {}, "run": {}}`,
+		".git/hooks/component.json":       `{"build": {}, "run": {}}`,
+		"jobs/extract/data/component.txt": "not a specification",
+	}
+	for name, contents := range specifications {
+		specificationPath := filepath.Join(root, name)
+		err = os.MkdirAll(filepath.Dir(specificationPath), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(specificationPath, []byte(contents), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Could not write file (%s): %s", name, err.Error())
+		}
+	}
+
+	_, err = AddComponent(store, "moved", Task, filepath.Join(tempDir, "elsewhere"), "")
+	if err != nil {
+		t.Fatalf("Could not register component: %s", err.Error())
+	}
+
+	discovered, err := DiscoverComponents(store, root, "")
+	if err != nil {
+		t.Fatalf("Unexpected error discovering components: %s", err.Error())
+	}
+	expectedStatuses := map[string]string{
+		filepath.Join(root, "jobs/broken"):  DiscoveryInvalid,
+		filepath.Join(root, "jobs/dup"):     DiscoveryConflict,
+		filepath.Join(root, "jobs/extract"): DiscoveryNew,
+		filepath.Join(root, "jobs/moved"):   DiscoveryConflict,
+		filepath.Join(root, "legacy/dup"):   DiscoveryConflict,
+		filepath.Join(root, "services/api"): DiscoveryNew,
+	}
+	if len(discovered) != len(expectedStatuses) {
+		t.Fatalf("Unexpected number of discovered components: expected=%d, actual=%d (%v)", len(expectedStatuses), len(discovered), discovered)
+	}
+	for i, component := range discovered {
+		if i > 0 && discovered[i-1].ComponentPath > component.ComponentPath {
+			t.Errorf("Discovered components are not sorted by path: %v", discovered)
+		}
+		if expectedStatuses[component.ComponentPath] != component.Status {
+			t.Errorf("Unexpected status for component (%s): expected=%s, actual=%s", component.ComponentPath, expectedStatuses[component.ComponentPath], component.Status)
+		}
+		if component.ID != filepath.Base(component.ComponentPath) {
+			t.Errorf("Unexpected ID for component (%s): %s", component.ComponentPath, component.ID)
+		}
+	}
+
+	registered := []string{}
+	results := RegisterDiscoveredComponents(store, discovered, Task, map[string]string{"repo": "monorepo"}, func(component DiscoveredComponent, err error) {
+		registered = append(registered, component.ID)
+	})
+	if len(registered) != 2 {
+		t.Errorf("Unexpected registrations: %v", registered)
+	}
+	for _, component := range results {
+		if expectedStatuses[component.ComponentPath] == DiscoveryNew && component.Status != DiscoveryAdded {
+			t.Errorf("Expected component (%s) to be added, but its status is %s: %s", component.ID, component.Status, component.Error)
+		}
+	}
+	if !DiscoveryHasProblems(results) {
+		t.Error("Expected conflicts and invalid specifications to be reported as problems")
+	}
+
+	api, err := SelectComponentByID(store, "api")
+	if err != nil || api.ComponentPath != filepath.Join(root, "services/api") {
+		t.Errorf("Unexpected registered component: %v, err=%v", api, err)
+	}
+	labels, err := Labels(store, LabelledComponent, "api")
+	if err != nil || labels["repo"] != "monorepo" {
+		t.Errorf("Unexpected labels for registered component: %v, err=%v", labels, err)
+	}
+
+	// Discovering again finds the newly registered components as already registered
+	rediscovered, err := DiscoverComponents(store, root, "")
+	if err != nil {
+		t.Fatalf("Unexpected error discovering components: %s", err.Error())
+	}
+	for _, component := range rediscovered {
+		if expectedStatuses[component.ComponentPath] == DiscoveryNew && component.Status != DiscoveryRegistered {
+			t.Errorf("Expected component (%s) to be registered, but its status is %s", component.ID, component.Status)
+		}
+	}
+
+	prefixed, err := DiscoverComponents(store, filepath.Join(root, "services"), "team-")
+	if err != nil || len(prefixed) != 1 || prefixed[0].ID != "team-api" || prefixed[0].Status != DiscoveryNew {
+		t.Errorf("Unexpected components discovered with prefix: %v, err=%v", prefixed, err)
+	}
+}
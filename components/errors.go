@@ -0,0 +1,32 @@
+package components
+
+import (
+	"context"
+	"errors"
+
+	"github.com/mattn/go-sqlite3"
+)
+
+// IsRetryable returns true if the operation (e.g. Execute or CreateBuild) which failed with the
+// given error may succeed if it is invoked again unchanged. Transient docker errors (see
+// IsTransientDockerError) and contention for the state database are retryable. Invalid
+// specifications, failed builds, containers which exited with non-zero codes, missing records, and
+// cancelled or expired contexts are not, since retrying them would only repeat the failure.
+func IsRetryable(err error) bool {
+	var specificationErr *InvalidSpecificationError
+	var buildErr *BuildFailedError
+	var executionErr *ExecutionFailedError
+	if err == nil || errors.As(err, &specificationErr) || errors.As(err, &buildErr) || errors.As(err, &executionErr) {
+		return false
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+
+	var sqliteErr sqlite3.Error
+	if errors.As(err, &sqliteErr) {
+		return sqliteErr.Code == sqlite3.ErrBusy || sqliteErr.Code == sqlite3.ErrLocked
+	}
+
+	return IsTransientDockerError(err)
+}
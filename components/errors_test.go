@@ -0,0 +1,86 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	docker "github.com/docker/docker/client"
+	"github.com/mattn/go-sqlite3"
+)
+
+func TestExecutionFailedError(t *testing.T) {
+	exitCode := 137
+	type ExecutionFailedErrorTest struct {
+		executionMetadata ExecutionMetadata
+		expected          string
+	}
+
+	tests := []ExecutionFailedErrorTest{
+		{
+			executionMetadata: ExecutionMetadata{ID: "execution", ComponentID: "component", ExitCode: &exitCode},
+			expected:          "Container (execution) for component (component) exited with non-zero code: 137",
+		},
+		{
+			executionMetadata: ExecutionMetadata{ID: "execution", ComponentID: "component", Step: "step", ExitCode: &exitCode, OOMKilled: true},
+			expected:          "Container (execution) for step (step) exited with non-zero code: 137 (it was killed for running out of memory)",
+		},
+	}
+
+	for i, test := range tests {
+		err := fmt.Errorf("Hook failed: %w", NewExecutionFailedError(test.executionMetadata))
+		var failedErr *ExecutionFailedError
+		if !errors.As(err, &failedErr) {
+			t.Errorf("[Test %d] Wrapped error is not an ExecutionFailedError: %v", i, err)
+			continue
+		}
+		if failedErr.ExitCode != exitCode {
+			t.Errorf("[Test %d] Unexpected exit code: expected=%d, actual=%d", i, exitCode, failedErr.ExitCode)
+		}
+		if failedErr.Error() != test.expected {
+			t.Errorf("[Test %d] Unexpected error message: expected=%q, actual=%q", i, test.expected, failedErr.Error())
+		}
+	}
+}
+
+func TestBuildFailedError(t *testing.T) {
+	err := fmt.Errorf("Error building flow: %w", &BuildFailedError{ComponentID: "component", BuildID: "build", Message: "failed", LogExcerpt: "ERROR: failed"})
+	var failedErr *BuildFailedError
+	if !errors.As(err, &failedErr) {
+		t.Fatalf("Wrapped error is not a BuildFailedError: %v", err)
+	}
+	if failedErr.ComponentID != "component" || failedErr.LogExcerpt != "ERROR: failed" {
+		t.Errorf("Unexpected BuildFailedError: %+v", failedErr)
+	}
+	expected := "Error building flow: Build (build) of component (component) failed: failed"
+	if err.Error() != expected {
+		t.Errorf("Unexpected error message: expected=%q, actual=%q", expected, err.Error())
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	type isRetryableTest struct {
+		err      error
+		expected bool
+	}
+
+	tests := []isRetryableTest{
+		{err: nil, expected: false},
+		{err: fmt.Errorf("Error creating container: %w", docker.ErrorConnectionFailed("unix:///var/run/docker.sock")), expected: true},
+		{err: fmt.Errorf("Error inserting execution: %w", sqlite3.Error{Code: sqlite3.ErrBusy}), expected: true},
+		{err: sqlite3.Error{Code: sqlite3.ErrConstraint}, expected: false},
+		{err: &InvalidSpecificationError{Err: ErrInvalidMountType}, expected: false},
+		{err: &BuildFailedError{ComponentID: "component", Message: "unexpected EOF"}, expected: false},
+		{err: &ExecutionFailedError{ExitCode: 1}, expected: false},
+		{err: fmt.Errorf("Error creating container: %w", context.DeadlineExceeded), expected: false},
+		{err: ErrComponentNotFound, expected: false},
+	}
+
+	for i, test := range tests {
+		actual := IsRetryable(test.err)
+		if actual != test.expected {
+			t.Errorf("[Test %d] Unexpected result for error (%v): expected=%t, actual=%t", i, test.err, test.expected, actual)
+		}
+	}
+}
@@ -1,31 +1,92 @@
 package components
 
 import (
+	"bytes"
 	"context"
-	"database/sql"
 	"errors"
 	"fmt"
-	"os"
+	"io"
+	"strconv"
+	"strings"
 	"time"
 
 	dockerTypes "github.com/docker/docker/api/types"
 	dockerContainer "github.com/docker/docker/api/types/container"
 	dockerMount "github.com/docker/docker/api/types/mount"
+	dockerNetwork "github.com/docker/docker/api/types/network"
 	docker "github.com/docker/docker/client"
+	"github.com/docker/docker/errdefs"
+	"github.com/docker/docker/pkg/stdcopy"
 	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+
+	"github.com/simiotics/shnorky/state"
 )
 
 // ErrEmptyBuildID signifies that a caller attempted to create execution metadata in which the
 // BuildID string was the empty string
 var ErrEmptyBuildID = errors.New("BuildID must be a non-empty string")
 
+// ExecutionPollInterval is the amount of time WaitForExecution waits between consecutive
+// inspections of a running execution container
+var ExecutionPollInterval = time.Second
+
+// ExecutionFailedError - signifies that the container of an execution exited with a non-zero code
+type ExecutionFailedError struct {
+	ExecutionID string
+	ComponentID string
+	// Step is the step of the flow run that the execution represents, if any
+	Step      string
+	ExitCode  int
+	OOMKilled bool
+}
+
+// NewExecutionFailedError creates an ExecutionFailedError for the given (finished) execution
+func NewExecutionFailedError(executionMetadata ExecutionMetadata) *ExecutionFailedError {
+	failedErr := &ExecutionFailedError{
+		ExecutionID: executionMetadata.ID,
+		ComponentID: executionMetadata.ComponentID,
+		Step:        executionMetadata.Step,
+		OOMKilled:   executionMetadata.OOMKilled,
+	}
+	if executionMetadata.ExitCode != nil {
+		failedErr.ExitCode = *executionMetadata.ExitCode
+	}
+	return failedErr
+}
+
+func (err *ExecutionFailedError) Error() string {
+	subject := fmt.Sprintf("component (%s)", err.ComponentID)
+	if err.Step != "" {
+		subject = fmt.Sprintf("step (%s)", err.Step)
+	}
+	message := fmt.Sprintf("Container (%s) for %s exited with non-zero code: %d", err.ExecutionID, subject, err.ExitCode)
+	if err.OOMKilled {
+		message += " (it was killed for running out of memory)"
+	}
+	return message
+}
+
 // ExecutionMetadata - the metadata about a component build execution that gets stored in the state database
 type ExecutionMetadata struct {
 	ID          string    `json:"id"`
 	BuildID     string    `json:"build_id"`
 	ComponentID string    `json:"component_id"`
 	CreatedAt   time.Time `json:"created_at"`
+	CreatedBy   string    `json:"created_by"`
 	FlowID      string    `json:"flow_id"`
+	FlowRunID   string    `json:"flow_run_id"`
+	Step        string    `json:"step"`
+	// Attempt is the number of the attempt at its flow step that the execution represents (starting
+	// at 1), and PreviousAttemptID is the execution of the step that it retried, if any
+	Attempt           int    `json:"attempt,omitempty"`
+	PreviousAttemptID string `json:"previous_attempt_id,omitempty"`
+	// The following members are only populated once the execution container has finished running
+	ExitCode   *int       `json:"exit_code"`
+	OOMKilled  bool       `json:"oom_killed"`
+	Error      string     `json:"error"`
+	FinishedAt *time.Time `json:"finished_at"`
+	ResourceUsage
 }
 
 // GenerateExecutionMetadata creates an ExecutionMetadata instance representing a potential
@@ -45,70 +106,134 @@ func GenerateExecutionMetadata(build BuildMetadata, flowID string) (ExecutionMet
 		return ExecutionMetadata{}, err
 	}
 
-	return ExecutionMetadata{ID: executionID.String(), BuildID: build.ID, ComponentID: build.ComponentID, CreatedAt: createdAt, FlowID: flowID}, nil
+	return ExecutionMetadata{ID: executionID.String(), BuildID: build.ID, ComponentID: build.ComponentID, CreatedAt: createdAt, CreatedBy: state.CurrentUser(), FlowID: flowID}, nil
+}
+
+// ExecutionLabels returns the docker labels which identify the container for the given execution,
+// along with the flow run and step (if any) that it belongs to, and DockerLabels
+func ExecutionLabels(executionMetadata ExecutionMetadata) map[string]string {
+	labels := map[string]string{ExecutionIDLabel: executionMetadata.ID, "shnorky.build_id": executionMetadata.BuildID}
+	if executionMetadata.FlowID != "" {
+		labels["shnorky.flow_id"] = executionMetadata.FlowID
+	}
+	if executionMetadata.FlowRunID != "" {
+		labels["shnorky.flow_run_id"] = executionMetadata.FlowRunID
+	}
+	if executionMetadata.Step != "" {
+		labels["shnorky.step"] = executionMetadata.Step
+	}
+	return WithDockerLabels(labels)
 }
 
-// Execute runs a container corresponding to the given build of the given component.
+// Execute runs a container corresponding to the given build of the given component. If the
+// execution is part of a flow run, flowID, flowRunID, and step identify the flow, the run, and the
+// step in the flow that the execution represents. Otherwise, they should be empty strings. The
+// remaining arguments are described on the corresponding members of ExecuteOptions.
+// Execute is equivalent to ExecuteWithOptions with the corresponding options, which new callers
+// should prefer.
 // TODO(nkashy1): Maybe take build metadata instead of build ID? This will reduce the number of
 // database lookups that happen in flow execution.
 func Execute(
 	ctx context.Context,
-	db *sql.DB,
+	store state.Store,
 	dockerClient *docker.Client,
 	buildID string,
 	flowID string,
+	flowRunID string,
+	step string,
 	mounts []MountConfiguration,
 	env map[string]string,
+	workdir string,
+	network string,
+	stdin io.Reader,
 ) (ExecutionMetadata, error) {
-	inverseMounts := map[string]int{}
-	for i, mountConfig := range mounts {
-		inverseMounts[mountConfig.Target] = i
-	}
+	return ExecuteWithOptions(
+		ctx,
+		store,
+		dockerClient,
+		WithBuild(buildID),
+		WithFlowRun(flowID, flowRunID, step),
+		WithMounts(mounts...),
+		WithEnv(env),
+		WithWorkdir(workdir),
+		WithNetwork(network),
+		WithStdin(stdin),
+	)
+}
 
-	buildMetadata, err := SelectBuildByID(db, buildID)
+// execute implements ExecuteWithOptions for the given (complete) options
+func execute(ctx context.Context, store state.Store, dockerClient *docker.Client, options ExecuteOptions) (ExecutionMetadata, error) {
+	buildMetadata, err := SelectBuildByID(store, options.BuildID)
 	if err != nil {
-		return ExecutionMetadata{}, fmt.Errorf("Error retrieving build metadata for build ID (%s) from state database: %s", buildID, err.Error())
+		return ExecutionMetadata{}, fmt.Errorf("Error retrieving build metadata for build ID (%s) from state database: %w", options.BuildID, err)
 	}
 
-	executionMetadata, err := GenerateExecutionMetadata(buildMetadata, flowID)
+	executionMetadata, err := GenerateExecutionMetadata(buildMetadata, options.FlowID)
 	if err != nil {
-		return ExecutionMetadata{}, fmt.Errorf("Error generating execution metadata for build (%s): %s", buildMetadata.ID, err.Error())
+		return ExecutionMetadata{}, fmt.Errorf("Error generating execution metadata for build (%s): %w", buildMetadata.ID, err)
 	}
+	executionMetadata.FlowRunID = options.FlowRunID
+	executionMetadata.Step = options.Step
+	executionMetadata.Attempt = options.Attempt
+	executionMetadata.PreviousAttemptID = options.PreviousAttemptID
 
-	componentMetadata, err := SelectComponentByID(db, buildMetadata.ComponentID)
+	componentMetadata, err := SelectComponentByID(store, buildMetadata.ComponentID)
 	if err != nil {
-		return executionMetadata, fmt.Errorf("Error retrieving component metadata for component ID (%s) from state database: %s", buildMetadata.ComponentID, err.Error())
+		return executionMetadata, fmt.Errorf("Error retrieving component metadata for component ID (%s) from state database: %w", buildMetadata.ComponentID, err)
 	}
 
-	specFile, err := os.Open(componentMetadata.SpecificationPath)
+	specFile, err := OpenComponentSpecification(componentMetadata)
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Could not open specification file (%s): %w", componentMetadata.SpecificationPath, err)
+	}
 	defer specFile.Close()
 	rawSpecification, err := ReadSingleSpecification(specFile)
 	if err != nil {
-		return executionMetadata, fmt.Errorf("Could not open specification file (%s): %s", componentMetadata.SpecificationPath, err.Error())
+		return executionMetadata, fmt.Errorf("Could not parse specification from specification file (%s): %w", componentMetadata.SpecificationPath, err)
 	}
 
 	specification, err := MaterializeComponentSpecification(rawSpecification)
 	if err != nil {
-		return executionMetadata, fmt.Errorf("Could not materialize component specification: %s", err.Error())
+		return executionMetadata, fmt.Errorf("Could not materialize component specification: %w", err)
 	}
 
+	mounts, err := ApplyDefaultMounts(specification, componentMetadata.ComponentPath, options.Mounts)
+	if err != nil {
+		return executionMetadata, err
+	}
+	inverseMounts := map[string]int{}
+	for i, mountConfig := range mounts {
+		inverseMounts[mountConfig.Target] = i
+	}
+
+	labels := map[string]string{CleanupLabel: options.Cleanup}
+	for key, value := range options.Labels {
+		labels[key] = value
+	}
+	for key, value := range ExecutionLabels(executionMetadata) {
+		labels[key] = value
+	}
 	containerConfig := &dockerContainer.Config{
-		Cmd:   specification.Run.Cmd,
-		Image: buildMetadata.ID,
+		Cmd:    specification.Run.Cmd,
+		Image:  buildMetadata.ID,
+		Labels: labels,
 	}
 
 	containerConfig.Env = make([]string, len(specification.Run.Env))
 	i := 0
-	// finalEnv is formed by merging the env argument to this function over the env specified
+	// finalEnv is formed by merging the env option over the env specified
 	// in the component specification. This determines the environment variables that get set
 	// for the execution container.
 	finalEnv := map[string]string{}
 	for key, value := range specification.Run.Env {
 		finalEnv[key] = value
 	}
-	for key, value := range env {
+	for key, value := range options.Env {
 		finalEnv[key] = value
 	}
+	for _, key := range specification.Run.Sensitive {
+		MarkSensitive(finalEnv[key])
+	}
 	for key, value := range finalEnv {
 		containerConfig.Env[i] = fmt.Sprintf("%s=%s", key, value)
 		i++
@@ -116,8 +241,58 @@ func Execute(
 
 	containerConfig.User = specification.Run.User
 
+	containerConfig.WorkingDir = specification.Run.Workdir
+	if options.Workdir != "" {
+		containerConfig.WorkingDir = options.Workdir
+	}
+
+	if options.Stdin != nil {
+		containerConfig.AttachStdin = true
+		containerConfig.OpenStdin = true
+		containerConfig.StdinOnce = true
+	}
+
+	shmSize, err := ParseShmSize(specification.Run.ShmSize)
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Could not parse shm_size (%s): %w", specification.Run.ShmSize, err)
+	}
+
 	hostConfig := &dockerContainer.HostConfig{
-		Mounts: make([]dockerMount.Mount, len(inverseMounts)),
+		Mounts:     make([]dockerMount.Mount, len(inverseMounts)),
+		Privileged: specification.Run.Privileged,
+		ShmSize:    shmSize,
+	}
+
+	hostConfig.Devices = make([]dockerContainer.DeviceMapping, len(specification.Run.Devices))
+	for i, device := range specification.Run.Devices {
+		deviceMapping, err := ParseDeviceMapping(device)
+		if err != nil {
+			return executionMetadata, fmt.Errorf("Could not parse device (%s): %w", device, err)
+		}
+		hostConfig.Devices[i] = deviceMapping
+	}
+
+	hostConfig.Ulimits, err = ParseUlimits(specification.Run.Ulimits)
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Could not parse ulimits: %w", err)
+	}
+
+	containerConfig.ExposedPorts, hostConfig.PortBindings, err = ParsePorts(specification.Run.Ports)
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Could not parse ports: %w", err)
+	}
+
+	containerConfig.Healthcheck, err = ParseHealthcheck(specification.Run.Healthcheck)
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Could not parse healthcheck: %w", err)
+	}
+
+	hostConfig.RestartPolicy, err = ParseRestartPolicy(specification.Run.RestartPolicy)
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Could not parse restart_policy (%s): %w", specification.Run.RestartPolicy, err)
+	}
+	if !hostConfig.RestartPolicy.IsNone() && componentMetadata.ComponentType != Service {
+		return executionMetadata, ErrRestartPolicyForTask
 	}
 
 	currentMount := 0
@@ -142,21 +317,282 @@ func Execute(
 			currentMount++
 		}
 	}
+	hostConfig.Mounts = hostConfig.Mounts[:currentMount]
+
+	// The scratch mountpoint is reserved, and the source of a service in development is mounted at
+	// its dev mountpoint (see DevSpecification), so they are mounted even if the component does not
+	// declare them
+	for _, target := range []string{ScratchMountpoint, specification.Dev.Mountpoint} {
+		if mountsIndex, ok := inverseMounts[target]; ok && target != "" && !declaresMountpoint(specification.Run, target) {
+			hostConfig.Mounts = append(hostConfig.Mounts, dockerMount.Mount{
+				Type:   ValidMountMethods[mounts[mountsIndex].Method],
+				Source: mounts[mountsIndex].Source,
+				Target: target,
+			})
+		}
+	}
 
-	response, err := dockerClient.ContainerCreate(ctx, containerConfig, hostConfig, nil, executionMetadata.ID)
+	var networkingConfig *dockerNetwork.NetworkingConfig
+	if options.Network != "" {
+		hostConfig.NetworkMode = dockerContainer.NetworkMode(options.Network)
+		endpointSettings := &dockerNetwork.EndpointSettings{}
+		if options.Step != "" {
+			endpointSettings.Aliases = []string{options.Step}
+		}
+		networkingConfig = &dockerNetwork.NetworkingConfig{
+			EndpointsConfig: map[string]*dockerNetwork.EndpointSettings{options.Network: endpointSettings},
+		}
+	}
+
+	var response dockerContainer.ContainerCreateCreatedBody
+	retried := false
+	err = retryDocker(ctx, func() error {
+		var createErr error
+		response, createErr = dockerClient.ContainerCreate(ctx, containerConfig, hostConfig, networkingConfig, executionMetadata.ID)
+		if retried && errdefs.IsConflict(createErr) {
+			// An earlier attempt may have created the container even though its response was lost
+			info, inspectErr := dockerClient.ContainerInspect(ctx, executionMetadata.ID)
+			if inspectErr == nil {
+				response.ID = info.ID
+				return nil
+			}
+		}
+		retried = true
+		return createErr
+	})
 	if err != nil {
-		return executionMetadata, fmt.Errorf("Error creating container for build (%s): %s", buildMetadata.ID, err.Error())
+		return executionMetadata, fmt.Errorf("Error creating container for build (%s): %w", buildMetadata.ID, err)
 	}
 
-	err = InsertExecution(db, executionMetadata)
+	err = InsertExecution(store, executionMetadata)
 	if err != nil {
-		return executionMetadata, fmt.Errorf("Error inserting execution into state database: %s", err.Error())
+		return executionMetadata, fmt.Errorf("Error inserting execution into state database: %w", err)
 	}
+	Logger(ctx).WithFields(ExecutionLogFields(executionMetadata)).Info("Created execution container")
 
-	err = dockerClient.ContainerStart(ctx, response.ID, dockerTypes.ContainerStartOptions{})
+	// The digest of the image is only recorded to compare executions, so failing to inspect the
+	// image does not prevent the execution
+	imageDigest := ""
+	imageInfo, _, inspectErr := dockerClient.ImageInspectWithRaw(ctx, buildMetadata.ID)
+	if inspectErr == nil {
+		imageDigest = imageInfo.ID
+	}
+	err = InsertExecutionConfiguration(store, GenerateExecutionConfiguration(executionMetadata.ID, imageDigest, containerConfig, hostConfig))
 	if err != nil {
-		return executionMetadata, fmt.Errorf("Error starting container (ID=%s): %s", response.ID, err.Error())
+		return executionMetadata, fmt.Errorf("Error inserting execution configuration into state database: %w", err)
+	}
+
+	if options.Stdin != nil {
+		attachOptions := dockerTypes.ContainerAttachOptions{Stream: true, Stdin: true}
+		hijackedResponse, err := dockerClient.ContainerAttach(ctx, response.ID, attachOptions)
+		if err != nil {
+			return executionMetadata, fmt.Errorf("Error attaching to standard input of container (ID=%s): %w", response.ID, err)
+		}
+		defer hijackedResponse.Close()
+
+		err = retryDocker(ctx, func() error {
+			return dockerClient.ContainerStart(ctx, response.ID, dockerTypes.ContainerStartOptions{})
+		})
+		if err != nil {
+			return executionMetadata, fmt.Errorf("Error starting container (ID=%s): %w", response.ID, err)
+		}
+
+		_, err = io.Copy(hijackedResponse.Conn, options.Stdin)
+		if err != nil {
+			return executionMetadata, fmt.Errorf("Error writing to standard input of container (ID=%s): %w", response.ID, err)
+		}
+		err = hijackedResponse.CloseWrite()
+		if err != nil {
+			return executionMetadata, fmt.Errorf("Error closing standard input of container (ID=%s): %w", response.ID, err)
+		}
+
+		return executionMetadata, nil
+	}
+
+	err = retryDocker(ctx, func() error {
+		return dockerClient.ContainerStart(ctx, response.ID, dockerTypes.ContainerStartOptions{})
+	})
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Error starting container (ID=%s): %w", response.ID, err)
+	}
+
+	return executionMetadata, nil
+}
+
+// declaresMountpoint returns true if the given run specification declares the given mountpoint
+func declaresMountpoint(runSpecification RunSpecification, mountpoint string) bool {
+	for _, mountSpecification := range runSpecification.Mountpoints {
+		if mountSpecification.Mountpoint == mountpoint {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordExecutionResult populates the result members (exit code, OOM-killed flag, error message,
+// and finish time) of the given execution metadata from the given container state and stores them
+// (along with the resource usage on the execution metadata) in the state database. If the
+// container is still running, the execution metadata is returned unchanged.
+func RecordExecutionResult(store state.Store, executionMetadata ExecutionMetadata, containerState *dockerTypes.ContainerState) (ExecutionMetadata, error) {
+	if containerState == nil || containerState.Running {
+		return executionMetadata, nil
+	}
+
+	exitCode := containerState.ExitCode
+	finishedAt, err := time.Parse(time.RFC3339Nano, containerState.FinishedAt)
+	if err != nil || finishedAt.IsZero() {
+		finishedAt = time.Now()
+	}
+
+	executionMetadata.ExitCode = &exitCode
+	executionMetadata.OOMKilled = containerState.OOMKilled
+	executionMetadata.Error = containerState.Error
+	executionMetadata.FinishedAt = &finishedAt
+
+	err = UpdateExecutionResult(store, executionMetadata)
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Error recording result of execution (%s) in state database: %w", executionMetadata.ID, err)
 	}
 
 	return executionMetadata, nil
 }
+
+// WaitForExecution blocks until the container for the execution with the given executionID has
+// finished running, records its result (and the resource usage sampled while it was running) in
+// the state database, and returns the updated execution metadata. The container is then removed if
+// its cleanup policy (see ExecuteOptions) calls for it.
+func WaitForExecution(ctx context.Context, store state.Store, dockerClient *docker.Client, executionID string) (ExecutionMetadata, error) {
+	executionMetadata, err := SelectExecutionByID(store, executionID)
+	if err != nil {
+		return executionMetadata, err
+	}
+
+	statsCtx, cancelStats := context.WithCancel(ctx)
+	defer cancelStats()
+	usageChan := CollectResourceUsage(statsCtx, dockerClient, executionID)
+
+	for {
+		var info dockerTypes.ContainerJSON
+		err := retryDocker(ctx, func() error {
+			var inspectErr error
+			info, inspectErr = dockerClient.ContainerInspect(ctx, executionID)
+			return inspectErr
+		})
+		if err != nil {
+			return executionMetadata, fmt.Errorf("Error inspecting container for execution (%s): %w", executionID, err)
+		}
+		if !info.State.Running {
+			cancelStats()
+			executionMetadata.ResourceUsage = <-usageChan
+			executionMetadata, err = RecordExecutionResult(store, executionMetadata, info.State)
+			if err == nil {
+				Logger(ctx).WithFields(ExecutionLogFields(executionMetadata)).WithFields(logrus.Fields{
+					"exit_code":  *executionMetadata.ExitCode,
+					"oom_killed": executionMetadata.OOMKilled,
+				}).Info("Execution finished")
+				if info.Config != nil && cleanupRequired(info.Config.Labels[CleanupLabel], *executionMetadata.ExitCode) {
+					removeErr := dockerClient.ContainerRemove(ctx, executionID, dockerTypes.ContainerRemoveOptions{})
+					if removeErr != nil {
+						Logger(ctx).WithFields(ExecutionLogFields(executionMetadata)).WithField("error", removeErr).Warn("Could not remove execution container")
+					}
+				}
+			}
+			return executionMetadata, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return executionMetadata, ctx.Err()
+		case <-time.After(ExecutionPollInterval):
+		}
+	}
+}
+
+// InspectExecution returns the metadata for the execution with the given executionID. If the
+// execution has not yet been recorded as finished, it inspects the corresponding container and
+// records its result if it has finished since.
+func InspectExecution(ctx context.Context, store state.Store, dockerClient *docker.Client, executionID string) (ExecutionMetadata, error) {
+	executionMetadata, err := SelectExecutionByID(store, executionID)
+	if err != nil {
+		return executionMetadata, err
+	}
+	if executionMetadata.FinishedAt != nil {
+		return executionMetadata, nil
+	}
+
+	var info dockerTypes.ContainerJSON
+	err = retryDocker(ctx, func() error {
+		var inspectErr error
+		info, inspectErr = dockerClient.ContainerInspect(ctx, executionID)
+		return inspectErr
+	})
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Error inspecting container for execution (%s): %w", executionID, err)
+	}
+	if info.State != nil && info.State.Status == "created" {
+		return executionMetadata, nil
+	}
+
+	return RecordExecutionResult(store, executionMetadata, info.State)
+}
+
+// ListExecutions streams executions one by one from the given state database into the given
+// executions channel. If componentID is non-empty, only the executions of that component's builds
+// are listed. If flowRunID is non-empty, only the executions of steps in that flow run are listed.
+// Only the given page of the executions is listed. This function closes the executions channel
+// when it is finished. If the given context is cancelled, it stops listing and returns the
+// context's error, so consumers may stop reading early.
+func ListExecutions(ctx context.Context, store state.Store, executions chan<- ExecutionMetadata, componentID, flowRunID string, page Page) error {
+	defer close(executions)
+
+	return store.ListExecutions(ctx, componentID, flowRunID, page, func(record state.ExecutionRecord) error {
+		select {
+		case executions <- executionMetadataFromRecord(record):
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	})
+}
+
+// ExecutionLogTail returns (at most) the last lines lines of the combined standard output and
+// standard error of the container for the execution with the given executionID.
+func ExecutionLogTail(ctx context.Context, dockerClient *docker.Client, executionID string, lines int) ([]string, error) {
+	logsOptions := dockerTypes.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Tail: strconv.Itoa(lines)}
+	logs, err := dockerClient.ContainerLogs(ctx, executionID, logsOptions)
+	if err != nil {
+		return []string{}, fmt.Errorf("Could not retrieve logs for container (%s): %w", executionID, err)
+	}
+	defer logs.Close()
+
+	var output bytes.Buffer
+	_, err = stdcopy.StdCopy(&output, &output, logs)
+	if err != nil {
+		return []string{}, fmt.Errorf("Could not read logs for container (%s): %w", executionID, err)
+	}
+
+	trimmedOutput := strings.TrimRight(output.String(), "\n")
+	if trimmedOutput == "" {
+		return []string{}, nil
+	}
+	return strings.Split(trimmedOutput, "\n"), nil
+}
+
+// FollowExecutionLogs writes (at most) the last lines lines of the combined standard output and
+// standard error of the container for the execution with the given executionID to w, followed by
+// anything the container logs after that. It returns once the container stops or the given context
+// is cancelled.
+func FollowExecutionLogs(ctx context.Context, dockerClient *docker.Client, executionID string, lines int, w io.Writer) error {
+	logsOptions := dockerTypes.ContainerLogsOptions{ShowStdout: true, ShowStderr: true, Follow: true, Tail: strconv.Itoa(lines)}
+	logs, err := dockerClient.ContainerLogs(ctx, executionID, logsOptions)
+	if err != nil {
+		return fmt.Errorf("Could not retrieve logs for container (%s): %w", executionID, err)
+	}
+	defer logs.Close()
+
+	_, err = stdcopy.StdCopy(w, w, logs)
+	if err != nil && ctx.Err() == nil {
+		return fmt.Errorf("Could not read logs for container (%s): %w", executionID, err)
+	}
+	return nil
+}
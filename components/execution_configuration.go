@@ -0,0 +1,78 @@
+package components
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	dockerContainer "github.com/docker/docker/api/types/container"
+	dockerMount "github.com/docker/docker/api/types/mount"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// ErrNoExecutionConfiguration - signifies that no configuration was recorded for an execution
+// (e.g. because it was created before execution configurations were recorded)
+var ErrNoExecutionConfiguration = errors.New("No configuration was recorded for the specified execution")
+
+// ExecutionConfiguration - the configuration that the container of an execution was created with
+type ExecutionConfiguration struct {
+	ExecutionID string `json:"execution_id"`
+	// ImageDigest is the ID (sha256 digest) of the image of the execution. It is empty if the image
+	// could not be inspected.
+	ImageDigest string `json:"image_digest,omitempty"`
+	// Env maps the environment variables of the execution to the hex-encoded SHA256 digests of their
+	// values, so that changes to them can be detected without storing secrets in the state database
+	Env map[string]string `json:"env"`
+	// Mounts lists the mounts of the execution, in the form "<type>:<source>:<target>", sorted
+	Mounts []string `json:"mounts"`
+}
+
+// GenerateExecutionConfiguration builds the configuration record of the execution with the given
+// ID from the configuration its container is created with
+func GenerateExecutionConfiguration(executionID, imageDigest string, containerConfig *dockerContainer.Config, hostConfig *dockerContainer.HostConfig) ExecutionConfiguration {
+	configuration := ExecutionConfiguration{
+		ExecutionID: executionID,
+		ImageDigest: imageDigest,
+		Env:         map[string]string{},
+		Mounts:      []string{},
+	}
+	for _, variable := range containerConfig.Env {
+		parts := strings.SplitN(variable, "=", 2)
+		value := ""
+		if len(parts) == 2 {
+			value = parts[1]
+		}
+		digest := sha256.Sum256([]byte(value))
+		configuration.Env[parts[0]] = hex.EncodeToString(digest[:])
+	}
+	if hostConfig != nil {
+		for _, mount := range hostConfig.Mounts {
+			configuration.Mounts = append(configuration.Mounts, formatMount(mount))
+		}
+	}
+	sort.Strings(configuration.Mounts)
+	return configuration
+}
+
+func formatMount(mount dockerMount.Mount) string {
+	return fmt.Sprintf("%s:%s:%s", mount.Type, mount.Source, mount.Target)
+}
+
+// InsertExecutionConfiguration records the given execution configuration in the state database
+func InsertExecutionConfiguration(store state.Store, configuration ExecutionConfiguration) error {
+	return store.UpsertExecutionConfiguration(state.ExecutionConfigurationRecord(configuration))
+}
+
+// SelectExecutionConfiguration returns the configuration recorded for the execution with the given
+// ID, or ErrNoExecutionConfiguration if there is none
+func SelectExecutionConfiguration(store state.Store, executionID string) (ExecutionConfiguration, error) {
+	record, err := store.SelectExecutionConfiguration(executionID)
+	if err == state.ErrNotFound {
+		return ExecutionConfiguration{}, ErrNoExecutionConfiguration
+	}
+	return ExecutionConfiguration(record), err
+}
@@ -0,0 +1,233 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/state"
+	"github.com/simiotics/shnorky/tracing"
+)
+
+// Cleanup policies - what happens to the container of an execution once WaitForExecution has
+// recorded its result
+var (
+	// CleanupNever keeps the container, so that its logs and artifacts remain available
+	CleanupNever = "never"
+	// CleanupOnSuccess removes the container if it exited with code 0
+	CleanupOnSuccess = "on-success"
+	// CleanupAlways removes the container whatever its exit code
+	CleanupAlways = "always"
+)
+
+// ValidCleanupPolicies is a set (of keys) enumerating the cleanup policies that executions accept
+var ValidCleanupPolicies = map[string]bool{
+	CleanupNever:     true,
+	CleanupOnSuccess: true,
+	CleanupAlways:    true,
+}
+
+// CleanupLabel is the docker label which records the cleanup policy of an execution container
+var CleanupLabel = "shnorky.cleanup"
+
+// ExecuteOptions - configures an execution started by ExecuteWithOptions. Zero values select the
+// defaults described on each member.
+type ExecuteOptions struct {
+	// BuildID is the build to execute. If it is empty, the most recent build of ComponentID is
+	// executed instead.
+	BuildID     string
+	ComponentID string
+	// FlowID, FlowRunID, and Step identify the flow, the run, and the step in the flow that the
+	// execution represents, if it is part of a flow run
+	FlowID    string
+	FlowRunID string
+	Step      string
+	// Attempt and PreviousAttemptID record which attempt at its flow step the execution represents,
+	// and the execution of the step that it retries (see ExecutionMetadata)
+	Attempt           int
+	PreviousAttemptID string
+	// Mounts are made in addition to the default mounts of the component (see
+	// DefaultsSpecification), which are made for every mountpoint not targeted by Mounts
+	Mounts []MountConfiguration
+	// Env is merged over the env of the component's run specification
+	Env map[string]string
+	// Labels are attached to the container in addition to those which identify the execution (see
+	// ExecutionLabels), which take precedence over them
+	Labels map[string]string
+	// Workdir, if non-empty, overrides the working directory from the component specification
+	Workdir string
+	// Network, if non-empty, is the docker network that the container is attached to (rather than
+	// the default bridge network), where other containers can reach it under the name of its step
+	Network string
+	// Stdin, if non-nil, is attached to the standard input of the container, and
+	// ExecuteWithOptions only returns once Stdin has been exhausted (at which point the container's
+	// standard input is closed)
+	Stdin io.Reader
+	// Timeout, if positive, bounds the time taken to create and start the container (including
+	// writing Stdin to it)
+	Timeout time.Duration
+	// Cleanup is one of the keys of ValidCleanupPolicies. Defaults to CleanupNever.
+	Cleanup string
+}
+
+// ExecuteOption - sets a member of ExecuteOptions
+type ExecuteOption func(*ExecuteOptions)
+
+// WithBuild selects the build to execute
+func WithBuild(buildID string) ExecuteOption {
+	return func(options *ExecuteOptions) {
+		options.BuildID = buildID
+	}
+}
+
+// WithComponent selects the most recent build of the given component for execution (unless a build
+// is selected with WithBuild)
+func WithComponent(componentID string) ExecuteOption {
+	return func(options *ExecuteOptions) {
+		options.ComponentID = componentID
+	}
+}
+
+// WithFlowRun identifies the flow, the run, and the step that the execution represents
+func WithFlowRun(flowID, flowRunID, step string) ExecuteOption {
+	return func(options *ExecuteOptions) {
+		options.FlowID = flowID
+		options.FlowRunID = flowRunID
+		options.Step = step
+	}
+}
+
+// WithAttempt records the execution as the given attempt at its flow step, retrying the execution
+// with the given ID (which is empty for first attempts)
+func WithAttempt(attempt int, previousAttemptID string) ExecuteOption {
+	return func(options *ExecuteOptions) {
+		options.Attempt = attempt
+		options.PreviousAttemptID = previousAttemptID
+	}
+}
+
+// WithMounts adds the given mounts to the execution
+func WithMounts(mounts ...MountConfiguration) ExecuteOption {
+	return func(options *ExecuteOptions) {
+		options.Mounts = append(options.Mounts, mounts...)
+	}
+}
+
+// WithEnv sets the given environment variables in the execution container, overriding those set
+// by earlier options
+func WithEnv(env map[string]string) ExecuteOption {
+	return func(options *ExecuteOptions) {
+		if options.Env == nil {
+			options.Env = map[string]string{}
+		}
+		for key, value := range env {
+			options.Env[key] = value
+		}
+	}
+}
+
+// WithLabels attaches the given docker labels to the execution container, overriding those set by
+// earlier options
+func WithLabels(labels map[string]string) ExecuteOption {
+	return func(options *ExecuteOptions) {
+		if options.Labels == nil {
+			options.Labels = map[string]string{}
+		}
+		for key, value := range labels {
+			options.Labels[key] = value
+		}
+	}
+}
+
+// WithWorkdir overrides the working directory from the component specification
+func WithWorkdir(workdir string) ExecuteOption {
+	return func(options *ExecuteOptions) {
+		options.Workdir = workdir
+	}
+}
+
+// WithNetwork attaches the execution container to the docker network with the given name
+func WithNetwork(network string) ExecuteOption {
+	return func(options *ExecuteOptions) {
+		options.Network = network
+	}
+}
+
+// WithStdin attaches the given reader to the standard input of the execution container
+func WithStdin(stdin io.Reader) ExecuteOption {
+	return func(options *ExecuteOptions) {
+		options.Stdin = stdin
+	}
+}
+
+// WithTimeout bounds the time taken to create and start the execution container
+func WithTimeout(timeout time.Duration) ExecuteOption {
+	return func(options *ExecuteOptions) {
+		options.Timeout = timeout
+	}
+}
+
+// WithCleanup sets the cleanup policy (one of the keys of ValidCleanupPolicies) of the execution
+// container
+func WithCleanup(cleanup string) ExecuteOption {
+	return func(options *ExecuteOptions) {
+		options.Cleanup = cleanup
+	}
+}
+
+// cleanupRequired returns true if a container with the given cleanup policy which exited with the
+// given code should be removed
+func cleanupRequired(cleanup string, exitCode int) bool {
+	return cleanup == CleanupAlways || (cleanup == CleanupOnSuccess && exitCode == 0)
+}
+
+// NewExecuteOptions applies the given options, in order, to the default ExecuteOptions
+func NewExecuteOptions(options ...ExecuteOption) ExecuteOptions {
+	executeOptions := ExecuteOptions{Cleanup: CleanupNever}
+	for _, option := range options {
+		option(&executeOptions)
+	}
+	return executeOptions
+}
+
+// ExecuteWithOptions runs a container corresponding to the build selected by the given options (see
+// ExecuteOptions). Creating and starting the container are retried on transient docker errors
+// according to the retry policy carried by ctx (see WithDockerRetryPolicy), and are traced (see the
+// tracing package) as an "execute" span.
+func ExecuteWithOptions(ctx context.Context, store state.Store, dockerClient *docker.Client, options ...ExecuteOption) (ExecutionMetadata, error) {
+	executeOptions := NewExecuteOptions(options...)
+	if executeOptions.Cleanup == "" {
+		executeOptions.Cleanup = CleanupNever
+	}
+	if !ValidCleanupPolicies[executeOptions.Cleanup] {
+		return ExecutionMetadata{}, fmt.Errorf("Invalid cleanup policy: %s. Choose one of %s, %s, %s", executeOptions.Cleanup, CleanupNever, CleanupOnSuccess, CleanupAlways)
+	}
+
+	if executeOptions.BuildID == "" {
+		if executeOptions.ComponentID == "" {
+			return ExecutionMetadata{}, ErrEmptyBuildID
+		}
+		buildMetadata, err := SelectMostRecentBuildForComponent(store, executeOptions.ComponentID)
+		if err != nil {
+			return ExecutionMetadata{}, fmt.Errorf("Error retrieving most recent build of component (%s) from state database: %w", executeOptions.ComponentID, err)
+		}
+		executeOptions.BuildID = buildMetadata.ID
+	}
+
+	if executeOptions.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, executeOptions.Timeout)
+		defer cancel()
+	}
+
+	ctx, span := tracing.Start(ctx, "execute", map[string]string{LogFieldBuildID: executeOptions.BuildID})
+	executionMetadata, err := execute(ctx, store, dockerClient, executeOptions)
+	for key, value := range ExecutionLogFields(executionMetadata) {
+		span.SetAttribute(key, fmt.Sprintf("%v", value))
+	}
+	span.End(err)
+	return executionMetadata, err
+}
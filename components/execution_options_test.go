@@ -0,0 +1,87 @@
+package components
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewExecuteOptions(t *testing.T) {
+	stdin := strings.NewReader("input")
+	options := NewExecuteOptions(
+		WithBuild("build"),
+		WithFlowRun("flow", "run", "step"),
+		WithMounts(MountConfiguration{Source: "/tmp/a", Target: "/a", Method: "bind"}),
+		WithMounts(MountConfiguration{Source: "/tmp/b", Target: "/b", Method: "bind"}),
+		WithEnv(map[string]string{"A": "1", "B": "1"}),
+		WithEnv(map[string]string{"B": "2"}),
+		WithLabels(map[string]string{"team": "data"}),
+		WithWorkdir("/work"),
+		WithNetwork("network"),
+		WithStdin(stdin),
+		WithTimeout(time.Minute),
+		WithCleanup(CleanupOnSuccess),
+	)
+
+	expected := ExecuteOptions{
+		BuildID:   "build",
+		FlowID:    "flow",
+		FlowRunID: "run",
+		Step:      "step",
+		Mounts: []MountConfiguration{
+			{Source: "/tmp/a", Target: "/a", Method: "bind"},
+			{Source: "/tmp/b", Target: "/b", Method: "bind"},
+		},
+		Env:     map[string]string{"A": "1", "B": "2"},
+		Labels:  map[string]string{"team": "data"},
+		Workdir: "/work",
+		Network: "network",
+		Stdin:   stdin,
+		Timeout: time.Minute,
+		Cleanup: CleanupOnSuccess,
+	}
+	if !reflect.DeepEqual(options, expected) {
+		t.Errorf("Unexpected options: expected=%+v, actual=%+v", expected, options)
+	}
+
+	if defaults := NewExecuteOptions(); defaults.Cleanup != CleanupNever {
+		t.Errorf("Unexpected default cleanup policy: expected=%s, actual=%s", CleanupNever, defaults.Cleanup)
+	}
+}
+
+func TestCleanupRequired(t *testing.T) {
+	type cleanupRequiredTest struct {
+		cleanup  string
+		exitCode int
+		expected bool
+	}
+
+	tests := []cleanupRequiredTest{
+		{cleanup: "", exitCode: 0, expected: false},
+		{cleanup: CleanupNever, exitCode: 0, expected: false},
+		{cleanup: CleanupOnSuccess, exitCode: 0, expected: true},
+		{cleanup: CleanupOnSuccess, exitCode: 1, expected: false},
+		{cleanup: CleanupAlways, exitCode: 1, expected: true},
+	}
+
+	for i, test := range tests {
+		actual := cleanupRequired(test.cleanup, test.exitCode)
+		if actual != test.expected {
+			t.Errorf("[Test %d] Unexpected result: expected=%t, actual=%t", i, test.expected, actual)
+		}
+	}
+}
+
+func TestExecuteWithOptionsInvalid(t *testing.T) {
+	_, err := ExecuteWithOptions(context.Background(), nil, nil, WithBuild("build"), WithCleanup("sometimes"))
+	if err == nil {
+		t.Error("Expected error for invalid cleanup policy but received none")
+	}
+
+	_, err = ExecuteWithOptions(context.Background(), nil, nil, WithMounts())
+	if err != ErrEmptyBuildID {
+		t.Errorf("Unexpected error without build or component: expected=%v, actual=%v", ErrEmptyBuildID, err)
+	}
+}
@@ -0,0 +1,248 @@
+package components
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// GitCommand - the git executable used to fetch the repositories that components are registered
+// from
+var GitCommand = "git"
+
+// ErrNoComponentSource - signifies that a component was not registered from a git repository
+var ErrNoComponentSource = errors.New("The specified component was not registered from a git repository")
+
+// ErrInvalidSourcePath - signifies that the path of a component (or of its specification) inside a
+// git repository is absolute or points outside of the repository
+var ErrInvalidSourcePath = errors.New("Paths inside git repositories must be relative and may not leave the repository")
+
+// ComponentSource - the provenance of a component registered from a git repository: the repository
+// URL, the ref (tag, branch, or commit) and subdirectory the component was registered from, and the
+// commit that ref resolved to when it was last fetched
+type ComponentSource struct {
+	ComponentID string    `json:"component_id"`
+	URL         string    `json:"url"`
+	Ref         string    `json:"ref,omitempty"`
+	Path        string    `json:"path,omitempty"`
+	Commit      string    `json:"commit"`
+	FetchedAt   time.Time `json:"fetched_at"`
+}
+
+// git runs the git command with the given arguments and returns its (trimmed) standard output
+func git(ctx context.Context, args ...string) (string, error) {
+	command := exec.CommandContext(ctx, GitCommand, args...)
+	var stderr strings.Builder
+	command.Stderr = &stderr
+	output, err := command.Output()
+	if err != nil {
+		return "", fmt.Errorf("git %s: %s: %s", args[0], err.Error(), strings.TrimSpace(stderr.String()))
+	}
+	return strings.TrimSpace(string(output)), nil
+}
+
+// FetchGitRepository makes the given ref (a tag, branch, or commit - the default branch if empty) of
+// the git repository at the given URL available under cacheDir and returns the path of a checkout of
+// that ref along with the commit it resolved to. Each repository is mirrored once under cacheDir and
+// updated on subsequent fetches, while checkouts are kept per commit (and reused) so that components
+// registered from older commits are not affected by later fetches.
+func FetchGitRepository(ctx context.Context, cacheDir, url, ref string) (string, string, error) {
+	digest := sha256.Sum256([]byte(url))
+	repositoryDir := filepath.Join(cacheDir, hex.EncodeToString(digest[:])[:16])
+	mirrorDir := filepath.Join(repositoryDir, "mirror")
+
+	_, err := os.Stat(mirrorDir)
+	if os.IsNotExist(err) {
+		err = os.MkdirAll(repositoryDir, 0744)
+		if err != nil {
+			return "", "", err
+		}
+		_, err = git(ctx, "clone", "--quiet", "--mirror", url, mirrorDir)
+		if err != nil {
+			os.RemoveAll(mirrorDir)
+			return "", "", fmt.Errorf("Could not clone repository (%s): %w", url, err)
+		}
+	} else if err != nil {
+		return "", "", err
+	} else {
+		_, err = git(ctx, "--git-dir", mirrorDir, "fetch", "--quiet", "--prune", "--tags", "origin")
+		if err != nil {
+			return "", "", fmt.Errorf("Could not fetch repository (%s): %w", url, err)
+		}
+	}
+
+	revision := ref
+	if revision == "" {
+		revision = "HEAD"
+	}
+	commit, err := git(ctx, "--git-dir", mirrorDir, "rev-parse", "--verify", "--quiet", revision+"^{commit}")
+	if err != nil {
+		return "", "", fmt.Errorf("Could not resolve ref (%s) in repository (%s): %w", revision, url, err)
+	}
+
+	checkoutDir := filepath.Join(repositoryDir, "checkouts", commit)
+	_, err = os.Stat(checkoutDir)
+	if err == nil {
+		return checkoutDir, commit, nil
+	}
+	if !os.IsNotExist(err) {
+		return "", "", err
+	}
+	_, err = git(ctx, "--git-dir", mirrorDir, "worktree", "add", "--quiet", "--detach", checkoutDir, commit)
+	if err != nil {
+		os.RemoveAll(checkoutDir)
+		git(ctx, "--git-dir", mirrorDir, "worktree", "prune")
+		return "", "", fmt.Errorf("Could not check out commit (%s) of repository (%s): %w", commit, url, err)
+	}
+	return checkoutDir, commit, nil
+}
+
+// joinSourcePath joins the given path inside a git checkout to the checkout directory, rejecting
+// paths which are absolute or leave the checkout
+func joinSourcePath(checkoutDir, sourcePath string) (string, error) {
+	if filepath.IsAbs(sourcePath) {
+		return "", ErrInvalidSourcePath
+	}
+	cleanPath := filepath.Clean(sourcePath)
+	if cleanPath == ".." || strings.HasPrefix(cleanPath, ".."+string(filepath.Separator)) {
+		return "", ErrInvalidSourcePath
+	}
+	return filepath.Join(checkoutDir, cleanPath), nil
+}
+
+// InferGitComponentID returns the ID that a component registered from the given subdirectory of the
+// git repository at the given URL is given if no ID is specified: the name of the subdirectory, or
+// the name of the repository if the component lives at its root
+func InferGitComponentID(url, sourcePath string) string {
+	if name := filepath.Base(filepath.Clean(sourcePath)); sourcePath != "" && name != "." {
+		return name
+	}
+	name := strings.TrimRight(url, "/")
+	if index := strings.LastIndexAny(name, "/:"); index >= 0 {
+		name = name[index+1:]
+	}
+	return strings.TrimSuffix(name, ".git")
+}
+
+// AddGitComponent fetches the given ref of the git repository at the given URL (see
+// FetchGitRepository) and registers the component in the given subdirectory (sourcePath) of its
+// checkout against the given state database, recording the URL, ref, subdirectory, and commit as the
+// source of the component. The specification path, if non-empty, is relative to the root of the
+// repository. If id is empty, the ID of the component is inferred by InferGitComponentID.
+// This is the handler for `shn components create --git`
+func AddGitComponent(ctx context.Context, store state.Store, cacheDir, id, componentType, url, ref, sourcePath, specificationPath string) (ComponentMetadata, error) {
+	if id == "" {
+		id = InferGitComponentID(url, sourcePath)
+	}
+
+	checkoutDir, commit, err := FetchGitRepository(ctx, cacheDir, url, ref)
+	if err != nil {
+		return ComponentMetadata{}, err
+	}
+	componentPath, err := joinSourcePath(checkoutDir, sourcePath)
+	if err != nil {
+		return ComponentMetadata{}, err
+	}
+	info, err := os.Stat(componentPath)
+	if err != nil {
+		return ComponentMetadata{}, fmt.Errorf("Could not find component directory (%s) at commit (%s): %w", sourcePath, commit, err)
+	}
+	if !info.IsDir() {
+		return ComponentMetadata{}, fmt.Errorf("Component path (%s) at commit (%s) is not a directory", sourcePath, commit)
+	}
+	if specificationPath != "" {
+		specificationPath, err = joinSourcePath(checkoutDir, specificationPath)
+		if err != nil {
+			return ComponentMetadata{}, err
+		}
+	}
+
+	component, err := AddComponent(store, id, componentType, componentPath, specificationPath)
+	if err != nil {
+		return component, err
+	}
+
+	source := ComponentSource{
+		ComponentID: id,
+		URL:         url,
+		Ref:         ref,
+		Path:        sourcePath,
+		Commit:      commit,
+		FetchedAt:   time.Now(),
+	}
+	err = insertComponentSource(store, source)
+	if err != nil {
+		DeleteComponentByID(store, id)
+		return component, err
+	}
+	component.Source = &source
+	return component, nil
+}
+
+// RefreshGitComponent fetches the ref that the component with the given ID was registered from
+// again and, if it now resolves to a different commit, points the component at the checkout of that
+// commit. Returns ErrNoComponentSource if the component was not registered from a git repository.
+// This is the handler for `shn components refresh`
+func RefreshGitComponent(ctx context.Context, store state.Store, cacheDir, id string) (ComponentMetadata, error) {
+	component, err := SelectComponentByID(store, id)
+	if err != nil {
+		return component, err
+	}
+	source, err := SelectComponentSource(store, id)
+	if err != nil {
+		return component, err
+	}
+
+	checkoutDir, commit, err := FetchGitRepository(ctx, cacheDir, source.URL, source.Ref)
+	if err != nil {
+		return component, err
+	}
+	source.FetchedAt = time.Now()
+	if commit != source.Commit {
+		componentPath, err := joinSourcePath(checkoutDir, source.Path)
+		if err != nil {
+			return component, err
+		}
+		// The specification keeps its position relative to the component directory
+		relativeSpecificationPath, err := filepath.Rel(component.ComponentPath, component.SpecificationPath)
+		if err != nil {
+			return component, err
+		}
+		component.ComponentPath = componentPath
+		component.SpecificationPath = filepath.Join(componentPath, relativeSpecificationPath)
+		component.SpecificationChecksum, component.SpecificationSnapshot = SnapshotSpecification(component.SpecificationPath)
+		err = UpdateComponent(store, component)
+		if err != nil {
+			return component, err
+		}
+		source.Commit = commit
+	}
+
+	err = insertComponentSource(store, source)
+	component.Source = &source
+	return component, err
+}
+
+// insertComponentSource records (or replaces) the source of a component in the given state database
+func insertComponentSource(store state.Store, source ComponentSource) error {
+	return store.UpsertComponentSource(state.ComponentSourceRecord(source))
+}
+
+// SelectComponentSource returns the source of the component with the given ID. Returns
+// ErrNoComponentSource if the component was not registered from a git repository.
+func SelectComponentSource(store state.Store, id string) (ComponentSource, error) {
+	record, err := store.SelectComponentSource(id)
+	if err == state.ErrNotFound {
+		return ComponentSource{}, ErrNoComponentSource
+	}
+	return ComponentSource(record), err
+}
@@ -0,0 +1,200 @@
+package components
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// commitFiles writes the given files into the git repository at repositoryDir and commits them,
+// returning the commit
+func commitFiles(t *testing.T, repositoryDir string, files map[string]string) string {
+	for name, contents := range files {
+		filePath := filepath.Join(repositoryDir, name)
+		err := os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(filePath, []byte(contents), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Could not write file (%s): %s", name, err.Error())
+		}
+	}
+	runGit(t, repositoryDir, "add", "-A")
+	runGit(t, repositoryDir, "commit", "--quiet", "-m", "Update")
+	return runGit(t, repositoryDir, "rev-parse", "HEAD")
+}
+
+func runGit(t *testing.T, dir string, args ...string) string {
+	command := exec.Command("git", append([]string{"-c", "user.name=test", "-c", "user.email=test@example.com"}, args...)...)
+	command.Dir = dir
+	output, err := command.CombinedOutput()
+	if err != nil {
+		t.Fatalf("git %s failed: %s: %s", args[0], err.Error(), strings.TrimSpace(string(output)))
+	}
+	return strings.TrimSpace(string(output))
+}
+
+func TestGitComponents(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git is not available")
+	}
+
+	tempDir, err := ioutil.TempDir("", "shnorky-git-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+
+	stateDir := path.Join(tempDir, "state")
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", err.Error())
+	}
+	db, err := sql.Open("sqlite3", path.Join(stateDir, state.DBFileName))
+	if err != nil {
+		t.Fatalf("Error opening state database: %s", err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	cacheDir := path.Join(stateDir, state.GitDirName)
+
+	repositoryDir := filepath.Join(tempDir, "components.git")
+	err = os.MkdirAll(repositoryDir, 0755)
+	if err != nil {
+		t.Fatalf("Could not create repository directory: %s", err.Error())
+	}
+	runGit(t, repositoryDir, "init", "--quiet")
+	firstCommit := commitFiles(t, repositoryDir, map[string]string{
+		"jobs/extract/component.json": `{"build": {}, "run": {}}`,
+		"jobs/extract/VERSION":        "1",
+	})
+	runGit(t, repositoryDir, "tag", "v1")
+	runGit(t, repositoryDir, "branch", "stable")
+	secondCommit := commitFiles(t, repositoryDir, map[string]string{"jobs/extract/VERSION": "2"})
+
+	ctx := context.Background()
+
+	type addTestCase struct {
+		id             string
+		ref            string
+		sourcePath     string
+		expectedID     string
+		expectedCommit string
+		expectedError  bool
+	}
+
+	addTestCases := []addTestCase{
+		{"", "v1", "jobs/extract", "extract", firstCommit, false},
+		{"extract-latest", "", "jobs/extract", "extract-latest", secondCommit, false},
+		{"extract-stable", "stable", "jobs/extract/", "extract-stable", firstCommit, false},
+		{"extract-commit", secondCommit, "jobs/extract", "extract-commit", secondCommit, false},
+		{"missing-ref", "v2", "jobs/extract", "", "", true},
+		{"missing-path", "v1", "jobs/load", "", "", true},
+		{"outside", "v1", "../jobs/extract", "", "", true},
+	}
+
+	for i, tc := range addTestCases {
+		component, err := AddGitComponent(ctx, store, cacheDir, tc.id, Task, repositoryDir, tc.ref, tc.sourcePath, "")
+		if tc.expectedError {
+			if err == nil {
+				t.Errorf("[Test %d] Expected error but did not get one", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[Test %d] Unexpected error: %s", i, err.Error())
+			continue
+		}
+		if component.ID != tc.expectedID {
+			t.Errorf("[Test %d] Unexpected ID: expected=%s, actual=%s", i, tc.expectedID, component.ID)
+		}
+		version, err := ioutil.ReadFile(filepath.Join(component.ComponentPath, "VERSION"))
+		if err != nil {
+			t.Errorf("[Test %d] Could not read file from component directory: %s", i, err.Error())
+		}
+		expectedVersion := "1"
+		if tc.expectedCommit == secondCommit {
+			expectedVersion = "2"
+		}
+		if string(version) != expectedVersion {
+			t.Errorf("[Test %d] Unexpected checkout: expected VERSION=%s, actual VERSION=%s", i, expectedVersion, string(version))
+		}
+
+		source, err := SelectComponentSource(store, component.ID)
+		if err != nil {
+			t.Errorf("[Test %d] Could not select component source: %s", i, err.Error())
+			continue
+		}
+		if source.URL != repositoryDir || source.Ref != tc.ref || source.Path != tc.sourcePath || source.Commit != tc.expectedCommit {
+			t.Errorf("[Test %d] Unexpected source: %v", i, source)
+		}
+	}
+
+	_, err = AddComponent(store, "local", Task, filepath.Join(repositoryDir, "jobs", "extract"), "")
+	if err != nil {
+		t.Fatalf("Could not register component: %s", err.Error())
+	}
+	_, err = SelectComponentSource(store, "local")
+	if err != ErrNoComponentSource {
+		t.Errorf("Unexpected error selecting source of local component: expected=%v, actual=%v", ErrNoComponentSource, err)
+	}
+	_, err = RefreshGitComponent(ctx, store, cacheDir, "local")
+	if err != ErrNoComponentSource {
+		t.Errorf("Unexpected error refreshing local component: expected=%v, actual=%v", ErrNoComponentSource, err)
+	}
+
+	// Moving the stable branch forward is picked up by a refresh, while the tagged component stays
+	// where it is
+	runGit(t, repositoryDir, "branch", "--force", "stable", secondCommit)
+
+	type refreshTestCase struct {
+		id             string
+		expectedCommit string
+	}
+
+	refreshTestCases := []refreshTestCase{
+		{"extract", firstCommit},
+		{"extract-stable", secondCommit},
+	}
+
+	for i, tc := range refreshTestCases {
+		component, err := RefreshGitComponent(ctx, store, cacheDir, tc.id)
+		if err != nil {
+			t.Errorf("[Test %d] Unexpected error: %s", i, err.Error())
+			continue
+		}
+		if component.Source == nil || component.Source.Commit != tc.expectedCommit {
+			t.Errorf("[Test %d] Unexpected source after refresh: %v", i, component.Source)
+		}
+
+		registered, err := SelectComponentByID(store, tc.id)
+		if err != nil {
+			t.Errorf("[Test %d] Could not select component: %s", i, err.Error())
+			continue
+		}
+		if !strings.Contains(registered.ComponentPath, tc.expectedCommit) {
+			t.Errorf("[Test %d] Component path (%s) does not point at commit (%s)", i, registered.ComponentPath, tc.expectedCommit)
+		}
+		if registered.SpecificationPath != filepath.Join(registered.ComponentPath, DefaultSpecificationFileName) {
+			t.Errorf("[Test %d] Unexpected specification path: %s", i, registered.SpecificationPath)
+		}
+	}
+
+	err = RemoveComponent(store, "extract")
+	if err != nil {
+		t.Fatalf("Could not remove component: %s", err.Error())
+	}
+	_, err = SelectComponentSource(store, "extract")
+	if err != ErrNoComponentSource {
+		t.Errorf("Source of removed component was not removed: %v", err)
+	}
+}
@@ -0,0 +1,83 @@
+package components
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// Types of resources which can be labelled
+var (
+	LabelledComponent = state.LabelledComponent
+	LabelledFlow      = state.LabelledFlow
+)
+
+// ErrInvalidLabel signifies that a caller attempted to use a label whose key is not a valid label
+// key or whose value contains a comma or a newline
+var ErrInvalidLabel = errors.New("Label keys must consist of letters, digits, \".\", \"_\", \"-\", and \"/\" (starting with a letter or digit), and label values may not contain commas or newlines")
+
+var labelKeyPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._/-]*$`)
+
+// ParseLabels parses labels given as "key=value" strings (e.g. through --label flags) into a map
+// from keys to values
+func ParseLabels(rawLabels []string) (map[string]string, error) {
+	labels := map[string]string{}
+	for _, rawLabel := range rawLabels {
+		keyValue := strings.SplitN(rawLabel, "=", 2)
+		if len(keyValue) != 2 {
+			return labels, fmt.Errorf("Invalid label (expected key=value): %s", rawLabel)
+		}
+		labels[keyValue[0]] = keyValue[1]
+	}
+	return labels, ValidateLabels(labels)
+}
+
+// ValidateLabels returns ErrInvalidLabel if any of the given labels is invalid, and nil otherwise
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !labelKeyPattern.MatchString(key) || strings.ContainsAny(value, ",\n") {
+			return ErrInvalidLabel
+		}
+	}
+	return nil
+}
+
+// SetLabels replaces the labels of the resource of the given type (LabelledComponent or
+// LabelledFlow) with the given ID in the given state database
+func SetLabels(store state.Store, resourceType, resourceID string, labels map[string]string) error {
+	err := ValidateLabels(labels)
+	if err != nil {
+		return err
+	}
+	return store.SetLabels(resourceType, resourceID, labels)
+}
+
+// Labels returns the labels of the resource of the given type with the given ID
+func Labels(store state.Store, resourceType, resourceID string) (map[string]string, error) {
+	return store.SelectLabels(resourceType, resourceID)
+}
+
+// MatchesLabels returns true if the given labels include every one of the labels in the given
+// selector
+func MatchesLabels(labels, selector map[string]string) bool {
+	for key, value := range selector {
+		if actual, ok := labels[key]; !ok || actual != value {
+			return false
+		}
+	}
+	return true
+}
+
+// FormatLabels renders the given labels as comma-separated "key=value" pairs, sorted by key
+func FormatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for key, value := range labels {
+		pairs = append(pairs, key+"="+value)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
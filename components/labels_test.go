@@ -0,0 +1,147 @@
+package components
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestParseLabels(t *testing.T) {
+	type parseLabelsTest struct {
+		rawLabels    []string
+		expected     map[string]string
+		returnsError bool
+	}
+
+	tests := []parseLabelsTest{
+		{rawLabels: []string{}, expected: map[string]string{}},
+		{rawLabels: []string{"team=data", "role=extract"}, expected: map[string]string{"team": "data", "role": "extract"}},
+		{rawLabels: []string{"example.com/owner=alice", "query=a=b"}, expected: map[string]string{"example.com/owner": "alice", "query": "a=b"}},
+		{rawLabels: []string{"empty="}, expected: map[string]string{"empty": ""}},
+		{rawLabels: []string{"team"}, returnsError: true},
+		{rawLabels: []string{"=data"}, returnsError: true},
+		{rawLabels: []string{"team name=data"}, returnsError: true},
+		{rawLabels: []string{"teams=data,ops"}, returnsError: true},
+	}
+
+	for i, test := range tests {
+		labels, err := ParseLabels(test.rawLabels)
+		if test.returnsError {
+			if err == nil {
+				t.Errorf("[Test %d] No error was returned but one was expected", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+			continue
+		}
+		if FormatLabels(labels) != FormatLabels(test.expected) {
+			t.Errorf("[Test %d] Unexpected labels: expected=%v, actual=%v", i, test.expected, labels)
+		}
+	}
+}
+
+func TestLabels(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-labels-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	createdAt := time.Unix(1577836800, 0)
+	componentLabels := map[string]map[string]string{
+		"extract":    {"team": "data", "role": "extract"},
+		"transform":  {"team": "data", "role": "transform"},
+		"alerts":     {"team": "ops"},
+		"unlabelled": {},
+	}
+	for i, componentID := range []string{"extract", "transform", "alerts", "unlabelled"} {
+		err = InsertComponent(store, ComponentMetadata{ID: componentID, ComponentType: Task, CreatedAt: createdAt.Add(time.Duration(i) * time.Second)})
+		if err != nil {
+			t.Fatalf("Error inserting component: %s", err.Error())
+		}
+		err = SetLabels(store, LabelledComponent, componentID, componentLabels[componentID])
+		if err != nil {
+			t.Fatalf("Error setting labels of component (%s): %s", componentID, err.Error())
+		}
+	}
+	// Flows may share IDs with components without sharing their labels
+	err = SetLabels(store, LabelledFlow, "extract", map[string]string{"team": "flows"})
+	if err != nil {
+		t.Fatalf("Error setting labels of flow: %s", err.Error())
+	}
+
+	labels, err := Labels(store, LabelledComponent, "extract")
+	if err != nil {
+		t.Fatalf("Error reading labels: %s", err.Error())
+	}
+	if FormatLabels(labels) != "role=extract,team=data" {
+		t.Errorf("Unexpected labels of component (extract): %v", labels)
+	}
+
+	err = SetLabels(store, LabelledComponent, "transform", map[string]string{"team": "data", "role": "load"})
+	if err != nil {
+		t.Fatalf("Error replacing labels: %s", err.Error())
+	}
+	componentLabels["transform"] = map[string]string{"team": "data", "role": "load"}
+
+	type selectorTest struct {
+		selector    map[string]string
+		expectedIDs []string
+	}
+
+	tests := []selectorTest{
+		{selector: map[string]string{}, expectedIDs: []string{"extract", "transform", "alerts", "unlabelled"}},
+		{selector: map[string]string{"team": "data"}, expectedIDs: []string{"extract", "transform"}},
+		{selector: map[string]string{"team": "data", "role": "load"}, expectedIDs: []string{"transform"}},
+		{selector: map[string]string{"team": "data", "role": "transform"}, expectedIDs: []string{}},
+		{selector: map[string]string{"team": "flows"}, expectedIDs: []string{}},
+		{selector: map[string]string{"owner": "alice"}, expectedIDs: []string{}},
+	}
+
+	for i, test := range tests {
+		componentsChan := make(chan ComponentMetadata)
+		go ListComponents(context.Background(), store, componentsChan, ComponentFilter{Labels: test.selector}, Page{})
+		componentIDs := []string{}
+		for component := range componentsChan {
+			componentIDs = append(componentIDs, component.ID)
+			if FormatLabels(component.Labels) != FormatLabels(componentLabels[component.ID]) {
+				t.Errorf("[Test %d] Unexpected labels on listed component (%s): expected=%v, actual=%v", i, component.ID, componentLabels[component.ID], component.Labels)
+			}
+		}
+		if fmt.Sprint(componentIDs) != fmt.Sprint(test.expectedIDs) {
+			t.Errorf("[Test %d] Unexpected components: expected=%v, actual=%v", i, test.expectedIDs, componentIDs)
+		}
+	}
+
+	err = RemoveComponent(store, "extract")
+	if err != nil {
+		t.Fatalf("Error removing component: %s", err.Error())
+	}
+	labels, err = Labels(store, LabelledComponent, "extract")
+	if err != nil || len(labels) != 0 {
+		t.Errorf("Labels of removed component were not removed: labels=%v, err=%v", labels, err)
+	}
+}
@@ -0,0 +1,78 @@
+package components
+
+import (
+	"context"
+	"io/ioutil"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Names of the fields which correlate log entries with the flows, runs, steps, builds, and
+// executions they concern
+var (
+	LogFieldFlowID      = "flow_id"
+	LogFieldRunID       = "run_id"
+	LogFieldStep        = "step"
+	LogFieldComponentID = "component_id"
+	LogFieldBuildID     = "build_id"
+	LogFieldExecutionID = "execution_id"
+)
+
+// Log is the logger to which builds and executions (including those of flow runs) are reported.
+// By default, its entries are discarded; the shn CLI replaces it with its own logger.
+var Log logrus.FieldLogger = discardLogger()
+
+func discardLogger() *logrus.Logger {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	return log
+}
+
+type logFieldsKey struct{}
+
+// WithLogFields returns a copy of the given context which carries the given log fields, in addition
+// to (and overriding) any it already carries. Logger attaches them to the entries it logs.
+func WithLogFields(ctx context.Context, fields logrus.Fields) context.Context {
+	merged := logrus.Fields{}
+	for key, value := range LogFieldsFromContext(ctx) {
+		merged[key] = value
+	}
+	for key, value := range fields {
+		merged[key] = value
+	}
+	return context.WithValue(ctx, logFieldsKey{}, merged)
+}
+
+// LogFieldsFromContext returns the log fields carried by the given context (see WithLogFields)
+func LogFieldsFromContext(ctx context.Context) logrus.Fields {
+	fields, ok := ctx.Value(logFieldsKey{}).(logrus.Fields)
+	if !ok {
+		return logrus.Fields{}
+	}
+	return fields
+}
+
+// Logger returns Log with the log fields carried by the given context attached
+func Logger(ctx context.Context) logrus.FieldLogger {
+	return Log.WithFields(LogFieldsFromContext(ctx))
+}
+
+// ExecutionLogFields returns the fields which correlate log entries with the given execution (and
+// the flow run and step it belongs to, if any)
+func ExecutionLogFields(executionMetadata ExecutionMetadata) logrus.Fields {
+	fields := logrus.Fields{
+		LogFieldComponentID: executionMetadata.ComponentID,
+		LogFieldBuildID:     executionMetadata.BuildID,
+		LogFieldExecutionID: executionMetadata.ID,
+	}
+	if executionMetadata.FlowID != "" {
+		fields[LogFieldFlowID] = executionMetadata.FlowID
+	}
+	if executionMetadata.FlowRunID != "" {
+		fields[LogFieldRunID] = executionMetadata.FlowRunID
+	}
+	if executionMetadata.Step != "" {
+		fields[LogFieldStep] = executionMetadata.Step
+	}
+	return fields
+}
@@ -0,0 +1,51 @@
+package components
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestLogger(t *testing.T) {
+	var buffer bytes.Buffer
+	log := logrus.New()
+	log.SetOutput(&buffer)
+	log.SetFormatter(&logrus.JSONFormatter{})
+
+	originalLog := Log
+	Log = log
+	defer func() { Log = originalLog }()
+
+	ctx := WithLogFields(context.Background(), logrus.Fields{LogFieldFlowID: "flow", LogFieldRunID: "run"})
+	ctx = WithLogFields(ctx, logrus.Fields{LogFieldRunID: "other-run"})
+	execution := ExecutionMetadata{ID: "execution", BuildID: "build", ComponentID: "component", FlowID: "flow", FlowRunID: "other-run", Step: "step"}
+	Logger(ctx).WithFields(ExecutionLogFields(execution)).Info("Created execution container")
+
+	var entry map[string]interface{}
+	err := json.Unmarshal(buffer.Bytes(), &entry)
+	if err != nil {
+		t.Fatalf("Could not parse log entry (%s): %s", buffer.String(), err.Error())
+	}
+
+	expectedFields := map[string]string{
+		LogFieldFlowID:      "flow",
+		LogFieldRunID:       "other-run",
+		LogFieldStep:        "step",
+		LogFieldComponentID: "component",
+		LogFieldBuildID:     "build",
+		LogFieldExecutionID: "execution",
+		"msg":               "Created execution container",
+	}
+	for key, expected := range expectedFields {
+		if entry[key] != expected {
+			t.Errorf("Unexpected value for log field (%s): expected=%s, actual=%v", key, expected, entry[key])
+		}
+	}
+
+	if len(LogFieldsFromContext(context.Background())) != 0 {
+		t.Errorf("Expected no log fields in a context which does not carry any")
+	}
+}
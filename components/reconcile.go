@@ -0,0 +1,163 @@
+package components
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// ExecutionIDLabel is the docker label which identifies the execution that a container was created
+// for. Containers with this label are considered to be managed by shnorky.
+var ExecutionIDLabel = "shnorky.execution_id"
+
+// ComponentIDLabel is the docker label which identifies the component that an image was built for
+var ComponentIDLabel = "shnorky.component_id"
+
+// EphemeralLabel marks the docker objects created by processes which use ephemeral state (see
+// state.InitEphemeral), so that they can be cleaned up later (e.g. with
+// "docker container prune --filter label=shnorky.ephemeral")
+var EphemeralLabel = "shnorky.ephemeral"
+
+// DockerLabels are attached to every docker object (image, container, or network) that shnorky
+// creates, in addition to the labels which identify the object
+var DockerLabels = map[string]string{}
+
+// WithDockerLabels returns the given labels along with DockerLabels (the given labels take
+// precedence)
+func WithDockerLabels(labels map[string]string) map[string]string {
+	merged := map[string]string{}
+	for key, value := range DockerLabels {
+		merged[key] = value
+	}
+	for key, value := range labels {
+		merged[key] = value
+	}
+	return merged
+}
+
+// ExitCodeUnknown is the exit code recorded for executions whose containers disappeared before
+// their results could be recorded
+var ExitCodeUnknown = -1
+
+// UnknownContainer - a container labelled by shnorky for which the state database has no execution
+type UnknownContainer struct {
+	ContainerID string `json:"container_id"`
+	ExecutionID string `json:"execution_id"`
+	Name        string `json:"name"`
+	State       string `json:"state"`
+}
+
+// Reconciliation - the outcome of reconciling the executions in a state database with the
+// containers known to the docker daemon
+type Reconciliation struct {
+	// Updated are the executions which were recorded as unfinished even though their containers had
+	// exited. Their results have been recorded from their containers.
+	Updated []ExecutionMetadata `json:"updated"`
+	// Missing are the unfinished executions whose containers no longer exist. They have been
+	// recorded as failed (with exit code ExitCodeUnknown).
+	Missing []ExecutionMetadata `json:"missing"`
+	// Unknown are the containers labelled by shnorky which do not correspond to any execution in
+	// the state database. They are left alone.
+	Unknown []UnknownContainer `json:"unknown"`
+}
+
+// ReconcileExecutions brings the executions in the given state database up to date with the
+// containers known to the docker daemon, which is useful when shnorky starts after a process which
+// was executing components died (or was killed) before it could record their results. Unfinished
+// executions whose containers have exited get their results recorded, and unfinished executions
+// whose containers no longer exist are recorded as failed. Containers labelled by shnorky which
+// have no corresponding execution are reported, but not modified. Executions which do not run in
+// containers (e.g. those of built-in gate steps, whose build ID is their component ID) are skipped.
+func ReconcileExecutions(ctx context.Context, store state.Store, dockerClient *docker.Client) (Reconciliation, error) {
+	records, err := store.SelectUnfinishedExecutions()
+	executions := executionMetadataFromRecords(records)
+	if err != nil {
+		return Reconciliation{}, err
+	}
+
+	containerStates := map[string]*dockerTypes.ContainerState{}
+	for _, execution := range executions {
+		if execution.BuildID == execution.ComponentID {
+			continue
+		}
+		info, err := dockerClient.ContainerInspect(ctx, execution.ID)
+		if docker.IsErrNotFound(err) {
+			containerStates[execution.ID] = nil
+			continue
+		}
+		if err != nil {
+			return Reconciliation{}, fmt.Errorf("Error inspecting container for execution (%s): %w", execution.ID, err)
+		}
+		containerStates[execution.ID] = info.State
+	}
+
+	containers, err := dockerClient.ContainerList(ctx, dockerTypes.ContainerListOptions{All: true, Filters: filters.NewArgs(filters.Arg("label", ExecutionIDLabel))})
+	if err != nil {
+		return Reconciliation{}, fmt.Errorf("Error listing containers: %w", err)
+	}
+
+	return reconcileExecutions(store, executions, containerStates, containers)
+}
+
+// reconcileExecutions implements ReconcileExecutions given the unfinished executions in the state
+// database, the states of their containers (keyed by execution ID, with nil states for containers
+// which do not exist), and the containers labelled by shnorky. Executions without an entry in
+// containerStates are skipped.
+func reconcileExecutions(store state.Store, executions []ExecutionMetadata, containerStates map[string]*dockerTypes.ContainerState, containers []dockerTypes.Container) (Reconciliation, error) {
+	reconciliation := Reconciliation{Updated: []ExecutionMetadata{}, Missing: []ExecutionMetadata{}, Unknown: []UnknownContainer{}}
+
+	for _, execution := range executions {
+		containerState, ok := containerStates[execution.ID]
+		if !ok {
+			continue
+		}
+		if containerState == nil {
+			exitCode := ExitCodeUnknown
+			finishedAt := time.Now()
+			execution.ExitCode = &exitCode
+			execution.FinishedAt = &finishedAt
+			execution.Error = "Container no longer exists"
+			err := UpdateExecutionResult(store, execution)
+			if err != nil {
+				return reconciliation, fmt.Errorf("Error recording result of execution (%s) in state database: %w", execution.ID, err)
+			}
+			reconciliation.Missing = append(reconciliation.Missing, execution)
+			continue
+		}
+		// Containers which were created but never started (or which are still running or paused)
+		// are left alone
+		if containerState.Status != "exited" && containerState.Status != "dead" {
+			continue
+		}
+		updatedExecution, err := RecordExecutionResult(store, execution, containerState)
+		if err != nil {
+			return reconciliation, err
+		}
+		reconciliation.Updated = append(reconciliation.Updated, updatedExecution)
+	}
+
+	for _, container := range containers {
+		executionID := container.Labels[ExecutionIDLabel]
+		_, err := SelectExecutionByID(store, executionID)
+		if err == nil {
+			continue
+		}
+		if err != ErrExecutionNotFound {
+			return reconciliation, err
+		}
+		name := ""
+		if len(container.Names) > 0 {
+			name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		reconciliation.Unknown = append(reconciliation.Unknown, UnknownContainer{ContainerID: container.ID, ExecutionID: executionID, Name: name, State: container.State})
+	}
+
+	return reconciliation, nil
+}
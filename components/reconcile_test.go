@@ -0,0 +1,107 @@
+package components
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestReconcileExecutions(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-reconcile-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatalf("Error opening state database file (%s): %s", stateDBPath, err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	executionIDs := []string{"exited", "running", "created", "missing", "host"}
+	executions := make([]ExecutionMetadata, len(executionIDs))
+	for i, executionID := range executionIDs {
+		executions[i] = ExecutionMetadata{ID: executionID, BuildID: "build", ComponentID: "component", CreatedAt: time.Now()}
+		err = InsertExecution(store, executions[i])
+		if err != nil {
+			t.Fatalf("Could not insert execution (%s): %s", executionID, err.Error())
+		}
+	}
+
+	containerStates := map[string]*dockerTypes.ContainerState{
+		"exited":  {Status: "exited", ExitCode: 3, FinishedAt: time.Now().Format(time.RFC3339Nano)},
+		"running": {Status: "running", Running: true},
+		"created": {Status: "created"},
+		"missing": nil,
+	}
+	containers := []dockerTypes.Container{
+		{ID: "c1", Names: []string{"/exited"}, Labels: map[string]string{ExecutionIDLabel: "exited"}, State: "exited"},
+		{ID: "c2", Names: []string{"/stray"}, Labels: map[string]string{ExecutionIDLabel: "stray"}, State: "running"},
+	}
+
+	reconciliation, err := reconcileExecutions(store, executions, containerStates, containers)
+	if err != nil {
+		t.Fatalf("Unexpected error reconciling executions: %s", err.Error())
+	}
+
+	if len(reconciliation.Updated) != 1 || reconciliation.Updated[0].ID != "exited" {
+		t.Errorf("Unexpected updated executions: %v", reconciliation.Updated)
+	}
+	if len(reconciliation.Missing) != 1 || reconciliation.Missing[0].ID != "missing" {
+		t.Errorf("Unexpected missing executions: %v", reconciliation.Missing)
+	}
+	if len(reconciliation.Unknown) != 1 || reconciliation.Unknown[0].ExecutionID != "stray" || reconciliation.Unknown[0].Name != "stray" {
+		t.Errorf("Unexpected unknown containers: %v", reconciliation.Unknown)
+	}
+
+	type expectedResult struct {
+		finished bool
+		exitCode int
+	}
+	expectedResults := map[string]expectedResult{
+		"exited":  {true, 3},
+		"running": {false, 0},
+		"created": {false, 0},
+		"missing": {true, ExitCodeUnknown},
+		"host":    {false, 0},
+	}
+	for executionID, expected := range expectedResults {
+		execution, err := SelectExecutionByID(store, executionID)
+		if err != nil {
+			t.Fatalf("Could not select execution (%s): %s", executionID, err.Error())
+		}
+		if !expected.finished {
+			if execution.FinishedAt != nil || execution.ExitCode != nil {
+				t.Errorf("Execution (%s) was unexpectedly finished: %v", executionID, execution)
+			}
+			continue
+		}
+		if execution.FinishedAt == nil || execution.ExitCode == nil || *execution.ExitCode != expected.exitCode {
+			t.Errorf("Unexpected result for execution (%s): expected exit code %d, got %v", executionID, expected.exitCode, execution.ExitCode)
+		}
+	}
+
+	unfinished, err := store.SelectUnfinishedExecutions()
+	if err != nil {
+		t.Fatalf("Could not select unfinished executions: %s", err.Error())
+	}
+	if len(unfinished) != 3 {
+		t.Errorf("Unexpected number of unfinished executions: expected=3, actual=%d", len(unfinished))
+	}
+}
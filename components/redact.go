@@ -0,0 +1,71 @@
+package components
+
+import (
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// RedactedValue replaces sensitive values in logs and command output
+var RedactedValue = "[REDACTED]"
+
+// sensitiveValues is the set (of keys) of the values which Redact masks
+var sensitiveValues = map[string]bool{}
+var sensitiveValuesMutex sync.RWMutex
+
+// MarkSensitive registers the given value as sensitive, so that Redact masks it from then on. It is
+// called by the specification materializers for the values of the environment variables that
+// specifications mark as sensitive. Empty values are ignored.
+func MarkSensitive(value string) {
+	if value == "" {
+		return
+	}
+	sensitiveValuesMutex.Lock()
+	defer sensitiveValuesMutex.Unlock()
+	sensitiveValues[value] = true
+}
+
+// Redact replaces every occurrence of a sensitive value (see MarkSensitive) in the given text with
+// RedactedValue
+func Redact(text string) string {
+	sensitiveValuesMutex.RLock()
+	defer sensitiveValuesMutex.RUnlock()
+	if len(sensitiveValues) == 0 {
+		return text
+	}
+
+	// Longer values are replaced first, so that values which contain other values are masked whole
+	values := make([]string, 0, len(sensitiveValues))
+	for value := range sensitiveValues {
+		values = append(values, value)
+	}
+	sort.Slice(values, func(i, j int) bool { return len(values[i]) > len(values[j]) })
+
+	for _, value := range values {
+		text = strings.Replace(text, value, RedactedValue, -1)
+	}
+	return text
+}
+
+// RedactingWriter - an io.Writer which masks sensitive values (see Redact) in everything written to
+// it before passing it on. Each call to Write is redacted separately, so values which are split
+// across calls are not masked.
+type RedactingWriter struct {
+	w io.Writer
+}
+
+// NewRedactingWriter creates a RedactingWriter which writes to the given writer
+func NewRedactingWriter(w io.Writer) *RedactingWriter {
+	return &RedactingWriter{w: w}
+}
+
+// Write writes the given bytes to the underlying writer, with sensitive values masked. On success,
+// it reports that all of the given bytes were written, whatever the length of the redacted output.
+func (writer *RedactingWriter) Write(p []byte) (int, error) {
+	_, err := io.WriteString(writer.w, Redact(string(p)))
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,44 @@
+package components
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRedact(t *testing.T) {
+	MarkSensitive("shnorky-test-password")
+	MarkSensitive("shnorky-test-password-suffix")
+	MarkSensitive("")
+
+	type redactTest struct {
+		text     string
+		expected string
+	}
+
+	testCases := []redactTest{
+		{text: "nothing to hide", expected: "nothing to hide"},
+		{text: "password=shnorky-test-password", expected: "password=" + RedactedValue},
+		{text: "shnorky-test-password-suffix", expected: RedactedValue},
+		{text: "shnorky-test-password shnorky-test-password", expected: RedactedValue + " " + RedactedValue},
+	}
+
+	for i, testCase := range testCases {
+		redacted := Redact(testCase.text)
+		if redacted != testCase.expected {
+			t.Errorf("[Test %d] Unexpected redaction: expected=%s, actual=%s", i, testCase.expected, redacted)
+		}
+	}
+
+	var buffer bytes.Buffer
+	writer := NewRedactingWriter(&buffer)
+	n, err := writer.Write([]byte("token: shnorky-test-password\n"))
+	if err != nil {
+		t.Fatalf("Unexpected error writing to redacting writer: %s", err.Error())
+	}
+	if n != len("token: shnorky-test-password\n") {
+		t.Errorf("Unexpected number of bytes written: %d", n)
+	}
+	if buffer.String() != "token: "+RedactedValue+"\n" {
+		t.Errorf("Unexpected output from redacting writer: %s", buffer.String())
+	}
+}
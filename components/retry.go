@@ -0,0 +1,106 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+
+	docker "github.com/docker/docker/client"
+)
+
+// DockerRetryPolicy - describes how docker API calls (image builds, and creating, starting, and
+// inspecting containers) which fail with transient errors are retried
+type DockerRetryPolicy struct {
+	// Attempts is the maximum number of times each call is made. Values below 2 disable retries.
+	Attempts int
+	// Interval is how long to wait before the first retry. The wait doubles with each subsequent
+	// retry, up to MaxDockerRetryInterval.
+	Interval time.Duration
+}
+
+// DefaultDockerRetryPolicy is the retry policy for docker API calls made with contexts which do
+// not carry a policy of their own (see WithDockerRetryPolicy)
+var DefaultDockerRetryPolicy = DockerRetryPolicy{Attempts: 5, Interval: time.Second}
+
+// MaxDockerRetryInterval caps the wait between retries of docker API calls, so that calls keep
+// being retried at a reasonable rate while the docker daemon restarts
+var MaxDockerRetryInterval = 30 * time.Second
+
+type dockerRetryPolicyKey struct{}
+
+// WithDockerRetryPolicy returns a copy of the given context which carries the given retry policy
+// for the docker API calls made with it
+func WithDockerRetryPolicy(ctx context.Context, policy DockerRetryPolicy) context.Context {
+	return context.WithValue(ctx, dockerRetryPolicyKey{}, policy)
+}
+
+// DockerRetryPolicyFromContext returns the retry policy carried by the given context, or
+// DefaultDockerRetryPolicy if it does not carry one
+func DockerRetryPolicyFromContext(ctx context.Context) DockerRetryPolicy {
+	policy, ok := ctx.Value(dockerRetryPolicyKey{}).(DockerRetryPolicy)
+	if !ok {
+		return DefaultDockerRetryPolicy
+	}
+	return policy
+}
+
+// IsTransientDockerError returns true if the given error (returned by a docker client) may go
+// away if the request is retried - e.g. because the connection to the daemon was cut off, timed
+// out, or refused while the daemon was restarting. Errors reported by the daemon itself (such as a
+// missing image or an invalid configuration) are not transient.
+func IsTransientDockerError(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	// docker.IsErrConnectionFailed does not unwrap the errors it is given
+	for wrappedErr := err; wrappedErr != nil; wrappedErr = errors.Unwrap(wrappedErr) {
+		if docker.IsErrConnectionFailed(wrappedErr) {
+			return true
+		}
+	}
+	if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+	if errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.EPIPE) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	// The docker client flattens some errors into their messages
+	message := err.Error()
+	for _, fragment := range []string{"connection reset by peer", "broken pipe", "unexpected EOF"} {
+		if strings.Contains(message, fragment) {
+			return true
+		}
+	}
+	return strings.HasSuffix(message, ": EOF") || message == "EOF"
+}
+
+// retryDocker makes the given docker API call until it succeeds, fails with an error which is not
+// retryable (see IsRetryable), or exhausts the attempts allowed by the retry policy carried by the
+// given context. It returns the error from the last attempt.
+func retryDocker(ctx context.Context, call func() error) error {
+	policy := DockerRetryPolicyFromContext(ctx)
+	interval := policy.Interval
+	for attempt := 1; ; attempt++ {
+		err := call()
+		if err == nil || attempt >= policy.Attempts || !IsRetryable(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(interval):
+		}
+		interval *= 2
+		if interval > MaxDockerRetryInterval {
+			interval = MaxDockerRetryInterval
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package components
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"syscall"
+	"testing"
+	"time"
+
+	docker "github.com/docker/docker/client"
+)
+
+func TestIsTransientDockerError(t *testing.T) {
+	type isTransientDockerErrorTest struct {
+		err      error
+		expected bool
+	}
+
+	tests := []isTransientDockerErrorTest{
+		{err: nil, expected: false},
+		{err: docker.ErrorConnectionFailed("unix:///var/run/docker.sock"), expected: true},
+		{err: io.EOF, expected: true},
+		{err: &url.Error{Op: "Post", URL: "http://docker/containers/create", Err: io.ErrUnexpectedEOF}, expected: true},
+		{err: fmt.Errorf("error during connect: %w", syscall.ECONNRESET), expected: true},
+		{err: errors.New("read unix @->/var/run/docker.sock: read: connection reset by peer"), expected: true},
+		{err: errors.New("error during connect: Post http://docker/build: EOF"), expected: true},
+		{err: context.Canceled, expected: false},
+		{err: errors.New("Error response from daemon: client version 1.40 is too new"), expected: false},
+		{err: errors.New("Error response from daemon: No such image: shnorky/missing:1"), expected: false},
+	}
+
+	for i, test := range tests {
+		actual := IsTransientDockerError(test.err)
+		if actual != test.expected {
+			t.Errorf("[Test %d] Unexpected result for error (%v): expected=%t, actual=%t", i, test.err, test.expected, actual)
+		}
+	}
+}
+
+func TestRetryDocker(t *testing.T) {
+	originalMaxInterval := MaxDockerRetryInterval
+	MaxDockerRetryInterval = 5 * time.Millisecond
+	defer func() { MaxDockerRetryInterval = originalMaxInterval }()
+
+	type retryDockerTest struct {
+		policy           DockerRetryPolicy
+		errs             []error
+		expectedAttempts int
+		expectedErr      bool
+	}
+
+	transientErr := docker.ErrorConnectionFailed("unix:///var/run/docker.sock")
+	permanentErr := errors.New("Error response from daemon: No such image: shnorky/missing:1")
+	tests := []retryDockerTest{
+		{policy: DockerRetryPolicy{Attempts: 3, Interval: time.Millisecond}, errs: []error{nil}, expectedAttempts: 1, expectedErr: false},
+		{policy: DockerRetryPolicy{Attempts: 3, Interval: time.Millisecond}, errs: []error{transientErr, transientErr, nil}, expectedAttempts: 3, expectedErr: false},
+		{policy: DockerRetryPolicy{Attempts: 3, Interval: time.Millisecond}, errs: []error{transientErr, transientErr, transientErr, nil}, expectedAttempts: 3, expectedErr: true},
+		{policy: DockerRetryPolicy{Attempts: 3, Interval: time.Millisecond}, errs: []error{transientErr, permanentErr, nil}, expectedAttempts: 2, expectedErr: true},
+		{policy: DockerRetryPolicy{Attempts: 1, Interval: time.Millisecond}, errs: []error{transientErr, nil}, expectedAttempts: 1, expectedErr: true},
+		{policy: DockerRetryPolicy{Attempts: 0}, errs: []error{transientErr, nil}, expectedAttempts: 1, expectedErr: true},
+	}
+
+	for i, test := range tests {
+		ctx := WithDockerRetryPolicy(context.Background(), test.policy)
+		attempts := 0
+		err := retryDocker(ctx, func() error {
+			err := test.errs[attempts]
+			attempts++
+			return err
+		})
+		if attempts != test.expectedAttempts {
+			t.Errorf("[Test %d] Unexpected number of attempts: expected=%d, actual=%d", i, test.expectedAttempts, attempts)
+		}
+		if (err != nil) != test.expectedErr {
+			t.Errorf("[Test %d] Unexpected error: expected error=%t, actual=%v", i, test.expectedErr, err)
+		}
+	}
+}
+
+func TestDockerRetryPolicyFromContext(t *testing.T) {
+	policy := DockerRetryPolicyFromContext(context.Background())
+	if policy != DefaultDockerRetryPolicy {
+		t.Errorf("Unexpected policy for context without one: expected=%v, actual=%v", DefaultDockerRetryPolicy, policy)
+	}
+
+	expected := DockerRetryPolicy{Attempts: 10, Interval: time.Minute}
+	policy = DockerRetryPolicyFromContext(WithDockerRetryPolicy(context.Background(), expected))
+	if policy != expected {
+		t.Errorf("Unexpected policy: expected=%v, actual=%v", expected, policy)
+	}
+}
@@ -0,0 +1,73 @@
+package components
+
+import (
+	"context"
+	"io"
+	"io/ioutil"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// Run registers the component in the given directory (with the specification at the given path)
+// under the given ID unless it is already registered, builds it if its build is stale (see
+// BuildIsStale), executes the build with the given mounts, workdir, and stdin (as Execute does),
+// and waits for the execution to finish. The output of the build and of the execution container is
+// streamed to outstream. This allows a component to be tried out without registering and building
+// it separately.
+// This is the handler for `shn components run`
+func Run(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	outstream io.Writer,
+	buildLogsDir string,
+	componentID string,
+	componentType string,
+	componentPath string,
+	specificationPath string,
+	mounts []MountConfiguration,
+	workdir string,
+	stdin io.Reader,
+) (ExecutionMetadata, error) {
+	if outstream == nil {
+		outstream = ioutil.Discard
+	}
+
+	_, err := EnsureComponent(store, componentID, componentType, componentPath, specificationPath)
+	if err != nil {
+		return ExecutionMetadata{}, err
+	}
+
+	stale, err := BuildIsStale(store, componentID)
+	if err != nil {
+		return ExecutionMetadata{}, err
+	}
+	var buildMetadata BuildMetadata
+	if stale {
+		buildMetadata, err = CreateBuild(ctx, store, dockerClient, outstream, buildLogsDir, componentID, BuildOptions{})
+	} else {
+		buildMetadata, err = SelectMostRecentBuildForComponent(store, componentID)
+	}
+	if err != nil {
+		return ExecutionMetadata{}, err
+	}
+
+	executionMetadata, err := ExecuteWithOptions(ctx, store, dockerClient, WithBuild(buildMetadata.ID), WithMounts(mounts...), WithWorkdir(workdir), WithStdin(stdin))
+	if err != nil {
+		return executionMetadata, err
+	}
+
+	// A negative number of lines makes docker return the complete logs
+	logsDone := make(chan error, 1)
+	go func() {
+		logsDone <- FollowExecutionLogs(ctx, dockerClient, executionMetadata.ID, -1, outstream)
+	}()
+	executionMetadata, err = WaitForExecution(ctx, store, dockerClient, executionMetadata.ID)
+	if err != nil {
+		return executionMetadata, err
+	}
+	<-logsDone
+	return executionMetadata, nil
+}
@@ -0,0 +1,34 @@
+package components
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// SnapshotSpecification returns the hex-encoded SHA256 digest and the contents of the specification
+// file at the given path, to be stored when a component is registered. If the file cannot be read,
+// both are empty.
+func SnapshotSpecification(specificationPath string) (string, string) {
+	contents, err := ioutil.ReadFile(specificationPath)
+	if err != nil {
+		return "", ""
+	}
+	digest := sha256.Sum256(contents)
+	return hex.EncodeToString(digest[:]), string(contents)
+}
+
+// OpenComponentSpecification opens the specification file of the given component. If the file no
+// longer exists but a snapshot of it was stored when the component was registered, the snapshot is
+// read in its place, so that components remain executable (and inspectable) after their
+// specification files are deleted.
+func OpenComponentSpecification(component ComponentMetadata) (io.ReadCloser, error) {
+	specFile, err := os.Open(component.SpecificationPath)
+	if os.IsNotExist(err) && component.SpecificationSnapshot != "" {
+		return ioutil.NopCloser(strings.NewReader(component.SpecificationSnapshot)), nil
+	}
+	return specFile, err
+}
@@ -0,0 +1,70 @@
+package components
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// TestSpecificationSnapshot registers a component, deletes its specification file, and checks that
+// its specification can still be read from the snapshot stored at registration
+func TestSpecificationSnapshot(t *testing.T) {
+	stateDir, db, err := state.InitEphemeral()
+	if err != nil {
+		t.Fatalf("Could not initialize ephemeral state: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	contents, err := ioutil.ReadFile("../examples/components/single-task/component.json")
+	if err != nil {
+		t.Fatalf("Could not read example specification: %s", err.Error())
+	}
+	specificationPath := filepath.Join(stateDir, "component.json")
+	err = ioutil.WriteFile(specificationPath, contents, 0644)
+	if err != nil {
+		t.Fatalf("Could not write specification: %s", err.Error())
+	}
+
+	component, err := AddComponent(store, "single-task", Task, "../examples/components/single-task", specificationPath)
+	if err != nil {
+		t.Fatalf("Could not add component: %s", err.Error())
+	}
+	expectedChecksum, expectedSnapshot := SnapshotSpecification(specificationPath)
+	if component.SpecificationChecksum == "" || component.SpecificationChecksum != expectedChecksum {
+		t.Errorf("Unexpected specification checksum: expected=%s, actual=%s", expectedChecksum, component.SpecificationChecksum)
+	}
+	selected, err := SelectComponentByID(store, component.ID)
+	if err != nil || selected.SpecificationSnapshot != expectedSnapshot || selected.SpecificationChecksum != expectedChecksum {
+		t.Errorf("Unexpected snapshot of specification in state database: checksum=%s, error=%v", selected.SpecificationChecksum, err)
+	}
+
+	err = os.Remove(specificationPath)
+	if err != nil {
+		t.Fatalf("Could not remove specification: %s", err.Error())
+	}
+	specification, err := ReadComponentSpecification(store, component.ID)
+	if err != nil {
+		t.Fatalf("Could not read specification of component from snapshot: %s", err.Error())
+	}
+	if specification.Run.Env["MY_ENV"] != "hello world" {
+		t.Errorf("Unexpected specification read from snapshot: %v", specification)
+	}
+
+	// Components registered without a readable specification have no snapshot to fall back to
+	missing, err := AddComponent(store, "missing", Task, stateDir, specificationPath)
+	if err != nil {
+		t.Fatalf("Could not add component: %s", err.Error())
+	}
+	if missing.SpecificationChecksum != "" || missing.SpecificationSnapshot != "" {
+		t.Errorf("Unexpected snapshot of missing specification: checksum=%s", missing.SpecificationChecksum)
+	}
+	_, err = ReadComponentSpecification(store, missing.ID)
+	if err == nil {
+		t.Error("Expected error reading missing specification, but did not get one")
+	}
+}
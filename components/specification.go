@@ -5,19 +5,82 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"os"
 	"os/user"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	dockerContainer "github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+	units "github.com/docker/go-units"
+
+	"github.com/simiotics/shnorky/state"
 )
 
 // ErrInvalidMountType signifies that there was an error parsing a component mount specification.
 // Specifically, that the MountType member did not have a valid value.
 var ErrInvalidMountType = errors.New("Invalid mount type in component mount specification: must be one of \"file\", \"dir\"")
 
+// ErrInvalidDevice signifies that there was an error parsing a device in a component run
+// specification. Devices must be of the form "<path on host>[:<path in container>[:<permissions>]]"
+// where permissions is a combination of the characters "r", "w", and "m".
+var ErrInvalidDevice = errors.New("Invalid device in component run specification: must be of the form \"<host path>[:<container path>[:<permissions>]]\"")
+
+// ErrInvalidShmSize signifies that the shm_size member of a component run specification could not
+// be parsed as a size (e.g. "64m", "2g", "1073741824")
+var ErrInvalidShmSize = errors.New("Invalid shm_size in component run specification: must be a size such as \"512m\" or \"2g\"")
+
+// ErrInvalidUlimit signifies that there was an error parsing a ulimit in a component run
+// specification. Ulimits must be of the form "<name>=<soft limit>[:<hard limit>]".
+var ErrInvalidUlimit = errors.New("Invalid ulimit in component run specification: must be of the form \"<name>=<soft limit>[:<hard limit>]\"")
+
+// ErrInvalidPort signifies that there was an error parsing a port in a component run specification.
+// Ports must be of the form "[[<host ip>:]<host port>:]<container port>[/<protocol>]".
+var ErrInvalidPort = errors.New("Invalid port in component run specification: must be of the form \"[[<host ip>:]<host port>:]<container port>[/<protocol>]\"")
+
+// ErrInvalidHealthcheck signifies that the healthcheck member of a component run specification does
+// not specify a command or specifies a duration which could not be parsed (e.g. "5s", "1m30s")
+var ErrInvalidHealthcheck = errors.New("Invalid healthcheck in component run specification: must specify a cmd, and its durations must be of the form \"5s\" or \"1m30s\"")
+
+// ErrInvalidExtraHost signifies that there was an error parsing an extra host in a component build
+// specification. Extra hosts must be of the form "<hostname>:<ip>".
+var ErrInvalidExtraHost = errors.New("Invalid extra host in component build specification: must be of the form \"<hostname>:<ip>\"")
+
+// ErrInvalidRestartPolicy signifies that the restart_policy member of a component run specification
+// could not be parsed. Restart policies must be one of "no", "on-failure[:<max retries>]", or
+// "always".
+var ErrInvalidRestartPolicy = errors.New("Invalid restart_policy in component run specification: must be one of \"no\", \"on-failure[:<max retries>]\", \"always\"")
+
+// ErrRestartPolicyForTask signifies that a task component specifies a restart policy other than
+// "no". Only service components may be restarted by docker.
+var ErrRestartPolicyForTask = errors.New("Only service components may specify a restart_policy")
+
+// InvalidSpecificationError - signifies that a component or flow specification could not be decoded
+// or failed validation. Its message is that of the error it wraps.
+type InvalidSpecificationError struct {
+	Err error
+}
+
+func (err *InvalidSpecificationError) Error() string {
+	return err.Err.Error()
+}
+
+// Unwrap returns the error describing what is wrong with the specification
+func (err *InvalidSpecificationError) Unwrap() error {
+	return err.Err
+}
+
 // ComponentSpecification - struct specifying how a component of a shnorky data processing flow
 // should be built and executed
 type ComponentSpecification struct {
-	Build BuildSpecification `json:"build"`
-	Run   RunSpecification   `json:"run"`
+	Build    BuildSpecification    `json:"build"`
+	Run      RunSpecification      `json:"run"`
+	Defaults DefaultsSpecification `json:"defaults"`
+	Dev      DevSpecification      `json:"dev"`
 }
 
 // BuildSpecification - struct specifying how a component of a shnorky data processing flow should
@@ -30,6 +93,20 @@ type BuildSpecification struct {
 	// Path to Dockerfile to be used to build the component - should be relative to the context
 	// path
 	Dockerfile string `json:"Dockerfile"`
+
+	// Target is the stage of a multi-stage Dockerfile which is built (e.g. "runtime"). If it is
+	// empty, the final stage is built. Builds may override it (see BuildOptions).
+	Target string `json:"target,omitempty"`
+
+	// Network is the networking mode of the containers that run the instructions of the Dockerfile
+	// (e.g. "host", "none", or the name of a docker network). If it is empty, docker's default is
+	// used.
+	Network string `json:"network,omitempty"`
+
+	// ExtraHosts are entries of the form "<hostname>:<ip>" which are added to /etc/hosts in the
+	// containers that run the instructions of the Dockerfile (e.g. to reach internal package
+	// mirrors)
+	ExtraHosts []string `json:"extra_hosts,omitempty"`
 }
 
 // RunSpecification - struct specifying how a component of a shnorky data processing flow should be
@@ -62,6 +139,125 @@ type RunSpecification struct {
 	// "env:UID" to use the user running the current shnorky process, for example
 	// "user:<username>" - container runs as the user with the given username
 	User string `json:"user"`
+
+	// Privileged specifies whether containers for this component should be run in privileged mode
+	// (required, for example, by components which mount FUSE filesystems)
+	Privileged bool `json:"privileged,omitempty"`
+
+	// Devices lists host devices which should be made available inside containers for this
+	// component. Each device is specified as "<host path>[:<container path>[:<permissions>]]", for
+	// example "/dev/fuse" or "/dev/video0:/dev/video0:rw". If the container path is not specified,
+	// it is the same as the host path. If permissions are not specified, they default to "rwm".
+	Devices []string `json:"devices,omitempty"`
+
+	// ShmSize specifies the size of /dev/shm in containers for this component, for example "2g".
+	// If it is not specified, docker uses its default size (64MB).
+	ShmSize string `json:"shm_size,omitempty"`
+
+	// Ulimits specifies resource limits for processes in containers for this component. Each
+	// ulimit is specified as "<name>=<soft limit>[:<hard limit>]", for example "nofile=65536" or
+	// "memlock=-1:-1". If the hard limit is not specified, it is the same as the soft limit.
+	Ulimits []string `json:"ulimits,omitempty"`
+
+	// Workdir overrides the working directory (set by WORKDIR in the Dockerfile) for containers
+	// representing this component. Supports "env:<VARIABLE_NAME>" values.
+	Workdir string `json:"workdir,omitempty"`
+
+	// Ports lists the ports of containers for this component which are published on the host, each
+	// specified as "[[<host ip>:]<host port>:]<container port>[/<protocol>]", for example "8080:80"
+	// or "127.0.0.1:5432:5432". If the host port is not specified, docker picks a free one.
+	Ports []string `json:"ports,omitempty"`
+
+	// Healthcheck specifies how docker checks that containers for this component are healthy. It
+	// overrides any HEALTHCHECK in the Dockerfile. `shn up` waits for each service to become
+	// healthy before starting the services which depend on it.
+	Healthcheck *HealthcheckSpecification `json:"healthcheck,omitempty"`
+
+	// RestartPolicy specifies whether docker restarts containers for this component when they
+	// exit, as one of "no", "on-failure[:<max retries>]", or "always". It may only be set for
+	// service components, so that services which crash during a flow run are brought back up.
+	RestartPolicy string `json:"restart_policy,omitempty"`
+
+	// Sensitive lists the names of the environment variables whose values are secrets. Their values
+	// (whether they are set in Env or by the flows which execute this component) are masked in logs
+	// and command output.
+	Sensitive []string `json:"sensitive,omitempty"`
+}
+
+// HealthcheckSpecification - struct specifying the command which docker runs inside a container to
+// check that it is healthy, and how often it does so
+type HealthcheckSpecification struct {
+	// Cmd is the command which is run in the container. It is healthy if the command exits with
+	// code 0. A single-element command is run with the container's default shell.
+	Cmd []string `json:"cmd"`
+
+	// Interval is the time between checks, for example "10s". It defaults to docker's default (30s).
+	Interval string `json:"interval,omitempty"`
+
+	// Timeout is the time after which a check is considered to have failed. It defaults to docker's
+	// default (30s).
+	Timeout string `json:"timeout,omitempty"`
+
+	// StartPeriod is the time the container is given to start up, during which failed checks do not
+	// count towards its retries.
+	StartPeriod string `json:"start_period,omitempty"`
+
+	// Retries is the number of consecutive failed checks after which the container is unhealthy. It
+	// defaults to docker's default (3).
+	Retries int `json:"retries,omitempty"`
+}
+
+// DefaultsSpecification - struct specifying settings which executions of a component inherit
+// unless they override them. This spares components with stable input and output layouts from
+// having the same mount configuration repeated for every execution.
+type DefaultsSpecification struct {
+	// Mounts are made into containers for this component at each target which is not targeted by
+	// the mount configuration of the execution. Their targets must be declared mountpoints. Relative
+	// sources of bind mounts are relative to the component path. Sources support
+	// "env:<VARIABLE_NAME>" values, but may not refer to remote object stores.
+	Mounts []MountConfiguration `json:"mounts,omitempty"`
+
+	// Env holds environment variables for containers for this component. The env of the run
+	// specification (and that of each execution) takes precedence over it.
+	Env map[string]string `json:"env,omitempty"`
+
+	// User is the user that containers for this component run as if the run specification does
+	// not specify one. It supports the same special values as the user in the run specification.
+	User string `json:"user,omitempty"`
+}
+
+// Methods by which DevelopService reloads a service component whose source has changed
+var (
+	// ReloadRestart - the container of the service is restarted
+	ReloadRestart = "restart"
+	// ReloadSignal - a signal is sent to the container of the service, which reloads itself
+	ReloadSignal = "signal"
+)
+
+// DevSpecification - struct specifying how a service component is reloaded during development
+// (see DevelopService). Rather than rebuilding the image of the service whenever its source changes,
+// the source is bind-mounted into its container, which is restarted (or signalled) on each change.
+type DevSpecification struct {
+	// Mountpoint is the path inside the container at which the source is mounted. Hot reloading is
+	// only enabled for components which specify it.
+	Mountpoint string `json:"mountpoint,omitempty"`
+
+	// Source is the directory (relative to the component path) which is mounted at the mountpoint.
+	// It defaults to the component path itself.
+	Source string `json:"source,omitempty"`
+
+	// Reload is the method by which the service is reloaded (one of ReloadRestart and
+	// ReloadSignal). It defaults to ReloadRestart.
+	Reload string `json:"reload,omitempty"`
+
+	// Signal is the signal sent to the container when Reload is ReloadSignal, for example "SIGUSR1".
+	// It defaults to "SIGHUP".
+	Signal string `json:"signal,omitempty"`
+
+	// Rebuild lists the paths (relative to the component path) whose changes still require the
+	// image to be rebuilt. It defaults to the Dockerfile. Changes to the specification always
+	// require a rebuild.
+	Rebuild []string `json:"rebuild,omitempty"`
 }
 
 // MountType is an enum representing the valid mount types for mount specifications
@@ -95,10 +291,64 @@ var ValidMountTypes = map[string]MountType{
 	"dir":  MountTypeDir,
 }
 
+// ReadComponentSpecification returns the specification of the component with the given ID. The
+// specifications of built-in components are returned even if they have not been registered.
+func ReadComponentSpecification(store state.Store, componentID string) (ComponentSpecification, error) {
+	if IsBuiltinComponent(componentID) {
+		return BuiltinComponentSpecification(componentID)
+	}
+
+	componentMetadata, err := SelectComponentByID(store, componentID)
+	if err != nil {
+		return ComponentSpecification{}, err
+	}
+	specFile, err := OpenComponentSpecification(componentMetadata)
+	if err != nil {
+		return ComponentSpecification{}, fmt.Errorf("Could not open specification file (%s): %w", componentMetadata.SpecificationPath, err)
+	}
+	defer specFile.Close()
+	return ReadSingleSpecification(specFile)
+}
+
+// ValidateMounts checks the given mount configurations against the mountpoints declared in the
+// given component specification. Every mount must target a declared mountpoint (or the reserved
+// ScratchMountpoint), no mountpoint may be targeted more than once, and every required mountpoint
+// must be targeted (either by the given mounts or by the default mounts of the component).
+func ValidateMounts(specification ComponentSpecification, mounts []MountConfiguration) error {
+	targets := map[string]bool{}
+	for _, mount := range mounts {
+		if targets[mount.Target] {
+			return fmt.Errorf("Multiple mounts for target: %s", mount.Target)
+		}
+		targets[mount.Target] = true
+		if mount.Target != ScratchMountpoint && !declaresMountpoint(specification.Run, mount.Target) {
+			return fmt.Errorf("Mount target (%s) does not match any declared mountpoint", mount.Target)
+		}
+	}
+	for _, mount := range specification.Defaults.Mounts {
+		targets[mount.Target] = true
+	}
+
+	for _, mountpoint := range specification.Run.Mountpoints {
+		if mountpoint.Required && !targets[mountpoint.Mountpoint] {
+			return fmt.Errorf("No mount provided for required mountpoint: %s", mountpoint.Mountpoint)
+		}
+	}
+	return nil
+}
+
 // ReadSingleSpecification reads a single ComponentSpecification JSON document and returns the
 // corresponding ComponentSpecification struct. It returns an error if there was an issue parsing
-// the specification into the struct.
+// the specification into the struct, or if it is invalid (an InvalidSpecificationError).
 func ReadSingleSpecification(reader io.Reader) (ComponentSpecification, error) {
+	specification, err := readSingleSpecification(reader)
+	if err != nil {
+		return specification, &InvalidSpecificationError{Err: err}
+	}
+	return specification, nil
+}
+
+func readSingleSpecification(reader io.Reader) (ComponentSpecification, error) {
 	dec := json.NewDecoder(reader)
 	dec.DisallowUnknownFields()
 
@@ -114,22 +364,305 @@ func ReadSingleSpecification(reader io.Reader) (ComponentSpecification, error) {
 		}
 	}
 
+	if err := ValidateExtraHosts(specification.Build.ExtraHosts); err != nil {
+		return specification, err
+	}
+
+	for _, device := range specification.Run.Devices {
+		if _, err := ParseDeviceMapping(device); err != nil {
+			return specification, err
+		}
+	}
+
+	if _, err := ParseShmSize(specification.Run.ShmSize); err != nil {
+		return specification, err
+	}
+
+	if _, err := ParseUlimits(specification.Run.Ulimits); err != nil {
+		return specification, err
+	}
+
+	if _, _, err := ParsePorts(specification.Run.Ports); err != nil {
+		return specification, err
+	}
+
+	if _, err := ParseHealthcheck(specification.Run.Healthcheck); err != nil {
+		return specification, err
+	}
+
+	if _, err := ParseRestartPolicy(specification.Run.RestartPolicy); err != nil {
+		return specification, err
+	}
+
+	if err := validateDefaultMounts(specification); err != nil {
+		return specification, err
+	}
+
+	if err := validateDevSpecification(specification.Dev); err != nil {
+		return specification, err
+	}
+
 	return specification, nil
 }
 
+// validateDevSpecification checks that the given dev specification, if it is not empty, has an
+// absolute mountpoint and a valid reload method
+func validateDevSpecification(dev DevSpecification) error {
+	if dev.Mountpoint == "" {
+		if dev.Source != "" || dev.Reload != "" || dev.Signal != "" || len(dev.Rebuild) > 0 {
+			return errors.New("Dev specification must specify a mountpoint")
+		}
+		return nil
+	}
+	if !path.IsAbs(dev.Mountpoint) {
+		return fmt.Errorf("Dev mountpoint (%s) must be an absolute path", dev.Mountpoint)
+	}
+	if dev.Reload != "" && dev.Reload != ReloadRestart && dev.Reload != ReloadSignal {
+		return fmt.Errorf("Invalid reload method (%s): must be one of %s, %s", dev.Reload, ReloadRestart, ReloadSignal)
+	}
+	if dev.Signal != "" && dev.Reload != ReloadSignal {
+		return fmt.Errorf("Dev signal (%s) may only be given with reload method %s", dev.Signal, ReloadSignal)
+	}
+	return nil
+}
+
+// validateDefaultMounts checks that the default mounts in the given specification target distinct,
+// declared mountpoints with valid mount methods and that none of their sources are remote
+func validateDefaultMounts(specification ComponentSpecification) error {
+	targets := map[string]bool{}
+	for _, mount := range specification.Defaults.Mounts {
+		if targets[mount.Target] {
+			return fmt.Errorf("Multiple default mounts for target: %s", mount.Target)
+		}
+		targets[mount.Target] = true
+		if mount.Target != ScratchMountpoint && !declaresMountpoint(specification.Run, mount.Target) {
+			return fmt.Errorf("Default mount target (%s) does not match any declared mountpoint", mount.Target)
+		}
+		if _, ok := ValidMountMethods[mount.Method]; !ok {
+			return ErrInvalidMountMethod
+		}
+		if _, ok := RemoteSourceScheme(mount.Source); ok {
+			return fmt.Errorf("Default mount source (%s) may not be remote", mount.Source)
+		}
+	}
+	return nil
+}
+
+// ApplyDefaultMounts returns the given mounts together with the default mounts of the given
+// component specification whose targets are not among those of the given mounts. The default
+// mounts are materialized (see MaterializeMountConfiguration), with the relative sources of bind
+// mounts resolved against the given component path.
+func ApplyDefaultMounts(specification ComponentSpecification, componentPath string, mounts []MountConfiguration) ([]MountConfiguration, error) {
+	if len(specification.Defaults.Mounts) == 0 {
+		return mounts, nil
+	}
+
+	targets := map[string]bool{}
+	for _, mount := range mounts {
+		targets[mount.Target] = true
+	}
+
+	result := make([]MountConfiguration, len(mounts), len(mounts)+len(specification.Defaults.Mounts))
+	copy(result, mounts)
+	for _, rawMount := range specification.Defaults.Mounts {
+		if targets[rawMount.Target] {
+			continue
+		}
+		source, err := MaterializeEnv(rawMount.Source)
+		if err != nil {
+			return mounts, fmt.Errorf("Could not materialize source of default mount (%s): %w", rawMount.Target, err)
+		}
+		if rawMount.Method == "bind" && !filepath.IsAbs(source) {
+			source = filepath.Join(componentPath, source)
+		}
+		mount, err := MaterializeMountConfiguration(MountConfiguration{Source: source, Target: rawMount.Target, Method: rawMount.Method})
+		if err != nil {
+			return mounts, fmt.Errorf("Invalid default mount (%s): %w", rawMount.Target, err)
+		}
+		result = append(result, mount)
+	}
+	return result, nil
+}
+
+// ParseDeviceMapping parses a device string from a RunSpecification into a docker DeviceMapping.
+// Returns ErrInvalidDevice if the device string is not of the form
+// "<host path>[:<container path>[:<permissions>]]".
+func ParseDeviceMapping(device string) (dockerContainer.DeviceMapping, error) {
+	parts := strings.Split(device, ":")
+	if len(parts) > 3 || parts[0] == "" {
+		return dockerContainer.DeviceMapping{}, ErrInvalidDevice
+	}
+
+	mapping := dockerContainer.DeviceMapping{
+		PathOnHost:        parts[0],
+		PathInContainer:   parts[0],
+		CgroupPermissions: "rwm",
+	}
+	if len(parts) > 1 && parts[1] != "" {
+		mapping.PathInContainer = parts[1]
+	}
+	if len(parts) > 2 {
+		permissions := parts[2]
+		if permissions == "" || strings.Trim(permissions, "rwm") != "" {
+			return dockerContainer.DeviceMapping{}, ErrInvalidDevice
+		}
+		mapping.CgroupPermissions = permissions
+	}
+
+	return mapping, nil
+}
+
+// ValidateExtraHosts checks that each of the extra_hosts of a BuildSpecification is of the form
+// "<hostname>:<ip>". The ip may also be "host-gateway", which docker resolves to the IP address of
+// the host. Returns ErrInvalidExtraHost if any of the extra hosts is invalid.
+func ValidateExtraHosts(extraHosts []string) error {
+	for _, extraHost := range extraHosts {
+		parts := strings.SplitN(extraHost, ":", 2)
+		if len(parts) != 2 || parts[0] == "" {
+			return ErrInvalidExtraHost
+		}
+		if parts[1] != "host-gateway" && net.ParseIP(parts[1]) == nil {
+			return ErrInvalidExtraHost
+		}
+	}
+	return nil
+}
+
+// ParseShmSize parses the shm_size member of a RunSpecification into a number of bytes. The empty
+// string parses to 0, which tells docker to use its default size. Returns ErrInvalidShmSize if the
+// size cannot be parsed.
+func ParseShmSize(shmSize string) (int64, error) {
+	if shmSize == "" {
+		return 0, nil
+	}
+	size, err := units.RAMInBytes(shmSize)
+	if err != nil || size < 0 {
+		return 0, ErrInvalidShmSize
+	}
+	return size, nil
+}
+
+// ParseUlimits parses the ulimits member of a RunSpecification into docker ulimits. Returns
+// ErrInvalidUlimit if any of the ulimits cannot be parsed.
+func ParseUlimits(ulimits []string) ([]*units.Ulimit, error) {
+	parsedUlimits := make([]*units.Ulimit, len(ulimits))
+	for i, ulimit := range ulimits {
+		parsedUlimit, err := units.ParseUlimit(ulimit)
+		if err != nil {
+			return []*units.Ulimit{}, ErrInvalidUlimit
+		}
+		parsedUlimits[i] = parsedUlimit
+	}
+	return parsedUlimits, nil
+}
+
+// ParsePorts parses the ports member of a RunSpecification into the set of container ports which
+// are exposed and their bindings to host ports. Returns ErrInvalidPort if any of the ports cannot be
+// parsed.
+func ParsePorts(ports []string) (nat.PortSet, nat.PortMap, error) {
+	exposedPorts, portBindings, err := nat.ParsePortSpecs(ports)
+	if err != nil {
+		return nat.PortSet{}, nat.PortMap{}, ErrInvalidPort
+	}
+	return exposedPorts, portBindings, nil
+}
+
+// ParseHealthcheck parses the healthcheck member of a RunSpecification into a docker HealthConfig.
+// A nil healthcheck parses to nil, which leaves the healthcheck (if any) of the image in place.
+// Returns ErrInvalidHealthcheck if the healthcheck has no command or any of its durations cannot be
+// parsed.
+func ParseHealthcheck(healthcheck *HealthcheckSpecification) (*dockerContainer.HealthConfig, error) {
+	if healthcheck == nil {
+		return nil, nil
+	}
+	if len(healthcheck.Cmd) == 0 || healthcheck.Retries < 0 {
+		return nil, ErrInvalidHealthcheck
+	}
+
+	config := &dockerContainer.HealthConfig{Retries: healthcheck.Retries}
+	if len(healthcheck.Cmd) == 1 {
+		config.Test = []string{"CMD-SHELL", healthcheck.Cmd[0]}
+	} else {
+		config.Test = append([]string{"CMD"}, healthcheck.Cmd...)
+	}
+
+	durations := []struct {
+		raw    string
+		parsed *time.Duration
+	}{
+		{healthcheck.Interval, &config.Interval},
+		{healthcheck.Timeout, &config.Timeout},
+		{healthcheck.StartPeriod, &config.StartPeriod},
+	}
+	for _, duration := range durations {
+		if duration.raw == "" {
+			continue
+		}
+		parsed, err := time.ParseDuration(duration.raw)
+		if err != nil || parsed < 0 {
+			return nil, ErrInvalidHealthcheck
+		}
+		*duration.parsed = parsed
+	}
+	return config, nil
+}
+
+// ParseRestartPolicy parses the restart_policy member of a RunSpecification into a docker restart
+// policy. The empty string parses to the empty policy, which docker treats as "no". Returns
+// ErrInvalidRestartPolicy if the policy cannot be parsed.
+func ParseRestartPolicy(restartPolicy string) (dockerContainer.RestartPolicy, error) {
+	parts := strings.SplitN(restartPolicy, ":", 2)
+	policy := dockerContainer.RestartPolicy{Name: parts[0]}
+	switch policy.Name {
+	case "", "no", "always":
+		if len(parts) > 1 {
+			return dockerContainer.RestartPolicy{}, ErrInvalidRestartPolicy
+		}
+	case "on-failure":
+		if len(parts) > 1 {
+			maxRetries, err := strconv.Atoi(parts[1])
+			if err != nil || maxRetries < 0 {
+				return dockerContainer.RestartPolicy{}, ErrInvalidRestartPolicy
+			}
+			policy.MaximumRetryCount = maxRetries
+		}
+	default:
+		return dockerContainer.RestartPolicy{}, ErrInvalidRestartPolicy
+	}
+	return policy, nil
+}
+
 // MaterializeComponentSpecification applies all run-time substitutions to the given
 // ComponentSpecification
 // For example, it replaces all "env:..." values with values of the corresponding environment
-// variables in the invoking process.
+// variables in the invoking process. The default env and user are merged into the materialized run
+// specification beneath the env and user that it specifies itself. Default mounts are left as they
+// are, since they are resolved against the component path (see ApplyDefaultMounts).
 func MaterializeComponentSpecification(rawSpecification ComponentSpecification) (ComponentSpecification, error) {
-	materializedRunSpecification, err := MaterializeRunSpecification(rawSpecification.Run)
+	runSpecification := rawSpecification.Run
+	if len(rawSpecification.Defaults.Env) > 0 {
+		runSpecification.Env = map[string]string{}
+		for key, value := range rawSpecification.Defaults.Env {
+			runSpecification.Env[key] = value
+		}
+		for key, value := range rawSpecification.Run.Env {
+			runSpecification.Env[key] = value
+		}
+	}
+	if runSpecification.User == "" {
+		runSpecification.User = rawSpecification.Defaults.User
+	}
+
+	materializedRunSpecification, err := MaterializeRunSpecification(runSpecification)
 	if err != nil {
-		return rawSpecification, fmt.Errorf("Could not materialize run specification: %s", err.Error())
+		return rawSpecification, &InvalidSpecificationError{Err: fmt.Errorf("Could not materialize run specification: %w", err)}
 	}
 
 	materializedSpecification := ComponentSpecification{
-		Build: rawSpecification.Build,
-		Run:   materializedRunSpecification,
+		Build:    rawSpecification.Build,
+		Run:      materializedRunSpecification,
+		Defaults: rawSpecification.Defaults,
+		Dev:      rawSpecification.Dev,
 	}
 	return materializedSpecification, nil
 }
@@ -138,30 +671,56 @@ func MaterializeComponentSpecification(rawSpecification ComponentSpecification)
 func MaterializeRunSpecification(rawSpecification RunSpecification) (RunSpecification, error) {
 	materializedUser, err := MaterializeUsername(rawSpecification.User)
 	if err != nil {
-		return rawSpecification, fmt.Errorf("Could not materialize user: %s", err.Error())
+		return rawSpecification, fmt.Errorf("Could not materialize user: %w", err)
 	}
 
 	materializedEnv := map[string]string{}
 	for key, value := range rawSpecification.Env {
-		materializedEnv[key] = MaterializeEnv(value)
+		materializedEnv[key], err = MaterializeEnv(value)
+		if err != nil {
+			return rawSpecification, fmt.Errorf("Could not materialize environment variable (%s): %w", key, err)
+		}
+	}
+	for _, key := range rawSpecification.Sensitive {
+		MarkSensitive(materializedEnv[key])
 	}
 
 	materializedEntrypoint := make([]string, len(rawSpecification.Entrypoint))
 	for i, value := range rawSpecification.Entrypoint {
-		materializedEntrypoint[i] = MaterializeEnv(value)
+		materializedEntrypoint[i], err = MaterializeEnv(value)
+		if err != nil {
+			return rawSpecification, fmt.Errorf("Could not materialize entrypoint: %w", err)
+		}
 	}
 
 	materializedCmd := make([]string, len(rawSpecification.Cmd))
 	for i, value := range rawSpecification.Cmd {
-		materializedCmd[i] = MaterializeEnv(value)
+		materializedCmd[i], err = MaterializeEnv(value)
+		if err != nil {
+			return rawSpecification, fmt.Errorf("Could not materialize cmd: %w", err)
+		}
+	}
+
+	materializedWorkdir, err := MaterializeEnv(rawSpecification.Workdir)
+	if err != nil {
+		return rawSpecification, fmt.Errorf("Could not materialize workdir: %w", err)
 	}
 
 	materializedSpecification := RunSpecification{
-		Env:         materializedEnv,
-		Entrypoint:  materializedEntrypoint,
-		Cmd:         materializedCmd,
-		Mountpoints: rawSpecification.Mountpoints,
-		User:        materializedUser,
+		Env:           materializedEnv,
+		Entrypoint:    materializedEntrypoint,
+		Cmd:           materializedCmd,
+		Mountpoints:   rawSpecification.Mountpoints,
+		User:          materializedUser,
+		Privileged:    rawSpecification.Privileged,
+		Devices:       rawSpecification.Devices,
+		ShmSize:       rawSpecification.ShmSize,
+		Ulimits:       rawSpecification.Ulimits,
+		Workdir:       materializedWorkdir,
+		Ports:         rawSpecification.Ports,
+		Healthcheck:   rawSpecification.Healthcheck,
+		RestartPolicy: rawSpecification.RestartPolicy,
+		Sensitive:     rawSpecification.Sensitive,
 	}
 	return materializedSpecification, nil
 }
@@ -173,14 +732,64 @@ var SpecialPrefixEnv = "env:"
 // SpecialPrefixUsername denotes that a value in a specification refers to a username, its suffix.
 var SpecialPrefixUsername = "user:"
 
+// EnvironmentPolicy restricts the environment variables that MaterializeEnv may read. The shn CLI
+// sets it from the state configuration.
+var EnvironmentPolicy state.EnvironmentConfiguration
+
+// ErrEnvironmentVariableNotPermitted - signifies that a specification refers to an environment
+// variable which EnvironmentPolicy does not permit it to read
+var ErrEnvironmentVariableNotPermitted = errors.New("Environment variable is not permitted by the environment policy in the state configuration")
+
+// EnvironmentVariableName returns the name of the environment variable that the given "env:"
+// value refers to. The second return value is false if the value is not an "env:" value.
+func EnvironmentVariableName(rawValue string) (string, bool) {
+	if !strings.HasPrefix(rawValue, SpecialPrefixEnv) {
+		return "", false
+	}
+	name := rawValue[len(SpecialPrefixEnv):]
+	if separator := strings.Index(name, ":"); separator >= 0 {
+		return name[:separator], true
+	}
+	return strings.TrimSuffix(name, "!"), true
+}
+
 // MaterializeEnv checks if a string is prefixed with "env:". If it is, it returns the value of the
 // environment variable whose name is the remainder of the string. If not, it returns the input
-// value.
-func MaterializeEnv(rawValue string) string {
-	if len(rawValue) >= len(SpecialPrefixEnv) && rawValue[:len(SpecialPrefixEnv)] == SpecialPrefixEnv {
-		return os.Getenv(rawValue[len(SpecialPrefixEnv):])
+// value. The remainder may also be of the form "VAR:default", in which case default is returned
+// if VAR is unset or empty, or of the form "VAR!", in which case an error is returned if VAR is
+// unset. Returns an error if EnvironmentPolicy does not permit VAR to be read (even if it is unset).
+func MaterializeEnv(rawValue string) (string, error) {
+	if name, ok := EnvironmentVariableName(rawValue); ok && !EnvironmentPolicy.Permits(name) {
+		return "", fmt.Errorf("%w: %s", ErrEnvironmentVariableNotPermitted, name)
+	}
+	return MaterializeTrustedEnv(rawValue)
+}
+
+// MaterializeTrustedEnv behaves like MaterializeEnv, but ignores EnvironmentPolicy. It is used for
+// values in the state configuration, which the policy does not restrict.
+func MaterializeTrustedEnv(rawValue string) (string, error) {
+	if len(rawValue) < len(SpecialPrefixEnv) || rawValue[:len(SpecialPrefixEnv)] != SpecialPrefixEnv {
+		return rawValue, nil
+	}
+	name := rawValue[len(SpecialPrefixEnv):]
+
+	if separator := strings.Index(name, ":"); separator >= 0 {
+		value := os.Getenv(name[:separator])
+		if value == "" {
+			return name[separator+1:], nil
+		}
+		return value, nil
+	}
+
+	if strings.HasSuffix(name, "!") {
+		name = strings.TrimSuffix(name, "!")
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return "", fmt.Errorf("Required environment variable is not set: %s", name)
+		}
+		return value, nil
 	}
-	return rawValue
+	return os.Getenv(name), nil
 }
 
 // MaterializeUsername returns a "uid:gid" string for the user with the given name if the user
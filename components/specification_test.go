@@ -1,8 +1,17 @@
 package components
 
 import (
+	"errors"
+	"os"
+	"reflect"
 	"strings"
 	"testing"
+	"time"
+
+	dockerContainer "github.com/docker/docker/api/types/container"
+	"github.com/docker/go-connections/nat"
+
+	"github.com/simiotics/shnorky/state"
 )
 
 func TestReadSingleSpecification(t *testing.T) {
@@ -147,6 +156,263 @@ func TestReadSingleSpecification(t *testing.T) {
 }`,
 			returnsError: false,
 		},
+		// Privileged mode and devices
+		{
+			specificationRaw: `
+{
+	"build": {
+		"Dockerfile": "Dockerfile",
+		"context": "component-dir"
+	},
+	"run": {
+		"cmd": ["echo", "hello", "world"],
+		"mountpoints": [],
+		"privileged": true,
+		"devices": ["/dev/fuse", "/dev/video0:/dev/camera:rw"]
+	}
+}`,
+			returnsError: false,
+		},
+		// Invalid device permissions
+		{
+			specificationRaw: `
+{
+	"build": {
+		"Dockerfile": "Dockerfile",
+		"context": "component-dir"
+	},
+	"run": {
+		"cmd": ["echo", "hello", "world"],
+		"mountpoints": [],
+		"devices": ["/dev/fuse:/dev/fuse:rwx"]
+	}
+}`,
+			returnsError: true,
+			testError:    ErrInvalidDevice,
+		},
+		// Shared memory size
+		{
+			specificationRaw: `
+{
+	"build": {
+		"Dockerfile": "Dockerfile",
+		"context": "component-dir"
+	},
+	"run": {
+		"cmd": ["python", "train.py"],
+		"mountpoints": [],
+		"shm_size": "2g"
+	}
+}`,
+			returnsError: false,
+		},
+		// Invalid shared memory size
+		{
+			specificationRaw: `
+{
+	"build": {
+		"Dockerfile": "Dockerfile",
+		"context": "component-dir"
+	},
+	"run": {
+		"cmd": ["python", "train.py"],
+		"mountpoints": [],
+		"shm_size": "lots"
+	}
+}`,
+			returnsError: true,
+			testError:    ErrInvalidShmSize,
+		},
+		// Ulimits
+		{
+			specificationRaw: `
+{
+	"build": {
+		"Dockerfile": "Dockerfile",
+		"context": "component-dir"
+	},
+	"run": {
+		"cmd": ["python", "etl.py"],
+		"mountpoints": [],
+		"ulimits": ["nofile=65536", "memlock=-1:-1"]
+	}
+}`,
+			returnsError: false,
+		},
+		// Ports and healthcheck
+		{
+			specificationRaw: `
+{
+	"build": {
+		"Dockerfile": "Dockerfile",
+		"context": "component-dir"
+	},
+	"run": {
+		"cmd": ["python", "-m", "http.server", "80"],
+		"mountpoints": [],
+		"ports": ["8080:80", "127.0.0.1:9090:9090/tcp"],
+		"healthcheck": {"cmd": ["curl", "-f", "http://localhost"], "interval": "5s", "retries": 5}
+	}
+}`,
+			returnsError: false,
+		},
+		// Invalid port
+		{
+			specificationRaw: `
+{
+	"build": {
+		"Dockerfile": "Dockerfile",
+		"context": "component-dir"
+	},
+	"run": {
+		"cmd": ["python", "-m", "http.server", "80"],
+		"mountpoints": [],
+		"ports": ["http:80"]
+	}
+}`,
+			returnsError: true,
+			testError:    ErrInvalidPort,
+		},
+		// Healthcheck without a command
+		{
+			specificationRaw: `
+{
+	"build": {
+		"Dockerfile": "Dockerfile",
+		"context": "component-dir"
+	},
+	"run": {
+		"cmd": ["python", "-m", "http.server", "80"],
+		"mountpoints": [],
+		"healthcheck": {"interval": "5s"}
+	}
+}`,
+			returnsError: true,
+			testError:    ErrInvalidHealthcheck,
+		},
+		// Default mounts targeting declared mountpoints
+		{
+			specificationRaw: `
+{
+	"build": {
+		"Dockerfile": "Dockerfile",
+		"context": "component-dir"
+	},
+	"run": {
+		"cmd": ["python", "etl.py"],
+		"mountpoints": [{"mount_type": "dir", "mountpoint": "/opt/mounthere", "read_only": false, "required": true}]
+	},
+	"defaults": {
+		"mounts": [{"source": "data", "target": "/opt/mounthere", "method": "bind"}],
+		"env": {"LOG_LEVEL": "info"},
+		"user": "env:UID"
+	}
+}`,
+			returnsError: false,
+		},
+		// Default mount targeting undeclared mountpoint
+		{
+			specificationRaw: `
+{
+	"build": {
+		"Dockerfile": "Dockerfile",
+		"context": "component-dir"
+	},
+	"run": {
+		"cmd": ["python", "etl.py"],
+		"mountpoints": []
+	},
+	"defaults": {
+		"mounts": [{"source": "data", "target": "/opt/mounthere", "method": "bind"}]
+	}
+}`,
+			returnsError: true,
+		},
+		// Default mount with remote source
+		{
+			specificationRaw: `
+{
+	"build": {
+		"Dockerfile": "Dockerfile",
+		"context": "component-dir"
+	},
+	"run": {
+		"cmd": ["python", "etl.py"],
+		"mountpoints": [{"mount_type": "dir", "mountpoint": "/opt/mounthere", "read_only": false, "required": true}]
+	},
+	"defaults": {
+		"mounts": [{"source": "s3://bucket/data", "target": "/opt/mounthere", "method": "bind"}]
+	}
+}`,
+			returnsError: true,
+		},
+		// Invalid ulimit name
+		{
+			specificationRaw: `
+{
+	"build": {
+		"Dockerfile": "Dockerfile",
+		"context": "component-dir"
+	},
+	"run": {
+		"cmd": ["python", "etl.py"],
+		"mountpoints": [],
+		"ulimits": ["openfiles=65536"]
+	}
+}`,
+			returnsError: true,
+			testError:    ErrInvalidUlimit,
+		},
+		// Hot-reloaded service
+		{
+			specificationRaw: `
+{
+	"build": {"Dockerfile": "Dockerfile", "context": "."},
+	"run": {"cmd": ["python", "server.py"], "mountpoints": []},
+	"dev": {"mountpoint": "/app", "source": "src", "reload": "signal", "signal": "SIGUSR1", "rebuild": ["requirements.txt"]}
+}`,
+			returnsError: false,
+		},
+		// Dev specification without a mountpoint
+		{
+			specificationRaw: `
+{
+	"build": {"Dockerfile": "Dockerfile", "context": "."},
+	"run": {"cmd": ["python", "server.py"], "mountpoints": []},
+	"dev": {"source": "src"}
+}`,
+			returnsError: true,
+		},
+		// Relative dev mountpoint
+		{
+			specificationRaw: `
+{
+	"build": {"Dockerfile": "Dockerfile", "context": "."},
+	"run": {"cmd": ["python", "server.py"], "mountpoints": []},
+	"dev": {"mountpoint": "app"}
+}`,
+			returnsError: true,
+		},
+		// Invalid reload method
+		{
+			specificationRaw: `
+{
+	"build": {"Dockerfile": "Dockerfile", "context": "."},
+	"run": {"cmd": ["python", "server.py"], "mountpoints": []},
+	"dev": {"mountpoint": "/app", "reload": "rebuild"}
+}`,
+			returnsError: true,
+		},
+		// Dev signal without signal reload method
+		{
+			specificationRaw: `
+{
+	"build": {"Dockerfile": "Dockerfile", "context": "."},
+	"run": {"cmd": ["python", "server.py"], "mountpoints": []},
+	"dev": {"mountpoint": "/app", "signal": "SIGUSR1"}
+}`,
+			returnsError: true,
+		},
 	}
 
 	for i, testCase := range testCases {
@@ -156,8 +422,453 @@ func TestReadSingleSpecification(t *testing.T) {
 			t.Errorf("[Test %d] Did not expect error: %s", i, err.Error())
 		} else if err == nil && testCase.returnsError {
 			t.Errorf("[Test %d] Expected error but received none", i)
-		} else if testCase.returnsError && testCase.testError != nil && err != testCase.testError {
+		} else if testCase.returnsError && testCase.testError != nil && !errors.Is(err, testCase.testError) {
 			t.Errorf("[Test %d] Did not get expected error: expected=%s, actual=%s", i, testCase.testError.Error(), err.Error())
 		}
 	}
 }
+
+func TestParseDeviceMapping(t *testing.T) {
+	type ParseDeviceMappingTestCase struct {
+		device            string
+		pathOnHost        string
+		pathInContainer   string
+		cgroupPermissions string
+		expectedError     error
+	}
+
+	testCases := []ParseDeviceMappingTestCase{
+		{
+			device:            "/dev/fuse",
+			pathOnHost:        "/dev/fuse",
+			pathInContainer:   "/dev/fuse",
+			cgroupPermissions: "rwm",
+		},
+		{
+			device:            "/dev/video0:/dev/camera",
+			pathOnHost:        "/dev/video0",
+			pathInContainer:   "/dev/camera",
+			cgroupPermissions: "rwm",
+		},
+		{
+			device:            "/dev/video0::r",
+			pathOnHost:        "/dev/video0",
+			pathInContainer:   "/dev/video0",
+			cgroupPermissions: "r",
+		},
+		{
+			device:        "",
+			expectedError: ErrInvalidDevice,
+		},
+		{
+			device:        ":/dev/fuse",
+			expectedError: ErrInvalidDevice,
+		},
+		{
+			device:        "/dev/fuse:/dev/fuse:rwm:extra",
+			expectedError: ErrInvalidDevice,
+		},
+		{
+			device:        "/dev/fuse:/dev/fuse:",
+			expectedError: ErrInvalidDevice,
+		},
+	}
+
+	for i, testCase := range testCases {
+		mapping, err := ParseDeviceMapping(testCase.device)
+		if err != testCase.expectedError {
+			t.Errorf("[Test %d] Unexpected error: expected=%v, actual=%v", i, testCase.expectedError, err)
+			continue
+		}
+		if mapping.PathOnHost != testCase.pathOnHost {
+			t.Errorf("[Test %d] Unexpected PathOnHost: expected=%s, actual=%s", i, testCase.pathOnHost, mapping.PathOnHost)
+		}
+		if mapping.PathInContainer != testCase.pathInContainer {
+			t.Errorf("[Test %d] Unexpected PathInContainer: expected=%s, actual=%s", i, testCase.pathInContainer, mapping.PathInContainer)
+		}
+		if mapping.CgroupPermissions != testCase.cgroupPermissions {
+			t.Errorf("[Test %d] Unexpected CgroupPermissions: expected=%s, actual=%s", i, testCase.cgroupPermissions, mapping.CgroupPermissions)
+		}
+	}
+}
+
+func TestParseShmSize(t *testing.T) {
+	type ParseShmSizeTestCase struct {
+		shmSize       string
+		expectedSize  int64
+		expectedError error
+	}
+
+	testCases := []ParseShmSizeTestCase{
+		{shmSize: "", expectedSize: 0},
+		{shmSize: "1024", expectedSize: 1024},
+		{shmSize: "64m", expectedSize: 64 * 1024 * 1024},
+		{shmSize: "2g", expectedSize: 2 * 1024 * 1024 * 1024},
+		{shmSize: "2gigantic", expectedError: ErrInvalidShmSize},
+		{shmSize: "-1", expectedError: ErrInvalidShmSize},
+	}
+
+	for i, testCase := range testCases {
+		size, err := ParseShmSize(testCase.shmSize)
+		if err != testCase.expectedError {
+			t.Errorf("[Test %d] Unexpected error: expected=%v, actual=%v", i, testCase.expectedError, err)
+		}
+		if size != testCase.expectedSize {
+			t.Errorf("[Test %d] Unexpected size: expected=%d, actual=%d", i, testCase.expectedSize, size)
+		}
+	}
+}
+
+func TestValidateExtraHosts(t *testing.T) {
+	type ValidateExtraHostsTestCase struct {
+		extraHosts    []string
+		expectedError error
+	}
+
+	testCases := []ValidateExtraHostsTestCase{
+		{extraHosts: nil},
+		{extraHosts: []string{"mirror.internal:10.0.0.5", "mirror6.internal:fd00::5"}},
+		{extraHosts: []string{"host.docker.internal:host-gateway"}},
+		{extraHosts: []string{"mirror.internal"}, expectedError: ErrInvalidExtraHost},
+		{extraHosts: []string{":10.0.0.5"}, expectedError: ErrInvalidExtraHost},
+		{extraHosts: []string{"mirror.internal:not-an-ip"}, expectedError: ErrInvalidExtraHost},
+	}
+
+	for i, testCase := range testCases {
+		err := ValidateExtraHosts(testCase.extraHosts)
+		if err != testCase.expectedError {
+			t.Errorf("[Test %d] Unexpected error: expected=%v, actual=%v", i, testCase.expectedError, err)
+		}
+	}
+}
+
+func TestParseUlimits(t *testing.T) {
+	type ParseUlimitsTestCase struct {
+		ulimits       []string
+		expectedNames []string
+		expectedSoft  []int64
+		expectedHard  []int64
+		expectedError error
+	}
+
+	testCases := []ParseUlimitsTestCase{
+		{
+			ulimits:       []string{},
+			expectedNames: []string{},
+			expectedSoft:  []int64{},
+			expectedHard:  []int64{},
+		},
+		{
+			ulimits:       []string{"nofile=1024:2048", "memlock=-1"},
+			expectedNames: []string{"nofile", "memlock"},
+			expectedSoft:  []int64{1024, -1},
+			expectedHard:  []int64{2048, -1},
+		},
+		{
+			ulimits:       []string{"nofile"},
+			expectedError: ErrInvalidUlimit,
+		},
+		{
+			ulimits:       []string{"nofile=2048:1024"},
+			expectedError: ErrInvalidUlimit,
+		},
+	}
+
+	for i, testCase := range testCases {
+		ulimits, err := ParseUlimits(testCase.ulimits)
+		if err != testCase.expectedError {
+			t.Errorf("[Test %d] Unexpected error: expected=%v, actual=%v", i, testCase.expectedError, err)
+			continue
+		}
+		if len(ulimits) != len(testCase.expectedNames) {
+			t.Errorf("[Test %d] Unexpected number of ulimits: expected=%d, actual=%d", i, len(testCase.expectedNames), len(ulimits))
+			continue
+		}
+		for j, ulimit := range ulimits {
+			if ulimit.Name != testCase.expectedNames[j] || ulimit.Soft != testCase.expectedSoft[j] || ulimit.Hard != testCase.expectedHard[j] {
+				t.Errorf("[Test %d] Unexpected ulimit %d: expected=%s=%d:%d, actual=%s=%d:%d", i, j, testCase.expectedNames[j], testCase.expectedSoft[j], testCase.expectedHard[j], ulimit.Name, ulimit.Soft, ulimit.Hard)
+			}
+		}
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	type ParsePortsTestCase struct {
+		ports            []string
+		expectedExposed  []string
+		expectedBindings map[string]string
+		expectedError    error
+	}
+
+	testCases := []ParsePortsTestCase{
+		{ports: []string{}, expectedExposed: []string{}, expectedBindings: map[string]string{}},
+		{
+			ports:            []string{"8080:80", "127.0.0.1:5432:5432", "53/udp"},
+			expectedExposed:  []string{"80/tcp", "5432/tcp", "53/udp"},
+			expectedBindings: map[string]string{"80/tcp": ":8080", "5432/tcp": "127.0.0.1:5432", "53/udp": ":"},
+		},
+		{ports: []string{"http:80"}, expectedError: ErrInvalidPort},
+		{ports: []string{"8080:80/sctcp"}, expectedError: ErrInvalidPort},
+	}
+
+	for i, testCase := range testCases {
+		exposed, bindings, err := ParsePorts(testCase.ports)
+		if err != testCase.expectedError {
+			t.Errorf("[Test %d] Unexpected error: expected=%v, actual=%v", i, testCase.expectedError, err)
+			continue
+		}
+		if len(exposed) != len(testCase.expectedExposed) {
+			t.Errorf("[Test %d] Unexpected number of exposed ports: expected=%d, actual=%d", i, len(testCase.expectedExposed), len(exposed))
+		}
+		for _, port := range testCase.expectedExposed {
+			if _, ok := exposed[nat.Port(port)]; !ok {
+				t.Errorf("[Test %d] Port (%s) was not exposed", i, port)
+			}
+		}
+		for port, expectedBinding := range testCase.expectedBindings {
+			portBindings := bindings[nat.Port(port)]
+			if len(portBindings) != 1 {
+				t.Errorf("[Test %d] Unexpected number of bindings for port (%s): %d", i, port, len(portBindings))
+				continue
+			}
+			binding := portBindings[0].HostIP + ":" + portBindings[0].HostPort
+			if binding != expectedBinding {
+				t.Errorf("[Test %d] Unexpected binding for port (%s): expected=%s, actual=%s", i, port, expectedBinding, binding)
+			}
+		}
+	}
+}
+
+func TestParseHealthcheck(t *testing.T) {
+	type ParseHealthcheckTestCase struct {
+		healthcheck    *HealthcheckSpecification
+		expectedConfig *dockerContainer.HealthConfig
+		expectedError  error
+	}
+
+	testCases := []ParseHealthcheckTestCase{
+		{healthcheck: nil, expectedConfig: nil},
+		{
+			healthcheck:    &HealthcheckSpecification{Cmd: []string{"pg_isready"}},
+			expectedConfig: &dockerContainer.HealthConfig{Test: []string{"CMD-SHELL", "pg_isready"}},
+		},
+		{
+			healthcheck: &HealthcheckSpecification{Cmd: []string{"curl", "-f", "http://localhost"}, Interval: "5s", Timeout: "1s", StartPeriod: "1m", Retries: 10},
+			expectedConfig: &dockerContainer.HealthConfig{
+				Test:        []string{"CMD", "curl", "-f", "http://localhost"},
+				Interval:    5 * time.Second,
+				Timeout:     time.Second,
+				StartPeriod: time.Minute,
+				Retries:     10,
+			},
+		},
+		{healthcheck: &HealthcheckSpecification{}, expectedError: ErrInvalidHealthcheck},
+		{healthcheck: &HealthcheckSpecification{Cmd: []string{"true"}, Interval: "often"}, expectedError: ErrInvalidHealthcheck},
+		{healthcheck: &HealthcheckSpecification{Cmd: []string{"true"}, Retries: -1}, expectedError: ErrInvalidHealthcheck},
+	}
+
+	for i, testCase := range testCases {
+		config, err := ParseHealthcheck(testCase.healthcheck)
+		if err != testCase.expectedError {
+			t.Errorf("[Test %d] Unexpected error: expected=%v, actual=%v", i, testCase.expectedError, err)
+			continue
+		}
+		if !reflect.DeepEqual(config, testCase.expectedConfig) {
+			t.Errorf("[Test %d] Unexpected healthcheck: expected=%v, actual=%v", i, testCase.expectedConfig, config)
+		}
+	}
+}
+
+func TestParseRestartPolicy(t *testing.T) {
+	type ParseRestartPolicyTestCase struct {
+		restartPolicy  string
+		expectedPolicy dockerContainer.RestartPolicy
+		expectedError  error
+	}
+
+	testCases := []ParseRestartPolicyTestCase{
+		{restartPolicy: "", expectedPolicy: dockerContainer.RestartPolicy{}},
+		{restartPolicy: "no", expectedPolicy: dockerContainer.RestartPolicy{Name: "no"}},
+		{restartPolicy: "always", expectedPolicy: dockerContainer.RestartPolicy{Name: "always"}},
+		{restartPolicy: "on-failure", expectedPolicy: dockerContainer.RestartPolicy{Name: "on-failure"}},
+		{restartPolicy: "on-failure:5", expectedPolicy: dockerContainer.RestartPolicy{Name: "on-failure", MaximumRetryCount: 5}},
+		{restartPolicy: "on-failure:-1", expectedError: ErrInvalidRestartPolicy},
+		{restartPolicy: "on-failure:often", expectedError: ErrInvalidRestartPolicy},
+		{restartPolicy: "always:3", expectedError: ErrInvalidRestartPolicy},
+		{restartPolicy: "sometimes", expectedError: ErrInvalidRestartPolicy},
+	}
+
+	for i, testCase := range testCases {
+		policy, err := ParseRestartPolicy(testCase.restartPolicy)
+		if err != testCase.expectedError {
+			t.Errorf("[Test %d] Unexpected error: expected=%v, actual=%v", i, testCase.expectedError, err)
+			continue
+		}
+		if policy != testCase.expectedPolicy {
+			t.Errorf("[Test %d] Unexpected restart policy: expected=%v, actual=%v", i, testCase.expectedPolicy, policy)
+		}
+	}
+}
+
+func TestMaterializeEnv(t *testing.T) {
+	os.Setenv("SHNORKY_TEST_SET", "value")
+	os.Setenv("SHNORKY_TEST_EMPTY", "")
+	os.Unsetenv("SHNORKY_TEST_UNSET")
+	defer os.Unsetenv("SHNORKY_TEST_SET")
+	defer os.Unsetenv("SHNORKY_TEST_EMPTY")
+
+	type envTest struct {
+		rawValue      string
+		expectedValue string
+		returnsError  bool
+	}
+
+	testCases := []envTest{
+		{rawValue: "literal", expectedValue: "literal"},
+		{rawValue: "env:SHNORKY_TEST_SET", expectedValue: "value"},
+		{rawValue: "env:SHNORKY_TEST_UNSET", expectedValue: ""},
+		{rawValue: "env:SHNORKY_TEST_SET:default", expectedValue: "value"},
+		{rawValue: "env:SHNORKY_TEST_UNSET:default", expectedValue: "default"},
+		{rawValue: "env:SHNORKY_TEST_EMPTY:default", expectedValue: "default"},
+		{rawValue: "env:SHNORKY_TEST_UNSET:http://localhost:8080", expectedValue: "http://localhost:8080"},
+		{rawValue: "env:SHNORKY_TEST_UNSET:", expectedValue: ""},
+		{rawValue: "env:SHNORKY_TEST_SET!", expectedValue: "value"},
+		{rawValue: "env:SHNORKY_TEST_EMPTY!", expectedValue: ""},
+		{rawValue: "env:SHNORKY_TEST_UNSET!", returnsError: true},
+	}
+
+	for i, testCase := range testCases {
+		value, err := MaterializeEnv(testCase.rawValue)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		} else if value != testCase.expectedValue {
+			t.Errorf("[Test %d] Unexpected value: expected=%s, actual=%s", i, testCase.expectedValue, value)
+		}
+	}
+}
+
+func TestMaterializeEnvPolicy(t *testing.T) {
+	os.Setenv("SHNORKY_TEST_SET", "value")
+	os.Setenv("SHNORKY_TEST_SECRET", "secret")
+	defer os.Unsetenv("SHNORKY_TEST_SET")
+	defer os.Unsetenv("SHNORKY_TEST_SECRET")
+
+	originalPolicy := EnvironmentPolicy
+	EnvironmentPolicy = state.EnvironmentConfiguration{Allow: []string{"SHNORKY_TEST_*"}, Deny: []string{"*_SECRET"}}
+	defer func() { EnvironmentPolicy = originalPolicy }()
+
+	type policyTest struct {
+		rawValue      string
+		expectedValue string
+		returnsError  bool
+	}
+
+	testCases := []policyTest{
+		{rawValue: "literal", expectedValue: "literal"},
+		{rawValue: "env:SHNORKY_TEST_SET", expectedValue: "value"},
+		{rawValue: "env:SHNORKY_TEST_SECRET", returnsError: true},
+		{rawValue: "env:SHNORKY_TEST_SECRET:default", returnsError: true},
+		{rawValue: "env:SHNORKY_TEST_SECRET!", returnsError: true},
+		{rawValue: "env:HOME", returnsError: true},
+	}
+
+	for i, testCase := range testCases {
+		value, err := MaterializeEnv(testCase.rawValue)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		} else if err != nil && !errors.Is(err, ErrEnvironmentVariableNotPermitted) {
+			t.Errorf("[Test %d] Unexpected error: expected=%v, actual=%v", i, ErrEnvironmentVariableNotPermitted, err)
+		} else if value != testCase.expectedValue {
+			t.Errorf("[Test %d] Unexpected value: expected=%s, actual=%s", i, testCase.expectedValue, value)
+		}
+	}
+
+	value, err := MaterializeTrustedEnv("env:SHNORKY_TEST_SECRET")
+	if err != nil {
+		t.Fatalf("Unexpected error materializing trusted value: %s", err.Error())
+	}
+	if value != "secret" {
+		t.Errorf("Unexpected trusted value: expected=secret, actual=%s", value)
+	}
+}
+
+func TestApplyDefaultMounts(t *testing.T) {
+	specification := ComponentSpecification{
+		Run: RunSpecification{
+			Mountpoints: []MountSpecification{
+				{MountType: "dir", Mountpoint: "/shnorky/inputs", Required: true},
+				{MountType: "dir", Mountpoint: "/shnorky/outputs", Required: true},
+			},
+		},
+		Defaults: DefaultsSpecification{
+			Mounts: []MountConfiguration{
+				{Source: "inputs", Target: "/shnorky/inputs", Method: "bind"},
+				{Source: "/tmp/outputs", Target: "/shnorky/outputs", Method: "bind"},
+			},
+		},
+	}
+
+	mounts, err := ApplyDefaultMounts(specification, "/components/etl", []MountConfiguration{})
+	if err != nil {
+		t.Fatalf("Unexpected error applying default mounts: %s", err.Error())
+	}
+	expectedMounts := []MountConfiguration{
+		{Source: "/components/etl/inputs", Target: "/shnorky/inputs", Method: "bind"},
+		{Source: "/tmp/outputs", Target: "/shnorky/outputs", Method: "bind"},
+	}
+	if !reflect.DeepEqual(mounts, expectedMounts) {
+		t.Errorf("Unexpected mounts: expected=%v, actual=%v", expectedMounts, mounts)
+	}
+
+	overrides := []MountConfiguration{{Source: "/data/outputs", Target: "/shnorky/outputs", Method: "bind"}}
+	mounts, err = ApplyDefaultMounts(specification, "/components/etl", overrides)
+	if err != nil {
+		t.Fatalf("Unexpected error applying default mounts with overrides: %s", err.Error())
+	}
+	expectedMounts = []MountConfiguration{
+		{Source: "/data/outputs", Target: "/shnorky/outputs", Method: "bind"},
+		{Source: "/components/etl/inputs", Target: "/shnorky/inputs", Method: "bind"},
+	}
+	if !reflect.DeepEqual(mounts, expectedMounts) {
+		t.Errorf("Unexpected mounts with overrides: expected=%v, actual=%v", expectedMounts, mounts)
+	}
+
+	if err := ValidateMounts(specification, overrides); err != nil {
+		t.Errorf("Expected default mounts to satisfy required mountpoints: %s", err.Error())
+	}
+}
+
+func TestMaterializeComponentSpecificationDefaults(t *testing.T) {
+	rawSpecification := ComponentSpecification{
+		Run: RunSpecification{Env: map[string]string{"LOG_LEVEL": "debug"}},
+		Defaults: DefaultsSpecification{
+			Env:  map[string]string{"LOG_LEVEL": "info", "REGION": "us-east-1"},
+			User: "1000:1000",
+		},
+	}
+
+	specification, err := MaterializeComponentSpecification(rawSpecification)
+	if err != nil {
+		t.Fatalf("Unexpected error materializing specification: %s", err.Error())
+	}
+	expectedEnv := map[string]string{"LOG_LEVEL": "debug", "REGION": "us-east-1"}
+	if !reflect.DeepEqual(specification.Run.Env, expectedEnv) {
+		t.Errorf("Unexpected env: expected=%v, actual=%v", expectedEnv, specification.Run.Env)
+	}
+	if specification.Run.User != "1000:1000" {
+		t.Errorf("Unexpected user: expected=%s, actual=%s", "1000:1000", specification.Run.User)
+	}
+
+	rawSpecification.Run.User = "0:0"
+	specification, err = MaterializeComponentSpecification(rawSpecification)
+	if err != nil {
+		t.Fatalf("Unexpected error materializing specification with user: %s", err.Error())
+	}
+	if specification.Run.User != "0:0" {
+		t.Errorf("Unexpected user: expected=%s, actual=%s", "0:0", specification.Run.User)
+	}
+}
@@ -0,0 +1,152 @@
+package components
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// SourceHash returns a hash of the contents of the given component: the paths, types, and contents
+// of the files under its component directory (skipping .git directories) and the contents of its
+// specification. Modification times are not part of the hash, so touching a file without changing it
+// does not change the hash.
+func SourceHash(component ComponentMetadata) (string, error) {
+	hash := sha256.New()
+	err := hashTree(hash, component.ComponentPath)
+	if err != nil {
+		return "", err
+	}
+
+	io.WriteString(hash, "specification\x00")
+	err = hashFile(hash, component.SpecificationPath)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashTree writes the paths (relative to root), types, and contents of the file at the given root
+// or, if it is a directory, of the files under it (skipping .git directories) to the given writer
+func hashTree(w io.Writer, root string) error {
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() && info.Name() == ".git" {
+			return filepath.SkipDir
+		}
+		relativePath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "%s\x00%s\x00", filepath.ToSlash(relativePath), info.Mode().String())
+		switch {
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			io.WriteString(w, target)
+		case info.Mode().IsRegular():
+			if err := hashFile(w, path); err != nil {
+				return err
+			}
+		}
+		w.Write([]byte{0})
+		return nil
+	})
+}
+
+// hashFile writes the contents of the file at the given path to the given writer
+func hashFile(w io.Writer, path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	_, err = io.Copy(w, file)
+	return err
+}
+
+// BuildIsStale returns true if the component with the given ID has not been built yet, or if its
+// source has changed since its most recent build - that is, if its SourceHash differs from the one
+// recorded for the build. For builds which were recorded without a source hash, it instead checks
+// whether its specification or any of the files in its component directory has been modified since
+// the build. Modification times are compared at the resolution at which builds are recorded
+// (seconds), so changes made within the same second as such a build are not detected.
+func BuildIsStale(store state.Store, componentID string) (bool, error) {
+	return BuildIsStaleForTarget(store, componentID, "")
+}
+
+// BuildIsStaleForTarget behaves like BuildIsStale, but considers only the builds of the component
+// which were made for the given Dockerfile target (see BuildOptions)
+func BuildIsStaleForTarget(store state.Store, componentID, target string) (bool, error) {
+	componentMetadata, err := SelectComponentByID(store, componentID)
+	if err != nil {
+		return false, err
+	}
+	buildMetadata, err := SelectMostRecentBuildForTarget(store, componentID, target)
+	if err == ErrBuildNotFound {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	if buildMetadata.SourceHash != "" {
+		sourceHash, err := SourceHash(componentMetadata)
+		if err != nil {
+			return false, err
+		}
+		return sourceHash != buildMetadata.SourceHash, nil
+	}
+
+	modified, err := lastModified(componentMetadata.SpecificationPath)
+	if err != nil {
+		return false, err
+	}
+	if componentModified, err := lastModified(componentMetadata.ComponentPath); err != nil {
+		return false, err
+	} else if componentModified.After(modified) {
+		modified = componentModified
+	}
+	return modified.Truncate(time.Second).After(buildMetadata.CreatedAt), nil
+}
+
+// StaleComponents returns those of the components with the given IDs whose builds are stale (see
+// BuildIsStale), in the order in which they are given
+func StaleComponents(store state.Store, componentIDs []string) ([]string, error) {
+	stale := []string{}
+	for _, componentID := range componentIDs {
+		isStale, err := BuildIsStale(store, componentID)
+		if err != nil {
+			return stale, fmt.Errorf("Could not check build of component (%s): %w", componentID, err)
+		}
+		if isStale {
+			stale = append(stale, componentID)
+		}
+	}
+	return stale, nil
+}
+
+// lastModified returns the most recent modification time of the file at the given path or, if it
+// is a directory, of any file or directory under it
+func lastModified(root string) (time.Time, error) {
+	var modified time.Time
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.ModTime().After(modified) {
+			modified = info.ModTime()
+		}
+		return nil
+	})
+	return modified, err
+}
@@ -0,0 +1,135 @@
+package components
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestBuildIsStale(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-stale-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	componentPath := path.Join(stateDir, "component")
+	err = os.MkdirAll(componentPath, 0755)
+	if err != nil {
+		t.Fatalf("Could not create component directory: %s", err.Error())
+	}
+	for _, filename := range []string{DefaultSpecificationFileName, "Dockerfile"} {
+		err = ioutil.WriteFile(path.Join(componentPath, filename), []byte("{}"), 0644)
+		if err != nil {
+			t.Fatalf("Could not write %s: %s", filename, err.Error())
+		}
+	}
+	past := time.Now().Add(-time.Hour)
+	for _, filename := range []string{componentPath, path.Join(componentPath, DefaultSpecificationFileName), path.Join(componentPath, "Dockerfile")} {
+		os.Chtimes(filename, past, past)
+	}
+
+	_, err = EnsureComponent(store, "stale", Task, componentPath, "")
+	if err != nil {
+		t.Fatalf("Could not register component: %s", err.Error())
+	}
+	_, err = EnsureComponent(store, "stale", Task, componentPath, "")
+	if err != nil {
+		t.Errorf("Expected component to be ensured more than once: %s", err.Error())
+	}
+	_, err = EnsureComponent(store, "stale", Task, stateDir, "")
+	if err == nil {
+		t.Error("Expected error ensuring component with a different directory")
+	}
+	_, err = EnsureComponent(store, "stale", Task, componentPath, path.Join(componentPath, "Dockerfile"))
+	if err == nil {
+		t.Error("Expected error ensuring component with a different specification")
+	}
+
+	stale, err := BuildIsStale(store, "stale")
+	if err != nil || !stale {
+		t.Errorf("Expected component without builds to be stale: stale=%t, error=%v", stale, err)
+	}
+
+	buildMetadata, err := GenerateBuildMetadata("stale")
+	if err != nil {
+		t.Fatalf("Could not generate build metadata: %s", err.Error())
+	}
+	err = InsertBuild(store, buildMetadata)
+	if err != nil {
+		t.Fatalf("Could not insert build: %s", err.Error())
+	}
+	stale, err = BuildIsStale(store, "stale")
+	if err != nil || stale {
+		t.Errorf("Expected component built after its last modification not to be stale: stale=%t, error=%v", stale, err)
+	}
+
+	future := time.Now().Add(time.Hour)
+	os.Chtimes(path.Join(componentPath, "Dockerfile"), future, future)
+	stale, err = BuildIsStale(store, "stale")
+	if err != nil || !stale {
+		t.Errorf("Expected component modified after its last build to be stale: stale=%t, error=%v", stale, err)
+	}
+
+	// Builds recorded with a source hash are only stale once the contents of the component change
+	component, err := SelectComponentByID(store, "stale")
+	if err != nil {
+		t.Fatalf("Could not select component: %s", err.Error())
+	}
+	hashedBuild, err := GenerateBuildMetadata("stale")
+	if err != nil {
+		t.Fatalf("Could not generate build metadata: %s", err.Error())
+	}
+	hashedBuild.ID = hashedBuild.ID + "-hashed"
+	hashedBuild.CreatedAt = hashedBuild.CreatedAt.Add(time.Second)
+	hashedBuild.SourceHash, err = SourceHash(component)
+	if err != nil {
+		t.Fatalf("Could not hash component source: %s", err.Error())
+	}
+	err = InsertBuild(store, hashedBuild)
+	if err != nil {
+		t.Fatalf("Could not insert build: %s", err.Error())
+	}
+	stale, err = BuildIsStale(store, "stale")
+	if err != nil || stale {
+		t.Errorf("Expected touched but unchanged component not to be stale: stale=%t, error=%v", stale, err)
+	}
+
+	err = ioutil.WriteFile(path.Join(componentPath, "Dockerfile"), []byte("FROM alpine"), 0644)
+	if err != nil {
+		t.Fatalf("Could not modify Dockerfile: %s", err.Error())
+	}
+	os.Chtimes(path.Join(componentPath, "Dockerfile"), past, past)
+	staleComponents, err := StaleComponents(store, []string{"stale"})
+	if err != nil || len(staleComponents) != 1 || staleComponents[0] != "stale" {
+		t.Errorf("Expected component whose contents changed after its last build to be stale: stale=%v, error=%v", staleComponents, err)
+	}
+
+	_, err = BuildIsStale(store, "unregistered")
+	if err != ErrComponentNotFound {
+		t.Errorf("Unexpected error for unregistered component: expected=%v, actual=%v", ErrComponentNotFound, err)
+	}
+	_, err = StaleComponents(store, []string{"unregistered"})
+	if err == nil {
+		t.Error("Expected error checking builds of unregistered component")
+	}
+}
@@ -1,10 +1,9 @@
 package components
 
 import (
-	"database/sql"
 	"errors"
-	"fmt"
-	"time"
+
+	"github.com/simiotics/shnorky/state"
 )
 
 // ErrComponentNotFound - signifies that a single row lookup against a state database returned
@@ -15,184 +14,219 @@ var ErrComponentNotFound = errors.New("Could not find the specified component")
 // database returned no rows
 var ErrBuildNotFound = errors.New("Could not find the specified build")
 
-// SQL statements
-var insertComponent = "INSERT INTO components (id, component_type, component_path, specification_path, created_at) VALUES(?, ?, ?, ?, ?);"
-var selectComponents = "SELECT * FROM components;"
-var selectComponentByID = "SELECT * FROM components WHERE id=?;"
-var deleteComponentByID = "DELETE FROM components WHERE id=?;"
-var insertBuild = "INSERT INTO builds (id, component_id, created_at) VALUES(?, ?, ?);"
-var selectBuilds = "SELECT * FROM builds;"
-var selectBuildByID = "SELECT * FROM builds WHERE id=?;"
-var selectBuildsByComponentID = "SELECT * FROM builds WHERE component_id=?;"
-var selectMostRecentBuildForComponent = "SELECT * FROM builds WHERE component_id=? ORDER BY created_at DESC LIMIT 1;"
-var deleteBuildByID = "DELETE FROM builds WHERE id=?;"
-var deleteBuildsByComponentID = "DELETE FROM builds WHERE component_id=?"
-var insertExecutionWithNoFlowID = "INSERT INTO executions (id, build_id, component_id, created_at) VALUES(?, ?, ?, ?);"
-var insertExecution = "INSERT INTO executions (id, build_id, component_id, created_at, flow_id) VALUES(?, ?, ?, ?, ?);"
+// ErrExecutionNotFound - signifies that a single row lookup against the executions table in a
+// state database returned no rows
+var ErrExecutionNotFound = errors.New("Could not find the specified execution")
 
-// InsertComponent creates a new row in the components table with the given component information.
-func InsertComponent(db *sql.DB, component ComponentMetadata) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	_, err = tx.Exec(
-		insertComponent,
-		component.ID,
-		component.ComponentType,
-		component.ComponentPath,
-		component.SpecificationPath,
-		component.CreatedAt.Unix(),
-	)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
+// ErrInvalidPage signifies that a caller attempted to list rows from a state database with a
+// negative limit or offset
+var ErrInvalidPage = state.ErrInvalidPage
 
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
+// Page - selects a window of the rows which a list function (e.g. ListComponents) would otherwise
+// stream in full (see state.Page)
+type Page = state.Page
+
+// The functions below adapt the records of a state.Store to component, build, execution, and
+// artifact metadata, translating state.ErrNotFound into the errors specific to each of them
 
-	return nil
+// InsertComponent creates a new row in the components table with the given component information.
+func InsertComponent(store state.Store, component ComponentMetadata) error {
+	return store.InsertComponent(state.ComponentRecord{
+		ID:                    component.ID,
+		ComponentType:         component.ComponentType,
+		ComponentPath:         component.ComponentPath,
+		SpecificationPath:     component.SpecificationPath,
+		CreatedAt:             component.CreatedAt,
+		CreatedBy:             component.CreatedBy,
+		SpecificationChecksum: component.SpecificationChecksum,
+		SpecificationSnapshot: component.SpecificationSnapshot,
+	})
 }
 
 // SelectComponentByID gets component metadata from the given state database using the given ID.
 // If no component with the given ID is found, returns ErrComponentNotFound in the error position.
-func SelectComponentByID(db *sql.DB, id string) (ComponentMetadata, error) {
-	var rowID, componentType, componentPath, specificationPath string
-	var createdAt int64
-	row := db.QueryRow(selectComponentByID, id)
-	err := row.Scan(&rowID, &componentType, &componentPath, &specificationPath, &createdAt)
-	if err == sql.ErrNoRows {
+func SelectComponentByID(store state.Store, id string) (ComponentMetadata, error) {
+	record, err := store.SelectComponent(id)
+	if err == state.ErrNotFound {
 		return ComponentMetadata{}, ErrComponentNotFound
 	}
 	if err != nil {
 		return ComponentMetadata{}, err
 	}
-	if rowID != id {
-		return ComponentMetadata{}, fmt.Errorf("Result had unexpected row ID: expected=%s, actual=%s", id, rowID)
-	}
-	return ComponentMetadata{ID: rowID, ComponentType: componentType, ComponentPath: componentPath, SpecificationPath: specificationPath, CreatedAt: time.Unix(createdAt, 0)}, nil
+	return ComponentMetadata{
+		ID:                    record.ID,
+		ComponentType:         record.ComponentType,
+		ComponentPath:         record.ComponentPath,
+		SpecificationPath:     record.SpecificationPath,
+		CreatedAt:             record.CreatedAt,
+		CreatedBy:             record.CreatedBy,
+		SpecificationChecksum: record.SpecificationChecksum,
+		SpecificationSnapshot: record.SpecificationSnapshot,
+	}, nil
 }
 
-// DeleteComponentByID creates a new row in the components table with the given component information.
-func DeleteComponentByID(db *sql.DB, id string) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	_, err = tx.Exec(deleteComponentByID, id)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
+// UpdateComponent stores the type, directory, and specification path (along with the checksum and
+// snapshot of the specification) of the given component against its row in the given state
+// database. If there is no such row, returns ErrComponentNotFound.
+func UpdateComponent(store state.Store, component ComponentMetadata) error {
+	err := store.UpdateComponent(state.ComponentRecord{
+		ID:                    component.ID,
+		ComponentType:         component.ComponentType,
+		ComponentPath:         component.ComponentPath,
+		SpecificationPath:     component.SpecificationPath,
+		SpecificationChecksum: component.SpecificationChecksum,
+		SpecificationSnapshot: component.SpecificationSnapshot,
+	})
+	if err == state.ErrNotFound {
+		return ErrComponentNotFound
+	}
+	return err
+}
 
-	return nil
+// DeleteComponentByID removes the row for the component with the given ID from the components
+// table
+func DeleteComponentByID(store state.Store, id string) error {
+	return store.DeleteComponent(id)
 }
 
 // InsertBuild inserts the build represented by the given build metadata into the given shnorky
 // state database
-func InsertBuild(db *sql.DB, buildMetadata BuildMetadata) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
-	_, err = tx.Exec(
-		insertBuild,
-		buildMetadata.ID,
-		buildMetadata.ComponentID,
-		buildMetadata.CreatedAt.Unix(),
-	)
-	if err != nil {
-		tx.Rollback()
-		return err
-	}
-
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
-
-	return nil
+func InsertBuild(store state.Store, buildMetadata BuildMetadata) error {
+	return store.InsertBuild(state.BuildRecord(buildMetadata))
 }
 
 // SelectBuildByID gets build metadata from the given state database using the given ID.
 // If no build with the given ID is found, returns ErrBuildNotFound in the error position.
-func SelectBuildByID(db *sql.DB, id string) (BuildMetadata, error) {
-	var rowID, componentID string
-	var createdAt int64
-	row := db.QueryRow(selectBuildByID, id)
-	err := row.Scan(&rowID, &componentID, &createdAt)
-	if err == sql.ErrNoRows {
+func SelectBuildByID(store state.Store, id string) (BuildMetadata, error) {
+	record, err := store.SelectBuild(id)
+	if err == state.ErrNotFound {
 		return BuildMetadata{}, ErrBuildNotFound
 	}
-	if err != nil {
-		return BuildMetadata{}, err
-	}
-	if rowID != id {
-		return BuildMetadata{}, fmt.Errorf("Result had unexpected row ID: expected=%s, actual=%s", id, rowID)
-	}
-	return BuildMetadata{ID: rowID, ComponentID: componentID, CreatedAt: time.Unix(createdAt, 0)}, nil
+	return BuildMetadata(record), err
 }
 
 // SelectMostRecentBuildForComponent gets build metadata from the given state database for the most
-// recent build for the component with the given componentID
-func SelectMostRecentBuildForComponent(db *sql.DB, componentID string) (BuildMetadata, error) {
-	var id, rowComponentID string
-	var createdAt int64
-	row := db.QueryRow(selectMostRecentBuildForComponent, componentID)
-	err := row.Scan(&id, &rowComponentID, &createdAt)
-	if err == sql.ErrNoRows {
+// recent build for the component with the given componentID, of the Dockerfile stage given by its
+// specification (i.e. excluding builds which overrode the target - see BuildOptions)
+func SelectMostRecentBuildForComponent(store state.Store, componentID string) (BuildMetadata, error) {
+	return SelectMostRecentBuildForTarget(store, componentID, "")
+}
+
+// SelectMostRecentBuildForTarget gets build metadata from the given state database for the most
+// recent build for the component with the given componentID which was made for the given target
+// (see BuildOptions). An empty target selects builds of the stage given by the specification.
+func SelectMostRecentBuildForTarget(store state.Store, componentID, target string) (BuildMetadata, error) {
+	record, err := store.SelectMostRecentBuild(componentID, target)
+	if err == state.ErrNotFound {
 		return BuildMetadata{}, ErrBuildNotFound
 	}
-	if err != nil {
-		return BuildMetadata{}, err
+	return BuildMetadata(record), err
+}
+
+// executionRecord converts the given execution metadata into a state.ExecutionRecord
+func executionRecord(executionMetadata ExecutionMetadata) state.ExecutionRecord {
+	return state.ExecutionRecord{
+		ID:                executionMetadata.ID,
+		BuildID:           executionMetadata.BuildID,
+		ComponentID:       executionMetadata.ComponentID,
+		CreatedAt:         executionMetadata.CreatedAt,
+		CreatedBy:         executionMetadata.CreatedBy,
+		FlowID:            executionMetadata.FlowID,
+		FlowRunID:         executionMetadata.FlowRunID,
+		Step:              executionMetadata.Step,
+		ExitCode:          executionMetadata.ExitCode,
+		OOMKilled:         executionMetadata.OOMKilled,
+		Error:             executionMetadata.Error,
+		FinishedAt:        executionMetadata.FinishedAt,
+		PeakMemoryBytes:   executionMetadata.PeakMemoryBytes,
+		CPUSeconds:        executionMetadata.CPUSeconds,
+		IOReadBytes:       executionMetadata.IOReadBytes,
+		IOWriteBytes:      executionMetadata.IOWriteBytes,
+		Attempt:           executionMetadata.Attempt,
+		PreviousAttemptID: executionMetadata.PreviousAttemptID,
 	}
-	if rowComponentID != componentID {
-		return BuildMetadata{}, fmt.Errorf("Result had unexpected component ID: expected=%s, actual=%s", componentID, rowComponentID)
+}
+
+// executionMetadataFromRecord converts the given state.ExecutionRecord into execution metadata
+func executionMetadataFromRecord(record state.ExecutionRecord) ExecutionMetadata {
+	return ExecutionMetadata{
+		ID:                record.ID,
+		BuildID:           record.BuildID,
+		ComponentID:       record.ComponentID,
+		CreatedAt:         record.CreatedAt,
+		CreatedBy:         record.CreatedBy,
+		FlowID:            record.FlowID,
+		FlowRunID:         record.FlowRunID,
+		Step:              record.Step,
+		ExitCode:          record.ExitCode,
+		OOMKilled:         record.OOMKilled,
+		Error:             record.Error,
+		FinishedAt:        record.FinishedAt,
+		Attempt:           record.Attempt,
+		PreviousAttemptID: record.PreviousAttemptID,
+		ResourceUsage: ResourceUsage{
+			PeakMemoryBytes: record.PeakMemoryBytes,
+			CPUSeconds:      record.CPUSeconds,
+			IOReadBytes:     record.IOReadBytes,
+			IOWriteBytes:    record.IOWriteBytes,
+		},
 	}
-	return BuildMetadata{ID: id, ComponentID: rowComponentID, CreatedAt: time.Unix(createdAt, 0)}, nil
 }
 
-// InsertExecution inserts an execution row into the state database
-func InsertExecution(db *sql.DB, executionMetadata ExecutionMetadata) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
+// executionMetadataFromRecords converts the given state.ExecutionRecords into execution metadata
+func executionMetadataFromRecords(records []state.ExecutionRecord) []ExecutionMetadata {
+	executions := make([]ExecutionMetadata, len(records))
+	for i, record := range records {
+		executions[i] = executionMetadataFromRecord(record)
 	}
-	if executionMetadata.FlowID == "" {
-		_, err = tx.Exec(
-			insertExecutionWithNoFlowID,
-			executionMetadata.ID,
-			executionMetadata.BuildID,
-			executionMetadata.ComponentID,
-			executionMetadata.CreatedAt.Unix(),
-		)
-	} else {
-		_, err = tx.Exec(
-			insertExecution,
-			executionMetadata.ID,
-			executionMetadata.BuildID,
-			executionMetadata.ComponentID,
-			executionMetadata.CreatedAt.Unix(),
-			executionMetadata.FlowID,
-		)
+	return executions
+}
+
+// InsertExecution inserts an execution row into the state database
+func InsertExecution(store state.Store, executionMetadata ExecutionMetadata) error {
+	return store.InsertExecution(executionRecord(executionMetadata))
+}
+
+// InsertArtifact inserts the artifact represented by the given artifact metadata into the given
+// shnorky state database
+func InsertArtifact(store state.Store, artifactMetadata ArtifactMetadata) error {
+	return store.InsertArtifact(state.ArtifactRecord(artifactMetadata))
+}
+
+// SelectExecutionByID gets execution metadata from the given state database using the given ID.
+// If no execution with the given ID is found, returns ErrExecutionNotFound in the error position.
+func SelectExecutionByID(store state.Store, id string) (ExecutionMetadata, error) {
+	record, err := store.SelectExecution(id)
+	if err == state.ErrNotFound {
+		return ExecutionMetadata{}, ErrExecutionNotFound
 	}
 	if err != nil {
-		tx.Rollback()
-		return err
+		return ExecutionMetadata{}, err
 	}
+	return executionMetadataFromRecord(record), nil
+}
 
-	err = tx.Commit()
-	if err != nil {
-		return err
-	}
+// SelectExecutionsByFlowRunID gets metadata for all executions belonging to the flow run with the
+// given flowRunID from the given state database, in the order in which they were created
+func SelectExecutionsByFlowRunID(store state.Store, flowRunID string) ([]ExecutionMetadata, error) {
+	records, err := store.SelectExecutionsByFlowRun(flowRunID)
+	return executionMetadataFromRecords(records), err
+}
 
-	return nil
+// SelectSuccessfulExecutionsByFlowID gets metadata for all executions belonging to runs of the flow
+// with the given flowID which finished with exit code 0, most recent first
+func SelectSuccessfulExecutionsByFlowID(store state.Store, flowID string) ([]ExecutionMetadata, error) {
+	records, err := store.SelectSuccessfulExecutionsByFlow(flowID)
+	return executionMetadataFromRecords(records), err
+}
+
+// UpdateExecutionResult stores the result members (exit code, OOM-killed flag, error message,
+// finish time, and resource usage) of the given execution metadata against the corresponding
+// execution row in the given state database
+func UpdateExecutionResult(store state.Store, executionMetadata ExecutionMetadata) error {
+	err := store.UpdateExecutionResult(executionRecord(executionMetadata))
+	if err == state.ErrNotFound {
+		return ErrExecutionNotFound
+	}
+	return err
 }
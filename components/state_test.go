@@ -1,6 +1,7 @@
 package components
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io/ioutil"
@@ -9,6 +10,7 @@ import (
 	"testing"
 	"time"
 
+	dockerTypes "github.com/docker/docker/api/types"
 	_ "github.com/mattn/go-sqlite3"
 
 	"github.com/simiotics/shnorky/state"
@@ -53,6 +55,7 @@ func TestInsertComponent(t *testing.T) {
 				ComponentPath:     "/tmp/components/rofl",
 				SpecificationPath: "/tmp/components/rofl/component.json",
 				CreatedAt:         time.Now(),
+				CreatedBy:         "alice",
 			},
 			shouldThrowError: false,
 			inSelection:      true,
@@ -76,9 +79,10 @@ func TestInsertComponent(t *testing.T) {
 		t.Fatal("Error opening state database file")
 	}
 	defer db.Close()
+	store := state.NewSQLiteStore(db)
 
 	for i, test := range tests {
-		err = InsertComponent(db, test.metadata)
+		err = InsertComponent(store, test.metadata)
 		if test.shouldThrowError && err == nil {
 			t.Errorf("[Test %d] Expected error but did not receive one", i)
 		} else if !test.shouldThrowError && err != nil {
@@ -86,7 +90,7 @@ func TestInsertComponent(t *testing.T) {
 		}
 	}
 
-	componentSelection := "SELECT * FROM components;"
+	componentSelection := "SELECT id, component_type, component_path, specification_path, created_at, IFNULL(created_by, ''), IFNULL(specification_checksum, ''), IFNULL(specification_snapshot, '') FROM components;"
 	rows, err := db.Query(componentSelection)
 	defer rows.Close()
 	if err != nil {
@@ -99,9 +103,9 @@ func TestInsertComponent(t *testing.T) {
 				t.Fatalf("[Test %d] Expected result in result set, but found none", i)
 			}
 
-			var id, componentType, componentPath, specificationPath string
+			var id, componentType, componentPath, specificationPath, createdBy, checksum, snapshot string
 			var createdAt int64
-			err = rows.Scan(&id, &componentType, &componentPath, &specificationPath, &createdAt)
+			err = rows.Scan(&id, &componentType, &componentPath, &specificationPath, &createdAt, &createdBy, &checksum, &snapshot)
 			if err != nil {
 				t.Errorf("[Test %d] Error scanning row: %s", i, err.Error())
 			}
@@ -121,12 +125,30 @@ func TestInsertComponent(t *testing.T) {
 			if createdAt != test.metadata.CreatedAt.Unix() {
 				t.Errorf("[Test %d] Unexpected component CreatedAt: expected=%d, actual=%d", i, test.metadata.CreatedAt.Unix(), createdAt)
 			}
+			if createdBy != test.metadata.CreatedBy {
+				t.Errorf("[Test %d] Unexpected component CreatedBy: expected=%s, actual=%s", i, test.metadata.CreatedBy, createdBy)
+			}
 		}
 	}
 
 	if rows.Next() {
 		t.Fatal("More rows in components table than expected")
 	}
+
+	ownedComponents := make(chan ComponentMetadata)
+	go func() {
+		err := ListComponents(context.Background(), store, ownedComponents, ComponentFilter{CreatedBy: "alice"}, Page{})
+		if err != nil {
+			t.Errorf("Error listing components by creator: %s", err.Error())
+		}
+	}()
+	ownedIDs := []string{}
+	for component := range ownedComponents {
+		ownedIDs = append(ownedIDs, component.ID)
+	}
+	if len(ownedIDs) != 1 || ownedIDs[0] != "rofl" {
+		t.Errorf("Unexpected components created by alice: %v", ownedIDs)
+	}
 }
 
 // TestSelectComponentByID first runs InsertComponent a number of times to load a temporary state
@@ -150,6 +172,7 @@ func TestSelectComponentByID(t *testing.T) {
 		t.Fatal("Error opening state database file")
 	}
 	defer db.Close()
+	store := state.NewSQLiteStore(db)
 
 	var i int
 	components := make([]ComponentMetadata, 10)
@@ -164,14 +187,14 @@ func TestSelectComponentByID(t *testing.T) {
 			t.Fatalf("[Component %d] Error creating component metadata: %s", i, err.Error())
 		}
 		components[i] = component
-		err = InsertComponent(db, component)
+		err = InsertComponent(store, component)
 		if err != nil {
 			t.Fatalf("[Component %d] Error inserting component into state database: %s", i, err.Error())
 		}
 	}
 
 	for i = 0; i < 10; i++ {
-		stateComponent, err := SelectComponentByID(db, components[i].ID)
+		stateComponent, err := SelectComponentByID(store, components[i].ID)
 		if err != nil {
 			t.Errorf("[Test %d] Received error when trying to get inserted component: %s", i, err.Error())
 		}
@@ -193,7 +216,7 @@ func TestSelectComponentByID(t *testing.T) {
 		}
 	}
 
-	stateComponent, err := SelectComponentByID(db, "nonexistent-id")
+	stateComponent, err := SelectComponentByID(store, "nonexistent-id")
 	if err != ErrComponentNotFound {
 		t.Error("[Test 11] Was expecting error ErrComponentNotFound for GetComponentByID on unregistered ID, but did not get it")
 	}
@@ -235,6 +258,7 @@ func TestDeleteComponentByID(t *testing.T) {
 		t.Fatal("Error opening state database file")
 	}
 	defer db.Close()
+	store := state.NewSQLiteStore(db)
 
 	var i int
 	components := make([]ComponentMetadata, 10)
@@ -249,18 +273,18 @@ func TestDeleteComponentByID(t *testing.T) {
 			t.Fatalf("[Component %d] Error creating component metadata: %s", i, err.Error())
 		}
 		components[i] = component
-		err = InsertComponent(db, component)
+		err = InsertComponent(store, component)
 		if err != nil {
 			t.Fatalf("[Component %d] Error inserting component into state database: %s", i, err.Error())
 		}
 	}
 
-	err = DeleteComponentByID(db, components[0].ID)
+	err = DeleteComponentByID(store, components[0].ID)
 	if err != nil {
 		t.Fatalf("[Test 0] Could not delete component: %s", err.Error())
 	}
 
-	rows, err := db.Query(selectComponents)
+	rows, err := db.Query("SELECT id, component_type, component_path, specification_path, created_at, IFNULL(created_by, ''), IFNULL(specification_checksum, ''), IFNULL(specification_snapshot, '') FROM components;")
 	if err != nil {
 		t.Fatalf("Could not select rows from components table: %s", err.Error())
 	}
@@ -270,9 +294,9 @@ func TestDeleteComponentByID(t *testing.T) {
 		if !ok {
 			t.Fatal("Not enough rows in components selection")
 		}
-		var id, componentType, componentPath, specificationPath string
+		var id, componentType, componentPath, specificationPath, createdBy, checksum, snapshot string
 		var createdAt int64
-		err = rows.Scan(&id, &componentType, &componentPath, &specificationPath, &createdAt)
+		err = rows.Scan(&id, &componentType, &componentPath, &specificationPath, &createdAt, &createdBy, &checksum, &snapshot)
 		if err != nil {
 			t.Errorf("[Test %d] Could not parse row from components selection: %s", i, err.Error())
 		}
@@ -285,7 +309,7 @@ func TestDeleteComponentByID(t *testing.T) {
 		t.Fatal("Too many rows in components selection")
 	}
 
-	err = DeleteComponentByID(db, "nonexistent-component-id")
+	err = DeleteComponentByID(store, "nonexistent-component-id")
 	if err != nil {
 		t.Fatal("DeleteComponentByID should not error out when asked to delete a row with a non-existent ID")
 	}
@@ -325,6 +349,7 @@ func TestInsertBuild(t *testing.T) {
 				ID:          "rofl",
 				ComponentID: "component-rofl",
 				CreatedAt:   time.Now(),
+				CreatedBy:   "alice",
 			},
 			shouldThrowError: false,
 			inSelection:      true,
@@ -346,9 +371,10 @@ func TestInsertBuild(t *testing.T) {
 		t.Fatal("Error opening state database file")
 	}
 	defer db.Close()
+	store := state.NewSQLiteStore(db)
 
 	for i, test := range tests {
-		err = InsertBuild(db, test.metadata)
+		err = InsertBuild(store, test.metadata)
 		if test.shouldThrowError && err == nil {
 			t.Errorf("[Test %d] Expected error but did not receive one", i)
 		} else if !test.shouldThrowError && err != nil {
@@ -356,7 +382,7 @@ func TestInsertBuild(t *testing.T) {
 		}
 	}
 
-	buildSelection := "SELECT * FROM builds;"
+	buildSelection := "SELECT id, component_id, created_at, IFNULL(created_by, ''), IFNULL(source_hash, ''), IFNULL(target, '') FROM builds;"
 	rows, err := db.Query(buildSelection)
 	defer rows.Close()
 	if err != nil {
@@ -369,9 +395,9 @@ func TestInsertBuild(t *testing.T) {
 				t.Fatalf("[Test %d] Expected result in result set, but found none", i)
 			}
 
-			var id, componentID string
+			var id, componentID, createdBy, sourceHash, target string
 			var createdAt int64
-			err = rows.Scan(&id, &componentID, &createdAt)
+			err = rows.Scan(&id, &componentID, &createdAt, &createdBy, &sourceHash, &target)
 			if err != nil {
 				t.Errorf("[Test %d] Error scanning row: %s", i, err.Error())
 			}
@@ -385,12 +411,33 @@ func TestInsertBuild(t *testing.T) {
 			if createdAt != test.metadata.CreatedAt.Unix() {
 				t.Errorf("[Test %d] Unexpected build CreatedAt: expected=%d, actual=%d", i, test.metadata.CreatedAt.Unix(), createdAt)
 			}
+			if createdBy != test.metadata.CreatedBy {
+				t.Errorf("[Test %d] Unexpected build CreatedBy: expected=%s, actual=%s", i, test.metadata.CreatedBy, createdBy)
+			}
+			if sourceHash != test.metadata.SourceHash {
+				t.Errorf("[Test %d] Unexpected build SourceHash: expected=%s, actual=%s", i, test.metadata.SourceHash, sourceHash)
+			}
 		}
 	}
 
 	if rows.Next() {
 		t.Fatal("More rows in builds table than expected")
 	}
+
+	ownedBuilds := make(chan BuildMetadata)
+	go func() {
+		err := ListBuilds(context.Background(), store, ownedBuilds, "", "alice", Page{})
+		if err != nil {
+			t.Errorf("Error listing builds by creator: %s", err.Error())
+		}
+	}()
+	ownedIDs := []string{}
+	for build := range ownedBuilds {
+		ownedIDs = append(ownedIDs, build.ID)
+	}
+	if len(ownedIDs) != 1 || ownedIDs[0] != "rofl" {
+		t.Errorf("Unexpected builds created by alice: %v", ownedIDs)
+	}
 }
 
 // TestSelectBuildByID first runs InsertBuild a number of times to load a temporary state database
@@ -414,6 +461,7 @@ func TestSelectBuildByID(t *testing.T) {
 		t.Fatal("Error opening state database file")
 	}
 	defer db.Close()
+	store := state.NewSQLiteStore(db)
 
 	var i int
 	builds := make([]BuildMetadata, 10)
@@ -423,14 +471,14 @@ func TestSelectBuildByID(t *testing.T) {
 			t.Fatalf("[Build %d] Error creating build metadata: %s", i, err.Error())
 		}
 		builds[i] = build
-		err = InsertBuild(db, build)
+		err = InsertBuild(store, build)
 		if err != nil {
 			t.Fatalf("[Build %d] Error inserting build into state database: %s", i, err.Error())
 		}
 	}
 
 	for i = 0; i < 10; i++ {
-		stateBuild, err := SelectBuildByID(db, builds[i].ID)
+		stateBuild, err := SelectBuildByID(store, builds[i].ID)
 		if err != nil {
 			t.Errorf("[Test %d] Received error when trying to get inserted build: %s", i, err.Error())
 		}
@@ -446,7 +494,7 @@ func TestSelectBuildByID(t *testing.T) {
 		}
 	}
 
-	stateBuild, err := SelectBuildByID(db, "nonexistent-id")
+	stateBuild, err := SelectBuildByID(store, "nonexistent-id")
 	if err != ErrBuildNotFound {
 		t.Error("[Test 11] Was expecting error ErrBuildNotFound for GetBuildByID on unregistered ID, but did not get it")
 	}
@@ -483,6 +531,7 @@ func TestSelectMostRecentBuildForComponent(t *testing.T) {
 		t.Fatal("Error opening state database file")
 	}
 	defer db.Close()
+	store := state.NewSQLiteStore(db)
 
 	var i int
 	builds := make([]BuildMetadata, 10)
@@ -492,14 +541,14 @@ func TestSelectMostRecentBuildForComponent(t *testing.T) {
 			t.Fatalf("[Build %d] Error creating build metadata: %s", i, err.Error())
 		}
 		builds[i] = build
-		err = InsertBuild(db, build)
+		err = InsertBuild(store, build)
 		if err != nil {
 			t.Fatalf("[Build %d] Error inserting build into state database: %s", i, err.Error())
 		}
 		time.Sleep(time.Second)
 	}
 
-	stateBuild, err := SelectMostRecentBuildForComponent(db, "test-component")
+	stateBuild, err := SelectMostRecentBuildForComponent(store, "test-component")
 	if err != nil {
 		t.Fatalf("Received error when trying to get inserted build: %s", err.Error())
 	}
@@ -540,6 +589,7 @@ func TestInsertExecution(t *testing.T) {
 		t.Fatal("Error opening state database file")
 	}
 	defer db.Close()
+	store := state.NewSQLiteStore(db)
 
 	build := BuildMetadata{
 		ID:          "shnorky/good:latest",
@@ -547,7 +597,7 @@ func TestInsertExecution(t *testing.T) {
 		CreatedAt:   time.Now(),
 	}
 
-	InsertBuild(db, build)
+	InsertBuild(store, build)
 
 	tests := []InsertExecutionTest{
 		{
@@ -563,7 +613,7 @@ func TestInsertExecution(t *testing.T) {
 	}
 
 	for i, test := range tests {
-		err = InsertExecution(db, test.metadata)
+		err = InsertExecution(store, test.metadata)
 		if test.shouldThrowError && err == nil {
 			t.Errorf("[Test %d] Expected error but did not receive one", i)
 		} else if !test.shouldThrowError && err != nil {
@@ -613,3 +663,331 @@ func TestInsertExecution(t *testing.T) {
 		t.Fatal("More rows in builds table than expected")
 	}
 }
+
+// TestUpdateExecutionResult inserts an execution into a temporary state database, records a result
+// against it using RecordExecutionResult, and checks that SelectExecutionByID returns the result
+func TestUpdateExecutionResult(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-update-execution-result-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	execution := ExecutionMetadata{
+		ID:          "oom-execution",
+		BuildID:     "shnorky/oom:latest",
+		ComponentID: "oom",
+		CreatedAt:   time.Now(),
+		CreatedBy:   "alice",
+		FlowID:      "oom-flow",
+	}
+	err = InsertExecution(store, execution)
+	if err != nil {
+		t.Fatalf("Error inserting execution: %s", err.Error())
+	}
+
+	stateExecution, err := SelectExecutionByID(store, execution.ID)
+	if err != nil {
+		t.Fatalf("Error selecting execution: %s", err.Error())
+	}
+	if stateExecution.FlowID != execution.FlowID {
+		t.Errorf("Unexpected FlowID: expected=%s, actual=%s", execution.FlowID, stateExecution.FlowID)
+	}
+	if stateExecution.CreatedBy != execution.CreatedBy {
+		t.Errorf("Unexpected CreatedBy: expected=%s, actual=%s", execution.CreatedBy, stateExecution.CreatedBy)
+	}
+	if stateExecution.ExitCode != nil || stateExecution.FinishedAt != nil {
+		t.Error("Unfinished execution had a result in the state database")
+	}
+
+	runningState := &dockerTypes.ContainerState{Status: "running", Running: true}
+	stateExecution, err = RecordExecutionResult(store, stateExecution, runningState)
+	if err != nil {
+		t.Fatalf("Error recording result for running execution: %s", err.Error())
+	}
+	if stateExecution.ExitCode != nil {
+		t.Error("Result was recorded for running execution")
+	}
+
+	finishedAt := time.Unix(time.Now().Unix(), 0)
+	exitedState := &dockerTypes.ContainerState{
+		Status:     "exited",
+		ExitCode:   137,
+		OOMKilled:  true,
+		Error:      "out of memory",
+		FinishedAt: finishedAt.Format(time.RFC3339Nano),
+	}
+	stateExecution.ResourceUsage = ResourceUsage{PeakMemoryBytes: 1 << 30, CPUSeconds: 12.5, IOReadBytes: 4096, IOWriteBytes: 2048}
+	_, err = RecordExecutionResult(store, stateExecution, exitedState)
+	if err != nil {
+		t.Fatalf("Error recording result for exited execution: %s", err.Error())
+	}
+
+	stateExecution, err = SelectExecutionByID(store, execution.ID)
+	if err != nil {
+		t.Fatalf("Error selecting execution: %s", err.Error())
+	}
+	if stateExecution.ExitCode == nil || *stateExecution.ExitCode != exitedState.ExitCode {
+		t.Errorf("Unexpected ExitCode: expected=%d, actual=%v", exitedState.ExitCode, stateExecution.ExitCode)
+	}
+	if !stateExecution.OOMKilled {
+		t.Error("Expected OOMKilled to be true")
+	}
+	if stateExecution.Error != exitedState.Error {
+		t.Errorf("Unexpected Error: expected=%s, actual=%s", exitedState.Error, stateExecution.Error)
+	}
+	if stateExecution.FinishedAt == nil || !stateExecution.FinishedAt.Equal(finishedAt) {
+		t.Errorf("Unexpected FinishedAt: expected=%v, actual=%v", finishedAt, stateExecution.FinishedAt)
+	}
+	expectedUsage := ResourceUsage{PeakMemoryBytes: 1 << 30, CPUSeconds: 12.5, IOReadBytes: 4096, IOWriteBytes: 2048}
+	if stateExecution.ResourceUsage != expectedUsage {
+		t.Errorf("Unexpected ResourceUsage: expected=%v, actual=%v", expectedUsage, stateExecution.ResourceUsage)
+	}
+
+	_, err = SelectExecutionByID(store, "nonexistent-execution")
+	if err != ErrExecutionNotFound {
+		t.Errorf("Expected ErrExecutionNotFound for nonexistent execution, got: %v", err)
+	}
+
+	err = UpdateExecutionResult(store, ExecutionMetadata{ID: "nonexistent-execution"})
+	if err != ErrExecutionNotFound {
+		t.Errorf("Expected ErrExecutionNotFound when updating nonexistent execution, got: %v", err)
+	}
+}
+
+// TestListPagination tests that ListComponents, ListBuilds, and ListExecutions list the requested
+// pages of rows in the order in which they were created
+func TestListPagination(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-list-pagination-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	createdAt := time.Unix(1577836800, 0)
+	for i := 0; i < 5; i++ {
+		component := ComponentMetadata{ID: fmt.Sprintf("component-%d", i), ComponentType: "task", CreatedAt: createdAt.Add(time.Duration(i) * time.Minute)}
+		err = InsertComponent(store, component)
+		if err != nil {
+			t.Fatalf("Error inserting component: %s", err.Error())
+		}
+		build := BuildMetadata{ID: fmt.Sprintf("shnorky/component-%d:1", i), ComponentID: component.ID, CreatedAt: component.CreatedAt}
+		err = InsertBuild(store, build)
+		if err != nil {
+			t.Fatalf("Error inserting build: %s", err.Error())
+		}
+		execution := ExecutionMetadata{ID: fmt.Sprintf("execution-%d", i), BuildID: build.ID, ComponentID: component.ID, CreatedAt: component.CreatedAt}
+		err = InsertExecution(store, execution)
+		if err != nil {
+			t.Fatalf("Error inserting execution: %s", err.Error())
+		}
+	}
+
+	type paginationTest struct {
+		page         Page
+		expectedIDs  []string
+		returnsError bool
+	}
+
+	tests := []paginationTest{
+		{page: Page{}, expectedIDs: []string{"0", "1", "2", "3", "4"}},
+		{page: Page{Limit: 2}, expectedIDs: []string{"0", "1"}},
+		{page: Page{Limit: 2, Offset: 2}, expectedIDs: []string{"2", "3"}},
+		{page: Page{Limit: 2, Offset: 4}, expectedIDs: []string{"4"}},
+		{page: Page{Offset: 3}, expectedIDs: []string{"3", "4"}},
+		{page: Page{Offset: 10}, expectedIDs: []string{}},
+		{page: Page{Limit: -1}, returnsError: true},
+		{page: Page{Offset: -1}, returnsError: true},
+	}
+
+	for i, test := range tests {
+		componentsChan := make(chan ComponentMetadata)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- ListComponents(context.Background(), store, componentsChan, ComponentFilter{}, test.page)
+		}()
+		componentIDs := []string{}
+		for component := range componentsChan {
+			componentIDs = append(componentIDs, component.ID)
+		}
+		checkPage(t, i, "components", "component-", <-errChan, test.returnsError, test.expectedIDs, componentIDs)
+
+		buildsChan := make(chan BuildMetadata)
+		go func() { errChan <- ListBuilds(context.Background(), store, buildsChan, "", "", test.page) }()
+		buildComponentIDs := []string{}
+		for build := range buildsChan {
+			buildComponentIDs = append(buildComponentIDs, build.ComponentID)
+		}
+		checkPage(t, i, "builds", "component-", <-errChan, test.returnsError, test.expectedIDs, buildComponentIDs)
+
+		executionsChan := make(chan ExecutionMetadata)
+		go func() { errChan <- ListExecutions(context.Background(), store, executionsChan, "", "", test.page) }()
+		executionIDs := []string{}
+		for execution := range executionsChan {
+			executionIDs = append(executionIDs, execution.ID)
+		}
+		checkPage(t, i, "executions", "execution-", <-errChan, test.returnsError, test.expectedIDs, executionIDs)
+	}
+
+	executionsChan := make(chan ExecutionMetadata)
+	go ListExecutions(context.Background(), store, executionsChan, "component-3", "", Page{})
+	executionIDs := []string{}
+	for execution := range executionsChan {
+		executionIDs = append(executionIDs, execution.ID)
+	}
+	if len(executionIDs) != 1 || executionIDs[0] != "execution-3" {
+		t.Errorf("Unexpected executions of component-3: %v", executionIDs)
+	}
+
+	// Consumers may stop reading early by cancelling the context
+	ctx, cancel := context.WithCancel(context.Background())
+	cancelledChan := make(chan ExecutionMetadata)
+	errChan := make(chan error, 1)
+	go func() { errChan <- ListExecutions(ctx, store, cancelledChan, "", "", Page{}) }()
+	first := <-cancelledChan
+	if first.ID != "execution-0" {
+		t.Errorf("Unexpected first execution: %s", first.ID)
+	}
+	cancel()
+	if err := <-errChan; err != context.Canceled {
+		t.Errorf("Expected cancelled listing to return context.Canceled, got: %v", err)
+	}
+	if _, open := <-cancelledChan; open {
+		t.Error("Expected executions channel to be closed after cancellation")
+	}
+}
+
+// checkPage checks the IDs which were listed for a test case in TestListPagination
+func checkPage(t *testing.T, i int, kind, prefix string, err error, returnsError bool, expectedSuffixes, actualIDs []string) {
+	if returnsError {
+		if err == nil {
+			t.Errorf("[Test %d] Listing %s did not return an error when one was expected", i, kind)
+		}
+		return
+	}
+	if err != nil {
+		t.Errorf("[Test %d] Error listing %s: %s", i, kind, err.Error())
+		return
+	}
+	expectedIDs := make([]string, len(expectedSuffixes))
+	for j, suffix := range expectedSuffixes {
+		expectedIDs[j] = prefix + suffix
+	}
+	if fmt.Sprint(actualIDs) != fmt.Sprint(expectedIDs) {
+		t.Errorf("[Test %d] Unexpected %s: expected=%v, actual=%v", i, kind, expectedIDs, actualIDs)
+	}
+}
+
+// TestListComponentsFilter tests that ListComponents only lists the components which match the
+// given filter
+func TestListComponentsFilter(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-list-components-filter-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	createdAt := time.Unix(1577836800, 0)
+	registered := []ComponentMetadata{
+		{ID: "etl-extract", ComponentType: Task, CreatedAt: createdAt, CreatedBy: "alice"},
+		{ID: "etl-load", ComponentType: Task, CreatedAt: createdAt.Add(time.Hour), CreatedBy: "bob"},
+		{ID: "etl_api", ComponentType: Service, CreatedAt: createdAt.Add(2 * time.Hour), CreatedBy: "alice"},
+		{ID: "report", ComponentType: Task, CreatedAt: createdAt.Add(3 * time.Hour), CreatedBy: "alice"},
+	}
+	for _, component := range registered {
+		err = InsertComponent(store, component)
+		if err != nil {
+			t.Fatalf("Error inserting component: %s", err.Error())
+		}
+	}
+
+	type filterTest struct {
+		filter       ComponentFilter
+		expectedIDs  []string
+		returnsError bool
+	}
+
+	tests := []filterTest{
+		{filter: ComponentFilter{}, expectedIDs: []string{"etl-extract", "etl-load", "etl_api", "report"}},
+		{filter: ComponentFilter{ComponentType: Task}, expectedIDs: []string{"etl-extract", "etl-load", "report"}},
+		{filter: ComponentFilter{ComponentType: Service}, expectedIDs: []string{"etl_api"}},
+		{filter: ComponentFilter{CreatedAfter: createdAt}, expectedIDs: []string{"etl-load", "etl_api", "report"}},
+		{filter: ComponentFilter{CreatedAfter: createdAt.Add(150 * time.Minute)}, expectedIDs: []string{"report"}},
+		{filter: ComponentFilter{IDPrefix: "etl-"}, expectedIDs: []string{"etl-extract", "etl-load"}},
+		{filter: ComponentFilter{IDPrefix: "etl_"}, expectedIDs: []string{"etl_api"}},
+		{filter: ComponentFilter{IDPrefix: "extract"}, expectedIDs: []string{}},
+		{filter: ComponentFilter{CreatedBy: "alice", ComponentType: Task, IDPrefix: "etl"}, expectedIDs: []string{"etl-extract"}},
+		{filter: ComponentFilter{IDPattern: "etl-*"}, expectedIDs: []string{"etl-extract", "etl-load"}},
+		{filter: ComponentFilter{IDPattern: "etl?api"}, expectedIDs: []string{"etl_api"}},
+		{filter: ComponentFilter{IDPattern: "*[dt]"}, expectedIDs: []string{"etl-extract", "etl-load", "report"}},
+		{filter: ComponentFilter{IDPattern: "report"}, expectedIDs: []string{"report"}},
+		{filter: ComponentFilter{IDPattern: "ETL-*"}, expectedIDs: []string{}},
+		{filter: ComponentFilter{ComponentType: "cron"}, returnsError: true},
+	}
+
+	for i, test := range tests {
+		componentsChan := make(chan ComponentMetadata)
+		errChan := make(chan error, 1)
+		go func() { errChan <- ListComponents(context.Background(), store, componentsChan, test.filter, Page{}) }()
+		componentIDs := []string{}
+		for component := range componentsChan {
+			componentIDs = append(componentIDs, component.ID)
+		}
+		err := <-errChan
+		if test.returnsError {
+			if err == nil {
+				t.Errorf("[Test %d] No error was returned but one was expected", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[Test %d] Error listing components: %s", i, err.Error())
+			continue
+		}
+		if fmt.Sprint(componentIDs) != fmt.Sprint(test.expectedIDs) {
+			t.Errorf("[Test %d] Unexpected components: expected=%v, actual=%v", i, test.expectedIDs, componentIDs)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package components
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+)
+
+// ResourceUsage - resource usage statistics for an execution container, aggregated over the
+// samples that docker reports while the container is running
+type ResourceUsage struct {
+	// PeakMemoryBytes is the largest memory usage (in bytes) observed for the container
+	PeakMemoryBytes int64 `json:"peak_memory_bytes"`
+	// CPUSeconds is the total CPU time consumed by the container (summed over all cores)
+	CPUSeconds float64 `json:"cpu_seconds"`
+	// IOReadBytes is the total number of bytes read from block devices by the container
+	IOReadBytes int64 `json:"io_read_bytes"`
+	// IOWriteBytes is the total number of bytes written to block devices by the container
+	IOWriteBytes int64 `json:"io_write_bytes"`
+}
+
+// Update folds a single docker stats sample into the resource usage statistics. CPU and I/O
+// counters reported by docker are cumulative, so the most recent sample determines those values.
+func (usage *ResourceUsage) Update(sample dockerTypes.StatsJSON) {
+	memory := sample.MemoryStats.MaxUsage
+	if sample.MemoryStats.Usage > memory {
+		memory = sample.MemoryStats.Usage
+	}
+	if int64(memory) > usage.PeakMemoryBytes {
+		usage.PeakMemoryBytes = int64(memory)
+	}
+
+	if sample.CPUStats.CPUUsage.TotalUsage > 0 {
+		usage.CPUSeconds = float64(sample.CPUStats.CPUUsage.TotalUsage) / 1e9
+	}
+
+	var readBytes, writeBytes int64
+	for _, entry := range sample.BlkioStats.IoServiceBytesRecursive {
+		if strings.EqualFold(entry.Op, "read") {
+			readBytes += int64(entry.Value)
+		} else if strings.EqualFold(entry.Op, "write") {
+			writeBytes += int64(entry.Value)
+		}
+	}
+	if readBytes > usage.IOReadBytes {
+		usage.IOReadBytes = readBytes
+	}
+	if writeBytes > usage.IOWriteBytes {
+		usage.IOWriteBytes = writeBytes
+	}
+}
+
+// CollectResourceUsage samples docker stats for the container with the given containerID until
+// the stats stream ends (which happens when the container stops) or the given context is
+// cancelled. The aggregated resource usage is sent on the returned channel, which is then closed.
+func CollectResourceUsage(ctx context.Context, dockerClient *docker.Client, containerID string) <-chan ResourceUsage {
+	usageChan := make(chan ResourceUsage, 1)
+
+	go func() {
+		usage := ResourceUsage{}
+		defer close(usageChan)
+		defer func() { usageChan <- usage }()
+
+		stats, err := dockerClient.ContainerStats(ctx, containerID, true)
+		if err != nil {
+			return
+		}
+		defer stats.Body.Close()
+
+		dec := json.NewDecoder(stats.Body)
+		for {
+			var sample dockerTypes.StatsJSON
+			err = dec.Decode(&sample)
+			if err != nil {
+				return
+			}
+			usage.Update(sample)
+		}
+	}()
+
+	return usageChan
+}
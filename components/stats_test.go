@@ -0,0 +1,60 @@
+package components
+
+import (
+	"testing"
+
+	dockerTypes "github.com/docker/docker/api/types"
+)
+
+// TestResourceUsageUpdate tests that resource usage tracks peak memory across samples while taking
+// cumulative CPU and I/O counters from the most recent samples
+func TestResourceUsageUpdate(t *testing.T) {
+	samples := []dockerTypes.StatsJSON{
+		{
+			Stats: dockerTypes.Stats{
+				CPUStats:    dockerTypes.CPUStats{CPUUsage: dockerTypes.CPUUsage{TotalUsage: 500000000}},
+				MemoryStats: dockerTypes.MemoryStats{Usage: 1024},
+				BlkioStats: dockerTypes.BlkioStats{
+					IoServiceBytesRecursive: []dockerTypes.BlkioStatEntry{
+						{Op: "Read", Value: 100},
+						{Op: "Write", Value: 10},
+						{Op: "Total", Value: 110},
+					},
+				},
+			},
+		},
+		{
+			Stats: dockerTypes.Stats{
+				CPUStats:    dockerTypes.CPUStats{CPUUsage: dockerTypes.CPUUsage{TotalUsage: 2500000000}},
+				MemoryStats: dockerTypes.MemoryStats{Usage: 4096, MaxUsage: 8192},
+				BlkioStats: dockerTypes.BlkioStats{
+					IoServiceBytesRecursive: []dockerTypes.BlkioStatEntry{
+						{Major: 8, Op: "read", Value: 200},
+						{Major: 9, Op: "read", Value: 50},
+						{Op: "write", Value: 20},
+					},
+				},
+			},
+		},
+		// Final sample after the container has stopped - docker reports zeroed statistics
+		{},
+	}
+
+	usage := ResourceUsage{}
+	for _, sample := range samples {
+		usage.Update(sample)
+	}
+
+	if usage.PeakMemoryBytes != 8192 {
+		t.Errorf("Unexpected PeakMemoryBytes: expected=%d, actual=%d", 8192, usage.PeakMemoryBytes)
+	}
+	if usage.CPUSeconds != 2.5 {
+		t.Errorf("Unexpected CPUSeconds: expected=%f, actual=%f", 2.5, usage.CPUSeconds)
+	}
+	if usage.IOReadBytes != 250 {
+		t.Errorf("Unexpected IOReadBytes: expected=%d, actual=%d", 250, usage.IOReadBytes)
+	}
+	if usage.IOWriteBytes != 20 {
+		t.Errorf("Unexpected IOWriteBytes: expected=%d, actual=%d", 20, usage.IOWriteBytes)
+	}
+}
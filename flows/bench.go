@@ -0,0 +1,157 @@
+package flows
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"text/tabwriter"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// BenchmarkRunKey is the key under which the statistics about the durations of whole runs appear
+// in the results of a benchmark
+var BenchmarkRunKey = "(run)"
+
+// BenchmarkStatistics - statistics about the durations of a step (or of whole runs) over the runs
+// of a benchmark
+type BenchmarkStatistics struct {
+	Step        string  `json:"step"`
+	Samples     int     `json:"samples"`
+	MeanSeconds float64 `json:"mean_seconds"`
+	MinSeconds  float64 `json:"min_seconds"`
+	P50Seconds  float64 `json:"p50_seconds"`
+	P95Seconds  float64 `json:"p95_seconds"`
+	MaxSeconds  float64 `json:"max_seconds"`
+}
+
+// BenchmarkResult - the results of benchmarking a flow
+type BenchmarkResult struct {
+	FlowID string   `json:"flow_id"`
+	RunIDs []string `json:"run_ids"`
+	// Steps holds the statistics for each step, ordered by step name, followed by the statistics
+	// for whole runs (under BenchmarkRunKey)
+	Steps []BenchmarkStatistics `json:"steps"`
+}
+
+// Benchmark executes the given number of runs of the flow with the given ID one after another (as
+// Execute does) and calculates statistics about the durations of each of its steps and of whole
+// runs. If a run fails, the benchmark stops and the statistics for the runs which completed are
+// returned along with the error.
+// This is the handler for `shn flows bench`
+func Benchmark(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	outstream io.Writer,
+	stateDir string,
+	flowID string,
+	iterations int,
+) (BenchmarkResult, error) {
+	result := BenchmarkResult{FlowID: flowID, RunIDs: []string{}, Steps: []BenchmarkStatistics{}}
+	if iterations < 1 {
+		return result, fmt.Errorf("Number of iterations must be positive: %d", iterations)
+	}
+
+	durations := map[string][]float64{}
+	var runErr error
+	for i := 0; i < iterations; i++ {
+		if outstream != nil {
+			fmt.Fprintf(outstream, "Benchmark run %d of %d\n", i+1, iterations)
+		}
+		run, executions, err := Execute(ctx, store, dockerClient, outstream, stateDir, flowID)
+		if run.ID != "" {
+			result.RunIDs = append(result.RunIDs, run.ID)
+		}
+		if err != nil {
+			runErr = fmt.Errorf("Benchmark run %d of %d failed: %w", i+1, iterations, err)
+			break
+		}
+
+		for step, execution := range executions {
+			if execution.FinishedAt != nil {
+				durations[step] = append(durations[step], execution.FinishedAt.Sub(execution.CreatedAt).Seconds())
+			}
+		}
+		if run.FinishedAt != nil {
+			durations[BenchmarkRunKey] = append(durations[BenchmarkRunKey], run.FinishedAt.Sub(run.CreatedAt).Seconds())
+		}
+	}
+
+	steps := make([]string, 0, len(durations))
+	for step := range durations {
+		if step != BenchmarkRunKey {
+			steps = append(steps, step)
+		}
+	}
+	sort.Strings(steps)
+	if _, ok := durations[BenchmarkRunKey]; ok {
+		steps = append(steps, BenchmarkRunKey)
+	}
+	for _, step := range steps {
+		result.Steps = append(result.Steps, SummarizeDurations(step, durations[step]))
+	}
+
+	return result, runErr
+}
+
+// SummarizeDurations calculates statistics about the given durations (in seconds) of the given
+// step. Percentiles are calculated by the nearest-rank method.
+func SummarizeDurations(step string, durations []float64) BenchmarkStatistics {
+	statistics := BenchmarkStatistics{Step: step, Samples: len(durations)}
+	if len(durations) == 0 {
+		return statistics
+	}
+
+	sorted := append([]float64{}, durations...)
+	sort.Float64s(sorted)
+	var total float64
+	for _, duration := range sorted {
+		total += duration
+	}
+
+	statistics.MeanSeconds = total / float64(len(sorted))
+	statistics.MinSeconds = sorted[0]
+	statistics.P50Seconds = percentile(sorted, 50)
+	statistics.P95Seconds = percentile(sorted, 95)
+	statistics.MaxSeconds = sorted[len(sorted)-1]
+	return statistics
+}
+
+// percentile returns the given percentile of the given (sorted, non-empty) values by the
+// nearest-rank method
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// WriteBenchmarkTable writes the given benchmark results to the given writer as a human-readable
+// table
+func WriteBenchmarkTable(w io.Writer, result BenchmarkResult) error {
+	fmt.Fprintf(w, "Flow: %s (runs: %d)\n\n", result.FlowID, len(result.RunIDs))
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tSAMPLES\tMEAN\tMIN\tP50\tP95\tMAX")
+	for _, statistics := range result.Steps {
+		fmt.Fprintf(
+			tw,
+			"%s\t%d\t%.1fs\t%.1fs\t%.1fs\t%.1fs\t%.1fs\n",
+			statistics.Step,
+			statistics.Samples,
+			statistics.MeanSeconds,
+			statistics.MinSeconds,
+			statistics.P50Seconds,
+			statistics.P95Seconds,
+			statistics.MaxSeconds,
+		)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,39 @@
+package flows
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSummarizeDurations(t *testing.T) {
+	type summaryTest struct {
+		durations          []float64
+		expectedStatistics BenchmarkStatistics
+	}
+
+	tests := []summaryTest{
+		{
+			durations:          []float64{},
+			expectedStatistics: BenchmarkStatistics{Step: "extract"},
+		},
+		{
+			durations:          []float64{2},
+			expectedStatistics: BenchmarkStatistics{Step: "extract", Samples: 1, MeanSeconds: 2, MinSeconds: 2, P50Seconds: 2, P95Seconds: 2, MaxSeconds: 2},
+		},
+		{
+			durations:          []float64{4, 1, 3, 2},
+			expectedStatistics: BenchmarkStatistics{Step: "extract", Samples: 4, MeanSeconds: 2.5, MinSeconds: 1, P50Seconds: 2, P95Seconds: 4, MaxSeconds: 4},
+		},
+		{
+			durations:          []float64{20, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19},
+			expectedStatistics: BenchmarkStatistics{Step: "extract", Samples: 20, MeanSeconds: 10.5, MinSeconds: 1, P50Seconds: 10, P95Seconds: 19, MaxSeconds: 20},
+		},
+	}
+
+	for i, test := range tests {
+		statistics := SummarizeDurations("extract", test.durations)
+		if !reflect.DeepEqual(statistics, test.expectedStatistics) {
+			t.Errorf("[Test %d] Unexpected statistics: expected=%v, actual=%v", i, test.expectedStatistics, statistics)
+		}
+	}
+}
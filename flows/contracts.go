@@ -0,0 +1,302 @@
+package flows
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+// DataFormatCSV denotes comma-separated data with a header row naming its columns
+var DataFormatCSV = "csv"
+
+// DataFormatJSONLines denotes newline-delimited JSON objects
+var DataFormatJSONLines = "jsonlines"
+
+// DataFormatJSON denotes a single JSON document
+var DataFormatJSON = "json"
+
+// DataFormatParquet denotes Apache Parquet data
+var DataFormatParquet = "parquet"
+
+// DataFormats is a set (of keys) enumerating the formats that data contracts may declare
+var DataFormats = map[string]bool{
+	DataFormatCSV:       true,
+	DataFormatJSONLines: true,
+	DataFormatJSON:      true,
+	DataFormatParquet:   true,
+}
+
+// DataContract - describes the format and schema of a dataset which is passed between the steps
+// of a flow
+type DataContract struct {
+	// Format is one of the keys of DataFormats
+	Format string `json:"format"`
+	// Columns lists the columns (for csv data) or top-level keys (for jsonlines data) that the
+	// dataset contains. A producer must provide every column that a consumer declares.
+	Columns []string `json:"columns,omitempty"`
+	// Path is the path of the dataset on the host. It is only needed for datasets that are
+	// validated at runtime, and is only used on the producer's side. Supports
+	// "env:<VARIABLE_NAME>" values and the same placeholders as mount configurations.
+	Path string `json:"path,omitempty"`
+}
+
+// StepContracts - declares (by dataset name) the datasets that a step produces and consumes
+type StepContracts struct {
+	Produces map[string]DataContract `json:"produces,omitempty"`
+	Consumes map[string]DataContract `json:"consumes,omitempty"`
+}
+
+// DataValidator validates that the dataset at a given path on the host satisfies a data contract
+type DataValidator interface {
+	Validate(path string, contract DataContract) error
+}
+
+// DataValidatorFunc adapts an ordinary function into a DataValidator
+type DataValidatorFunc func(path string, contract DataContract) error
+
+// Validate calls f(path, contract)
+func (f DataValidatorFunc) Validate(path string, contract DataContract) error {
+	return f(path, contract)
+}
+
+var dataValidatorsLock sync.RWMutex
+var dataValidators = map[string]DataValidator{
+	DataFormatCSV:       DataValidatorFunc(validateCSV),
+	DataFormatJSONLines: DataValidatorFunc(validateJSONLines),
+	DataFormatJSON:      DataValidatorFunc(validateJSON),
+}
+
+// RegisterDataValidator registers the given validator for datasets of the given format, replacing
+// any validator previously registered for that format. Formats without a registered validator
+// (e.g. parquet, by default) are not validated at runtime.
+func RegisterDataValidator(format string, validator DataValidator) {
+	dataValidatorsLock.Lock()
+	defer dataValidatorsLock.Unlock()
+	dataValidators[format] = validator
+}
+
+// MaterializeStepContracts validates the data contracts declared by the steps of a flow, checking
+// that each dataset is produced by exactly one step, that every consumed dataset is produced by a
+// step that the consumer (transitively) depends on, and that the producer's contract satisfies the
+// consumer's
+func MaterializeStepContracts(steps map[string]string, dependencies map[string][]string, rawContracts map[string]StepContracts) (map[string]StepContracts, error) {
+	materializedContracts := map[string]StepContracts{}
+	producers := map[string]string{}
+	for step, rawStepContracts := range rawContracts {
+		if _, ok := steps[step]; !ok {
+			return materializedContracts, fmt.Errorf("Unknown step in contracts: %s", step)
+		}
+
+		materializedStepContracts := StepContracts{Produces: map[string]DataContract{}, Consumes: map[string]DataContract{}}
+		for dataset, contract := range rawStepContracts.Produces {
+			if producer, ok := producers[dataset]; ok {
+				return materializedContracts, fmt.Errorf("Dataset (%s) is produced by more than one step: %s, %s", dataset, producer, step)
+			}
+			producers[dataset] = step
+			materializedContract, err := materializeDataContract(contract)
+			if err != nil {
+				return materializedContracts, fmt.Errorf("Invalid contract for dataset (%s) produced by step (%s): %w", dataset, step, err)
+			}
+			materializedStepContracts.Produces[dataset] = materializedContract
+		}
+		for dataset, contract := range rawStepContracts.Consumes {
+			materializedContract, err := materializeDataContract(contract)
+			if err != nil {
+				return materializedContracts, fmt.Errorf("Invalid contract for dataset (%s) consumed by step (%s): %w", dataset, step, err)
+			}
+			materializedContract.Path = ""
+			materializedStepContracts.Consumes[dataset] = materializedContract
+		}
+		materializedContracts[step] = materializedStepContracts
+	}
+
+	for step, stepContracts := range materializedContracts {
+		upstream := upstreamSteps(dependencies, step)
+		for dataset, consumed := range stepContracts.Consumes {
+			producer, ok := producers[dataset]
+			if !ok {
+				return materializedContracts, fmt.Errorf("Dataset (%s) consumed by step (%s) is not produced by any step", dataset, step)
+			}
+			if !upstream[producer] {
+				return materializedContracts, fmt.Errorf("Step (%s) consumes dataset (%s) but does not depend on its producer (%s)", step, dataset, producer)
+			}
+			err := checkCompatibility(materializedContracts[producer].Produces[dataset], consumed)
+			if err != nil {
+				return materializedContracts, fmt.Errorf("Dataset (%s) produced by step (%s) does not satisfy contract of step (%s): %w", dataset, producer, step, err)
+			}
+		}
+	}
+
+	return materializedContracts, nil
+}
+
+// ValidateProducedData validates the datasets produced by the given step in the given flow run
+// against their contracts, using the validators registered for their formats. Datasets without
+// paths, and datasets in formats without registered validators, are skipped.
+func ValidateProducedData(specification FlowSpecification, run FlowRunMetadata, step string) error {
+	variables := TemplateVariables(run, step)
+	datasets := []string{}
+	for dataset := range specification.Contracts[step].Produces {
+		datasets = append(datasets, dataset)
+	}
+	sort.Strings(datasets)
+
+	for _, dataset := range datasets {
+		contract := specification.Contracts[step].Produces[dataset]
+		if contract.Path == "" {
+			continue
+		}
+		dataValidatorsLock.RLock()
+		validator, ok := dataValidators[contract.Format]
+		dataValidatorsLock.RUnlock()
+		if !ok {
+			continue
+		}
+		path := components.RenderTemplate(contract.Path, variables)
+		err := validator.Validate(path, contract)
+		if err != nil {
+			return fmt.Errorf("Dataset (%s) at %s violates its contract: %w", dataset, path, err)
+		}
+	}
+	return nil
+}
+
+func materializeDataContract(rawContract DataContract) (DataContract, error) {
+	if !DataFormats[rawContract.Format] {
+		return rawContract, fmt.Errorf("Unknown data format: %s", rawContract.Format)
+	}
+	if len(rawContract.Columns) > 0 && rawContract.Format == DataFormatJSON {
+		return rawContract, fmt.Errorf("Columns cannot be declared for %s data", rawContract.Format)
+	}
+
+	materializedContract := DataContract{Format: rawContract.Format, Columns: rawContract.Columns}
+	if rawContract.Path != "" {
+		absolutePath, err := materializePath(rawContract.Path)
+		if err != nil {
+			return rawContract, err
+		}
+		materializedContract.Path = absolutePath
+	}
+	return materializedContract, nil
+}
+
+// checkCompatibility returns an error if the produced contract does not satisfy the consumed one
+func checkCompatibility(produced, consumed DataContract) error {
+	if produced.Format != consumed.Format {
+		return fmt.Errorf("Format mismatch: produced=%s, consumed=%s", produced.Format, consumed.Format)
+	}
+	missing := missingColumns(produced.Columns, consumed.Columns)
+	if len(missing) > 0 {
+		return fmt.Errorf("Missing columns: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// missingColumns returns the required columns which are not present in available
+func missingColumns(available, required []string) []string {
+	availableSet := map[string]bool{}
+	for _, column := range available {
+		availableSet[column] = true
+	}
+	missing := []string{}
+	for _, column := range required {
+		if !availableSet[column] {
+			missing = append(missing, column)
+		}
+	}
+	return missing
+}
+
+// upstreamSteps returns the set of steps that the given step transitively depends on
+func upstreamSteps(dependencies map[string][]string, step string) map[string]bool {
+	upstream := map[string]bool{}
+	pending := append([]string{}, dependencies[step]...)
+	for len(pending) > 0 {
+		current := pending[0]
+		pending = pending[1:]
+		if upstream[current] {
+			continue
+		}
+		upstream[current] = true
+		pending = append(pending, dependencies[current]...)
+	}
+	return upstream
+}
+
+func validateCSV(path string, contract DataContract) error {
+	dataFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+
+	reader := csv.NewReader(dataFile)
+	header, err := reader.Read()
+	if err != nil {
+		return fmt.Errorf("Could not read header row: %w", err)
+	}
+	missing := missingColumns(header, contract.Columns)
+	if len(missing) > 0 {
+		return fmt.Errorf("Missing columns: %s", strings.Join(missing, ", "))
+	}
+	for {
+		_, err = reader.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func validateJSONLines(path string, contract DataContract) error {
+	dataFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+
+	scanner := bufio.NewScanner(dataFile)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var record map[string]interface{}
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return fmt.Errorf("Line %d is not a JSON object: %w", line, err)
+		}
+		recordColumns := make([]string, 0, len(record))
+		for column := range record {
+			recordColumns = append(recordColumns, column)
+		}
+		missing := missingColumns(recordColumns, contract.Columns)
+		if len(missing) > 0 {
+			return fmt.Errorf("Line %d is missing columns: %s", line, strings.Join(missing, ", "))
+		}
+	}
+	return scanner.Err()
+}
+
+func validateJSON(path string, contract DataContract) error {
+	dataFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+
+	var document interface{}
+	return json.NewDecoder(dataFile).Decode(&document)
+}
@@ -0,0 +1,146 @@
+package flows
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMaterializeStepContracts(t *testing.T) {
+	steps := map[string]string{"extract": "extractor", "transform": "transformer", "load": "loader"}
+	dependencies := map[string][]string{"transform": {"extract"}, "load": {"transform"}}
+
+	type contractsTest struct {
+		contracts    map[string]StepContracts
+		returnsError bool
+	}
+
+	testCases := []contractsTest{
+		{
+			contracts: map[string]StepContracts{
+				"extract": {Produces: map[string]DataContract{"raw": {Format: "csv", Columns: []string{"id", "name", "value"}}}},
+				"load":    {Consumes: map[string]DataContract{"raw": {Format: "csv", Columns: []string{"id", "value"}}}},
+			},
+			returnsError: false,
+		},
+		{
+			contracts: map[string]StepContracts{
+				"extract": {Produces: map[string]DataContract{"raw": {Format: "csv", Columns: []string{"id"}}}},
+				"load":    {Consumes: map[string]DataContract{"raw": {Format: "csv", Columns: []string{"id", "value"}}}},
+			},
+			returnsError: true,
+		},
+		{
+			contracts: map[string]StepContracts{
+				"extract":   {Produces: map[string]DataContract{"raw": {Format: "csv"}}},
+				"transform": {Consumes: map[string]DataContract{"raw": {Format: "jsonlines"}}},
+			},
+			returnsError: true,
+		},
+		{
+			contracts: map[string]StepContracts{
+				"load":    {Produces: map[string]DataContract{"raw": {Format: "csv"}}},
+				"extract": {Consumes: map[string]DataContract{"raw": {Format: "csv"}}},
+			},
+			returnsError: true,
+		},
+		{
+			contracts: map[string]StepContracts{
+				"transform": {Consumes: map[string]DataContract{"raw": {Format: "csv"}}},
+			},
+			returnsError: true,
+		},
+		{
+			contracts: map[string]StepContracts{
+				"extract": {Produces: map[string]DataContract{"raw": {Format: "xlsx"}}},
+			},
+			returnsError: true,
+		},
+		{
+			contracts: map[string]StepContracts{
+				"extract":   {Produces: map[string]DataContract{"raw": {Format: "csv"}}},
+				"transform": {Produces: map[string]DataContract{"raw": {Format: "csv"}}},
+			},
+			returnsError: true,
+		},
+		{
+			contracts: map[string]StepContracts{
+				"unknown": {Produces: map[string]DataContract{"raw": {Format: "csv"}}},
+			},
+			returnsError: true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		_, err := MaterializeStepContracts(steps, dependencies, testCase.contracts)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		}
+	}
+}
+
+func TestValidateProducedData(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "shnorky-contracts-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dataDir)
+
+	type validationTest struct {
+		format       string
+		contents     string
+		columns      []string
+		returnsError bool
+	}
+
+	testCases := []validationTest{
+		{format: "csv", contents: "id,name\n1,a\n2,b\n", columns: []string{"id", "name"}, returnsError: false},
+		{format: "csv", contents: "id,name\n1,a\n", columns: []string{"id", "value"}, returnsError: true},
+		{format: "csv", contents: "id,name\n1,a,extra\n", columns: []string{"id"}, returnsError: true},
+		{format: "jsonlines", contents: "{\"id\": 1, \"name\": \"a\"}\n\n{\"id\": 2, \"name\": \"b\"}\n", columns: []string{"id"}, returnsError: false},
+		{format: "jsonlines", contents: "{\"id\": 1}\n{\"name\": \"b\"}\n", columns: []string{"id"}, returnsError: true},
+		{format: "jsonlines", contents: "not json\n", returnsError: true},
+		{format: "json", contents: "{\"id\": 1}", returnsError: false},
+		{format: "json", contents: "{\"id\": ", returnsError: true},
+		{format: "parquet", contents: "not parquet", returnsError: false},
+	}
+
+	run := FlowRunMetadata{ID: "run", FlowID: "flow"}
+	for i, testCase := range testCases {
+		dataPath := filepath.Join(dataDir, "data")
+		err = ioutil.WriteFile(dataPath, []byte(testCase.contents), 0644)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not write data file: %s", i, err.Error())
+		}
+
+		specification := FlowSpecification{
+			Contracts: map[string]StepContracts{
+				"produce": {Produces: map[string]DataContract{"data": {Format: testCase.format, Columns: testCase.columns, Path: dataPath}}},
+			},
+		}
+		err = ValidateProducedData(specification, run, "produce")
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		}
+	}
+
+	RegisterDataValidator(DataFormatParquet, DataValidatorFunc(func(path string, contract DataContract) error {
+		return errors.New("Invalid parquet file")
+	}))
+	defer delete(dataValidators, DataFormatParquet)
+	specification := FlowSpecification{
+		Contracts: map[string]StepContracts{
+			"produce": {Produces: map[string]DataContract{"data": {Format: DataFormatParquet, Path: filepath.Join(dataDir, "data")}}},
+		},
+	}
+	err = ValidateProducedData(specification, run, "produce")
+	if err == nil {
+		t.Errorf("Expected registered validator to be used for parquet data")
+	}
+}
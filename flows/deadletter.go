@@ -0,0 +1,186 @@
+package flows
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+// DeadLetterRecordFileName is the name of the file, written next to each dead-lettered input,
+// which records why the input was dead-lettered
+var DeadLetterRecordFileName = "dead_letter.json"
+
+// DeadLetterSpecification - specifies how a step whose input may be poisonous (i.e. cause the step
+// to fail no matter how many times it is retried) should be handled. The step is retried the given
+// number of times and, if it still fails, its input is set aside in the dead-letter directory and
+// the rest of the flow proceeds as if the step had been allowed to fail.
+type DeadLetterSpecification struct {
+	// Retries is the number of times the step is retried after its first failure
+	Retries int `json:"retries"`
+	// Input is the target of the mount (for the step) whose source is the input of the step. For
+	// partitioned steps, it defaults to the target of the partition, so that the shard that each
+	// shard step processes is dead-lettered on its own (see PartitionSpecification).
+	Input string `json:"input"`
+	// Directory is the directory under which dead-lettered inputs are stored (in a subdirectory
+	// named "<run ID>/<step>"). Supports "env:<VARIABLE_NAME>" values.
+	Directory string `json:"directory"`
+	// Move specifies whether the input should be moved (rather than copied) into the dead-letter
+	// directory, so that subsequent runs do not see it. It is not supported for partitioned steps.
+	Move bool `json:"move,omitempty"`
+}
+
+// DeadLetterRecord - describes an input which was dead-lettered in a flow run
+type DeadLetterRecord struct {
+	FlowID      string    `json:"flow_id"`
+	RunID       string    `json:"run_id"`
+	Step        string    `json:"step"`
+	ExecutionID string    `json:"execution_id"`
+	ExitCode    *int      `json:"exit_code"`
+	Attempts    int       `json:"attempts"`
+	Source      string    `json:"source"`
+	Destination string    `json:"destination"`
+	Moved       bool      `json:"moved"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// MaterializeDeadLetterSpecification validates the given dead-letter specification for a step
+// with the given mounts and resolves its directory to an absolute path
+func MaterializeDeadLetterSpecification(rawSpecification DeadLetterSpecification, mounts []components.MountConfiguration) (DeadLetterSpecification, error) {
+	if rawSpecification.Retries < 0 {
+		return rawSpecification, errors.New("Retries must be non-negative")
+	}
+
+	materializedDirectory, err := components.MaterializeEnv(rawSpecification.Directory)
+	if err != nil {
+		return rawSpecification, err
+	}
+	if materializedDirectory == "" {
+		return rawSpecification, errors.New("Dead-letter directory must be a non-empty string")
+	}
+	absoluteDirectory, err := filepath.Abs(materializedDirectory)
+	if err != nil {
+		return rawSpecification, err
+	}
+
+	if _, ok := inputMount(rawSpecification.Input, mounts); !ok {
+		return rawSpecification, fmt.Errorf("No mount with target (%s)", rawSpecification.Input)
+	}
+
+	return DeadLetterSpecification{
+		Retries:   rawSpecification.Retries,
+		Input:     rawSpecification.Input,
+		Directory: absoluteDirectory,
+		Move:      rawSpecification.Move,
+	}, nil
+}
+
+// inputMount returns the mount configuration with the given target
+func inputMount(target string, mounts []components.MountConfiguration) (components.MountConfiguration, bool) {
+	for _, mount := range mounts {
+		if mount.Target == target {
+			return mount, true
+		}
+	}
+	return components.MountConfiguration{}, false
+}
+
+// DeadLetterInput sets aside the input of the given failed execution of a step in the given run,
+// as specified by the given dead-letter specification, and writes a record describing why it was
+// set aside next to it. attempts is the number of times the step was executed.
+func DeadLetterInput(
+	specification DeadLetterSpecification,
+	mounts []components.MountConfiguration,
+	run FlowRunMetadata,
+	step string,
+	executionMetadata components.ExecutionMetadata,
+	attempts int,
+) (DeadLetterRecord, error) {
+	mount, ok := inputMount(specification.Input, mounts)
+	if !ok {
+		return DeadLetterRecord{}, fmt.Errorf("No mount with target (%s) for step (%s)", specification.Input, step)
+	}
+
+	destinationDir := filepath.Join(specification.Directory, run.ID, step)
+	err := os.MkdirAll(destinationDir, 0744)
+	if err != nil {
+		return DeadLetterRecord{}, fmt.Errorf("Could not create dead-letter directory (%s): %w", destinationDir, err)
+	}
+
+	record := DeadLetterRecord{
+		FlowID:      run.FlowID,
+		RunID:       run.ID,
+		Step:        step,
+		ExecutionID: executionMetadata.ID,
+		ExitCode:    executionMetadata.ExitCode,
+		Attempts:    attempts,
+		Source:      mount.Source,
+		Destination: filepath.Join(destinationDir, filepath.Base(mount.Source)),
+		Moved:       specification.Move,
+		CreatedAt:   time.Now(),
+	}
+
+	err = copyPath(record.Source, record.Destination)
+	if err != nil {
+		return record, fmt.Errorf("Could not copy input (%s) to dead-letter directory: %w", record.Source, err)
+	}
+	if specification.Move {
+		err = os.RemoveAll(record.Source)
+		if err != nil {
+			return record, fmt.Errorf("Could not remove dead-lettered input (%s): %w", record.Source, err)
+		}
+	}
+
+	recordFile, err := os.Create(filepath.Join(destinationDir, DeadLetterRecordFileName))
+	if err != nil {
+		return record, fmt.Errorf("Could not create dead-letter record: %w", err)
+	}
+	defer recordFile.Close()
+
+	enc := json.NewEncoder(recordFile)
+	enc.SetIndent("", "    ")
+	err = enc.Encode(record)
+	if err != nil {
+		return record, fmt.Errorf("Could not write dead-letter record: %w", err)
+	}
+
+	return record, nil
+}
+
+// copyPath copies the file or directory at source to destination, preserving file modes
+func copyPath(source, destination string) error {
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destination, relativePath)
+
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+
+		sourceFile, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer sourceFile.Close()
+
+		targetFile, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode())
+		if err != nil {
+			return err
+		}
+		defer targetFile.Close()
+
+		_, err = io.Copy(targetFile, sourceFile)
+		return err
+	})
+}
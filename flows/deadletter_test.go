@@ -0,0 +1,89 @@
+package flows
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+func TestMaterializeDeadLetterSpecification(t *testing.T) {
+	mounts := []components.MountConfiguration{{Source: "/tmp/input.txt", Target: "/shnorky/inputs.txt", Method: "bind"}}
+
+	type materializeDeadLetterTest struct {
+		rawSpecification DeadLetterSpecification
+		returnsError     bool
+	}
+
+	testCases := []materializeDeadLetterTest{
+		{rawSpecification: DeadLetterSpecification{Retries: 2, Input: "/shnorky/inputs.txt", Directory: "/tmp/dead-letters"}, returnsError: false},
+		{rawSpecification: DeadLetterSpecification{Retries: -1, Input: "/shnorky/inputs.txt", Directory: "/tmp/dead-letters"}, returnsError: true},
+		{rawSpecification: DeadLetterSpecification{Retries: 2, Input: "/shnorky/outputs.txt", Directory: "/tmp/dead-letters"}, returnsError: true},
+		{rawSpecification: DeadLetterSpecification{Retries: 2, Input: "/shnorky/inputs.txt"}, returnsError: true},
+	}
+
+	for i, testCase := range testCases {
+		_, err := MaterializeDeadLetterSpecification(testCase.rawSpecification, mounts)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		}
+	}
+}
+
+// TestDeadLetterInput moves a poisonous input into a dead-letter directory and checks the record
+// written next to it
+func TestDeadLetterInput(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "shnorky-dead-letter-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+
+	inputPath := filepath.Join(tempDir, "input.txt")
+	err = ioutil.WriteFile(inputPath, []byte("poison"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write input file: %s", err.Error())
+	}
+
+	mounts := []components.MountConfiguration{{Source: inputPath, Target: "/shnorky/inputs.txt", Method: "bind"}}
+	specification := DeadLetterSpecification{Retries: 1, Input: "/shnorky/inputs.txt", Directory: filepath.Join(tempDir, "dead-letters"), Move: true}
+	run := FlowRunMetadata{ID: "run", FlowID: "flow"}
+	exitCode := 3
+	execution := components.ExecutionMetadata{ID: "execution", ExitCode: &exitCode}
+
+	record, err := DeadLetterInput(specification, mounts, run, "step", execution, 2)
+	if err != nil {
+		t.Fatalf("Unexpected error dead-lettering input: %s", err.Error())
+	}
+
+	expectedDestination := filepath.Join(tempDir, "dead-letters", "run", "step", "input.txt")
+	if record.Destination != expectedDestination {
+		t.Errorf("Unexpected destination: expected=%s, actual=%s", expectedDestination, record.Destination)
+	}
+	contents, err := ioutil.ReadFile(expectedDestination)
+	if err != nil || string(contents) != "poison" {
+		t.Errorf("Dead-lettered input does not have the expected contents: %s", string(contents))
+	}
+	if _, err := os.Stat(inputPath); !os.IsNotExist(err) {
+		t.Errorf("Expected input to be moved out of its original location")
+	}
+
+	recordFile, err := os.Open(filepath.Join(tempDir, "dead-letters", "run", "step", DeadLetterRecordFileName))
+	if err != nil {
+		t.Fatalf("Could not open dead-letter record: %s", err.Error())
+	}
+	defer recordFile.Close()
+	var storedRecord DeadLetterRecord
+	err = json.NewDecoder(recordFile).Decode(&storedRecord)
+	if err != nil {
+		t.Fatalf("Could not decode dead-letter record: %s", err.Error())
+	}
+	if storedRecord.ExecutionID != "execution" || storedRecord.Attempts != 2 || storedRecord.ExitCode == nil || *storedRecord.ExitCode != 3 {
+		t.Errorf("Unexpected dead-letter record: %v", storedRecord)
+	}
+}
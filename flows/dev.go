@@ -0,0 +1,258 @@
+package flows
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"time"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// DevPollInterval - how often Develop checks the sources of the components of a flow for changes
+var DevPollInterval = time.Second
+
+type stepSelectionKey struct{}
+
+// WithSteps returns a copy of the given context which restricts the flow runs executed with it to
+// the given steps. Dependencies of the selected steps on steps which are not selected are dropped,
+// so the selected steps use whatever those steps produced in earlier runs.
+func WithSteps(ctx context.Context, steps []string) context.Context {
+	return context.WithValue(ctx, stepSelectionKey{}, steps)
+}
+
+// applyStepSelection returns a copy of the given flow specification restricted to the steps
+// selected by the given context (see WithSteps)
+func applyStepSelection(ctx context.Context, specification FlowSpecification) (FlowSpecification, error) {
+	steps, ok := ctx.Value(stepSelectionKey{}).([]string)
+	if !ok {
+		return specification, nil
+	}
+	selected := map[string]bool{}
+	for _, step := range steps {
+		if _, ok := specification.Steps[step]; !ok {
+			return specification, fmt.Errorf("Unknown step in step selection: %s", step)
+		}
+		selected[step] = true
+	}
+
+	selectedSteps := map[string]string{}
+	dependencies := map[string][]string{}
+	for step, componentID := range specification.Steps {
+		if !selected[step] {
+			continue
+		}
+		selectedSteps[step] = componentID
+		for _, dependency := range specification.Dependencies[step] {
+			if selected[dependency] {
+				dependencies[step] = append(dependencies[step], dependency)
+			}
+		}
+	}
+	specification.Steps = selectedSteps
+	specification.Dependencies = dependencies
+	specification.Stages = nil
+	return specification, nil
+}
+
+// DownstreamSteps returns the given steps of the given flow specification together with every step
+// which depends on any of them (directly or transitively), in lexicographic order
+func DownstreamSteps(specification FlowSpecification, steps []string) []string {
+	dependents := map[string][]string{}
+	for step, dependencies := range specification.Dependencies {
+		for _, dependency := range dependencies {
+			dependents[dependency] = append(dependents[dependency], step)
+		}
+	}
+
+	downstream := map[string]bool{}
+	queue := append([]string{}, steps...)
+	for len(queue) > 0 {
+		step := queue[0]
+		queue = queue[1:]
+		if downstream[step] {
+			continue
+		}
+		downstream[step] = true
+		queue = append(queue, dependents[step]...)
+	}
+
+	result := make([]string, 0, len(downstream))
+	for step := range downstream {
+		result = append(result, step)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// DevIteration - the outcome of one iteration of Develop: the components whose sources changed
+// (for the first iteration, and whenever the flow specification changes, the components whose
+// builds are stale), the builds created for them, and the steps which were executed in the run
+type DevIteration struct {
+	Changed []string                            `json:"changed"`
+	Builds  map[string]components.BuildMetadata `json:"builds"`
+	Steps   []string                            `json:"steps"`
+	RunID   string                              `json:"run_id,omitempty"`
+	Error   string                              `json:"error,omitempty"`
+}
+
+// sourceHashes returns the source hash of each of the components which the steps of the given flow
+// specification run (excluding host steps, built-in components, and embedded components)
+func sourceHashes(store state.Store, specification FlowSpecification) (map[string]string, error) {
+	hashes := map[string]string{}
+	for _, componentID := range specification.Steps {
+		if _, ok := hashes[componentID]; ok || isHostStep(componentID) || components.IsBuiltinComponent(componentID) || IsEmbeddedComponent(componentID) {
+			continue
+		}
+		component, err := components.SelectComponentByID(store, componentID)
+		if err != nil {
+			return hashes, fmt.Errorf("Could not select component (%s): %w", componentID, err)
+		}
+		hashes[componentID], err = components.SourceHash(component)
+		if err != nil {
+			return hashes, fmt.Errorf("Could not hash source of component (%s): %w", componentID, err)
+		}
+	}
+	return hashes, nil
+}
+
+// Develop executes the flow with the given ID and then watches the component directories of its
+// steps for changes, checking their sources (see components.SourceHash) every pollInterval. Whenever
+// the sources of some components change, it rebuilds those components and executes the steps which
+// run them along with every step downstream of those steps. Changes to the flow specification itself
+// cause the whole flow to be executed again. The given callback is called with the outcome of each
+// iteration. Failures (including specifications or component directories which cannot be read while
+// they are being edited) are reported through the callback once and do not stop Develop, which runs
+// until the given context is cancelled and then returns the context's error.
+// This is the handler for `shn dev`
+func Develop(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	outstream io.Writer,
+	stateDir string,
+	flowID string,
+	pollInterval time.Duration,
+	iterated func(DevIteration),
+) error {
+	if iterated == nil {
+		iterated = func(DevIteration) {}
+	}
+	var hashes map[string]string
+	var checksum, lastError string
+	ticker := time.NewTicker(pollInterval)
+	defer ticker.Stop()
+	for ; ; waitForTick(ctx, ticker) {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		specification, currentChecksum, currentHashes, err := readDevState(store, flowID)
+		if err != nil {
+			if err.Error() != lastError {
+				lastError = err.Error()
+				iterated(DevIteration{Changed: []string{}, Builds: map[string]components.BuildMetadata{}, Error: lastError})
+			}
+			continue
+		}
+
+		iteration := DevIteration{Changed: []string{}, Builds: map[string]components.BuildMetadata{}}
+		var changedSteps []string
+		if hashes == nil || currentChecksum != checksum {
+			iteration.Changed, err = StaleComponents(store, flowID)
+			if err != nil {
+				if err.Error() != lastError {
+					lastError = err.Error()
+					iterated(DevIteration{Changed: []string{}, Builds: map[string]components.BuildMetadata{}, Error: lastError})
+				}
+				continue
+			}
+			for step := range specification.Steps {
+				changedSteps = append(changedSteps, step)
+			}
+		} else {
+			for componentID, hash := range currentHashes {
+				if hashes[componentID] != hash {
+					iteration.Changed = append(iteration.Changed, componentID)
+				}
+			}
+			sort.Strings(iteration.Changed)
+			changed := map[string]bool{}
+			for _, componentID := range iteration.Changed {
+				changed[componentID] = true
+			}
+			for step, componentID := range specification.Steps {
+				if changed[componentID] {
+					changedSteps = append(changedSteps, step)
+				}
+			}
+		}
+		hashes = currentHashes
+		checksum = currentChecksum
+		lastError = ""
+
+		if len(changedSteps) == 0 {
+			continue
+		}
+		iteration.Steps = DownstreamSteps(specification, changedSteps)
+		err = developIteration(ctx, store, dockerClient, outstream, stateDir, flowID, &iteration)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if err != nil {
+			iteration.Error = err.Error()
+		}
+		iterated(iteration)
+	}
+}
+
+// waitForTick waits for the next tick of the given ticker or for the given context to be cancelled
+func waitForTick(ctx context.Context, ticker *time.Ticker) {
+	select {
+	case <-ctx.Done():
+	case <-ticker.C:
+	}
+}
+
+// readDevState reads the (materialized) specification of the flow with the given ID along with its
+// checksum and the source hashes of the components of its steps
+func readDevState(store state.Store, flowID string) (FlowSpecification, string, map[string]string, error) {
+	flow, err := SelectFlowByID(store, flowID)
+	if err != nil {
+		return FlowSpecification{}, "", nil, err
+	}
+	checksum, err := SpecificationChecksum(flow.SpecificationPath)
+	if err != nil {
+		return FlowSpecification{}, "", nil, err
+	}
+	specification, err := ReadFlowSpecification(store, flowID)
+	if err != nil {
+		return specification, "", nil, err
+	}
+	hashes, err := sourceHashes(store, specification)
+	return specification, checksum, hashes, err
+}
+
+// developIteration rebuilds the changed components of the given iteration and executes its steps
+func developIteration(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, stateDir, flowID string, iteration *DevIteration) error {
+	for _, componentID := range iteration.Changed {
+		buildMetadata, err := components.CreateBuild(ctx, store, dockerClient, outstream, filepath.Join(stateDir, state.BuildLogsDirName), componentID, components.BuildOptions{})
+		if err != nil {
+			return fmt.Errorf("Error building component (%s): %w", componentID, err)
+		}
+		iteration.Builds[componentID] = buildMetadata
+	}
+
+	run, err := GenerateFlowRunMetadata(flowID)
+	if err != nil {
+		return err
+	}
+	run, _, err = ExecuteRun(WithSteps(ctx, iteration.Steps), store, dockerClient, outstream, stateDir, run)
+	iteration.RunID = run.ID
+	return err
+}
@@ -0,0 +1,104 @@
+package flows
+
+import (
+	"context"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestDownstreamSteps(t *testing.T) {
+	specification := FlowSpecification{
+		Steps: map[string]string{"extract": "extractor", "fetch": "fetcher", "load": "loader", "report": "reporter", "audit": "auditor"},
+		Dependencies: map[string][]string{
+			"load":   {"extract", "fetch"},
+			"report": {"load"},
+			"audit":  {"fetch"},
+		},
+	}
+
+	type downstreamTest struct {
+		steps    []string
+		expected []string
+	}
+
+	tests := []downstreamTest{
+		{[]string{"extract"}, []string{"extract", "load", "report"}},
+		{[]string{"fetch"}, []string{"audit", "fetch", "load", "report"}},
+		{[]string{"report"}, []string{"report"}},
+		{[]string{"load", "audit"}, []string{"audit", "load", "report"}},
+		{[]string{}, []string{}},
+	}
+
+	for i, test := range tests {
+		actual := DownstreamSteps(specification, test.steps)
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("[Test %d] Unexpected downstream steps: expected=%v, actual=%v", i, test.expected, actual)
+		}
+	}
+}
+
+func TestApplyStepSelection(t *testing.T) {
+	specification := FlowSpecification{
+		Steps: map[string]string{"extract": "extractor", "fetch": "fetcher", "load": "loader", "report": "reporter"},
+		Dependencies: map[string][]string{
+			"load":   {"extract", "fetch"},
+			"report": {"load"},
+		},
+	}
+
+	selected, err := applyStepSelection(context.Background(), specification)
+	if err != nil || !reflect.DeepEqual(selected, specification) {
+		t.Errorf("Expected specification without step selection to be unchanged: actual=%v, error=%v", selected, err)
+	}
+
+	selected, err = applyStepSelection(WithSteps(context.Background(), []string{"load", "report"}), specification)
+	if err != nil {
+		t.Fatalf("Unexpected error selecting steps: %s", err.Error())
+	}
+	expectedSteps := map[string]string{"load": "loader", "report": "reporter"}
+	if !reflect.DeepEqual(selected.Steps, expectedSteps) {
+		t.Errorf("Unexpected steps: expected=%v, actual=%v", expectedSteps, selected.Steps)
+	}
+	expectedDependencies := map[string][]string{"report": {"load"}}
+	if !reflect.DeepEqual(selected.Dependencies, expectedDependencies) {
+		t.Errorf("Unexpected dependencies: expected=%v, actual=%v", expectedDependencies, selected.Dependencies)
+	}
+	stages, err := CalculateStages(selected)
+	if err != nil || !reflect.DeepEqual(stages, [][]string{{"load"}, {"report"}}) {
+		t.Errorf("Unexpected stages of selected steps: stages=%v, error=%v", stages, err)
+	}
+
+	_, err = applyStepSelection(WithSteps(context.Background(), []string{"transform"}), specification)
+	if err == nil {
+		t.Error("Expected error selecting unknown step")
+	}
+}
+
+// TestDevelopReportsErrors checks that Develop reports a flow which cannot be read once (rather
+// than on every poll) and keeps running until its context is cancelled
+func TestDevelopReportsErrors(t *testing.T) {
+	stateDir, db, err := state.InitEphemeral()
+	if err != nil {
+		t.Fatalf("Could not initialize ephemeral state: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	iterations := []DevIteration{}
+	err = Develop(ctx, store, nil, nil, stateDir, "unregistered", 5*time.Millisecond, func(iteration DevIteration) {
+		iterations = append(iterations, iteration)
+	})
+	if err != context.DeadlineExceeded {
+		t.Errorf("Unexpected error: expected=%v, actual=%v", context.DeadlineExceeded, err)
+	}
+	if len(iterations) != 1 || iterations[0].Error == "" {
+		t.Errorf("Expected a single failed iteration, got: %v", iterations)
+	}
+}
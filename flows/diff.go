@@ -0,0 +1,269 @@
+package flows
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// StepExecutionSummary - the execution of a step in a flow run, as compared by CompareRuns. If the
+// step was retried, the summary describes its last attempt, but its duration runs from the start of
+// its first attempt.
+type StepExecutionSummary struct {
+	ExecutionID     string  `json:"execution_id"`
+	BuildID         string  `json:"build_id"`
+	ImageDigest     string  `json:"image_digest,omitempty"`
+	ExitCode        *int    `json:"exit_code"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// Configuration is nil if no configuration was recorded for the execution
+	Configuration *components.ExecutionConfiguration `json:"-"`
+}
+
+// StepComparison - the differences between the executions of a step in two flow runs
+type StepComparison struct {
+	Step string `json:"step"`
+	// A and B are nil if the step was not executed in the corresponding run
+	A *StepExecutionSummary `json:"a"`
+	B *StepExecutionSummary `json:"b"`
+	// DurationDeltaSeconds is the duration of the step in run B minus its duration in run A
+	DurationDeltaSeconds float64 `json:"duration_delta_seconds"`
+	ExitCodeChanged      bool    `json:"exit_code_changed"`
+	ImageChanged         bool    `json:"image_changed"`
+	// EnvChanges lists the environment variables which were added ("+NAME"), removed ("-NAME"), or
+	// whose values changed ("~NAME") between the runs
+	EnvChanges []string `json:"env_changes"`
+	// MountChanges lists the mounts which were added ("+<type>:<source>:<target>") or removed
+	// ("-<type>:<source>:<target>") between the runs
+	MountChanges []string `json:"mount_changes"`
+}
+
+// RunComparison - the differences between two flow runs, step by step
+type RunComparison struct {
+	A                    FlowRunMetadata  `json:"a"`
+	B                    FlowRunMetadata  `json:"b"`
+	DurationDeltaSeconds float64          `json:"duration_delta_seconds"`
+	Steps                []StepComparison `json:"steps"`
+}
+
+// CompareRuns compares the flow runs with the given IDs, step by step: the durations and exit codes
+// of their executions, the images they ran, and the environment variables and mounts they were
+// given. Steps are ordered by name.
+// This is the handler for `shn flows diff-runs`
+func CompareRuns(store state.Store, runIDA, runIDB string) (RunComparison, error) {
+	comparison := RunComparison{Steps: []StepComparison{}}
+
+	runA, summariesA, err := summarizeRunSteps(store, runIDA)
+	if err != nil {
+		return comparison, err
+	}
+	runB, summariesB, err := summarizeRunSteps(store, runIDB)
+	if err != nil {
+		return comparison, err
+	}
+	comparison.A, comparison.B = runA, runB
+	comparison.DurationDeltaSeconds = durationSince(runB.CreatedAt, runB.FinishedAt) - durationSince(runA.CreatedAt, runA.FinishedAt)
+
+	steps := []string{}
+	for step := range summariesA {
+		steps = append(steps, step)
+	}
+	for step := range summariesB {
+		if _, ok := summariesA[step]; !ok {
+			steps = append(steps, step)
+		}
+	}
+	sort.Strings(steps)
+
+	for _, step := range steps {
+		comparison.Steps = append(comparison.Steps, compareStep(step, summariesA[step], summariesB[step]))
+	}
+
+	return comparison, nil
+}
+
+// summarizeRunSteps returns the flow run with the given ID along with a summary of the execution of
+// each of its steps
+func summarizeRunSteps(store state.Store, runID string) (FlowRunMetadata, map[string]*StepExecutionSummary, error) {
+	summaries := map[string]*StepExecutionSummary{}
+
+	run, err := SelectFlowRunByID(store, runID)
+	if err != nil {
+		return run, summaries, fmt.Errorf("Error retrieving flow run (%s): %w", runID, err)
+	}
+
+	executions, err := components.SelectExecutionsByFlowRunID(store, runID)
+	if err != nil {
+		return run, summaries, fmt.Errorf("Error retrieving executions for flow run (%s): %w", runID, err)
+	}
+
+	starts := map[string]time.Time{}
+	latest := map[string]components.ExecutionMetadata{}
+	for _, execution := range executions {
+		if execution.Step == "" {
+			continue
+		}
+		if start, ok := starts[execution.Step]; !ok || execution.CreatedAt.Before(start) {
+			starts[execution.Step] = execution.CreatedAt
+		}
+		if previous, ok := latest[execution.Step]; !ok || execution.CreatedAt.After(previous.CreatedAt) {
+			latest[execution.Step] = execution
+		}
+	}
+
+	for step, execution := range latest {
+		summary := &StepExecutionSummary{
+			ExecutionID:     execution.ID,
+			BuildID:         execution.BuildID,
+			ExitCode:        execution.ExitCode,
+			DurationSeconds: durationSince(starts[step], execution.FinishedAt),
+		}
+		configuration, err := components.SelectExecutionConfiguration(store, execution.ID)
+		if err == nil {
+			summary.ImageDigest = configuration.ImageDigest
+			summary.Configuration = &configuration
+		} else if err != components.ErrNoExecutionConfiguration {
+			return run, summaries, err
+		}
+		summaries[step] = summary
+	}
+
+	return run, summaries, nil
+}
+
+// compareStep compares the given executions of the given step (either of which may be nil)
+func compareStep(step string, a, b *StepExecutionSummary) StepComparison {
+	comparison := StepComparison{Step: step, A: a, B: b, EnvChanges: []string{}, MountChanges: []string{}}
+	if a == nil || b == nil {
+		return comparison
+	}
+
+	comparison.DurationDeltaSeconds = b.DurationSeconds - a.DurationSeconds
+	comparison.ExitCodeChanged = (a.ExitCode == nil) != (b.ExitCode == nil) || (a.ExitCode != nil && b.ExitCode != nil && *a.ExitCode != *b.ExitCode)
+	if a.ImageDigest != "" && b.ImageDigest != "" {
+		comparison.ImageChanged = a.ImageDigest != b.ImageDigest
+	} else {
+		comparison.ImageChanged = a.BuildID != b.BuildID
+	}
+
+	if a.Configuration == nil || b.Configuration == nil {
+		return comparison
+	}
+	for name, digest := range a.Configuration.Env {
+		otherDigest, ok := b.Configuration.Env[name]
+		if !ok {
+			comparison.EnvChanges = append(comparison.EnvChanges, "-"+name)
+		} else if digest != otherDigest {
+			comparison.EnvChanges = append(comparison.EnvChanges, "~"+name)
+		}
+	}
+	for name := range b.Configuration.Env {
+		if _, ok := a.Configuration.Env[name]; !ok {
+			comparison.EnvChanges = append(comparison.EnvChanges, "+"+name)
+		}
+	}
+	sort.Slice(comparison.EnvChanges, func(i, j int) bool {
+		return comparison.EnvChanges[i][1:] < comparison.EnvChanges[j][1:]
+	})
+
+	mountsA := map[string]bool{}
+	for _, mount := range a.Configuration.Mounts {
+		mountsA[mount] = true
+	}
+	mountsB := map[string]bool{}
+	for _, mount := range b.Configuration.Mounts {
+		mountsB[mount] = true
+		if !mountsA[mount] {
+			comparison.MountChanges = append(comparison.MountChanges, "+"+mount)
+		}
+	}
+	for _, mount := range a.Configuration.Mounts {
+		if !mountsB[mount] {
+			comparison.MountChanges = append(comparison.MountChanges, "-"+mount)
+		}
+	}
+	sort.Strings(comparison.MountChanges)
+
+	return comparison
+}
+
+// WriteRunComparison writes the given run comparison to the given writer as a human-readable table
+// of the durations and exit codes of the steps in both runs, followed by the differences between
+// the images, environment variables, and mounts of each step
+func WriteRunComparison(w io.Writer, comparison RunComparison) error {
+	fmt.Fprintf(w, "Run A: %s (flow: %s, status: %s, duration: %.1fs)\n", comparison.A.ID, comparison.A.FlowID, comparison.A.Status, durationSince(comparison.A.CreatedAt, comparison.A.FinishedAt))
+	fmt.Fprintf(w, "Run B: %s (flow: %s, status: %s, duration: %.1fs, delta: %+.1fs)\n\n", comparison.B.ID, comparison.B.FlowID, comparison.B.Status, durationSince(comparison.B.CreatedAt, comparison.B.FinishedAt), comparison.DurationDeltaSeconds)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tDURATION A\tDURATION B\tDELTA\tEXIT A\tEXIT B\tCHANGES")
+	details := []string{}
+	for _, step := range comparison.Steps {
+		changes := []string{}
+		if step.A == nil {
+			changes = append(changes, "only in B")
+		}
+		if step.B == nil {
+			changes = append(changes, "only in A")
+		}
+		if step.ExitCodeChanged {
+			changes = append(changes, "exit code")
+		}
+		if step.ImageChanged {
+			changes = append(changes, "image")
+			details = append(details, fmt.Sprintf("%s: image %s -> %s", step.Step, summaryImage(step.A), summaryImage(step.B)))
+		}
+		if len(step.EnvChanges) > 0 {
+			changes = append(changes, "env")
+			details = append(details, fmt.Sprintf("%s: env %s", step.Step, strings.Join(step.EnvChanges, ", ")))
+		}
+		if len(step.MountChanges) > 0 {
+			changes = append(changes, "mounts")
+			details = append(details, fmt.Sprintf("%s: mounts %s", step.Step, strings.Join(step.MountChanges, ", ")))
+		}
+
+		delta := ""
+		if step.A != nil && step.B != nil {
+			delta = fmt.Sprintf("%+.1fs", step.DurationDeltaSeconds)
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", step.Step, summaryDuration(step.A), summaryDuration(step.B), delta, summaryExitCode(step.A), summaryExitCode(step.B), strings.Join(changes, ", "))
+	}
+	err := tw.Flush()
+	if err != nil || len(details) == 0 {
+		return err
+	}
+
+	fmt.Fprintln(w, "\nDifferences:")
+	for _, detail := range details {
+		fmt.Fprintf(w, "  %s\n", detail)
+	}
+	return nil
+}
+
+func summaryDuration(summary *StepExecutionSummary) string {
+	if summary == nil {
+		return "-"
+	}
+	return fmt.Sprintf("%.1fs", summary.DurationSeconds)
+}
+
+func summaryExitCode(summary *StepExecutionSummary) string {
+	if summary == nil {
+		return "-"
+	}
+	if summary.ExitCode == nil {
+		return "running"
+	}
+	return fmt.Sprintf("%d", *summary.ExitCode)
+}
+
+func summaryImage(summary *StepExecutionSummary) string {
+	if summary.ImageDigest != "" {
+		return summary.ImageDigest
+	}
+	return summary.BuildID
+}
@@ -0,0 +1,135 @@
+package flows
+
+import (
+	"bytes"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	dockerContainer "github.com/docker/docker/api/types/container"
+	dockerMount "github.com/docker/docker/api/types/mount"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// TestCompareRuns records two runs of a flow whose steps differ in duration, exit code, image,
+// environment, and mounts, and checks the differences that CompareRuns finds between them
+func TestCompareRuns(t *testing.T) {
+	stateDir, db, err := state.InitEphemeral()
+	if err != nil {
+		t.Fatalf("Could not initialize ephemeral state: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	start := time.Unix(time.Now().Unix()-1000, 0)
+
+	type execution struct {
+		run      string
+		step     string
+		build    string
+		offset   int
+		duration int
+		exitCode int
+		env      []string
+		mounts   []dockerMount.Mount
+	}
+	mount := dockerMount.Mount{Type: dockerMount.TypeBind, Source: "/data/a", Target: "/data"}
+	otherMount := dockerMount.Mount{Type: dockerMount.TypeBind, Source: "/data/b", Target: "/data"}
+	executions := []execution{
+		{run: "run-a", step: "extract", build: "build-1", offset: 0, duration: 10, env: []string{"SOURCE=s3://bucket", "DEBUG=0"}, mounts: []dockerMount.Mount{mount}},
+		{run: "run-a", step: "load", build: "build-1", offset: 10, duration: 5},
+		{run: "run-a", step: "report", build: "build-1", offset: 15, duration: 1},
+		{run: "run-b", step: "extract", build: "build-1", offset: 100, duration: 30, env: []string{"SOURCE=s3://other-bucket", "VERBOSE=1"}, mounts: []dockerMount.Mount{otherMount}},
+		// load was retried in run-b: its duration spans both attempts
+		{run: "run-b", step: "load", build: "build-2", offset: 130, duration: 2, exitCode: 1},
+		{run: "run-b", step: "load", build: "build-2", offset: 132, duration: 3, exitCode: 1},
+	}
+	for _, runID := range []string{"run-a", "run-b"} {
+		err = InsertFlowRun(store, FlowRunMetadata{ID: runID, FlowID: "flow", Status: RunStatusRunning, CreatedAt: start})
+		if err != nil {
+			t.Fatalf("[Run %s] Error inserting flow run: %s", runID, err.Error())
+		}
+	}
+	for i, e := range executions {
+		executionMetadata := components.ExecutionMetadata{
+			ID:          e.run + "-" + e.step + "-" + string('a'+rune(i)),
+			BuildID:     e.build,
+			ComponentID: "component",
+			CreatedAt:   start.Add(time.Duration(e.offset) * time.Second),
+			FlowID:      "flow",
+			FlowRunID:   e.run,
+			Step:        e.step,
+		}
+		err = components.InsertExecution(store, executionMetadata)
+		if err != nil {
+			t.Fatalf("[Test %d] Error inserting execution: %s", i, err.Error())
+		}
+		exitCode := e.exitCode
+		finishedAt := executionMetadata.CreatedAt.Add(time.Duration(e.duration) * time.Second)
+		executionMetadata.ExitCode = &exitCode
+		executionMetadata.FinishedAt = &finishedAt
+		err = components.UpdateExecutionResult(store, executionMetadata)
+		if err != nil {
+			t.Fatalf("[Test %d] Error updating execution result: %s", i, err.Error())
+		}
+
+		configuration := components.GenerateExecutionConfiguration(
+			executionMetadata.ID,
+			"sha256:"+e.build,
+			&dockerContainer.Config{Env: e.env},
+			&dockerContainer.HostConfig{Mounts: e.mounts},
+		)
+		err = components.InsertExecutionConfiguration(store, configuration)
+		if err != nil {
+			t.Fatalf("[Test %d] Error inserting execution configuration: %s", i, err.Error())
+		}
+	}
+
+	comparison, err := CompareRuns(store, "run-a", "run-b")
+	if err != nil {
+		t.Fatalf("Error comparing runs: %s", err.Error())
+	}
+	if len(comparison.Steps) != 3 {
+		t.Fatalf("Unexpected number of steps: expected=%d, actual=%d", 3, len(comparison.Steps))
+	}
+
+	extract, load, report := comparison.Steps[0], comparison.Steps[1], comparison.Steps[2]
+	if extract.Step != "extract" || extract.DurationDeltaSeconds != 20 || extract.ExitCodeChanged || extract.ImageChanged {
+		t.Errorf("Unexpected comparison of step (extract): %+v", extract)
+	}
+	expectedEnvChanges := []string{"-DEBUG", "~SOURCE", "+VERBOSE"}
+	if !reflect.DeepEqual(extract.EnvChanges, expectedEnvChanges) {
+		t.Errorf("Unexpected environment changes: expected=%v, actual=%v", expectedEnvChanges, extract.EnvChanges)
+	}
+	expectedMountChanges := []string{"+bind:/data/b:/data", "-bind:/data/a:/data"}
+	if !reflect.DeepEqual(extract.MountChanges, expectedMountChanges) {
+		t.Errorf("Unexpected mount changes: expected=%v, actual=%v", expectedMountChanges, extract.MountChanges)
+	}
+	if load.Step != "load" || load.DurationDeltaSeconds != 0 || !load.ExitCodeChanged || !load.ImageChanged || load.B.ExecutionID != "run-b-load-f" {
+		t.Errorf("Unexpected comparison of step (load): %+v", load)
+	}
+	if report.Step != "report" || report.A == nil || report.B != nil {
+		t.Errorf("Unexpected comparison of step (report): %+v", report)
+	}
+
+	var buf bytes.Buffer
+	err = WriteRunComparison(&buf, comparison)
+	if err != nil {
+		t.Fatalf("Error writing run comparison: %s", err.Error())
+	}
+	for _, expected := range []string{"only in A", "exit code, image", "extract: env -DEBUG, ~SOURCE, +VERBOSE", "load: image sha256:build-1 -> sha256:build-2"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Run comparison did not contain expected string (%s):\n%s", expected, buf.String())
+		}
+	}
+
+	_, err = CompareRuns(store, "run-a", "nonexistent-run")
+	if err == nil {
+		t.Error("Expected error comparing against nonexistent run, but did not get one")
+	}
+}
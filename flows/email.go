@@ -0,0 +1,136 @@
+package flows
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/smtp"
+	"strings"
+	"time"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// sendMail sends an email through an SMTP server - it has the same signature as smtp.SendMail,
+// which is what EmailNotifier uses by default
+type sendMail func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error
+
+// EmailNotifier sends a summary email through an SMTP server when a flow run fails. Other events
+// are ignored.
+type EmailNotifier struct {
+	configuration state.SMTPConfiguration
+	dockerClient  *docker.Client
+	send          sendMail
+}
+
+// NewEmailNotifier creates an EmailNotifier which sends emails according to the given SMTP
+// configuration. The given docker client is used to retrieve the logs of the failing step; if it is
+// nil, emails are sent without logs.
+func NewEmailNotifier(configuration state.SMTPConfiguration, dockerClient *docker.Client) (*EmailNotifier, error) {
+	materializedConfiguration := configuration
+	var err error
+	materializedConfiguration.Username, err = components.MaterializeTrustedEnv(configuration.Username)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SMTP configuration: %w", err)
+	}
+	materializedConfiguration.Password, err = components.MaterializeTrustedEnv(configuration.Password)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid SMTP configuration: %w", err)
+	}
+	if materializedConfiguration.LogLines == 0 {
+		materializedConfiguration.LogLines = state.DefaultEmailLogLines
+	}
+	return &EmailNotifier{configuration: materializedConfiguration, dockerClient: dockerClient, send: smtp.SendMail}, nil
+}
+
+// Notify sends an email describing the given event if it is a run failure
+func (notifier *EmailNotifier) Notify(ctx context.Context, event RunEvent) error {
+	if event.Type != RunEventFailed {
+		return nil
+	}
+
+	logLines := []string{}
+	var logsErr error
+	if event.FailedExecutionID != "" && notifier.dockerClient != nil {
+		logLines, logsErr = components.ExecutionLogTail(ctx, notifier.dockerClient, event.FailedExecutionID, notifier.configuration.LogLines)
+	}
+
+	var auth smtp.Auth
+	if notifier.configuration.Username != "" {
+		auth = smtp.PlainAuth("", notifier.configuration.Username, notifier.configuration.Password, notifier.configuration.Host)
+	}
+
+	addr := fmt.Sprintf("%s:%d", notifier.configuration.Host, notifier.configuration.Port)
+	message := notifier.message(event, logLines, logsErr)
+	err := notifier.send(addr, auth, notifier.configuration.From, notifier.configuration.To, message)
+	if err != nil {
+		return fmt.Errorf("Error sending email through %s: %w", addr, err)
+	}
+
+	return nil
+}
+
+// message renders the email (headers and body) describing the given failure event
+func (notifier *EmailNotifier) message(event RunEvent, logLines []string, logsErr error) []byte {
+	var buffer bytes.Buffer
+
+	fmt.Fprintf(&buffer, "From: %s\r\n", notifier.configuration.From)
+	fmt.Fprintf(&buffer, "To: %s\r\n", strings.Join(notifier.configuration.To, ", "))
+	fmt.Fprintf(&buffer, "Subject: [shnorky] Run %s of flow %s failed\r\n", event.Run.ID, event.Run.FlowID)
+	fmt.Fprintf(&buffer, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buffer.WriteString("Content-Type: text/plain; charset=UTF-8\r\n")
+	buffer.WriteString("\r\n")
+
+	fmt.Fprintf(&buffer, "Flow: %s\r\n", event.Run.FlowID)
+	fmt.Fprintf(&buffer, "Run: %s\r\n", event.Run.ID)
+	fmt.Fprintf(&buffer, "Started at: %s\r\n", event.Run.CreatedAt.Format(time.RFC3339))
+	fmt.Fprintf(&buffer, "Duration: %s\r\n", runDuration(event.Run))
+	if event.FailedStep != "" {
+		fmt.Fprintf(&buffer, "Failing step: %s (execution: %s)\r\n", event.FailedStep, event.FailedExecutionID)
+	}
+	if event.Error != "" {
+		fmt.Fprintf(&buffer, "Error: %s\r\n", event.Error)
+	}
+
+	if logsErr != nil {
+		fmt.Fprintf(&buffer, "\r\nCould not retrieve logs for the failing step: %s\r\n", logsErr.Error())
+	} else if len(logLines) > 0 {
+		fmt.Fprintf(&buffer, "\r\nLast %d log lines from step %s:\r\n\r\n", len(logLines), event.FailedStep)
+		for _, line := range logLines {
+			fmt.Fprintf(&buffer, "%s\r\n", line)
+		}
+	}
+
+	fmt.Fprintf(&buffer, "\r\nRun `shn flows report --run %s` for more details.\r\n", event.Run.ID)
+
+	return buffer.Bytes()
+}
+
+// failedExecution returns the step and the execution of the first step (in the given executions)
+// which finished with a non-zero exit code. If there is no such step, it returns the first step
+// which has not finished. If all steps finished successfully, ok is false.
+func failedExecution(executions map[string]components.ExecutionMetadata) (step string, execution components.ExecutionMetadata, ok bool) {
+	var unfinishedStep string
+	var unfinishedExecution components.ExecutionMetadata
+	for candidate, candidateExecution := range executions {
+		if candidateExecution.ExitCode == nil {
+			if unfinishedStep == "" || candidate < unfinishedStep {
+				unfinishedStep, unfinishedExecution = candidate, candidateExecution
+			}
+			continue
+		}
+		if *candidateExecution.ExitCode != 0 && (!ok || candidate < step) {
+			step, execution, ok = candidate, candidateExecution, true
+		}
+	}
+	if ok {
+		return step, execution, ok
+	}
+	if unfinishedStep != "" {
+		return unfinishedStep, unfinishedExecution, true
+	}
+	return "", components.ExecutionMetadata{}, false
+}
@@ -0,0 +1,98 @@
+package flows
+
+import (
+	"context"
+	"net/smtp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// TestEmailNotifier checks that the email notifier only sends emails for failed runs, and that the
+// emails it sends describe the failure
+func TestEmailNotifier(t *testing.T) {
+	notifier, err := NewEmailNotifier(
+		state.SMTPConfiguration{Host: "smtp.example.com", Port: 25, From: "shn@example.com", To: []string{"a@example.com", "b@example.com"}},
+		nil,
+	)
+	if err != nil {
+		t.Fatalf("Could not create email notifier: %s", err.Error())
+	}
+
+	type sentMail struct {
+		addr string
+		from string
+		to   []string
+		msg  string
+	}
+	sent := []sentMail{}
+	notifier.send = func(addr string, auth smtp.Auth, from string, to []string, msg []byte) error {
+		sent = append(sent, sentMail{addr: addr, from: from, to: to, msg: string(msg)})
+		return nil
+	}
+
+	start := time.Unix(time.Now().Unix()-100, 0)
+	finishedAt := start.Add(30 * time.Second)
+	run := FlowRunMetadata{ID: "run", FlowID: "flow", Status: RunStatusFailed, CreatedAt: start, FinishedAt: &finishedAt}
+
+	ctx := context.Background()
+	for _, eventType := range []string{RunEventStarted, RunEventSucceeded} {
+		err := notifier.Notify(ctx, RunEvent{Type: eventType, Run: run})
+		if err != nil {
+			t.Fatalf("Unexpected error notifying of %s event: %s", eventType, err.Error())
+		}
+	}
+	if len(sent) != 0 {
+		t.Fatalf("Expected no emails for non-failure events, but %d were sent", len(sent))
+	}
+
+	err = notifier.Notify(ctx, RunEvent{Type: RunEventFailed, Run: run, Error: "step exploded", FailedStep: "second", FailedExecutionID: "execution"})
+	if err != nil {
+		t.Fatalf("Unexpected error notifying of failure: %s", err.Error())
+	}
+	if len(sent) != 1 {
+		t.Fatalf("Expected exactly one email, but %d were sent", len(sent))
+	}
+
+	if sent[0].addr != "smtp.example.com:25" {
+		t.Errorf("Unexpected SMTP address: %s", sent[0].addr)
+	}
+	if sent[0].from != "shn@example.com" || len(sent[0].to) != 2 {
+		t.Errorf("Unexpected sender or recipients: from=%s, to=%v", sent[0].from, sent[0].to)
+	}
+	for _, fragment := range []string{"Subject: [shnorky] Run run of flow flow failed", "Failing step: second (execution: execution)", "Error: step exploded", "Duration: 30s"} {
+		if !strings.Contains(sent[0].msg, fragment) {
+			t.Errorf("Expected email to contain %q:\n%s", fragment, sent[0].msg)
+		}
+	}
+}
+
+func TestFailedExecution(t *testing.T) {
+	zero := 0
+	one := 1
+	executions := map[string]components.ExecutionMetadata{
+		"a": {ID: "execution-a", ExitCode: &zero},
+		"b": {ID: "execution-b"},
+		"c": {ID: "execution-c", ExitCode: &one},
+	}
+
+	step, execution, ok := failedExecution(executions)
+	if !ok || step != "c" || execution.ID != "execution-c" {
+		t.Errorf("Expected step c to be reported as failed: step=%s, execution=%s, ok=%t", step, execution.ID, ok)
+	}
+
+	delete(executions, "c")
+	step, _, ok = failedExecution(executions)
+	if !ok || step != "b" {
+		t.Errorf("Expected unfinished step b to be reported as failed: step=%s, ok=%t", step, ok)
+	}
+
+	delete(executions, "b")
+	_, _, ok = failedExecution(executions)
+	if ok {
+		t.Error("Expected no failed step when all steps succeeded")
+	}
+}
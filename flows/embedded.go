@@ -0,0 +1,184 @@
+package flows
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// EmbeddedComponentPrefix prefixes the IDs under which the components embedded in flow
+// specifications are registered: the component embedded as <name> in the specification of the flow
+// <flow> is registered as "embedded:<flow>/<name>" (see EmbeddedComponentID)
+var EmbeddedComponentPrefix = "embedded:"
+
+// EmbeddedDockerfileName is the name of the Dockerfile written for embedded components which
+// specify their Dockerfile inline
+var EmbeddedDockerfileName = "Dockerfile"
+
+// EmbeddedComponentSpecification - a component which is defined inline in a flow specification
+// rather than registered separately. Steps refer to an embedded component by its name (its key
+// under "components" in the flow specification). Embedded components are registered and built
+// automatically when the flow is first built or executed, and rebuilt whenever their definitions
+// change.
+type EmbeddedComponentSpecification struct {
+	// ComponentType is the type of the component (task if empty)
+	ComponentType string `json:"component_type,omitempty"`
+	// Path is the directory containing the implementation of the component. Relative paths are
+	// resolved against the directory containing the flow specification file.
+	Path string `json:"path,omitempty"`
+	// Dockerfile holds the contents of the Dockerfile for components which do not need any other
+	// files to build. Exactly one of Path and Dockerfile must be specified.
+	Dockerfile string `json:"dockerfile,omitempty"`
+	// Specification is the component specification. Its values are materialized when the
+	// component is executed, as for registered components.
+	Specification components.ComponentSpecification `json:"specification"`
+}
+
+// EmbeddedComponentID returns the ID under which the component embedded with the given name in the
+// specification of the flow with the given ID is registered
+func EmbeddedComponentID(flowID, name string) string {
+	return EmbeddedComponentPrefix + flowID + "/" + name
+}
+
+// IsEmbeddedComponent returns true if the given component ID refers to a component embedded in a
+// flow specification
+func IsEmbeddedComponent(componentID string) bool {
+	return strings.HasPrefix(componentID, EmbeddedComponentPrefix)
+}
+
+// MaterializeEmbeddedComponentSpecification validates the embedded component with the given name
+// and applies defaults to it
+func MaterializeEmbeddedComponentSpecification(name string, rawSpecification EmbeddedComponentSpecification) (EmbeddedComponentSpecification, error) {
+	if name == "" || strings.ContainsAny(name, "/:") {
+		return rawSpecification, fmt.Errorf("Invalid name (must be non-empty and may not contain \"/\" or \":\"): %s", name)
+	}
+
+	materializedSpecification := rawSpecification
+	if materializedSpecification.ComponentType == "" {
+		materializedSpecification.ComponentType = components.Task
+	}
+	if _, ok := components.ComponentTypes[materializedSpecification.ComponentType]; !ok {
+		return rawSpecification, fmt.Errorf("Invalid component type: %s", rawSpecification.ComponentType)
+	}
+
+	if (rawSpecification.Path == "") == (rawSpecification.Dockerfile == "") {
+		return rawSpecification, fmt.Errorf("Exactly one of path and dockerfile must be specified")
+	}
+	if rawSpecification.Dockerfile != "" {
+		if !reflect.DeepEqual(rawSpecification.Specification.Build, components.BuildSpecification{}) {
+			return rawSpecification, fmt.Errorf("Components with inline Dockerfiles may not specify how they are built")
+		}
+		materializedSpecification.Specification.Build = components.BuildSpecification{Dockerfile: EmbeddedDockerfileName}
+	}
+	return materializedSpecification, nil
+}
+
+// ResolveEmbeddedComponents returns a copy of the given specification of the flow with the given ID
+// in which each step that refers to an embedded component refers to the ID under which that
+// component is registered instead (see EmbeddedComponentID)
+func ResolveEmbeddedComponents(flowID string, specification FlowSpecification) FlowSpecification {
+	if len(specification.Components) == 0 {
+		return specification
+	}
+	resolvedSteps := map[string]string{}
+	for step, component := range specification.Steps {
+		if _, ok := specification.Components[component]; ok {
+			component = EmbeddedComponentID(flowID, component)
+		}
+		resolvedSteps[step] = component
+	}
+	specification.Steps = resolvedSteps
+	return specification
+}
+
+// RegisterEmbeddedComponents registers the components embedded in the given specification of the
+// given flow against the given state database, writing their specifications (and inline
+// Dockerfiles) into directories under embeddedDir. Components which are already registered are
+// updated to match the specification. It returns the specification with its steps resolved (see
+// ResolveEmbeddedComponents), along with the IDs of the components which were registered or
+// updated and so need to be built.
+func RegisterEmbeddedComponents(store state.Store, embeddedDir string, flow FlowMetadata, specification FlowSpecification) (FlowSpecification, []string, error) {
+	names := make([]string, 0, len(specification.Components))
+	for name := range specification.Components {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	changed := []string{}
+	for _, name := range names {
+		embeddedComponent := specification.Components[name]
+		componentID := EmbeddedComponentID(flow.ID, name)
+		embeddedComponentDir := filepath.Join(embeddedDir, flow.ID, name)
+		err := os.MkdirAll(embeddedComponentDir, 0755)
+		if err != nil {
+			return specification, changed, fmt.Errorf("Could not create directory for embedded component (%s): %w", componentID, err)
+		}
+
+		componentPath := embeddedComponentDir
+		modified := false
+		if embeddedComponent.Dockerfile != "" {
+			modified, err = writeIfModified(filepath.Join(embeddedComponentDir, EmbeddedDockerfileName), []byte(embeddedComponent.Dockerfile))
+			if err != nil {
+				return specification, changed, fmt.Errorf("Could not write Dockerfile for embedded component (%s): %w", componentID, err)
+			}
+		} else {
+			componentPath = embeddedComponent.Path
+			if !filepath.IsAbs(componentPath) {
+				componentPath = filepath.Join(filepath.Dir(flow.SpecificationPath), componentPath)
+			}
+		}
+
+		specificationBytes, err := json.MarshalIndent(embeddedComponent.Specification, "", "    ")
+		if err != nil {
+			return specification, changed, err
+		}
+		specificationPath := filepath.Join(embeddedComponentDir, components.DefaultSpecificationFileName)
+		specificationModified, err := writeIfModified(specificationPath, specificationBytes)
+		if err != nil {
+			return specification, changed, fmt.Errorf("Could not write specification for embedded component (%s): %w", componentID, err)
+		}
+		modified = modified || specificationModified
+
+		registered, err := components.SelectComponentByID(store, componentID)
+		if err == nil && registered.ComponentPath == componentPath && registered.ComponentType == embeddedComponent.ComponentType {
+			if modified {
+				changed = append(changed, componentID)
+			}
+			continue
+		} else if err == nil {
+			err = components.DeleteComponentByID(store, componentID)
+		} else if err == components.ErrComponentNotFound {
+			err = nil
+		}
+		if err != nil {
+			return specification, changed, err
+		}
+
+		_, err = components.AddComponent(store, componentID, embeddedComponent.ComponentType, componentPath, specificationPath)
+		if err != nil {
+			return specification, changed, fmt.Errorf("Could not register embedded component (%s): %w", componentID, err)
+		}
+		changed = append(changed, componentID)
+	}
+
+	return ResolveEmbeddedComponents(flow.ID, specification), changed, nil
+}
+
+// writeIfModified writes the given contents to the file at the given path unless it already has
+// those contents, and returns true if it wrote the file
+func writeIfModified(filePath string, contents []byte) (bool, error) {
+	current, err := ioutil.ReadFile(filePath)
+	if err == nil && bytes.Equal(current, contents) {
+		return false, nil
+	}
+	return true, ioutil.WriteFile(filePath, contents, 0644)
+}
@@ -0,0 +1,170 @@
+package flows
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestMaterializeEmbeddedComponentSpecification(t *testing.T) {
+	type embeddedTest struct {
+		name          string
+		raw           EmbeddedComponentSpecification
+		expectedType  string
+		expectedBuild components.BuildSpecification
+		returnsError  bool
+	}
+
+	tests := []embeddedTest{
+		{
+			name:          "appender",
+			raw:           EmbeddedComponentSpecification{Dockerfile: "FROM alpine:3.11.2\n"},
+			expectedType:  components.Task,
+			expectedBuild: components.BuildSpecification{Dockerfile: EmbeddedDockerfileName},
+		},
+		{
+			name: "server",
+			raw: EmbeddedComponentSpecification{
+				ComponentType: components.Service,
+				Path:          "server",
+				Specification: components.ComponentSpecification{Build: components.BuildSpecification{Context: "src", Dockerfile: "Dockerfile.server"}},
+			},
+			expectedType:  components.Service,
+			expectedBuild: components.BuildSpecification{Context: "src", Dockerfile: "Dockerfile.server"},
+		},
+		{name: "appender", raw: EmbeddedComponentSpecification{}, returnsError: true},
+		{name: "appender", raw: EmbeddedComponentSpecification{Path: "appender", Dockerfile: "FROM alpine:3.11.2\n"}, returnsError: true},
+		{name: "appender", raw: EmbeddedComponentSpecification{ComponentType: "cron", Path: "appender"}, returnsError: true},
+		{
+			name: "appender",
+			raw: EmbeddedComponentSpecification{
+				Dockerfile:    "FROM alpine:3.11.2\n",
+				Specification: components.ComponentSpecification{Build: components.BuildSpecification{Dockerfile: "Dockerfile.other"}},
+			},
+			returnsError: true,
+		},
+		{name: "", raw: EmbeddedComponentSpecification{Path: "appender"}, returnsError: true},
+		{name: "nested/appender", raw: EmbeddedComponentSpecification{Path: "appender"}, returnsError: true},
+		{name: "builtin:notify", raw: EmbeddedComponentSpecification{Path: "appender"}, returnsError: true},
+	}
+
+	for i, test := range tests {
+		materialized, err := MaterializeEmbeddedComponentSpecification(test.name, test.raw)
+		if test.returnsError {
+			if err == nil {
+				t.Errorf("[Test %d] Expected error but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[Test %d] Unexpected error: %s", i, err.Error())
+			continue
+		}
+		if materialized.ComponentType != test.expectedType {
+			t.Errorf("[Test %d] Unexpected component type: expected=%s, actual=%s", i, test.expectedType, materialized.ComponentType)
+		}
+		if !reflect.DeepEqual(materialized.Specification.Build, test.expectedBuild) {
+			t.Errorf("[Test %d] Unexpected build specification: expected=%v, actual=%v", i, test.expectedBuild, materialized.Specification.Build)
+		}
+	}
+}
+
+func TestRegisterEmbeddedComponents(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-embedded-components-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	specificationPath, err := filepath.Abs("../examples/flows/single-file.json")
+	if err != nil {
+		t.Fatalf("Could not resolve path of example flow: %s", err.Error())
+	}
+	flow, err := AddFlow(store, "single-file", specificationPath)
+	if err != nil {
+		t.Fatalf("Error adding flow: %s", err.Error())
+	}
+	specification, err := ReadSpecificationFile(flow.SpecificationPath)
+	if err != nil {
+		t.Fatalf("Error reading flow specification: %s", err.Error())
+	}
+
+	embeddedDir := path.Join(stateDir, state.EmbeddedDirName)
+	componentID := EmbeddedComponentID("single-file", "appender")
+
+	resolved, changed, err := RegisterEmbeddedComponents(store, embeddedDir, flow, specification)
+	if err != nil {
+		t.Fatalf("Error registering embedded components: %s", err.Error())
+	}
+	if !reflect.DeepEqual(changed, []string{componentID}) {
+		t.Errorf("Unexpected changed components on first registration: expected=%v, actual=%v", []string{componentID}, changed)
+	}
+	expectedSteps := map[string]string{"first": componentID, "second": componentID}
+	if !reflect.DeepEqual(resolved.Steps, expectedSteps) {
+		t.Errorf("Unexpected steps: expected=%v, actual=%v", expectedSteps, resolved.Steps)
+	}
+
+	component, err := components.SelectComponentByID(store, componentID)
+	if err != nil {
+		t.Fatalf("Error selecting embedded component: %s", err.Error())
+	}
+	dockerfile, err := ioutil.ReadFile(filepath.Join(component.ComponentPath, EmbeddedDockerfileName))
+	if err != nil || string(dockerfile) != specification.Components["appender"].Dockerfile {
+		t.Errorf("Unexpected Dockerfile for embedded component: %q (error: %v)", string(dockerfile), err)
+	}
+	componentSpecification, err := components.ReadComponentSpecification(store, componentID)
+	if err != nil {
+		t.Fatalf("Error reading embedded component specification: %s", err.Error())
+	}
+	if len(componentSpecification.Run.Mountpoints) != 2 {
+		t.Errorf("Unexpected number of mountpoints: expected=%d, actual=%d", 2, len(componentSpecification.Run.Mountpoints))
+	}
+
+	_, changed, err = RegisterEmbeddedComponents(store, embeddedDir, flow, specification)
+	if err != nil {
+		t.Fatalf("Error registering embedded components again: %s", err.Error())
+	}
+	if len(changed) != 0 {
+		t.Errorf("Unexpected changed components on unchanged registration: %v", changed)
+	}
+
+	modifiedComponent := specification.Components["appender"]
+	modifiedComponent.Dockerfile += "LABEL modified=true\n"
+	specification.Components = map[string]EmbeddedComponentSpecification{"appender": modifiedComponent}
+	_, changed, err = RegisterEmbeddedComponents(store, embeddedDir, flow, specification)
+	if err != nil {
+		t.Fatalf("Error registering modified embedded components: %s", err.Error())
+	}
+	if !reflect.DeepEqual(changed, []string{componentID}) {
+		t.Errorf("Unexpected changed components on modified registration: expected=%v, actual=%v", []string{componentID}, changed)
+	}
+
+	readSpecification, err := ReadFlowSpecification(store, "single-file")
+	if err != nil {
+		t.Fatalf("Error reading registered flow specification: %s", err.Error())
+	}
+	if !reflect.DeepEqual(readSpecification.Steps, expectedSteps) {
+		t.Errorf("Unexpected steps from ReadFlowSpecification: expected=%v, actual=%v", expectedSteps, readSpecification.Steps)
+	}
+}
@@ -2,17 +2,26 @@ package flows
 
 import (
 	"context"
-	"database/sql"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	docker "github.com/docker/docker/client"
+	"github.com/sirupsen/logrus"
 
 	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/staging"
+	"github.com/simiotics/shnorky/state"
+	"github.com/simiotics/shnorky/tracing"
 )
 
 // ErrEmptyID signifies that a caller attempted to create component metadata in which the ID string
@@ -28,6 +37,15 @@ type FlowMetadata struct {
 	ID                string    `json:"id"`
 	SpecificationPath string    `json:"specification_path"`
 	CreatedAt         time.Time `json:"created_at"`
+	CreatedBy         string    `json:"created_by"`
+	// SpecificationChecksum is the hex-encoded SHA256 digest of the specification file when the
+	// flow was registered by AddFlow
+	SpecificationChecksum string `json:"specification_checksum,omitempty"`
+	// SpecificationSnapshot is the specification document (see ReadSpecificationDocument) when the
+	// flow was registered by AddFlow. It is used by DiffFlowSpecification.
+	SpecificationSnapshot string `json:"-"`
+	// Labels are only populated by ListFlows
+	Labels map[string]string `json:"labels,omitempty"`
 }
 
 // GenerateFlowMetadata creates a FlowMetadata instance from the specified parameters, applying
@@ -43,141 +61,1064 @@ func GenerateFlowMetadata(id, specificationPath string) (FlowMetadata, error) {
 
 	createdAt := time.Now()
 
-	metadata := FlowMetadata{ID: id, SpecificationPath: specificationPath, CreatedAt: createdAt}
+	metadata := FlowMetadata{ID: id, SpecificationPath: specificationPath, CreatedAt: createdAt, CreatedBy: state.CurrentUser()}
 
 	return metadata, nil
 }
 
 // AddFlow registers a flow (by metadata) against a shnorky state database. It validates the
-// specification at the given path first.
+// specification at the given path first, including the mounts of each step against the
+// mountpoints of the step's component (so the components must already be registered). The flow,
+// the components used by its steps, and the checksum and snapshot of its specification are stored
+// in a single transaction, so a failed registration does not leave a partially registered flow
+// behind.
 // This is the handler for `shnorky flows add`
-func AddFlow(db *sql.DB, id, specificationPath string) (FlowMetadata, error) {
-	absoluteSpecificationPath, err := filepath.Abs(specificationPath)
+func AddFlow(store state.Store, id, specificationPath string) (FlowMetadata, error) {
+	absoluteSpecificationPath, specification, checksum, err := validateFlowSpecification(store, specificationPath)
 	if err != nil {
 		return FlowMetadata{}, err
 	}
 
-	specFile, err := os.Open(absoluteSpecificationPath)
+	metadata, err := GenerateFlowMetadata(id, absoluteSpecificationPath)
 	if err != nil {
-		return FlowMetadata{}, fmt.Errorf("Error opening specification file (%s): %s", absoluteSpecificationPath, err.Error())
+		return metadata, err
 	}
-	_, err = ReadSingleSpecification(specFile)
+	metadata.SpecificationChecksum = checksum
+	snapshot, err := ReadSpecificationDocument(absoluteSpecificationPath)
 	if err != nil {
-		return FlowMetadata{}, fmt.Errorf("Error reading specification (%s): %s", absoluteSpecificationPath, err.Error())
+		return metadata, err
 	}
+	metadata.SpecificationSnapshot = string(snapshot)
 
-	metadata, err := GenerateFlowMetadata(id, absoluteSpecificationPath)
+	err = RegisterFlow(store, metadata, specification.Steps)
+
+	return metadata, err
+}
+
+// UpdateFlow points the registered flow with the given ID at the specification at the given path
+// (which is validated as it is by AddFlow), and records the components used by its steps and the
+// checksum and snapshot of the specification afresh. If no flow with the given ID is registered,
+// returns ErrFlowNotFound.
+func UpdateFlow(store state.Store, id, specificationPath string) (FlowMetadata, error) {
+	metadata, err := SelectFlowByID(store, id)
 	if err != nil {
 		return metadata, err
 	}
+	absoluteSpecificationPath, specification, checksum, err := validateFlowSpecification(store, specificationPath)
+	if err != nil {
+		return metadata, err
+	}
+	metadata.SpecificationPath = absoluteSpecificationPath
+	metadata.SpecificationChecksum = checksum
+	snapshot, err := ReadSpecificationDocument(absoluteSpecificationPath)
+	if err != nil {
+		return metadata, err
+	}
+	metadata.SpecificationSnapshot = string(snapshot)
 
-	err = InsertFlow(db, metadata)
+	err = updateFlow(store, metadata, specification.Steps)
 
 	return metadata, err
 }
 
-// Build - Builds images for each component of a given flow
-func Build(ctx context.Context, db *sql.DB, dockerClient *docker.Client, outstream io.Writer, flowID string) (map[string]components.BuildMetadata, error) {
-	flow, err := SelectFlowByID(db, flowID)
+// validateFlowSpecification reads and validates the flow specification at the given path for
+// registration, and returns its absolute path, the specification (with its component selectors
+// resolved), and its checksum
+func validateFlowSpecification(store state.Store, specificationPath string) (string, FlowSpecification, string, error) {
+	absoluteSpecificationPath, err := filepath.Abs(specificationPath)
 	if err != nil {
-		return map[string]components.BuildMetadata{}, err
+		return "", FlowSpecification{}, "", err
 	}
 
-	specFile, err := os.Open(flow.SpecificationPath)
+	specification, err := ReadSpecificationFile(absoluteSpecificationPath)
+	if err != nil {
+		return "", specification, "", fmt.Errorf("Error reading specification (%s): %w", absoluteSpecificationPath, err)
+	}
+	checksum, err := SpecificationChecksum(absoluteSpecificationPath)
+	if err != nil {
+		return "", specification, "", fmt.Errorf("Error computing checksum of specification (%s): %w", absoluteSpecificationPath, err)
+	}
+	specification, err = ResolveComponentSelectors(store, specification)
+	if err != nil {
+		return "", specification, "", fmt.Errorf("Invalid steps in specification (%s): %w", absoluteSpecificationPath, err)
+	}
+	err = ValidateMounts(store, specification)
+	if err != nil {
+		return "", specification, "", fmt.Errorf("Invalid mounts in specification (%s): %w", absoluteSpecificationPath, err)
+	}
+
+	return absoluteSpecificationPath, specification, checksum, nil
+}
+
+// SpecificationChecksum returns the hex-encoded SHA256 digest of the contents of the flow
+// specification file at the given path
+func SpecificationChecksum(specificationPath string) (string, error) {
+	contents, err := ioutil.ReadFile(specificationPath)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256(contents)
+	return hex.EncodeToString(digest[:]), nil
+}
+
+// ValidateMounts checks the mounts of each step in the given flow specification against the
+// mountpoints declared by the specification of the step's component (which may be embedded in the
+// flow specification)
+func ValidateMounts(store state.Store, specification FlowSpecification) error {
+	steps := make([]string, 0, len(specification.Steps))
+	for step := range specification.Steps {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+
+	for _, step := range steps {
+		componentID := specification.Steps[step]
+		if isHostStep(componentID) {
+			continue
+		}
+		var componentSpecification components.ComponentSpecification
+		var err error
+		if embeddedComponent, ok := specification.Components[componentID]; ok {
+			componentSpecification = embeddedComponent.Specification
+		} else {
+			componentSpecification, err = components.ReadComponentSpecification(store, componentID)
+		}
+		if err != nil {
+			return fmt.Errorf("Could not read specification for component (%s) of step (%s): %w", componentID, step, err)
+		}
+		mounts := specification.Mounts[step]
+		if partitionedStep, _, ok := shardOfStep(specification, step); ok && specification.Partitions[partitionedStep].Target != "" {
+			// The shard is mounted at the target of the partition when the step starts
+			mounts = append(append([]components.MountConfiguration{}, mounts...), components.MountConfiguration{Target: specification.Partitions[partitionedStep].Target, Method: "bind"})
+		}
+		err = components.ValidateMounts(componentSpecification, mounts)
+		if err != nil {
+			return fmt.Errorf("Step (%s) using component (%s): %w", step, componentID, err)
+		}
+	}
+	return nil
+}
+
+// Build - Builds images for each component of a given flow (including components used as hooks).
+// Built-in components and components embedded in the flow specification are registered (with their
+// implementations written under the given state directory) before they are built. Every image is
+// built with the given options, except that components are also built for each of the targets that
+// steps select (see FlowSpecification.Targets). The builds are keyed by component ID, followed by
+// "@<target>" for the builds of targets selected by steps.
+func Build(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, stateDir, flowID string, options components.BuildOptions) (map[string]components.BuildMetadata, error) {
+	ctx = components.WithLogFields(ctx, logrus.Fields{components.LogFieldFlowID: flowID})
+	flow, err := SelectFlowByID(store, flowID)
 	if err != nil {
 		return map[string]components.BuildMetadata{}, err
 	}
 
-	specification, err := ReadSingleSpecification(specFile)
+	specification, err := ReadRegisteredSpecification(flow)
+	if err != nil {
+		return map[string]components.BuildMetadata{}, err
+	}
+	specification, err = ResolveComponentSelectors(store, specification)
+	if err != nil {
+		return map[string]components.BuildMetadata{}, err
+	}
+	specification, _, err = RegisterEmbeddedComponents(store, filepath.Join(stateDir, state.EmbeddedDirName), flow, specification)
 	if err != nil {
 		return map[string]components.BuildMetadata{}, err
 	}
 
 	componentBuilds := map[string]components.BuildMetadata{}
 
-	for _, component := range specification.Steps {
-		_, ok := componentBuilds[component]
-		if ok {
+	// targets maps the components to build to the targets they are built for ("" standing for the
+	// target of the given options)
+	targets := map[string][]string{}
+	for step, component := range specification.Steps {
+		if isHostStep(component) {
 			continue
 		}
+		targets[component] = append(targets[component], specification.Targets[step])
+	}
+	for _, component := range HookComponents(specification) {
+		targets[component] = append(targets[component], "")
+	}
 
-		buildMetadata, err := components.CreateBuild(ctx, db, dockerClient, outstream, component)
-		if err != nil {
-			return componentBuilds, err
+	for component, componentTargets := range targets {
+		if components.IsBuiltinComponent(component) {
+			_, err = components.EnsureBuiltinComponent(store, filepath.Join(stateDir, state.BuiltinDirName), component)
+			if err != nil {
+				return componentBuilds, err
+			}
 		}
 
-		componentBuilds[component] = buildMetadata
+		for _, target := range componentTargets {
+			key := component
+			targetOptions := options
+			if target != "" {
+				key = component + "@" + target
+				targetOptions.Target = target
+			}
+			if _, ok := componentBuilds[key]; ok {
+				continue
+			}
+
+			buildMetadata, err := components.CreateBuild(ctx, store, dockerClient, outstream, filepath.Join(stateDir, state.BuildLogsDirName), component, targetOptions)
+			if err != nil {
+				return componentBuilds, err
+			}
+
+			componentBuilds[key] = buildMetadata
+		}
 	}
 
 	return componentBuilds, nil
 }
 
+// buildableComponents returns the IDs of the components which the steps and hooks of the given
+// specification run (excluding host steps and built-in components), in lexicographic order
+func buildableComponents(specification FlowSpecification) []string {
+	componentIDs := make([]string, 0, len(specification.Steps))
+	for _, componentID := range specification.Steps {
+		componentIDs = append(componentIDs, componentID)
+	}
+	componentIDs = append(componentIDs, HookComponents(specification)...)
+	sort.Strings(componentIDs)
+
+	buildable := make([]string, 0, len(componentIDs))
+	for i, componentID := range componentIDs {
+		if (i > 0 && componentIDs[i-1] == componentID) || isHostStep(componentID) || components.IsBuiltinComponent(componentID) {
+			continue
+		}
+		buildable = append(buildable, componentID)
+	}
+	return buildable
+}
+
+// StaleComponents returns the IDs of the components of the flow with the given ID (including
+// components used as hooks) whose builds are stale (see components.BuildIsStale), in lexicographic
+// order. Embedded components are not checked, since ExecuteRun builds them whenever they change.
+func StaleComponents(store state.Store, flowID string) ([]string, error) {
+	specification, err := ReadFlowSpecification(store, flowID)
+	if err != nil {
+		return []string{}, err
+	}
+	componentIDs := []string{}
+	for _, componentID := range buildableComponents(specification) {
+		if !IsEmbeddedComponent(componentID) {
+			componentIDs = append(componentIDs, componentID)
+		}
+	}
+	return components.StaleComponents(store, componentIDs)
+}
+
+// BuildStaleComponents builds each of the components of the flow with the given ID whose build is
+// stale (see StaleComponents) and returns the new builds, keyed by component ID.
+func BuildStaleComponents(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, stateDir, flowID string) (map[string]components.BuildMetadata, error) {
+	componentBuilds := map[string]components.BuildMetadata{}
+	staleComponents, err := StaleComponents(store, flowID)
+	if err != nil {
+		return componentBuilds, err
+	}
+	for _, componentID := range staleComponents {
+		buildMetadata, err := components.CreateBuild(ctx, store, dockerClient, outstream, filepath.Join(stateDir, state.BuildLogsDirName), componentID, components.BuildOptions{})
+		if err != nil {
+			return componentBuilds, fmt.Errorf("Error building component (%s): %w", componentID, err)
+		}
+		componentBuilds[componentID] = buildMetadata
+	}
+	return componentBuilds, nil
+}
+
 // Execute - Executes the given builds of each step in a workflow in an order which respects the
-// dependencies between steps
+// dependencies between steps. Each call to Execute is recorded in the state database as a flow run,
+// which is returned along with the executions for each step. Artifacts produced by the steps are
+// stored under the given state directory. If outstream is not nil, progress through the run (with
+// an estimate of the remaining time based on previous runs of the flow) is written to it. The
+// notifiers configured in the flow specification are told when the run starts and how it ends. If
+// the state directory configures SMTP, an email is also sent if the run fails. Each run gets a
+// scratch directory under the state directory which is mounted into its steps and cleaned up
+// according to the retention policy in the state configuration. Execute fails without starting a
+// run if any of the inputs declared in the flow specification are missing, and the run fails if any
+// of the declared outputs are missing at the end.
+//
+// If the state configuration limits the number of concurrent runs and that many runs are already in
+// progress, the run is queued and starts once it reaches the head of the queue (see QueuedRuns).
+// The run gets the priority from the flow specification.
+//
+// Execute fails without starting a run if the flow already has as many unfinished runs as its
+// specification allows (see FlowSpecification.MaxConcurrentRuns), unless the context was created by
+// WithQuotaWait, in which case the run waits for one of them to finish.
+//
+// Concurrent runs of the same flow are isolated from each other: each run gets its own docker
+// network (on which its containers can reach each other by step name) and its own scratch
+// directory, and the run fails before any of its steps start if its network, scratch directory,
+// or declared outputs are used by another unfinished run (see ClaimRunResources).
 func Execute(
 	ctx context.Context,
-	db *sql.DB,
+	store state.Store,
 	dockerClient *docker.Client,
+	outstream io.Writer,
+	stateDir string,
 	flowID string,
-) (map[string]components.ExecutionMetadata, error) {
-	flow, err := SelectFlowByID(db, flowID)
+) (FlowRunMetadata, map[string]components.ExecutionMetadata, error) {
+	run, err := GenerateFlowRunMetadata(flowID)
 	if err != nil {
-		return map[string]components.ExecutionMetadata{}, err
+		return run, map[string]components.ExecutionMetadata{}, err
 	}
+	return ExecuteRun(ctx, store, dockerClient, outstream, stateDir, run)
+}
+
+// ExecuteRun executes the given (fresh) run of a flow in the same way as Execute. If the run has a
+// priority of 0, it gets the priority from the flow specification instead.
+func ExecuteRun(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	outstream io.Writer,
+	stateDir string,
+	run FlowRunMetadata,
+) (FlowRunMetadata, map[string]components.ExecutionMetadata, error) {
+	return executeRun(ctx, store, dockerClient, outstream, stateDir, run, false)
+}
+
+// executeRun implements ExecuteRun. If claimed is true, the run has already been recorded in the
+// state database and started (e.g. by a worker which claimed a submitted run), so it is neither
+// inserted nor queued. The run is traced (see the tracing package) as a "flow_run" span, with a
+// "stage" span for each of its stages and a "step" span for each of its steps.
+func executeRun(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	outstream io.Writer,
+	stateDir string,
+	run FlowRunMetadata,
+	claimed bool,
+) (FlowRunMetadata, map[string]components.ExecutionMetadata, error) {
+	ctx, span := tracing.Start(ctx, "flow_run", map[string]string{components.LogFieldFlowID: run.FlowID, components.LogFieldRunID: run.ID})
+	run, componentExecutions, err := performRun(ctx, store, dockerClient, outstream, stateDir, run, claimed)
+	span.SetAttribute("status", run.Status)
+	span.End(err)
+	return run, componentExecutions, err
+}
 
-	specFile, err := os.Open(flow.SpecificationPath)
+// performRun performs the flow run for executeRun, within the span of the run
+func performRun(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	outstream io.Writer,
+	stateDir string,
+	run FlowRunMetadata,
+	claimed bool,
+) (FlowRunMetadata, map[string]components.ExecutionMetadata, error) {
+	flowID := run.FlowID
+	ctx = components.WithLogFields(ctx, logrus.Fields{components.LogFieldFlowID: flowID, components.LogFieldRunID: run.ID})
+	if claimed {
+		defer keepRunAlive(store, run.ID)()
+	}
+	flow, err := SelectFlowByID(store, flowID)
 	if err != nil {
-		return map[string]components.ExecutionMetadata{}, err
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
 	}
 
-	specification, err := ReadSingleSpecification(specFile)
+	specification, err := ReadRegisteredSpecification(flow)
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+	specification, err = ResolveComponentSelectors(store, specification)
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+	if specification.DockerRetries != nil {
+		ctx = components.WithDockerRetryPolicy(ctx, specification.DockerRetries.Policy())
+	}
+	specification, changedComponents, err := RegisterEmbeddedComponents(store, filepath.Join(stateDir, state.EmbeddedDirName), flow, specification)
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+	specification, err = applyMountOverrides(ctx, specification)
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+	specification = applyPathSubstitutions(ctx, specification)
+	specification = applyParameters(ctx, specification)
+	specification, err = applyStepSelection(ctx, specification)
 	if err != nil {
-		return map[string]components.ExecutionMetadata{}, err
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+	for _, componentID := range changedComponents {
+		buildOutstream := outstream
+		if buildOutstream == nil {
+			buildOutstream = ioutil.Discard
+		}
+		_, err = components.CreateBuild(ctx, store, dockerClient, buildOutstream, filepath.Join(stateDir, state.BuildLogsDirName), componentID, components.BuildOptions{})
+		if err != nil {
+			return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, fmt.Errorf("Error building embedded component (%s): %w", componentID, err)
+		}
 	}
 
 	// buildIDs maps steps to build IDs
 	buildIDs := map[string]string{}
 	for step, componentID := range specification.Steps {
-		buildID, err := components.SelectMostRecentBuildForComponent(db, componentID)
+		if isHostStep(componentID) {
+			continue
+		}
+		buildID, err := mostRecentBuild(ctx, store, dockerClient, outstream, stateDir, componentID, specification.Targets[step])
 		if err != nil {
-			return map[string]components.ExecutionMetadata{}, err
+			return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
 		}
 		buildIDs[step] = buildID.ID
 	}
 
+	// hookBuildIDs maps components used as hooks to build IDs
+	hookBuildIDs := map[string]string{}
+	for _, componentID := range HookComponents(specification) {
+		buildID, err := mostRecentBuild(ctx, store, dockerClient, outstream, stateDir, componentID, "")
+		if err != nil {
+			return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, fmt.Errorf("Error retrieving build for hook component (%s): %w", componentID, err)
+		}
+		hookBuildIDs[componentID] = buildID.ID
+	}
+
 	stages, err := CalculateStages(specification)
 	if err != nil {
-		return map[string]components.ExecutionMetadata{}, err
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+
+	config, err := state.ReadConfig(stateDir)
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+	backends, err := staging.Backends(config.Staging)
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
 	}
+	var emailNotifier *EmailNotifier
+	if config.SMTP != nil {
+		emailNotifier, err = NewEmailNotifier(*config.SMTP, dockerClient)
+		if err != nil {
+			return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+		}
+	}
+
+	if run.Priority == 0 {
+		run.Priority = specification.Priority
+	}
+	err = ValidateInputs(specification, run)
+	if err != nil {
+		return run, map[string]components.ExecutionMetadata{}, err
+	}
+
+	_, err = PruneScratchDirs(store, stateDir, config.Scratch.MaxAge)
+	if err != nil && outstream != nil {
+		fmt.Fprintf(outstream, "Warning: could not prune old scratch directories: %s\n", err.Error())
+	}
+	scratchDir, err := CreateScratchDir(stateDir, run.ID)
+	if err != nil {
+		return run, map[string]components.ExecutionMetadata{}, err
+	}
+
+	if !claimed {
+		if config.Runs.MaxConcurrent > 0 {
+			run.Status = RunStatusQueued
+		}
+		err = insertRunWithinQuota(ctx, store, run, maxConcurrentRuns(specification), newProgressWriter(outstream, nil, nil))
+		if err != nil {
+			os.RemoveAll(scratchDir)
+			return run, map[string]components.ExecutionMetadata{}, err
+		}
+		defer keepRunAlive(store, run.ID)()
+		if run.Status == RunStatusQueued {
+			run, err = waitForTurn(ctx, store, run, config.Runs.MaxConcurrent, newProgressWriter(outstream, nil, nil))
+			if err != nil {
+				os.RemoveAll(scratchDir)
+				return run, map[string]components.ExecutionMetadata{}, err
+			}
+		}
+	}
+
+	notifiers := GenerateNotifiers(specification.Notifications)
+	if emailNotifier != nil {
+		notifiers = append(notifiers, emailNotifier)
+	}
+	notifyAll(ctx, notifiers, outstream, RunEvent{Type: RunEventStarted, Run: run})
+	components.Logger(ctx).Info("Started flow run")
+
+	artifactsDir := filepath.Join(stateDir, state.ArtifactsDirName)
+
+	statistics, err := StepDurationStatistics(store, flowID, DefaultStatisticsWindow)
+	if err != nil {
+		statistics = map[string]DurationStatistics{}
+	}
+	progress := newProgressWriter(outstream, statistics, stages)
+
+	hooks := &hookRunner{store: store, dockerClient: dockerClient, outstream: outstream, run: run, buildIDs: hookBuildIDs, scratchDir: scratchDir}
+	stager := staging.NewStager(backends)
 
 	componentExecutions := map[string]components.ExecutionMetadata{}
-	for _, stage := range stages {
+	hooks.network, err = isolateRun(ctx, store, dockerClient, run, specification, scratchDir)
+	if err == nil {
+		err = hooks.runHooks(ctx, specification.Hooks.Before, "before", map[string]string{})
+	}
+	if err == nil {
+		componentExecutions, err = executeStages(ctx, store, dockerClient, artifactsDir, scratchDir, run, specification, buildIDs, stages, progress, hooks, stager)
+	}
+	if err == nil {
+		err = VerifyOutputs(specification, run)
+	}
+
+	// A run which was cancelled (e.g. because shn was interrupted) still runs its after hooks, cleans
+	// up, and records that it failed
+	if ctx.Err() != nil {
+		ctx = detachedContext{ctx}
+	}
+
+	run.Status = RunStatusSucceeded
+	if err != nil {
+		run.Status = RunStatusFailed
+	} else if len(FailedSteps(componentExecutions)) > 0 {
+		run.Status = RunStatusSucceededWithWarnings
+	}
+
+	hooksErr := hooks.runHooks(ctx, specification.Hooks.After, "after", map[string]string{HookEnvRunStatus: run.Status})
+	if hooksErr != nil && err == nil {
+		err = hooksErr
+		run.Status = RunStatusFailed
+	}
+	if hooks.network != "" {
+		networkErr := dockerClient.NetworkRemove(ctx, hooks.network)
+		if networkErr != nil && outstream != nil {
+			fmt.Fprintf(outstream, "Warning: could not remove network (%s): %s\n", hooks.network, networkErr.Error())
+		}
+	}
+	scratchErr := CleanupScratchDir(config.Scratch, scratchDir, run.Status)
+	if scratchErr != nil && outstream != nil {
+		fmt.Fprintf(outstream, "Warning: could not clean up scratch directory (%s): %s\n", scratchDir, scratchErr.Error())
+	}
+
+	finishedAt := time.Now()
+	run.FinishedAt = &finishedAt
+	updateErr := UpdateFlowRunStatus(store, run)
+
+	event := RunEvent{Type: RunEventSucceeded, Run: run}
+	if err != nil {
+		event.Type = RunEventFailed
+		event.Error = err.Error()
+		if step, execution, ok := failedExecution(componentExecutions); ok {
+			event.FailedStep = step
+			event.FailedExecutionID = execution.ID
+		}
+	}
+	notifyAll(ctx, notifiers, outstream, event)
+	runLogger := components.Logger(ctx).WithField("status", run.Status)
+	if err != nil {
+		runLogger = runLogger.WithField("error", err.Error())
+	}
+	runLogger.Info("Flow run finished")
+
+	if err != nil {
+		return run, componentExecutions, err
+	}
+	if updateErr != nil {
+		return run, componentExecutions, fmt.Errorf("Error updating status of flow run (%s): %w", run.ID, updateErr)
+	}
+
+	return run, componentExecutions, nil
+}
+
+// executeStages executes the steps of the given flow run stage by stage, waiting for all the steps
+// in a stage to complete (successfully, unless they are allowed to fail) before starting the next
+// stage. The hooks for each step are run immediately before it is started and immediately after it
+// finishes, and its on_success or on_failure handlers are run as soon as its outcome is known.
+// Failed steps are attempted again, in fresh containers, up to their number of attempts (see
+// stepAttempts) before their outcome is decided. Service steps
+// are not waited on - they run until every stage has finished, at which point they are stopped.
+// Service steps whose services are up (see Up) are not started at all; the standing services are
+// connected to the run's network for the duration of the run instead. Steps which require service
+// steps (see DependencyRequires) are only started once those services are healthy.
+func executeStages(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	artifactsDir string,
+	scratchDir string,
+	run FlowRunMetadata,
+	specification FlowSpecification,
+	buildIDs map[string]string,
+	stages [][]string,
+	progress *progressWriter,
+	hooks *hookRunner,
+	stager *staging.Stager,
+) (componentExecutions map[string]components.ExecutionMetadata, err error) {
+	componentExecutions = map[string]components.ExecutionMetadata{}
+
+	// The spans of the stage and the steps in progress are ended with the error that the run failed
+	// with (if any) when the run returns. Ending a span which has already ended has no effect.
+	var stageSpan *tracing.Span
+	stepSpans := map[string]*tracing.Span{}
+	stepContexts := map[string]context.Context{}
+	defer func() {
+		for _, stepSpan := range stepSpans {
+			stepSpan.End(err)
+		}
+		stageSpan.End(err)
+	}()
+
+	services, err := serviceSteps(store, specification)
+	if err != nil {
+		return componentExecutions, err
+	}
+	err = validateRequirements(specification, services)
+	if err != nil {
+		return componentExecutions, err
+	}
+	err = validateAttempts(specification, services)
+	if err != nil {
+		return componentExecutions, err
+	}
+	// runningServices holds the service steps which have been started, all of which are stopped once
+	// the run's stages have finished (or the run has failed)
+	runningServices := []string{}
+	defer func() {
+		stopCtx := ctx
+		if ctx.Err() != nil {
+			stopCtx = detachedContext{ctx}
+		}
+		stopErr := stopServices(stopCtx, store, dockerClient, componentExecutions, runningServices, specification.AllowFailure)
+		if stopErr != nil && err == nil {
+			err = stopErr
+		}
+	}()
+	// unfinishedSteps maps the task steps which have been started but whose outcomes have not yet
+	// been decided to their latest executions. If the run is cancelled, their containers are stopped
+	// so that they do not outlive it.
+	unfinishedSteps := map[string]components.ExecutionMetadata{}
+	defer func() {
+		if ctx.Err() != nil {
+			stopUnfinishedSteps(detachedContext{ctx}, store, dockerClient, unfinishedSteps)
+		}
+	}()
+
+	// standingServices holds the service steps whose services are up (see Up), which the run uses
+	// rather than starting them itself
+	standingServices, err := attachStandingServices(ctx, store, dockerClient, run, services)
+	defer detachStandingServices(dockerClient, run, standingServices)
+	if err != nil {
+		return componentExecutions, err
+	}
+
+	// waitForStep waits for the given execution of the given step to finish, running the step's
+	// on_failure handlers if it cannot be waited on. Executions of built-in validation steps have
+	// already finished by the time they are waited on, and gate steps finish once they are decided.
+	waitForStep := func(step string, executionMetadata components.ExecutionMetadata) (components.ExecutionMetadata, error) {
+		var err error
+		if executionMetadata.ExitCode == nil && specification.Steps[step] == GateComponentID {
+			progress.gateWaiting(run, step, specification.Gates[step])
+			executionMetadata, err = waitForGate(stepContexts[step], store, specification, executionMetadata)
+		} else if executionMetadata.ExitCode == nil {
+			executionMetadata, err = components.WaitForExecution(stepContexts[step], store, dockerClient, executionMetadata.ID)
+		}
+		if err != nil {
+			stepEnv := map[string]string{
+				HookEnvStep:        step,
+				HookEnvComponentID: specification.Steps[step],
+				HookEnvExecutionID: executionMetadata.ID,
+				HookEnvStepStatus:  RunStatusFailed,
+			}
+			hooks.runHandlers(ctx, specification.OnFailure[step], fmt.Sprintf("on_failure:%s", step), stepEnv)
+			return executionMetadata, fmt.Errorf("Error executing step (%s): %w", step, err)
+		}
+		componentExecutions[step] = executionMetadata
+		progress.stepFinished(step, executionMetadata)
+		return executionMetadata, nil
+	}
+
+	for i, stage := range stages {
+		err := waitWhilePaused(ctx, store, run.ID, i, progress)
+		if err != nil {
+			return componentExecutions, err
+		}
+		progress.stageStarted(i)
+		var stageCtx context.Context
+		stageCtx, stageSpan = tracing.Start(ctx, "stage", map[string]string{"stage": strconv.Itoa(i + 1), "steps": strings.Join(stage, ",")})
 		stepExecutions := map[string]components.ExecutionMetadata{}
 		for _, step := range stage {
-			executionMetadata, err := components.Execute(ctx, db, dockerClient, buildIDs[step], flowID, specification.Mounts[step], specification.Env[step])
+			if executionMetadata, ok := standingServices[step]; ok {
+				componentExecutions[step] = executionMetadata
+				continue
+			}
+			stepContexts[step], stepSpans[step] = tracing.Start(stageCtx, "step", map[string]string{
+				components.LogFieldStep:        step,
+				components.LogFieldComponentID: specification.Steps[step],
+			})
+			stepCtx := stepContexts[step]
+			stepEnv := map[string]string{HookEnvStep: step, HookEnvComponentID: specification.Steps[step]}
+			err := hooks.runHooks(stepCtx, beforeStepHooks(specification, step), fmt.Sprintf("before:%s", step), stepEnv)
 			if err != nil {
 				return componentExecutions, err
 			}
+
+			var executionMetadata components.ExecutionMetadata
+			err = waitForRequirements(stepCtx, dockerClient, specification, componentExecutions, step)
+			if err == nil {
+				executionMetadata, err = startStep(stepCtx, store, dockerClient, scratchDir, stager, run, specification, buildIDs, step, 1, "")
+			}
+			if err != nil {
+				stepEnv[HookEnvStepStatus] = RunStatusFailed
+				hooks.runHandlers(ctx, specification.OnFailure[step], fmt.Sprintf("on_failure:%s", step), stepEnv)
+				return componentExecutions, err
+			}
 			componentExecutions[step] = executionMetadata
+			if services[step] {
+				runningServices = append(runningServices, step)
+				continue
+			}
 			stepExecutions[step] = executionMetadata
+			unfinishedSteps[step] = executionMetadata
 		}
 
 		for step, executionMetadata := range stepExecutions {
-			for {
-				info, err := dockerClient.ContainerInspect(ctx, executionMetadata.ID)
+			executionMetadata, err := waitForStep(step, executionMetadata)
+			if err != nil {
+				return componentExecutions, err
+			}
+
+			// Failed steps get retried, each attempt being recorded as an execution linked to the one
+			// before it, and the inputs of steps with dead-letter specifications get set aside if
+			// they fail on every attempt
+			deadLetter, hasDeadLetter := specification.DeadLetters[step]
+			maxAttempts := stepAttempts(specification, step)
+			attempts := 1
+			for *executionMetadata.ExitCode != 0 && attempts < maxAttempts {
+				progress.stepRetrying(step, attempts, maxAttempts-1)
+				components.Logger(ctx).WithFields(components.ExecutionLogFields(executionMetadata)).WithField("retry", attempts).Warn("Retrying failed step")
+				executionMetadata, err = startStep(stepContexts[step], store, dockerClient, scratchDir, stager, run, specification, buildIDs, step, attempts+1, executionMetadata.ID)
+				if err != nil {
+					return componentExecutions, err
+				}
+				unfinishedSteps[step] = executionMetadata
+				attempts++
+				executionMetadata, err = waitForStep(step, executionMetadata)
+				if err != nil {
+					return componentExecutions, err
+				}
+			}
+			delete(unfinishedSteps, step)
+			deadLettered := false
+			if hasDeadLetter && *executionMetadata.ExitCode != 0 {
+				variables := TemplateVariables(run, step)
+				deadLetter.Input = components.RenderTemplate(deadLetter.Input, variables)
+				mounts := components.RenderMountTemplates(specification.Mounts[step], variables)
+				if shardMount, ok := shardInputMount(scratchDir, specification, step); ok {
+					mounts = append(mounts, shardMount)
+				}
+				record, err := DeadLetterInput(deadLetter, mounts, run, step, executionMetadata, attempts)
 				if err != nil {
-					return componentExecutions, fmt.Errorf("Error executing step (%s): %s", step, err.Error())
+					return componentExecutions, fmt.Errorf("Error dead-lettering input for step (%s): %w", step, err)
 				}
-				if info.State.Running {
-					continue
-				} else if info.State.ExitCode == 0 {
-					break
-				} else {
-					return componentExecutions, fmt.Errorf("Container (%s) for step (%s) exited with non-zero code: %d", info.ID, step, info.State.ExitCode)
+				progress.inputDeadLettered(record)
+				components.Logger(ctx).WithFields(components.ExecutionLogFields(executionMetadata)).WithField("destination", record.Destination).Warn("Dead-lettered input of failed step")
+				deadLettered = true
+			}
+
+			if *executionMetadata.ExitCode == 0 {
+				err = stager.Unstage(ctx, step)
+				if err != nil {
+					return componentExecutions, fmt.Errorf("Error uploading staged mounts for step (%s): %w", step, err)
+				}
+			}
+
+			if artifactName, ok := specification.StdoutArtifacts[step]; ok {
+				_, err = components.CaptureStdoutArtifact(ctx, store, dockerClient, artifactsDir, executionMetadata.ID, artifactName)
+				if err != nil {
+					return componentExecutions, fmt.Errorf("Error capturing stdout artifact (%s) for step (%s): %w", artifactName, step, err)
 				}
 			}
+
+			var contractErr error
+			if specification.ValidateContracts && *executionMetadata.ExitCode == 0 {
+				contractErr = ValidateProducedData(specification, run, step)
+			}
+
+			stepEnv := map[string]string{
+				HookEnvStep:        step,
+				HookEnvComponentID: specification.Steps[step],
+				HookEnvExecutionID: executionMetadata.ID,
+				HookEnvExitCode:    fmt.Sprintf("%d", *executionMetadata.ExitCode),
+				HookEnvStepStatus:  RunStatusSucceeded,
+			}
+			if *executionMetadata.ExitCode != 0 || contractErr != nil {
+				stepEnv[HookEnvStepStatus] = RunStatusFailed
+				hooks.runHandlers(ctx, specification.OnFailure[step], fmt.Sprintf("on_failure:%s", step), stepEnv)
+			} else {
+				hooks.runHandlers(ctx, specification.OnSuccess[step], fmt.Sprintf("on_success:%s", step), stepEnv)
+			}
+
+			err = hooks.runHooks(ctx, afterStepHooks(specification, step), fmt.Sprintf("after:%s", step), stepEnv)
+			if err != nil {
+				return componentExecutions, err
+			}
+
+			if contractErr != nil {
+				return componentExecutions, fmt.Errorf("Step (%s) violated its data contracts: %w", step, contractErr)
+			}
+			if *executionMetadata.ExitCode != 0 && !specification.AllowFailure[step] && !deadLettered {
+				return componentExecutions, components.NewExecutionFailedError(executionMetadata)
+			}
+
+			stepSpans[step].SetAttribute("exit_code", strconv.Itoa(*executionMetadata.ExitCode))
+			if *executionMetadata.ExitCode != 0 {
+				stepSpans[step].End(components.NewExecutionFailedError(executionMetadata))
+			} else {
+				stepSpans[step].End(nil)
+			}
 		}
+
+		// The spans of service steps end with the stages they start in, although the services keep
+		// running
+		for _, step := range stage {
+			stepSpans[step].End(nil)
+		}
+		stageSpan.End(nil)
 	}
 
 	return componentExecutions, nil
 }
+
+// stageMounts downloads the remote sources (e.g. "s3://bucket/key") among the given mounts for the
+// given step into a fresh staging directory under the scratch directory of the run, and returns the
+// mounts with those sources replaced by their local copies
+func stageMounts(ctx context.Context, stager *staging.Stager, scratchDir, step string, mounts []components.MountConfiguration) ([]components.MountConfiguration, error) {
+	hasRemoteSource := false
+	for _, mount := range mounts {
+		if _, ok := components.RemoteSourceScheme(mount.Source); ok {
+			hasRemoteSource = true
+		}
+	}
+	if !hasRemoteSource {
+		return mounts, nil
+	}
+
+	stagingDir, err := ioutil.TempDir(scratchDir, fmt.Sprintf(".staging-%s-", step))
+	if err != nil {
+		return mounts, fmt.Errorf("Could not create staging directory for step (%s): %w", step, err)
+	}
+	return stager.Stage(ctx, step, mounts, stagingDir)
+}
+
+// mostRecentBuild returns the most recent build of the component with the given ID for the given
+// target (see components.BuildOptions). Built-in components which have not yet been built are
+// registered and built on demand, as are embedded components (which must already be registered)
+// which have not yet been built. Builds for non-empty targets are made on demand if the component
+// has not been built for the target since its source last changed.
+func mostRecentBuild(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, stateDir, componentID, target string) (components.BuildMetadata, error) {
+	if target != "" && !components.IsBuiltinComponent(componentID) {
+		stale, err := components.BuildIsStaleForTarget(store, componentID, target)
+		if err != nil {
+			return components.BuildMetadata{}, fmt.Errorf("Could not check build of component (%s) for target (%s): %w", componentID, target, err)
+		}
+		if !stale {
+			return components.SelectMostRecentBuildForTarget(store, componentID, target)
+		}
+	} else {
+		buildMetadata, err := components.SelectMostRecentBuildForTarget(store, componentID, target)
+		if err == nil || !(components.IsBuiltinComponent(componentID) || IsEmbeddedComponent(componentID)) {
+			return buildMetadata, err
+		}
+	}
+
+	if components.IsBuiltinComponent(componentID) {
+		_, err := components.EnsureBuiltinComponent(store, filepath.Join(stateDir, state.BuiltinDirName), componentID)
+		if err != nil {
+			return components.BuildMetadata{}, err
+		}
+	}
+	if outstream == nil {
+		outstream = ioutil.Discard
+	}
+	return components.CreateBuild(ctx, store, dockerClient, outstream, filepath.Join(stateDir, state.BuildLogsDirName), componentID, components.BuildOptions{Target: target})
+}
+
+// startStep starts an execution of the build for the given step in the given flow run, rendering
+// any placeholders in the step's mount configurations, staging remote mount sources, and mounting
+// the run's scratch directory. The execution is recorded as the given attempt at the step, retrying
+// the execution with the given ID (empty for first attempts).
+// Built-in validation steps are run to completion on the host instead.
+func startStep(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	scratchDir string,
+	stager *staging.Stager,
+	run FlowRunMetadata,
+	specification FlowSpecification,
+	buildIDs map[string]string,
+	step string,
+	attempt int,
+	previousAttemptID string,
+) (components.ExecutionMetadata, error) {
+	if specification.Steps[step] == ValidateComponentID {
+		return runValidationStep(store, run, specification, step)
+	}
+	if specification.Steps[step] == GateComponentID {
+		return startGateStep(store, run, specification, step)
+	}
+
+	mounts, err := renderMounts(run, step, specification.Mounts[step])
+	if err != nil {
+		return components.ExecutionMetadata{}, err
+	}
+	mounts, err = stageMounts(ctx, stager, scratchDir, step, mounts)
+	if err != nil {
+		return components.ExecutionMetadata{}, err
+	}
+	mounts, env := withScratch(scratchDir, mounts, specification.Env[step])
+	mounts, env, err = withPartition(scratchDir, run, specification, step, mounts, env)
+	if err != nil {
+		return components.ExecutionMetadata{}, err
+	}
+
+	var stdin io.Reader
+	if stdinPath, ok := specification.Stdin[step]; ok {
+		stdinFile, err := os.Open(stdinPath)
+		if err != nil {
+			return components.ExecutionMetadata{}, fmt.Errorf("Error opening stdin file (%s) for step (%s): %w", stdinPath, step, err)
+		}
+		defer stdinFile.Close()
+		stdin = stdinFile
+	}
+
+	return components.ExecuteWithOptions(
+		ctx,
+		store,
+		dockerClient,
+		components.WithBuild(buildIDs[step]),
+		components.WithFlowRun(run.FlowID, run.ID, step),
+		components.WithAttempt(attempt, previousAttemptID),
+		components.WithMounts(mounts...),
+		components.WithEnv(env),
+		components.WithWorkdir(specification.Workdirs[step]),
+		components.WithNetwork(RunNetworkName(run.ID)),
+		components.WithStdin(stdin),
+	)
+}
+
+// stepAttempts returns the number of times that the given step is attempted before its failure is
+// decided: its attempts (see FlowSpecification.Attempts), or one more than the retries of its
+// dead-letter specification if that is greater
+func stepAttempts(specification FlowSpecification, step string) int {
+	attempts := specification.Attempts[step]
+	if deadLetter, ok := specification.DeadLetters[step]; ok && deadLetter.Retries+1 > attempts {
+		attempts = deadLetter.Retries + 1
+	}
+	if attempts < 1 {
+		attempts = 1
+	}
+	return attempts
+}
+
+// FailedSteps returns the steps (in lexicographic order) whose executions finished with a non-zero
+// exit code
+func FailedSteps(executions map[string]components.ExecutionMetadata) []string {
+	steps := []string{}
+	for step, executionMetadata := range executions {
+		if executionMetadata.ExitCode != nil && *executionMetadata.ExitCode != 0 {
+			steps = append(steps, step)
+		}
+	}
+	sort.Strings(steps)
+	return steps
+}
+
+// progressWriter reports the progress of a flow run, along with an estimate of the time remaining
+// in the run. A nil progressWriter (or one with a nil writer) reports nothing.
+type progressWriter struct {
+	w              io.Writer
+	statistics     map[string]DurationStatistics
+	stages         [][]string
+	currentStage   int
+	stageStartedAt time.Time
+}
+
+func newProgressWriter(w io.Writer, statistics map[string]DurationStatistics, stages [][]string) *progressWriter {
+	return &progressWriter{w: w, statistics: statistics, stages: stages}
+}
+
+// eta renders the estimated time remaining in the run
+func (progress *progressWriter) eta() string {
+	remaining, complete := EstimateRemaining(progress.statistics, progress.stages, progress.currentStage, time.Since(progress.stageStartedAt))
+	if !complete && remaining == 0 {
+		return "ETA: unknown"
+	}
+	eta := fmt.Sprintf("ETA: %s", remaining.Round(time.Second))
+	if !complete {
+		eta = fmt.Sprintf("ETA: at least %s", remaining.Round(time.Second))
+	}
+	return eta
+}
+
+func (progress *progressWriter) stageStarted(stage int) {
+	if progress == nil || progress.w == nil {
+		return
+	}
+	progress.currentStage = stage
+	progress.stageStartedAt = time.Now()
+	fmt.Fprintf(progress.w, "[stage %d/%d] Starting steps: %s (%s)\n", stage+1, len(progress.stages), strings.Join(progress.stages[stage], ", "), progress.eta())
+}
+
+func (progress *progressWriter) stepFinished(step string, executionMetadata components.ExecutionMetadata) {
+	if progress == nil || progress.w == nil {
+		return
+	}
+	duration := time.Since(executionMetadata.CreatedAt)
+	if executionMetadata.FinishedAt != nil {
+		duration = executionMetadata.FinishedAt.Sub(executionMetadata.CreatedAt)
+	}
+	exitCode := "unknown"
+	if executionMetadata.ExitCode != nil {
+		exitCode = fmt.Sprintf("%d", *executionMetadata.ExitCode)
+	}
+	fmt.Fprintf(progress.w, "[stage %d/%d] Step %s finished in %s with exit code %s (%s)\n", progress.currentStage+1, len(progress.stages), step, duration.Round(time.Second), exitCode, progress.eta())
+}
+
+func (progress *progressWriter) stepRetrying(step string, attempt, retries int) {
+	if progress == nil || progress.w == nil {
+		return
+	}
+	fmt.Fprintf(progress.w, "[stage %d/%d] Retrying step %s (retry %d/%d)\n", progress.currentStage+1, len(progress.stages), step, attempt, retries)
+}
+
+func (progress *progressWriter) runWaitingForQuota(run FlowRunMetadata, maxRuns int) {
+	if progress == nil || progress.w == nil {
+		return
+	}
+	fmt.Fprintf(progress.w, "Run %s is waiting for a slot (flow %s allows %d concurrent runs)\n", run.ID, run.FlowID, maxRuns)
+}
+
+func (progress *progressWriter) runQueued(run FlowRunMetadata, position int) {
+	if progress == nil || progress.w == nil {
+		return
+	}
+	fmt.Fprintf(progress.w, "Run %s is queued at position %d (priority %d)\n", run.ID, position, run.Priority)
+}
+
+func (progress *progressWriter) runPaused(run FlowRunMetadata, stage int) {
+	if progress == nil || progress.w == nil {
+		return
+	}
+	fmt.Fprintf(progress.w, "[stage %d/%d] Run paused before starting this stage (shn flows resume --run %s)\n", stage+1, len(progress.stages), run.ID)
+}
+
+func (progress *progressWriter) gateWaiting(run FlowRunMetadata, step string, gate GateSpecification) {
+	if progress == nil || progress.w == nil {
+		return
+	}
+	fmt.Fprintf(progress.w, "[stage %d/%d] Step %s is waiting for approval (shn flows approve --run %s --step %s)\n", progress.currentStage+1, len(progress.stages), step, run.ID, step)
+	if gate.Message != "" {
+		fmt.Fprintf(progress.w, "[stage %d/%d]   %s\n", progress.currentStage+1, len(progress.stages), gate.Message)
+	}
+}
+
+func (progress *progressWriter) inputDeadLettered(record DeadLetterRecord) {
+	if progress == nil || progress.w == nil {
+		return
+	}
+	fmt.Fprintf(progress.w, "[stage %d/%d] Step %s failed %d times - input dead-lettered to %s\n", progress.currentStage+1, len(progress.stages), record.Step, record.Attempts, record.Destination)
+}
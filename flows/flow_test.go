@@ -0,0 +1,212 @@
+package flows
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// TestAddFlowValidatesMounts registers flows whose steps mount different targets against a
+// registered component and a built-in component, and checks that only flows whose mounts match the
+// components' mountpoints are registered
+func TestAddFlowValidatesMounts(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-add-flow-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Error creating state directory: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	_, err = components.AddComponent(store, "single-task", components.Task, "../examples/components/single-task", "")
+	if err != nil {
+		t.Fatalf("Error registering component: %s", err.Error())
+	}
+
+	type addFlowTest struct {
+		specification string
+		returnsError  bool
+	}
+
+	testCases := []addFlowTest{
+		{
+			specification: `{"steps": {"a": "single-task"}, "mounts": {"a": [
+				{"source": "/tmp/in", "target": "/shnorky/inputs.txt", "method": "bind"},
+				{"source": "/tmp/out", "target": "/shnorky/outputs.txt", "method": "bind"},
+				{"source": "/tmp/scratch", "target": "/shnorky/scratch", "method": "bind"}
+			]}}`,
+		},
+		{
+			specification: `{"steps": {"a": "single-task"}, "mounts": {"a": [
+				{"source": "/tmp/in", "target": "/shnorky/inputs.txt", "method": "bind"}
+			]}}`,
+			returnsError: true,
+		},
+		{
+			specification: `{"steps": {"a": "single-task"}, "mounts": {"a": [
+				{"source": "/tmp/in", "target": "/shnorky/inputs.txt", "method": "bind"},
+				{"source": "/tmp/out", "target": "/shnorky/outputs.txt", "method": "bind"},
+				{"source": "/tmp/other", "target": "/shnorky/other.txt", "method": "bind"}
+			]}}`,
+			returnsError: true,
+		},
+		{
+			specification: `{"steps": {"a": "single-task"}, "mounts": {"a": [
+				{"source": "/tmp/in", "target": "/shnorky/inputs.txt", "method": "bind"},
+				{"source": "/tmp/out", "target": "/shnorky/outputs.txt", "method": "bind"},
+				{"source": "/tmp/out2", "target": "/shnorky/outputs.txt", "method": "bind"}
+			]}}`,
+			returnsError: true,
+		},
+		{
+			specification: `{"steps": {"a": "unregistered"}}`,
+			returnsError:  true,
+		},
+		{
+			specification: `{"steps": {"a": "builtin:unzip"}, "mounts": {"a": [
+				{"source": "/tmp/input.zip", "target": "/shnorky/input.zip", "method": "bind"},
+				{"source": "/tmp/output", "target": "/shnorky/output", "method": "bind"}
+			]}}`,
+		},
+		{
+			specification: `{"steps": {"a": "builtin:unzip"}}`,
+			returnsError:  true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		specificationPath := path.Join(stateDir, fmt.Sprintf("flow-%d.json", i))
+		err = ioutil.WriteFile(specificationPath, []byte(testCase.specification), 0644)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not write flow specification: %s", i, err.Error())
+		}
+
+		flowID := fmt.Sprintf("flow-%d", i)
+		_, err = AddFlow(store, flowID, specificationPath)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		}
+		if err != nil {
+			continue
+		}
+
+		flow, err := SelectFlowByID(store, flowID)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not select registered flow: %s", i, err.Error())
+		}
+		checksum, err := SpecificationChecksum(specificationPath)
+		if err != nil || flow.SpecificationChecksum != checksum {
+			t.Errorf("[Test %d] Unexpected specification checksum: expected=%s, actual=%s, err=%v", i, checksum, flow.SpecificationChecksum, err)
+		}
+		specification, err := ReadSpecificationFile(specificationPath)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not read flow specification: %s", i, err.Error())
+		}
+		steps, err := SelectFlowComponents(store, flowID)
+		if err != nil || !reflect.DeepEqual(steps, specification.Steps) {
+			t.Errorf("[Test %d] Unexpected flow components: expected=%v, actual=%v, err=%v", i, specification.Steps, steps, err)
+		}
+	}
+}
+
+// TestStaleComponents registers a flow whose components have all been built, changes the source of
+// one of them, and checks that only that component is reported as stale
+func TestStaleComponents(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-stale-flow-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Error creating state directory: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+
+	db, err := sql.Open("sqlite3", path.Join(stateDir, state.DBFileName))
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	for _, componentID := range []string{"extract", "load"} {
+		componentPath := path.Join(stateDir, componentID)
+		err = os.MkdirAll(componentPath, 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path.Join(componentPath, components.DefaultSpecificationFileName), []byte(`{"build": {}, "run": {}}`), 0644)
+		}
+		if err == nil {
+			err = ioutil.WriteFile(path.Join(componentPath, "Dockerfile"), []byte("FROM alpine:3.11.2\n"), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Could not write component (%s): %s", componentID, err.Error())
+		}
+		component, err := components.AddComponent(store, componentID, components.Task, componentPath, "")
+		if err != nil {
+			t.Fatalf("Error registering component (%s): %s", componentID, err.Error())
+		}
+		build, err := components.GenerateBuildMetadata(componentID)
+		if err != nil {
+			t.Fatalf("Could not generate build metadata: %s", err.Error())
+		}
+		build.SourceHash, err = components.SourceHash(component)
+		if err == nil {
+			err = components.InsertBuild(store, build)
+		}
+		if err != nil {
+			t.Fatalf("Could not record build of component (%s): %s", componentID, err.Error())
+		}
+	}
+
+	specificationPath := path.Join(stateDir, "flow.json")
+	err = ioutil.WriteFile(specificationPath, []byte(`{"steps": {"a": "extract", "b": "load", "c": "load"}}`), 0644)
+	if err != nil {
+		t.Fatalf("Could not write flow specification: %s", err.Error())
+	}
+	_, err = AddFlow(store, "etl", specificationPath)
+	if err != nil {
+		t.Fatalf("Error registering flow: %s", err.Error())
+	}
+
+	staleComponents, err := StaleComponents(store, "etl")
+	if err != nil || len(staleComponents) != 0 {
+		t.Errorf("Expected no stale components: stale=%v, error=%v", staleComponents, err)
+	}
+
+	err = ioutil.WriteFile(path.Join(stateDir, "load", "Dockerfile"), []byte("FROM alpine:3.12\n"), 0644)
+	if err != nil {
+		t.Fatalf("Could not modify Dockerfile: %s", err.Error())
+	}
+	staleComponents, err = StaleComponents(store, "etl")
+	if err != nil || !reflect.DeepEqual(staleComponents, []string{"load"}) {
+		t.Errorf("Unexpected stale components: expected=%v, actual=%v, error=%v", []string{"load"}, staleComponents, err)
+	}
+
+	_, err = StaleComponents(store, "unregistered")
+	if err == nil {
+		t.Error("Expected error checking components of unregistered flow")
+	}
+}
@@ -0,0 +1,215 @@
+package flows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// GateComponentID is the ID of the built-in component which pauses a flow run until a person
+// approves (or rejects) it, e.g. after reviewing the output of a sample run. Steps using this
+// component run on the host (rather than in a container) and may be configured by the Gates member
+// of the flow specification.
+var GateComponentID = components.BuiltinComponentPrefix + "gate"
+
+// ApprovalStatusPending is the status of approvals which have not been decided
+var ApprovalStatusPending = "pending"
+
+// ApprovalStatusApproved is the status of approvals which let their flow runs continue
+var ApprovalStatusApproved = "approved"
+
+// ApprovalStatusRejected is the status of approvals which fail their gate steps
+var ApprovalStatusRejected = "rejected"
+
+// ApprovalStatusExpired is the status of approvals which were not decided before their gate's
+// timeout
+var ApprovalStatusExpired = "expired"
+
+// ApprovalPollInterval is how often gate steps check the state database for a decision
+var ApprovalPollInterval = time.Second
+
+// ErrApprovalNotFound - signifies that there is no pending approval for a step of a flow run
+var ErrApprovalNotFound = errors.New("Could not find a pending approval for the specified step")
+
+// GateSpecification - configures a built-in gate step
+type GateSpecification struct {
+	// Message is shown to the people asked to approve the gate (e.g. "Review the sample output in
+	// /data/sample.csv before the full run")
+	Message string `json:"message,omitempty"`
+	// Timeout is how long (e.g. "24h") the gate waits for a decision before failing. If it is
+	// empty, the gate waits indefinitely.
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// Approval - a request for a decision on a gate step in a flow run
+type Approval struct {
+	ExecutionID string     `json:"execution_id"`
+	FlowRunID   string     `json:"flow_run_id"`
+	Step        string     `json:"step"`
+	Message     string     `json:"message"`
+	Status      string     `json:"status"`
+	RequestedAt time.Time  `json:"requested_at"`
+	DecidedAt   *time.Time `json:"decided_at"`
+	DecidedBy   string     `json:"decided_by"`
+	Comment     string     `json:"comment"`
+}
+
+// MaterializeGateSpecification validates the given gate specification
+func MaterializeGateSpecification(rawSpecification GateSpecification) (GateSpecification, error) {
+	if rawSpecification.Timeout != "" {
+		timeout, err := time.ParseDuration(rawSpecification.Timeout)
+		if err != nil {
+			return rawSpecification, fmt.Errorf("Invalid timeout: %w", err)
+		}
+		if timeout <= 0 {
+			return rawSpecification, fmt.Errorf("Invalid timeout (must be positive): %s", rawSpecification.Timeout)
+		}
+	}
+	return rawSpecification, nil
+}
+
+// isHostStep returns true if steps using the given component run on the host rather than in a
+// container (and so have no builds)
+func isHostStep(componentID string) bool {
+	return componentID == ValidateComponentID || componentID == GateComponentID
+}
+
+// startGateStep records the given gate step of the given flow run in the state database as an
+// (unfinished) execution, along with a pending approval for it
+func startGateStep(store state.Store, run FlowRunMetadata, specification FlowSpecification, step string) (components.ExecutionMetadata, error) {
+	build := components.BuildMetadata{ID: GateComponentID, ComponentID: GateComponentID}
+	executionMetadata, err := components.GenerateExecutionMetadata(build, run.FlowID)
+	if err != nil {
+		return executionMetadata, err
+	}
+	executionMetadata.FlowRunID = run.ID
+	executionMetadata.Step = step
+
+	err = components.InsertExecution(store, executionMetadata)
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Error inserting execution for gate step (%s) into state database: %w", step, err)
+	}
+	err = store.InsertApproval(state.ApprovalRecord{
+		ExecutionID: executionMetadata.ID,
+		FlowRunID:   run.ID,
+		Step:        step,
+		Message:     specification.Gates[step].Message,
+		Status:      ApprovalStatusPending,
+		RequestedAt: executionMetadata.CreatedAt,
+	})
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Error requesting approval for gate step (%s): %w", step, err)
+	}
+	return executionMetadata, nil
+}
+
+// waitForGate waits until the approval for the given execution of a gate step is decided (or, if
+// the gate has a timeout, expires), and records the outcome as the result of the execution. The
+// execution exits with code 0 if it was approved, and with code 1 otherwise.
+func waitForGate(ctx context.Context, store state.Store, specification FlowSpecification, executionMetadata components.ExecutionMetadata) (components.ExecutionMetadata, error) {
+	var deadline <-chan time.Time
+	if timeout := specification.Gates[executionMetadata.Step].Timeout; timeout != "" {
+		duration, err := time.ParseDuration(timeout)
+		if err != nil {
+			return executionMetadata, err
+		}
+		deadline = time.After(duration)
+	}
+	ticker := time.NewTicker(ApprovalPollInterval)
+	defer ticker.Stop()
+
+	var approval Approval
+	var err error
+	for {
+		approval, err = SelectApproval(store, executionMetadata.ID)
+		if err != nil {
+			return executionMetadata, err
+		}
+		if approval.Status != ApprovalStatusPending {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			return executionMetadata, ctx.Err()
+		case <-deadline:
+			err = store.ExpireApproval(executionMetadata.ID, ApprovalStatusPending, ApprovalStatusExpired, time.Now())
+			if err != nil {
+				return executionMetadata, err
+			}
+		case <-ticker.C:
+		}
+	}
+
+	exitCode := 0
+	switch approval.Status {
+	case ApprovalStatusApproved:
+	case ApprovalStatusExpired:
+		exitCode = 1
+		executionMetadata.Error = "Approval expired before a decision was made"
+	default:
+		exitCode = 1
+		executionMetadata.Error = fmt.Sprintf("Rejected by %s", approval.DecidedBy)
+		if approval.Comment != "" {
+			executionMetadata.Error = fmt.Sprintf("%s: %s", executionMetadata.Error, approval.Comment)
+		}
+	}
+	finishedAt := time.Now()
+	executionMetadata.ExitCode = &exitCode
+	executionMetadata.FinishedAt = &finishedAt
+
+	err = components.UpdateExecutionResult(store, executionMetadata)
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Error recording result of gate step (%s) in state database: %w", executionMetadata.Step, err)
+	}
+	return executionMetadata, nil
+}
+
+// DecideApproval approves (or rejects) the pending approval for the given gate step of the given
+// flow run on behalf of decidedBy. It returns ErrApprovalNotFound if the step is not waiting for a
+// decision.
+// This is the handler for `shn flows approve`
+func DecideApproval(store state.Store, runID, step string, approved bool, decidedBy, comment string) error {
+	status := ApprovalStatusApproved
+	if !approved {
+		status = ApprovalStatusRejected
+	}
+	decidedAt := time.Now()
+	err := store.DecideApproval(state.ApprovalRecord{
+		FlowRunID: runID,
+		Step:      step,
+		Status:    status,
+		DecidedAt: &decidedAt,
+		DecidedBy: decidedBy,
+		Comment:   comment,
+	}, ApprovalStatusPending)
+	if err == state.ErrNotFound {
+		return ErrApprovalNotFound
+	}
+	return err
+}
+
+// SelectApproval returns the approval for the given execution of a gate step
+func SelectApproval(store state.Store, executionID string) (Approval, error) {
+	record, err := store.SelectApproval(executionID)
+	if err == state.ErrNotFound {
+		return Approval{}, ErrApprovalNotFound
+	}
+	return Approval(record), err
+}
+
+// ListApprovals returns the approvals for the given flow run (or, if runID is empty, for all flow
+// runs) with the given status (or, if status is empty, with any status), oldest first
+// This is the handler for `shn flows approvals`
+func ListApprovals(store state.Store, runID, status string) ([]Approval, error) {
+	records, err := store.SelectApprovals(runID, status)
+	approvals := make([]Approval, len(records))
+	for i, record := range records {
+		approvals[i] = Approval(record)
+	}
+	return approvals, err
+}
@@ -0,0 +1,161 @@
+package flows
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestMaterializeGates(t *testing.T) {
+	type gatesTest struct {
+		specification FlowSpecification
+		returnsError  bool
+	}
+
+	testCases := []gatesTest{
+		{
+			specification: FlowSpecification{
+				Steps: map[string]string{"review": GateComponentID},
+			},
+			returnsError: false,
+		},
+		{
+			specification: FlowSpecification{
+				Steps: map[string]string{"review": GateComponentID},
+				Gates: map[string]GateSpecification{"review": {Message: "Check the sample", Timeout: "24h"}},
+			},
+			returnsError: false,
+		},
+		{
+			specification: FlowSpecification{
+				Steps: map[string]string{"review": "reviewer"},
+				Gates: map[string]GateSpecification{"review": {Message: "Check the sample"}},
+			},
+			returnsError: true,
+		},
+		{
+			specification: FlowSpecification{
+				Steps: map[string]string{"review": GateComponentID},
+				Gates: map[string]GateSpecification{"review": {Timeout: "tomorrow"}},
+			},
+			returnsError: true,
+		},
+		{
+			specification: FlowSpecification{
+				Steps:           map[string]string{"review": GateComponentID},
+				StdoutArtifacts: map[string]string{"review": "decision"},
+			},
+			returnsError: true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		_, err := MaterializeFlowSpecification(testCase.specification)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		}
+	}
+}
+
+func TestGateStep(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-gate-step-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatalf("Error opening state database file (%s): %s", stateDBPath, err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	originalPollInterval := ApprovalPollInterval
+	ApprovalPollInterval = 10 * time.Millisecond
+	defer func() { ApprovalPollInterval = originalPollInterval }()
+
+	run := FlowRunMetadata{ID: "run", FlowID: "flow"}
+	specification := FlowSpecification{
+		Steps: map[string]string{"approve": GateComponentID, "reject": GateComponentID, "expire": GateComponentID},
+		Gates: map[string]GateSpecification{
+			"approve": {Message: "Check the sample"},
+			"expire":  {Timeout: "50ms"},
+		},
+	}
+
+	type gateTest struct {
+		step             string
+		approved         bool
+		decide           bool
+		expectedExitCode int
+		expectedStatus   string
+	}
+
+	tests := []gateTest{
+		{"approve", true, true, 0, ApprovalStatusApproved},
+		{"reject", false, true, 1, ApprovalStatusRejected},
+		{"expire", false, false, 1, ApprovalStatusExpired},
+	}
+
+	for i, test := range tests {
+		executionMetadata, err := startGateStep(store, run, specification, test.step)
+		if err != nil {
+			t.Fatalf("[Test %d] Unexpected error starting gate step: %s", i, err.Error())
+		}
+		pending, err := ListApprovals(store, run.ID, ApprovalStatusPending)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not list pending approvals: %s", i, err.Error())
+		}
+		if len(pending) != 1 || pending[0].Step != test.step || pending[0].Message != specification.Gates[test.step].Message {
+			t.Fatalf("[Test %d] Unexpected pending approvals: %v", i, pending)
+		}
+
+		if test.decide {
+			go func(step string, approved bool) {
+				time.Sleep(30 * time.Millisecond)
+				DecideApproval(store, run.ID, step, approved, "reviewer", "looks fine")
+			}(test.step, test.approved)
+		}
+		executionMetadata, err = waitForGate(context.Background(), store, specification, executionMetadata)
+		if err != nil {
+			t.Fatalf("[Test %d] Unexpected error waiting for gate: %s", i, err.Error())
+		}
+
+		storedExecution, err := components.SelectExecutionByID(store, executionMetadata.ID)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not select execution: %s", i, err.Error())
+		}
+		if storedExecution.ExitCode == nil || *storedExecution.ExitCode != test.expectedExitCode {
+			t.Errorf("[Test %d] Unexpected exit code: expected=%d, actual=%v", i, test.expectedExitCode, storedExecution.ExitCode)
+		}
+		approval, err := SelectApproval(store, executionMetadata.ID)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not select approval: %s", i, err.Error())
+		}
+		if approval.Status != test.expectedStatus || approval.DecidedAt == nil {
+			t.Errorf("[Test %d] Unexpected approval: %v", i, approval)
+		}
+
+		err = DecideApproval(store, run.ID, test.step, true, "reviewer", "")
+		if err != ErrApprovalNotFound {
+			t.Errorf("[Test %d] Unexpected error deciding decided approval: expected=%v, actual=%v", i, ErrApprovalNotFound, err)
+		}
+	}
+}
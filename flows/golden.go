@@ -0,0 +1,542 @@
+package flows
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// Layout of a fixtures directory for golden-output tests of a flow:
+//
+//	<fixtures>/
+//	|-- test.json         (optional FixtureConfiguration)
+//	|-- inputs/<input>    (replaces the path of the flow input with that name)
+//	`-- expected/<output> (golden file or directory for the flow output with that name)
+var (
+	FixtureConfigurationFileName = "test.json"
+	FixtureInputsDirName         = "inputs"
+	FixtureExpectedDirName       = "expected"
+)
+
+// Comparators which can be used to compare the outputs of a flow against golden outputs
+var (
+	// ComparatorExact requires outputs to be byte-for-byte identical to their golden outputs
+	ComparatorExact = "exact"
+	// ComparatorCSVUnordered requires outputs to be CSV files with the same header row and the same
+	// (multiset of) data rows as their golden outputs, in any order
+	ComparatorCSVUnordered = "csv-unordered"
+	// ComparatorNumeric compares outputs with their golden outputs token by token (tokens are
+	// separated by whitespace and commas), allowing numeric tokens to differ by up to the tolerance
+	ComparatorNumeric = "numeric"
+)
+
+// ValidComparators is a set (of keys) enumerating the comparators that shnorky supports
+var ValidComparators = map[string]bool{
+	ComparatorExact:        true,
+	ComparatorCSVUnordered: true,
+	ComparatorNumeric:      true,
+}
+
+// MaxReportedDifferences is the maximum number of differences reported for each output of a
+// golden-output test
+var MaxReportedDifferences = 10
+
+// ComparatorSpecification - specifies how an output of a flow is compared against its golden output
+type ComparatorSpecification struct {
+	// Type is one of the ValidComparators. Defaults to ComparatorExact.
+	Type string `json:"type"`
+	// Tolerance is the largest absolute difference allowed between numbers by ComparatorNumeric
+	Tolerance float64 `json:"tolerance,omitempty"`
+}
+
+// FixtureConfiguration - the (optional) configuration of a golden-output test, read from the
+// FixtureConfigurationFileName file in its fixtures directory
+type FixtureConfiguration struct {
+	// Comparators maps output names to the comparators used for them. Outputs which are not listed
+	// are compared exactly.
+	Comparators map[string]ComparatorSpecification `json:"comparators,omitempty"`
+	// Parameters are passed to the flow run as WithParameters does
+	Parameters map[string]string `json:"parameters,omitempty"`
+}
+
+// OutputComparison - the result of comparing an output of a flow run against its golden output
+type OutputComparison struct {
+	Output      string   `json:"output"`
+	Comparator  string   `json:"comparator"`
+	Passed      bool     `json:"passed"`
+	Differences []string `json:"differences,omitempty"`
+}
+
+// GoldenTestResult - the result of a golden-output test of a flow
+type GoldenTestResult struct {
+	FlowID  string             `json:"flow_id"`
+	RunID   string             `json:"run_id,omitempty"`
+	Passed  bool               `json:"passed"`
+	Outputs []OutputComparison `json:"outputs"`
+	// Error is set if the flow run failed, in which case its outputs are not compared
+	Error string `json:"error,omitempty"`
+}
+
+type pathSubstitutionsKey struct{}
+
+// WithPathSubstitutions returns a copy of the given context which carries substitutions of paths
+// on the host for the flow runs executed with it. Each key in the given map is a path (as it
+// appears in the flow specification) which is replaced by the corresponding value wherever it (or
+// a path under it) appears in the mounts, stdin files, inputs, outputs, and partitions of the flow.
+func WithPathSubstitutions(ctx context.Context, substitutions map[string]string) context.Context {
+	return context.WithValue(ctx, pathSubstitutionsKey{}, substitutions)
+}
+
+// applyPathSubstitutions returns a copy of the given flow specification with the path
+// substitutions carried by the given context (see WithPathSubstitutions) applied
+func applyPathSubstitutions(ctx context.Context, specification FlowSpecification) FlowSpecification {
+	substitutions, ok := ctx.Value(pathSubstitutionsKey{}).(map[string]string)
+	if !ok || len(substitutions) == 0 {
+		return specification
+	}
+
+	mounts := map[string][]components.MountConfiguration{}
+	for step, stepMounts := range specification.Mounts {
+		substitutedMounts := make([]components.MountConfiguration, len(stepMounts))
+		for i, mount := range stepMounts {
+			mount.Source = substitutePath(mount.Source, substitutions)
+			substitutedMounts[i] = mount
+		}
+		mounts[step] = substitutedMounts
+	}
+	specification.Mounts = mounts
+
+	stdin := map[string]string{}
+	for step, path := range specification.Stdin {
+		stdin[step] = substitutePath(path, substitutions)
+	}
+	specification.Stdin = stdin
+
+	inputs := map[string]InputSpecification{}
+	for name, input := range specification.Inputs {
+		if input.Path != "" {
+			input.Path = substitutePath(input.Path, substitutions)
+		}
+		inputs[name] = input
+	}
+	specification.Inputs = inputs
+
+	outputs := map[string]OutputSpecification{}
+	for name, output := range specification.Outputs {
+		output.Path = substitutePath(output.Path, substitutions)
+		outputs[name] = output
+	}
+	specification.Outputs = outputs
+
+	partitions := map[string]PartitionSpecification{}
+	for step, partition := range specification.Partitions {
+		partition.Input = substitutePath(partition.Input, substitutions)
+		partitions[step] = partition
+	}
+	specification.Partitions = partitions
+
+	return specification
+}
+
+// substitutePath applies the first of the given substitutions which matches the given path (or
+// one of its parent directories)
+func substitutePath(path string, substitutions map[string]string) string {
+	if substitution, ok := substitutions[path]; ok {
+		return substitution
+	}
+	for original, substitution := range substitutions {
+		if strings.HasPrefix(path, original+string(filepath.Separator)) {
+			return substitution + strings.TrimPrefix(path, original)
+		}
+	}
+	return path
+}
+
+// ReadFixtureConfiguration reads the configuration of the golden-output test in the given fixtures
+// directory. A fixtures directory without a configuration file has an empty configuration.
+func ReadFixtureConfiguration(fixturesDir string) (FixtureConfiguration, error) {
+	configuration := FixtureConfiguration{}
+	configurationPath := filepath.Join(fixturesDir, FixtureConfigurationFileName)
+	configurationFile, err := os.Open(configurationPath)
+	if os.IsNotExist(err) {
+		return configuration, nil
+	} else if err != nil {
+		return configuration, fmt.Errorf("Could not open fixture configuration (%s): %w", configurationPath, err)
+	}
+	defer configurationFile.Close()
+
+	decoder := json.NewDecoder(configurationFile)
+	decoder.DisallowUnknownFields()
+	err = decoder.Decode(&configuration)
+	if err != nil {
+		return configuration, fmt.Errorf("Could not parse fixture configuration (%s): %w", configurationPath, err)
+	}
+	for output, comparator := range configuration.Comparators {
+		if comparator.Type == "" {
+			comparator.Type = ComparatorExact
+		}
+		if !ValidComparators[comparator.Type] {
+			return configuration, fmt.Errorf("Invalid comparator (%s) for output (%s)", comparator.Type, output)
+		}
+		if comparator.Tolerance < 0 {
+			return configuration, fmt.Errorf("Invalid tolerance (%f) for output (%s): must not be negative", comparator.Tolerance, output)
+		}
+		configuration.Comparators[output] = comparator
+	}
+	return configuration, nil
+}
+
+// RunGoldenTest executes the flow with the given ID against the fixture inputs in the given
+// fixtures directory and compares the outputs that it produces against the golden outputs stored
+// there. The paths of the flow's declared inputs which have fixtures are replaced by the fixtures
+// (see WithPathSubstitutions), and the paths of its declared outputs which have golden outputs are
+// replaced by paths in a temporary directory, so that the test neither reads real inputs nor
+// overwrites real outputs. An error is returned only if the test could not be set up - the failure
+// of the flow run is reported on the result.
+// This is the handler for `shn flows test`
+func RunGoldenTest(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	outstream io.Writer,
+	stateDir string,
+	flowID string,
+	fixturesDir string,
+) (GoldenTestResult, error) {
+	result := GoldenTestResult{FlowID: flowID, Outputs: []OutputComparison{}}
+
+	flow, err := SelectFlowByID(store, flowID)
+	if err != nil {
+		return result, err
+	}
+	specification, err := ReadRegisteredSpecification(flow)
+	if err != nil {
+		return result, err
+	}
+	configuration, err := ReadFixtureConfiguration(fixturesDir)
+	if err != nil {
+		return result, err
+	}
+	fixturesDir, err = filepath.Abs(fixturesDir)
+	if err != nil {
+		return result, fmt.Errorf("Could not resolve fixtures directory: %w", err)
+	}
+
+	outputsDir, err := ioutil.TempDir("", "shnorky-flow-test-")
+	if err != nil {
+		return result, fmt.Errorf("Could not create directory for test outputs: %w", err)
+	}
+	defer os.RemoveAll(outputsDir)
+
+	substitutions := map[string]string{}
+	for name, input := range specification.Inputs {
+		fixturePath := filepath.Join(fixturesDir, FixtureInputsDirName, name)
+		if _, err := os.Stat(fixturePath); input.Path != "" && err == nil {
+			substitutions[input.Path] = fixturePath
+		}
+	}
+
+	// goldenPaths and outputPaths map output names to the paths of their golden outputs and to the
+	// paths that the test run writes them to
+	goldenPaths := map[string]string{}
+	outputPaths := map[string]string{}
+	for name, output := range specification.Outputs {
+		goldenPath := filepath.Join(fixturesDir, FixtureExpectedDirName, name)
+		goldenInfo, err := os.Stat(goldenPath)
+		if err != nil {
+			continue
+		}
+		// Outputs are mounted into containers, so they must exist (as files or directories,
+		// whichever their golden outputs are) before the flow runs
+		outputPath := filepath.Join(outputsDir, name)
+		if goldenInfo.IsDir() {
+			err = os.Mkdir(outputPath, 0777)
+		} else {
+			err = ioutil.WriteFile(outputPath, []byte{}, 0666)
+		}
+		if err != nil {
+			return result, fmt.Errorf("Could not create test output (%s): %w", name, err)
+		}
+		goldenPaths[name] = goldenPath
+		outputPaths[name] = outputPath
+		substitutions[output.Path] = outputPath
+	}
+	if len(goldenPaths) == 0 {
+		return result, fmt.Errorf("No golden outputs for the outputs of flow (%s) in fixtures directory: %s", flowID, filepath.Join(fixturesDir, FixtureExpectedDirName))
+	}
+	for name := range configuration.Comparators {
+		if _, ok := goldenPaths[name]; !ok {
+			return result, fmt.Errorf("Comparator given for output (%s) which has no golden output", name)
+		}
+	}
+
+	ctx = WithPathSubstitutions(ctx, substitutions)
+	if len(configuration.Parameters) > 0 {
+		ctx = WithParameters(ctx, configuration.Parameters)
+	}
+	run, _, runErr := Execute(ctx, store, dockerClient, outstream, stateDir, flowID)
+	result.RunID = run.ID
+	if runErr != nil {
+		result.Error = runErr.Error()
+		return result, nil
+	}
+
+	names := make([]string, 0, len(goldenPaths))
+	for name := range goldenPaths {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	result.Passed = true
+	for _, name := range names {
+		comparator, ok := configuration.Comparators[name]
+		if !ok {
+			comparator = ComparatorSpecification{Type: ComparatorExact}
+		}
+		differences := CompareOutputs(outputPaths[name], goldenPaths[name], comparator)
+		comparison := OutputComparison{Output: name, Comparator: comparator.Type, Passed: len(differences) == 0}
+		if len(differences) > MaxReportedDifferences {
+			differences = append(differences[:MaxReportedDifferences], fmt.Sprintf("... and %d more differences", len(differences)-MaxReportedDifferences))
+		}
+		comparison.Differences = differences
+		result.Outputs = append(result.Outputs, comparison)
+		result.Passed = result.Passed && comparison.Passed
+	}
+
+	return result, nil
+}
+
+// CompareOutputs compares the output at actualPath against the golden output at expectedPath using
+// the given comparator, and returns the differences between them (which are empty if the output
+// matches). Directories are compared file by file, using the comparator for each file.
+func CompareOutputs(actualPath, expectedPath string, comparator ComparatorSpecification) []string {
+	expectedFiles, err := listFiles(expectedPath)
+	if err != nil {
+		return []string{fmt.Sprintf("Could not read golden output: %s", err.Error())}
+	}
+	actualFiles, err := listFiles(actualPath)
+	if err != nil {
+		return []string{fmt.Sprintf("Could not read output: %s", err.Error())}
+	}
+
+	differences := []string{}
+	for _, name := range expectedFiles {
+		actualFile := filepath.Join(actualPath, name)
+		if _, err := os.Stat(actualFile); err != nil {
+			differences = append(differences, fmt.Sprintf("%s: missing", name))
+			continue
+		}
+		for _, difference := range compareFiles(actualFile, filepath.Join(expectedPath, name), comparator) {
+			if name != "." {
+				difference = fmt.Sprintf("%s: %s", name, difference)
+			}
+			differences = append(differences, difference)
+		}
+	}
+	expected := map[string]bool{}
+	for _, name := range expectedFiles {
+		expected[name] = true
+	}
+	for _, name := range actualFiles {
+		if !expected[name] {
+			differences = append(differences, fmt.Sprintf("%s: unexpected file", name))
+		}
+	}
+	return differences
+}
+
+// listFiles returns the paths (relative to the given path, in lexicographic order) of the regular
+// files under the given directory, or "." if the given path is a file
+func listFiles(path string) ([]string, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return []string{"."}, nil
+	}
+
+	files := []string{}
+	err = filepath.Walk(path, func(filePath string, fileInfo os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if fileInfo.Mode().IsRegular() {
+			relativePath, err := filepath.Rel(path, filePath)
+			if err != nil {
+				return err
+			}
+			files = append(files, relativePath)
+		}
+		return nil
+	})
+	sort.Strings(files)
+	return files, err
+}
+
+// compareFiles compares the file at actualPath against the file at expectedPath using the given
+// comparator
+func compareFiles(actualPath, expectedPath string, comparator ComparatorSpecification) []string {
+	actual, err := ioutil.ReadFile(actualPath)
+	if err != nil {
+		return []string{fmt.Sprintf("could not read output: %s", err.Error())}
+	}
+	expected, err := ioutil.ReadFile(expectedPath)
+	if err != nil {
+		return []string{fmt.Sprintf("could not read golden output: %s", err.Error())}
+	}
+
+	switch comparator.Type {
+	case ComparatorCSVUnordered:
+		return compareCSVUnordered(string(actual), string(expected))
+	case ComparatorNumeric:
+		return compareNumeric(string(actual), string(expected), comparator.Tolerance)
+	default:
+		return compareExact(string(actual), string(expected))
+	}
+}
+
+// compareExact reports the first line at which the given contents differ
+func compareExact(actual, expected string) []string {
+	if actual == expected {
+		return []string{}
+	}
+	actualLines := strings.Split(actual, "\n")
+	expectedLines := strings.Split(expected, "\n")
+	for i := 0; i < len(actualLines) && i < len(expectedLines); i++ {
+		if actualLines[i] != expectedLines[i] {
+			return []string{fmt.Sprintf("line %d: expected %q, got %q", i+1, expectedLines[i], actualLines[i])}
+		}
+	}
+	return []string{fmt.Sprintf("expected %d lines, got %d", len(expectedLines), len(actualLines))}
+}
+
+// compareCSVUnordered reports the header mismatch (if any) and the data rows which appear more
+// often in one of the given CSV contents than in the other
+func compareCSVUnordered(actual, expected string) []string {
+	actualRows, err := csv.NewReader(strings.NewReader(actual)).ReadAll()
+	if err != nil {
+		return []string{fmt.Sprintf("could not parse output as CSV: %s", err.Error())}
+	}
+	expectedRows, err := csv.NewReader(strings.NewReader(expected)).ReadAll()
+	if err != nil {
+		return []string{fmt.Sprintf("could not parse golden output as CSV: %s", err.Error())}
+	}
+	if len(actualRows) == 0 || len(expectedRows) == 0 {
+		if len(actualRows) == len(expectedRows) {
+			return []string{}
+		}
+		return []string{fmt.Sprintf("expected %d rows, got %d", len(expectedRows), len(actualRows))}
+	}
+
+	differences := []string{}
+	actualHeader := strings.Join(actualRows[0], ",")
+	expectedHeader := strings.Join(expectedRows[0], ",")
+	if actualHeader != expectedHeader {
+		differences = append(differences, fmt.Sprintf("header: expected %q, got %q", expectedHeader, actualHeader))
+	}
+
+	// counts maps rows to the number of times they appear in the output less the number of times
+	// they appear in the golden output
+	counts := map[string]int{}
+	for _, row := range actualRows[1:] {
+		counts[strings.Join(row, ",")]++
+	}
+	for _, row := range expectedRows[1:] {
+		counts[strings.Join(row, ",")]--
+	}
+	rows := make([]string, 0, len(counts))
+	for row, count := range counts {
+		if count != 0 {
+			rows = append(rows, row)
+		}
+	}
+	sort.Strings(rows)
+	for _, row := range rows {
+		if counts[row] > 0 {
+			differences = append(differences, fmt.Sprintf("unexpected row (x%d): %q", counts[row], row))
+		} else {
+			differences = append(differences, fmt.Sprintf("missing row (x%d): %q", -counts[row], row))
+		}
+	}
+	return differences
+}
+
+// compareNumeric compares the given contents token by token, where tokens are separated by
+// whitespace and commas. Tokens which parse as numbers in both contents may differ by up to the
+// given tolerance; other tokens must be identical.
+func compareNumeric(actual, expected string, tolerance float64) []string {
+	separator := func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t' || r == '\n' || r == '\r'
+	}
+	actualTokens := strings.FieldsFunc(actual, separator)
+	expectedTokens := strings.FieldsFunc(expected, separator)
+
+	differences := []string{}
+	for i := 0; i < len(actualTokens) && i < len(expectedTokens); i++ {
+		if actualTokens[i] == expectedTokens[i] {
+			continue
+		}
+		actualNumber, actualErr := strconv.ParseFloat(actualTokens[i], 64)
+		expectedNumber, expectedErr := strconv.ParseFloat(expectedTokens[i], 64)
+		if actualErr == nil && expectedErr == nil && math.Abs(actualNumber-expectedNumber) <= tolerance {
+			continue
+		}
+		differences = append(differences, fmt.Sprintf("token %d: expected %q, got %q", i+1, expectedTokens[i], actualTokens[i]))
+	}
+	if len(actualTokens) != len(expectedTokens) {
+		differences = append(differences, fmt.Sprintf("expected %d tokens, got %d", len(expectedTokens), len(actualTokens)))
+	}
+	return differences
+}
+
+// WriteGoldenTestTable writes the given golden-output test result to the given writer as a
+// human-readable table, followed by the differences found for each output
+func WriteGoldenTestTable(w io.Writer, result GoldenTestResult) error {
+	fmt.Fprintf(w, "Flow: %s (run: %s)\n", result.FlowID, result.RunID)
+	if result.Error != "" {
+		fmt.Fprintf(w, "Run failed: %s\n", result.Error)
+		return nil
+	}
+	fmt.Fprintln(w)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "OUTPUT\tCOMPARATOR\tRESULT")
+	for _, comparison := range result.Outputs {
+		status := "passed"
+		if !comparison.Passed {
+			status = "failed"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\n", comparison.Output, comparison.Comparator, status)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	for _, comparison := range result.Outputs {
+		if len(comparison.Differences) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\nDifferences in %s:\n", comparison.Output)
+		for _, difference := range comparison.Differences {
+			fmt.Fprintf(w, "  %s\n", difference)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package flows
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+func TestApplyPathSubstitutions(t *testing.T) {
+	specification := FlowSpecification{
+		Steps: map[string]string{"extract": "extractor", "load": "loader"},
+		Mounts: map[string][]components.MountConfiguration{
+			"extract": {{Source: "/data/inputs/raw.csv", Target: "/shnorky/raw.csv", Method: "bind"}},
+			"load":    {{Source: "/data/outputs/reports", Target: "/shnorky/reports", Method: "bind"}, {Source: "/data/outputs-old", Target: "/shnorky/old", Method: "bind"}},
+		},
+		Stdin:   map[string]string{"load": "/data/inputs/raw.csv"},
+		Inputs:  map[string]InputSpecification{"raw": {Path: "/data/inputs"}, "token": {Env: "TOKEN"}},
+		Outputs: map[string]OutputSpecification{"reports": {Path: "/data/outputs/reports"}},
+	}
+
+	unchanged := applyPathSubstitutions(context.Background(), specification)
+	if !reflect.DeepEqual(unchanged, specification) {
+		t.Errorf("Expected specification to be unchanged without substitutions: %v", unchanged)
+	}
+
+	substitutions := map[string]string{"/data/inputs": "/fixtures/inputs/raw", "/data/outputs": "/tmp/outputs"}
+	substituted := applyPathSubstitutions(WithPathSubstitutions(context.Background(), substitutions), specification)
+	expectedMounts := map[string][]components.MountConfiguration{
+		"extract": {{Source: "/fixtures/inputs/raw/raw.csv", Target: "/shnorky/raw.csv", Method: "bind"}},
+		"load":    {{Source: "/tmp/outputs/reports", Target: "/shnorky/reports", Method: "bind"}, {Source: "/data/outputs-old", Target: "/shnorky/old", Method: "bind"}},
+	}
+	if !reflect.DeepEqual(substituted.Mounts, expectedMounts) {
+		t.Errorf("Unexpected mounts: expected=%v, actual=%v", expectedMounts, substituted.Mounts)
+	}
+	if substituted.Stdin["load"] != "/fixtures/inputs/raw/raw.csv" {
+		t.Errorf("Unexpected stdin path: %s", substituted.Stdin["load"])
+	}
+	expectedInputs := map[string]InputSpecification{"raw": {Path: "/fixtures/inputs/raw"}, "token": {Env: "TOKEN"}}
+	if !reflect.DeepEqual(substituted.Inputs, expectedInputs) {
+		t.Errorf("Unexpected inputs: expected=%v, actual=%v", expectedInputs, substituted.Inputs)
+	}
+	if path := substituted.Outputs["reports"].Path; path != "/tmp/outputs/reports" {
+		t.Errorf("Unexpected output path: %s", path)
+	}
+	if specification.Mounts["extract"][0].Source != "/data/inputs/raw.csv" {
+		t.Error("Applying substitutions modified the original specification")
+	}
+}
+
+func TestReadFixtureConfiguration(t *testing.T) {
+	type configurationTest struct {
+		raw                   string
+		expectedConfiguration FixtureConfiguration
+		returnsError          bool
+	}
+
+	tests := []configurationTest{
+		{
+			raw: `{"comparators": {"report": {"type": "numeric", "tolerance": 0.01}, "counts": {}}, "parameters": {"REGION": "eu"}}`,
+			expectedConfiguration: FixtureConfiguration{
+				Comparators: map[string]ComparatorSpecification{
+					"report": {Type: ComparatorNumeric, Tolerance: 0.01},
+					"counts": {Type: ComparatorExact},
+				},
+				Parameters: map[string]string{"REGION": "eu"},
+			},
+		},
+		{raw: `{"comparators": {"report": {"type": "fuzzy"}}}`, returnsError: true},
+		{raw: `{"comparators": {"report": {"type": "numeric", "tolerance": -1}}}`, returnsError: true},
+		{raw: `{"comparator": {}}`, returnsError: true},
+	}
+
+	for i, test := range tests {
+		dir, err := ioutil.TempDir("", "shnorky-fixture-configuration-tests-")
+		if err != nil {
+			t.Fatalf("Could not create temporary directory: %s", err.Error())
+		}
+		defer os.RemoveAll(dir)
+
+		err = ioutil.WriteFile(filepath.Join(dir, FixtureConfigurationFileName), []byte(test.raw), 0644)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not write fixture configuration: %s", i, err.Error())
+		}
+		configuration, err := ReadFixtureConfiguration(dir)
+		if test.returnsError {
+			if err == nil {
+				t.Errorf("[Test %d] Expected error but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[Test %d] Unexpected error: %s", i, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(configuration, test.expectedConfiguration) {
+			t.Errorf("[Test %d] Unexpected configuration: expected=%v, actual=%v", i, test.expectedConfiguration, configuration)
+		}
+	}
+
+	configuration, err := ReadFixtureConfiguration(os.TempDir())
+	if err != nil || len(configuration.Comparators) != 0 {
+		t.Errorf("Expected empty configuration without configuration file: configuration=%v, err=%v", configuration, err)
+	}
+}
+
+func TestCompareOutputs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shnorky-compare-outputs-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"report.csv":              "region,total\nus,10\neu,20\n",
+		"report-reordered.csv":    "region,total\neu,20\nus,10\n",
+		"report-changed.csv":      "region,total\neu,21\nus,10\n",
+		"report-renamed.csv":      "area,total\nus,10\neu,20\n",
+		"metrics.txt":             "accuracy 0.9512\nloss 0.12, 0.10\n",
+		"metrics-close.txt":       "accuracy 0.9509\nloss 0.1201, 0.1\n",
+		"metrics-far.txt":         "accuracy 0.9\nloss 0.12, 0.10\n",
+		"expected/a.txt":          "a\n",
+		"expected/nested/b.txt":   "b\n",
+		"matching/a.txt":          "a\n",
+		"matching/nested/b.txt":   "b\n",
+		"mismatching/a.txt":       "A\n",
+		"mismatching/unknown.txt": "?\n",
+	}
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		err = os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(contents), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Could not write file (%s): %s", name, err.Error())
+		}
+	}
+
+	type compareTest struct {
+		actual              string
+		expected            string
+		comparator          ComparatorSpecification
+		expectedDifferences int
+	}
+
+	tests := []compareTest{
+		{actual: "report.csv", expected: "report.csv", comparator: ComparatorSpecification{Type: ComparatorExact}, expectedDifferences: 0},
+		{actual: "report-reordered.csv", expected: "report.csv", comparator: ComparatorSpecification{Type: ComparatorExact}, expectedDifferences: 1},
+		{actual: "report-reordered.csv", expected: "report.csv", comparator: ComparatorSpecification{Type: ComparatorCSVUnordered}, expectedDifferences: 0},
+		// eu,21 is unexpected and eu,20 is missing
+		{actual: "report-changed.csv", expected: "report.csv", comparator: ComparatorSpecification{Type: ComparatorCSVUnordered}, expectedDifferences: 2},
+		{actual: "report-renamed.csv", expected: "report.csv", comparator: ComparatorSpecification{Type: ComparatorCSVUnordered}, expectedDifferences: 1},
+		{actual: "metrics-close.txt", expected: "metrics.txt", comparator: ComparatorSpecification{Type: ComparatorNumeric, Tolerance: 0.001}, expectedDifferences: 0},
+		{actual: "metrics-close.txt", expected: "metrics.txt", comparator: ComparatorSpecification{Type: ComparatorNumeric}, expectedDifferences: 2},
+		{actual: "metrics-far.txt", expected: "metrics.txt", comparator: ComparatorSpecification{Type: ComparatorNumeric, Tolerance: 0.001}, expectedDifferences: 1},
+		{actual: "matching", expected: "expected", comparator: ComparatorSpecification{Type: ComparatorExact}, expectedDifferences: 0},
+		// a.txt differs, nested/b.txt is missing, and unknown.txt is unexpected
+		{actual: "mismatching", expected: "expected", comparator: ComparatorSpecification{Type: ComparatorExact}, expectedDifferences: 3},
+		{actual: "missing.csv", expected: "report.csv", comparator: ComparatorSpecification{Type: ComparatorExact}, expectedDifferences: 1},
+	}
+
+	for i, test := range tests {
+		differences := CompareOutputs(filepath.Join(dir, test.actual), filepath.Join(dir, test.expected), test.comparator)
+		if len(differences) != test.expectedDifferences {
+			t.Errorf("[Test %d] Unexpected number of differences: expected=%d, actual=%d (%v)", i, test.expectedDifferences, len(differences), differences)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package flows
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// ReadFlowSpecification reads the specification of the registered flow with the given ID,
+// resolving the label selectors of its steps (see ResolveComponentSelectors) and its references to
+// embedded components (see ResolveEmbeddedComponents)
+func ReadFlowSpecification(store state.Store, flowID string) (FlowSpecification, error) {
+	flow, err := SelectFlowByID(store, flowID)
+	if err != nil {
+		return FlowSpecification{}, err
+	}
+	specification, err := ReadRegisteredSpecification(flow)
+	if err != nil {
+		return specification, err
+	}
+	specification, err = ResolveComponentSelectors(store, specification)
+	if err != nil {
+		return specification, err
+	}
+	return ResolveEmbeddedComponents(flowID, specification), nil
+}
+
+// WriteGraph draws the steps of the given (materialized) flow specification to w as an ASCII
+// graph. Steps are grouped by stage, and each step is annotated with its component and with the
+// steps it depends on. For example:
+//
+//	[stage 1]
+//	  +-- extract (extractor)
+//	  `-- fetch (builtin:http-fetch)
+//	        |
+//	        v
+//	[stage 2]
+//	  `-- load (loader) <- extract, fetch
+//
+// Dependencies which are not of type DependencyAfter are annotated with their types, e.g.
+// "api [requires]".
+func WriteGraph(w io.Writer, specification FlowSpecification) error {
+	stages := specification.Stages
+	if len(stages) == 0 && len(specification.Steps) > 0 {
+		var err error
+		stages, err = CalculateStages(specification)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, stage := range stages {
+		if i > 0 {
+			_, err := fmt.Fprint(w, "        |\n        v\n")
+			if err != nil {
+				return err
+			}
+		}
+		_, err := fmt.Fprintf(w, "[stage %d]\n", i+1)
+		if err != nil {
+			return err
+		}
+
+		steps := append([]string{}, stage...)
+		sort.Strings(steps)
+		for j, step := range steps {
+			branch := "+--"
+			if j == len(steps)-1 {
+				branch = "`--"
+			}
+			line := fmt.Sprintf("  %s %s (%s)", branch, step, specification.Steps[step])
+			dependencies := append([]string{}, specification.Dependencies[step]...)
+			if len(dependencies) > 0 {
+				sort.Strings(dependencies)
+				for k, dependency := range dependencies {
+					if dependencyType := DependencyType(specification, step, dependency); dependencyType != DependencyAfter {
+						dependencies[k] = fmt.Sprintf("%s [%s]", dependency, dependencyType)
+					}
+				}
+				line = fmt.Sprintf("%s <- %s", line, strings.Join(dependencies, ", "))
+			}
+			_, err = fmt.Fprintln(w, line)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,71 @@
+package flows
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestWriteGraph(t *testing.T) {
+	specification, err := MaterializeFlowSpecification(FlowSpecification{
+		Steps: map[string]string{
+			"fetch":   "builtin:http-fetch",
+			"extract": "extractor",
+			"load":    "loader",
+			"report":  "reporter",
+		},
+		Dependencies: map[string][]string{
+			"load":   {"fetch", "extract"},
+			"report": {"load"},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Could not materialize specification: %s", err.Error())
+	}
+
+	var buffer bytes.Buffer
+	err = WriteGraph(&buffer, specification)
+	if err != nil {
+		t.Fatalf("Could not write graph: %s", err.Error())
+	}
+
+	expected := "[stage 1]\n" +
+		"  +-- extract (extractor)\n" +
+		"  `-- fetch (builtin:http-fetch)\n" +
+		"        |\n        v\n" +
+		"[stage 2]\n" +
+		"  `-- load (loader) <- extract, fetch\n" +
+		"        |\n        v\n" +
+		"[stage 3]\n" +
+		"  `-- report (reporter) <- load\n"
+	if buffer.String() != expected {
+		t.Errorf("Unexpected graph:\nexpected:\n%s\nactual:\n%s", expected, buffer.String())
+	}
+}
+
+func TestWriteGraphDependencyTypes(t *testing.T) {
+	specification, err := MaterializeFlowSpecification(FlowSpecification{
+		Steps:        map[string]string{"api": "api", "db": "postgres", "test": "tester"},
+		Dependencies: map[string][]string{"api": {"requires:db"}, "test": {"requires:api", "db"}},
+	})
+	if err != nil {
+		t.Fatalf("Could not materialize specification: %s", err.Error())
+	}
+
+	var buffer bytes.Buffer
+	err = WriteGraph(&buffer, specification)
+	if err != nil {
+		t.Fatalf("Could not write graph: %s", err.Error())
+	}
+
+	expected := "[stage 1]\n" +
+		"  `-- db (postgres)\n" +
+		"        |\n        v\n" +
+		"[stage 2]\n" +
+		"  `-- api (api) <- db [requires]\n" +
+		"        |\n        v\n" +
+		"[stage 3]\n" +
+		"  `-- test (tester) <- api [requires], db\n"
+	if buffer.String() != expected {
+		t.Errorf("Unexpected graph:\nexpected:\n%s\nactual:\n%s", expected, buffer.String())
+	}
+}
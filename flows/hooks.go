@@ -0,0 +1,281 @@
+package flows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"sort"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// ErrInvalidHook signifies that a hook in a flow specification did not specify exactly one of a
+// host command or a component to run
+var ErrInvalidHook = errors.New("Hook must specify exactly one of command or component")
+
+// AllStepsKey is the key in the StepHooks member of a flow specification whose hooks are run around
+// every step in the flow
+var AllStepsKey = "*"
+
+// HookSpecification - specifies a host command or a component which should be run before or after a
+// step or an entire flow
+type HookSpecification struct {
+	// Command is a command (and its arguments) run on the host. Its elements support
+	// "env:<VARIABLE_NAME>" values.
+	Command []string `json:"command,omitempty"`
+	// Component is the ID of a registered component whose most recent build is executed
+	Component string `json:"component,omitempty"`
+	// Env specifies additional environment variables for the hook. Values support
+	// "env:<VARIABLE_NAME>" values.
+	Env map[string]string `json:"env,omitempty"`
+	// Mounts specifies mount configurations for component hooks
+	Mounts []components.MountConfiguration `json:"mounts,omitempty"`
+}
+
+// HooksSpecification - specifies hooks which are run before and after a step or an entire flow
+type HooksSpecification struct {
+	Before []HookSpecification `json:"before,omitempty"`
+	After  []HookSpecification `json:"after,omitempty"`
+}
+
+// Environment variables through which hooks are told about the context they are running in
+var (
+	HookEnvFlowID      = "SHNORKY_FLOW_ID"
+	HookEnvRunID       = "SHNORKY_RUN_ID"
+	HookEnvHook        = "SHNORKY_HOOK"
+	HookEnvStep        = "SHNORKY_STEP"
+	HookEnvComponentID = "SHNORKY_COMPONENT_ID"
+	HookEnvExecutionID = "SHNORKY_EXECUTION_ID"
+	HookEnvExitCode    = "SHNORKY_EXIT_CODE"
+	HookEnvRunStatus   = "SHNORKY_RUN_STATUS"
+	HookEnvStepStatus  = "SHNORKY_STEP_STATUS"
+)
+
+// MaterializeHookSpecification validates the given hook specification and renders any special
+// values in it
+func MaterializeHookSpecification(rawHook HookSpecification) (HookSpecification, error) {
+	if (len(rawHook.Command) == 0) == (rawHook.Component == "") {
+		return rawHook, ErrInvalidHook
+	}
+	if rawHook.Component == "" && len(rawHook.Mounts) > 0 {
+		return rawHook, errors.New("Mounts can only be specified for component hooks")
+	}
+
+	materializedHook := HookSpecification{Component: rawHook.Component}
+
+	if len(rawHook.Command) > 0 {
+		materializedHook.Command = make([]string, len(rawHook.Command))
+		for i, value := range rawHook.Command {
+			materializedValue, err := components.MaterializeEnv(value)
+			if err != nil {
+				return rawHook, err
+			}
+			materializedHook.Command[i] = materializedValue
+		}
+	}
+
+	materializedHook.Env = map[string]string{}
+	for key, value := range rawHook.Env {
+		materializedValue, err := components.MaterializeEnv(value)
+		if err != nil {
+			return rawHook, fmt.Errorf("Could not materialize environment variable (%s): %w", key, err)
+		}
+		materializedHook.Env[key] = materializedValue
+	}
+
+	materializedHook.Mounts = make([]components.MountConfiguration, len(rawHook.Mounts))
+	for i, rawConfig := range rawHook.Mounts {
+		materializedConfig, err := components.MaterializeMountConfiguration(rawConfig)
+		if err != nil {
+			return materializedHook, err
+		}
+		materializedHook.Mounts[i] = materializedConfig
+	}
+
+	return materializedHook, nil
+}
+
+// MaterializeHooksSpecification materializes each of the before and after hooks in the given hooks
+// specification
+func MaterializeHooksSpecification(rawHooks HooksSpecification) (HooksSpecification, error) {
+	materializedHooks := HooksSpecification{
+		Before: make([]HookSpecification, len(rawHooks.Before)),
+		After:  make([]HookSpecification, len(rawHooks.After)),
+	}
+	for i, rawHook := range rawHooks.Before {
+		materializedHook, err := MaterializeHookSpecification(rawHook)
+		if err != nil {
+			return materializedHooks, fmt.Errorf("Invalid before hook %d: %w", i, err)
+		}
+		materializedHooks.Before[i] = materializedHook
+	}
+	for i, rawHook := range rawHooks.After {
+		materializedHook, err := MaterializeHookSpecification(rawHook)
+		if err != nil {
+			return materializedHooks, fmt.Errorf("Invalid after hook %d: %w", i, err)
+		}
+		materializedHooks.After[i] = materializedHook
+	}
+	return materializedHooks, nil
+}
+
+// HookComponents returns the IDs of all the components used as hooks or step outcome handlers in
+// the given flow specification, in lexicographic order
+func HookComponents(specification FlowSpecification) []string {
+	componentIDs := map[string]bool{}
+	addHooks := func(hooks []HookSpecification) {
+		for _, hook := range hooks {
+			if hook.Component != "" {
+				componentIDs[hook.Component] = true
+			}
+		}
+	}
+	addHooks(specification.Hooks.Before)
+	addHooks(specification.Hooks.After)
+	for _, stepHooks := range specification.StepHooks {
+		addHooks(stepHooks.Before)
+		addHooks(stepHooks.After)
+	}
+	for _, handlers := range specification.OnSuccess {
+		addHooks(handlers)
+	}
+	for _, handlers := range specification.OnFailure {
+		addHooks(handlers)
+	}
+
+	sortedIDs := make([]string, 0, len(componentIDs))
+	for componentID := range componentIDs {
+		sortedIDs = append(sortedIDs, componentID)
+	}
+	sort.Strings(sortedIDs)
+	return sortedIDs
+}
+
+// beforeStepHooks returns the hooks which should be run before the given step - the hooks for all
+// steps followed by the hooks specific to that step
+func beforeStepHooks(specification FlowSpecification, step string) []HookSpecification {
+	hooks := append([]HookSpecification{}, specification.StepHooks[AllStepsKey].Before...)
+	return append(hooks, specification.StepHooks[step].Before...)
+}
+
+// afterStepHooks returns the hooks which should be run after the given step - the hooks specific to
+// that step followed by the hooks for all steps
+func afterStepHooks(specification FlowSpecification, step string) []HookSpecification {
+	hooks := append([]HookSpecification{}, specification.StepHooks[step].After...)
+	return append(hooks, specification.StepHooks[AllStepsKey].After...)
+}
+
+// hookRunner runs the hooks of a single flow run
+type hookRunner struct {
+	store        state.Store
+	dockerClient *docker.Client
+	outstream    io.Writer
+	run          FlowRunMetadata
+	// buildIDs maps the IDs of components used as hooks to the IDs of the builds that are executed
+	// when running those hooks
+	buildIDs map[string]string
+	// scratchDir is the scratch directory of the flow run (on the host)
+	scratchDir string
+	// network is the docker network of the flow run, which component hooks are attached to
+	network string
+}
+
+// runHooks runs the given hooks in order, stopping at the first hook which fails. name identifies
+// the hooks in executions and error messages (e.g. "before:<step>"), and env describes the context
+// in which they are running.
+func (runner *hookRunner) runHooks(ctx context.Context, hooks []HookSpecification, name string, env map[string]string) error {
+	for i, hook := range hooks {
+		hookEnv := map[string]string{HookEnvFlowID: runner.run.FlowID, HookEnvRunID: runner.run.ID, HookEnvHook: name}
+		for key, value := range env {
+			hookEnv[key] = value
+		}
+		for key, value := range hook.Env {
+			hookEnv[key] = value
+		}
+
+		var err error
+		if hook.Component != "" {
+			err = runner.runComponentHook(ctx, hook, name, hookEnv)
+		} else {
+			err = runner.runCommandHook(ctx, hook, hookEnv)
+		}
+		if err != nil {
+			return fmt.Errorf("Hook %d (%s) failed: %w", i, name, err)
+		}
+	}
+	return nil
+}
+
+// runHandlers runs the given step outcome handlers in the same way as runHooks. Handlers do not
+// affect the outcome of the flow run, so failures are only reported on the runner's outstream (if
+// it is not nil).
+func (runner *hookRunner) runHandlers(ctx context.Context, handlers []HookSpecification, name string, env map[string]string) {
+	err := runner.runHooks(ctx, handlers, name, env)
+	if err != nil && runner.outstream != nil {
+		fmt.Fprintf(runner.outstream, "Warning: step outcome handler failed in run (%s): %s\n", runner.run.ID, err.Error())
+	}
+}
+
+// runCommandHook runs the command for the given hook on the host, with the given environment
+// variables set on top of the environment of the shnorky process
+func (runner *hookRunner) runCommandHook(ctx context.Context, hook HookSpecification, env map[string]string) error {
+	cmd := exec.CommandContext(ctx, hook.Command[0], hook.Command[1:]...)
+	cmd.Env = os.Environ()
+	if runner.scratchDir != "" {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", ScratchDirEnv, runner.scratchDir))
+	}
+	for key, value := range env {
+		cmd.Env = append(cmd.Env, fmt.Sprintf("%s=%s", key, value))
+	}
+	cmd.Stdout = ioutil.Discard
+	cmd.Stderr = ioutil.Discard
+	if runner.outstream != nil {
+		cmd.Stdout = runner.outstream
+		cmd.Stderr = runner.outstream
+	}
+	return cmd.Run()
+}
+
+// runComponentHook executes the most recent build of the component for the given hook as part of
+// the flow run and waits for it to finish successfully
+func (runner *hookRunner) runComponentHook(ctx context.Context, hook HookSpecification, name string, env map[string]string) error {
+	buildID, ok := runner.buildIDs[hook.Component]
+	if !ok {
+		return fmt.Errorf("No build for hook component (%s)", hook.Component)
+	}
+
+	mounts, err := renderMounts(runner.run, name, hook.Mounts)
+	if err != nil {
+		return err
+	}
+	mounts, env = withScratch(runner.scratchDir, mounts, env)
+
+	executionMetadata, err := components.ExecuteWithOptions(
+		ctx,
+		runner.store,
+		runner.dockerClient,
+		components.WithBuild(buildID),
+		components.WithFlowRun(runner.run.FlowID, runner.run.ID, name),
+		components.WithMounts(mounts...),
+		components.WithEnv(env),
+		components.WithNetwork(runner.network),
+	)
+	if err != nil {
+		return err
+	}
+	executionMetadata, err = components.WaitForExecution(ctx, runner.store, runner.dockerClient, executionMetadata.ID)
+	if err != nil {
+		return err
+	}
+	if *executionMetadata.ExitCode != 0 {
+		return fmt.Errorf("Hook component (%s) failed: %w", hook.Component, components.NewExecutionFailedError(executionMetadata))
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package flows
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+func TestMaterializeHookSpecification(t *testing.T) {
+	type materializeHookTest struct {
+		rawHook      HookSpecification
+		returnsError bool
+	}
+
+	testCases := []materializeHookTest{
+		{rawHook: HookSpecification{Command: []string{"echo", "hello"}}, returnsError: false},
+		{rawHook: HookSpecification{Component: "cleanup"}, returnsError: false},
+		{rawHook: HookSpecification{}, returnsError: true},
+		{rawHook: HookSpecification{Command: []string{"echo"}, Component: "cleanup"}, returnsError: true},
+		{rawHook: HookSpecification{Command: []string{"echo"}, Mounts: []components.MountConfiguration{{Source: "/tmp", Target: "/tmp", Method: "bind"}}}, returnsError: true},
+	}
+
+	for i, testCase := range testCases {
+		_, err := MaterializeHookSpecification(testCase.rawHook)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		}
+	}
+}
+
+func TestStepHooksOrder(t *testing.T) {
+	specification := FlowSpecification{
+		Steps: map[string]string{"a": "component-a", "b": "component-b"},
+		StepHooks: map[string]HooksSpecification{
+			AllStepsKey: {
+				Before: []HookSpecification{{Command: []string{"all-before"}}},
+				After:  []HookSpecification{{Command: []string{"all-after"}}},
+			},
+			"a": {
+				Before: []HookSpecification{{Command: []string{"a-before"}}},
+				After:  []HookSpecification{{Component: "a-after"}},
+			},
+		},
+	}
+
+	before := beforeStepHooks(specification, "a")
+	if len(before) != 2 || before[0].Command[0] != "all-before" || before[1].Command[0] != "a-before" {
+		t.Errorf("Unexpected before hooks for step a: %v", before)
+	}
+	after := afterStepHooks(specification, "a")
+	if len(after) != 2 || after[0].Component != "a-after" || after[1].Command[0] != "all-after" {
+		t.Errorf("Unexpected after hooks for step a: %v", after)
+	}
+	if len(beforeStepHooks(specification, "b")) != 1 || len(afterStepHooks(specification, "b")) != 1 {
+		t.Errorf("Expected only the hooks for all steps to run around step b")
+	}
+
+	hookComponents := HookComponents(specification)
+	if len(hookComponents) != 1 || hookComponents[0] != "a-after" {
+		t.Errorf("Unexpected hook components: %v", hookComponents)
+	}
+}
+
+// TestRunCommandHooks runs host command hooks which record their environment and checks that they
+// see the context of the step they were run for
+func TestRunCommandHooks(t *testing.T) {
+	outputDir, err := ioutil.TempDir("", "shnorky-hooks-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(outputDir)
+
+	outputPath := path.Join(outputDir, "hook.txt")
+	hooks := []HookSpecification{
+		{
+			Command: []string{"sh", "-c", "echo \"$SHNORKY_RUN_ID $SHNORKY_HOOK $SHNORKY_STEP $CUSTOM\" > " + outputPath},
+			Env:     map[string]string{"CUSTOM": "custom"},
+		},
+	}
+
+	runner := &hookRunner{run: FlowRunMetadata{ID: "run", FlowID: "flow"}}
+	err = runner.runHooks(context.Background(), hooks, "before:a", map[string]string{HookEnvStep: "a"})
+	if err != nil {
+		t.Fatalf("Unexpected error running hooks: %s", err.Error())
+	}
+
+	output, err := ioutil.ReadFile(outputPath)
+	if err != nil {
+		t.Fatalf("Could not read hook output: %s", err.Error())
+	}
+	if strings.TrimSpace(string(output)) != "run before:a a custom" {
+		t.Errorf("Unexpected hook output: %s", string(output))
+	}
+
+	err = runner.runHooks(context.Background(), []HookSpecification{{Command: []string{"false"}}}, "after", map[string]string{})
+	if err == nil {
+		t.Error("Expected error from failing hook")
+	}
+}
+
+// TestRunHandlers checks that failing step outcome handlers are reported on the runner's outstream
+// instead of being returned as errors
+func TestRunHandlers(t *testing.T) {
+	var outstream bytes.Buffer
+	runner := &hookRunner{outstream: &outstream, run: FlowRunMetadata{ID: "run", FlowID: "flow"}}
+	runner.runHandlers(context.Background(), []HookSpecification{{Command: []string{"false"}}}, "on_failure:a", map[string]string{HookEnvStepStatus: RunStatusFailed})
+	if !strings.Contains(outstream.String(), "on_failure:a") {
+		t.Errorf("Expected failing handler to be reported on outstream: %s", outstream.String())
+	}
+}
+
+func TestMaterializeStepHandlers(t *testing.T) {
+	steps := map[string]string{"a": "component-a"}
+
+	handlers, err := materializeStepHandlers(steps, map[string][]HookSpecification{"a": {{Component: "alert"}}})
+	if err != nil {
+		t.Fatalf("Unexpected error materializing handlers: %s", err.Error())
+	}
+	if len(handlers["a"]) != 1 || handlers["a"][0].Component != "alert" {
+		t.Errorf("Unexpected materialized handlers: %v", handlers)
+	}
+
+	_, err = materializeStepHandlers(steps, map[string][]HookSpecification{"b": {{Component: "alert"}}})
+	if err == nil {
+		t.Error("Expected error materializing handlers for unknown step")
+	}
+
+	_, err = materializeStepHandlers(steps, map[string][]HookSpecification{"a": {{}}})
+	if err == nil {
+		t.Error("Expected error materializing invalid handler")
+	}
+}
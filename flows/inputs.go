@@ -0,0 +1,117 @@
+package flows
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+// ErrInvalidInput signifies that a declared flow input did not specify exactly one of a path or an
+// environment variable
+var ErrInvalidInput = errors.New("Flow input must specify exactly one of path or env")
+
+// InputSpecification - declares an input that a flow requires in order to run. An input is either
+// a path on the host (a file or directory which must exist) or a parameter passed to the flow
+// through an environment variable (which must be set).
+type InputSpecification struct {
+	// Path is the path of the input on the host. Supports "env:<VARIABLE_NAME>" values and the
+	// same placeholders as mount configurations (e.g. "{{date}}").
+	Path string `json:"path,omitempty"`
+	// Env is the name of the environment variable through which the input is passed to the flow
+	Env string `json:"env,omitempty"`
+	// Description documents the input for users of the flow
+	Description string `json:"description,omitempty"`
+}
+
+// OutputSpecification - declares an output that a flow produces. The output must exist on the host
+// once all the steps of the flow have completed.
+type OutputSpecification struct {
+	// Path is the path of the output on the host. Supports "env:<VARIABLE_NAME>" values and the
+	// same placeholders as mount configurations (e.g. "{{run_id}}").
+	Path string `json:"path"`
+	// Description documents the output for users of the flow
+	Description string `json:"description,omitempty"`
+}
+
+// MaterializeInputSpecification validates the given input specification and resolves its path (if
+// any) to an absolute path
+func MaterializeInputSpecification(rawInput InputSpecification) (InputSpecification, error) {
+	if (rawInput.Path == "") == (rawInput.Env == "") {
+		return rawInput, ErrInvalidInput
+	}
+
+	materializedInput := InputSpecification{Env: rawInput.Env, Description: rawInput.Description}
+	if rawInput.Path != "" {
+		absolutePath, err := materializePath(rawInput.Path)
+		if err != nil {
+			return rawInput, err
+		}
+		materializedInput.Path = absolutePath
+	}
+	return materializedInput, nil
+}
+
+// MaterializeOutputSpecification validates the given output specification and resolves its path to
+// an absolute path
+func MaterializeOutputSpecification(rawOutput OutputSpecification) (OutputSpecification, error) {
+	if rawOutput.Path == "" {
+		return rawOutput, errors.New("Flow output must specify a path")
+	}
+	absolutePath, err := materializePath(rawOutput.Path)
+	if err != nil {
+		return rawOutput, err
+	}
+	return OutputSpecification{Path: absolutePath, Description: rawOutput.Description}, nil
+}
+
+// ValidateInputs checks that all the inputs declared in the given flow specification are
+// available for the given flow run. The returned error lists every missing input.
+func ValidateInputs(specification FlowSpecification, run FlowRunMetadata) error {
+	variables := TemplateVariables(run, "")
+	missing := []string{}
+	for name, input := range specification.Inputs {
+		if input.Env != "" {
+			if !components.EnvironmentPolicy.Permits(input.Env) {
+				missing = append(missing, fmt.Sprintf("%s (environment variable %s is not permitted by the environment policy)", name, input.Env))
+				continue
+			}
+			if _, ok := os.LookupEnv(input.Env); !ok {
+				missing = append(missing, fmt.Sprintf("%s (environment variable %s is not set)", name, input.Env))
+			}
+			continue
+		}
+		path := components.RenderTemplate(input.Path, variables)
+		if _, err := os.Stat(path); err != nil {
+			missing = append(missing, fmt.Sprintf("%s (%s does not exist)", name, path))
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("Missing flow inputs: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// VerifyOutputs checks that all the outputs declared in the given flow specification were
+// produced by the given flow run. The returned error lists every missing output.
+func VerifyOutputs(specification FlowSpecification, run FlowRunMetadata) error {
+	variables := TemplateVariables(run, "")
+	missing := []string{}
+	for name, output := range specification.Outputs {
+		path := components.RenderTemplate(output.Path, variables)
+		if _, err := os.Stat(path); err != nil {
+			missing = append(missing, fmt.Sprintf("%s (%s does not exist)", name, path))
+		}
+	}
+
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("Missing flow outputs: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package flows
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMaterializeInputSpecification(t *testing.T) {
+	type inputTest struct {
+		input        InputSpecification
+		returnsError bool
+	}
+
+	testCases := []inputTest{
+		{input: InputSpecification{Path: "/tmp/inputs.txt"}, returnsError: false},
+		{input: InputSpecification{Env: "MY_PARAMETER"}, returnsError: false},
+		{input: InputSpecification{}, returnsError: true},
+		{input: InputSpecification{Path: "/tmp/inputs.txt", Env: "MY_PARAMETER"}, returnsError: true},
+	}
+
+	for i, testCase := range testCases {
+		_, err := MaterializeInputSpecification(testCase.input)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		}
+	}
+
+	_, err := MaterializeOutputSpecification(OutputSpecification{})
+	if err == nil {
+		t.Errorf("Expected error materializing output without a path")
+	}
+}
+
+func TestValidateInputsAndVerifyOutputs(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "shnorky-inputs-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dataDir)
+
+	run := FlowRunMetadata{ID: "run", FlowID: "flow", CreatedAt: time.Date(2020, 3, 1, 0, 0, 0, 0, time.UTC)}
+
+	err = ioutil.WriteFile(filepath.Join(dataDir, "inputs.txt"), []byte("inputs"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write input file: %s", err.Error())
+	}
+	os.Setenv("SHNORKY_TEST_PARAMETER", "value")
+	defer os.Unsetenv("SHNORKY_TEST_PARAMETER")
+
+	specification := FlowSpecification{
+		Inputs: map[string]InputSpecification{
+			"data":      {Path: filepath.Join(dataDir, "inputs.txt")},
+			"parameter": {Env: "SHNORKY_TEST_PARAMETER"},
+		},
+		Outputs: map[string]OutputSpecification{
+			"report": {Path: filepath.Join(dataDir, "{{run_id}}", "report.txt")},
+		},
+	}
+
+	err = ValidateInputs(specification, run)
+	if err != nil {
+		t.Errorf("Unexpected error validating available inputs: %s", err.Error())
+	}
+
+	specification.Inputs["missing"] = InputSpecification{Env: "SHNORKY_TEST_MISSING_PARAMETER"}
+	err = ValidateInputs(specification, run)
+	if err == nil {
+		t.Errorf("Expected error validating inputs with a missing parameter")
+	}
+
+	err = VerifyOutputs(specification, run)
+	if err == nil {
+		t.Errorf("Expected error verifying outputs before they were produced")
+	}
+
+	err = os.MkdirAll(filepath.Join(dataDir, "run"), 0755)
+	if err != nil {
+		t.Fatalf("Could not create output directory: %s", err.Error())
+	}
+	err = ioutil.WriteFile(filepath.Join(dataDir, "run", "report.txt"), []byte("report"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write output file: %s", err.Error())
+	}
+	err = VerifyOutputs(specification, run)
+	if err != nil {
+		t.Errorf("Unexpected error verifying produced outputs: %s", err.Error())
+	}
+}
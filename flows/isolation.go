@@ -0,0 +1,113 @@
+package flows
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// RunNetworkPrefix is the prefix of the names of the docker networks created for flow runs. Each
+// run gets its own network (named after the run ID), so the containers of concurrent runs of the
+// same flow cannot reach each other.
+var RunNetworkPrefix = "shnorky-run-"
+
+// Kinds of resources which a flow run must not share with other unfinished runs
+var (
+	RunResourceNetwork    = "network"
+	RunResourceScratchDir = "scratch_dir"
+	RunResourceOutput     = "output"
+)
+
+// RunResource - a resource (e.g. a docker network or a path on the host) used by a flow run
+type RunResource struct {
+	FlowRunID string `json:"flow_run_id"`
+	Kind      string `json:"kind"`
+	Name      string `json:"name"`
+}
+
+// RunNetworkName returns the name of the docker network for the flow run with the given ID
+func RunNetworkName(runID string) string {
+	return RunNetworkPrefix + runID
+}
+
+// RunResources returns the resources which the given run of a flow with the given specification
+// uses, and which no other unfinished run may use at the same time: its docker network, its scratch
+// directory, and the paths of the outputs declared in the specification (with their placeholders
+// rendered for the run).
+func RunResources(specification FlowSpecification, run FlowRunMetadata, scratchDir string) []RunResource {
+	resources := []RunResource{
+		{FlowRunID: run.ID, Kind: RunResourceNetwork, Name: RunNetworkName(run.ID)},
+		{FlowRunID: run.ID, Kind: RunResourceScratchDir, Name: scratchDir},
+	}
+	variables := TemplateVariables(run, "")
+	outputs := []string{}
+	for name := range specification.Outputs {
+		outputs = append(outputs, name)
+	}
+	sort.Strings(outputs)
+	for _, name := range outputs {
+		path := components.RenderTemplate(specification.Outputs[name].Path, variables)
+		resources = append(resources, RunResource{FlowRunID: run.ID, Kind: RunResourceOutput, Name: path})
+	}
+	return resources
+}
+
+// ClaimRunResources records the given resources against the given flow run in the state database.
+// If any of them is already used by another unfinished flow run, nothing is recorded and an error
+// describing the conflicts is returned.
+func ClaimRunResources(store state.Store, run FlowRunMetadata, resources []RunResource) error {
+	records := make([]state.RunResourceRecord, len(resources))
+	for i, resource := range resources {
+		records[i] = state.RunResourceRecord(resource)
+	}
+	conflicts, err := store.ClaimRunResources(run.ID, records)
+	if err != nil {
+		return err
+	}
+	if len(conflicts) > 0 {
+		descriptions := make([]string, len(conflicts))
+		for i, conflict := range conflicts {
+			descriptions[i] = fmt.Sprintf("%s %s (run %s)", conflict.Kind, conflict.Name, conflict.FlowRunID)
+		}
+		return fmt.Errorf("Flow run (%s) would share resources with unfinished runs: %s - use the {{run_id}} placeholder to give each run its own paths", run.ID, strings.Join(descriptions, ", "))
+	}
+	return nil
+}
+
+// RunConflicts returns the resources of the given flow run which are also used by other unfinished
+// flow runs. Runs which were started by Execute never share resources, so this is empty unless the
+// state database has been modified by other means.
+func RunConflicts(store state.Store, runID string) ([]RunResource, error) {
+	records, err := store.SelectRunResourceConflicts(runID)
+	resources := make([]RunResource, len(records))
+	for i, record := range records {
+		resources[i] = RunResource(record)
+	}
+	return resources, err
+}
+
+// isolateRun claims the resources of the given flow run and creates its docker network. It returns
+// the name of the network.
+func isolateRun(ctx context.Context, store state.Store, dockerClient *docker.Client, run FlowRunMetadata, specification FlowSpecification, scratchDir string) (string, error) {
+	err := ClaimRunResources(store, run, RunResources(specification, run, scratchDir))
+	if err != nil {
+		return "", err
+	}
+
+	network := RunNetworkName(run.ID)
+	_, err = dockerClient.NetworkCreate(ctx, network, dockerTypes.NetworkCreate{
+		CheckDuplicate: true,
+		Labels:         components.WithDockerLabels(map[string]string{"shnorky.flow_id": run.FlowID, "shnorky.flow_run_id": run.ID}),
+	})
+	if err != nil {
+		return "", fmt.Errorf("Error creating network (%s) for flow run (%s): %w", network, run.ID, err)
+	}
+	return network, nil
+}
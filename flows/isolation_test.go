@@ -0,0 +1,97 @@
+package flows
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestClaimRunResources(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-isolation-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatalf("Error opening state database file (%s): %s", stateDBPath, err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	namespaced := FlowSpecification{
+		Outputs: map[string]OutputSpecification{"report": {Path: "/data/{{run_id}}/report.csv"}},
+	}
+	shared := FlowSpecification{
+		Outputs: map[string]OutputSpecification{"report": {Path: "/data/report.csv"}},
+	}
+
+	runs := make([]FlowRunMetadata, 4)
+	for i := range runs {
+		runs[i], err = GenerateFlowRunMetadata("flow")
+		if err != nil {
+			t.Fatalf("Could not generate flow run metadata: %s", err.Error())
+		}
+		err = InsertFlowRun(store, runs[i])
+		if err != nil {
+			t.Fatalf("Could not insert flow run: %s", err.Error())
+		}
+	}
+
+	type claimTest struct {
+		specification FlowSpecification
+		run           FlowRunMetadata
+		returnsError  bool
+	}
+
+	testCases := []claimTest{
+		{namespaced, runs[0], false},
+		{namespaced, runs[1], false},
+		{shared, runs[2], false},
+		{shared, runs[3], true},
+	}
+
+	for i, testCase := range testCases {
+		scratchDir := path.Join(stateDir, state.ScratchDirName, testCase.run.ID)
+		err = ClaimRunResources(store, testCase.run, RunResources(testCase.specification, testCase.run, scratchDir))
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		}
+
+		conflicts, err := RunConflicts(store, testCase.run.ID)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not check for conflicts: %s", i, err.Error())
+		}
+		if len(conflicts) > 0 {
+			t.Errorf("[Test %d] Unexpected conflicts for flow run: %v", i, conflicts)
+		}
+	}
+
+	// Once the run using the shared output finishes, another run may use it
+	finishedAt := time.Now()
+	runs[2].Status = RunStatusSucceeded
+	runs[2].FinishedAt = &finishedAt
+	err = UpdateFlowRunStatus(store, runs[2])
+	if err != nil {
+		t.Fatalf("Could not finish flow run: %s", err.Error())
+	}
+	err = ClaimRunResources(store, runs[3], RunResources(shared, runs[3], path.Join(stateDir, state.ScratchDirName, runs[3].ID)))
+	if err != nil {
+		t.Errorf("Could not claim resources released by finished run: %s", err.Error())
+	}
+}
@@ -0,0 +1,177 @@
+package flows
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+)
+
+// JSONSchema - the subset of JSON Schema that built-in validation steps understand. Keywords which
+// are not listed here are ignored.
+type JSONSchema struct {
+	Type                 interface{}            `json:"type,omitempty"`
+	Properties           map[string]*JSONSchema `json:"properties,omitempty"`
+	Required             []string               `json:"required,omitempty"`
+	AdditionalProperties *bool                  `json:"additionalProperties,omitempty"`
+	Items                *JSONSchema            `json:"items,omitempty"`
+	Enum                 []interface{}          `json:"enum,omitempty"`
+	Minimum              *float64               `json:"minimum,omitempty"`
+	Maximum              *float64               `json:"maximum,omitempty"`
+	MinLength            *int                   `json:"minLength,omitempty"`
+	MaxLength            *int                   `json:"maxLength,omitempty"`
+	Pattern              string                 `json:"pattern,omitempty"`
+	MinItems             *int                   `json:"minItems,omitempty"`
+	MaxItems             *int                   `json:"maxItems,omitempty"`
+}
+
+// Validate checks the given value (as decoded by encoding/json into an interface{}) against the
+// schema. The returned error describes the first violation found, along with its location in the
+// value.
+func (schema *JSONSchema) Validate(value interface{}) error {
+	return schema.validate(value, "$")
+}
+
+func (schema *JSONSchema) validate(value interface{}, location string) error {
+	if schema == nil {
+		return nil
+	}
+
+	if schema.Type != nil {
+		types := []string{}
+		switch schemaType := schema.Type.(type) {
+		case string:
+			types = append(types, schemaType)
+		case []interface{}:
+			for _, item := range schemaType {
+				if typeName, ok := item.(string); ok {
+					types = append(types, typeName)
+				}
+			}
+		}
+		matched := false
+		for _, typeName := range types {
+			if jsonTypeMatches(typeName, value) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: expected type %v, got %s", location, schema.Type, jsonTypeName(value))
+		}
+	}
+
+	if len(schema.Enum) > 0 {
+		encodedValue, _ := json.Marshal(value)
+		matched := false
+		for _, candidate := range schema.Enum {
+			encodedCandidate, _ := json.Marshal(candidate)
+			if string(encodedValue) == string(encodedCandidate) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return fmt.Errorf("%s: value %s is not one of the allowed values", location, string(encodedValue))
+		}
+	}
+
+	switch typedValue := value.(type) {
+	case float64:
+		if schema.Minimum != nil && typedValue < *schema.Minimum {
+			return fmt.Errorf("%s: %v is less than the minimum (%v)", location, typedValue, *schema.Minimum)
+		}
+		if schema.Maximum != nil && typedValue > *schema.Maximum {
+			return fmt.Errorf("%s: %v is greater than the maximum (%v)", location, typedValue, *schema.Maximum)
+		}
+	case string:
+		length := len([]rune(typedValue))
+		if schema.MinLength != nil && length < *schema.MinLength {
+			return fmt.Errorf("%s: string is shorter than the minimum length (%d)", location, *schema.MinLength)
+		}
+		if schema.MaxLength != nil && length > *schema.MaxLength {
+			return fmt.Errorf("%s: string is longer than the maximum length (%d)", location, *schema.MaxLength)
+		}
+		if schema.Pattern != "" {
+			pattern, err := regexp.Compile(schema.Pattern)
+			if err != nil {
+				return fmt.Errorf("%s: invalid pattern in schema (%s): %w", location, schema.Pattern, err)
+			}
+			if !pattern.MatchString(typedValue) {
+				return fmt.Errorf("%s: string does not match pattern %s", location, schema.Pattern)
+			}
+		}
+	case []interface{}:
+		if schema.MinItems != nil && len(typedValue) < *schema.MinItems {
+			return fmt.Errorf("%s: array has fewer than the minimum number of items (%d)", location, *schema.MinItems)
+		}
+		if schema.MaxItems != nil && len(typedValue) > *schema.MaxItems {
+			return fmt.Errorf("%s: array has more than the maximum number of items (%d)", location, *schema.MaxItems)
+		}
+		for i, item := range typedValue {
+			err := schema.Items.validate(item, fmt.Sprintf("%s[%d]", location, i))
+			if err != nil {
+				return err
+			}
+		}
+	case map[string]interface{}:
+		for _, property := range schema.Required {
+			if _, ok := typedValue[property]; !ok {
+				return fmt.Errorf("%s: missing required property %s", location, property)
+			}
+		}
+		properties := make([]string, 0, len(typedValue))
+		for property := range typedValue {
+			properties = append(properties, property)
+		}
+		sort.Strings(properties)
+		for _, property := range properties {
+			propertySchema, ok := schema.Properties[property]
+			if !ok {
+				if schema.AdditionalProperties != nil && !*schema.AdditionalProperties {
+					return fmt.Errorf("%s: unexpected property %s", location, property)
+				}
+				continue
+			}
+			err := propertySchema.validate(typedValue[property], fmt.Sprintf("%s.%s", location, property))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func jsonTypeMatches(typeName string, value interface{}) bool {
+	switch typeName {
+	case "integer":
+		number, ok := value.(float64)
+		return ok && number == math.Trunc(number)
+	case "number":
+		_, ok := value.(float64)
+		return ok
+	default:
+		return jsonTypeName(value) == typeName
+	}
+}
+
+func jsonTypeName(value interface{}) string {
+	switch value.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
@@ -0,0 +1,79 @@
+package flows
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// ComponentSelectorPrefix marks steps (in the steps of a flow specification) which refer to a
+// component by its labels rather than by its ID, e.g. "label:team=data,role=extract". Such a step
+// uses the single registered component which has all of the given labels.
+var ComponentSelectorPrefix = "label:"
+
+// IsComponentSelector returns true if the given component of a step is a label selector (see
+// ComponentSelectorPrefix)
+func IsComponentSelector(component string) bool {
+	return strings.HasPrefix(component, ComponentSelectorPrefix)
+}
+
+// ParseComponentSelector parses the labels out of the given label selector
+func ParseComponentSelector(selector string) (map[string]string, error) {
+	rawLabels := strings.Split(strings.TrimPrefix(selector, ComponentSelectorPrefix), ",")
+	labels, err := components.ParseLabels(rawLabels)
+	if err != nil {
+		return labels, fmt.Errorf("Invalid label selector (%s): %w", selector, err)
+	}
+	return labels, nil
+}
+
+// ResolveComponentSelectors returns a copy of the given flow specification in which each step that
+// refers to its component by a label selector refers to the ID of the matching component instead.
+// It returns an error if no component, or more than one component, matches the selector of a step.
+func ResolveComponentSelectors(store state.Store, specification FlowSpecification) (FlowSpecification, error) {
+	resolvedSteps := map[string]string{}
+	steps := make([]string, 0, len(specification.Steps))
+	for step, component := range specification.Steps {
+		resolvedSteps[step] = component
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+
+	for _, step := range steps {
+		selector := specification.Steps[step]
+		if !IsComponentSelector(selector) {
+			continue
+		}
+		labels, err := ParseComponentSelector(selector)
+		if err != nil {
+			return specification, fmt.Errorf("Step (%s): %w", step, err)
+		}
+
+		componentsChan := make(chan components.ComponentMetadata)
+		errChan := make(chan error, 1)
+		go func() {
+			errChan <- components.ListComponents(context.Background(), store, componentsChan, components.ComponentFilter{Labels: labels}, components.Page{})
+		}()
+		matches := []string{}
+		for component := range componentsChan {
+			matches = append(matches, component.ID)
+		}
+		if err := <-errChan; err != nil {
+			return specification, fmt.Errorf("Error resolving label selector (%s) of step (%s): %w", selector, step, err)
+		}
+		if len(matches) == 0 {
+			return specification, fmt.Errorf("No component matches label selector (%s) of step (%s)", selector, step)
+		}
+		if len(matches) > 1 {
+			return specification, fmt.Errorf("Several components match label selector (%s) of step (%s): %s", selector, step, strings.Join(matches, ", "))
+		}
+		resolvedSteps[step] = matches[0]
+	}
+
+	specification.Steps = resolvedSteps
+	return specification, nil
+}
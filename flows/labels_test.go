@@ -0,0 +1,158 @@
+package flows
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestResolveComponentSelectors(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-component-selectors-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	componentLabels := map[string]map[string]string{
+		"extractor":   {"team": "data", "role": "extract"},
+		"transformer": {"team": "data", "role": "transform"},
+	}
+	for componentID, labels := range componentLabels {
+		err = components.InsertComponent(store, components.ComponentMetadata{ID: componentID, ComponentType: components.Task, CreatedAt: time.Now()})
+		if err != nil {
+			t.Fatalf("Error inserting component: %s", err.Error())
+		}
+		err = components.SetLabels(store, components.LabelledComponent, componentID, labels)
+		if err != nil {
+			t.Fatalf("Error setting labels: %s", err.Error())
+		}
+	}
+
+	type selectorsTest struct {
+		steps         map[string]string
+		expectedSteps map[string]string
+		returnsError  bool
+	}
+
+	testCases := []selectorsTest{
+		{
+			steps:         map[string]string{"extract": "label:role=extract", "transform": "transformer", "review": GateComponentID},
+			expectedSteps: map[string]string{"extract": "extractor", "transform": "transformer", "review": GateComponentID},
+		},
+		{
+			steps:         map[string]string{"transform": "label:team=data,role=transform"},
+			expectedSteps: map[string]string{"transform": "transformer"},
+		},
+		{
+			steps:        map[string]string{"extract": "label:team=data"},
+			returnsError: true,
+		},
+		{
+			steps:        map[string]string{"extract": "label:team=ops"},
+			returnsError: true,
+		},
+		{
+			steps:        map[string]string{"extract": "label:team"},
+			returnsError: true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		specification := FlowSpecification{Steps: testCase.steps}
+		resolvedSpecification, err := ResolveComponentSelectors(store, specification)
+		if testCase.returnsError {
+			if err == nil {
+				t.Errorf("[Test %d] No error was returned but one was expected", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+			continue
+		}
+		for step, expectedComponent := range testCase.expectedSteps {
+			if resolvedSpecification.Steps[step] != expectedComponent {
+				t.Errorf("[Test %d] Unexpected component for step (%s): expected=%s, actual=%s", i, step, expectedComponent, resolvedSpecification.Steps[step])
+			}
+		}
+		for step, component := range testCase.steps {
+			if specification.Steps[step] != component {
+				t.Errorf("[Test %d] Original specification was modified for step (%s)", i, step)
+			}
+		}
+	}
+
+	_, err = MaterializeFlowSpecification(FlowSpecification{Steps: map[string]string{"extract": "label:team data"}})
+	if err == nil {
+		t.Error("Specification with invalid label selector was materialized")
+	}
+}
+
+func TestListFlowsByLabels(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-list-flows-by-labels-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	for _, flowID := range []string{"nightly", "hourly"} {
+		err = InsertFlow(store, FlowMetadata{ID: flowID, SpecificationPath: "/tmp/" + flowID + ".json", CreatedAt: time.Now()})
+		if err != nil {
+			t.Fatalf("Error inserting flow: %s", err.Error())
+		}
+	}
+	err = components.SetLabels(store, components.LabelledFlow, "nightly", map[string]string{"env": "prod"})
+	if err != nil {
+		t.Fatalf("Error setting labels: %s", err.Error())
+	}
+
+	listedFlows, err := collectFlows(store, "", map[string]string{"env": "prod"})
+	if err != nil {
+		t.Fatalf("Error listing flows: %s", err.Error())
+	}
+	if len(listedFlows) != 1 || listedFlows[0].ID != "nightly" || listedFlows[0].Labels["env"] != "prod" {
+		t.Errorf("Unexpected flows labelled env=prod: %v", listedFlows)
+	}
+
+	listedFlows, err = collectFlows(store, "", nil)
+	if err != nil {
+		t.Fatalf("Error listing flows: %s", err.Error())
+	}
+	if len(listedFlows) != 2 {
+		t.Errorf("Unexpected number of flows: expected=%d, actual=%d", 2, len(listedFlows))
+	}
+}
@@ -0,0 +1,57 @@
+package flows
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// deadEndWarnings returns a warning for each step of the given (materialized) flow specification
+// which no other step depends on and which declares no outputs - that is, which produces no data
+// contracts, captures no stdout artifact, and mounts no source containing one of the outputs of the
+// flow. The results of such steps are not used by anything that shnorky knows about. Built-in
+// validation and gate steps are not expected to produce anything, so they are never reported.
+func deadEndWarnings(specification FlowSpecification) []string {
+	dependedOn := map[string]bool{}
+	for _, dependencies := range specification.Dependencies {
+		for _, dependency := range dependencies {
+			dependedOn[dependency] = true
+		}
+	}
+
+	steps := make([]string, 0, len(specification.Steps))
+	for step, componentID := range specification.Steps {
+		if !dependedOn[step] && !isHostStep(componentID) && !declaresOutputs(specification, step) {
+			steps = append(steps, step)
+		}
+	}
+	sort.Strings(steps)
+
+	warnings := make([]string, len(steps))
+	for i, step := range steps {
+		warnings[i] = fmt.Sprintf("No step depends on step (%s), and it declares no outputs", step)
+	}
+	return warnings
+}
+
+// declaresOutputs returns true if the given step of the given flow specification produces data
+// contracts, captures a stdout artifact, or mounts a source which is (or contains) one of the
+// outputs of the flow
+func declaresOutputs(specification FlowSpecification, step string) bool {
+	if len(specification.Contracts[step].Produces) > 0 {
+		return true
+	}
+	if _, ok := specification.StdoutArtifacts[step]; ok {
+		return true
+	}
+	for _, output := range specification.Outputs {
+		for _, mount := range specification.Mounts[step] {
+			source := filepath.Clean(mount.Source)
+			if output.Path == source || strings.HasPrefix(output.Path, source+string(filepath.Separator)) {
+				return true
+			}
+		}
+	}
+	return false
+}
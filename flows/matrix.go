@@ -0,0 +1,462 @@
+package flows
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// MatrixRunResult - summary of the flow run executed for one combination of parameters in a
+// parameter matrix
+type MatrixRunResult struct {
+	Parameters  map[string]string `json:"parameters"`
+	RunID       string            `json:"run_id"`
+	Status      string            `json:"status"`
+	Succeeded   bool              `json:"succeeded"`
+	FailedSteps []string          `json:"failed_steps"`
+	Error       string            `json:"error,omitempty"`
+}
+
+type parametersKey struct{}
+
+// WithParameters returns a copy of the given context which carries parameters for the flow runs
+// executed with it. Parameters are passed to the containers of every step as environment variables
+// (overriding the env in the flow specification) and replace placeholders of the form
+// "{{<parameter>}}" in the mount configurations, inputs, outputs, and partitioned inputs of the
+// flow.
+func WithParameters(ctx context.Context, parameters map[string]string) context.Context {
+	return context.WithValue(ctx, parametersKey{}, parameters)
+}
+
+// applyParameters returns a copy of the given flow specification in which the parameters carried
+// by the given context (see WithParameters) have been applied
+func applyParameters(ctx context.Context, specification FlowSpecification) FlowSpecification {
+	parameters, ok := ctx.Value(parametersKey{}).(map[string]string)
+	if !ok || len(parameters) == 0 {
+		return specification
+	}
+
+	env := map[string]map[string]string{}
+	mounts := map[string][]components.MountConfiguration{}
+	for step := range specification.Steps {
+		env[step] = map[string]string{}
+		for key, value := range specification.Env[step] {
+			env[step][key] = value
+		}
+		for key, value := range parameters {
+			env[step][key] = value
+		}
+		if stepMounts, ok := specification.Mounts[step]; ok {
+			mounts[step] = components.RenderMountTemplates(stepMounts, parameters)
+		}
+	}
+	specification.Env = env
+	specification.Mounts = mounts
+
+	inputs := map[string]InputSpecification{}
+	for name, input := range specification.Inputs {
+		input.Path = components.RenderTemplate(input.Path, parameters)
+		inputs[name] = input
+	}
+	specification.Inputs = inputs
+
+	outputs := map[string]OutputSpecification{}
+	for name, output := range specification.Outputs {
+		output.Path = components.RenderTemplate(output.Path, parameters)
+		outputs[name] = output
+	}
+	specification.Outputs = outputs
+
+	partitions := map[string]PartitionSpecification{}
+	for step, partition := range specification.Partitions {
+		partition.Input = components.RenderTemplate(partition.Input, parameters)
+		partitions[step] = partition
+	}
+	specification.Partitions = partitions
+
+	return specification
+}
+
+// ReadMatrix reads a parameter matrix, which maps the names of parameters to the lists of values
+// that they take, from the given reader. The matrix may be written either as a JSON object or in the
+// subset of YAML consisting of top-level "<name>: [<value>, ...]" entries and "<name>:" entries
+// followed by indented "- <value>" items. Parameter names may not collide with the placeholders
+// that shnorky provides itself (see TemplateVariables).
+func ReadMatrix(reader io.Reader) (map[string][]string, error) {
+	content, err := ioutil.ReadAll(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	var matrix map[string][]string
+	if trimmed := bytes.TrimSpace(content); len(trimmed) > 0 && trimmed[0] == '{' {
+		matrix, err = parseJSONMatrix(trimmed)
+	} else {
+		matrix, err = parseYAMLMatrix(content)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matrix) == 0 {
+		return nil, fmt.Errorf("Invalid matrix: no parameters")
+	}
+	reserved := TemplateVariables(FlowRunMetadata{}, "")
+	for name, values := range matrix {
+		if name == "" {
+			return nil, fmt.Errorf("Invalid matrix: empty parameter name")
+		}
+		if _, ok := reserved[name]; ok {
+			return nil, fmt.Errorf("Invalid matrix: parameter name is reserved: %s", name)
+		}
+		if len(values) == 0 {
+			return nil, fmt.Errorf("Invalid matrix: no values for parameter: %s", name)
+		}
+	}
+	return matrix, nil
+}
+
+// parseJSONMatrix parses a parameter matrix written as a JSON object whose values are arrays of
+// strings, numbers, or booleans
+func parseJSONMatrix(content []byte) (map[string][]string, error) {
+	decoder := json.NewDecoder(bytes.NewReader(content))
+	decoder.UseNumber()
+	var rawMatrix map[string][]interface{}
+	err := decoder.Decode(&rawMatrix)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid matrix: %w", err)
+	}
+
+	matrix := map[string][]string{}
+	for name, rawValues := range rawMatrix {
+		values := make([]string, len(rawValues))
+		for i, rawValue := range rawValues {
+			switch value := rawValue.(type) {
+			case string:
+				values[i] = value
+			case json.Number:
+				values[i] = value.String()
+			case bool:
+				values[i] = strconv.FormatBool(value)
+			default:
+				return nil, fmt.Errorf("Invalid matrix: values of parameter (%s) must be strings, numbers, or booleans", name)
+			}
+		}
+		matrix[name] = values
+	}
+	return matrix, nil
+}
+
+// parseYAMLMatrix parses a parameter matrix written in the subset of YAML described in ReadMatrix
+func parseYAMLMatrix(content []byte) (map[string][]string, error) {
+	matrix := map[string][]string{}
+	// current is the parameter whose "- <value>" items are being read
+	current := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		rawLine := stripYAMLComment(scanner.Text())
+		line := strings.TrimSpace(rawLine)
+		if line == "" || line == "---" {
+			continue
+		}
+
+		if rawLine[0] == ' ' || rawLine[0] == '\t' {
+			if current == "" || !strings.HasPrefix(line, "-") {
+				return nil, fmt.Errorf("Invalid matrix (line %d): unexpected indentation", lineNumber)
+			}
+			value, err := parseYAMLScalar(strings.TrimSpace(line[1:]))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid matrix (line %d): %w", lineNumber, err)
+			}
+			matrix[current] = append(matrix[current], value)
+			continue
+		}
+
+		separator := yamlKeySeparator(line)
+		if separator < 0 {
+			return nil, fmt.Errorf("Invalid matrix (line %d): expected \"<name>: <values>\"", lineNumber)
+		}
+		name, err := parseYAMLScalar(strings.TrimSpace(line[:separator]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid matrix (line %d): %w", lineNumber, err)
+		}
+		if _, ok := matrix[name]; ok {
+			return nil, fmt.Errorf("Invalid matrix (line %d): duplicate parameter: %s", lineNumber, name)
+		}
+
+		rest := strings.TrimSpace(line[separator+1:])
+		current = ""
+		switch {
+		case rest == "":
+			matrix[name] = []string{}
+			current = name
+		case strings.HasPrefix(rest, "["):
+			if !strings.HasSuffix(rest, "]") {
+				return nil, fmt.Errorf("Invalid matrix (line %d): unterminated list", lineNumber)
+			}
+			values := []string{}
+			for _, item := range splitYAMLFlowList(rest[1 : len(rest)-1]) {
+				value, err := parseYAMLScalar(strings.TrimSpace(item))
+				if err != nil {
+					return nil, fmt.Errorf("Invalid matrix (line %d): %w", lineNumber, err)
+				}
+				values = append(values, value)
+			}
+			matrix[name] = values
+		default:
+			value, err := parseYAMLScalar(rest)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid matrix (line %d): %w", lineNumber, err)
+			}
+			matrix[name] = []string{value}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return matrix, nil
+}
+
+// stripYAMLComment removes the comment (if any) from the given line of YAML. Comments start with
+// "#" at the beginning of the line or after whitespace, outside of quoted strings.
+func stripYAMLComment(line string) string {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote != 0:
+			if line[i] == '\\' && quote == '"' {
+				i++
+			} else if line[i] == quote {
+				quote = 0
+			}
+		case line[i] == '"' || line[i] == '\'':
+			quote = line[i]
+		case line[i] == '#' && (i == 0 || line[i-1] == ' ' || line[i-1] == '\t'):
+			return strings.TrimRight(line[:i], " \t")
+		}
+	}
+	return strings.TrimRight(line, " \t")
+}
+
+// yamlKeySeparator returns the index of the colon which separates the key from the value in the
+// given line of YAML, or -1 if there is none
+func yamlKeySeparator(line string) int {
+	var quote byte
+	for i := 0; i < len(line); i++ {
+		switch {
+		case quote != 0:
+			if line[i] == '\\' && quote == '"' {
+				i++
+			} else if line[i] == quote {
+				quote = 0
+			}
+		case line[i] == '"' || line[i] == '\'':
+			quote = line[i]
+		case line[i] == ':' && (i == len(line)-1 || line[i+1] == ' ' || line[i+1] == '\t'):
+			return i
+		}
+	}
+	return -1
+}
+
+// splitYAMLFlowList splits the contents of a YAML flow list (without its brackets) at the commas
+// which are outside of quoted strings
+func splitYAMLFlowList(list string) []string {
+	if strings.TrimSpace(list) == "" {
+		return []string{}
+	}
+	items := []string{}
+	var quote byte
+	start := 0
+	for i := 0; i < len(list); i++ {
+		switch {
+		case quote != 0:
+			if list[i] == '\\' && quote == '"' {
+				i++
+			} else if list[i] == quote {
+				quote = 0
+			}
+		case list[i] == '"' || list[i] == '\'':
+			quote = list[i]
+		case list[i] == ',':
+			items = append(items, list[start:i])
+			start = i + 1
+		}
+	}
+	return append(items, list[start:])
+}
+
+// parseYAMLScalar returns the value of the given (trimmed) YAML scalar, removing its quotes if it
+// is quoted
+func parseYAMLScalar(scalar string) (string, error) {
+	if scalar == "" {
+		return "", fmt.Errorf("empty value")
+	}
+	switch scalar[0] {
+	case '"':
+		value, err := strconv.Unquote(scalar)
+		if err != nil {
+			return "", fmt.Errorf("invalid quoted value: %s", scalar)
+		}
+		return value, nil
+	case '\'':
+		if len(scalar) < 2 || scalar[len(scalar)-1] != '\'' {
+			return "", fmt.Errorf("invalid quoted value: %s", scalar)
+		}
+		return strings.Replace(scalar[1:len(scalar)-1], "''", "'", -1), nil
+	case '[', '{', '-', '&', '*', '!', '|', '>':
+		return "", fmt.Errorf("unsupported value: %s", scalar)
+	}
+	return scalar, nil
+}
+
+// ExpandMatrix returns every combination of the values of the parameters in the given matrix. The
+// combinations are ordered by the values of the parameters (in lexicographic order of their
+// names), with values taken in the order in which the matrix lists them.
+func ExpandMatrix(matrix map[string][]string) []map[string]string {
+	names := make([]string, 0, len(matrix))
+	for name := range matrix {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combinations := []map[string]string{{}}
+	for _, name := range names {
+		expanded := make([]map[string]string, 0, len(combinations)*len(matrix[name]))
+		for _, combination := range combinations {
+			for _, value := range matrix[name] {
+				extended := map[string]string{name: value}
+				for key, existing := range combination {
+					extended[key] = existing
+				}
+				expanded = append(expanded, extended)
+			}
+		}
+		combinations = expanded
+	}
+	return combinations
+}
+
+// ExecuteMatrix executes one run of the flow with the given ID for each combination of parameters
+// in the given matrix (see ExpandMatrix and WithParameters). At most parallelism runs are executed
+// at a time (if parallelism is not positive, all the runs are executed at once), and runs wait for
+// the flow's limit on concurrent runs (see WithQuotaWait). Runs which fail do not stop the others.
+// The returned results are in the order of the combinations.
+// This is the handler for `shn flows execute --matrix`
+func ExecuteMatrix(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	outstream io.Writer,
+	stateDir string,
+	flowID string,
+	matrix map[string][]string,
+	parallelism int,
+	priority int,
+) []MatrixRunResult {
+	ctx = WithQuotaWait(ctx)
+	combinations := ExpandMatrix(matrix)
+	if parallelism <= 0 || parallelism > len(combinations) {
+		parallelism = len(combinations)
+	}
+
+	results := make([]MatrixRunResult, len(combinations))
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range indices {
+				results[index] = executeCombination(ctx, store, dockerClient, outstream, stateDir, flowID, combinations[index], priority)
+			}
+		}()
+	}
+	for index := range combinations {
+		indices <- index
+	}
+	close(indices)
+	wg.Wait()
+
+	return results
+}
+
+// executeCombination executes a run of the flow with the given ID with the given parameters and
+// summarizes its result
+func executeCombination(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	outstream io.Writer,
+	stateDir string,
+	flowID string,
+	parameters map[string]string,
+	priority int,
+) MatrixRunResult {
+	result := MatrixRunResult{Parameters: parameters, FailedSteps: []string{}}
+	run, err := GenerateFlowRunMetadata(flowID)
+	if err != nil {
+		result.Status = RunStatusFailed
+		result.Error = err.Error()
+		return result
+	}
+	run.Priority = priority
+	result.RunID = run.ID
+
+	finishedRun, executions, err := ExecuteRun(WithParameters(ctx, parameters), store, dockerClient, outstream, stateDir, run)
+	result.Status = finishedRun.Status
+	result.FailedSteps = FailedSteps(executions)
+	if err != nil {
+		result.Status = RunStatusFailed
+		result.Error = err.Error()
+	}
+	result.Succeeded = err == nil && result.Status != RunStatusFailed
+	return result
+}
+
+// WriteMatrixSummaryTable writes the given results of a matrix execution to the given writer as a
+// human-readable table, followed by the number of combinations which succeeded
+func WriteMatrixSummaryTable(w io.Writer, results []MatrixRunResult) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PARAMETERS\tRUN\tSTATUS\tFAILED STEPS\tERROR")
+	succeeded := 0
+	for _, result := range results {
+		if result.Succeeded {
+			succeeded++
+		}
+		names := make([]string, 0, len(result.Parameters))
+		for name := range result.Parameters {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		parameters := make([]string, len(names))
+		for i, name := range names {
+			parameters[i] = fmt.Sprintf("%s=%s", name, result.Parameters[name])
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", strings.Join(parameters, " "), result.RunID, result.Status, strings.Join(result.FailedSteps, ","), result.Error)
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, err = fmt.Fprintf(w, "\n%d of %d combinations succeeded\n", succeeded, len(results))
+	return err
+}
@@ -0,0 +1,106 @@
+package flows
+
+import (
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+func TestReadMatrix(t *testing.T) {
+	type matrixTest struct {
+		raw            string
+		expectedMatrix map[string][]string
+		returnsError   bool
+	}
+
+	tests := []matrixTest{
+		{
+			raw:            "region: [us, eu]\nsize: [small, \"large, very\"]\n",
+			expectedMatrix: map[string][]string{"region": {"us", "eu"}, "size": {"small", "large, very"}},
+		},
+		{
+			raw:            "# Regions to process\nregion:\n  - us # United States\n  - 'eu'\nbatch: 10\n",
+			expectedMatrix: map[string][]string{"region": {"us", "eu"}, "batch": {"10"}},
+		},
+		{
+			raw:            `{"region": ["us", "eu"], "batch": [10, 20], "dry_run": [true]}`,
+			expectedMatrix: map[string][]string{"region": {"us", "eu"}, "batch": {"10", "20"}, "dry_run": {"true"}},
+		},
+		{raw: "", returnsError: true},
+		{raw: "region: []\n", returnsError: true},
+		{raw: "region:\nsize: [small]\n", returnsError: true},
+		{raw: "region: [us]\nregion: [eu]\n", returnsError: true},
+		{raw: "  - us\n", returnsError: true},
+		{raw: "region us\n", returnsError: true},
+		{raw: "region: [us\n", returnsError: true},
+		{raw: "region: {us: 1}\n", returnsError: true},
+		{raw: "run_id: [first]\n", returnsError: true},
+		{raw: `{"region": [["us"]]}`, returnsError: true},
+	}
+
+	for i, test := range tests {
+		matrix, err := ReadMatrix(strings.NewReader(test.raw))
+		if test.returnsError {
+			if err == nil {
+				t.Errorf("[Test %d] Expected error but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[Test %d] Unexpected error: %s", i, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(matrix, test.expectedMatrix) {
+			t.Errorf("[Test %d] Unexpected matrix: expected=%v, actual=%v", i, test.expectedMatrix, matrix)
+		}
+	}
+}
+
+func TestExpandMatrix(t *testing.T) {
+	matrix := map[string][]string{"size": {"small", "large"}, "region": {"us", "eu"}}
+	expectedCombinations := []map[string]string{
+		{"region": "us", "size": "small"},
+		{"region": "us", "size": "large"},
+		{"region": "eu", "size": "small"},
+		{"region": "eu", "size": "large"},
+	}
+	combinations := ExpandMatrix(matrix)
+	if !reflect.DeepEqual(combinations, expectedCombinations) {
+		t.Errorf("Unexpected combinations: expected=%v, actual=%v", expectedCombinations, combinations)
+	}
+}
+
+func TestApplyParameters(t *testing.T) {
+	specification := FlowSpecification{
+		Steps:   map[string]string{"extract": "extractor", "load": "loader"},
+		Env:     map[string]map[string]string{"extract": {"REGION": "default", "LOG_LEVEL": "info"}},
+		Mounts:  map[string][]components.MountConfiguration{"extract": {{Source: "/data/{{REGION}}/{{run_id}}", Target: "/shnorky/outputs", Method: "bind"}}},
+		Outputs: map[string]OutputSpecification{"report": {Path: "/data/{{REGION}}/report.csv"}},
+	}
+
+	unchanged := applyParameters(context.Background(), specification)
+	if !reflect.DeepEqual(unchanged, specification) {
+		t.Errorf("Expected specification to be unchanged without parameters: %v", unchanged)
+	}
+
+	applied := applyParameters(WithParameters(context.Background(), map[string]string{"REGION": "eu"}), specification)
+	expectedEnv := map[string]map[string]string{
+		"extract": {"REGION": "eu", "LOG_LEVEL": "info"},
+		"load":    {"REGION": "eu"},
+	}
+	if !reflect.DeepEqual(applied.Env, expectedEnv) {
+		t.Errorf("Unexpected env: expected=%v, actual=%v", expectedEnv, applied.Env)
+	}
+	if source := applied.Mounts["extract"][0].Source; source != "/data/eu/{{run_id}}" {
+		t.Errorf("Unexpected mount source: expected=%s, actual=%s", "/data/eu/{{run_id}}", source)
+	}
+	if path := applied.Outputs["report"].Path; path != "/data/eu/report.csv" {
+		t.Errorf("Unexpected output path: expected=%s, actual=%s", "/data/eu/report.csv", path)
+	}
+	if specification.Env["extract"]["REGION"] != "default" {
+		t.Error("Applying parameters modified the original specification")
+	}
+}
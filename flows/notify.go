@@ -0,0 +1,196 @@
+package flows
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+// ErrEmptyWebhookURL signifies that a notification configuration did not specify the URL that
+// notifications should be posted to
+var ErrEmptyWebhookURL = errors.New("Webhook URL must be a non-empty string")
+
+// NotificationTimeout is the amount of time a notifier waits for a webhook to respond before giving
+// up on a notification
+var NotificationTimeout = 10 * time.Second
+
+// RunEventStarted is the type of event sent when a flow run starts
+var RunEventStarted = "started"
+
+// RunEventSucceeded is the type of event sent when all the steps in a flow run complete
+// successfully
+var RunEventSucceeded = "succeeded"
+
+// RunEventFailed is the type of event sent when a flow run is aborted because of an error
+var RunEventFailed = "failed"
+
+// RunEvent - describes a change in the status of a flow run that notifiers are told about
+type RunEvent struct {
+	// Type is one of RunEventStarted, RunEventSucceeded, RunEventFailed
+	Type string          `json:"type"`
+	Run  FlowRunMetadata `json:"run"`
+	// Error is the message of the error which caused the run to fail (only set for failed runs)
+	Error string `json:"error,omitempty"`
+	// FailedStep and FailedExecutionID identify the step whose execution caused the run to fail
+	// (only set for failed runs in which a step execution failed)
+	FailedStep        string `json:"failed_step,omitempty"`
+	FailedExecutionID string `json:"failed_execution_id,omitempty"`
+}
+
+// Notifier is implemented by anything which can tell the outside world about events in flow runs
+type Notifier interface {
+	Notify(ctx context.Context, event RunEvent) error
+}
+
+// NotificationsSpecification - specifies where notifications about runs of a flow should be sent
+type NotificationsSpecification struct {
+	// Slack configures notifications posted to a Slack channel using an incoming webhook
+	Slack *SlackConfiguration `json:"slack,omitempty"`
+}
+
+// SlackConfiguration - specifies how run notifications should be posted to Slack
+type SlackConfiguration struct {
+	// WebhookURL is the URL of the Slack incoming webhook that messages are posted to. Supports
+	// "env:<VARIABLE_NAME>" values so that the webhook URL need not be stored in the specification.
+	WebhookURL string `json:"webhook_url"`
+	// LogsURL is an optional link to the logs for a run which is included in each message. The
+	// string "{run_id}" in the URL is replaced by the ID of the run. Supports "env:<VARIABLE_NAME>"
+	// values.
+	LogsURL string `json:"logs_url,omitempty"`
+}
+
+// MaterializeNotificationsSpecification validates the given notifications specification and
+// renders any special values in it
+func MaterializeNotificationsSpecification(rawSpecification NotificationsSpecification) (NotificationsSpecification, error) {
+	materializedSpecification := NotificationsSpecification{}
+	if rawSpecification.Slack != nil {
+		webhookURL, err := components.MaterializeEnv(rawSpecification.Slack.WebhookURL)
+		if err != nil {
+			return materializedSpecification, fmt.Errorf("Invalid slack notification configuration: %w", err)
+		}
+		logsURL, err := components.MaterializeEnv(rawSpecification.Slack.LogsURL)
+		if err != nil {
+			return materializedSpecification, fmt.Errorf("Invalid slack notification configuration: %w", err)
+		}
+		slack := SlackConfiguration{WebhookURL: webhookURL, LogsURL: logsURL}
+		if slack.WebhookURL == "" {
+			return materializedSpecification, fmt.Errorf("Invalid slack notification configuration: %w", ErrEmptyWebhookURL)
+		}
+		materializedSpecification.Slack = &slack
+	}
+	return materializedSpecification, nil
+}
+
+// GenerateNotifiers creates a notifier for each notification channel configured in the given
+// notifications specification
+func GenerateNotifiers(specification NotificationsSpecification) []Notifier {
+	notifiers := []Notifier{}
+	if specification.Slack != nil {
+		notifiers = append(notifiers, NewSlackNotifier(*specification.Slack))
+	}
+	return notifiers
+}
+
+// notifyAll sends the given event to each of the given notifiers. Notifications are best effort -
+// failures are reported on outstream (if it is not nil) but do not affect the flow run.
+func notifyAll(ctx context.Context, notifiers []Notifier, outstream io.Writer, event RunEvent) {
+	for _, notifier := range notifiers {
+		err := notifier.Notify(ctx, event)
+		if err != nil && outstream != nil {
+			fmt.Fprintf(outstream, "Warning: could not send notification for run (%s): %s\n", event.Run.ID, err.Error())
+		}
+	}
+}
+
+// postWebhook posts the given payload (as JSON) to the webhook at the given URL. It returns an
+// error if the webhook does not respond with a 2xx status code.
+func postWebhook(ctx context.Context, client *http.Client, url string, payload interface{}) error {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return fmt.Errorf("Could not marshal webhook payload: %w", err)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Could not create webhook request: %w", err)
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := client.Do(request)
+	if err != nil {
+		return fmt.Errorf("Error posting to webhook: %w", err)
+	}
+	defer response.Body.Close()
+	io.Copy(ioutil.Discard, response.Body)
+
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		return fmt.Errorf("Webhook responded with unexpected status: %s", response.Status)
+	}
+
+	return nil
+}
+
+// SlackNotifier posts messages about flow runs to a Slack incoming webhook
+type SlackNotifier struct {
+	configuration SlackConfiguration
+	client        *http.Client
+}
+
+// NewSlackNotifier creates a SlackNotifier which posts messages according to the given
+// configuration
+func NewSlackNotifier(configuration SlackConfiguration) *SlackNotifier {
+	return &SlackNotifier{configuration: configuration, client: &http.Client{Timeout: NotificationTimeout}}
+}
+
+// slackMessage is the payload accepted by Slack incoming webhooks
+type slackMessage struct {
+	Text string `json:"text"`
+}
+
+// Notify posts a message describing the given event to Slack
+func (notifier *SlackNotifier) Notify(ctx context.Context, event RunEvent) error {
+	return postWebhook(ctx, notifier.client, notifier.configuration.WebhookURL, slackMessage{Text: notifier.message(event)})
+}
+
+// message renders the text of the Slack message for the given event
+func (notifier *SlackNotifier) message(event RunEvent) string {
+	var text string
+	switch event.Type {
+	case RunEventStarted:
+		text = fmt.Sprintf(":arrow_forward: Run `%s` of flow *%s* started", event.Run.ID, event.Run.FlowID)
+	case RunEventSucceeded:
+		text = fmt.Sprintf(":white_check_mark: Run `%s` of flow *%s* succeeded in %s", event.Run.ID, event.Run.FlowID, runDuration(event.Run))
+		if event.Run.Status == RunStatusSucceededWithWarnings {
+			text = fmt.Sprintf(":warning: Run `%s` of flow *%s* succeeded with warnings in %s", event.Run.ID, event.Run.FlowID, runDuration(event.Run))
+		}
+	case RunEventFailed:
+		text = fmt.Sprintf(":x: Run `%s` of flow *%s* failed after %s", event.Run.ID, event.Run.FlowID, runDuration(event.Run))
+		if event.Error != "" {
+			text += fmt.Sprintf(": %s", event.Error)
+		}
+	default:
+		text = fmt.Sprintf("Run `%s` of flow *%s*: %s", event.Run.ID, event.Run.FlowID, event.Type)
+	}
+
+	if notifier.configuration.LogsURL != "" {
+		logsURL := strings.Replace(notifier.configuration.LogsURL, "{run_id}", event.Run.ID, -1)
+		text += fmt.Sprintf(" (<%s|logs>)", logsURL)
+	}
+
+	return text
+}
+
+// runDuration renders the duration of the given run, rounded to the second
+func runDuration(run FlowRunMetadata) string {
+	return time.Duration(durationSince(run.CreatedAt, run.FinishedAt) * float64(time.Second)).Round(time.Second).String()
+}
@@ -0,0 +1,95 @@
+package flows
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestSlackNotifier posts events for a failed run to a fake Slack webhook and checks the messages
+// that the webhook receives
+func TestSlackNotifier(t *testing.T) {
+	messages := []slackMessage{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var message slackMessage
+		err := json.NewDecoder(r.Body).Decode(&message)
+		if err != nil {
+			t.Errorf("Could not decode message posted to webhook: %s", err.Error())
+		}
+		messages = append(messages, message)
+		if strings.Contains(message.Text, "reject") {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	notifier := NewSlackNotifier(SlackConfiguration{WebhookURL: server.URL, LogsURL: "https://logs.example.com/runs/{run_id}"})
+
+	start := time.Unix(time.Now().Unix()-100, 0)
+	finishedAt := start.Add(90 * time.Second)
+	run := FlowRunMetadata{ID: "run", FlowID: "flow", Status: RunStatusRunning, CreatedAt: start}
+
+	ctx := context.Background()
+	err := notifier.Notify(ctx, RunEvent{Type: RunEventStarted, Run: run})
+	if err != nil {
+		t.Fatalf("Error notifying of run start: %s", err.Error())
+	}
+
+	run.Status = RunStatusFailed
+	run.FinishedAt = &finishedAt
+	err = notifier.Notify(ctx, RunEvent{Type: RunEventFailed, Run: run, Error: "step exploded"})
+	if err != nil {
+		t.Fatalf("Error notifying of run failure: %s", err.Error())
+	}
+
+	err = notifier.Notify(ctx, RunEvent{Type: RunEventFailed, Run: run, Error: "reject"})
+	if err == nil {
+		t.Fatal("Expected error when webhook responds with non-2xx status")
+	}
+
+	if len(messages) != 3 {
+		t.Fatalf("Unexpected number of messages posted to webhook: expected=%d, actual=%d", 3, len(messages))
+	}
+
+	expectedFragments := [][]string{
+		{"`run`", "*flow*", "started", "<https://logs.example.com/runs/run|logs>"},
+		{"`run`", "*flow*", "failed after 1m30s", "step exploded", "<https://logs.example.com/runs/run|logs>"},
+	}
+	for i, fragments := range expectedFragments {
+		for _, fragment := range fragments {
+			if !strings.Contains(messages[i].Text, fragment) {
+				t.Errorf("[Message %d] Expected message to contain %q: %s", i, fragment, messages[i].Text)
+			}
+		}
+	}
+}
+
+func TestMaterializeNotificationsSpecification(t *testing.T) {
+	os.Setenv("SHNORKY_TEST_SLACK_WEBHOOK", "https://hooks.example.com/abc")
+	defer os.Unsetenv("SHNORKY_TEST_SLACK_WEBHOOK")
+
+	specification, err := MaterializeNotificationsSpecification(NotificationsSpecification{
+		Slack: &SlackConfiguration{WebhookURL: "env:SHNORKY_TEST_SLACK_WEBHOOK"},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error materializing notifications specification: %s", err.Error())
+	}
+	if specification.Slack == nil || specification.Slack.WebhookURL != "https://hooks.example.com/abc" {
+		t.Fatalf("Slack webhook URL was not materialized: %v", specification.Slack)
+	}
+	if len(GenerateNotifiers(specification)) != 1 {
+		t.Errorf("Expected exactly one notifier to be generated")
+	}
+
+	_, err = MaterializeNotificationsSpecification(NotificationsSpecification{
+		Slack: &SlackConfiguration{WebhookURL: "env:SHNORKY_TEST_UNSET_SLACK_WEBHOOK"},
+	})
+	if err == nil {
+		t.Error("Expected error materializing slack configuration with empty webhook URL")
+	}
+}
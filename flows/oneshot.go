@@ -0,0 +1,146 @@
+package flows
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+type mountOverridesKey struct{}
+
+// WithMountOverrides returns a copy of the given context which carries mount configurations (by
+// step) for the flow runs executed with it. The mounts of each step in the given map replace the
+// mounts that the flow specification gives for that step.
+func WithMountOverrides(ctx context.Context, mounts map[string][]components.MountConfiguration) context.Context {
+	return context.WithValue(ctx, mountOverridesKey{}, mounts)
+}
+
+// applyMountOverrides returns a copy of the given flow specification in which the mounts of the
+// steps overridden by the given context (see WithMountOverrides) have been replaced
+func applyMountOverrides(ctx context.Context, specification FlowSpecification) (FlowSpecification, error) {
+	overrides, ok := ctx.Value(mountOverridesKey{}).(map[string][]components.MountConfiguration)
+	if !ok || len(overrides) == 0 {
+		return specification, nil
+	}
+	mounts := map[string][]components.MountConfiguration{}
+	for step, stepMounts := range specification.Mounts {
+		mounts[step] = stepMounts
+	}
+	for step, stepMounts := range overrides {
+		if _, ok := specification.Steps[step]; !ok {
+			return specification, fmt.Errorf("Unknown step in mount configuration: %s", step)
+		}
+		mounts[step] = stepMounts
+	}
+	specification.Mounts = mounts
+	return specification, nil
+}
+
+// RunSpecification registers the flow specified at the given path under the given ID (or reuses
+// the flow registered under that ID if it has the same specification), registers the components
+// in componentPaths (a map from component IDs to component directories) which have not been
+// registered yet, builds every component of the flow whose build is stale (see
+// components.BuildIsStale), and then executes the flow as ExecuteRun does. The mounts of the steps
+// in the given map replace the mounts in the flow specification for this run.
+// This is the handler for `shn run`
+func RunSpecification(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	outstream io.Writer,
+	stateDir string,
+	flowID string,
+	specificationPath string,
+	componentPaths map[string]string,
+	mounts map[string][]components.MountConfiguration,
+) (FlowRunMetadata, map[string]components.ExecutionMetadata, error) {
+	componentIDs := make([]string, 0, len(componentPaths))
+	for componentID := range componentPaths {
+		componentIDs = append(componentIDs, componentID)
+	}
+	sort.Strings(componentIDs)
+	for _, componentID := range componentIDs {
+		_, err := components.EnsureComponent(store, componentID, components.Task, componentPaths[componentID], "")
+		if err != nil {
+			return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+		}
+	}
+
+	absoluteSpecificationPath, err := filepath.Abs(specificationPath)
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+	flow, err := SelectFlowByID(store, flowID)
+	registered := err == nil
+	if err == ErrFlowNotFound {
+		flow, err = GenerateFlowMetadata(flowID, absoluteSpecificationPath)
+	} else if err == nil && flow.SpecificationPath != absoluteSpecificationPath {
+		err = fmt.Errorf("Flow (%s) is already registered with a different specification (%s)", flowID, flow.SpecificationPath)
+	}
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+
+	// The mounts are validated with the overrides applied, since the specification may leave it to
+	// the mount configuration to provide the required mounts
+	specification, err := ReadSpecificationFile(flow.SpecificationPath)
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+	specification, err = ResolveComponentSelectors(store, specification)
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+	ctx = WithMountOverrides(ctx, mounts)
+	specification, err = applyMountOverrides(ctx, specification)
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+	err = ValidateMounts(store, specification)
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, fmt.Errorf("Invalid mounts: %w", err)
+	}
+	if !registered {
+		err = InsertFlow(store, flow)
+		if err != nil {
+			return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+		}
+	}
+
+	specification, _, err = RegisterEmbeddedComponents(store, filepath.Join(stateDir, state.EmbeddedDirName), flow, specification)
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+	if specification.DockerRetries != nil {
+		ctx = components.WithDockerRetryPolicy(ctx, specification.DockerRetries.Policy())
+	}
+
+	buildOutstream := outstream
+	if buildOutstream == nil {
+		buildOutstream = ioutil.Discard
+	}
+	staleComponents, err := components.StaleComponents(store, buildableComponents(specification))
+	if err != nil {
+		return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, err
+	}
+	for _, componentID := range staleComponents {
+		_, err = components.CreateBuild(ctx, store, dockerClient, buildOutstream, filepath.Join(stateDir, state.BuildLogsDirName), componentID, components.BuildOptions{})
+		if err != nil {
+			return FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, fmt.Errorf("Error building component (%s): %w", componentID, err)
+		}
+	}
+
+	run, err := GenerateFlowRunMetadata(flowID)
+	if err != nil {
+		return run, map[string]components.ExecutionMetadata{}, err
+	}
+	return ExecuteRun(ctx, store, dockerClient, outstream, stateDir, run)
+}
@@ -0,0 +1,64 @@
+package flows
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+func TestApplyMountOverrides(t *testing.T) {
+	specificationMounts := []components.MountConfiguration{{Source: "/data/inputs.txt", Target: "/shnorky/inputs.txt", Method: "bind"}}
+	overrideMounts := []components.MountConfiguration{{Source: "/tmp/inputs.txt", Target: "/shnorky/inputs.txt", Method: "bind"}}
+	specification := FlowSpecification{
+		Steps:  map[string]string{"extract": "extractor", "load": "loader"},
+		Mounts: map[string][]components.MountConfiguration{"extract": specificationMounts, "load": specificationMounts},
+	}
+
+	type overridesTest struct {
+		overrides      map[string][]components.MountConfiguration
+		expectedMounts map[string][]components.MountConfiguration
+		returnsError   bool
+	}
+
+	tests := []overridesTest{
+		{
+			overrides:      nil,
+			expectedMounts: map[string][]components.MountConfiguration{"extract": specificationMounts, "load": specificationMounts},
+		},
+		{
+			overrides:      map[string][]components.MountConfiguration{"extract": overrideMounts},
+			expectedMounts: map[string][]components.MountConfiguration{"extract": overrideMounts, "load": specificationMounts},
+		},
+		{
+			overrides:    map[string][]components.MountConfiguration{"transform": overrideMounts},
+			returnsError: true,
+		},
+	}
+
+	for i, test := range tests {
+		ctx := context.Background()
+		if test.overrides != nil {
+			ctx = WithMountOverrides(ctx, test.overrides)
+		}
+		overridden, err := applyMountOverrides(ctx, specification)
+		if test.returnsError {
+			if err == nil {
+				t.Errorf("[Test %d] Expected error but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[Test %d] Unexpected error: %s", i, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(overridden.Mounts, test.expectedMounts) {
+			t.Errorf("[Test %d] Unexpected mounts: expected=%v, actual=%v", i, test.expectedMounts, overridden.Mounts)
+		}
+	}
+
+	if !reflect.DeepEqual(specification.Mounts["extract"], specificationMounts) {
+		t.Error("Mount overrides modified the original specification")
+	}
+}
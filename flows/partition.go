@@ -0,0 +1,641 @@
+package flows
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+// Strategies by which inputs can be partitioned
+var (
+	// PartitionByFiles splits the files in an input directory into shards with (nearly) equal
+	// numbers of files
+	PartitionByFiles = "files"
+	// PartitionByLines splits an input file into shards with (nearly) equal numbers of lines
+	PartitionByLines = "lines"
+	// PartitionBySize splits an input file into shards of (nearly) equal sizes without splitting
+	// lines, or the files in an input directory into shards of (nearly) equal total sizes
+	PartitionBySize = "size"
+)
+
+// PartitionsDirName is the name of the directory (under the scratch directory of a flow run) into
+// which the inputs of partitioned steps are split
+var PartitionsDirName = "partitions"
+
+// Environment variables through which the containers for shards of partitioned steps are told
+// about their shards
+var (
+	PartitionDirEnv   = "SHNORKY_PARTITION_DIR"
+	PartitionIndexEnv = "SHNORKY_PARTITION_INDEX"
+	PartitionCountEnv = "SHNORKY_PARTITION_COUNT"
+)
+
+// PartitionSpecification - struct specifying how the input of a data-parallel step is split into
+// shards. A partitioned step is replaced by one step per shard (see ShardStepName), each of which
+// runs the component of the partitioned step on a single shard.
+type PartitionSpecification struct {
+	// Input is the path of the file or directory on the host which is partitioned. Supports
+	// "env:<VARIABLE_NAME>" values and the same placeholders as mount configurations. It is split
+	// when the first shard starts, so it may be produced by an earlier step.
+	Input string `json:"input"`
+	// Shards is the number of shards into which the input is split
+	Shards int `json:"shards"`
+	// By is the strategy by which the input is split - one of "files", "lines", or "size"
+	By string `json:"by"`
+	// Target is the mountpoint at which the directory containing its shard is mounted into the
+	// container for each shard. If it is empty, the directory is only available under the scratch
+	// mountpoint (at the path given by SHNORKY_PARTITION_DIR).
+	Target string `json:"target,omitempty"`
+	// Merge is the step (if any) which merges the outputs of the shards. It runs once all the
+	// shards have finished.
+	Merge string `json:"merge,omitempty"`
+}
+
+// ShardStepName returns the name of the step which processes the shard with the given index of the
+// input of the given partitioned step
+func ShardStepName(step string, index int) string {
+	return fmt.Sprintf("%s-%d", step, index)
+}
+
+// MaterializePartitionSpecification validates the given partition specification and resolves its
+// input to an absolute path
+func MaterializePartitionSpecification(rawPartition PartitionSpecification) (PartitionSpecification, error) {
+	if rawPartition.Input == "" {
+		return rawPartition, fmt.Errorf("No input")
+	}
+	if rawPartition.Shards < 1 {
+		return rawPartition, fmt.Errorf("Number of shards must be positive: %d", rawPartition.Shards)
+	}
+	if rawPartition.By != PartitionByFiles && rawPartition.By != PartitionByLines && rawPartition.By != PartitionBySize {
+		return rawPartition, fmt.Errorf("Invalid partitioning strategy (%s): must be one of \"%s\", \"%s\", \"%s\"", rawPartition.By, PartitionByFiles, PartitionByLines, PartitionBySize)
+	}
+	if rawPartition.Target != "" && !filepath.IsAbs(rawPartition.Target) {
+		return rawPartition, fmt.Errorf("Target must be an absolute path: %s", rawPartition.Target)
+	}
+
+	input, err := materializePath(rawPartition.Input)
+	if err != nil {
+		return rawPartition, err
+	}
+	materializedPartition := rawPartition
+	materializedPartition.Input = input
+	return materializedPartition, nil
+}
+
+// ResolvePartitions replaces each partitioned step in the given flow specification with its shard
+// steps. The shard steps inherit the component, dependencies, mounts, env, workdir, target,
+// allow_failure setting, attempts, and dead-letter specification of the partitioned step, steps
+// which depended on the partitioned step depend on all of its shards instead, and the merge step
+// (if any) runs after all of them. Each shard is dead-lettered on its own, so a shard which keeps
+// failing does not stop the other shards or the merge step. The partitions in the returned
+// specification are materialized.
+func ResolvePartitions(rawSpecification FlowSpecification) (FlowSpecification, error) {
+	if len(rawSpecification.Partitions) == 0 {
+		return rawSpecification, nil
+	}
+
+	resolvedSpecification := rawSpecification
+	resolvedSpecification.Steps = map[string]string{}
+	for step, component := range rawSpecification.Steps {
+		resolvedSpecification.Steps[step] = component
+	}
+	resolvedSpecification.Dependencies = map[string][]string{}
+	for step, dependencies := range rawSpecification.Dependencies {
+		resolvedSpecification.Dependencies[step] = append([]string{}, dependencies...)
+	}
+	resolvedSpecification.DependencyTypes = map[string]map[string]string{}
+	for step, dependencyTypes := range rawSpecification.DependencyTypes {
+		resolvedSpecification.DependencyTypes[step] = map[string]string{}
+		for dependency, dependencyType := range dependencyTypes {
+			resolvedSpecification.DependencyTypes[step][dependency] = dependencyType
+		}
+	}
+	resolvedSpecification.Mounts = map[string][]components.MountConfiguration{}
+	for step, mounts := range rawSpecification.Mounts {
+		resolvedSpecification.Mounts[step] = mounts
+	}
+	resolvedSpecification.Env = map[string]map[string]string{}
+	for step, env := range rawSpecification.Env {
+		resolvedSpecification.Env[step] = env
+	}
+	resolvedSpecification.Workdirs = map[string]string{}
+	for step, workdir := range rawSpecification.Workdirs {
+		resolvedSpecification.Workdirs[step] = workdir
+	}
+	resolvedSpecification.Targets = map[string]string{}
+	for step, target := range rawSpecification.Targets {
+		resolvedSpecification.Targets[step] = target
+	}
+	resolvedSpecification.AllowFailure = map[string]bool{}
+	for step, allowed := range rawSpecification.AllowFailure {
+		resolvedSpecification.AllowFailure[step] = allowed
+	}
+	resolvedSpecification.Attempts = map[string]int{}
+	for step, attempts := range rawSpecification.Attempts {
+		resolvedSpecification.Attempts[step] = attempts
+	}
+	resolvedSpecification.DeadLetters = map[string]DeadLetterSpecification{}
+	for step, deadLetter := range rawSpecification.DeadLetters {
+		resolvedSpecification.DeadLetters[step] = deadLetter
+	}
+	resolvedSpecification.Partitions = map[string]PartitionSpecification{}
+
+	partitionedSteps := make([]string, 0, len(rawSpecification.Partitions))
+	for step := range rawSpecification.Partitions {
+		partitionedSteps = append(partitionedSteps, step)
+	}
+	sort.Strings(partitionedSteps)
+
+	for _, step := range partitionedSteps {
+		partition, err := MaterializePartitionSpecification(rawSpecification.Partitions[step])
+		if err != nil {
+			return rawSpecification, fmt.Errorf("Invalid partition for step (%s): %w", step, err)
+		}
+		component, ok := resolvedSpecification.Steps[step]
+		if !ok {
+			return rawSpecification, fmt.Errorf("Unknown step in partitions: %s", step)
+		}
+		if isHostStep(component) {
+			return rawSpecification, fmt.Errorf("Step (%s) uses the %s component and cannot be partitioned", step, component)
+		}
+		if partition.Merge != "" {
+			if _, ok := resolvedSpecification.Steps[partition.Merge]; !ok || partition.Merge == step {
+				return rawSpecification, fmt.Errorf("Unknown merge step (%s) for partitioned step (%s)", partition.Merge, step)
+			}
+		}
+		// Settings which cannot be shared between the shards are not supported for partitioned steps
+		unsupported := []string{}
+		if _, ok := rawSpecification.Stdin[step]; ok {
+			unsupported = append(unsupported, "stdin")
+		}
+		if _, ok := rawSpecification.StdoutArtifacts[step]; ok {
+			unsupported = append(unsupported, "stdout_artifacts")
+		}
+		if _, ok := rawSpecification.Contracts[step]; ok {
+			unsupported = append(unsupported, "contracts")
+		}
+		if _, ok := rawSpecification.StepHooks[step]; ok {
+			unsupported = append(unsupported, "step_hooks")
+		}
+		if _, ok := rawSpecification.OnSuccess[step]; ok {
+			unsupported = append(unsupported, "on_success")
+		}
+		if _, ok := rawSpecification.OnFailure[step]; ok {
+			unsupported = append(unsupported, "on_failure")
+		}
+		if len(unsupported) > 0 {
+			return rawSpecification, fmt.Errorf("Partitioned step (%s) cannot have %s", step, strings.Join(unsupported, ", "))
+		}
+		if rawSpecification.DeadLetters[step].Move {
+			return rawSpecification, fmt.Errorf("Partitioned step (%s) cannot move dead-lettered inputs, as its shards are copies of its input", step)
+		}
+
+		shards := make([]string, partition.Shards)
+		for i := range shards {
+			shards[i] = ShardStepName(step, i)
+			if _, ok := resolvedSpecification.Steps[shards[i]]; ok {
+				return rawSpecification, fmt.Errorf("Shard (%s) of partitioned step (%s) conflicts with an existing step", shards[i], step)
+			}
+		}
+
+		for _, shard := range shards {
+			resolvedSpecification.Steps[shard] = component
+			if dependencies, ok := resolvedSpecification.Dependencies[step]; ok {
+				resolvedSpecification.Dependencies[shard] = append([]string{}, dependencies...)
+			}
+			if dependencyTypes, ok := resolvedSpecification.DependencyTypes[step]; ok {
+				resolvedSpecification.DependencyTypes[shard] = dependencyTypes
+			}
+			if mounts, ok := resolvedSpecification.Mounts[step]; ok {
+				resolvedSpecification.Mounts[shard] = mounts
+			}
+			if env, ok := resolvedSpecification.Env[step]; ok {
+				resolvedSpecification.Env[shard] = env
+			}
+			if workdir, ok := resolvedSpecification.Workdirs[step]; ok {
+				resolvedSpecification.Workdirs[shard] = workdir
+			}
+			if target, ok := resolvedSpecification.Targets[step]; ok {
+				resolvedSpecification.Targets[shard] = target
+			}
+			if allowed, ok := resolvedSpecification.AllowFailure[step]; ok {
+				resolvedSpecification.AllowFailure[shard] = allowed
+			}
+			if attempts, ok := resolvedSpecification.Attempts[step]; ok {
+				resolvedSpecification.Attempts[shard] = attempts
+			}
+			if deadLetter, ok := resolvedSpecification.DeadLetters[step]; ok {
+				// Unless another of its mounts is named, the input of each shard is the shard itself
+				if deadLetter.Input == "" {
+					deadLetter.Input = partition.Target
+				}
+				resolvedSpecification.DeadLetters[shard] = deadLetter
+			}
+		}
+		delete(resolvedSpecification.Steps, step)
+		delete(resolvedSpecification.Dependencies, step)
+		delete(resolvedSpecification.DependencyTypes, step)
+		delete(resolvedSpecification.Mounts, step)
+		delete(resolvedSpecification.Env, step)
+		delete(resolvedSpecification.Workdirs, step)
+		delete(resolvedSpecification.Targets, step)
+		delete(resolvedSpecification.AllowFailure, step)
+		delete(resolvedSpecification.Attempts, step)
+		delete(resolvedSpecification.DeadLetters, step)
+
+		for dependent, dependencies := range resolvedSpecification.Dependencies {
+			replaced := []string{}
+			for _, dependency := range dependencies {
+				if dependency == step {
+					replaced = append(replaced, shards...)
+				} else {
+					replaced = append(replaced, dependency)
+				}
+			}
+			resolvedSpecification.Dependencies[dependent] = replaced
+			if dependencyType, ok := resolvedSpecification.DependencyTypes[dependent][step]; ok {
+				delete(resolvedSpecification.DependencyTypes[dependent], step)
+				for _, shard := range shards {
+					resolvedSpecification.DependencyTypes[dependent][shard] = dependencyType
+				}
+			}
+		}
+		if partition.Merge != "" {
+			mergeDependencies := map[string]bool{}
+			for _, dependency := range resolvedSpecification.Dependencies[partition.Merge] {
+				mergeDependencies[dependency] = true
+			}
+			for _, shard := range shards {
+				if !mergeDependencies[shard] {
+					resolvedSpecification.Dependencies[partition.Merge] = append(resolvedSpecification.Dependencies[partition.Merge], shard)
+				}
+			}
+		}
+
+		resolvedSpecification.Partitions[step] = partition
+	}
+
+	return resolvedSpecification, nil
+}
+
+// shardOfStep returns the partitioned step and the index of the shard that the given step
+// processes, if it is a shard step in the given flow specification
+func shardOfStep(specification FlowSpecification, step string) (string, int, bool) {
+	separator := strings.LastIndex(step, "-")
+	if separator < 0 {
+		return "", 0, false
+	}
+	partitionedStep := step[:separator]
+	partition, ok := specification.Partitions[partitionedStep]
+	if !ok {
+		return "", 0, false
+	}
+	index, err := strconv.Atoi(step[separator+1:])
+	if err != nil || index < 0 || index >= partition.Shards || ShardStepName(partitionedStep, index) != step {
+		return "", 0, false
+	}
+	return partitionedStep, index, true
+}
+
+// shardInputMount returns the mount of the directory containing the shard that the given step
+// processes (under the given scratch directory), if it is a shard step in the given flow
+// specification. The target of the mount is that of the partition, which is empty if the shard is
+// only available under the scratch mountpoint.
+func shardInputMount(scratchDir string, specification FlowSpecification, step string) (components.MountConfiguration, bool) {
+	partitionedStep, index, ok := shardOfStep(specification, step)
+	if !ok {
+		return components.MountConfiguration{}, false
+	}
+	return components.MountConfiguration{
+		Source: filepath.Join(scratchDir, PartitionsDirName, partitionedStep, strconv.Itoa(index)),
+		Target: specification.Partitions[partitionedStep].Target,
+		Method: "bind",
+	}, true
+}
+
+// withPartition returns the given mounts and environment for the container for the given step of
+// the given flow run, extended with the shard that the step processes if it is a shard step. The
+// input of the partitioned step is split into the scratch directory of the run when its first shard
+// starts.
+func withPartition(
+	scratchDir string,
+	run FlowRunMetadata,
+	specification FlowSpecification,
+	step string,
+	mounts []components.MountConfiguration,
+	env map[string]string,
+) ([]components.MountConfiguration, map[string]string, error) {
+	partitionedStep, index, ok := shardOfStep(specification, step)
+	if !ok {
+		return mounts, env, nil
+	}
+	partition := specification.Partitions[partitionedStep]
+
+	partitionDir := filepath.Join(scratchDir, PartitionsDirName, partitionedStep)
+	if _, err := os.Stat(partitionDir); os.IsNotExist(err) {
+		input := components.RenderTemplate(partition.Input, TemplateVariables(run, partitionedStep))
+		err = PartitionInput(input, partition.By, partition.Shards, partitionDir)
+		if err != nil {
+			return mounts, env, fmt.Errorf("Could not partition input (%s) of step (%s): %w", input, partitionedStep, err)
+		}
+	} else if err != nil {
+		return mounts, env, err
+	}
+
+	shardEnv := map[string]string{}
+	for key, value := range env {
+		shardEnv[key] = value
+	}
+	shardEnv[PartitionDirEnv] = filepath.ToSlash(filepath.Join(components.ScratchMountpoint, PartitionsDirName, partitionedStep, strconv.Itoa(index)))
+	shardEnv[PartitionIndexEnv] = strconv.Itoa(index)
+	shardEnv[PartitionCountEnv] = strconv.Itoa(partition.Shards)
+
+	if partition.Target == "" {
+		return mounts, shardEnv, nil
+	}
+	shardMount, _ := shardInputMount(scratchDir, specification, step)
+	shardMounts := append([]components.MountConfiguration{}, mounts...)
+	shardMounts = append(shardMounts, shardMount)
+	return shardMounts, shardEnv, nil
+}
+
+// PartitionInput splits the file or directory at the given input path into the given number of
+// shards by the given strategy. Each shard is written to a directory (named after its index) under
+// the given partition directory. Shards of a file contain a single file with the same name as the
+// input, while shards of a directory contain some of its files (at the same relative paths). Shards
+// may be empty if the input is too small to fill all of them.
+func PartitionInput(input, by string, shards int, partitionDir string) error {
+	if shards < 1 {
+		return fmt.Errorf("Number of shards must be positive: %d", shards)
+	}
+	info, err := os.Stat(input)
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(partitionDir), 0755)
+	if err != nil {
+		return err
+	}
+	// The input is split into a temporary directory which is renamed once all the shards have been
+	// written, so that a failed split is attempted again rather than leaving incomplete shards
+	tempDir, err := ioutil.TempDir(filepath.Dir(partitionDir), fmt.Sprintf(".%s-", filepath.Base(partitionDir)))
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(tempDir)
+	for i := 0; i < shards; i++ {
+		err = os.Mkdir(filepath.Join(tempDir, strconv.Itoa(i)), 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case info.IsDir() && (by == PartitionByFiles || by == PartitionBySize):
+		err = partitionDirectory(input, by, shards, tempDir)
+	case !info.IsDir() && by == PartitionByLines:
+		err = partitionFileByLines(input, shards, tempDir)
+	case !info.IsDir() && by == PartitionBySize:
+		err = partitionFileBySize(input, info.Size(), shards, tempDir)
+	case info.IsDir():
+		err = fmt.Errorf("Directories cannot be partitioned by %s", by)
+	default:
+		err = fmt.Errorf("Files cannot be partitioned by %s", by)
+	}
+	if err != nil {
+		return err
+	}
+
+	// Directories are made accessible to containers which do not run as the current user
+	err = os.Chmod(tempDir, 0755)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tempDir, partitionDir)
+}
+
+// partitionDirectory assigns the regular files under the given input directory to shards, either
+// in runs of (nearly) equal numbers of files (in lexicographic order of their paths) or, by size,
+// to whichever shard is smallest at the time (in decreasing order of their sizes). The files are
+// linked into the shards where possible and copied otherwise.
+func partitionDirectory(input, by string, shards int, partitionDir string) error {
+	type inputFile struct {
+		path string
+		size int64
+	}
+	files := []inputFile{}
+	err := filepath.Walk(input, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			relativePath, err := filepath.Rel(input, path)
+			if err != nil {
+				return err
+			}
+			files = append(files, inputFile{path: relativePath, size: info.Size()})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	assignments := make([]int, len(files))
+	if by == PartitionByFiles {
+		for i := range files {
+			assignments[i] = balancedShard(i, len(files), shards)
+		}
+	} else {
+		order := make([]int, len(files))
+		for i := range order {
+			order[i] = i
+		}
+		sort.SliceStable(order, func(i, j int) bool { return files[order[i]].size > files[order[j]].size })
+		shardSizes := make([]int64, shards)
+		for _, fileIndex := range order {
+			smallest := 0
+			for shard, size := range shardSizes {
+				if size < shardSizes[smallest] {
+					smallest = shard
+				}
+			}
+			assignments[fileIndex] = smallest
+			shardSizes[smallest] += files[fileIndex].size
+		}
+	}
+
+	for i, file := range files {
+		target := filepath.Join(partitionDir, strconv.Itoa(assignments[i]), file.path)
+		err = os.MkdirAll(filepath.Dir(target), 0755)
+		if err != nil {
+			return err
+		}
+		err = linkOrCopy(filepath.Join(input, file.path), target)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// balancedShard returns the shard to which the item with the given index (of the given number of
+// items) is assigned when the items are split, in order, into runs of (nearly) equal lengths. The
+// earlier shards get one more item than the later ones if the items cannot be split evenly.
+func balancedShard(index, items, shards int) int {
+	quotient, remainder := items/shards, items%shards
+	if index < remainder*(quotient+1) {
+		return index / (quotient + 1)
+	}
+	return remainder + (index-remainder*(quotient+1))/quotient
+}
+
+// linkOrCopy hard links the file at the given source path to the given target path, copying it if
+// it cannot be linked (e.g. because the paths are on different filesystems)
+func linkOrCopy(source, target string) error {
+	if err := os.Link(source, target); err == nil {
+		return nil
+	}
+
+	sourceFile, err := os.Open(source)
+	if err != nil {
+		return err
+	}
+	defer sourceFile.Close()
+	targetFile, err := os.Create(target)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(targetFile, sourceFile)
+	if err != nil {
+		targetFile.Close()
+		return err
+	}
+	return targetFile.Close()
+}
+
+// partitionFileByLines splits the file at the given input path into shards with (nearly) equal
+// numbers of lines
+func partitionFileByLines(input string, shards int, partitionDir string) error {
+	lines := 0
+	err := scanLines(input, func(line []byte) error {
+		lines++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	writer := newShardWriter(partitionDir, filepath.Base(input))
+	current := 0
+	err = scanLines(input, func(line []byte) error {
+		err := writer.write(balancedShard(current, lines, shards), line)
+		current++
+		return err
+	})
+	closeErr := writer.close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// partitionFileBySize splits the file at the given input path into shards of (nearly) equal sizes,
+// moving on to the next shard only at the end of a line
+func partitionFileBySize(input string, size int64, shards int, partitionDir string) error {
+	writer := newShardWriter(partitionDir, filepath.Base(input))
+	var offset int64
+	err := scanLines(input, func(line []byte) error {
+		// Each line goes to the shard which contains its midpoint
+		shard := int((2*offset + int64(len(line))) * int64(shards) / (2 * size))
+		offset += int64(len(line))
+		return writer.write(shard, line)
+	})
+	closeErr := writer.close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// scanLines calls the given function with each line (including its line terminator) of the file at
+// the given path
+func scanLines(path string, handle func(line []byte) error) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 {
+			handleErr := handle(line)
+			if handleErr != nil {
+				return handleErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// shardWriter writes lines to the files with a given name in the shard directories under a
+// partition directory, keeping the file for the current shard open
+type shardWriter struct {
+	partitionDir string
+	name         string
+	shard        int
+	file         *os.File
+	writer       *bufio.Writer
+}
+
+func newShardWriter(partitionDir, name string) *shardWriter {
+	return &shardWriter{partitionDir: partitionDir, name: name, shard: -1}
+}
+
+// write writes the given line to the file for the given shard
+func (w *shardWriter) write(shard int, line []byte) error {
+	if shard != w.shard {
+		err := w.close()
+		if err != nil {
+			return err
+		}
+		w.file, err = os.Create(filepath.Join(w.partitionDir, strconv.Itoa(shard), w.name))
+		if err != nil {
+			return err
+		}
+		w.writer = bufio.NewWriter(w.file)
+		w.shard = shard
+	}
+	_, err := w.writer.Write(line)
+	return err
+}
+
+// close flushes and closes the file for the current shard (if any)
+func (w *shardWriter) close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.writer.Flush()
+	closeErr := w.file.Close()
+	w.file = nil
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
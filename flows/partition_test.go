@@ -0,0 +1,256 @@
+package flows
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+func TestResolvePartitions(t *testing.T) {
+	mounts := []components.MountConfiguration{{Source: "/data/outputs", Target: "/shnorky/outputs", Method: "bind"}}
+	rawSpecification := FlowSpecification{
+		Steps:        map[string]string{"extract": "extractor", "transform": "transformer", "merge": "merger", "load": "loader"},
+		Dependencies: map[string][]string{"transform": {"extract"}, "load": {"transform", "merge"}},
+		Mounts:       map[string][]components.MountConfiguration{"transform": mounts},
+		Env:          map[string]map[string]string{"transform": {"LOG_LEVEL": "info"}},
+		Partitions: map[string]PartitionSpecification{
+			"transform": {Input: "/data/inputs.txt", Shards: 2, By: PartitionByLines, Target: "/shnorky/shard", Merge: "merge"},
+		},
+	}
+
+	specification, err := MaterializeFlowSpecification(rawSpecification)
+	if err != nil {
+		t.Fatalf("Unexpected error materializing specification: %s", err.Error())
+	}
+
+	expectedSteps := map[string]string{"extract": "extractor", "transform-0": "transformer", "transform-1": "transformer", "merge": "merger", "load": "loader"}
+	if !reflect.DeepEqual(specification.Steps, expectedSteps) {
+		t.Errorf("Unexpected steps: expected=%v, actual=%v", expectedSteps, specification.Steps)
+	}
+	expectedDependencies := map[string][]string{
+		"transform-0": {"extract"},
+		"transform-1": {"extract"},
+		"merge":       {"transform-0", "transform-1"},
+		"load":        {"transform-0", "transform-1", "merge"},
+	}
+	if !reflect.DeepEqual(specification.Dependencies, expectedDependencies) {
+		t.Errorf("Unexpected dependencies: expected=%v, actual=%v", expectedDependencies, specification.Dependencies)
+	}
+	for _, shard := range []string{"transform-0", "transform-1"} {
+		if !reflect.DeepEqual(specification.Mounts[shard], mounts) {
+			t.Errorf("Unexpected mounts for shard (%s): %v", shard, specification.Mounts[shard])
+		}
+		if specification.Env[shard]["LOG_LEVEL"] != "info" {
+			t.Errorf("Unexpected env for shard (%s): %v", shard, specification.Env[shard])
+		}
+	}
+	expectedStages := [][]string{{"extract"}, {"transform-0", "transform-1"}, {"merge"}, {"load"}}
+	for _, stage := range specification.Stages {
+		sort.Strings(stage)
+	}
+	if !reflect.DeepEqual(specification.Stages, expectedStages) {
+		t.Errorf("Unexpected stages: expected=%v, actual=%v", expectedStages, specification.Stages)
+	}
+	if _, ok := rawSpecification.Steps["transform-0"]; ok {
+		t.Error("Resolving partitions modified the raw specification")
+	}
+
+	partitionedStep, index, ok := shardOfStep(specification, "transform-1")
+	if !ok || partitionedStep != "transform" || index != 1 {
+		t.Errorf("Unexpected shard for step (transform-1): step=%s, index=%d, ok=%t", partitionedStep, index, ok)
+	}
+	for _, step := range []string{"transform-2", "extract", "transform-01"} {
+		if _, _, ok := shardOfStep(specification, step); ok {
+			t.Errorf("Did not expect step (%s) to be a shard", step)
+		}
+	}
+
+	invalidPartitions := []map[string]PartitionSpecification{
+		{"transform": {Input: "/data/inputs.txt", Shards: 0, By: PartitionByLines}},
+		{"transform": {Input: "/data/inputs.txt", Shards: 2, By: "rows"}},
+		{"transform": {Shards: 2, By: PartitionByLines}},
+		{"transform": {Input: "/data/inputs.txt", Shards: 2, By: PartitionByLines, Target: "shard"}},
+		{"transform": {Input: "/data/inputs.txt", Shards: 2, By: PartitionByLines, Merge: "combine"}},
+		{"transform": {Input: "/data/inputs.txt", Shards: 2, By: PartitionByLines, Merge: "transform"}},
+		{"report": {Input: "/data/inputs.txt", Shards: 2, By: PartitionByLines}},
+	}
+	for i, partitions := range invalidPartitions {
+		invalidSpecification := rawSpecification
+		invalidSpecification.Partitions = partitions
+		_, err := MaterializeFlowSpecification(invalidSpecification)
+		if err == nil {
+			t.Errorf("[Test %d] Expected error but got none", i)
+		}
+	}
+
+	// Types of dependencies carry over to the shards
+	typedSpecification := rawSpecification
+	typedSpecification.Steps = map[string]string{"db": "postgres", "transform": "transformer", "report": "reporter"}
+	typedSpecification.Dependencies = map[string][]string{"transform": {"requires:db"}, "report": {"requires:transform"}}
+	typedSpecification.Partitions = map[string]PartitionSpecification{"transform": {Input: "/data/inputs.txt", Shards: 2, By: PartitionByLines}}
+	specification, err = MaterializeFlowSpecification(typedSpecification)
+	if err != nil {
+		t.Fatalf("Unexpected error materializing specification with typed dependencies: %s", err.Error())
+	}
+	expectedTypes := map[string]map[string]string{
+		"transform-0": {"db": DependencyRequires},
+		"transform-1": {"db": DependencyRequires},
+		"report":      {"transform-0": DependencyRequires, "transform-1": DependencyRequires},
+	}
+	if !reflect.DeepEqual(specification.DependencyTypes, expectedTypes) {
+		t.Errorf("Unexpected dependency types: expected=%v, actual=%v", expectedTypes, specification.DependencyTypes)
+	}
+
+	invalidSpecification := rawSpecification
+	invalidSpecification.StdoutArtifacts = map[string]string{"transform": "transformed"}
+	_, err = MaterializeFlowSpecification(invalidSpecification)
+	if err == nil {
+		t.Error("Expected error for partitioned step with stdout artifact")
+	}
+
+	// Each shard is dead-lettered on its own, and its input defaults to the shard itself
+	deadLetterSpecification := rawSpecification
+	deadLetterSpecification.DeadLetters = map[string]DeadLetterSpecification{"transform": {Retries: 1, Directory: "/data/dead-letters"}}
+	specification, err = MaterializeFlowSpecification(deadLetterSpecification)
+	if err != nil {
+		t.Fatalf("Unexpected error materializing specification with dead letters: %s", err.Error())
+	}
+	expectedDeadLetter := DeadLetterSpecification{Retries: 1, Input: "/shnorky/shard", Directory: "/data/dead-letters"}
+	expectedDeadLetters := map[string]DeadLetterSpecification{"transform-0": expectedDeadLetter, "transform-1": expectedDeadLetter}
+	if !reflect.DeepEqual(specification.DeadLetters, expectedDeadLetters) {
+		t.Errorf("Unexpected dead letters: expected=%v, actual=%v", expectedDeadLetters, specification.DeadLetters)
+	}
+	if _, ok := deadLetterSpecification.DeadLetters["transform-0"]; ok {
+		t.Error("Resolving partitions modified the dead letters of the raw specification")
+	}
+
+	shardMount, ok := shardInputMount("/scratch", specification, "transform-1")
+	expectedShardMount := components.MountConfiguration{Source: filepath.Join("/scratch", PartitionsDirName, "transform", "1"), Target: "/shnorky/shard", Method: "bind"}
+	if !ok || shardMount != expectedShardMount {
+		t.Errorf("Unexpected shard input mount: expected=%v, actual=%v, ok=%t", expectedShardMount, shardMount, ok)
+	}
+	if _, ok := shardInputMount("/scratch", specification, "extract"); ok {
+		t.Error("Did not expect step (extract) to have a shard input mount")
+	}
+
+	// Shards are copies of the input of the partitioned step, so they cannot be moved
+	deadLetterSpecification.DeadLetters = map[string]DeadLetterSpecification{"transform": {Retries: 1, Directory: "/data/dead-letters", Move: true}}
+	_, err = MaterializeFlowSpecification(deadLetterSpecification)
+	if err == nil {
+		t.Error("Expected error for partitioned step which moves dead-lettered inputs")
+	}
+}
+
+func TestPartitionInput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shnorky-partition-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	inputFile := filepath.Join(dir, "inputs.txt")
+	err = ioutil.WriteFile(inputFile, []byte("a\nbb\nccc\ndddd\neeeee"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write input file: %s", err.Error())
+	}
+	inputDir := filepath.Join(dir, "inputs")
+	inputFiles := map[string]string{"a.txt": "a", "b.txt": "bbbbbbbb", "nested/c.txt": "cc", "nested/d.txt": "ddd"}
+	for name, content := range inputFiles {
+		err = os.MkdirAll(filepath.Dir(filepath.Join(inputDir, name)), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(filepath.Join(inputDir, name), []byte(content), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Could not write input file (%s): %s", name, err.Error())
+		}
+	}
+
+	type partitionTest struct {
+		input          string
+		by             string
+		shards         int
+		expectedShards []map[string]string
+		returnsError   bool
+	}
+
+	tests := []partitionTest{
+		{
+			input:          inputFile,
+			by:             PartitionByLines,
+			shards:         2,
+			expectedShards: []map[string]string{{"inputs.txt": "a\nbb\nccc\n"}, {"inputs.txt": "dddd\neeeee"}},
+		},
+		{
+			input:          inputFile,
+			by:             PartitionBySize,
+			shards:         2,
+			expectedShards: []map[string]string{{"inputs.txt": "a\nbb\nccc\n"}, {"inputs.txt": "dddd\neeeee"}},
+		},
+		{
+			input:          inputFile,
+			by:             PartitionByLines,
+			shards:         7,
+			expectedShards: []map[string]string{{"inputs.txt": "a\n"}, {"inputs.txt": "bb\n"}, {"inputs.txt": "ccc\n"}, {"inputs.txt": "dddd\n"}, {"inputs.txt": "eeeee"}, {}, {}},
+		},
+		{
+			input:  inputDir,
+			by:     PartitionByFiles,
+			shards: 2,
+			expectedShards: []map[string]string{
+				{"a.txt": "a", "b.txt": "bbbbbbbb"},
+				{"nested/c.txt": "cc", "nested/d.txt": "ddd"},
+			},
+		},
+		{
+			input:  inputDir,
+			by:     PartitionBySize,
+			shards: 2,
+			expectedShards: []map[string]string{
+				{"b.txt": "bbbbbbbb"},
+				{"a.txt": "a", "nested/c.txt": "cc", "nested/d.txt": "ddd"},
+			},
+		},
+		{input: inputDir, by: PartitionByLines, shards: 2, returnsError: true},
+		{input: inputFile, by: PartitionByFiles, shards: 2, returnsError: true},
+		{input: filepath.Join(dir, "missing.txt"), by: PartitionByLines, shards: 2, returnsError: true},
+	}
+
+	for i, test := range tests {
+		partitionDir := filepath.Join(dir, "partitions", strconv.Itoa(i))
+		err := PartitionInput(test.input, test.by, test.shards, partitionDir)
+		if test.returnsError {
+			if err == nil {
+				t.Errorf("[Test %d] Expected error but got none", i)
+			}
+			if _, statErr := os.Stat(partitionDir); !os.IsNotExist(statErr) {
+				t.Errorf("[Test %d] Expected no partition directory after failed partitioning", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[Test %d] Unexpected error: %s", i, err.Error())
+			continue
+		}
+		for shard, expectedFiles := range test.expectedShards {
+			shardDir := filepath.Join(partitionDir, strconv.Itoa(shard))
+			files := map[string]string{}
+			filepath.Walk(shardDir, func(path string, info os.FileInfo, err error) error {
+				if err == nil && info.Mode().IsRegular() {
+					relativePath, _ := filepath.Rel(shardDir, path)
+					content, _ := ioutil.ReadFile(path)
+					files[filepath.ToSlash(relativePath)] = string(content)
+				}
+				return nil
+			})
+			if !reflect.DeepEqual(files, expectedFiles) {
+				t.Errorf("[Test %d] Unexpected files in shard %d: expected=%v, actual=%v", i, shard, expectedFiles, files)
+			}
+		}
+	}
+}
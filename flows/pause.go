@@ -0,0 +1,153 @@
+package flows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// RunStatusPaused is the status of a flow run which has been paused: it does not start any more
+// stages until it is resumed
+var RunStatusPaused = "paused"
+
+// PausePollInterval is how often paused flow runs check the state database to see if they have
+// been resumed
+var PausePollInterval = time.Second
+
+// ErrRunNotRunning - signifies that a caller attempted to pause a flow run which is not running
+var ErrRunNotRunning = errors.New("The specified flow run is not running")
+
+// ErrRunNotPaused - signifies that a caller attempted to resume a flow run which is not paused
+var ErrRunNotPaused = errors.New("The specified flow run is not paused")
+
+// PauseRun pauses the given flow run, so that it does not start any more stages until it is
+// resumed. Steps which are already running are left to finish unless pauseContainers is true, in
+// which case their containers are paused as well (using docker pause). It returns the IDs of the
+// executions whose containers were paused.
+// This is the handler for `shn flows pause`
+func PauseRun(ctx context.Context, store state.Store, dockerClient *docker.Client, runID string, pauseContainers bool) ([]string, error) {
+	err := setUnfinishedRunStatus(store, runID, RunStatusRunning, RunStatusPaused, ErrRunNotRunning)
+	if err != nil {
+		return []string{}, err
+	}
+	if !pauseContainers {
+		return []string{}, nil
+	}
+
+	containers, err := runContainers(ctx, store, dockerClient, runID)
+	if err != nil {
+		return []string{}, err
+	}
+	paused := []string{}
+	for executionID, state := range containers {
+		if !state.Running || state.Paused {
+			continue
+		}
+		err = dockerClient.ContainerPause(ctx, executionID)
+		if err != nil {
+			return paused, fmt.Errorf("Error pausing container for execution (%s): %w", executionID, err)
+		}
+		paused = append(paused, executionID)
+	}
+	return paused, nil
+}
+
+// ResumeRun resumes the given paused flow run, unpausing any of its containers which were paused.
+// The run continues from the stage at which it was paused. It returns the IDs of the executions
+// whose containers were unpaused.
+// This is the handler for `shn flows resume`
+func ResumeRun(ctx context.Context, store state.Store, dockerClient *docker.Client, runID string) ([]string, error) {
+	unpaused := []string{}
+	containers, err := runContainers(ctx, store, dockerClient, runID)
+	if err != nil {
+		return unpaused, err
+	}
+	for executionID, state := range containers {
+		if !state.Paused {
+			continue
+		}
+		err = dockerClient.ContainerUnpause(ctx, executionID)
+		if err != nil {
+			return unpaused, fmt.Errorf("Error unpausing container for execution (%s): %w", executionID, err)
+		}
+		unpaused = append(unpaused, executionID)
+	}
+
+	return unpaused, setUnfinishedRunStatus(store, runID, RunStatusPaused, RunStatusRunning, ErrRunNotPaused)
+}
+
+// setUnfinishedRunStatus changes the status of the given flow run from one status to another,
+// returning notInStatusErr if the run is not in the former status (or has finished)
+func setUnfinishedRunStatus(store state.Store, runID, from, to string, notInStatusErr error) error {
+	_, err := SelectFlowRunByID(store, runID)
+	if err != nil {
+		return err
+	}
+	updated, err := store.TransitionFlowRun(runID, from, to)
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return notInStatusErr
+	}
+	return nil
+}
+
+// containerState - the parts of the state of an execution's container that pausing cares about
+type containerState struct {
+	Running bool
+	Paused  bool
+}
+
+// runContainers returns the states of the containers of the unfinished executions in the given
+// flow run (keyed by execution ID). Executions of steps which run on the host have no containers
+// and are skipped.
+func runContainers(ctx context.Context, store state.Store, dockerClient *docker.Client, runID string) (map[string]containerState, error) {
+	executions, err := components.SelectExecutionsByFlowRunID(store, runID)
+	if err != nil {
+		return map[string]containerState{}, err
+	}
+	containers := map[string]containerState{}
+	for _, execution := range executions {
+		if execution.FinishedAt != nil || isHostStep(execution.ComponentID) {
+			continue
+		}
+		info, err := dockerClient.ContainerInspect(ctx, execution.ID)
+		if err != nil {
+			return containers, fmt.Errorf("Error inspecting container for execution (%s): %w", execution.ID, err)
+		}
+		containers[execution.ID] = containerState{Running: info.State.Running, Paused: info.State.Paused}
+	}
+	return containers, nil
+}
+
+// waitWhilePaused returns as soon as the given flow run is not paused, reporting the pause (before
+// the given stage) through progress
+func waitWhilePaused(ctx context.Context, store state.Store, runID string, stage int, progress *progressWriter) error {
+	reported := false
+	for {
+		run, err := SelectFlowRunByID(store, runID)
+		if err != nil {
+			return err
+		}
+		if run.Status != RunStatusPaused {
+			return nil
+		}
+		if !reported {
+			progress.runPaused(run, stage)
+			reported = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(PausePollInterval):
+		}
+	}
+}
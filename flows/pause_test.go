@@ -0,0 +1,102 @@
+package flows
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestPauseAndResumeRun(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-pause-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatalf("Error opening state database file (%s): %s", stateDBPath, err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	originalPollInterval := PausePollInterval
+	PausePollInterval = 10 * time.Millisecond
+	defer func() { PausePollInterval = originalPollInterval }()
+
+	ctx := context.Background()
+	finishedAt := time.Now()
+	running := FlowRunMetadata{ID: "running", FlowID: "flow", Status: RunStatusRunning, CreatedAt: time.Now()}
+	finished := FlowRunMetadata{ID: "finished", FlowID: "flow", Status: RunStatusSucceeded, CreatedAt: time.Now(), FinishedAt: &finishedAt}
+	for _, run := range []FlowRunMetadata{running, finished} {
+		err = InsertFlowRun(store, run)
+		if err != nil {
+			t.Fatalf("Could not insert flow run (%s): %s", run.ID, err.Error())
+		}
+	}
+	err = UpdateFlowRunStatus(store, finished)
+	if err != nil {
+		t.Fatalf("Could not finish flow run: %s", err.Error())
+	}
+
+	_, err = PauseRun(ctx, store, nil, finished.ID, false)
+	if err != ErrRunNotRunning {
+		t.Errorf("Unexpected error pausing finished run: expected=%v, actual=%v", ErrRunNotRunning, err)
+	}
+	_, err = ResumeRun(ctx, store, nil, running.ID)
+	if err != ErrRunNotPaused {
+		t.Errorf("Unexpected error resuming running run: expected=%v, actual=%v", ErrRunNotPaused, err)
+	}
+	_, err = PauseRun(ctx, store, nil, "nonexistent", false)
+	if err != ErrFlowRunNotFound {
+		t.Errorf("Unexpected error pausing nonexistent run: expected=%v, actual=%v", ErrFlowRunNotFound, err)
+	}
+
+	_, err = PauseRun(ctx, store, nil, running.ID, false)
+	if err != nil {
+		t.Fatalf("Could not pause run: %s", err.Error())
+	}
+	pausedRun, err := SelectFlowRunByID(store, running.ID)
+	if err != nil {
+		t.Fatalf("Could not select run: %s", err.Error())
+	}
+	if pausedRun.Status != RunStatusPaused {
+		t.Errorf("Unexpected status for paused run: %s", pausedRun.Status)
+	}
+
+	waited := make(chan error, 1)
+	go func() {
+		waited <- waitWhilePaused(ctx, store, running.ID, 0, nil)
+	}()
+	select {
+	case err = <-waited:
+		t.Fatalf("Stopped waiting before run was resumed: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	_, err = ResumeRun(ctx, store, nil, running.ID)
+	if err != nil {
+		t.Fatalf("Could not resume run: %s", err.Error())
+	}
+	select {
+	case err = <-waited:
+		if err != nil {
+			t.Errorf("Unexpected error waiting for run to be resumed: %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Still waiting after run was resumed")
+	}
+}
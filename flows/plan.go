@@ -0,0 +1,171 @@
+package flows
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// PlannedStep - a step of a flow plan, along with the historical mean duration of its successful
+// executions
+type PlannedStep struct {
+	Step      string `json:"step"`
+	Component string `json:"component"`
+	// Samples is the number of successful executions that MeanSeconds was calculated from. If it is
+	// 0, the step has never executed successfully and its duration is unknown.
+	Samples     int     `json:"samples"`
+	MeanSeconds float64 `json:"mean_seconds"`
+	// Critical is true if the step lies on the critical path of the flow
+	Critical bool `json:"critical"`
+}
+
+// FlowPlan - the stages in which the steps of a flow are executed, annotated with their historical
+// durations
+type FlowPlan struct {
+	FlowID string          `json:"flow_id"`
+	Stages [][]PlannedStep `json:"stages"`
+	// CriticalPath is the chain of dependent steps with the greatest total duration - the flow can
+	// never finish faster than it, however many steps execute in parallel
+	CriticalPath        []string `json:"critical_path"`
+	CriticalPathSeconds float64  `json:"critical_path_seconds"`
+	// EstimatedSeconds is how long a run of the flow is expected to take when its stages are
+	// executed one after another, each taking as long as its slowest step
+	EstimatedSeconds float64 `json:"estimated_seconds"`
+	// Complete is false if some of the steps have no duration statistics, in which case the
+	// durations in the plan are lower bounds
+	Complete bool `json:"complete"`
+}
+
+// PlanFlow calculates the plan of the flow with the given ID from its specification and the
+// duration statistics of (at most) the window most recent successful executions of each its steps.
+// This is the handler for `shn flows plan`
+func PlanFlow(store state.Store, flowID string, window int) (FlowPlan, error) {
+	specification, err := ReadFlowSpecification(store, flowID)
+	if err != nil {
+		return FlowPlan{}, err
+	}
+
+	statistics, err := StepDurationStatistics(store, flowID, window)
+	if err != nil {
+		return FlowPlan{}, err
+	}
+
+	plan := Plan(specification, statistics)
+	plan.FlowID = flowID
+	return plan, nil
+}
+
+// Plan annotates the stages of the given (materialized) flow specification with the given duration
+// statistics and calculates its critical path. Steps without statistics are treated as taking no
+// time.
+func Plan(specification FlowSpecification, statistics map[string]DurationStatistics) FlowPlan {
+	plan := FlowPlan{Stages: make([][]PlannedStep, len(specification.Stages)), Complete: true}
+
+	durations := map[string]float64{}
+	for step, stepStatistics := range statistics {
+		durations[step] = stepStatistics.MeanSeconds
+	}
+	plan.CriticalPath, plan.CriticalPathSeconds = criticalPath(specification, durations)
+	critical := map[string]bool{}
+	for _, step := range plan.CriticalPath {
+		critical[step] = true
+	}
+
+	for i, stage := range specification.Stages {
+		steps := append([]string{}, stage...)
+		sort.Strings(steps)
+		var stageSeconds float64
+		for _, step := range steps {
+			stepStatistics, ok := statistics[step]
+			if !ok {
+				plan.Complete = false
+			}
+			if stepStatistics.MeanSeconds > stageSeconds {
+				stageSeconds = stepStatistics.MeanSeconds
+			}
+			plan.Stages[i] = append(plan.Stages[i], PlannedStep{
+				Step:        step,
+				Component:   specification.Steps[step],
+				Samples:     stepStatistics.Samples,
+				MeanSeconds: stepStatistics.MeanSeconds,
+				Critical:    critical[step],
+			})
+		}
+		plan.EstimatedSeconds += stageSeconds
+	}
+
+	return plan
+}
+
+// criticalPath returns the chain of dependent steps of the given (materialized) flow specification
+// with the greatest total duration, given the durations (in seconds) of its steps, along with that
+// total duration. Steps which do not appear in durations are treated as taking no time.
+func criticalPath(specification FlowSpecification, durations map[string]float64) ([]string, float64) {
+	// finishes[step] is the total duration of the longest chain of dependencies ending in step, and
+	// predecessors[step] is the dependency preceding step in that chain
+	finishes := map[string]float64{}
+	predecessors := map[string]string{}
+	last := ""
+	for _, stage := range specification.Stages {
+		steps := append([]string{}, stage...)
+		sort.Strings(steps)
+		for _, step := range steps {
+			var start float64
+			dependencies := append([]string{}, specification.Dependencies[step]...)
+			sort.Strings(dependencies)
+			for _, dependency := range dependencies {
+				if predecessors[step] == "" || finishes[dependency] > start {
+					start = finishes[dependency]
+					predecessors[step] = dependency
+				}
+			}
+			finishes[step] = start + durations[step]
+			// Stages are visited in order, so ties go to the later step (which extends the chain)
+			if last == "" || finishes[step] >= finishes[last] {
+				last = step
+			}
+		}
+	}
+
+	path := []string{}
+	for step := last; step != ""; step = predecessors[step] {
+		path = append([]string{step}, path...)
+	}
+	return path, finishes[last]
+}
+
+// WritePlan writes the given flow plan to the given writer as a human-readable table, followed by
+// its critical path and estimated duration. Steps on the critical path are marked with a "*".
+func WritePlan(w io.Writer, plan FlowPlan) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STAGE\tSTEP\tCOMPONENT\tSAMPLES\tMEAN\tCRITICAL")
+	for i, stage := range plan.Stages {
+		for _, step := range stage {
+			mean := "unknown"
+			if step.Samples > 0 {
+				mean = fmt.Sprintf("%.1fs", step.MeanSeconds)
+			}
+			critical := ""
+			if step.Critical {
+				critical = "*"
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\t%d\t%s\t%s\n", i+1, step.Step, step.Component, step.Samples, mean, critical)
+		}
+	}
+	err := tw.Flush()
+	if err != nil {
+		return err
+	}
+
+	bound := ""
+	if !plan.Complete {
+		bound = "at least "
+	}
+	fmt.Fprintf(w, "\nCritical path: %s (%s%.1fs)\n", strings.Join(plan.CriticalPath, " -> "), bound, plan.CriticalPathSeconds)
+	_, err = fmt.Fprintf(w, "Estimated duration: %s%.1fs (stage by stage)\n", bound, plan.EstimatedSeconds)
+	return err
+}
@@ -0,0 +1,100 @@
+package flows
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPlan(t *testing.T) {
+	specification, err := MaterializeFlowSpecification(FlowSpecification{
+		Steps:        map[string]string{"extract": "extractor", "clean": "cleaner", "enrich": "enricher", "load": "loader"},
+		Dependencies: map[string][]string{"clean": {"extract"}, "enrich": {"extract"}, "load": {"clean", "enrich"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error materializing specification: %s", err.Error())
+	}
+
+	type PlanTest struct {
+		statistics                  map[string]DurationStatistics
+		expectedCriticalPath        []string
+		expectedCriticalPathSeconds float64
+		expectedEstimatedSeconds    float64
+		expectedComplete            bool
+	}
+
+	tests := []PlanTest{
+		{
+			statistics: map[string]DurationStatistics{
+				"extract": {Samples: 3, MeanSeconds: 10},
+				"clean":   {Samples: 3, MeanSeconds: 5},
+				"enrich":  {Samples: 3, MeanSeconds: 30},
+				"load":    {Samples: 3, MeanSeconds: 2},
+			},
+			expectedCriticalPath:        []string{"extract", "enrich", "load"},
+			expectedCriticalPathSeconds: 42,
+			expectedEstimatedSeconds:    42,
+			expectedComplete:            true,
+		},
+		{
+			statistics: map[string]DurationStatistics{
+				"extract": {Samples: 1, MeanSeconds: 10},
+				"clean":   {Samples: 1, MeanSeconds: 20},
+			},
+			expectedCriticalPath:        []string{"extract", "clean", "load"},
+			expectedCriticalPathSeconds: 30,
+			expectedEstimatedSeconds:    30,
+			expectedComplete:            false,
+		},
+		{
+			statistics:                  map[string]DurationStatistics{},
+			expectedCriticalPath:        []string{"extract", "clean", "load"},
+			expectedCriticalPathSeconds: 0,
+			expectedEstimatedSeconds:    0,
+			expectedComplete:            false,
+		},
+	}
+
+	for i, test := range tests {
+		plan := Plan(specification, test.statistics)
+		if !reflect.DeepEqual(plan.CriticalPath, test.expectedCriticalPath) {
+			t.Errorf("[Test %d] Unexpected critical path: expected=%v, actual=%v", i, test.expectedCriticalPath, plan.CriticalPath)
+		}
+		if plan.CriticalPathSeconds != test.expectedCriticalPathSeconds {
+			t.Errorf("[Test %d] Unexpected critical path duration: expected=%f, actual=%f", i, test.expectedCriticalPathSeconds, plan.CriticalPathSeconds)
+		}
+		if plan.EstimatedSeconds != test.expectedEstimatedSeconds {
+			t.Errorf("[Test %d] Unexpected estimated duration: expected=%f, actual=%f", i, test.expectedEstimatedSeconds, plan.EstimatedSeconds)
+		}
+		if plan.Complete != test.expectedComplete {
+			t.Errorf("[Test %d] Unexpected completeness: expected=%t, actual=%t", i, test.expectedComplete, plan.Complete)
+		}
+		if len(plan.Stages) != 3 || len(plan.Stages[1]) != 2 {
+			t.Errorf("[Test %d] Unexpected stages: %v", i, plan.Stages)
+		}
+		for _, stage := range plan.Stages {
+			for _, step := range stage {
+				onPath := false
+				for _, critical := range test.expectedCriticalPath {
+					onPath = onPath || critical == step.Step
+				}
+				if step.Critical != onPath {
+					t.Errorf("[Test %d] Unexpected criticality of step (%s): %t", i, step.Step, step.Critical)
+				}
+			}
+		}
+	}
+
+	var buffer bytes.Buffer
+	err = WritePlan(&buffer, Plan(specification, tests[1].statistics))
+	if err != nil {
+		t.Fatalf("Unexpected error writing plan: %s", err.Error())
+	}
+	output := buffer.String()
+	for _, expected := range []string{"enrich", "unknown", "Critical path: extract -> clean -> load (at least 30.0s)", "Estimated duration: at least 30.0s"} {
+		if !strings.Contains(output, expected) {
+			t.Errorf("Plan output does not contain %q:\n%s", expected, output)
+		}
+	}
+}
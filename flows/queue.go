@@ -0,0 +1,87 @@
+package flows
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// RunStatusQueued is the status of a flow run which is waiting for other runs to finish before it
+// starts (because the state configuration limits the number of concurrent runs)
+var RunStatusQueued = "queued"
+
+// QueuePollInterval is how often queued flow runs check the state database to see if they can
+// start
+var QueuePollInterval = time.Second
+
+// activeRunStatuses are the statuses of the flow runs which are in progress, and so count towards
+// the limit on concurrent runs in the state configuration
+var activeRunStatuses = []string{RunStatusRunning, RunStatusPaused}
+
+// QueuedRuns returns the flow runs which are waiting to start (including submitted runs which are
+// waiting for a worker), in the order in which they will start: highest priority first and, among
+// runs with the same priority, oldest first
+// This is the handler for `shn queue list`
+func QueuedRuns(store state.Store) ([]FlowRunMetadata, error) {
+	records, err := store.SelectQueuedFlowRuns([]string{RunStatusQueued, RunStatusSubmitted})
+	return flowRunsFromRecords(records), err
+}
+
+// ActiveRuns returns the number of flow runs which are in progress (running or paused), i.e. which
+// count towards the limit on concurrent runs
+func ActiveRuns(store state.Store) (int, error) {
+	return store.CountUnfinishedFlowRuns(activeRunStatuses)
+}
+
+// waitForTurn waits until the given queued flow run is at the head of the queue and fewer than
+// maxConcurrent runs are in progress, and then marks it as running. Its position in the queue is
+// reported through progress whenever it changes. If the context is cancelled while the run is
+// queued, the run is marked as failed.
+func waitForTurn(ctx context.Context, store state.Store, run FlowRunMetadata, maxConcurrent int, progress *progressWriter) (FlowRunMetadata, error) {
+	reportedPosition := 0
+	for {
+		queue, err := QueuedRuns(store)
+		if err != nil {
+			return run, err
+		}
+		position := 0
+		for i, queuedRun := range queue {
+			if queuedRun.ID == run.ID {
+				position = i + 1
+				break
+			}
+		}
+		if position == 0 {
+			return run, fmt.Errorf("Flow run (%s) left the queue before it started", run.ID)
+		}
+
+		if position == 1 {
+			// Checking the limit and starting the run at once means that two processes cannot both
+			// take the last free slot
+			started, err := store.StartFlowRun(run.ID, RunStatusQueued, RunStatusRunning, activeRunStatuses, maxConcurrent)
+			if err != nil {
+				return run, err
+			}
+			if started {
+				run.Status = RunStatusRunning
+				return run, nil
+			}
+		}
+		if position != reportedPosition {
+			progress.runQueued(run, position)
+			reportedPosition = position
+		}
+
+		select {
+		case <-ctx.Done():
+			finishedAt := time.Now()
+			run.Status = RunStatusFailed
+			run.FinishedAt = &finishedAt
+			UpdateFlowRunStatus(store, run)
+			return run, ctx.Err()
+		case <-time.After(QueuePollInterval):
+		}
+	}
+}
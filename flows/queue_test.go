@@ -0,0 +1,129 @@
+package flows
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestRunQueue(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-queue-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatalf("Error opening state database file (%s): %s", stateDBPath, err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	originalPollInterval := QueuePollInterval
+	QueuePollInterval = 10 * time.Millisecond
+	defer func() { QueuePollInterval = originalPollInterval }()
+
+	ctx := context.Background()
+	createdAt := time.Now()
+	running := FlowRunMetadata{ID: "running", FlowID: "flow", Status: RunStatusRunning, CreatedAt: createdAt}
+	low := FlowRunMetadata{ID: "low", FlowID: "flow", Status: RunStatusQueued, CreatedAt: createdAt, Priority: -1}
+	first := FlowRunMetadata{ID: "first", FlowID: "flow", Status: RunStatusQueued, CreatedAt: createdAt}
+	second := FlowRunMetadata{ID: "second", FlowID: "flow", Status: RunStatusQueued, CreatedAt: createdAt}
+	high := FlowRunMetadata{ID: "high", FlowID: "flow", Status: RunStatusQueued, CreatedAt: createdAt, Priority: 5}
+	for _, run := range []FlowRunMetadata{running, low, first, second, high} {
+		err = InsertFlowRun(store, run)
+		if err != nil {
+			t.Fatalf("Could not insert flow run (%s): %s", run.ID, err.Error())
+		}
+	}
+
+	queue, err := QueuedRuns(store)
+	if err != nil {
+		t.Fatalf("Could not list queued runs: %s", err.Error())
+	}
+	expectedOrder := []string{high.ID, first.ID, second.ID, low.ID}
+	if len(queue) != len(expectedOrder) {
+		t.Fatalf("Unexpected number of queued runs: expected=%d, actual=%d", len(expectedOrder), len(queue))
+	}
+	for i, run := range queue {
+		if run.ID != expectedOrder[i] {
+			t.Errorf("Unexpected run at position %d in queue: expected=%s, actual=%s", i+1, expectedOrder[i], run.ID)
+		}
+	}
+
+	// Runs which are not at the head of the queue do not start, even if there are free slots
+	waitCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	failedRun, err := waitForTurn(waitCtx, store, low, 10, nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Unexpected error waiting for turn of run at back of queue: expected=%v, actual=%v", context.DeadlineExceeded, err)
+	}
+	if failedRun.Status != RunStatusFailed || failedRun.FinishedAt == nil {
+		t.Errorf("Run was not failed after it was cancelled while queued: %v", failedRun)
+	}
+
+	started := make(chan FlowRunMetadata, 1)
+	go func() {
+		startedRun, _ := waitForTurn(ctx, store, high, 1, nil)
+		started <- startedRun
+	}()
+	select {
+	case <-started:
+		t.Fatal("Queued run started while the maximum number of runs were in progress")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	finishedAt := time.Now()
+	running.Status = RunStatusSucceeded
+	running.FinishedAt = &finishedAt
+	err = UpdateFlowRunStatus(store, running)
+	if err != nil {
+		t.Fatalf("Could not finish flow run: %s", err.Error())
+	}
+	select {
+	case startedRun := <-started:
+		if startedRun.Status != RunStatusRunning {
+			t.Errorf("Unexpected status for started run: %s", startedRun.Status)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Queued run did not start after a slot became free")
+	}
+
+	active, err := ActiveRuns(store)
+	if err != nil {
+		t.Fatalf("Could not count active runs: %s", err.Error())
+	}
+	if active != 1 {
+		t.Errorf("Unexpected number of active runs: expected=1, actual=%d", active)
+	}
+
+	// The next run in the queue cannot take the slot held by the started run
+	startedFirst, err := store.StartFlowRun(first.ID, RunStatusQueued, RunStatusRunning, activeRunStatuses, 1)
+	if err != nil {
+		t.Fatalf("Could not attempt to start queued run: %s", err.Error())
+	}
+	if startedFirst {
+		t.Error("Store reported starting a queued run even though no slot was free")
+	}
+	firstRun, err := SelectFlowRunByID(store, first.ID)
+	if err != nil {
+		t.Fatalf("Could not select flow run: %s", err.Error())
+	}
+	if firstRun.Status != RunStatusQueued {
+		t.Errorf("Queued run started even though no slot was free: %s", firstRun.Status)
+	}
+}
@@ -0,0 +1,87 @@
+package flows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// DefaultMaxConcurrentRuns is the number of runs of a flow which may be unfinished at once, unless
+// its specification sets max_concurrent_runs. It guards non-idempotent flows from being run twice
+// at the same time by accident.
+var DefaultMaxConcurrentRuns = 1
+
+// ErrFlowRunQuotaExceeded signifies that a run of a flow could not start because the flow already
+// has as many unfinished runs as its specification allows
+var ErrFlowRunQuotaExceeded = errors.New("Flow already has the maximum number of concurrent runs")
+
+// unfinishedRunStatuses are the statuses of the flow runs which count towards the limit on
+// concurrent runs of their flows
+var unfinishedRunStatuses = []string{RunStatusSubmitted, RunStatusQueued, RunStatusRunning, RunStatusPaused}
+
+type quotaWaitKey struct{}
+
+// WithQuotaWait returns a copy of the given context with which flow runs wait for a slot to free up
+// when their flow already has as many unfinished runs as it allows (see
+// FlowSpecification.MaxConcurrentRuns), rather than failing with ErrFlowRunQuotaExceeded
+func WithQuotaWait(ctx context.Context) context.Context {
+	return context.WithValue(ctx, quotaWaitKey{}, true)
+}
+
+// maxConcurrentRuns returns the number of runs of the flow with the given specification which may
+// be unfinished at once
+func maxConcurrentRuns(specification FlowSpecification) int {
+	if specification.MaxConcurrentRuns > 0 {
+		return specification.MaxConcurrentRuns
+	}
+	return DefaultMaxConcurrentRuns
+}
+
+// UnfinishedRuns returns the IDs of the runs of the given flow which count towards its limit on
+// concurrent runs: those which are submitted, queued, running, or paused, oldest first
+func UnfinishedRuns(store state.Store, flowID string) ([]string, error) {
+	return store.SelectUnfinishedFlowRunIDs(flowID, unfinishedRunStatuses)
+}
+
+// insertRunWithinQuota records the given (fresh) flow run in the state database once its flow has
+// fewer than maxRuns unfinished runs. If the flow has no free slot, it fails with an error wrapping
+// ErrFlowRunQuotaExceeded - unless the context was created by WithQuotaWait, in which case it checks
+// again every QueuePollInterval (reporting through progress that the run is waiting) until a slot
+// frees up or the context is cancelled.
+func insertRunWithinQuota(ctx context.Context, store state.Store, run FlowRunMetadata, maxRuns int, progress *progressWriter) error {
+	wait, _ := ctx.Value(quotaWaitKey{}).(bool)
+	reported := false
+	for {
+		// Checking the quota and inserting the run at once means that two processes cannot both take
+		// the last free slot
+		inserted, err := store.InsertFlowRunWithinQuota(state.FlowRunRecord(run), unfinishedRunStatuses, maxRuns)
+		if err != nil {
+			return fmt.Errorf("Error inserting flow run into state database: %w", err)
+		}
+		if inserted {
+			return nil
+		}
+
+		if !wait {
+			runIDs, err := UnfinishedRuns(store, run.FlowID)
+			if err != nil {
+				return err
+			}
+			return fmt.Errorf("%w (%d) - unfinished runs: %s", ErrFlowRunQuotaExceeded, maxRuns, strings.Join(runIDs, ", "))
+		}
+		if !reported {
+			progress.runWaitingForQuota(run, maxRuns)
+			reported = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(QueuePollInterval):
+		}
+	}
+}
@@ -0,0 +1,107 @@
+package flows
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestRunQuota(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-quota-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatalf("Error opening state database file (%s): %s", stateDBPath, err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	originalPollInterval := QueuePollInterval
+	QueuePollInterval = 10 * time.Millisecond
+	defer func() { QueuePollInterval = originalPollInterval }()
+
+	if maxConcurrentRuns(FlowSpecification{}) != DefaultMaxConcurrentRuns || maxConcurrentRuns(FlowSpecification{MaxConcurrentRuns: 3}) != 3 {
+		t.Errorf("Unexpected limits on concurrent runs")
+	}
+
+	ctx := context.Background()
+	createdAt := time.Now()
+	running := FlowRunMetadata{ID: "running", FlowID: "flow", Status: RunStatusRunning, CreatedAt: createdAt}
+	err = insertRunWithinQuota(ctx, store, running, 1, nil)
+	if err != nil {
+		t.Fatalf("Could not insert first flow run: %s", err.Error())
+	}
+
+	// Runs of other flows are not affected by the quota
+	other := FlowRunMetadata{ID: "other", FlowID: "other-flow", Status: RunStatusRunning, CreatedAt: createdAt}
+	err = insertRunWithinQuota(ctx, store, other, 1, nil)
+	if err != nil {
+		t.Errorf("Could not insert run of another flow: %s", err.Error())
+	}
+
+	second := FlowRunMetadata{ID: "second", FlowID: "flow", Status: RunStatusRunning, CreatedAt: createdAt}
+	err = insertRunWithinQuota(ctx, store, second, 1, nil)
+	if !errors.Is(err, ErrFlowRunQuotaExceeded) {
+		t.Errorf("Unexpected error inserting run beyond quota: expected=%v, actual=%v", ErrFlowRunQuotaExceeded, err)
+	}
+	_, err = SelectFlowRunByID(store, second.ID)
+	if err != ErrFlowRunNotFound {
+		t.Errorf("Run beyond quota was inserted: %v", err)
+	}
+	unfinished, err := UnfinishedRuns(store, "flow")
+	if err != nil || len(unfinished) != 1 || unfinished[0] != running.ID {
+		t.Errorf("Unexpected unfinished runs: %v, err=%v", unfinished, err)
+	}
+
+	inserted := make(chan error, 1)
+	go func() {
+		inserted <- insertRunWithinQuota(WithQuotaWait(ctx), store, second, 1, nil)
+	}()
+	select {
+	case <-inserted:
+		t.Fatal("Waiting run was inserted while its flow had no free slot")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	finishedAt := time.Now()
+	running.Status = RunStatusSucceeded
+	running.FinishedAt = &finishedAt
+	err = UpdateFlowRunStatus(store, running)
+	if err != nil {
+		t.Fatalf("Could not finish flow run: %s", err.Error())
+	}
+	select {
+	case err = <-inserted:
+		if err != nil {
+			t.Errorf("Unexpected error inserting waiting run: %s", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiting run was not inserted after a slot became free")
+	}
+
+	waitCtx, cancel := context.WithTimeout(WithQuotaWait(ctx), 50*time.Millisecond)
+	defer cancel()
+	third := FlowRunMetadata{ID: "third", FlowID: "flow", Status: RunStatusRunning, CreatedAt: createdAt}
+	err = insertRunWithinQuota(waitCtx, store, third, 1, nil)
+	if err != context.DeadlineExceeded {
+		t.Errorf("Unexpected error waiting for a slot: expected=%v, actual=%v", context.DeadlineExceeded, err)
+	}
+}
@@ -0,0 +1,110 @@
+package flows
+
+import (
+	"context"
+	"time"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// RunHeartbeatInterval is how often the process executing a flow run records (as the heartbeat of
+// the run) that it is still alive
+var RunHeartbeatInterval = 30 * time.Second
+
+// AbandonedRunTimeout is how long after its last heartbeat an unfinished flow run is considered to
+// have been abandoned by the process which was executing it (see ReconcileRuns)
+var AbandonedRunTimeout = 2 * time.Minute
+
+// executingRunStatuses are the statuses of the flow runs which a process is executing (as opposed
+// to submitted runs, which wait for workers)
+var executingRunStatuses = []string{RunStatusQueued, RunStatusRunning, RunStatusPaused}
+
+// keepRunAlive records a heartbeat for the flow run with the given ID now, and then every
+// RunHeartbeatInterval until the returned function is called, so that ReconcileRuns does not mistake
+// the run for one which was abandoned
+func keepRunAlive(store state.Store, runID string) func() {
+	beat := func() {
+		store.UpdateFlowRunHeartbeat(runID, time.Now())
+	}
+	beat()
+
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(RunHeartbeatInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				beat()
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// ReconcileRuns records the flow runs which were abandoned by the processes executing them (e.g.
+// because those processes were killed) as failed, so that they stop counting towards the limits on
+// concurrent runs and release their resources (see ClaimRunResources). A queued, running, or paused
+// run is considered abandoned once it has not recorded a heartbeat for AbandonedRunTimeout and none
+// of its executions are still running - executions should be reconciled first (see
+// components.ReconcileExecutions). Submitted runs wait for workers rather than processes, so they
+// are never abandoned. The returned runs are those which were recorded as failed.
+func ReconcileRuns(store state.Store) ([]FlowRunMetadata, error) {
+
+	cutoff := time.Now().Add(-AbandonedRunTimeout)
+	records, err := store.SelectAbandonedFlowRuns(executingRunStatuses, cutoff)
+	if err != nil {
+		return []FlowRunMetadata{}, err
+	}
+
+	failed := []FlowRunMetadata{}
+	for _, run := range flowRunsFromRecords(records) {
+		// The run is only failed if it is still abandoned, in case it recorded a heartbeat (or
+		// started an execution) since it was selected
+		finishedAt := time.Now()
+		run.Status = RunStatusFailed
+		run.FinishedAt = &finishedAt
+		updated, err := store.FailAbandonedFlowRun(state.FlowRunRecord(run), executingRunStatuses, cutoff)
+		if err != nil {
+			return failed, err
+		}
+		if updated {
+			failed = append(failed, run)
+		}
+	}
+	return failed, nil
+}
+
+// detachedContext carries the values (e.g. log fields and tracing spans) of the context that it
+// wraps, but is never cancelled. Flow runs which were cancelled use it to clean up after themselves.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// stopUnfinishedSteps stops the containers of the given executions (keyed by step), which had not
+// finished when their flow run was cancelled, and records their results. Executions which do not run
+// in containers (e.g. those of gate steps) are skipped.
+func stopUnfinishedSteps(ctx context.Context, store state.Store, dockerClient *docker.Client, executions map[string]components.ExecutionMetadata) {
+	for step, executionMetadata := range executions {
+		if executionMetadata.ExitCode != nil || executionMetadata.BuildID == executionMetadata.ComponentID {
+			continue
+		}
+		timeout := ServiceStopTimeout
+		err := dockerClient.ContainerStop(ctx, executionMetadata.ID, &timeout)
+		if err == nil {
+			_, err = components.WaitForExecution(ctx, store, dockerClient, executionMetadata.ID)
+		}
+		if err != nil {
+			components.Logger(ctx).WithFields(components.ExecutionLogFields(executionMetadata)).WithField("error", err.Error()).Warnf("Could not stop step (%s) of cancelled flow run", step)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package flows
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestReconcileRuns(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-reconcile-runs-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatalf("Error opening state database file (%s): %s", stateDBPath, err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	// Every run was created long enough ago to have been abandoned, had it not recorded heartbeats
+	createdAt := time.Now().Add(-time.Hour)
+	runs := map[string]FlowRunMetadata{
+		"leftover":   {ID: "leftover", FlowID: "flow", Status: RunStatusRunning, CreatedAt: createdAt},
+		"paused":     {ID: "paused", FlowID: "other-flow", Status: RunStatusPaused, CreatedAt: createdAt},
+		"alive":      {ID: "alive", FlowID: "alive-flow", Status: RunStatusRunning, CreatedAt: createdAt},
+		"executing":  {ID: "executing", FlowID: "executing-flow", Status: RunStatusRunning, CreatedAt: createdAt},
+		"submitted":  {ID: "submitted", FlowID: "submitted-flow", Status: RunStatusSubmitted, CreatedAt: createdAt},
+		"succeeded":  {ID: "succeeded", FlowID: "succeeded-flow", Status: RunStatusSucceeded, CreatedAt: createdAt},
+		"gate-waits": {ID: "gate-waits", FlowID: "gate-flow", Status: RunStatusRunning, CreatedAt: createdAt},
+	}
+	for _, run := range runs {
+		err = InsertFlowRun(store, run)
+		if err != nil {
+			t.Fatalf("[%s] Could not insert flow run: %s", run.ID, err.Error())
+		}
+	}
+	err = ClaimRunResources(store, runs["leftover"], RunResources(FlowSpecification{}, runs["leftover"], "/scratch/leftover"))
+	if err != nil {
+		t.Fatalf("Could not claim resources for leftover run: %s", err.Error())
+	}
+
+	// The container of an execution of the "executing" run may still be running, whereas the
+	// execution of the gate step of the "gate-waits" run has no container
+	executions := []components.ExecutionMetadata{
+		{ID: "container-execution", BuildID: "build", ComponentID: "component", CreatedAt: createdAt, FlowID: "executing-flow", FlowRunID: "executing", Step: "step"},
+		{ID: "gate-execution", BuildID: GateComponentID, ComponentID: GateComponentID, CreatedAt: createdAt, FlowID: "gate-flow", FlowRunID: "gate-waits", Step: "approve"},
+	}
+	for _, execution := range executions {
+		err = components.InsertExecution(store, execution)
+		if err != nil {
+			t.Fatalf("[%s] Could not insert execution: %s", execution.ID, err.Error())
+		}
+	}
+
+	stopHeartbeat := keepRunAlive(store, "alive")
+	defer stopHeartbeat()
+
+	// The leftover run holds the only slot that its flow allows
+	next := FlowRunMetadata{ID: "next", FlowID: "flow", Status: RunStatusRunning, CreatedAt: time.Now()}
+	err = insertRunWithinQuota(context.Background(), store, next, 1, nil)
+	if err == nil {
+		t.Fatal("Expected leftover run to count towards the quota of its flow")
+	}
+
+	abandoned, err := ReconcileRuns(store)
+	if err != nil {
+		t.Fatalf("Could not reconcile flow runs: %s", err.Error())
+	}
+	expectedAbandoned := map[string]bool{"leftover": true, "paused": true, "gate-waits": true}
+	if len(abandoned) != len(expectedAbandoned) {
+		t.Errorf("Unexpected number of abandoned runs: expected=%d, actual=%d", len(expectedAbandoned), len(abandoned))
+	}
+	for _, run := range abandoned {
+		if !expectedAbandoned[run.ID] {
+			t.Errorf("Unexpected abandoned run: %s", run.ID)
+		}
+	}
+
+	for runID, run := range runs {
+		storedRun, err := SelectFlowRunByID(store, runID)
+		if err != nil {
+			t.Fatalf("[%s] Could not select flow run: %s", runID, err.Error())
+		}
+		expectedStatus := run.Status
+		if expectedAbandoned[runID] {
+			expectedStatus = RunStatusFailed
+		}
+		if storedRun.Status != expectedStatus {
+			t.Errorf("[%s] Unexpected status: expected=%s, actual=%s", runID, expectedStatus, storedRun.Status)
+		}
+		if expectedAbandoned[runID] && storedRun.FinishedAt == nil {
+			t.Errorf("[%s] Abandoned run was not finished", runID)
+		}
+	}
+
+	// Once the leftover run has failed, its flow has a free slot and its resources are released
+	err = insertRunWithinQuota(context.Background(), store, next, 1, nil)
+	if err != nil {
+		t.Errorf("Could not insert run after leftover run was reconciled: %s", err.Error())
+	}
+	err = ClaimRunResources(store, next, []RunResource{{Kind: RunResourceScratchDir, Name: "/scratch/leftover"}})
+	if err != nil {
+		t.Errorf("Could not claim resources released by leftover run: %s", err.Error())
+	}
+
+	// Reconciling again changes nothing
+	abandoned, err = ReconcileRuns(store)
+	if err != nil || len(abandoned) != 0 {
+		t.Errorf("Unexpected result of reconciling again: abandoned=%v, err=%v", abandoned, err)
+	}
+}
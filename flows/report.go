@@ -0,0 +1,286 @@
+package flows
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+	"time"
+
+	units "github.com/docker/go-units"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// StepReport - summary of the execution of a single step in a flow run. A step which was retried is
+// summarized over all of its attempts: it runs from the start of its first attempt to the end of its
+// last one, its outcome is that of its last attempt, and its resource usage adds up the usage of
+// every attempt (apart from its peak memory, which is the highest of any attempt).
+type StepReport struct {
+	Step string `json:"step"`
+	// ExecutionID is the ID of the execution of the last attempt at the step
+	ExecutionID string `json:"execution_id"`
+	// ExecutionIDs are the IDs of the executions of every attempt at the step, in order
+	ExecutionIDs    []string   `json:"execution_ids"`
+	ComponentID     string     `json:"component_id"`
+	ExitCode        *int       `json:"exit_code"`
+	OOMKilled       bool       `json:"oom_killed"`
+	StartedAt       time.Time  `json:"started_at"`
+	FinishedAt      *time.Time `json:"finished_at"`
+	DurationSeconds float64    `json:"duration_seconds"`
+	Attempts        int        `json:"attempts"`
+	Retries         int        `json:"retries"`
+	// BuildID is the ID of the build (i.e. image) that the step was executed from. It is empty for
+	// steps which do not run in containers (e.g. gate steps).
+	BuildID string `json:"build_id"`
+	// BuildCached is true if the build already existed when the run started, rather than being built
+	// for the run (e.g. because the source of its component had changed). This does not reflect
+	// docker's layer cache, which shnorky does not record.
+	BuildCached bool `json:"build_cached"`
+	components.ResourceUsage
+}
+
+// RunTotals - aggregate statistics over all the steps in a flow run
+type RunTotals struct {
+	// DurationSeconds is the wall-clock duration of the flow run
+	DurationSeconds float64 `json:"duration_seconds"`
+	// StepSeconds is the sum of the durations of the individual steps in the flow run
+	StepSeconds     float64 `json:"step_seconds"`
+	CPUSeconds      float64 `json:"cpu_seconds"`
+	PeakMemoryBytes int64   `json:"peak_memory_bytes"`
+	IOReadBytes     int64   `json:"io_read_bytes"`
+	IOWriteBytes    int64   `json:"io_write_bytes"`
+	// Retries is the number of times that steps of the flow run were retried
+	Retries int `json:"retries"`
+	// CachedBuilds is the number of steps whose builds already existed when the run started
+	CachedBuilds int `json:"cached_builds"`
+}
+
+// RunReport - summary of a flow run, with per-step details and totals for the run
+type RunReport struct {
+	Run    FlowRunMetadata `json:"run"`
+	Steps  []StepReport    `json:"steps"`
+	Totals RunTotals       `json:"totals"`
+	// CriticalPath is only calculated on request (see AnalyzeCriticalPath)
+	CriticalPath *CriticalPathReport `json:"critical_path,omitempty"`
+}
+
+// CriticalPathStep - a step on the critical path of a flow run
+type CriticalPathStep struct {
+	Step            string  `json:"step"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	// Share is the fraction of the wall-clock duration of the run that the step took up
+	Share float64 `json:"share"`
+}
+
+// CriticalPathReport - the chain of dependent steps which determined the wall-clock duration of a
+// flow run
+type CriticalPathReport struct {
+	Steps           []CriticalPathStep `json:"steps"`
+	DurationSeconds float64            `json:"duration_seconds"`
+	// Bottleneck is the step on the critical path which took the longest
+	Bottleneck string `json:"bottleneck"`
+}
+
+// durationSince returns the number of seconds between start and end. If end is nil (i.e. the
+// corresponding run or step is still in progress), the current time is used instead.
+func durationSince(start time.Time, end *time.Time) float64 {
+	if end == nil {
+		return time.Since(start).Seconds()
+	}
+	return end.Sub(start).Seconds()
+}
+
+// GenerateRunReport builds a report for the flow run with the given runID from the executions
+// recorded against it in the given state database. The steps in the report are in the order in
+// which they started.
+func GenerateRunReport(store state.Store, runID string) (RunReport, error) {
+	run, err := SelectFlowRunByID(store, runID)
+	if err != nil {
+		return RunReport{}, err
+	}
+
+	executions, err := components.SelectExecutionsByFlowRunID(store, runID)
+	if err != nil {
+		return RunReport{}, fmt.Errorf("Error retrieving executions for flow run (%s): %w", runID, err)
+	}
+
+	report := RunReport{Run: run, Steps: []StepReport{}}
+	report.Totals.DurationSeconds = durationSince(run.CreatedAt, run.FinishedAt)
+
+	// Executions are ordered by creation time, so the attempts at each step are visited in order.
+	// lastAttempts holds the attempt numbers of the latest attempts visited, which decide the
+	// outcomes of their steps.
+	stepIndices := map[string]int{}
+	lastAttempts := map[string]int{}
+	for _, execution := range executions {
+		i, ok := stepIndices[execution.Step]
+		if !ok {
+			i = len(report.Steps)
+			stepIndices[execution.Step] = i
+			report.Steps = append(report.Steps, StepReport{Step: execution.Step, ExecutionIDs: []string{}, StartedAt: execution.CreatedAt})
+		}
+		stepReport := &report.Steps[i]
+		stepReport.Attempts++
+		stepReport.ExecutionIDs = append(stepReport.ExecutionIDs, execution.ID)
+		stepReport.CPUSeconds += execution.CPUSeconds
+		stepReport.IOReadBytes += execution.IOReadBytes
+		stepReport.IOWriteBytes += execution.IOWriteBytes
+		if execution.PeakMemoryBytes > stepReport.PeakMemoryBytes {
+			stepReport.PeakMemoryBytes = execution.PeakMemoryBytes
+		}
+		if ok && execution.Attempt < lastAttempts[execution.Step] {
+			continue
+		}
+		lastAttempts[execution.Step] = execution.Attempt
+		stepReport.ExecutionID = execution.ID
+		stepReport.ComponentID = execution.ComponentID
+		stepReport.ExitCode = execution.ExitCode
+		stepReport.OOMKilled = execution.OOMKilled
+		stepReport.FinishedAt = execution.FinishedAt
+		if execution.BuildID != execution.ComponentID {
+			stepReport.BuildID = execution.BuildID
+		}
+	}
+
+	for i := range report.Steps {
+		stepReport := &report.Steps[i]
+		stepReport.Retries = stepReport.Attempts - 1
+		stepReport.DurationSeconds = durationSince(stepReport.StartedAt, stepReport.FinishedAt)
+		if stepReport.BuildID != "" {
+			build, err := components.SelectBuildByID(store, stepReport.BuildID)
+			if err != nil && err != components.ErrBuildNotFound {
+				return report, fmt.Errorf("Error retrieving build (%s) for step (%s): %w", stepReport.BuildID, stepReport.Step, err)
+			}
+			stepReport.BuildCached = err == nil && build.CreatedAt.Before(run.CreatedAt)
+		}
+
+		report.Totals.StepSeconds += stepReport.DurationSeconds
+		report.Totals.CPUSeconds += stepReport.CPUSeconds
+		if stepReport.PeakMemoryBytes > report.Totals.PeakMemoryBytes {
+			report.Totals.PeakMemoryBytes = stepReport.PeakMemoryBytes
+		}
+		report.Totals.IOReadBytes += stepReport.IOReadBytes
+		report.Totals.IOWriteBytes += stepReport.IOWriteBytes
+		report.Totals.Retries += stepReport.Retries
+		if stepReport.BuildCached {
+			report.Totals.CachedBuilds++
+		}
+	}
+
+	return report, nil
+}
+
+// WriteRunReportTable writes the given run report to the given writer as a human-readable table
+func WriteRunReportTable(w io.Writer, report RunReport) error {
+	fmt.Fprintf(w, "Run: %s (flow: %s, status: %s)\n\n", report.Run.ID, report.Run.FlowID, report.Run.Status)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tEXECUTION\tEXIT CODE\tRETRIES\tBUILD\tDURATION\tCPU\tPEAK MEMORY\tI/O READ\tI/O WRITE")
+	for _, step := range report.Steps {
+		exitCode := "running"
+		if step.ExitCode != nil {
+			exitCode = fmt.Sprintf("%d", *step.ExitCode)
+			if step.OOMKilled {
+				exitCode += " (OOM)"
+			}
+		}
+		build := "-"
+		if step.BuildCached {
+			build = "cached"
+		} else if step.BuildID != "" {
+			build = "built"
+		}
+		fmt.Fprintf(
+			tw,
+			"%s\t%s\t%s\t%d\t%s\t%.1fs\t%.1fs\t%s\t%s\t%s\n",
+			step.Step,
+			step.ExecutionID,
+			exitCode,
+			step.Retries,
+			build,
+			step.DurationSeconds,
+			step.CPUSeconds,
+			units.BytesSize(float64(step.PeakMemoryBytes)),
+			units.BytesSize(float64(step.IOReadBytes)),
+			units.BytesSize(float64(step.IOWriteBytes)),
+		)
+	}
+	fmt.Fprintf(
+		tw,
+		"TOTAL\t\t\t%d\t%d cached\t%.1fs\t%.1fs\t%s\t%s\t%s\n",
+		report.Totals.Retries,
+		report.Totals.CachedBuilds,
+		report.Totals.DurationSeconds,
+		report.Totals.CPUSeconds,
+		units.BytesSize(float64(report.Totals.PeakMemoryBytes)),
+		units.BytesSize(float64(report.Totals.IOReadBytes)),
+		units.BytesSize(float64(report.Totals.IOWriteBytes)),
+	)
+	err := tw.Flush()
+	if err != nil || report.CriticalPath == nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "\nCritical path (%.1fs of %.1fs):\n\n", report.CriticalPath.DurationSeconds, report.Totals.DurationSeconds)
+	tw = tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tDURATION\tSHARE\tBOTTLENECK")
+	for _, step := range report.CriticalPath.Steps {
+		bottleneck := ""
+		if step.Step == report.CriticalPath.Bottleneck {
+			bottleneck = "*"
+		}
+		fmt.Fprintf(tw, "%s\t%.1fs\t%.0f%%\t%s\n", step.Step, step.DurationSeconds, step.Share*100, bottleneck)
+	}
+
+	return tw.Flush()
+}
+
+// AnalyzeCriticalPath calculates the critical path of the flow run summarized by the given report
+// using the current specification of its flow, and attaches it to the report
+func AnalyzeCriticalPath(store state.Store, report *RunReport) error {
+	specification, err := ReadFlowSpecification(store, report.Run.FlowID)
+	if err != nil {
+		return err
+	}
+
+	criticalPathReport := RunCriticalPath(specification, *report)
+	report.CriticalPath = &criticalPathReport
+	return nil
+}
+
+// RunCriticalPath calculates the critical path of the flow run summarized by the given report from
+// the recorded durations of its steps and the dependencies between them in the given (materialized)
+// flow specification. The duration of a step which was retried runs from the start of its first
+// attempt to the end of its last one.
+func RunCriticalPath(specification FlowSpecification, report RunReport) CriticalPathReport {
+	starts := map[string]time.Time{}
+	ends := map[string]time.Time{}
+	for _, step := range report.Steps {
+		end := step.StartedAt.Add(time.Duration(step.DurationSeconds * float64(time.Second)))
+		if start, ok := starts[step.Step]; !ok || step.StartedAt.Before(start) {
+			starts[step.Step] = step.StartedAt
+		}
+		if end.After(ends[step.Step]) {
+			ends[step.Step] = end
+		}
+	}
+	durations := map[string]float64{}
+	for step, start := range starts {
+		durations[step] = ends[step].Sub(start).Seconds()
+	}
+
+	path, pathSeconds := criticalPath(specification, durations)
+	criticalPathReport := CriticalPathReport{Steps: make([]CriticalPathStep, len(path)), DurationSeconds: pathSeconds}
+	for i, step := range path {
+		criticalPathReport.Steps[i] = CriticalPathStep{Step: step, DurationSeconds: durations[step]}
+		if report.Totals.DurationSeconds > 0 {
+			criticalPathReport.Steps[i].Share = durations[step] / report.Totals.DurationSeconds
+		}
+		if criticalPathReport.Bottleneck == "" || durations[step] > durations[criticalPathReport.Bottleneck] {
+			criticalPathReport.Bottleneck = step
+		}
+	}
+
+	return criticalPathReport
+}
@@ -0,0 +1,252 @@
+package flows
+
+import (
+	"bytes"
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// TestGenerateRunReport records a flow run with three finished steps (one of which was retried) in a
+// temporary state database and checks the per-step details and totals in the resulting report
+func TestGenerateRunReport(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-run-report-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Error creating state directory: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	start := time.Unix(time.Now().Unix()-100, 0)
+	runFinishedAt := start.Add(60 * time.Second)
+	run := FlowRunMetadata{ID: "run", FlowID: "flow", Status: RunStatusRunning, CreatedAt: start}
+	err = InsertFlowRun(store, run)
+	if err != nil {
+		t.Fatalf("Error inserting flow run: %s", err.Error())
+	}
+	run.Status = RunStatusSucceeded
+	run.FinishedAt = &runFinishedAt
+	err = UpdateFlowRunStatus(store, run)
+	if err != nil {
+		t.Fatalf("Error updating flow run: %s", err.Error())
+	}
+
+	// The first two steps run a build which existed before the run, and the flaky step runs one which
+	// was built for the run
+	builds := []components.BuildMetadata{
+		{ID: "build", ComponentID: "component", CreatedAt: start.Add(-10 * time.Second)},
+		{ID: "new-build", ComponentID: "flaky-component", CreatedAt: start.Add(time.Second)},
+	}
+	for _, build := range builds {
+		err = components.InsertBuild(store, build)
+		if err != nil {
+			t.Fatalf("[Build %s] Error inserting build: %s", build.ID, err.Error())
+		}
+	}
+
+	stepDurations := map[string]int{"first": 20, "second": 30, "flaky": 10}
+	stepUsage := map[string]components.ResourceUsage{
+		"first":  {PeakMemoryBytes: 1024, CPUSeconds: 10, IOReadBytes: 100, IOWriteBytes: 10},
+		"second": {PeakMemoryBytes: 4096, CPUSeconds: 5, IOReadBytes: 200, IOWriteBytes: 20},
+	}
+	offset := 0
+	for _, step := range []string{"first", "second"} {
+		execution := components.ExecutionMetadata{
+			ID:          "execution-" + step,
+			BuildID:     "build",
+			ComponentID: "component",
+			CreatedAt:   start.Add(time.Duration(offset) * time.Second),
+			FlowID:      run.FlowID,
+			FlowRunID:   run.ID,
+			Step:        step,
+		}
+		err = components.InsertExecution(store, execution)
+		if err != nil {
+			t.Fatalf("[Step %s] Error inserting execution: %s", step, err.Error())
+		}
+		offset += stepDurations[step]
+		exitCode := 0
+		finishedAt := start.Add(time.Duration(offset) * time.Second)
+		execution.ExitCode = &exitCode
+		execution.FinishedAt = &finishedAt
+		execution.ResourceUsage = stepUsage[step]
+		err = components.UpdateExecutionResult(store, execution)
+		if err != nil {
+			t.Fatalf("[Step %s] Error updating execution result: %s", step, err.Error())
+		}
+	}
+
+	// The flaky step fails on its first attempt and succeeds when it is retried
+	flakyAttempts := []struct {
+		offset, duration, exitCode int
+		usage                      components.ResourceUsage
+	}{
+		{50, 5, 1, components.ResourceUsage{PeakMemoryBytes: 2048, CPUSeconds: 1, IOReadBytes: 10, IOWriteBytes: 1}},
+		{56, 4, 0, components.ResourceUsage{PeakMemoryBytes: 1024, CPUSeconds: 2, IOReadBytes: 20, IOWriteBytes: 2}},
+	}
+	previousAttemptID := ""
+	for i, attempt := range flakyAttempts {
+		execution := components.ExecutionMetadata{
+			ID:                fmt.Sprintf("execution-flaky-%d", i+1),
+			BuildID:           "new-build",
+			ComponentID:       "flaky-component",
+			CreatedAt:         start.Add(time.Duration(attempt.offset) * time.Second),
+			FlowID:            run.FlowID,
+			FlowRunID:         run.ID,
+			Step:              "flaky",
+			Attempt:           i + 1,
+			PreviousAttemptID: previousAttemptID,
+		}
+		err = components.InsertExecution(store, execution)
+		if err != nil {
+			t.Fatalf("[Attempt %d] Error inserting execution: %s", i+1, err.Error())
+		}
+		exitCode := attempt.exitCode
+		finishedAt := execution.CreatedAt.Add(time.Duration(attempt.duration) * time.Second)
+		execution.ExitCode = &exitCode
+		execution.FinishedAt = &finishedAt
+		execution.ResourceUsage = attempt.usage
+		err = components.UpdateExecutionResult(store, execution)
+		if err != nil {
+			t.Fatalf("[Attempt %d] Error updating execution result: %s", i+1, err.Error())
+		}
+		previousAttemptID = execution.ID
+	}
+	stepUsage["flaky"] = components.ResourceUsage{PeakMemoryBytes: 2048, CPUSeconds: 3, IOReadBytes: 30, IOWriteBytes: 3}
+
+	report, err := GenerateRunReport(store, run.ID)
+	if err != nil {
+		t.Fatalf("Error generating run report: %s", err.Error())
+	}
+
+	if report.Run.Status != RunStatusSucceeded {
+		t.Errorf("Unexpected run status: expected=%s, actual=%s", RunStatusSucceeded, report.Run.Status)
+	}
+	if len(report.Steps) != 3 {
+		t.Fatalf("Unexpected number of steps in report: expected=%d, actual=%d", 3, len(report.Steps))
+	}
+	expectedRetries := map[string]int{"first": 0, "second": 0, "flaky": 1}
+	for _, stepReport := range report.Steps {
+		if stepReport.Retries != expectedRetries[stepReport.Step] || stepReport.Attempts != expectedRetries[stepReport.Step]+1 {
+			t.Errorf("[Step %s] Unexpected retries: expected=%d, actual=%d (attempts=%d)", stepReport.Step, expectedRetries[stepReport.Step], stepReport.Retries, stepReport.Attempts)
+		}
+		if stepReport.BuildCached != (stepReport.Step != "flaky") {
+			t.Errorf("[Step %s] Unexpected build cache hit: %v", stepReport.Step, stepReport.BuildCached)
+		}
+		if stepReport.DurationSeconds != float64(stepDurations[stepReport.Step]) {
+			t.Errorf("[Step %s] Unexpected duration: expected=%d, actual=%f", stepReport.Step, stepDurations[stepReport.Step], stepReport.DurationSeconds)
+		}
+		if stepReport.ResourceUsage != stepUsage[stepReport.Step] {
+			t.Errorf("[Step %s] Unexpected resource usage: expected=%v, actual=%v", stepReport.Step, stepUsage[stepReport.Step], stepReport.ResourceUsage)
+		}
+	}
+
+	flaky := report.Steps[2]
+	if flaky.Step != "flaky" || flaky.ExecutionID != "execution-flaky-2" || *flaky.ExitCode != 0 || !reflect.DeepEqual(flaky.ExecutionIDs, []string{"execution-flaky-1", "execution-flaky-2"}) {
+		t.Errorf("Unexpected report for retried step: %v", flaky)
+	}
+
+	// The retried step is counted once, over both of its attempts
+	expectedTotals := RunTotals{
+		DurationSeconds: 60,
+		StepSeconds:     60,
+		CPUSeconds:      18,
+		PeakMemoryBytes: 4096,
+		IOReadBytes:     330,
+		IOWriteBytes:    33,
+		Retries:         1,
+		CachedBuilds:    2,
+	}
+	if report.Totals != expectedTotals {
+		t.Errorf("Unexpected totals: expected=%v, actual=%v", expectedTotals, report.Totals)
+	}
+
+	var buf bytes.Buffer
+	err = WriteRunReportTable(&buf, report)
+	if err != nil {
+		t.Fatalf("Error writing report table: %s", err.Error())
+	}
+	for _, expected := range []string{"execution-first", "execution-second", "execution-flaky-2", "cached", "TOTAL"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Report table did not contain expected string (%s):\n%s", expected, buf.String())
+		}
+	}
+
+	_, err = GenerateRunReport(store, "nonexistent-run")
+	if err != ErrFlowRunNotFound {
+		t.Errorf("Expected ErrFlowRunNotFound for nonexistent run, got: %v", err)
+	}
+}
+
+func TestRunCriticalPath(t *testing.T) {
+	specification, err := MaterializeFlowSpecification(FlowSpecification{
+		Steps:        map[string]string{"extract": "extractor", "clean": "cleaner", "enrich": "enricher", "load": "loader"},
+		Dependencies: map[string][]string{"clean": {"extract"}, "enrich": {"extract"}, "load": {"clean", "enrich"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error materializing specification: %s", err.Error())
+	}
+
+	start := time.Unix(time.Now().Unix()-1000, 0)
+	// enrich failed once and was retried, so its duration spans both attempts
+	report := RunReport{
+		Steps: []StepReport{
+			{Step: "extract", StartedAt: start, DurationSeconds: 10},
+			{Step: "clean", StartedAt: start.Add(10 * time.Second), DurationSeconds: 15},
+			{Step: "enrich", StartedAt: start.Add(10 * time.Second), DurationSeconds: 5},
+			{Step: "enrich", StartedAt: start.Add(20 * time.Second), DurationSeconds: 40},
+			{Step: "load", StartedAt: start.Add(60 * time.Second), DurationSeconds: 20},
+		},
+		Totals: RunTotals{DurationSeconds: 80},
+	}
+
+	criticalPath := RunCriticalPath(specification, report)
+	expectedSteps := []CriticalPathStep{
+		{Step: "extract", DurationSeconds: 10, Share: 0.125},
+		{Step: "enrich", DurationSeconds: 50, Share: 0.625},
+		{Step: "load", DurationSeconds: 20, Share: 0.25},
+	}
+	if !reflect.DeepEqual(criticalPath.Steps, expectedSteps) {
+		t.Errorf("Unexpected critical path: expected=%v, actual=%v", expectedSteps, criticalPath.Steps)
+	}
+	if criticalPath.DurationSeconds != 80 {
+		t.Errorf("Unexpected critical path duration: expected=%d, actual=%f", 80, criticalPath.DurationSeconds)
+	}
+	if criticalPath.Bottleneck != "enrich" {
+		t.Errorf("Unexpected bottleneck: expected=%s, actual=%s", "enrich", criticalPath.Bottleneck)
+	}
+
+	report.CriticalPath = &criticalPath
+	var buf bytes.Buffer
+	err = WriteRunReportTable(&buf, report)
+	if err != nil {
+		t.Fatalf("Error writing report table: %s", err.Error())
+	}
+	for _, expected := range []string{"Critical path (80.0s of 80.0s)", "62%", "BOTTLENECK"} {
+		if !strings.Contains(buf.String(), expected) {
+			t.Errorf("Report table did not contain expected string (%s):\n%s", expected, buf.String())
+		}
+	}
+}
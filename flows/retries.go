@@ -0,0 +1,46 @@
+package flows
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+// DockerRetriesSpecification - specifies how the docker API calls made for runs of a flow (image
+// builds, and creating, starting, and inspecting containers) are retried when they fail with
+// transient errors, overriding the default policy (components.DefaultDockerRetryPolicy)
+type DockerRetriesSpecification struct {
+	// Attempts is the maximum number of times each call is made. Setting it to 1 disables retries.
+	Attempts int `json:"attempts"`
+	// Interval is how long to wait before the first retry (e.g. "5s"). The wait doubles with each
+	// subsequent retry. If empty, the interval of the default policy is used.
+	Interval string `json:"interval,omitempty"`
+}
+
+// MaterializeDockerRetriesSpecification validates the given docker retries specification
+func MaterializeDockerRetriesSpecification(rawSpecification DockerRetriesSpecification) (DockerRetriesSpecification, error) {
+	if rawSpecification.Attempts < 1 {
+		return rawSpecification, fmt.Errorf("Invalid attempts (must be at least 1): %d", rawSpecification.Attempts)
+	}
+	if rawSpecification.Interval != "" {
+		interval, err := time.ParseDuration(rawSpecification.Interval)
+		if err != nil {
+			return rawSpecification, fmt.Errorf("Invalid interval: %w", err)
+		}
+		if interval <= 0 {
+			return rawSpecification, fmt.Errorf("Invalid interval (must be positive): %s", rawSpecification.Interval)
+		}
+	}
+	return rawSpecification, nil
+}
+
+// Policy returns the retry policy described by the (materialized) docker retries specification
+func (specification DockerRetriesSpecification) Policy() components.DockerRetryPolicy {
+	policy := components.DockerRetryPolicy{Attempts: specification.Attempts, Interval: components.DefaultDockerRetryPolicy.Interval}
+	if specification.Interval != "" {
+		// The interval was validated on materialization
+		policy.Interval, _ = time.ParseDuration(specification.Interval)
+	}
+	return policy
+}
@@ -0,0 +1,61 @@
+package flows
+
+import (
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+func TestMaterializeDockerRetries(t *testing.T) {
+	type dockerRetriesTest struct {
+		dockerRetries  *DockerRetriesSpecification
+		returnsError   bool
+		expectedPolicy components.DockerRetryPolicy
+	}
+
+	testCases := []dockerRetriesTest{
+		{
+			dockerRetries:  &DockerRetriesSpecification{Attempts: 10, Interval: "5s"},
+			returnsError:   false,
+			expectedPolicy: components.DockerRetryPolicy{Attempts: 10, Interval: 5 * time.Second},
+		},
+		{
+			dockerRetries:  &DockerRetriesSpecification{Attempts: 1},
+			returnsError:   false,
+			expectedPolicy: components.DockerRetryPolicy{Attempts: 1, Interval: components.DefaultDockerRetryPolicy.Interval},
+		},
+		{
+			dockerRetries: &DockerRetriesSpecification{Attempts: 0},
+			returnsError:  true,
+		},
+		{
+			dockerRetries: &DockerRetriesSpecification{Attempts: 3, Interval: "soon"},
+			returnsError:  true,
+		},
+		{
+			dockerRetries: &DockerRetriesSpecification{Attempts: 3, Interval: "-1s"},
+			returnsError:  true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		specification := FlowSpecification{
+			Steps:         map[string]string{"a": "component-a"},
+			DockerRetries: testCase.dockerRetries,
+		}
+		materializedSpecification, err := MaterializeFlowSpecification(specification)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		}
+		if err != nil {
+			continue
+		}
+		policy := materializedSpecification.DockerRetries.Policy()
+		if policy != testCase.expectedPolicy {
+			t.Errorf("[Test %d] Unexpected retry policy: expected=%v, actual=%v", i, testCase.expectedPolicy, policy)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package flows
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+// RunStatusRunning is the status of a flow run whose steps are still being executed
+var RunStatusRunning = "running"
+
+// RunStatusSucceeded is the status of a flow run all of whose steps completed successfully
+var RunStatusSucceeded = "succeeded"
+
+// RunStatusSucceededWithWarnings is the status of a flow run which completed, but in which steps
+// that were allowed to fail did fail
+var RunStatusSucceededWithWarnings = "succeeded_with_warnings"
+
+// RunStatusFailed is the status of a flow run which was aborted because of an error
+var RunStatusFailed = "failed"
+
+// FlowRunMetadata - the metadata about a single execution of a flow that gets stored in the state
+// database
+type FlowRunMetadata struct {
+	ID         string     `json:"id"`
+	FlowID     string     `json:"flow_id"`
+	Status     string     `json:"status"`
+	CreatedAt  time.Time  `json:"created_at"`
+	FinishedAt *time.Time `json:"finished_at"`
+	// Priority determines the order in which queued runs start (higher priorities start first)
+	Priority int `json:"priority"`
+}
+
+// GenerateFlowRunMetadata creates a FlowRunMetadata instance representing a fresh (running) run of
+// the flow with the given flowID.
+func GenerateFlowRunMetadata(flowID string) (FlowRunMetadata, error) {
+	if flowID == "" {
+		return FlowRunMetadata{}, ErrEmptyID
+	}
+
+	runID, err := uuid.NewRandom()
+	if err != nil {
+		return FlowRunMetadata{}, err
+	}
+
+	return FlowRunMetadata{ID: runID.String(), FlowID: flowID, Status: RunStatusRunning, CreatedAt: time.Now()}, nil
+}
+
+// TemplateVariables returns the values of the placeholders which may be used in the mount
+// configurations of the given step of the given flow run:
+// "{{run_id}}" - the ID of the flow run
+// "{{flow_id}}" - the ID of the flow
+// "{{step}}" - the name of the step
+// "{{date}}" - the date on which the run started, formatted as YYYY-MM-DD
+func TemplateVariables(run FlowRunMetadata, step string) map[string]string {
+	return map[string]string{
+		"run_id":  run.ID,
+		"flow_id": run.FlowID,
+		"step":    step,
+		"date":    run.CreatedAt.Format("2006-01-02"),
+	}
+}
+
+// renderMounts renders the placeholders in the given mount configurations for the given step of
+// the given flow run. The rendered sources of bind mounts whose sources contained placeholders are
+// created as directories if they do not already exist, so that each run can write its outputs to a
+// fresh directory.
+func renderMounts(run FlowRunMetadata, step string, mounts []components.MountConfiguration) ([]components.MountConfiguration, error) {
+	renderedMounts := components.RenderMountTemplates(mounts, TemplateVariables(run, step))
+	for i, renderedMount := range renderedMounts {
+		if renderedMount.Method != "bind" || renderedMount.Source == mounts[i].Source {
+			continue
+		}
+		if _, ok := components.RemoteSourceScheme(renderedMount.Source); ok {
+			continue
+		}
+		_, err := os.Stat(renderedMount.Source)
+		if os.IsNotExist(err) {
+			err = os.MkdirAll(renderedMount.Source, 0755)
+		}
+		if err != nil {
+			return renderedMounts, fmt.Errorf("Could not prepare mount source (%s) for step (%s): %w", renderedMount.Source, step, err)
+		}
+	}
+	return renderedMounts, nil
+}
@@ -0,0 +1,52 @@
+package flows
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+// TestRenderMounts renders templated mount configurations for a step of a flow run and checks that
+// the sources of templated bind mounts are created
+func TestRenderMounts(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "shnorky-render-mounts-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+
+	run := FlowRunMetadata{ID: "run", FlowID: "flow", CreatedAt: time.Date(2020, time.March, 4, 12, 0, 0, 0, time.Local)}
+	mounts := []components.MountConfiguration{
+		{Source: filepath.Join(tempDir, "inputs.txt"), Target: "/shnorky/inputs.txt", Method: "bind"},
+		{Source: filepath.Join(tempDir, "{{flow_id}}", "{{date}}", "{{run_id}}"), Target: "/shnorky/{{step}}", Method: "bind"},
+		{Source: "{{unknown}}", Target: "/shnorky/volume", Method: "volume"},
+	}
+
+	renderedMounts, err := renderMounts(run, "step", mounts)
+	if err != nil {
+		t.Fatalf("Unexpected error rendering mounts: %s", err.Error())
+	}
+
+	expectedMounts := []components.MountConfiguration{
+		{Source: filepath.Join(tempDir, "inputs.txt"), Target: "/shnorky/inputs.txt", Method: "bind"},
+		{Source: filepath.Join(tempDir, "flow", "2020-03-04", "run"), Target: "/shnorky/step", Method: "bind"},
+		{Source: "{{unknown}}", Target: "/shnorky/volume", Method: "volume"},
+	}
+	for i, expectedMount := range expectedMounts {
+		if renderedMounts[i] != expectedMount {
+			t.Errorf("[Mount %d] Unexpected rendered mount: expected=%v, actual=%v", i, expectedMount, renderedMounts[i])
+		}
+	}
+
+	info, err := os.Stat(expectedMounts[1].Source)
+	if err != nil || !info.IsDir() {
+		t.Errorf("Expected source of templated bind mount to be created as a directory")
+	}
+	if _, err := os.Stat(expectedMounts[0].Source); !os.IsNotExist(err) {
+		t.Errorf("Did not expect source of untemplated bind mount to be created")
+	}
+}
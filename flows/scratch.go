@@ -0,0 +1,119 @@
+package flows
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// ScratchDirEnv is the environment variable through which steps (and hooks) are told where the
+// scratch directory for their flow run is. For containers, this is components.ScratchMountpoint.
+// For host command hooks, it is the path of the scratch directory on the host.
+var ScratchDirEnv = "SHNORKY_SCRATCH_DIR"
+
+// CreateScratchDir creates the scratch directory for the flow run with the given runID under the
+// given state directory and returns its path
+func CreateScratchDir(stateDir, runID string) (string, error) {
+	scratchDir, err := filepath.Abs(filepath.Join(stateDir, state.ScratchDirName, runID))
+	if err != nil {
+		return scratchDir, err
+	}
+	err = os.MkdirAll(scratchDir, 0755)
+	if err != nil {
+		return scratchDir, fmt.Errorf("Could not create scratch directory (%s): %w", scratchDir, err)
+	}
+	return scratchDir, nil
+}
+
+// CleanupScratchDir applies the retention policy in the given scratch configuration to the given
+// scratch directory of a flow run which finished with the given status
+func CleanupScratchDir(configuration state.ScratchConfiguration, scratchDir, status string) error {
+	switch configuration.Retention {
+	case state.ScratchRetentionKeep:
+		return nil
+	case state.ScratchRetentionKeepFailed:
+		if status == RunStatusFailed {
+			return nil
+		}
+	}
+	return os.RemoveAll(scratchDir)
+}
+
+// PruneScratchDirs removes the scratch directories under the given state directory which were last
+// modified longer ago than the given maximum age (e.g. "72h"). Scratch directories which belong to
+// flow runs that have not finished (according to the given state database) are kept, however old
+// they are. If maxAge is empty, nothing is removed. The paths of the removed directories are
+// returned.
+func PruneScratchDirs(store state.Store, stateDir, maxAge string) ([]string, error) {
+	removed := []string{}
+	if maxAge == "" {
+		return removed, nil
+	}
+	age, err := time.ParseDuration(maxAge)
+	if err != nil {
+		return removed, err
+	}
+
+	scratchRoot := filepath.Join(stateDir, state.ScratchDirName)
+	entries, err := ioutil.ReadDir(scratchRoot)
+	if os.IsNotExist(err) {
+		return removed, nil
+	}
+	if err != nil {
+		return removed, err
+	}
+
+	cutoff := time.Now().Add(-age)
+	for _, entry := range entries {
+		if !entry.IsDir() || !entry.ModTime().Before(cutoff) {
+			continue
+		}
+		scratchDir := filepath.Join(scratchRoot, entry.Name())
+		absoluteScratchDir, err := filepath.Abs(scratchDir)
+		if err != nil {
+			return removed, err
+		}
+		// A scratch directory belongs to the runs it is named after and to the runs which claimed it
+		// (see RunResources)
+		unfinishedRuns, err := store.CountUnfinishedFlowRunsUsing(entry.Name(), RunResourceScratchDir, absoluteScratchDir)
+		if err != nil {
+			return removed, fmt.Errorf("Could not check whether scratch directory (%s) is in use: %w", scratchDir, err)
+		}
+		if unfinishedRuns > 0 {
+			continue
+		}
+		err = os.RemoveAll(scratchDir)
+		if err != nil {
+			return removed, err
+		}
+		removed = append(removed, scratchDir)
+	}
+
+	return removed, nil
+}
+
+// withScratch returns the given mounts and environment for a container, extended so that the
+// container has access to the given scratch directory. If scratchDir is empty or the mounts
+// already use the scratch mountpoint, the mounts are returned unchanged.
+func withScratch(scratchDir string, mounts []components.MountConfiguration, env map[string]string) ([]components.MountConfiguration, map[string]string) {
+	if scratchDir == "" {
+		return mounts, env
+	}
+
+	scratchEnv := map[string]string{ScratchDirEnv: components.ScratchMountpoint}
+	for key, value := range env {
+		scratchEnv[key] = value
+	}
+
+	if _, ok := inputMount(components.ScratchMountpoint, mounts); ok {
+		return mounts, scratchEnv
+	}
+	scratchMounts := append([]components.MountConfiguration{}, mounts...)
+	scratchMounts = append(scratchMounts, components.MountConfiguration{Source: scratchDir, Target: components.ScratchMountpoint, Method: "bind"})
+	return scratchMounts, scratchEnv
+}
@@ -0,0 +1,163 @@
+package flows
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// TestScratchDirRetention creates scratch directories for runs with different outcomes and checks
+// which of them survive each retention policy
+func TestScratchDirRetention(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-scratch-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+
+	type retentionTest struct {
+		retention    string
+		status       string
+		expectedKept bool
+	}
+
+	testCases := []retentionTest{
+		{retention: state.ScratchRetentionDelete, status: RunStatusFailed, expectedKept: false},
+		{retention: state.ScratchRetentionKeepFailed, status: RunStatusFailed, expectedKept: true},
+		{retention: state.ScratchRetentionKeepFailed, status: RunStatusSucceeded, expectedKept: false},
+		{retention: state.ScratchRetentionKeepFailed, status: RunStatusSucceededWithWarnings, expectedKept: false},
+		{retention: state.ScratchRetentionKeep, status: RunStatusSucceeded, expectedKept: true},
+	}
+
+	for i, testCase := range testCases {
+		scratchDir, err := CreateScratchDir(stateDir, "run")
+		if err != nil {
+			t.Fatalf("[Test %d] Could not create scratch directory: %s", i, err.Error())
+		}
+		if scratchDir != filepath.Join(stateDir, state.ScratchDirName, "run") {
+			t.Errorf("[Test %d] Unexpected scratch directory: %s", i, scratchDir)
+		}
+
+		err = CleanupScratchDir(state.ScratchConfiguration{Retention: testCase.retention}, scratchDir, testCase.status)
+		if err != nil {
+			t.Fatalf("[Test %d] Unexpected error cleaning up scratch directory: %s", i, err.Error())
+		}
+
+		_, err = os.Stat(scratchDir)
+		kept := err == nil
+		if kept != testCase.expectedKept {
+			t.Errorf("[Test %d] Unexpected retention: expected=%t, actual=%t", i, testCase.expectedKept, kept)
+		}
+		os.RemoveAll(scratchDir)
+	}
+}
+
+func TestPruneScratchDirs(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-scratch-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatalf("Error opening state database file (%s): %s", stateDBPath, err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	// The scratch directories of unfinished runs are kept however old they are, as are scratch
+	// directories which unfinished runs have claimed under other names
+	past := time.Now().Add(-48 * time.Hour)
+	finishedAt := time.Now()
+	runs := []FlowRunMetadata{
+		{ID: "running-run", FlowID: "flow", Status: RunStatusRunning, CreatedAt: past},
+		{ID: "finished-run", FlowID: "flow", Status: RunStatusSucceeded, CreatedAt: past, FinishedAt: &finishedAt},
+		{ID: "claiming-run", FlowID: "other-flow", Status: RunStatusRunning, CreatedAt: past},
+	}
+	for _, run := range runs {
+		err = InsertFlowRun(store, run)
+		if err != nil {
+			t.Fatalf("[%s] Could not insert flow run: %s", run.ID, err.Error())
+		}
+		err = UpdateFlowRunStatus(store, run)
+		if err != nil {
+			t.Fatalf("[%s] Could not update flow run: %s", run.ID, err.Error())
+		}
+	}
+
+	scratchDirs := map[string]string{}
+	for _, name := range []string{"old-run", "new-run", "running-run", "finished-run", "claimed"} {
+		scratchDirs[name], err = CreateScratchDir(stateDir, name)
+		if err != nil {
+			t.Fatalf("Could not create scratch directory (%s): %s", name, err.Error())
+		}
+		if name != "new-run" {
+			err = os.Chtimes(scratchDirs[name], past, past)
+			if err != nil {
+				t.Fatalf("Could not change modification time of scratch directory (%s): %s", name, err.Error())
+			}
+		}
+	}
+	err = ClaimRunResources(store, runs[2], []RunResource{{Kind: RunResourceScratchDir, Name: scratchDirs["claimed"]}})
+	if err != nil {
+		t.Fatalf("Could not claim scratch directory: %s", err.Error())
+	}
+
+	removed, err := PruneScratchDirs(store, stateDir, "")
+	if err != nil || len(removed) != 0 {
+		t.Errorf("Expected nothing to be pruned without a maximum age: removed=%v, err=%v", removed, err)
+	}
+
+	removed, err = PruneScratchDirs(store, stateDir, "24h")
+	if err != nil {
+		t.Fatalf("Unexpected error pruning scratch directories: %s", err.Error())
+	}
+	sort.Strings(removed)
+	expectedRemoved := []string{scratchDirs["finished-run"], scratchDirs["old-run"]}
+	if !reflect.DeepEqual(removed, expectedRemoved) {
+		t.Errorf("Unexpected pruned scratch directories: expected=%v, actual=%v", expectedRemoved, removed)
+	}
+	for _, name := range []string{"new-run", "running-run", "claimed"} {
+		if _, err := os.Stat(scratchDirs[name]); err != nil {
+			t.Errorf("Expected scratch directory (%s) to survive pruning", name)
+		}
+	}
+}
+
+func TestWithScratch(t *testing.T) {
+	mounts := []components.MountConfiguration{{Source: "/tmp/inputs.txt", Target: "/shnorky/inputs.txt", Method: "bind"}}
+	env := map[string]string{"MY_ENV": "hello"}
+
+	scratchMounts, scratchEnv := withScratch("/tmp/scratch", mounts, env)
+	if len(scratchMounts) != 2 || scratchMounts[1].Source != "/tmp/scratch" || scratchMounts[1].Target != components.ScratchMountpoint {
+		t.Errorf("Unexpected mounts with scratch directory: %v", scratchMounts)
+	}
+	if scratchEnv[ScratchDirEnv] != components.ScratchMountpoint || scratchEnv["MY_ENV"] != "hello" {
+		t.Errorf("Unexpected environment with scratch directory: %v", scratchEnv)
+	}
+	if len(mounts) != 1 {
+		t.Errorf("Expected original mounts to be left unchanged")
+	}
+
+	unchangedMounts, unchangedEnv := withScratch("", mounts, env)
+	if len(unchangedMounts) != 1 || len(unchangedEnv) != 1 {
+		t.Errorf("Expected mounts and environment to be unchanged without a scratch directory")
+	}
+}
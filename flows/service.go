@@ -0,0 +1,191 @@
+package flows
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// LoadTestComponentID is the ID of the built-in component which generates load against a service
+// step on the flow run's network
+var LoadTestComponentID = components.BuiltinComponentPrefix + "load-test"
+
+// LoadTestArtifactName is the name of the artifact into which the results of a load-test step are
+// captured, unless the flow specification captures its stdout under a different name
+var LoadTestArtifactName = "load-test.json"
+
+// ServiceStopTimeout is the amount of time that service steps are given to shut down gracefully
+// once the other steps in their flow run have finished, after which they are killed
+var ServiceStopTimeout = 10 * time.Second
+
+// ServiceHealthTimeout is the amount of time that service steps are given to become healthy (or,
+// if they have no healthcheck, to keep running) when other steps require them (see
+// DependencyRequires) or when they are brought up by Up
+var ServiceHealthTimeout = 2 * time.Minute
+
+// ServiceHealthPollInterval is how often WaitForHealthy inspects the container of a service
+var ServiceHealthPollInterval = 500 * time.Millisecond
+
+// serviceSteps returns the set of steps in the given flow specification which run components of
+// type service. Service steps are started like any other step, but they are not waited on - steps
+// which depend on them are started as soon as they are, and they keep running (reachable by their
+// step names on the flow run's network) until every stage of the run has finished.
+func serviceSteps(store state.Store, specification FlowSpecification) (map[string]bool, error) {
+	services := map[string]bool{}
+	for step, componentID := range specification.Steps {
+		if isHostStep(componentID) {
+			continue
+		}
+		component, err := components.SelectComponentByID(store, componentID)
+		if err != nil {
+			return services, fmt.Errorf("Error retrieving component (%s) for step (%s): %w", componentID, step, err)
+		}
+		if component.ComponentType == components.Service {
+			services[step] = true
+		}
+	}
+	return services, nil
+}
+
+// stopServices stops the containers for the given (running) service steps and records their
+// results in the state database. Services which exited on their own before being stopped have
+// their results recorded in executions, and an error is returned if any of them failed (unless it
+// is allowed to fail). The executions of services which were still running are left as they were
+// when the services started, as their exit codes reflect being stopped rather than their outcomes.
+func stopServices(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	executions map[string]components.ExecutionMetadata,
+	services []string,
+	allowFailure map[string]bool,
+) error {
+	var failureErr error
+	for _, step := range services {
+		executionMetadata := executions[step]
+		info, err := dockerClient.ContainerInspect(ctx, executionMetadata.ID)
+		if err != nil {
+			return fmt.Errorf("Error inspecting container (%s) for service step (%s): %w", executionMetadata.ID, step, err)
+		}
+		running := info.State != nil && info.State.Running
+		if running {
+			timeout := ServiceStopTimeout
+			err = dockerClient.ContainerStop(ctx, executionMetadata.ID, &timeout)
+			if err != nil {
+				return fmt.Errorf("Error stopping container (%s) for service step (%s): %w", executionMetadata.ID, step, err)
+			}
+		}
+
+		finishedExecution, err := components.WaitForExecution(ctx, store, dockerClient, executionMetadata.ID)
+		if err != nil {
+			return fmt.Errorf("Error recording result of service step (%s): %w", step, err)
+		}
+		if !running {
+			executions[step] = finishedExecution
+			if *finishedExecution.ExitCode != 0 && !allowFailure[step] && failureErr == nil {
+				failureErr = components.NewExecutionFailedError(finishedExecution)
+			}
+		}
+	}
+	return failureErr
+}
+
+// WaitForHealthy waits for the container of the execution with the given ID to become healthy. For
+// containers without a healthcheck, it only checks that the container is running. It returns an
+// error if the container stops, if it becomes unhealthy, or if the given timeout elapses first (in
+// which case the error wraps context.DeadlineExceeded).
+func WaitForHealthy(ctx context.Context, dockerClient *docker.Client, executionID string, timeout time.Duration) error {
+	deadline := time.After(timeout)
+	ticker := time.NewTicker(ServiceHealthPollInterval)
+	defer ticker.Stop()
+	for {
+		info, err := dockerClient.ContainerInspect(ctx, executionID)
+		if err != nil {
+			return fmt.Errorf("Error inspecting container (%s): %w", executionID, err)
+		}
+		if info.State != nil {
+			if !info.State.Running {
+				return fmt.Errorf("Container (%s) exited with code %d", executionID, info.State.ExitCode)
+			}
+			if info.State.Health == nil || info.State.Health.Status == dockerTypes.Healthy {
+				return nil
+			}
+			if info.State.Health.Status == dockerTypes.Unhealthy {
+				output := ""
+				if checks := info.State.Health.Log; len(checks) > 0 {
+					output = checks[len(checks)-1].Output
+				}
+				return fmt.Errorf("Container (%s) is unhealthy: %s", executionID, output)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-deadline:
+			return fmt.Errorf("Container (%s) did not become healthy within %s: %w", executionID, timeout, context.DeadlineExceeded)
+		case <-ticker.C:
+		}
+	}
+}
+
+// validateRequirements checks that every step which is required by another step of the given flow
+// specification (see DependencyRequires) is one of the given service steps
+func validateRequirements(specification FlowSpecification, services map[string]bool) error {
+	steps := make([]string, 0, len(specification.Dependencies))
+	for step := range specification.Dependencies {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+	for _, step := range steps {
+		for _, dependency := range specification.Dependencies[step] {
+			if DependencyType(specification, step, dependency) == DependencyRequires && !services[dependency] {
+				return fmt.Errorf("Step (%s) requires step (%s), which does not run a service component", step, dependency)
+			}
+		}
+	}
+	return nil
+}
+
+// validateAttempts checks that none of the given service steps is attempted more than once (see
+// FlowSpecification.Attempts) - services are not waited on, so the flow engine cannot retry them.
+// Services which should survive crashes specify a restart policy instead.
+func validateAttempts(specification FlowSpecification, services map[string]bool) error {
+	steps := make([]string, 0, len(specification.Attempts))
+	for step := range specification.Attempts {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+	for _, step := range steps {
+		if services[step] && specification.Attempts[step] > 1 {
+			return fmt.Errorf("Step (%s) runs a service component, so it cannot be attempted more than once (use a restart_policy instead)", step)
+		}
+	}
+	return nil
+}
+
+// waitForRequirements waits for the service steps which the given step requires (see
+// DependencyRequires) to become healthy, given their executions
+func waitForRequirements(ctx context.Context, dockerClient *docker.Client, specification FlowSpecification, executions map[string]components.ExecutionMetadata, step string) error {
+	for _, dependency := range specification.Dependencies[step] {
+		if DependencyType(specification, step, dependency) != DependencyRequires {
+			continue
+		}
+		executionMetadata, ok := executions[dependency]
+		if !ok {
+			continue
+		}
+		err := WaitForHealthy(ctx, dockerClient, executionMetadata.ID, ServiceHealthTimeout)
+		if err != nil {
+			return fmt.Errorf("Service step (%s) required by step (%s) is not healthy: %w", dependency, step, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+package flows
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestServiceSteps(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-service-steps-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatalf("Error opening state database file (%s): %s", stateDBPath, err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	_, err = components.AddComponent(store, "api", components.Service, "../examples/components/single-task", "")
+	if err != nil {
+		t.Fatalf("Could not add service component: %s", err.Error())
+	}
+	_, err = components.AddComponent(store, "single-task", components.Task, "../examples/components/single-task", "")
+	if err != nil {
+		t.Fatalf("Could not add task component: %s", err.Error())
+	}
+	_, err = components.EnsureBuiltinComponent(store, path.Join(stateDir, state.BuiltinDirName), LoadTestComponentID)
+	if err != nil {
+		t.Fatalf("Could not ensure load-test component: %s", err.Error())
+	}
+
+	specification := FlowSpecification{
+		Steps: map[string]string{
+			"api":     "api",
+			"prepare": "single-task",
+			"load":    LoadTestComponentID,
+			"approve": GateComponentID,
+		},
+	}
+	services, err := serviceSteps(store, specification)
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+	expectedServices := map[string]bool{"api": true}
+	if !reflect.DeepEqual(services, expectedServices) {
+		t.Errorf("Unexpected service steps: expected=%v, actual=%v", expectedServices, services)
+	}
+
+	specification.Steps["missing"] = "missing"
+	_, err = serviceSteps(store, specification)
+	if err == nil {
+		t.Error("Expected error for step with unregistered component")
+	}
+}
+
+func TestMaterializeLoadTestArtifacts(t *testing.T) {
+	rawSpecification := FlowSpecification{
+		Steps:           map[string]string{"api": "api", "smoke": LoadTestComponentID, "soak": LoadTestComponentID},
+		Dependencies:    map[string][]string{"smoke": {"api"}, "soak": {"api"}},
+		StdoutArtifacts: map[string]string{"soak": "soak-results.json"},
+	}
+
+	specification, err := MaterializeFlowSpecification(rawSpecification)
+	if err != nil {
+		t.Fatalf("Unexpected error materializing specification: %s", err.Error())
+	}
+	expectedArtifacts := map[string]string{"smoke": LoadTestArtifactName, "soak": "soak-results.json"}
+	if !reflect.DeepEqual(specification.StdoutArtifacts, expectedArtifacts) {
+		t.Errorf("Unexpected stdout artifacts: expected=%v, actual=%v", expectedArtifacts, specification.StdoutArtifacts)
+	}
+}
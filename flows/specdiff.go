@@ -0,0 +1,188 @@
+package flows
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// ErrNoSpecificationSnapshot - signifies that no snapshot of the specification of a flow was stored
+// when it was registered (because it was registered before snapshots were)
+var ErrNoSpecificationSnapshot = errors.New("No snapshot of the specification was stored when the flow was registered; re-register the flow to store one")
+
+// DiffContextLines is the number of unchanged lines shown around each change in a specification diff
+var DiffContextLines = 3
+
+// SpecificationDiff - the differences between the specification of a flow as it was registered and
+// its specification file as it currently is on disk
+type SpecificationDiff struct {
+	FlowID            string `json:"flow_id"`
+	SpecificationPath string `json:"specification_path"`
+	// ChecksumChanged is true if the specification file itself has changed since the flow was
+	// registered (even if only its formatting has)
+	ChecksumChanged bool `json:"checksum_changed"`
+	// Diff is a unified diff from the registered specification document to the current one (with
+	// includes merged into both). It is empty if they are the same.
+	Diff string `json:"diff"`
+}
+
+// DiffFlowSpecification compares the specification document (see ReadSpecificationDocument) of the
+// flow with the given ID as it was when the flow was registered with the document as it is now, so
+// that users can tell whether the flow needs to be re-registered. Returns
+// ErrNoSpecificationSnapshot if the flow was registered without a snapshot.
+// This is the handler for `shn flows diff`
+func DiffFlowSpecification(store state.Store, flowID string) (SpecificationDiff, error) {
+	flow, err := SelectFlowByID(store, flowID)
+	if err != nil {
+		return SpecificationDiff{}, err
+	}
+	specificationDiff := SpecificationDiff{FlowID: flow.ID, SpecificationPath: flow.SpecificationPath}
+	if flow.SpecificationSnapshot == "" {
+		return specificationDiff, ErrNoSpecificationSnapshot
+	}
+
+	checksum, err := SpecificationChecksum(flow.SpecificationPath)
+	if err != nil {
+		return specificationDiff, fmt.Errorf("Error computing checksum of specification (%s): %w", flow.SpecificationPath, err)
+	}
+	specificationDiff.ChecksumChanged = checksum != flow.SpecificationChecksum
+
+	current, err := ReadSpecificationDocument(flow.SpecificationPath)
+	if err != nil {
+		return specificationDiff, fmt.Errorf("Error reading specification (%s): %w", flow.SpecificationPath, err)
+	}
+
+	specificationDiff.Diff = unifiedDiff(
+		fmt.Sprintf("%s (registered)", flow.SpecificationPath),
+		fmt.Sprintf("%s (on disk)", flow.SpecificationPath),
+		splitLines(flow.SpecificationSnapshot),
+		splitLines(string(current)),
+		DiffContextLines,
+	)
+	return specificationDiff, nil
+}
+
+func splitLines(text string) []string {
+	if text == "" {
+		return []string{}
+	}
+	return strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+}
+
+// unifiedDiff renders the differences between the lines a and b (named nameA and nameB) in the
+// unified diff format, with the given number of lines of context around each change. It returns
+// the empty string if a and b are the same.
+func unifiedDiff(nameA, nameB string, a, b []string, context int) string {
+	// lengths[i][j] is the length of the longest common subsequence of a[i:] and b[j:]
+	lengths := make([][]int, len(a)+1)
+	for i := range lengths {
+		lengths[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lengths[i][j] = lengths[i+1][j+1] + 1
+			} else if lengths[i+1][j] >= lengths[i][j+1] {
+				lengths[i][j] = lengths[i+1][j]
+			} else {
+				lengths[i][j] = lengths[i][j+1]
+			}
+		}
+	}
+
+	edits := []diffEdit{}
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			edits = append(edits, diffEdit{' ', a[i]})
+			i++
+			j++
+		case j == len(b) || (i < len(a) && lengths[i+1][j] >= lengths[i][j+1]):
+			edits = append(edits, diffEdit{'-', a[i]})
+			i++
+		default:
+			edits = append(edits, diffEdit{'+', b[j]})
+			j++
+		}
+	}
+
+	var builder strings.Builder
+	// lineA and lineB are the (1-based) line numbers in a and b of the edit at index k
+	lineA, lineB := 1, 1
+	for k := 0; k < len(edits); {
+		if edits[k].kind == ' ' {
+			lineA++
+			lineB++
+			k++
+			continue
+		}
+
+		// A hunk runs from context lines before its first change to context lines after its last,
+		// and changes separated by more than 2*context unchanged lines go in separate hunks
+		start := k - context
+		if start < 0 {
+			start = 0
+		}
+		end := k + 1
+		for next := k + 1; next < len(edits) && next-end <= 2*context; next++ {
+			if edits[next].kind != ' ' {
+				end = next + 1
+			}
+		}
+		stop := end + context
+		if stop > len(edits) {
+			stop = len(edits)
+		}
+
+		if builder.Len() == 0 {
+			fmt.Fprintf(&builder, "--- %s\n+++ %s\n", nameA, nameB)
+		}
+		var countA, countB int
+		for _, edit := range edits[start:stop] {
+			if edit.kind != '+' {
+				countA++
+			}
+			if edit.kind != '-' {
+				countB++
+			}
+		}
+		fmt.Fprintf(&builder, "@@ -%s +%s @@\n", hunkRange(lineA-(k-start), countA), hunkRange(lineB-(k-start), countB))
+		for _, edit := range edits[start:stop] {
+			fmt.Fprintf(&builder, "%c%s\n", edit.kind, edit.line)
+		}
+
+		for _, edit := range edits[k:stop] {
+			if edit.kind != '+' {
+				lineA++
+			}
+			if edit.kind != '-' {
+				lineB++
+			}
+		}
+		k = stop
+	}
+
+	return builder.String()
+}
+
+// diffEdit - a line of the edit script between two sequences of lines, of kind ' ' (in both), '-'
+// (only in the first), or '+' (only in the second)
+type diffEdit struct {
+	kind byte
+	line string
+}
+
+// hunkRange renders the range of lines in a hunk header. As in GNU diff, an empty range is given
+// by the line before it.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		start--
+	}
+	if count == 1 {
+		return fmt.Sprintf("%d", start)
+	}
+	return fmt.Sprintf("%d,%d", start, count)
+}
@@ -0,0 +1,149 @@
+package flows
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestUnifiedDiff(t *testing.T) {
+	type UnifiedDiffTest struct {
+		a, b     []string
+		expected string
+	}
+
+	lines := []string{"1", "2", "3", "4", "5", "6", "7", "8", "9", "10", "11", "12"}
+	changed := append([]string{}, lines...)
+	changed[1] = "two"
+	changed[10] = "eleven"
+
+	tests := []UnifiedDiffTest{
+		{
+			a:        lines,
+			b:        lines,
+			expected: "",
+		},
+		{
+			a:        []string{},
+			b:        []string{"a", "b"},
+			expected: "--- a\n+++ b\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+		},
+		{
+			a:        []string{"a", "b", "c"},
+			b:        []string{"a", "c"},
+			expected: "--- a\n+++ b\n@@ -1,3 +1,2 @@\n a\n-b\n c\n",
+		},
+		{
+			a:        lines,
+			b:        changed,
+			expected: "--- a\n+++ b\n@@ -1,5 +1,5 @@\n 1\n-2\n+two\n 3\n 4\n 5\n@@ -8,5 +8,5 @@\n 8\n 9\n 10\n-11\n+eleven\n 12\n",
+		},
+		{
+			a:        lines[:8],
+			b:        append(append([]string{}, changed[:6]...), "7", "eight"),
+			expected: "--- a\n+++ b\n@@ -1,8 +1,8 @@\n 1\n-2\n+two\n 3\n 4\n 5\n 6\n 7\n-8\n+eight\n",
+		},
+	}
+
+	for i, test := range tests {
+		diff := unifiedDiff("a", "b", test.a, test.b, 3)
+		if diff != test.expected {
+			t.Errorf("[Test %d] Unexpected diff:\nexpected:\n%s\nactual:\n%s", i, test.expected, diff)
+		}
+	}
+}
+
+// TestDiffFlowSpecification registers a flow, changes its specification file, and checks that
+// DiffFlowSpecification reports the change
+func TestDiffFlowSpecification(t *testing.T) {
+	stateDir, db, err := state.InitEphemeral()
+	if err != nil {
+		t.Fatalf("Could not initialize ephemeral state: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	specificationPath := filepath.Join(stateDir, "flow.json")
+	err = ioutil.WriteFile(specificationPath, []byte(`{"steps": {"approve": "builtin:gate"}}`), 0644)
+	if err != nil {
+		t.Fatalf("Could not write specification: %s", err.Error())
+	}
+	_, err = AddFlow(store, "flow", specificationPath)
+	if err != nil {
+		t.Fatalf("Could not add flow: %s", err.Error())
+	}
+
+	// Reformatting the specification changes its checksum but not its contents
+	err = ioutil.WriteFile(specificationPath, []byte("{\n  \"steps\": {\"approve\": \"builtin:gate\"}\n}\n"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write specification: %s", err.Error())
+	}
+	specificationDiff, err := DiffFlowSpecification(store, "flow")
+	if err != nil {
+		t.Fatalf("Unexpected error diffing specification: %s", err.Error())
+	}
+	if !specificationDiff.ChecksumChanged || specificationDiff.Diff != "" {
+		t.Errorf("Unexpected diff of reformatted specification: %+v", specificationDiff)
+	}
+
+	err = ioutil.WriteFile(specificationPath, []byte(`{"steps": {"approve": "builtin:gate", "review": "builtin:gate"}}`), 0644)
+	if err != nil {
+		t.Fatalf("Could not write specification: %s", err.Error())
+	}
+	specificationDiff, err = DiffFlowSpecification(store, "flow")
+	if err != nil {
+		t.Fatalf("Unexpected error diffing specification: %s", err.Error())
+	}
+	if !specificationDiff.ChecksumChanged || !strings.Contains(specificationDiff.Diff, `+    "review": "builtin:gate"`) {
+		t.Errorf("Unexpected diff of changed specification: %+v", specificationDiff)
+	}
+
+	_, err = DiffFlowSpecification(store, "unregistered")
+	if err != ErrFlowNotFound {
+		t.Errorf("Expected ErrFlowNotFound for unregistered flow, got: %v", err)
+	}
+}
+
+// TestReadRegisteredSpecification checks that the specification of a registered flow is read from
+// the snapshot stored at registration once its specification file has been deleted
+func TestReadRegisteredSpecification(t *testing.T) {
+	stateDir, db, err := state.InitEphemeral()
+	if err != nil {
+		t.Fatalf("Could not initialize ephemeral state: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	specificationPath := filepath.Join(stateDir, "flow.json")
+	err = ioutil.WriteFile(specificationPath, []byte(`{"steps": {"approve": "builtin:gate", "review": "builtin:gate"}, "dependencies": {"review": ["approve"]}}`), 0644)
+	if err != nil {
+		t.Fatalf("Could not write specification: %s", err.Error())
+	}
+	_, err = AddFlow(store, "flow", specificationPath)
+	if err != nil {
+		t.Fatalf("Could not add flow: %s", err.Error())
+	}
+
+	err = os.Remove(specificationPath)
+	if err != nil {
+		t.Fatalf("Could not remove specification: %s", err.Error())
+	}
+	specification, err := ReadFlowSpecification(store, "flow")
+	if err != nil {
+		t.Fatalf("Could not read specification of flow from snapshot: %s", err.Error())
+	}
+	if len(specification.Stages) != 2 || specification.Stages[1][0] != "review" {
+		t.Errorf("Unexpected stages of specification read from snapshot: %v", specification.Stages)
+	}
+
+	_, err = DiffFlowSpecification(store, "flow")
+	if err == nil {
+		t.Error("Expected error diffing deleted specification, but did not get one")
+	}
+}
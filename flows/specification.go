@@ -1,40 +1,231 @@
 package flows
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/simiotics/shnorky/components"
 	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/staging"
+)
+
+// Types of dependencies between steps
+var (
+	// DependencyAfter - the dependent step starts once the step it depends on has finished. Service
+	// steps, which run until the end of the flow run, count as finished once they have started.
+	DependencyAfter = "after"
+	// DependencyRequires - the dependent step starts once the service step it depends on is
+	// running and healthy (see components.HealthcheckSpecification)
+	DependencyRequires = "requires"
 )
 
 // FlowSpecification - struct specifying a shnorky data processing flow
 type FlowSpecification struct {
-	// Steps indexes each step in the flow and maps step names to component IDs
+	// Includes lists the paths of other specification files (which may be fragments, e.g. containing
+	// only mounts or env) to merge into this one. Relative paths are resolved against the directory
+	// of the including file. Included files are merged in order, and then the including
+	// specification is merged on top of them: objects are merged key by key (recursively), while
+	// lists and other values replace the ones they are merged over. Includes are resolved when a
+	// specification is read, so this is always empty in materialized specifications.
+	Includes []string `json:"includes,omitempty"`
+	// Steps indexes each step in the flow and maps step names to component IDs. Instead of an ID, a
+	// step may give a label selector (e.g. "label:team=data,role=extract") which matches exactly
+	// one registered component (see ComponentSelectorPrefix).
 	Steps map[string]string `json:"steps"`
+	// Components defines (by name) components which are embedded in the specification rather than
+	// registered separately, so that a flow can be described by a single file. A step refers to an
+	// embedded component by its name in Steps. Embedded components are registered and built when
+	// the flow is first built or executed (see RegisterEmbeddedComponents).
+	Components map[string]EmbeddedComponentSpecification `json:"components,omitempty"`
+	// StepTemplates defines (by name) reusable step definitions. A step refers to a template with
+	// the value "template:<name>" in Steps, and can override the template's mounts and env through
+	// Mounts and Env. Templates are resolved on materialization, so this is always empty in
+	// materialized specifications.
+	StepTemplates map[string]StepTemplate `json:"step_templates,omitempty"`
 	// Dependencies has step names as its keys and the corresponding value are the names of steps
 	// that the key step depends on. Steps which have no dependencies need not be included in this
-	// map
+	// map. A dependency may be prefixed with its type (see DependencyTypes), e.g. "requires:api";
+	// unprefixed dependencies are of type DependencyAfter. The prefixes are moved into
+	// DependencyTypes on materialization.
 	Dependencies map[string][]string `json:"dependencies"`
+	// DependencyTypes maps each step to the types of those of its dependencies which are not of
+	// type DependencyAfter, by the names of the steps it depends on. It is filled in from the
+	// prefixes in Dependencies when the specification is materialized.
+	DependencyTypes map[string]map[string]string `json:"dependency_types,omitempty"`
 	// Stages denotes the sequence in which steps will execute. Steps appearing in the same stage
 	// can be run in parallel.
 	Stages [][]string `json:"stages,omitempty"`
-	// Mounts maps each step (by name) to mount configurations for its corresponding component
+	// Mounts maps each step (by name) to mount configurations for its corresponding component.
+	// Sources may be object store URIs (e.g. "s3://bucket/key", "gs://bucket/key", or
+	// "az://account/container/blob" for a file, or "s3://bucket/prefix/" for a directory), which
+	// are staged on the host before the step runs and uploaded back if it succeeds. Sources may also
+	// be "https://" or "sftp://" URIs of read-only files, optionally with a checksum in their
+	// fragment (e.g. "sftp://user@host/exports/data.csv#sha256=<hex digest>"), which are fetched
+	// into the run's scratch directory before the step runs.
 	Mounts map[string][]components.MountConfiguration `json:"mounts"`
 	// Env maps each step (by name) to environment variable mappings (key-value mappings of variable
 	// name to variable value) for that step. The environment variable values get materialized
 	// following the same rules as values in a component runtime specification.
 	Env map[string]map[string]string `json:"env,omitempty"`
+	// Sensitive lists the names of the environment variables (set in Env or in the env of hooks)
+	// whose values are secrets. Their values are masked in logs and command output.
+	Sensitive []string `json:"sensitive,omitempty"`
+	// Workdirs maps steps (by name) to working directories in which their containers should run,
+	// overriding the workdir in the corresponding component's run specification. Values get
+	// materialized following the same rules as values in a component runtime specification.
+	Workdirs map[string]string `json:"workdirs,omitempty"`
+	// Targets maps steps (by name) to the stages of their components' multi-stage Dockerfiles which
+	// they run, overriding the target in the component specifications. A component is built
+	// separately for each target that its steps select.
+	Targets map[string]string `json:"targets,omitempty"`
+	// Stdin maps steps (by name) to paths of files on the host whose contents should be piped into
+	// the standard input of their containers. Paths may be specified as "env:<VARIABLE_NAME>" and
+	// are resolved to absolute paths on materialization.
+	Stdin map[string]string `json:"stdin,omitempty"`
+	// StdoutArtifacts maps steps (by name) to artifact names. The standard output of the container
+	// for each such step is captured into the artifact store under the given name once the step
+	// finishes.
+	StdoutArtifacts map[string]string `json:"stdout_artifacts,omitempty"`
+	// Notifications specifies where notifications about the start and outcome of each run of the
+	// flow should be sent
+	Notifications NotificationsSpecification `json:"notifications"`
+	// Hooks specifies host commands or components which are run before the first step and after
+	// the last step of each run of the flow. After hooks are run whether or not the run succeeded.
+	Hooks HooksSpecification `json:"hooks"`
+	// StepHooks maps steps (by name) to host commands or components which are run before and
+	// after those steps. Hooks under the key "*" are run around every step.
+	StepHooks map[string]HooksSpecification `json:"step_hooks,omitempty"`
+	// OnSuccess maps steps (by name) to handlers (specified in the same way as hooks) which are run
+	// when those steps finish successfully
+	OnSuccess map[string][]HookSpecification `json:"on_success,omitempty"`
+	// OnFailure maps steps (by name) to handlers which are run when those steps fail. Handlers are
+	// run for their side effects (e.g. cleanup or alerting) - their own failures are reported but
+	// do not change the outcome of the flow run.
+	OnFailure map[string][]HookSpecification `json:"on_failure,omitempty"`
+	// AllowFailure marks steps (by name) whose failure (i.e. exit with a non-zero code) should not
+	// abort the flow run. Such a step is recorded as failed, the rest of the flow proceeds, and the
+	// run is recorded as succeeded with warnings.
+	AllowFailure map[string]bool `json:"allow_failure,omitempty"`
+	// DeadLetters maps steps (by name) to dead-letter specifications describing how those steps
+	// should be retried and where their inputs should be set aside if they keep failing
+	DeadLetters map[string]DeadLetterSpecification `json:"dead_letters,omitempty"`
+	// Attempts maps task steps (by name) to the number of times they are attempted before their
+	// failure is decided. Each attempt creates a fresh container and is recorded as its own
+	// execution, linked to the attempt before it. Steps are attempted once by default.
+	Attempts map[string]int `json:"attempts,omitempty"`
+	// Inputs declares (by name) the inputs that the flow requires. Runs of the flow do not start
+	// unless all of them are available.
+	Inputs map[string]InputSpecification `json:"inputs,omitempty"`
+	// Outputs declares (by name) the outputs that the flow produces. Runs of the flow fail if any of
+	// them is missing once all the steps have completed.
+	Outputs map[string]OutputSpecification `json:"outputs,omitempty"`
+	// Contracts maps steps (by name) to the datasets they produce and consume, along with the
+	// format and schema of each dataset. Contracts are checked for compatibility when the
+	// specification is materialized.
+	Contracts map[string]StepContracts `json:"contracts,omitempty"`
+	// ValidateContracts specifies whether datasets produced by steps should also be validated
+	// against their contracts at runtime, as soon as the producing steps finish
+	ValidateContracts bool `json:"validate_contracts,omitempty"`
+	// Validations configures (by step name) the steps which use the built-in validation component
+	// (ValidateComponentID). Every such step must have a validation specification.
+	Validations map[string]ValidationSpecification `json:"validations,omitempty"`
+	// Gates configures (by step name) the steps which use the built-in gate component
+	// (GateComponentID). Gate steps without a gate specification wait indefinitely for a decision.
+	Gates map[string]GateSpecification `json:"gates,omitempty"`
+	// Priority determines the order in which queued runs of the flow start when the state
+	// configuration limits the number of concurrent runs: runs with higher priorities start first,
+	// and runs with the same priority start in the order they were queued
+	Priority int `json:"priority,omitempty"`
+	// MaxConcurrentRuns is the number of runs of the flow which may be unfinished at once (see
+	// maxConcurrentRuns). Further runs fail to start, unless they are made to wait for a slot (see
+	// WithQuotaWait). Defaults to DefaultMaxConcurrentRuns.
+	MaxConcurrentRuns int `json:"max_concurrent_runs,omitempty"`
+	// DockerRetries overrides how docker API calls made for runs of the flow are retried when they
+	// fail with transient errors (e.g. while the docker daemon restarts)
+	DockerRetries *DockerRetriesSpecification `json:"docker_retries,omitempty"`
+	// Partitions configures (by step name) the data-parallel steps whose inputs are split into
+	// shards, each of which is processed by a separate step (see ResolvePartitions)
+	Partitions map[string]PartitionSpecification `json:"partitions,omitempty"`
+	// Warnings describes problems with the structure of the flow which do not prevent it from
+	// running, e.g. steps whose results nothing uses (see deadEndWarnings). Like Stages, it is
+	// calculated when the specification is materialized.
+	Warnings []string `json:"warnings,omitempty"`
+}
+
+// markSensitiveValues marks the (materialized) values of the environment variables which the given
+// flow specification lists as sensitive, in the env of its steps and of its hooks, so that they are
+// redacted from logs and command output
+func markSensitiveValues(specification FlowSpecification) {
+	if len(specification.Sensitive) == 0 {
+		return
+	}
+
+	envs := []map[string]string{}
+	for _, env := range specification.Env {
+		envs = append(envs, env)
+	}
+	hooks := append(append([]HookSpecification{}, specification.Hooks.Before...), specification.Hooks.After...)
+	for _, stepHooks := range specification.StepHooks {
+		hooks = append(append(hooks, stepHooks.Before...), stepHooks.After...)
+	}
+	for _, handlers := range specification.OnSuccess {
+		hooks = append(hooks, handlers...)
+	}
+	for _, handlers := range specification.OnFailure {
+		hooks = append(hooks, handlers...)
+	}
+	for _, hook := range hooks {
+		envs = append(envs, hook.Env)
+	}
+
+	for _, env := range envs {
+		for _, key := range specification.Sensitive {
+			components.MarkSensitive(env[key])
+		}
+	}
 }
 
 // MaterializeFlowSpecification takes a raw FlowSpecification struct and returns a materialized one
 // in which the members of the raw specification have been validated and special values have been
 // rendered.
 func MaterializeFlowSpecification(rawSpecification FlowSpecification) (FlowSpecification, error) {
+	if len(rawSpecification.Includes) > 0 {
+		return rawSpecification, errors.New("Includes must be resolved (by reading the specification) before it is materialized")
+	}
+
+	rawSpecification, warnings, err := resolveDependencyTypes(rawSpecification)
+	if err != nil {
+		return rawSpecification, err
+	}
+	rawSpecification, err = ResolveStepTemplates(rawSpecification)
+	if err != nil {
+		return rawSpecification, err
+	}
+	rawSpecification, err = ResolvePartitions(rawSpecification)
+	if err != nil {
+		return rawSpecification, err
+	}
+
 	for step, component := range rawSpecification.Steps {
 		if component == "" {
 			return rawSpecification, fmt.Errorf("Invalid component for step %s", step)
 		}
+		if IsComponentSelector(component) {
+			if _, err := ParseComponentSelector(component); err != nil {
+				return rawSpecification, fmt.Errorf("Invalid component for step %s: %w", step, err)
+			}
+		}
+		if components.IsBuiltinComponent(component) && !isHostStep(component) {
+			if _, err := components.BuiltinComponentDescription(component); err != nil {
+				return rawSpecification, fmt.Errorf("Invalid component for step %s: %w", step, err)
+			}
+		}
 	}
 
 	for step, deps := range rawSpecification.Dependencies {
@@ -51,9 +242,43 @@ func MaterializeFlowSpecification(rawSpecification FlowSpecification) (FlowSpeci
 		}
 	}
 
+	for step, dependencyTypes := range rawSpecification.DependencyTypes {
+		for dependency, dependencyType := range dependencyTypes {
+			if !dependsOn(rawSpecification, step, dependency) {
+				return rawSpecification, fmt.Errorf("Dependency type given for step (%s) which does not depend on step (%s)", step, dependency)
+			}
+			if dependencyType == DependencyRequires && isHostStep(rawSpecification.Steps[dependency]) {
+				return rawSpecification, fmt.Errorf("Step (%s) requires step (%s), which uses the %s component rather than a service", step, dependency, rawSpecification.Steps[dependency])
+			}
+		}
+	}
+
+	if rawSpecification.MaxConcurrentRuns < 0 {
+		return rawSpecification, fmt.Errorf("max_concurrent_runs must be non-negative: %d", rawSpecification.MaxConcurrentRuns)
+	}
+
 	materializedSpecification := FlowSpecification{
-		Steps:        rawSpecification.Steps,
-		Dependencies: rawSpecification.Dependencies,
+		Steps:             rawSpecification.Steps,
+		Dependencies:      rawSpecification.Dependencies,
+		DependencyTypes:   rawSpecification.DependencyTypes,
+		Priority:          rawSpecification.Priority,
+		MaxConcurrentRuns: rawSpecification.MaxConcurrentRuns,
+		Partitions:        rawSpecification.Partitions,
+		Sensitive:         rawSpecification.Sensitive,
+	}
+	if len(materializedSpecification.DependencyTypes) == 0 {
+		materializedSpecification.DependencyTypes = nil
+	}
+
+	if len(rawSpecification.Components) > 0 {
+		materializedComponents := map[string]EmbeddedComponentSpecification{}
+		for name, rawComponent := range rawSpecification.Components {
+			materializedComponents[name], err = MaterializeEmbeddedComponentSpecification(name, rawComponent)
+			if err != nil {
+				return materializedSpecification, fmt.Errorf("Invalid embedded component (%s): %w", name, err)
+			}
+		}
+		materializedSpecification.Components = materializedComponents
 	}
 
 	// Stages will always get recalculated, even if it is already populated in the rawSpecification
@@ -68,6 +293,13 @@ func MaterializeFlowSpecification(rawSpecification FlowSpecification) (FlowSpeci
 		materializedConfigs := make([]components.MountConfiguration, len(rawConfigs))
 		for i, rawConfig := range rawConfigs {
 			materializedConfig, err := components.MaterializeMountConfiguration(rawConfig)
+			if _, ok := components.RemoteSourceScheme(materializedConfig.Source); err == nil && ok {
+				if !staging.Supported(materializedConfig.Source) {
+					err = fmt.Errorf("Unsupported mount source (%s) for step (%s)", materializedConfig.Source, step)
+				} else if materializedConfig.Method != "bind" {
+					err = fmt.Errorf("Remote mount source (%s) of step (%s) must use the bind method", materializedConfig.Source, step)
+				}
+			}
 			if err != nil {
 				materializedSpecification.Mounts = map[string][]components.MountConfiguration{
 					step: {materializedConfig},
@@ -84,41 +316,536 @@ func MaterializeFlowSpecification(rawSpecification FlowSpecification) (FlowSpeci
 	for step, envMap := range rawSpecification.Env {
 		materializedEnvMap := map[string]string{}
 		for key, value := range envMap {
-			materializedEnvMap[key] = components.MaterializeEnv(value)
+			materializedValue, err := components.MaterializeEnv(value)
+			if err != nil {
+				return materializedSpecification, fmt.Errorf("Could not materialize environment variable (%s) for step (%s): %w", key, step, err)
+			}
+			materializedEnvMap[key] = materializedValue
 		}
 		materializedEnv[step] = materializedEnvMap
 	}
 	materializedSpecification.Env = materializedEnv
 
+	materializedWorkdirs := map[string]string{}
+	for step, workdir := range rawSpecification.Workdirs {
+		materializedWorkdir, err := components.MaterializeEnv(workdir)
+		if err != nil {
+			return materializedSpecification, fmt.Errorf("Could not materialize workdir for step (%s): %w", step, err)
+		}
+		materializedWorkdirs[step] = materializedWorkdir
+	}
+	materializedSpecification.Workdirs = materializedWorkdirs
+
+	materializedTargets := map[string]string{}
+	for step, target := range rawSpecification.Targets {
+		component, ok := rawSpecification.Steps[step]
+		if !ok {
+			return materializedSpecification, fmt.Errorf("Unknown step in targets: %s", step)
+		}
+		if isHostStep(component) {
+			return materializedSpecification, fmt.Errorf("Step (%s) runs on the host, so it has no target", step)
+		}
+		if target == "" {
+			return materializedSpecification, fmt.Errorf("Empty target for step (%s)", step)
+		}
+		materializedTargets[step] = target
+	}
+	materializedSpecification.Targets = materializedTargets
+
+	materializedStdin := map[string]string{}
+	for step, rawPath := range rawSpecification.Stdin {
+		absolutePath, err := materializePath(rawPath)
+		if err != nil {
+			return materializedSpecification, fmt.Errorf("Could not resolve stdin path (%s) for step (%s): %w", rawPath, step, err)
+		}
+		materializedStdin[step] = absolutePath
+	}
+	materializedSpecification.Stdin = materializedStdin
+
+	materializedStdoutArtifacts := map[string]string{}
+	for step, name := range rawSpecification.StdoutArtifacts {
+		err := components.ValidateArtifactName(name)
+		if err != nil {
+			return materializedSpecification, fmt.Errorf("Invalid stdout artifact (%s) for step (%s): %w", name, step, err)
+		}
+		materializedStdoutArtifacts[step] = name
+	}
+	for step, component := range rawSpecification.Steps {
+		if _, ok := materializedStdoutArtifacts[step]; component == LoadTestComponentID && !ok {
+			materializedStdoutArtifacts[step] = LoadTestArtifactName
+		}
+	}
+	materializedSpecification.StdoutArtifacts = materializedStdoutArtifacts
+
+	materializedNotifications, err := MaterializeNotificationsSpecification(rawSpecification.Notifications)
+	if err != nil {
+		return materializedSpecification, err
+	}
+	materializedSpecification.Notifications = materializedNotifications
+
+	materializedHooks, err := MaterializeHooksSpecification(rawSpecification.Hooks)
+	if err != nil {
+		return materializedSpecification, fmt.Errorf("Invalid flow hooks: %w", err)
+	}
+	materializedSpecification.Hooks = materializedHooks
+
+	materializedStepHooks := map[string]HooksSpecification{}
+	for step, rawHooks := range rawSpecification.StepHooks {
+		if _, ok := rawSpecification.Steps[step]; !ok && step != AllStepsKey {
+			return materializedSpecification, fmt.Errorf("Unknown step in step hooks: %s", step)
+		}
+		materializedStepHooks[step], err = MaterializeHooksSpecification(rawHooks)
+		if err != nil {
+			return materializedSpecification, fmt.Errorf("Invalid hooks for step (%s): %w", step, err)
+		}
+	}
+	materializedSpecification.StepHooks = materializedStepHooks
+
+	materializedSpecification.OnSuccess, err = materializeStepHandlers(rawSpecification.Steps, rawSpecification.OnSuccess)
+	if err != nil {
+		return materializedSpecification, fmt.Errorf("Invalid on_success handlers: %w", err)
+	}
+	materializedAllowFailure := map[string]bool{}
+	for step, allowed := range rawSpecification.AllowFailure {
+		if _, ok := rawSpecification.Steps[step]; !ok {
+			return materializedSpecification, fmt.Errorf("Unknown step in allow_failure: %s", step)
+		}
+		if allowed {
+			materializedAllowFailure[step] = true
+		}
+	}
+	materializedSpecification.AllowFailure = materializedAllowFailure
+
+	materializedDeadLetters := map[string]DeadLetterSpecification{}
+	for step, rawDeadLetter := range rawSpecification.DeadLetters {
+		if _, ok := rawSpecification.Steps[step]; !ok {
+			return materializedSpecification, fmt.Errorf("Unknown step in dead_letters: %s", step)
+		}
+		mounts := materializedSpecification.Mounts[step]
+		if shardMount, ok := shardInputMount("", rawSpecification, step); ok {
+			mounts = append(append([]components.MountConfiguration{}, mounts...), shardMount)
+		}
+		materializedDeadLetter, err := MaterializeDeadLetterSpecification(rawDeadLetter, mounts)
+		if err != nil {
+			return materializedSpecification, fmt.Errorf("Invalid dead-letter specification for step (%s): %w", step, err)
+		}
+		materializedDeadLetters[step] = materializedDeadLetter
+	}
+	materializedSpecification.DeadLetters = materializedDeadLetters
+
+	materializedAttempts := map[string]int{}
+	for step, attempts := range rawSpecification.Attempts {
+		component, ok := rawSpecification.Steps[step]
+		if !ok {
+			return materializedSpecification, fmt.Errorf("Unknown step in attempts: %s", step)
+		}
+		if isHostStep(component) {
+			return materializedSpecification, fmt.Errorf("Step (%s) runs on the host, so it cannot be attempted more than once", step)
+		}
+		if attempts < 1 {
+			return materializedSpecification, fmt.Errorf("Attempts for step (%s) must be at least 1", step)
+		}
+		materializedAttempts[step] = attempts
+	}
+	materializedSpecification.Attempts = materializedAttempts
+
+	materializedInputs := map[string]InputSpecification{}
+	for name, rawInput := range rawSpecification.Inputs {
+		materializedInputs[name], err = MaterializeInputSpecification(rawInput)
+		if err != nil {
+			return materializedSpecification, fmt.Errorf("Invalid input (%s): %w", name, err)
+		}
+	}
+	materializedSpecification.Inputs = materializedInputs
+
+	materializedOutputs := map[string]OutputSpecification{}
+	for name, rawOutput := range rawSpecification.Outputs {
+		materializedOutputs[name], err = MaterializeOutputSpecification(rawOutput)
+		if err != nil {
+			return materializedSpecification, fmt.Errorf("Invalid output (%s): %w", name, err)
+		}
+	}
+	materializedSpecification.Outputs = materializedOutputs
+
+	materializedSpecification.OnFailure, err = materializeStepHandlers(rawSpecification.Steps, rawSpecification.OnFailure)
+	if err != nil {
+		return materializedSpecification, fmt.Errorf("Invalid on_failure handlers: %w", err)
+	}
+
+	materializedSpecification.Contracts, err = MaterializeStepContracts(rawSpecification.Steps, rawSpecification.Dependencies, rawSpecification.Contracts)
+	if err != nil {
+		return materializedSpecification, fmt.Errorf("Invalid data contracts: %w", err)
+	}
+	materializedSpecification.ValidateContracts = rawSpecification.ValidateContracts
+
+	materializedValidations := map[string]ValidationSpecification{}
+	for step, rawValidation := range rawSpecification.Validations {
+		if rawSpecification.Steps[step] != ValidateComponentID {
+			return materializedSpecification, fmt.Errorf("Step (%s) has a validation specification but does not use the %s component", step, ValidateComponentID)
+		}
+		materializedValidations[step], err = MaterializeValidationSpecification(rawValidation)
+		if err != nil {
+			return materializedSpecification, fmt.Errorf("Invalid validation for step (%s): %w", step, err)
+		}
+	}
+	for step, component := range rawSpecification.Steps {
+		if component != ValidateComponentID {
+			continue
+		}
+		if _, ok := materializedValidations[step]; !ok {
+			return materializedSpecification, fmt.Errorf("Validation step (%s) has no validation specification", step)
+		}
+		if _, ok := rawSpecification.StdoutArtifacts[step]; ok {
+			return materializedSpecification, fmt.Errorf("Validation step (%s) cannot capture a stdout artifact", step)
+		}
+	}
+	materializedSpecification.Validations = materializedValidations
+
+	materializedGates := map[string]GateSpecification{}
+	for step, rawGate := range rawSpecification.Gates {
+		if rawSpecification.Steps[step] != GateComponentID {
+			return materializedSpecification, fmt.Errorf("Step (%s) has a gate specification but does not use the %s component", step, GateComponentID)
+		}
+		materializedGates[step], err = MaterializeGateSpecification(rawGate)
+		if err != nil {
+			return materializedSpecification, fmt.Errorf("Invalid gate for step (%s): %w", step, err)
+		}
+	}
+	for step, component := range rawSpecification.Steps {
+		if component != GateComponentID {
+			continue
+		}
+		if _, ok := rawSpecification.StdoutArtifacts[step]; ok {
+			return materializedSpecification, fmt.Errorf("Gate step (%s) cannot capture a stdout artifact", step)
+		}
+	}
+	materializedSpecification.Gates = materializedGates
+
+	if rawSpecification.DockerRetries != nil {
+		dockerRetries, err := MaterializeDockerRetriesSpecification(*rawSpecification.DockerRetries)
+		if err != nil {
+			return materializedSpecification, fmt.Errorf("Invalid docker_retries: %w", err)
+		}
+		materializedSpecification.DockerRetries = &dockerRetries
+	}
+
+	markSensitiveValues(materializedSpecification)
+
+	// Like stages, warnings are always recalculated
+	materializedSpecification.Warnings = append(warnings, deadEndWarnings(materializedSpecification)...)
+	if len(materializedSpecification.Warnings) == 0 {
+		materializedSpecification.Warnings = nil
+	}
+
 	return materializedSpecification, nil
 }
 
+// materializeStepHandlers materializes step outcome handlers (which are keyed by step name),
+// checking that each of them is registered against a step in the given steps map
+func materializeStepHandlers(steps map[string]string, rawHandlers map[string][]HookSpecification) (map[string][]HookSpecification, error) {
+	materializedHandlers := map[string][]HookSpecification{}
+	for step, handlers := range rawHandlers {
+		if _, ok := steps[step]; !ok {
+			return materializedHandlers, fmt.Errorf("Unknown step: %s", step)
+		}
+		materializedHandlers[step] = make([]HookSpecification, len(handlers))
+		for i, rawHandler := range handlers {
+			materializedHandler, err := MaterializeHookSpecification(rawHandler)
+			if err != nil {
+				return materializedHandlers, fmt.Errorf("Handler %d for step (%s): %w", i, step, err)
+			}
+			materializedHandlers[step][i] = materializedHandler
+		}
+	}
+	return materializedHandlers, nil
+}
+
 // ReadSingleSpecification reads a single ComponentSpecification JSON document and returns the
 // corresponding ComponentSpecification struct. It returns an error if there was an issue parsing
-// the specification into the struct.
+// the specification into the struct, or if it is invalid (a components.InvalidSpecificationError).
+// Relative include paths are resolved against the current working directory.
 func ReadSingleSpecification(reader io.Reader) (FlowSpecification, error) {
-	dec := json.NewDecoder(reader)
-	dec.DisallowUnknownFields()
+	return readSpecification(reader, "", []string{})
+}
+
+// ReadSpecificationFile reads the flow specification at the given path, resolving any includes
+// relative to the directory containing it
+func ReadSpecificationFile(specificationPath string) (FlowSpecification, error) {
+	absolutePath, err := filepath.Abs(specificationPath)
+	if err != nil {
+		return FlowSpecification{}, err
+	}
+	specFile, err := os.Open(absolutePath)
+	if err != nil {
+		return FlowSpecification{}, fmt.Errorf("Error opening specification file (%s): %w", absolutePath, err)
+	}
+	defer specFile.Close()
+	return readSpecification(specFile, filepath.Dir(absolutePath), []string{absolutePath})
+}
+
+// ReadRegisteredSpecification reads the specification file of the given registered flow. If the
+// file no longer exists, the snapshot of the specification stored when the flow was registered (if
+// any) is read in its place, so that flows remain executable (and inspectable) after their
+// specification files are deleted.
+func ReadRegisteredSpecification(flow FlowMetadata) (FlowSpecification, error) {
+	specification, err := ReadSpecificationFile(flow.SpecificationPath)
+	if err != nil && flow.SpecificationSnapshot != "" {
+		if _, statErr := os.Stat(flow.SpecificationPath); os.IsNotExist(statErr) {
+			return readSpecification(strings.NewReader(flow.SpecificationSnapshot), filepath.Dir(flow.SpecificationPath), []string{flow.SpecificationPath})
+		}
+	}
+	return specification, err
+}
+
+// ReadSpecificationDocument reads the flow specification at the given path and returns it as a
+// JSON document into which its includes have been merged, but which has not been materialized
+// (e.g. "env:" values are left as they are). Unlike the original file, the returned document does
+// not depend on any other files.
+func ReadSpecificationDocument(specificationPath string) ([]byte, error) {
+	absolutePath, err := filepath.Abs(specificationPath)
+	if err != nil {
+		return []byte{}, err
+	}
+	specFile, err := os.Open(absolutePath)
+	if err != nil {
+		return []byte{}, fmt.Errorf("Error opening specification file (%s): %w", absolutePath, err)
+	}
+	defer specFile.Close()
+	document, err := readSpecificationDocument(specFile, filepath.Dir(absolutePath), []string{absolutePath})
+	if err != nil {
+		return []byte{}, fmt.Errorf("Error decoding flow specification: %w", err)
+	}
+	return json.MarshalIndent(document, "", "  ")
+}
 
+func readSpecification(reader io.Reader, baseDir string, includeStack []string) (FlowSpecification, error) {
 	var rawSpecification FlowSpecification
-	err := dec.Decode(&rawSpecification)
+	document, err := readSpecificationDocument(reader, baseDir, includeStack)
+	if err != nil {
+		return rawSpecification, &components.InvalidSpecificationError{Err: fmt.Errorf("Error decoding flow specification: %w", err)}
+	}
+	documentBytes, err := json.Marshal(document)
+	if err != nil {
+		return rawSpecification, fmt.Errorf("Error decoding flow specification: %w", err)
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(documentBytes))
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&rawSpecification)
 	if err != nil {
-		return rawSpecification, fmt.Errorf("Error decoding flow specification: %s", err.Error())
+		return rawSpecification, &components.InvalidSpecificationError{Err: fmt.Errorf("Error decoding flow specification: %w", err)}
 	}
 
 	// Performs full verification (including dependency resolution)
 	specification, err := MaterializeFlowSpecification(rawSpecification)
 	if err != nil {
-		return specification, fmt.Errorf("Error validating flow specification: %s", err.Error())
+		return specification, &components.InvalidSpecificationError{Err: fmt.Errorf("Error validating flow specification: %w", err)}
 	}
 
 	return specification, nil
 }
 
+// readSpecificationDocument decodes a flow specification JSON document from the given reader and
+// merges the documents it includes into it. includeStack holds the absolute paths of the documents
+// which are currently being read, so that cyclic includes can be detected.
+func readSpecificationDocument(reader io.Reader, baseDir string, includeStack []string) (map[string]interface{}, error) {
+	dec := json.NewDecoder(reader)
+	dec.UseNumber()
+	var document map[string]interface{}
+	err := dec.Decode(&document)
+	if err != nil {
+		return document, err
+	}
+
+	rawIncludes, ok := document["includes"]
+	if !ok {
+		return document, nil
+	}
+	delete(document, "includes")
+	includes, ok := rawIncludes.([]interface{})
+	if !ok {
+		return document, errors.New("includes must be a list of paths")
+	}
+
+	merged := map[string]interface{}{}
+	for _, rawInclude := range includes {
+		include, ok := rawInclude.(string)
+		if !ok {
+			return document, errors.New("includes must be a list of paths")
+		}
+		includePath, err := components.MaterializeEnv(include)
+		if err != nil {
+			return document, err
+		}
+		if !filepath.IsAbs(includePath) {
+			includePath = filepath.Join(baseDir, includePath)
+		}
+		includePath, err = filepath.Abs(includePath)
+		if err != nil {
+			return document, err
+		}
+		for _, includingPath := range includeStack {
+			if includingPath == includePath {
+				return document, fmt.Errorf("Cyclic include of %s", includePath)
+			}
+		}
+
+		includeFile, err := os.Open(includePath)
+		if err != nil {
+			return document, fmt.Errorf("Could not open included specification (%s): %w", includePath, err)
+		}
+		nextStack := append(append([]string{}, includeStack...), includePath)
+		included, err := readSpecificationDocument(includeFile, filepath.Dir(includePath), nextStack)
+		includeFile.Close()
+		if err != nil {
+			return document, fmt.Errorf("Error in included specification (%s): %w", includePath, err)
+		}
+		merged = mergeDocuments(merged, included)
+	}
+	return mergeDocuments(merged, document), nil
+}
+
+// mergeDocuments merges the JSON object overlay over base. Objects present in both are merged
+// recursively, and any other value in overlay replaces the corresponding value in base.
+func mergeDocuments(base, overlay map[string]interface{}) map[string]interface{} {
+	merged := map[string]interface{}{}
+	for key, value := range base {
+		merged[key] = value
+	}
+	for key, value := range overlay {
+		baseObject, baseIsObject := merged[key].(map[string]interface{})
+		overlayObject, overlayIsObject := value.(map[string]interface{})
+		if baseIsObject && overlayIsObject {
+			merged[key] = mergeDocuments(baseObject, overlayObject)
+		} else {
+			merged[key] = value
+		}
+	}
+	return merged
+}
+
+// ParseDependency splits an entry in the Dependencies of a flow specification into the name of the
+// step which it refers to and the type of the dependency. Entries without a type prefix are of type
+// DependencyAfter.
+func ParseDependency(rawDependency string) (string, string, error) {
+	for _, dependencyType := range []string{DependencyAfter, DependencyRequires} {
+		prefix := dependencyType + ":"
+		if strings.HasPrefix(rawDependency, prefix) {
+			return strings.TrimPrefix(rawDependency, prefix), dependencyType, nil
+		}
+	}
+	if i := strings.Index(rawDependency, ":"); i >= 0 {
+		return rawDependency, "", fmt.Errorf("Invalid dependency type (%s) in dependency (%s): must be one of %s, %s", rawDependency[:i], rawDependency, DependencyAfter, DependencyRequires)
+	}
+	return rawDependency, DependencyAfter, nil
+}
+
+// resolveDependencyTypes strips the type prefixes from the entries in the Dependencies of the given
+// specification and records the types of the dependencies (other than DependencyAfter) in its
+// DependencyTypes, alongside any that it already gives. Dependencies of steps on themselves and
+// dependencies which are listed more than once are dropped, and a warning is returned for each.
+func resolveDependencyTypes(rawSpecification FlowSpecification) (FlowSpecification, []string, error) {
+	warnings := []string{}
+	resolvedSpecification := rawSpecification
+	resolvedSpecification.DependencyTypes = map[string]map[string]string{}
+	for step, dependencyTypes := range rawSpecification.DependencyTypes {
+		for dependency, dependencyType := range dependencyTypes {
+			if dependencyType != DependencyAfter && dependencyType != DependencyRequires {
+				return rawSpecification, warnings, fmt.Errorf("Invalid type (%s) of dependency (%s) for step (%s): must be one of %s, %s", dependencyType, dependency, step, DependencyAfter, DependencyRequires)
+			}
+			setDependencyType(resolvedSpecification.DependencyTypes, step, dependency, dependencyType)
+		}
+	}
+
+	if rawSpecification.Dependencies != nil {
+		resolvedSpecification.Dependencies = map[string][]string{}
+	}
+	steps := make([]string, 0, len(rawSpecification.Dependencies))
+	for step := range rawSpecification.Dependencies {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+	for _, step := range steps {
+		rawDependencies := rawSpecification.Dependencies[step]
+		dependencies := make([]string, 0, len(rawDependencies))
+		listed := map[string]bool{}
+		for _, rawDependency := range rawDependencies {
+			dependency, dependencyType, err := ParseDependency(rawDependency)
+			if err != nil {
+				return rawSpecification, warnings, fmt.Errorf("Invalid dependency for step (%s): %w", step, err)
+			}
+			if dependency == step {
+				warnings = append(warnings, fmt.Sprintf("Step (%s) depends on itself; the dependency is ignored", step))
+				continue
+			}
+			if dependency != rawDependency {
+				setDependencyType(resolvedSpecification.DependencyTypes, step, dependency, dependencyType)
+			}
+			if listed[dependency] {
+				warnings = append(warnings, fmt.Sprintf("Step (%s) lists its dependency on step (%s) more than once", step, dependency))
+				continue
+			}
+			listed[dependency] = true
+			dependencies = append(dependencies, dependency)
+		}
+		resolvedSpecification.Dependencies[step] = dependencies
+	}
+
+	if len(resolvedSpecification.DependencyTypes) == 0 {
+		resolvedSpecification.DependencyTypes = nil
+	}
+	return resolvedSpecification, warnings, nil
+}
+
+// setDependencyType records the given type for the dependency of the given step on the given
+// dependency. Dependencies of type DependencyAfter are not recorded.
+func setDependencyType(dependencyTypes map[string]map[string]string, step, dependency, dependencyType string) {
+	if dependencyType == DependencyAfter {
+		delete(dependencyTypes[step], dependency)
+		if len(dependencyTypes[step]) == 0 {
+			delete(dependencyTypes, step)
+		}
+		return
+	}
+	if dependencyTypes[step] == nil {
+		dependencyTypes[step] = map[string]string{}
+	}
+	dependencyTypes[step][dependency] = dependencyType
+}
+
+// DependencyType returns the type of the dependency of the given step on the given dependency in
+// the given (materialized) flow specification
+func DependencyType(specification FlowSpecification, step, dependency string) string {
+	if dependencyType, ok := specification.DependencyTypes[step][dependency]; ok {
+		return dependencyType
+	}
+	return DependencyAfter
+}
+
+// dependsOn returns true if the given step depends on the given dependency in the given
+// specification
+func dependsOn(specification FlowSpecification, step, dependency string) bool {
+	for _, candidate := range specification.Dependencies[step] {
+		if candidate == dependency {
+			return true
+		}
+	}
+	return false
+}
+
 // ErrCyclicDependency is returned when flow dependency resolution fails because there was a cycle
 // in the dependency graph.
 var ErrCyclicDependency = errors.New("Cyclic dependency detected in given flow")
 
+// materializePath applies "env:" substitutions to the given path and resolves it to an absolute path
+func materializePath(rawPath string) (string, error) {
+	materializedPath, err := components.MaterializeEnv(rawPath)
+	if err != nil {
+		return rawPath, err
+	}
+	return filepath.Abs(materializedPath)
+}
+
 // CalculateStages calculates stages for the execution of the flow with the given specification.
 // Each stage is an array of flow steps which can be executed concurrently (although they do not
 // have to be)
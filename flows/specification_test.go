@@ -1,6 +1,11 @@
 package flows
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/simiotics/shnorky/components"
@@ -245,6 +250,12 @@ func TestMaterializeSpecification(t *testing.T) {
 						"key-1": "value-1",
 					},
 				},
+				Workdirs: map[string]string{
+					"b": "/opt/workdir",
+				},
+				Stdin: map[string]string{
+					"a": "/tmp/stdin.txt",
+				},
 			},
 			expectedSpecification: FlowSpecification{
 				Steps: map[string]string{
@@ -269,6 +280,12 @@ func TestMaterializeSpecification(t *testing.T) {
 						"key-1": "value-1",
 					},
 				},
+				Workdirs: map[string]string{
+					"b": "/opt/workdir",
+				},
+				Stdin: map[string]string{
+					"a": "/tmp/stdin.txt",
+				},
 			},
 			returnsError: false,
 		},
@@ -421,5 +438,421 @@ func TestMaterializeSpecification(t *testing.T) {
 				}
 			}
 		}
+
+		if len(specification.Workdirs) != len(testCase.expectedSpecification.Workdirs) {
+			t.Errorf("[Test %d] Unexpected number of workdirs: expected=%d, actual=%d", i, len(testCase.expectedSpecification.Workdirs), len(specification.Workdirs))
+			break
+		}
+		for step, workdir := range specification.Workdirs {
+			if workdir != testCase.expectedSpecification.Workdirs[step] {
+				t.Errorf("[Test %d] Step %s - mismatched workdirs: expected=%s, actual=%s", i, step, testCase.expectedSpecification.Workdirs[step], workdir)
+			}
+		}
+
+		if len(specification.Stdin) != len(testCase.expectedSpecification.Stdin) {
+			t.Errorf("[Test %d] Unexpected number of stdin paths: expected=%d, actual=%d", i, len(testCase.expectedSpecification.Stdin), len(specification.Stdin))
+			break
+		}
+		for step, stdinPath := range specification.Stdin {
+			if stdinPath != testCase.expectedSpecification.Stdin[step] {
+				t.Errorf("[Test %d] Step %s - mismatched stdin paths: expected=%s, actual=%s", i, step, testCase.expectedSpecification.Stdin[step], stdinPath)
+			}
+		}
+	}
+}
+
+func TestMaterializeAllowFailure(t *testing.T) {
+	rawSpecification := FlowSpecification{
+		Steps:        map[string]string{"a": "component-a", "b": "component-b"},
+		AllowFailure: map[string]bool{"a": true, "b": false},
+	}
+	specification, err := MaterializeFlowSpecification(rawSpecification)
+	if err != nil {
+		t.Fatalf("Unexpected error materializing specification: %s", err.Error())
+	}
+	if !specification.AllowFailure["a"] || specification.AllowFailure["b"] {
+		t.Errorf("Unexpected allow_failure flags: %v", specification.AllowFailure)
+	}
+
+	rawSpecification.AllowFailure = map[string]bool{"c": true}
+	_, err = MaterializeFlowSpecification(rawSpecification)
+	if err == nil {
+		t.Error("Expected error materializing allow_failure flag for unknown step")
+	}
+}
+
+func TestMaterializeTargets(t *testing.T) {
+	rawSpecification := FlowSpecification{
+		Steps:   map[string]string{"a": "component-a", "b": "component-a"},
+		Targets: map[string]string{"b": "test"},
+	}
+	specification, err := MaterializeFlowSpecification(rawSpecification)
+	if err != nil {
+		t.Fatalf("Unexpected error materializing specification: %s", err.Error())
+	}
+	if len(specification.Targets) != 1 || specification.Targets["b"] != "test" {
+		t.Errorf("Unexpected targets: %v", specification.Targets)
+	}
+
+	invalidTargets := []map[string]string{
+		{"c": "test"},
+		{"b": ""},
+	}
+	for _, targets := range invalidTargets {
+		rawSpecification.Targets = targets
+		_, err = MaterializeFlowSpecification(rawSpecification)
+		if err == nil {
+			t.Errorf("Expected error materializing targets: %v", targets)
+		}
+	}
+}
+
+func TestParseDependency(t *testing.T) {
+	type dependencyTest struct {
+		rawDependency string
+		expectedStep  string
+		expectedType  string
+		expectedError bool
+	}
+
+	tests := []dependencyTest{
+		{"load", "load", DependencyAfter, false},
+		{"after:load", "load", DependencyAfter, false},
+		{"requires:api", "api", DependencyRequires, false},
+		{"needs:api", "", "", true},
+	}
+
+	for i, test := range tests {
+		step, dependencyType, err := ParseDependency(test.rawDependency)
+		if test.expectedError {
+			if err == nil {
+				t.Errorf("[Test %d] Expected error but did not get one", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[Test %d] Unexpected error: %s", i, err.Error())
+			continue
+		}
+		if step != test.expectedStep || dependencyType != test.expectedType {
+			t.Errorf("[Test %d] Unexpected dependency: expected=%s (%s), actual=%s (%s)", i, test.expectedStep, test.expectedType, step, dependencyType)
+		}
+	}
+}
+
+func TestMaterializeDependencyTypes(t *testing.T) {
+	rawSpecification := FlowSpecification{
+		Steps: map[string]string{"api": "api", "db": "postgres", "migrate": "migrator", "test": "tester"},
+		Dependencies: map[string][]string{
+			"api":     {"requires:db", "migrate"},
+			"migrate": {"requires:db"},
+			"test":    {"requires:api", "after:migrate"},
+		},
+	}
+	specification, err := MaterializeFlowSpecification(rawSpecification)
+	if err != nil {
+		t.Fatalf("Unexpected error materializing specification: %s", err.Error())
+	}
+
+	expectedDependencies := map[string][]string{"api": {"db", "migrate"}, "migrate": {"db"}, "test": {"api", "migrate"}}
+	if !reflect.DeepEqual(specification.Dependencies, expectedDependencies) {
+		t.Errorf("Unexpected dependencies: expected=%v, actual=%v", expectedDependencies, specification.Dependencies)
+	}
+	expectedTypes := map[string]map[string]string{
+		"api":     {"db": DependencyRequires},
+		"migrate": {"db": DependencyRequires},
+		"test":    {"api": DependencyRequires},
+	}
+	if !reflect.DeepEqual(specification.DependencyTypes, expectedTypes) {
+		t.Errorf("Unexpected dependency types: expected=%v, actual=%v", expectedTypes, specification.DependencyTypes)
+	}
+	if DependencyType(specification, "test", "api") != DependencyRequires || DependencyType(specification, "test", "migrate") != DependencyAfter {
+		t.Errorf("Unexpected types of dependencies of step (test): %v", specification.DependencyTypes["test"])
+	}
+	expectedStages := [][]string{{"db"}, {"migrate"}, {"api"}, {"test"}}
+	if !reflect.DeepEqual(specification.Stages, expectedStages) {
+		t.Errorf("Unexpected stages: expected=%v, actual=%v", expectedStages, specification.Stages)
+	}
+
+	// Materializing a materialized specification preserves the types of its dependencies
+	rematerialized, err := MaterializeFlowSpecification(specification)
+	if err != nil || !reflect.DeepEqual(rematerialized.DependencyTypes, expectedTypes) {
+		t.Errorf("Unexpected dependency types after rematerializing: types=%v, error=%v", rematerialized.DependencyTypes, err)
+	}
+
+	invalidSpecifications := []FlowSpecification{
+		{Steps: map[string]string{"a": "a", "b": "b"}, Dependencies: map[string][]string{"b": {"needs:a"}}},
+		{Steps: map[string]string{"a": "a", "b": "b"}, Dependencies: map[string][]string{"b": {"requires:c"}}},
+		{Steps: map[string]string{"a": GateComponentID, "b": "b"}, Dependencies: map[string][]string{"b": {"requires:a"}}},
+		{Steps: map[string]string{"a": "a", "b": "b"}, DependencyTypes: map[string]map[string]string{"b": {"a": DependencyRequires}}},
+		{Steps: map[string]string{"a": "a", "b": "b"}, Dependencies: map[string][]string{"b": {"a"}}, DependencyTypes: map[string]map[string]string{"b": {"a": "before"}}},
+	}
+	for i, invalidSpecification := range invalidSpecifications {
+		_, err := MaterializeFlowSpecification(invalidSpecification)
+		if err == nil {
+			t.Errorf("[Test %d] Expected error but did not get one", i)
+		}
+	}
+}
+
+func TestMaterializeWarnings(t *testing.T) {
+	type MaterializeWarningsTest struct {
+		rawSpecification     FlowSpecification
+		expectedDependencies map[string][]string
+		expectedWarnings     []string
+	}
+
+	tests := []MaterializeWarningsTest{
+		{
+			rawSpecification: FlowSpecification{
+				Steps:        map[string]string{"a": "a", "b": "b"},
+				Dependencies: map[string][]string{"b": {"a"}},
+				Outputs:      map[string]OutputSpecification{"report": {Path: "/tmp/out/report.csv"}},
+				Mounts:       map[string][]components.MountConfiguration{"b": {{Source: "/tmp/out", Target: "/out", Method: "bind"}}},
+			},
+			expectedDependencies: map[string][]string{"b": {"a"}},
+			expectedWarnings:     nil,
+		},
+		{
+			rawSpecification: FlowSpecification{
+				Steps:        map[string]string{"a": "a", "b": "b", "c": "c"},
+				Dependencies: map[string][]string{"b": {"a"}, "c": {"b", "a", "after:b", "c"}},
+				Outputs:      map[string]OutputSpecification{"report": {Path: "/tmp/out/report.csv"}},
+				Mounts:       map[string][]components.MountConfiguration{"c": {{Source: "/tmp/out", Target: "/out", Method: "bind"}}},
+			},
+			expectedDependencies: map[string][]string{"b": {"a"}, "c": {"b", "a"}},
+			expectedWarnings: []string{
+				"Step (c) lists its dependency on step (b) more than once",
+				"Step (c) depends on itself; the dependency is ignored",
+			},
+		},
+		{
+			rawSpecification: FlowSpecification{
+				Steps:        map[string]string{"a": "a", "b": "b", "approve": GateComponentID},
+				Dependencies: map[string][]string{"approve": {"a"}},
+			},
+			expectedDependencies: map[string][]string{"approve": {"a"}},
+			expectedWarnings:     []string{"No step depends on step (b), and it declares no outputs"},
+		},
+		{
+			rawSpecification: FlowSpecification{
+				Steps:           map[string]string{"a": "a", "b": "b"},
+				StdoutArtifacts: map[string]string{"b": "log.txt"},
+			},
+			expectedDependencies: nil,
+			expectedWarnings:     []string{"No step depends on step (a), and it declares no outputs"},
+		},
+	}
+
+	for i, test := range tests {
+		specification, err := MaterializeFlowSpecification(test.rawSpecification)
+		if err != nil {
+			t.Errorf("[Test %d] Unexpected error materializing specification: %s", i, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(specification.Dependencies, test.expectedDependencies) {
+			t.Errorf("[Test %d] Unexpected dependencies: expected=%v, actual=%v", i, test.expectedDependencies, specification.Dependencies)
+		}
+		if !reflect.DeepEqual(specification.Warnings, test.expectedWarnings) {
+			t.Errorf("[Test %d] Unexpected warnings: expected=%q, actual=%q", i, test.expectedWarnings, specification.Warnings)
+		}
+	}
+}
+
+func TestValidateRequirements(t *testing.T) {
+	specification, err := MaterializeFlowSpecification(FlowSpecification{
+		Steps:        map[string]string{"api": "api", "load": "loader", "test": "tester"},
+		Dependencies: map[string][]string{"test": {"requires:api", "load"}},
+	})
+	if err != nil {
+		t.Fatalf("Unexpected error materializing specification: %s", err.Error())
+	}
+
+	err = validateRequirements(specification, map[string]bool{"api": true})
+	if err != nil {
+		t.Errorf("Unexpected error validating requirements on a service: %s", err.Error())
+	}
+	err = validateRequirements(specification, map[string]bool{})
+	if err == nil {
+		t.Error("Expected error validating requirement on a step which is not a service")
+	}
+}
+
+func TestMaterializeAttempts(t *testing.T) {
+	rawSpecification := FlowSpecification{
+		Steps:    map[string]string{"a": "component-a", "b": "component-b"},
+		Attempts: map[string]int{"a": 3},
+	}
+	specification, err := MaterializeFlowSpecification(rawSpecification)
+	if err != nil {
+		t.Fatalf("Unexpected error materializing specification: %s", err.Error())
+	}
+	if stepAttempts(specification, "a") != 3 || stepAttempts(specification, "b") != 1 {
+		t.Errorf("Unexpected attempts: a=%d, b=%d", stepAttempts(specification, "a"), stepAttempts(specification, "b"))
+	}
+	specification.DeadLetters = map[string]DeadLetterSpecification{"a": {Retries: 4}}
+	if stepAttempts(specification, "a") != 5 {
+		t.Errorf("Unexpected attempts for dead-lettered step: expected=5, actual=%d", stepAttempts(specification, "a"))
+	}
+
+	err = validateAttempts(specification, map[string]bool{"b": true})
+	if err != nil {
+		t.Errorf("Unexpected error validating attempts: %s", err.Error())
+	}
+	err = validateAttempts(specification, map[string]bool{"a": true})
+	if err == nil {
+		t.Error("Expected error validating attempts for a service step")
+	}
+
+	invalidAttempts := []map[string]int{
+		{"c": 2},
+		{"a": 0},
+	}
+	for _, attempts := range invalidAttempts {
+		rawSpecification.Attempts = attempts
+		_, err = MaterializeFlowSpecification(rawSpecification)
+		if err == nil {
+			t.Errorf("Expected error materializing attempts: %v", attempts)
+		}
+	}
+}
+
+func TestFailedSteps(t *testing.T) {
+	zero := 0
+	one := 1
+	executions := map[string]components.ExecutionMetadata{
+		"a": {ExitCode: &one},
+		"b": {ExitCode: &zero},
+		"c": {},
+		"d": {ExitCode: &one},
+	}
+	failedSteps := FailedSteps(executions)
+	if len(failedSteps) != 2 || failedSteps[0] != "a" || failedSteps[1] != "d" {
+		t.Errorf("Unexpected failed steps: %v", failedSteps)
+	}
+}
+
+func TestMaterializeRemoteMounts(t *testing.T) {
+	type remoteMountTest struct {
+		mount          components.MountConfiguration
+		expectedSource string
+		returnsError   bool
+	}
+
+	testCases := []remoteMountTest{
+		{mount: components.MountConfiguration{Source: "s3://bucket/inputs/", Target: "/shnorky/inputs", Method: "bind"}, expectedSource: "s3://bucket/inputs/"},
+		{mount: components.MountConfiguration{Source: "ftp://host/inputs", Target: "/shnorky/inputs", Method: "bind"}, returnsError: true},
+		{mount: components.MountConfiguration{Source: "s3://bucket/inputs/", Target: "/shnorky/inputs", Method: "volume"}, returnsError: true},
+		{mount: components.MountConfiguration{Source: "sftp://user@host/exports/data.csv", Target: "/shnorky/data.csv", Method: "bind"}, expectedSource: "sftp://user@host/exports/data.csv"},
+		{mount: components.MountConfiguration{Source: "https://host/exports/data.csv#sha1=abcd", Target: "/shnorky/data.csv", Method: "bind"}, returnsError: true},
+	}
+
+	for i, testCase := range testCases {
+		specification, err := MaterializeFlowSpecification(FlowSpecification{
+			Steps:  map[string]string{"step": "component"},
+			Mounts: map[string][]components.MountConfiguration{"step": {testCase.mount}},
+		})
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		} else if err == nil && specification.Mounts["step"][0].Source != testCase.expectedSource {
+			t.Errorf("[Test %d] Unexpected source: %s", i, specification.Mounts["step"][0].Source)
+		}
+	}
+}
+
+func TestReadSpecificationFileIncludes(t *testing.T) {
+	specDir, err := ioutil.TempDir("", "shnorky-includes-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(specDir)
+
+	files := map[string]string{
+		"fragments/common.json": `{
+	"includes": ["env.json"],
+	"steps": {"extract": "extractor", "load": "loader"},
+	"dependencies": {"load": ["extract"]},
+	"mounts": {"extract": [{"source": "/tmp/extract", "target": "/shnorky/output", "method": "bind"}]}
+}`,
+		"fragments/env.json": `{"env": {"extract": {"MODE": "full", "LEVEL": "info"}}}`,
+		"flow.json": `{
+	"includes": ["fragments/common.json"],
+	"steps": {"report": "reporter"},
+	"dependencies": {"report": ["load"]},
+	"env": {"extract": {"MODE": "incremental"}}
+}`,
+		"cycle-a.json":          `{"includes": ["cycle-b.json"], "steps": {"a": "component"}}`,
+		"cycle-b.json":          `{"includes": ["cycle-a.json"]}`,
+		"missing.json":          `{"includes": ["fragments/missing.json"], "steps": {"a": "component"}}`,
+		"invalid.json":          `{"includes": "fragments/env.json", "steps": {"a": "component"}}`,
+		"unknown.json":          `{"includes": ["unknown-fragment.json"], "steps": {"a": "component"}}`,
+		"unknown-fragment.json": `{"stepz": {"a": "component"}}`,
+	}
+	for name, contents := range files {
+		err = os.MkdirAll(filepath.Dir(filepath.Join(specDir, name)), 0755)
+		if err != nil {
+			t.Fatalf("Could not create directory for %s: %s", name, err.Error())
+		}
+		err = ioutil.WriteFile(filepath.Join(specDir, name), []byte(contents), 0644)
+		if err != nil {
+			t.Fatalf("Could not write %s: %s", name, err.Error())
+		}
+	}
+
+	specification, err := ReadSpecificationFile(filepath.Join(specDir, "flow.json"))
+	if err != nil {
+		t.Fatalf("Could not read specification with includes: %s", err.Error())
+	}
+	if len(specification.Steps) != 3 || specification.Steps["extract"] != "extractor" || specification.Steps["report"] != "reporter" {
+		t.Errorf("Unexpected steps: %v", specification.Steps)
+	}
+	if len(specification.Dependencies["load"]) != 1 || len(specification.Dependencies["report"]) != 1 {
+		t.Errorf("Unexpected dependencies: %v", specification.Dependencies)
+	}
+	if len(specification.Mounts["extract"]) != 1 {
+		t.Errorf("Unexpected mounts: %v", specification.Mounts)
+	}
+	if specification.Env["extract"]["MODE"] != "incremental" || specification.Env["extract"]["LEVEL"] != "info" {
+		t.Errorf("Unexpected env: %v", specification.Env)
+	}
+	if len(specification.Includes) != 0 || len(specification.Stages) != 3 {
+		t.Errorf("Unexpected includes (%v) or stages (%v)", specification.Includes, specification.Stages)
+	}
+
+	for _, name := range []string{"cycle-a.json", "missing.json", "invalid.json", "unknown.json"} {
+		_, err = ReadSpecificationFile(filepath.Join(specDir, name))
+		if err == nil {
+			t.Errorf("[%s] Expected error reading specification", name)
+		}
+	}
+
+	_, err = ReadSingleSpecification(strings.NewReader(`{"includes": ["` + filepath.Join(specDir, "fragments", "common.json") + `"]}`))
+	if err != nil {
+		t.Errorf("Unexpected error reading specification with absolute include: %s", err.Error())
+	}
+}
+
+func TestMaterializeSensitive(t *testing.T) {
+	os.Setenv("SHNORKY_TEST_SENSITIVE", "shnorky-test-flow-secret")
+	defer os.Unsetenv("SHNORKY_TEST_SENSITIVE")
+
+	rawSpecification := FlowSpecification{
+		Steps:     map[string]string{"approve": GateComponentID},
+		Env:       map[string]map[string]string{"approve": {"TOKEN": "env:SHNORKY_TEST_SENSITIVE", "MODE": "strict"}},
+		Hooks:     HooksSpecification{Before: []HookSpecification{{Command: []string{"true"}, Env: map[string]string{"TOKEN": "shnorky-test-hook-secret"}}}},
+		Sensitive: []string{"TOKEN"},
+	}
+
+	_, err := MaterializeFlowSpecification(rawSpecification)
+	if err != nil {
+		t.Fatalf("Unexpected error materializing flow specification: %s", err.Error())
+	}
+
+	redacted := components.Redact("shnorky-test-flow-secret shnorky-test-hook-secret strict")
+	expected := components.RedactedValue + " " + components.RedactedValue + " strict"
+	if redacted != expected {
+		t.Errorf("Unexpected redaction: expected=%s, actual=%s", expected, redacted)
 	}
 }
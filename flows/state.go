@@ -1,59 +1,171 @@
 package flows
 
 import (
-	"database/sql"
+	"context"
 	"errors"
-	"fmt"
-	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
 )
 
 // ErrFlowNotFound - signifies that a single row lookup against a state database returned
 // no rows
 var ErrFlowNotFound = errors.New("Could not find the specified flow")
 
-var insertFlow = "INSERT INTO flows (id, specification_path, created_at) VALUES(?, ?, ?);"
-var selectFlowByID = "SELECT * FROM flows WHERE id=?;"
+// ErrFlowRunNotFound - signifies that a single row lookup against the flow_runs table in a state
+// database returned no rows
+var ErrFlowRunNotFound = errors.New("Could not find the specified flow run")
 
-// InsertFlow creates a new row in the components table with the given component information.
-func InsertFlow(db *sql.DB, component FlowMetadata) error {
-	tx, err := db.Begin()
-	if err != nil {
-		return err
+// InsertFlow creates a new row in the flows table with the given flow information.
+func InsertFlow(store state.Store, flow FlowMetadata) error {
+	return RegisterFlow(store, flow, nil)
+}
+
+// RegisterFlow creates a new row in the flows table with the given flow information, along with a
+// row in the flow_components table for each of the given steps (which map step names to the IDs of
+// their components), in a single transaction.
+func RegisterFlow(store state.Store, flow FlowMetadata, steps map[string]string) error {
+	flowComponents := []state.FlowComponentRecord{}
+	for step, componentID := range steps {
+		flowComponents = append(flowComponents, state.FlowComponentRecord{FlowID: flow.ID, Step: step, ComponentID: componentID})
 	}
-	_, err = tx.Exec(
-		insertFlow,
-		component.ID,
-		component.SpecificationPath,
-		component.CreatedAt.Unix(),
-	)
-	if err != nil {
-		tx.Rollback()
-		return err
+	return store.RegisterFlow(state.FlowRecord{
+		ID:                    flow.ID,
+		SpecificationPath:     flow.SpecificationPath,
+		CreatedAt:             flow.CreatedAt,
+		CreatedBy:             flow.CreatedBy,
+		SpecificationChecksum: flow.SpecificationChecksum,
+		SpecificationSnapshot: flow.SpecificationSnapshot,
+	}, flowComponents)
+}
+
+// updateFlow stores the specification path, checksum, and snapshot of the given flow against its
+// row, and replaces the components recorded for its steps with the given ones, in a single
+// transaction
+func updateFlow(store state.Store, flow FlowMetadata, steps map[string]string) error {
+	flowComponents := []state.FlowComponentRecord{}
+	for step, componentID := range steps {
+		flowComponents = append(flowComponents, state.FlowComponentRecord{FlowID: flow.ID, Step: step, ComponentID: componentID})
+	}
+	err := store.UpdateFlow(state.FlowRecord{
+		ID:                    flow.ID,
+		SpecificationPath:     flow.SpecificationPath,
+		SpecificationChecksum: flow.SpecificationChecksum,
+		SpecificationSnapshot: flow.SpecificationSnapshot,
+	}, flowComponents)
+	if err == state.ErrNotFound {
+		return ErrFlowNotFound
 	}
+	return err
+}
 
-	err = tx.Commit()
-	if err != nil {
-		return err
+// SelectFlowComponents returns the IDs of the components used by the steps of the flow with the
+// given ID (as recorded when it was registered), keyed by step
+func SelectFlowComponents(store state.Store, flowID string) (map[string]string, error) {
+	records, err := store.SelectFlowComponents(flowID)
+	steps := map[string]string{}
+	for _, record := range records {
+		steps[record.Step] = record.ComponentID
 	}
+	return steps, err
+}
 
-	return nil
+// flowFromRecord converts the given state.FlowRecord into flow metadata
+func flowFromRecord(record state.FlowRecord) FlowMetadata {
+	return FlowMetadata{
+		ID:                    record.ID,
+		SpecificationPath:     record.SpecificationPath,
+		CreatedAt:             record.CreatedAt,
+		CreatedBy:             record.CreatedBy,
+		SpecificationChecksum: record.SpecificationChecksum,
+		SpecificationSnapshot: record.SpecificationSnapshot,
+	}
 }
 
 // SelectFlowByID gets flow metadata from the given state database using the given ID.
 // If no flow with the given ID is found, returns ErrFlowNotFound in the error position.
-func SelectFlowByID(db *sql.DB, id string) (FlowMetadata, error) {
-	var rowID, specificationPath string
-	var createdAt int64
-	row := db.QueryRow(selectFlowByID, id)
-	err := row.Scan(&rowID, &specificationPath, &createdAt)
-	if err == sql.ErrNoRows {
+func SelectFlowByID(store state.Store, id string) (FlowMetadata, error) {
+	record, err := store.SelectFlow(id)
+	if err == state.ErrNotFound {
 		return FlowMetadata{}, ErrFlowNotFound
 	}
 	if err != nil {
 		return FlowMetadata{}, err
 	}
-	if rowID != id {
-		return FlowMetadata{}, fmt.Errorf("Result had unexpected row ID: expected=%s, actual=%s", id, rowID)
+	return flowFromRecord(record), nil
+}
+
+// ListFlows streams the metadata (including labels) of the flows registered against the given
+// state database one by one into the given flows channel, in lexicographic order of their IDs. If
+// createdBy is non-empty, only the flows registered by that user are listed. If labels is
+// non-empty, only the flows which have all of those labels are listed. This function closes the
+// flows channel when it is finished. If the given context is cancelled, it stops listing and
+// returns the context's error, so consumers may stop reading early.
+func ListFlows(ctx context.Context, store state.Store, flows chan<- FlowMetadata, createdBy string, labels map[string]string) error {
+	defer close(flows)
+
+	// The labels of each flow are looked up only once all the flows have been read, as the state
+	// database may only allow a single connection at a time
+	records, err := store.SelectFlows(createdBy)
+	if err != nil {
+		return err
+	}
+
+	for _, record := range records {
+		flow := flowFromRecord(record)
+		flow.Labels, err = components.Labels(store, components.LabelledFlow, flow.ID)
+		if err != nil {
+			return err
+		}
+		if !components.MatchesLabels(flow.Labels, labels) {
+			continue
+		}
+		select {
+		case flows <- flow:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// InsertFlowRun creates a new row in the flow_runs table with the given flow run information.
+func InsertFlowRun(store state.Store, run FlowRunMetadata) error {
+	return store.InsertFlowRun(state.FlowRunRecord(run))
+}
+
+// SelectFlowRunByID gets flow run metadata from the given state database using the given ID.
+// If no flow run with the given ID is found, returns ErrFlowRunNotFound in the error position.
+func SelectFlowRunByID(store state.Store, id string) (FlowRunMetadata, error) {
+	record, err := store.SelectFlowRun(id)
+	if err == state.ErrNotFound {
+		return FlowRunMetadata{}, ErrFlowRunNotFound
+	}
+	return FlowRunMetadata(record), err
+}
+
+// flowRunsFromRecords converts the given state.FlowRunRecords into flow run metadata
+func flowRunsFromRecords(records []state.FlowRunRecord) []FlowRunMetadata {
+	runs := make([]FlowRunMetadata, len(records))
+	for i, record := range records {
+		runs[i] = FlowRunMetadata(record)
+	}
+	return runs
+}
+
+// SelectFlowRunsByFlowID returns (at most limit of) the most recent runs of the flow with the given
+// ID, most recent first
+func SelectFlowRunsByFlowID(store state.Store, flowID string, limit int) ([]FlowRunMetadata, error) {
+	records, err := store.SelectFlowRunsByFlow(flowID, limit)
+	return flowRunsFromRecords(records), err
+}
+
+// UpdateFlowRunStatus stores the status and finish time of the given flow run against the
+// corresponding row in the given state database
+func UpdateFlowRunStatus(store state.Store, run FlowRunMetadata) error {
+	err := store.UpdateFlowRunStatus(state.FlowRunRecord(run))
+	if err == state.ErrNotFound {
+		return ErrFlowRunNotFound
 	}
-	return FlowMetadata{ID: rowID, SpecificationPath: specificationPath, CreatedAt: time.Unix(createdAt, 0)}, nil
+	return err
 }
@@ -1,6 +1,7 @@
 package flows
 
 import (
+	"context"
 	"database/sql"
 	"fmt"
 	"io/ioutil"
@@ -47,6 +48,7 @@ func TestInsertFlow(t *testing.T) {
 				ID:                "rofl",
 				SpecificationPath: "/tmp/flows/rofl/flow.json",
 				CreatedAt:         time.Now(),
+				CreatedBy:         "alice",
 			},
 			shouldThrowError: false,
 			inSelection:      true,
@@ -68,9 +70,10 @@ func TestInsertFlow(t *testing.T) {
 		t.Fatal("Error opening state database file")
 	}
 	defer db.Close()
+	store := state.NewSQLiteStore(db)
 
 	for i, test := range tests {
-		err = InsertFlow(db, test.metadata)
+		err = InsertFlow(store, test.metadata)
 		if test.shouldThrowError && err == nil {
 			t.Errorf("[Test %d] Expected error but did not receive one", i)
 		} else if !test.shouldThrowError && err != nil {
@@ -78,7 +81,7 @@ func TestInsertFlow(t *testing.T) {
 		}
 	}
 
-	flowSelection := "SELECT * FROM flows;"
+	flowSelection := "SELECT id, specification_path, created_at, IFNULL(created_by, '') FROM flows;"
 	rows, err := db.Query(flowSelection)
 	defer rows.Close()
 	if err != nil {
@@ -91,9 +94,9 @@ func TestInsertFlow(t *testing.T) {
 				t.Fatalf("[Test %d] Expected result in result set, but found none", i)
 			}
 
-			var id, specificationPath string
+			var id, specificationPath, createdBy string
 			var createdAt int64
-			err = rows.Scan(&id, &specificationPath, &createdAt)
+			err = rows.Scan(&id, &specificationPath, &createdAt, &createdBy)
 			if err != nil {
 				t.Errorf("[Test %d] Error scanning row: %s", i, err.Error())
 			}
@@ -107,6 +110,9 @@ func TestInsertFlow(t *testing.T) {
 			if createdAt != test.metadata.CreatedAt.Unix() {
 				t.Errorf("[Test %d] Unexpected flow CreatedAt: expected=%d, actual=%d", i, test.metadata.CreatedAt.Unix(), createdAt)
 			}
+			if createdBy != test.metadata.CreatedBy {
+				t.Errorf("[Test %d] Unexpected flow CreatedBy: expected=%s, actual=%s", i, test.metadata.CreatedBy, createdBy)
+			}
 		}
 	}
 
@@ -136,6 +142,7 @@ func TestSelectFlowByID(t *testing.T) {
 		t.Fatal("Error opening state database file")
 	}
 	defer db.Close()
+	store := state.NewSQLiteStore(db)
 
 	var i int
 	flows := make([]FlowMetadata, 10)
@@ -144,15 +151,18 @@ func TestSelectFlowByID(t *testing.T) {
 		if err != nil {
 			t.Fatalf("[Flow %d] Error creating flow metadata: %s", i, err.Error())
 		}
+		if i == 3 {
+			flow.CreatedBy = "someone-else"
+		}
 		flows[i] = flow
-		err = InsertFlow(db, flow)
+		err = InsertFlow(store, flow)
 		if err != nil {
 			t.Fatalf("[Flow %d] Error inserting flow into state database: %s", i, err.Error())
 		}
 	}
 
 	for i = 0; i < 10; i++ {
-		stateFlow, err := SelectFlowByID(db, flows[i].ID)
+		stateFlow, err := SelectFlowByID(store, flows[i].ID)
 		if err != nil {
 			t.Errorf("[Test %d] Received error when trying to get inserted flow: %s", i, err.Error())
 		}
@@ -166,9 +176,12 @@ func TestSelectFlowByID(t *testing.T) {
 		if stateFlow.CreatedAt != expectedCreatedAt {
 			t.Errorf("[Test %d] Unexpected CreatedAt retrieved from state database: expected=%s, actual=%s", i, expectedCreatedAt, stateFlow.CreatedAt)
 		}
+		if stateFlow.CreatedBy != flows[i].CreatedBy {
+			t.Errorf("[Test %d] Unexpected CreatedBy retrieved from state database: expected=%s, actual=%s", i, flows[i].CreatedBy, stateFlow.CreatedBy)
+		}
 	}
 
-	stateFlow, err := SelectFlowByID(db, "nonexistent-id")
+	stateFlow, err := SelectFlowByID(store, "nonexistent-id")
 	if err != ErrFlowNotFound {
 		t.Error("[Test 11] Was expecting error ErrFlowNotFound for GetFlowByID on unregistered ID, but did not get it")
 	}
@@ -181,4 +194,180 @@ func TestSelectFlowByID(t *testing.T) {
 	if !stateFlow.CreatedAt.IsZero() {
 		t.Errorf("[Test 11] GetFlowByID on unregistered ID returned non-zero CreatedAt: %v", stateFlow.CreatedAt)
 	}
+
+	ownedFlows, err := collectFlows(store, "someone-else", nil)
+	if err != nil {
+		t.Fatalf("Error listing flows by creator: %s", err.Error())
+	}
+	if len(ownedFlows) != 1 || ownedFlows[0].ID != flows[3].ID {
+		t.Errorf("Unexpected flows created by someone-else: %v", ownedFlows)
+	}
+
+	listedFlows, err := collectFlows(store, "", nil)
+	if err != nil {
+		t.Fatalf("Error listing flows: %s", err.Error())
+	}
+	if len(listedFlows) != len(flows) {
+		t.Fatalf("Unexpected number of listed flows: expected=%d, actual=%d", len(flows), len(listedFlows))
+	}
+	for i, flow := range listedFlows {
+		if flow.ID != flows[i].ID || flow.SpecificationPath != flows[i].SpecificationPath {
+			t.Errorf("[Test %d] Unexpected listed flow: %v", i, flow)
+		}
+	}
+}
+
+// TestFlowRunState tests that flow runs can be inserted into a state database, retrieved by ID, and
+// have their statuses updated
+func TestFlowRunState(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-flow-run-state-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Error creating state directory: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	_, err = GenerateFlowRunMetadata("")
+	if err != ErrEmptyID {
+		t.Errorf("Expected ErrEmptyID when generating flow run metadata without flow ID, got: %v", err)
+	}
+
+	run, err := GenerateFlowRunMetadata("flow")
+	if err != nil {
+		t.Fatalf("Error generating flow run metadata: %s", err.Error())
+	}
+	if run.Status != RunStatusRunning {
+		t.Errorf("Unexpected status for fresh flow run: expected=%s, actual=%s", RunStatusRunning, run.Status)
+	}
+
+	err = InsertFlowRun(store, run)
+	if err != nil {
+		t.Fatalf("Error inserting flow run: %s", err.Error())
+	}
+
+	stateRun, err := SelectFlowRunByID(store, run.ID)
+	if err != nil {
+		t.Fatalf("Error selecting flow run: %s", err.Error())
+	}
+	if stateRun.FlowID != run.FlowID || stateRun.Status != RunStatusRunning || stateRun.FinishedAt != nil {
+		t.Errorf("Unexpected flow run retrieved from state database: %v", stateRun)
+	}
+
+	finishedAt := time.Unix(time.Now().Unix(), 0)
+	stateRun.Status = RunStatusFailed
+	stateRun.FinishedAt = &finishedAt
+	err = UpdateFlowRunStatus(store, stateRun)
+	if err != nil {
+		t.Fatalf("Error updating flow run status: %s", err.Error())
+	}
+
+	stateRun, err = SelectFlowRunByID(store, run.ID)
+	if err != nil {
+		t.Fatalf("Error selecting flow run: %s", err.Error())
+	}
+	if stateRun.Status != RunStatusFailed {
+		t.Errorf("Unexpected flow run status: expected=%s, actual=%s", RunStatusFailed, stateRun.Status)
+	}
+	if stateRun.FinishedAt == nil || !stateRun.FinishedAt.Equal(finishedAt) {
+		t.Errorf("Unexpected flow run FinishedAt: expected=%v, actual=%v", finishedAt, stateRun.FinishedAt)
+	}
+
+	_, err = SelectFlowRunByID(store, "nonexistent-run")
+	if err != ErrFlowRunNotFound {
+		t.Errorf("Expected ErrFlowRunNotFound for nonexistent flow run, got: %v", err)
+	}
+	err = UpdateFlowRunStatus(store, FlowRunMetadata{ID: "nonexistent-run", Status: RunStatusSucceeded})
+	if err != ErrFlowRunNotFound {
+		t.Errorf("Expected ErrFlowRunNotFound when updating nonexistent flow run, got: %v", err)
+	}
+
+	laterRun, err := GenerateFlowRunMetadata("flow")
+	if err != nil {
+		t.Fatalf("Error generating flow run metadata: %s", err.Error())
+	}
+	laterRun.CreatedAt = run.CreatedAt.Add(time.Minute)
+	err = InsertFlowRun(store, laterRun)
+	if err != nil {
+		t.Fatalf("Error inserting flow run: %s", err.Error())
+	}
+	runs, err := SelectFlowRunsByFlowID(store, "flow", 10)
+	if err != nil {
+		t.Fatalf("Error selecting flow runs: %s", err.Error())
+	}
+	if len(runs) != 2 || runs[0].ID != laterRun.ID || runs[1].ID != run.ID || runs[1].FinishedAt == nil {
+		t.Errorf("Unexpected flow runs: %v", runs)
+	}
+	runs, err = SelectFlowRunsByFlowID(store, "flow", 1)
+	if err != nil || len(runs) != 1 {
+		t.Errorf("Expected a single flow run with limit 1, got: %v (%v)", runs, err)
+	}
+}
+
+// collectFlows lists the flows matching the given filters using ListFlows and returns them
+func collectFlows(store state.Store, createdBy string, labels map[string]string) ([]FlowMetadata, error) {
+	flowsChan := make(chan FlowMetadata)
+	errChan := make(chan error, 1)
+	go func() { errChan <- ListFlows(context.Background(), store, flowsChan, createdBy, labels) }()
+	listedFlows := []FlowMetadata{}
+	for flow := range flowsChan {
+		listedFlows = append(listedFlows, flow)
+	}
+	return listedFlows, <-errChan
+}
+
+// TestListFlowsCancellation tests that ListFlows stops listing when its context is cancelled
+func TestListFlowsCancellation(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-list-flows-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+
+	db, err := sql.Open("sqlite3", path.Join(stateDir, state.DBFileName))
+	if err != nil {
+		t.Fatalf("Error opening state database: %s", err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	for i := 0; i < 3; i++ {
+		err = InsertFlow(store, FlowMetadata{ID: fmt.Sprintf("flow-%d", i), SpecificationPath: "flow.json", CreatedAt: time.Now()})
+		if err != nil {
+			t.Fatalf("Error inserting flow: %s", err.Error())
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	flowsChan := make(chan FlowMetadata)
+	errChan := make(chan error, 1)
+	go func() { errChan <- ListFlows(ctx, store, flowsChan, "", nil) }()
+	first := <-flowsChan
+	if first.ID != "flow-0" {
+		t.Errorf("Unexpected first flow: %s", first.ID)
+	}
+	cancel()
+	if err := <-errChan; err != context.Canceled {
+		t.Errorf("Expected cancelled listing to return context.Canceled, got: %v", err)
+	}
+	if _, open := <-flowsChan; open {
+		t.Error("Expected flows channel to be closed after cancellation")
+	}
 }
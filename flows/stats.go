@@ -0,0 +1,132 @@
+package flows
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"text/tabwriter"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// DefaultStatisticsWindow is the number of most recent successful executions of each step which
+// are used to calculate duration statistics
+var DefaultStatisticsWindow = 10
+
+// DurationStatistics - rolling statistics about the durations of successful executions of a step
+// in a flow
+type DurationStatistics struct {
+	Step        string  `json:"step"`
+	Samples     int     `json:"samples"`
+	MeanSeconds float64 `json:"mean_seconds"`
+	MinSeconds  float64 `json:"min_seconds"`
+	MaxSeconds  float64 `json:"max_seconds"`
+	LastSeconds float64 `json:"last_seconds"`
+}
+
+// StepDurationStatistics calculates duration statistics for each step of the flow with the given
+// flowID using (at most) the window most recent successful executions of that step. Steps which
+// have never executed successfully do not appear in the returned map.
+func StepDurationStatistics(store state.Store, flowID string, window int) (map[string]DurationStatistics, error) {
+	executions, err := components.SelectSuccessfulExecutionsByFlowID(store, flowID)
+	if err != nil {
+		return map[string]DurationStatistics{}, fmt.Errorf("Error retrieving executions for flow (%s): %w", flowID, err)
+	}
+
+	statistics := map[string]DurationStatistics{}
+	totals := map[string]float64{}
+	// executions are ordered from most recent to least recent
+	for _, execution := range executions {
+		if execution.Step == "" || execution.FinishedAt == nil {
+			continue
+		}
+		stepStatistics := statistics[execution.Step]
+		if window > 0 && stepStatistics.Samples >= window {
+			continue
+		}
+
+		duration := execution.FinishedAt.Sub(execution.CreatedAt).Seconds()
+		if stepStatistics.Samples == 0 {
+			stepStatistics = DurationStatistics{
+				Step:        execution.Step,
+				MinSeconds:  duration,
+				MaxSeconds:  duration,
+				LastSeconds: duration,
+			}
+		}
+		if duration < stepStatistics.MinSeconds {
+			stepStatistics.MinSeconds = duration
+		}
+		if duration > stepStatistics.MaxSeconds {
+			stepStatistics.MaxSeconds = duration
+		}
+		stepStatistics.Samples++
+		totals[execution.Step] += duration
+		stepStatistics.MeanSeconds = totals[execution.Step] / float64(stepStatistics.Samples)
+		statistics[execution.Step] = stepStatistics
+	}
+
+	return statistics, nil
+}
+
+// EstimateRemaining estimates how much longer a flow run will take given historical duration
+// statistics for its steps, its stages, the index of the stage currently being executed, and how
+// long that stage has been executing for. Each stage is expected to take as long as its slowest
+// step. The second return value is false if there are steps in the current or subsequent stages
+// for which there are no statistics (in which case the estimate is a lower bound).
+func EstimateRemaining(statistics map[string]DurationStatistics, stages [][]string, currentStage int, elapsedInStage time.Duration) (time.Duration, bool) {
+	complete := true
+	var remaining float64
+	for i := currentStage; i < len(stages); i++ {
+		var stageSeconds float64
+		for _, step := range stages[i] {
+			stepStatistics, ok := statistics[step]
+			if !ok {
+				complete = false
+				continue
+			}
+			if stepStatistics.MeanSeconds > stageSeconds {
+				stageSeconds = stepStatistics.MeanSeconds
+			}
+		}
+		if i == currentStage {
+			stageSeconds -= elapsedInStage.Seconds()
+			if stageSeconds < 0 {
+				stageSeconds = 0
+			}
+		}
+		remaining += stageSeconds
+	}
+
+	return time.Duration(remaining * float64(time.Second)), complete
+}
+
+// WriteDurationStatisticsTable writes the given duration statistics to the given writer as a
+// human-readable table, ordered by step name
+func WriteDurationStatisticsTable(w io.Writer, statistics map[string]DurationStatistics) error {
+	steps := make([]string, 0, len(statistics))
+	for step := range statistics {
+		steps = append(steps, step)
+	}
+	sort.Strings(steps)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "STEP\tSAMPLES\tMEAN\tMIN\tMAX\tLAST")
+	for _, step := range steps {
+		stepStatistics := statistics[step]
+		fmt.Fprintf(
+			tw,
+			"%s\t%d\t%.1fs\t%.1fs\t%.1fs\t%.1fs\n",
+			step,
+			stepStatistics.Samples,
+			stepStatistics.MeanSeconds,
+			stepStatistics.MinSeconds,
+			stepStatistics.MaxSeconds,
+			stepStatistics.LastSeconds,
+		)
+	}
+
+	return tw.Flush()
+}
@@ -0,0 +1,175 @@
+package flows
+
+import (
+	"database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// TestStepDurationStatistics records several finished executions of the steps of a flow in a
+// temporary state database and checks the rolling statistics calculated from them
+func TestStepDurationStatistics(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-step-statistics-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Error creating state directory: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	start := time.Unix(time.Now().Unix()-1000, 0)
+
+	type execution struct {
+		step     string
+		flowID   string
+		offset   int
+		duration int
+		exitCode int
+	}
+	executions := []execution{
+		{step: "first", flowID: "flow", offset: 0, duration: 10, exitCode: 0},
+		{step: "first", flowID: "flow", offset: 100, duration: 20, exitCode: 0},
+		{step: "first", flowID: "flow", offset: 200, duration: 60, exitCode: 0},
+		{step: "first", flowID: "flow", offset: 300, duration: 500, exitCode: 1},
+		{step: "second", flowID: "flow", offset: 150, duration: 5, exitCode: 0},
+		{step: "first", flowID: "other-flow", offset: 400, duration: 500, exitCode: 0},
+	}
+	for i, e := range executions {
+		executionMetadata := components.ExecutionMetadata{
+			ID:          fmt.Sprintf("execution-%d", i),
+			BuildID:     "build",
+			ComponentID: "component",
+			CreatedAt:   start.Add(time.Duration(e.offset) * time.Second),
+			FlowID:      e.flowID,
+			FlowRunID:   fmt.Sprintf("run-%d", i),
+			Step:        e.step,
+		}
+		err = components.InsertExecution(store, executionMetadata)
+		if err != nil {
+			t.Fatalf("[Execution %d] Error inserting execution: %s", i, err.Error())
+		}
+		exitCode := e.exitCode
+		finishedAt := executionMetadata.CreatedAt.Add(time.Duration(e.duration) * time.Second)
+		executionMetadata.ExitCode = &exitCode
+		executionMetadata.FinishedAt = &finishedAt
+		err = components.UpdateExecutionResult(store, executionMetadata)
+		if err != nil {
+			t.Fatalf("[Execution %d] Error updating execution result: %s", i, err.Error())
+		}
+	}
+
+	type statisticsTest struct {
+		window   int
+		expected map[string]DurationStatistics
+	}
+
+	tests := []statisticsTest{
+		{
+			window: 10,
+			expected: map[string]DurationStatistics{
+				"first":  {Step: "first", Samples: 3, MeanSeconds: 30, MinSeconds: 10, MaxSeconds: 60, LastSeconds: 60},
+				"second": {Step: "second", Samples: 1, MeanSeconds: 5, MinSeconds: 5, MaxSeconds: 5, LastSeconds: 5},
+			},
+		},
+		{
+			window: 2,
+			expected: map[string]DurationStatistics{
+				"first":  {Step: "first", Samples: 2, MeanSeconds: 40, MinSeconds: 20, MaxSeconds: 60, LastSeconds: 60},
+				"second": {Step: "second", Samples: 1, MeanSeconds: 5, MinSeconds: 5, MaxSeconds: 5, LastSeconds: 5},
+			},
+		},
+	}
+
+	for i, test := range tests {
+		statistics, err := StepDurationStatistics(store, "flow", test.window)
+		if err != nil {
+			t.Fatalf("[Test %d] Error calculating statistics: %s", i, err.Error())
+		}
+		if len(statistics) != len(test.expected) {
+			t.Fatalf("[Test %d] Unexpected number of steps in statistics: expected %d, actual %d", i, len(test.expected), len(statistics))
+		}
+		for step, expected := range test.expected {
+			if statistics[step] != expected {
+				t.Errorf("[Test %d] Unexpected statistics for step %s: expected %v, actual %v", i, step, expected, statistics[step])
+			}
+		}
+	}
+}
+
+// TestEstimateRemaining checks that the remaining time in a flow run is estimated from the slowest
+// step in each remaining stage
+func TestEstimateRemaining(t *testing.T) {
+	statistics := map[string]DurationStatistics{
+		"a": {Step: "a", Samples: 1, MeanSeconds: 10},
+		"b": {Step: "b", Samples: 1, MeanSeconds: 30},
+		"c": {Step: "c", Samples: 1, MeanSeconds: 20},
+	}
+
+	type estimateTest struct {
+		stages           [][]string
+		currentStage     int
+		elapsedInStage   time.Duration
+		expected         time.Duration
+		expectedComplete bool
+	}
+
+	tests := []estimateTest{
+		{
+			stages:           [][]string{{"a", "b"}, {"c"}},
+			currentStage:     0,
+			elapsedInStage:   0,
+			expected:         50 * time.Second,
+			expectedComplete: true,
+		},
+		{
+			stages:           [][]string{{"a", "b"}, {"c"}},
+			currentStage:     0,
+			elapsedInStage:   10 * time.Second,
+			expected:         40 * time.Second,
+			expectedComplete: true,
+		},
+		{
+			stages:           [][]string{{"a", "b"}, {"c"}},
+			currentStage:     1,
+			elapsedInStage:   45 * time.Second,
+			expected:         0,
+			expectedComplete: true,
+		},
+		{
+			stages:           [][]string{{"a"}, {"c", "unknown"}},
+			currentStage:     0,
+			elapsedInStage:   0,
+			expected:         30 * time.Second,
+			expectedComplete: false,
+		},
+	}
+
+	for i, test := range tests {
+		remaining, complete := EstimateRemaining(statistics, test.stages, test.currentStage, test.elapsedInStage)
+		if remaining != test.expected {
+			t.Errorf("[Test %d] Unexpected estimate: expected %s, actual %s", i, test.expected, remaining)
+		}
+		if complete != test.expectedComplete {
+			t.Errorf("[Test %d] Unexpected completeness: expected %t, actual %t", i, test.expectedComplete, complete)
+		}
+	}
+}
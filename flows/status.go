@@ -0,0 +1,119 @@
+package flows
+
+import (
+	"sort"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// StepStatusPending is the status of a step which has not started in a flow run
+var StepStatusPending = "pending"
+
+// StepStatusRunning is the status of a step whose execution has not finished
+var StepStatusRunning = "running"
+
+// StepStatusAwaitingApproval is the status of a gate step which is waiting for a decision
+var StepStatusAwaitingApproval = "awaiting_approval"
+
+// StepStatusSucceeded is the status of a step whose execution exited with code 0
+var StepStatusSucceeded = "succeeded"
+
+// StepStatusFailed is the status of a step whose execution exited with a non-zero code
+var StepStatusFailed = "failed"
+
+// StepStatus - the state of a single step in a flow run
+type StepStatus struct {
+	Step        string `json:"step"`
+	ComponentID string `json:"component_id"`
+	// ExecutionID is the ID of the most recent execution of the step in the run (empty if the step
+	// has not started)
+	ExecutionID string `json:"execution_id,omitempty"`
+	Status      string `json:"status"`
+	ExitCode    *int   `json:"exit_code"`
+}
+
+// RunStepStatuses returns the status of each step in the given flow run, in execution order (see
+// StepStatuses). If the flow's specification can no longer be read, only the steps which have been
+// executed are returned. Gate steps which are waiting for a decision are reported as awaiting
+// approval rather than running.
+func RunStepStatuses(store state.Store, run FlowRunMetadata) ([]StepStatus, error) {
+	executions, err := components.SelectExecutionsByFlowRunID(store, run.ID)
+	if err != nil {
+		return []StepStatus{}, err
+	}
+	specification, err := ReadFlowSpecification(store, run.FlowID)
+	if err != nil {
+		specification = FlowSpecification{}
+	}
+	statuses := StepStatuses(specification, executions)
+
+	approvals, err := ListApprovals(store, run.ID, ApprovalStatusPending)
+	if err != nil {
+		return statuses, err
+	}
+	pending := map[string]bool{}
+	for _, approval := range approvals {
+		pending[approval.ExecutionID] = true
+	}
+	for i, status := range statuses {
+		if status.Status == StepStatusRunning && pending[status.ExecutionID] {
+			statuses[i].Status = StepStatusAwaitingApproval
+		}
+	}
+	return statuses, nil
+}
+
+// StepStatuses combines the steps of the given (materialized) flow specification with the given
+// executions from a run of the flow. Steps are returned stage by stage (and in lexicographic order
+// within each stage), followed by any steps which have executions but are not in the
+// specification. If a step was executed more than once (e.g. because it was retried), its status
+// reflects its most recent execution.
+func StepStatuses(specification FlowSpecification, executions []components.ExecutionMetadata) []StepStatus {
+	latestExecutions := map[string]components.ExecutionMetadata{}
+	for _, execution := range executions {
+		latestExecution, ok := latestExecutions[execution.Step]
+		if !ok || !execution.CreatedAt.Before(latestExecution.CreatedAt) {
+			latestExecutions[execution.Step] = execution
+		}
+	}
+
+	steps := []string{}
+	seen := map[string]bool{}
+	for _, stage := range specification.Stages {
+		stageSteps := append([]string{}, stage...)
+		sort.Strings(stageSteps)
+		for _, step := range stageSteps {
+			steps = append(steps, step)
+			seen[step] = true
+		}
+	}
+	extraSteps := []string{}
+	for step := range latestExecutions {
+		if !seen[step] {
+			extraSteps = append(extraSteps, step)
+		}
+	}
+	sort.Strings(extraSteps)
+	steps = append(steps, extraSteps...)
+
+	statuses := make([]StepStatus, len(steps))
+	for i, step := range steps {
+		status := StepStatus{Step: step, ComponentID: specification.Steps[step], Status: StepStatusPending}
+		if execution, ok := latestExecutions[step]; ok {
+			status.ExecutionID = execution.ID
+			status.ComponentID = execution.ComponentID
+			status.ExitCode = execution.ExitCode
+			switch {
+			case execution.ExitCode == nil:
+				status.Status = StepStatusRunning
+			case *execution.ExitCode == 0:
+				status.Status = StepStatusSucceeded
+			default:
+				status.Status = StepStatusFailed
+			}
+		}
+		statuses[i] = status
+	}
+	return statuses
+}
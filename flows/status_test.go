@@ -0,0 +1,38 @@
+package flows
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+func TestStepStatuses(t *testing.T) {
+	zero := 0
+	one := 1
+	now := time.Now()
+	specification := FlowSpecification{
+		Steps:  map[string]string{"a": "component-a", "b": "component-b", "c": "component-c", "d": "component-d"},
+		Stages: [][]string{{"b", "a"}, {"c"}, {"d"}},
+	}
+	executions := []components.ExecutionMetadata{
+		{ID: "a-1", ComponentID: "component-a", Step: "a", CreatedAt: now, ExitCode: &zero},
+		{ID: "b-1", ComponentID: "component-b", Step: "b", CreatedAt: now, ExitCode: &one},
+		{ID: "b-2", ComponentID: "component-b", Step: "b", CreatedAt: now.Add(time.Second), ExitCode: &zero},
+		{ID: "c-1", ComponentID: "component-c", Step: "c", CreatedAt: now.Add(2 * time.Second)},
+		{ID: "x-1", ComponentID: "component-x", Step: "x", CreatedAt: now, ExitCode: &one},
+	}
+
+	expected := []StepStatus{
+		{Step: "a", ComponentID: "component-a", ExecutionID: "a-1", Status: StepStatusSucceeded, ExitCode: &zero},
+		{Step: "b", ComponentID: "component-b", ExecutionID: "b-2", Status: StepStatusSucceeded, ExitCode: &zero},
+		{Step: "c", ComponentID: "component-c", ExecutionID: "c-1", Status: StepStatusRunning},
+		{Step: "d", ComponentID: "component-d", Status: StepStatusPending},
+		{Step: "x", ComponentID: "component-x", ExecutionID: "x-1", Status: StepStatusFailed, ExitCode: &one},
+	}
+	statuses := StepStatuses(specification, executions)
+	if !reflect.DeepEqual(statuses, expected) {
+		t.Errorf("Unexpected step statuses: expected %v, got %v", expected, statuses)
+	}
+}
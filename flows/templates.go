@@ -0,0 +1,90 @@
+package flows
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+// SpecialPrefixTemplate denotes that the value of a step in a flow specification refers to the step
+// template whose name is its suffix, rather than to a component
+var SpecialPrefixTemplate = "template:"
+
+// StepTemplate - a reusable step definition which steps in a flow specification can refer to (as
+// "template:<name>") instead of to a component
+type StepTemplate struct {
+	// Component is the ID of the component that steps using the template run
+	Component string `json:"component"`
+	// Mounts are mount configurations for the component. A step's own mounts are added to these,
+	// replacing any template mount with the same target.
+	Mounts []components.MountConfiguration `json:"mounts,omitempty"`
+	// Env maps environment variable names to values. A step's own env is merged over this.
+	Env map[string]string `json:"env,omitempty"`
+}
+
+// ResolveStepTemplates replaces the references to step templates in the steps of the given flow
+// specification with the components of those templates, and merges the mounts and env of each
+// template with the overrides specified for the steps that use it. The returned specification has
+// no step templates.
+func ResolveStepTemplates(rawSpecification FlowSpecification) (FlowSpecification, error) {
+	resolvedSpecification := rawSpecification
+	resolvedSpecification.StepTemplates = nil
+	resolvedSpecification.Steps = map[string]string{}
+	resolvedSpecification.Mounts = map[string][]components.MountConfiguration{}
+	for step, mounts := range rawSpecification.Mounts {
+		resolvedSpecification.Mounts[step] = mounts
+	}
+	resolvedSpecification.Env = map[string]map[string]string{}
+	for step, env := range rawSpecification.Env {
+		resolvedSpecification.Env[step] = env
+	}
+
+	for name, template := range rawSpecification.StepTemplates {
+		if template.Component == "" || strings.HasPrefix(template.Component, SpecialPrefixTemplate) {
+			return rawSpecification, fmt.Errorf("Invalid component for step template %s", name)
+		}
+	}
+
+	for step, component := range rawSpecification.Steps {
+		if !strings.HasPrefix(component, SpecialPrefixTemplate) {
+			resolvedSpecification.Steps[step] = component
+			continue
+		}
+		templateName := strings.TrimPrefix(component, SpecialPrefixTemplate)
+		template, ok := rawSpecification.StepTemplates[templateName]
+		if !ok {
+			return rawSpecification, fmt.Errorf("Unknown step template (%s) for step (%s)", templateName, step)
+		}
+		resolvedSpecification.Steps[step] = template.Component
+
+		stepMounts := rawSpecification.Mounts[step]
+		overriddenTargets := map[string]bool{}
+		for _, mount := range stepMounts {
+			overriddenTargets[mount.Target] = true
+		}
+		mounts := []components.MountConfiguration{}
+		for _, mount := range template.Mounts {
+			if !overriddenTargets[mount.Target] {
+				mounts = append(mounts, mount)
+			}
+		}
+		mounts = append(mounts, stepMounts...)
+		if len(mounts) > 0 {
+			resolvedSpecification.Mounts[step] = mounts
+		}
+
+		env := map[string]string{}
+		for key, value := range template.Env {
+			env[key] = value
+		}
+		for key, value := range rawSpecification.Env[step] {
+			env[key] = value
+		}
+		if len(env) > 0 {
+			resolvedSpecification.Env[step] = env
+		}
+	}
+
+	return resolvedSpecification, nil
+}
@@ -0,0 +1,75 @@
+package flows
+
+import (
+	"testing"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+func TestResolveStepTemplates(t *testing.T) {
+	rawSpecification := FlowSpecification{
+		StepTemplates: map[string]StepTemplate{
+			"loader": {
+				Component: "loader-component",
+				Mounts: []components.MountConfiguration{
+					{Source: "/tmp/config.json", Target: "/shnorky/config.json", Method: "bind"},
+					{Source: "/tmp/data", Target: "/shnorky/data", Method: "bind"},
+				},
+				Env: map[string]string{"TABLE": "events", "BATCH_SIZE": "100"},
+			},
+		},
+		Steps: map[string]string{
+			"load-events": "template:loader",
+			"load-users":  "template:loader",
+			"report":      "reporter",
+		},
+		Dependencies: map[string][]string{"report": {"load-events", "load-users"}},
+		Mounts: map[string][]components.MountConfiguration{
+			"load-users": {{Source: "/tmp/users", Target: "/shnorky/data", Method: "bind"}},
+		},
+		Env: map[string]map[string]string{
+			"load-users": {"TABLE": "users"},
+		},
+	}
+
+	specification, err := MaterializeFlowSpecification(rawSpecification)
+	if err != nil {
+		t.Fatalf("Could not materialize specification with step templates: %s", err.Error())
+	}
+	if specification.Steps["load-events"] != "loader-component" || specification.Steps["load-users"] != "loader-component" || specification.Steps["report"] != "reporter" {
+		t.Errorf("Unexpected steps: %v", specification.Steps)
+	}
+	if len(specification.StepTemplates) != 0 {
+		t.Errorf("Expected step templates to be resolved, got: %v", specification.StepTemplates)
+	}
+
+	if len(specification.Mounts["load-events"]) != 2 {
+		t.Errorf("Unexpected mounts for load-events: %v", specification.Mounts["load-events"])
+	}
+	usersMounts := specification.Mounts["load-users"]
+	if len(usersMounts) != 2 || usersMounts[0].Target != "/shnorky/config.json" || usersMounts[1].Source != "/tmp/users" {
+		t.Errorf("Unexpected mounts for load-users: %v", usersMounts)
+	}
+	if _, ok := specification.Mounts["report"]; ok {
+		t.Errorf("Unexpected mounts for report: %v", specification.Mounts["report"])
+	}
+
+	if specification.Env["load-events"]["TABLE"] != "events" || specification.Env["load-users"]["TABLE"] != "users" || specification.Env["load-users"]["BATCH_SIZE"] != "100" {
+		t.Errorf("Unexpected env: %v", specification.Env)
+	}
+	if len(rawSpecification.Env["load-users"]) != 1 || len(rawSpecification.Mounts["load-users"]) != 1 {
+		t.Errorf("Expected raw specification not to be modified")
+	}
+
+	invalidSpecifications := []FlowSpecification{
+		{Steps: map[string]string{"a": "template:missing"}},
+		{StepTemplates: map[string]StepTemplate{"empty": {}}, Steps: map[string]string{"a": "template:empty"}},
+		{StepTemplates: map[string]StepTemplate{"nested": {Component: "template:other"}}, Steps: map[string]string{"a": "template:nested"}},
+	}
+	for i, invalidSpecification := range invalidSpecifications {
+		_, err := MaterializeFlowSpecification(invalidSpecification)
+		if err == nil {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		}
+	}
+}
@@ -0,0 +1,332 @@
+package flows
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	dockerNetwork "github.com/docker/docker/api/types/network"
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// UpNetworkPrefix is the prefix of the names of the docker networks created by Up. Each flow whose
+// services are up gets its own network (named after the flow ID).
+var UpNetworkPrefix = "shnorky-up-"
+
+// ErrFlowNotUp - signifies that the services of a flow are not up (see Up)
+var ErrFlowNotUp = errors.New("The services of the specified flow are not up")
+
+// StandingService - a service step of a flow which was started by Up and keeps running until Down
+type StandingService struct {
+	FlowID      string    `json:"flow_id"`
+	Step        string    `json:"step"`
+	ExecutionID string    `json:"execution_id"`
+	Network     string    `json:"network"`
+	StartedAt   time.Time `json:"started_at"`
+}
+
+// UpNetworkName returns the name of the docker network for the standing services of the flow with
+// the given ID
+func UpNetworkName(flowID string) string {
+	return UpNetworkPrefix + flowID
+}
+
+// SelectStandingServices returns the standing services of the flow with the given ID, in
+// lexicographic order of their steps. It returns an empty slice if the services of the flow are not
+// up.
+func SelectStandingServices(store state.Store, flowID string) ([]StandingService, error) {
+	records, err := store.SelectStandingServices(flowID)
+	services := make([]StandingService, len(records))
+	for i, record := range records {
+		services[i] = StandingService(record)
+	}
+	return services, err
+}
+
+// Up starts every service step of the flow with the given ID (building those whose builds are
+// stale first) on a network of their own, where they are reachable by their step names, and leaves
+// them running. The services are started stage by stage, and Up waits for the services in each
+// stage to become healthy (see WaitForHealthy) before starting the next one. If they do not become
+// healthy within ServiceHealthTimeout, Up gives up.
+// The mounts, env, and workdirs of the steps are taken from the flow specification; mounts with
+// remote sources are not supported. If any service fails to start, the services which were started
+// are torn down again.
+// While the services of a flow are up, runs of the flow use them instead of starting their own
+// service steps (see Execute), so that they keep running across runs.
+// This is the handler for `shn up`
+func Up(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, stateDir, flowID string) ([]StandingService, error) {
+	if outstream == nil {
+		outstream = ioutil.Discard
+	}
+	standing, err := SelectStandingServices(store, flowID)
+	if err != nil {
+		return standing, err
+	}
+	if len(standing) > 0 {
+		return standing, fmt.Errorf("Services of flow (%s) are already up - run `shn down` to stop them", flowID)
+	}
+
+	flow, err := SelectFlowByID(store, flowID)
+	if err != nil {
+		return standing, err
+	}
+	specification, err := ReadRegisteredSpecification(flow)
+	if err != nil {
+		return standing, err
+	}
+	specification, err = ResolveComponentSelectors(store, specification)
+	if err != nil {
+		return standing, err
+	}
+	specification, _, err = RegisterEmbeddedComponents(store, filepath.Join(stateDir, state.EmbeddedDirName), flow, specification)
+	if err != nil {
+		return standing, err
+	}
+	services, err := serviceSteps(store, specification)
+	if err != nil {
+		return standing, err
+	}
+	if len(services) == 0 {
+		return standing, fmt.Errorf("Flow (%s) has no service steps", flowID)
+	}
+	stages, err := CalculateStages(specification)
+	if err != nil {
+		return standing, err
+	}
+
+	buildIDs, err := buildServices(ctx, store, dockerClient, outstream, stateDir, specification, services)
+	if err != nil {
+		return standing, err
+	}
+
+	network := UpNetworkName(flowID)
+	_, err = dockerClient.NetworkCreate(ctx, network, dockerTypes.NetworkCreate{
+		CheckDuplicate: true,
+		Labels:         components.WithDockerLabels(map[string]string{"shnorky.flow_id": flowID, "shnorky.up": "true"}),
+	})
+	if err != nil {
+		return standing, fmt.Errorf("Error creating network (%s) for services of flow (%s): %w", network, flowID, err)
+	}
+
+	// run is only used to render the placeholders in the mounts of the services
+	run, err := GenerateFlowRunMetadata(flowID)
+	if err != nil {
+		return standing, err
+	}
+	for _, stage := range stages {
+		started := []StandingService{}
+		for _, step := range stage {
+			if !services[step] {
+				continue
+			}
+			service, err := startStandingService(ctx, store, dockerClient, run, specification, buildIDs[step], step, network)
+			if err != nil {
+				return standing, tearDown(store, dockerClient, flowID, network, err)
+			}
+			started = append(started, service)
+			fmt.Fprintf(outstream, "Started service (%s) in container (%s)\n", step, service.ExecutionID)
+		}
+		for _, service := range started {
+			err = WaitForHealthy(ctx, dockerClient, service.ExecutionID, ServiceHealthTimeout)
+			if err != nil {
+				return standing, tearDown(store, dockerClient, flowID, network, fmt.Errorf("Service (%s) did not become healthy: %w", service.Step, err))
+			}
+			fmt.Fprintf(outstream, "Service (%s) is up\n", service.Step)
+		}
+		standing = append(standing, started...)
+	}
+	sort.Slice(standing, func(i, j int) bool { return standing[i].Step < standing[j].Step })
+	return standing, nil
+}
+
+// buildServices builds the components of the given service steps whose builds are stale and returns
+// the IDs of the builds to run for each of the steps
+func buildServices(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, stateDir string, specification FlowSpecification, services map[string]bool) (map[string]string, error) {
+	componentIDs := []string{}
+	for step := range services {
+		componentIDs = append(componentIDs, specification.Steps[step])
+	}
+	sort.Strings(componentIDs)
+
+	buildIDs := map[string]string{}
+	built := map[string]string{}
+	for _, componentID := range componentIDs {
+		if _, ok := built[componentID]; ok {
+			continue
+		}
+		stale, err := components.BuildIsStale(store, componentID)
+		if err != nil {
+			return buildIDs, fmt.Errorf("Could not check build of component (%s): %w", componentID, err)
+		}
+		var buildMetadata components.BuildMetadata
+		if stale {
+			buildMetadata, err = components.CreateBuild(ctx, store, dockerClient, outstream, filepath.Join(stateDir, state.BuildLogsDirName), componentID, components.BuildOptions{})
+		} else {
+			buildMetadata, err = components.SelectMostRecentBuildForComponent(store, componentID)
+		}
+		if err != nil {
+			return buildIDs, fmt.Errorf("Error building component (%s): %w", componentID, err)
+		}
+		built[componentID] = buildMetadata.ID
+	}
+	for step := range services {
+		buildIDs[step] = built[specification.Steps[step]]
+	}
+	return buildIDs, nil
+}
+
+// startStandingService starts a container for the given service step on the given network and
+// records it as a standing service
+func startStandingService(
+	ctx context.Context,
+	store state.Store,
+	dockerClient *docker.Client,
+	run FlowRunMetadata,
+	specification FlowSpecification,
+	buildID string,
+	step string,
+	network string,
+) (StandingService, error) {
+	mounts, err := renderMounts(run, step, specification.Mounts[step])
+	if err != nil {
+		return StandingService{}, err
+	}
+	for _, mount := range mounts {
+		if _, ok := components.RemoteSourceScheme(mount.Source); ok {
+			return StandingService{}, fmt.Errorf("Service step (%s) mounts a remote source (%s), which is not supported for standing services", step, mount.Source)
+		}
+	}
+
+	executionMetadata, err := components.ExecuteWithOptions(
+		ctx,
+		store,
+		dockerClient,
+		components.WithBuild(buildID),
+		components.WithFlowRun(run.FlowID, "", step),
+		components.WithMounts(mounts...),
+		components.WithEnv(specification.Env[step]),
+		components.WithWorkdir(specification.Workdirs[step]),
+		components.WithNetwork(network),
+	)
+	if err != nil {
+		return StandingService{}, fmt.Errorf("Error starting service step (%s): %w", step, err)
+	}
+
+	service := StandingService{
+		FlowID:      run.FlowID,
+		Step:        step,
+		ExecutionID: executionMetadata.ID,
+		Network:     network,
+		StartedAt:   executionMetadata.CreatedAt,
+	}
+	err = store.InsertStandingService(state.StandingServiceRecord(service))
+	if err != nil {
+		return service, fmt.Errorf("Error recording standing service (%s): %w", step, err)
+	}
+	return service, nil
+}
+
+// tearDown stops the services of the given flow which Up managed to start before it failed, removes
+// their network, and returns the given error
+func tearDown(store state.Store, dockerClient *docker.Client, flowID, network string, err error) error {
+	_, downErr := Down(context.Background(), store, dockerClient, flowID)
+	if downErr == ErrFlowNotUp {
+		dockerClient.NetworkRemove(context.Background(), network)
+	}
+	return err
+}
+
+// Down stops the standing services of the flow with the given ID, records their results in the
+// state database, and removes their network. It returns the (finished) executions of the services,
+// or ErrFlowNotUp if the services of the flow are not up.
+// This is the handler for `shn down`
+func Down(ctx context.Context, store state.Store, dockerClient *docker.Client, flowID string) ([]components.ExecutionMetadata, error) {
+	executions := []components.ExecutionMetadata{}
+	standing, err := SelectStandingServices(store, flowID)
+	if err != nil {
+		return executions, err
+	}
+	if len(standing) == 0 {
+		return executions, ErrFlowNotUp
+	}
+
+	for _, service := range standing {
+		timeout := ServiceStopTimeout
+		err = dockerClient.ContainerStop(ctx, service.ExecutionID, &timeout)
+		if docker.IsErrNotFound(err) {
+			// The container was removed by other means, and its execution is recorded as failed
+			// when executions are next reconciled with docker
+			execution, err := components.SelectExecutionByID(store, service.ExecutionID)
+			if err != nil {
+				return executions, err
+			}
+			executions = append(executions, execution)
+			continue
+		}
+		if err != nil {
+			return executions, fmt.Errorf("Error stopping container (%s) for service (%s): %w", service.ExecutionID, service.Step, err)
+		}
+		execution, err := components.WaitForExecution(ctx, store, dockerClient, service.ExecutionID)
+		if err != nil {
+			return executions, fmt.Errorf("Error recording result of service (%s): %w", service.Step, err)
+		}
+		executions = append(executions, execution)
+	}
+
+	err = store.DeleteStandingServices(flowID)
+	if err != nil {
+		return executions, err
+	}
+	network := standing[0].Network
+	err = dockerClient.NetworkRemove(ctx, network)
+	if err != nil && !docker.IsErrNotFound(err) {
+		return executions, fmt.Errorf("Error removing network (%s): %w", network, err)
+	}
+	return executions, nil
+}
+
+// attachStandingServices connects the running standing services (see Up) of the flow of the given
+// run which correspond to the given service steps to the network of the run, under their step
+// names, and returns their executions by step. These steps are not started by the run.
+func attachStandingServices(ctx context.Context, store state.Store, dockerClient *docker.Client, run FlowRunMetadata, services map[string]bool) (map[string]components.ExecutionMetadata, error) {
+	attached := map[string]components.ExecutionMetadata{}
+	standing, err := SelectStandingServices(store, run.FlowID)
+	if err != nil {
+		return attached, err
+	}
+	for _, service := range standing {
+		if !services[service.Step] {
+			continue
+		}
+		info, err := dockerClient.ContainerInspect(ctx, service.ExecutionID)
+		if err != nil || info.State == nil || !info.State.Running {
+			continue
+		}
+		execution, err := components.SelectExecutionByID(store, service.ExecutionID)
+		if err != nil {
+			return attached, err
+		}
+		err = dockerClient.NetworkConnect(ctx, RunNetworkName(run.ID), service.ExecutionID, &dockerNetwork.EndpointSettings{Aliases: []string{service.Step}})
+		if err != nil {
+			return attached, fmt.Errorf("Error connecting standing service (%s) to network of flow run (%s): %w", service.Step, run.ID, err)
+		}
+		attached[service.Step] = execution
+	}
+	return attached, nil
+}
+
+// detachStandingServices disconnects the given standing services from the network of the given run
+func detachStandingServices(dockerClient *docker.Client, run FlowRunMetadata, attached map[string]components.ExecutionMetadata) {
+	for _, execution := range attached {
+		dockerClient.NetworkDisconnect(context.Background(), RunNetworkName(run.ID), execution.ID, true)
+	}
+}
@@ -0,0 +1,74 @@
+package flows
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// TestUpAndDownWithoutDocker checks the cases in which Up and Down refuse to do anything before they
+// touch docker
+func TestUpAndDownWithoutDocker(t *testing.T) {
+	stateDir, db, err := state.InitEphemeral()
+	if err != nil {
+		t.Fatalf("Could not initialize ephemeral state: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	specificationPath := path.Join(stateDir, "flow.json")
+	err = ioutil.WriteFile(specificationPath, []byte(`{"steps": {"approve": "builtin:gate"}}`), 0644)
+	if err != nil {
+		t.Fatalf("Could not write flow specification: %s", err.Error())
+	}
+	_, err = AddFlow(store, "tasks", specificationPath)
+	if err != nil {
+		t.Fatalf("Could not add flow: %s", err.Error())
+	}
+
+	ctx := context.Background()
+	_, err = Up(ctx, store, nil, nil, stateDir, "tasks")
+	if err == nil || !strings.Contains(err.Error(), "no service steps") {
+		t.Errorf("Expected error bringing up flow without service steps, got: %v", err)
+	}
+
+	_, err = Down(ctx, store, nil, "tasks")
+	if err != ErrFlowNotUp {
+		t.Errorf("Unexpected error bringing down flow which is not up: expected=%v, actual=%v", ErrFlowNotUp, err)
+	}
+
+	startedAt := time.Unix(1577836800, 0)
+	for _, step := range []string{"db", "api"} {
+		err = store.InsertStandingService(state.StandingServiceRecord{FlowID: "tasks", Step: step, ExecutionID: "execution-" + step, Network: UpNetworkName("tasks"), StartedAt: startedAt})
+		if err != nil {
+			t.Fatalf("Could not insert standing service: %s", err.Error())
+		}
+	}
+	standing, err := SelectStandingServices(store, "tasks")
+	if err != nil {
+		t.Fatalf("Could not select standing services: %s", err.Error())
+	}
+	if len(standing) != 2 || standing[0].Step != "api" || standing[1].Step != "db" {
+		t.Fatalf("Unexpected standing services: %v", standing)
+	}
+	if standing[0].ExecutionID != "execution-api" || standing[0].Network != "shnorky-up-tasks" || !standing[0].StartedAt.Equal(startedAt) {
+		t.Errorf("Unexpected standing service: %v", standing[0])
+	}
+
+	_, err = Up(ctx, store, nil, nil, stateDir, "tasks")
+	if err == nil || !strings.Contains(err.Error(), "already up") {
+		t.Errorf("Expected error bringing up flow whose services are up, got: %v", err)
+	}
+
+	standing, err = SelectStandingServices(store, "other")
+	if err != nil || len(standing) != 0 {
+		t.Errorf("Expected no standing services for other flow: services=%v, error=%v", standing, err)
+	}
+}
@@ -0,0 +1,206 @@
+package flows
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// ValidateComponentID is the ID of the built-in component which validates files against a schema.
+// Steps using this component run on the host (rather than in a container) and are configured by
+// the Validations member of the flow specification.
+var ValidateComponentID = components.BuiltinComponentPrefix + "validate"
+
+// ValidationFormats is a set (of keys) enumerating the formats that validation steps understand
+var ValidationFormats = map[string]bool{
+	DataFormatJSON:      true,
+	DataFormatJSONLines: true,
+	DataFormatCSV:       true,
+}
+
+// ValidationSpecification - configures a built-in validation step
+type ValidationSpecification struct {
+	// Path is the path on the host of the file to validate. If it is a directory, every file
+	// directly inside it is validated. Supports "env:<VARIABLE_NAME>" values and the same
+	// placeholders as mount configurations.
+	Path string `json:"path"`
+	// Format is one of the keys of ValidationFormats. "ndjson" is accepted as an alias for
+	// "jsonlines".
+	Format string `json:"format"`
+	// Schema is the path on the host of a JSON Schema document which json documents (or each line
+	// of jsonlines files) must satisfy. Only the keywords in JSONSchema are checked.
+	Schema string `json:"schema,omitempty"`
+	// Columns lists the columns that the header row of csv files must contain
+	Columns []string `json:"columns,omitempty"`
+}
+
+// MaterializeValidationSpecification validates the given validation specification and resolves
+// the paths in it to absolute paths
+func MaterializeValidationSpecification(rawSpecification ValidationSpecification) (ValidationSpecification, error) {
+	format := rawSpecification.Format
+	if format == "ndjson" {
+		format = DataFormatJSONLines
+	}
+	if !ValidationFormats[format] {
+		return rawSpecification, fmt.Errorf("Unsupported validation format: %s", rawSpecification.Format)
+	}
+	if rawSpecification.Path == "" {
+		return rawSpecification, errors.New("Validation must specify a path")
+	}
+	if rawSpecification.Schema != "" && format == DataFormatCSV {
+		return rawSpecification, errors.New("Schemas are only supported for json and jsonlines validation")
+	}
+	if len(rawSpecification.Columns) > 0 && format != DataFormatCSV {
+		return rawSpecification, errors.New("Columns are only supported for csv validation")
+	}
+
+	materializedSpecification := ValidationSpecification{Format: format, Columns: rawSpecification.Columns}
+	var err error
+	materializedSpecification.Path, err = materializePath(rawSpecification.Path)
+	if err != nil {
+		return rawSpecification, err
+	}
+	if rawSpecification.Schema != "" {
+		materializedSpecification.Schema, err = materializePath(rawSpecification.Schema)
+		if err != nil {
+			return rawSpecification, err
+		}
+	}
+	return materializedSpecification, nil
+}
+
+// RunValidation validates the files specified by the given validation specification, rendering
+// placeholders in its path with the given variables
+func RunValidation(specification ValidationSpecification, variables map[string]string) error {
+	var schema *JSONSchema
+	if specification.Schema != "" {
+		schemaBytes, err := ioutil.ReadFile(specification.Schema)
+		if err != nil {
+			return fmt.Errorf("Could not read schema (%s): %w", specification.Schema, err)
+		}
+		schema = &JSONSchema{}
+		err = json.Unmarshal(schemaBytes, schema)
+		if err != nil {
+			return fmt.Errorf("Could not parse schema (%s): %w", specification.Schema, err)
+		}
+	}
+
+	path := components.RenderTemplate(specification.Path, variables)
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	paths := []string{path}
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return err
+		}
+		paths = []string{}
+		for _, entry := range entries {
+			if !entry.IsDir() {
+				paths = append(paths, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	for _, filePath := range paths {
+		switch specification.Format {
+		case DataFormatCSV:
+			err = validateCSV(filePath, DataContract{Format: DataFormatCSV, Columns: specification.Columns})
+		case DataFormatJSONLines:
+			err = validateJSONLinesSchema(filePath, schema)
+		case DataFormatJSON:
+			err = validateJSONSchema(filePath, schema)
+		}
+		if err != nil {
+			return fmt.Errorf("%s: %w", filePath, err)
+		}
+	}
+	return nil
+}
+
+// runValidationStep runs the given built-in validation step of the given flow run on the host,
+// recording it in the state database as an execution which exits with code 1 if validation fails
+func runValidationStep(store state.Store, run FlowRunMetadata, specification FlowSpecification, step string) (components.ExecutionMetadata, error) {
+	build := components.BuildMetadata{ID: ValidateComponentID, ComponentID: ValidateComponentID}
+	executionMetadata, err := components.GenerateExecutionMetadata(build, run.FlowID)
+	if err != nil {
+		return executionMetadata, err
+	}
+	executionMetadata.FlowRunID = run.ID
+	executionMetadata.Step = step
+
+	err = components.InsertExecution(store, executionMetadata)
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Error inserting execution for validation step (%s) into state database: %w", step, err)
+	}
+
+	exitCode := 0
+	err = RunValidation(specification.Validations[step], TemplateVariables(run, step))
+	if err != nil {
+		exitCode = 1
+		executionMetadata.Error = err.Error()
+	}
+	finishedAt := time.Now()
+	executionMetadata.ExitCode = &exitCode
+	executionMetadata.FinishedAt = &finishedAt
+
+	err = components.UpdateExecutionResult(store, executionMetadata)
+	if err != nil {
+		return executionMetadata, fmt.Errorf("Error recording result of validation step (%s) in state database: %w", step, err)
+	}
+	return executionMetadata, nil
+}
+
+func validateJSONSchema(path string, schema *JSONSchema) error {
+	dataFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+
+	var document interface{}
+	err = json.NewDecoder(dataFile).Decode(&document)
+	if err != nil {
+		return err
+	}
+	return schema.Validate(document)
+}
+
+func validateJSONLinesSchema(path string, schema *JSONSchema) error {
+	dataFile, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer dataFile.Close()
+
+	scanner := bufio.NewScanner(dataFile)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		if strings.TrimSpace(scanner.Text()) == "" {
+			continue
+		}
+		var document interface{}
+		err = json.Unmarshal(scanner.Bytes(), &document)
+		if err != nil {
+			return fmt.Errorf("Line %d is not valid JSON: %w", line, err)
+		}
+		err = schema.Validate(document)
+		if err != nil {
+			return fmt.Errorf("Line %d: %w", line, err)
+		}
+	}
+	return scanner.Err()
+}
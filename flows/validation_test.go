@@ -0,0 +1,257 @@
+package flows
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestJSONSchemaValidate(t *testing.T) {
+	rawSchema := `{
+		"type": "object",
+		"required": ["id", "name"],
+		"additionalProperties": false,
+		"properties": {
+			"id": {"type": "integer", "minimum": 1},
+			"name": {"type": "string", "minLength": 1, "pattern": "^[a-z]+$"},
+			"kind": {"enum": ["a", "b"]},
+			"tags": {"type": "array", "maxItems": 2, "items": {"type": "string"}},
+			"score": {"type": ["number", "null"]}
+		}
+	}`
+	var schema JSONSchema
+	err := json.Unmarshal([]byte(rawSchema), &schema)
+	if err != nil {
+		t.Fatalf("Could not parse schema: %s", err.Error())
+	}
+
+	type schemaTest struct {
+		document     string
+		returnsError bool
+	}
+
+	testCases := []schemaTest{
+		{document: `{"id": 1, "name": "abc"}`, returnsError: false},
+		{document: `{"id": 1, "name": "abc", "kind": "b", "tags": ["x"], "score": null}`, returnsError: false},
+		{document: `{"id": 1}`, returnsError: true},
+		{document: `{"id": 1.5, "name": "abc"}`, returnsError: true},
+		{document: `{"id": 0, "name": "abc"}`, returnsError: true},
+		{document: `{"id": 1, "name": "ABC"}`, returnsError: true},
+		{document: `{"id": 1, "name": ""}`, returnsError: true},
+		{document: `{"id": 1, "name": "abc", "kind": "c"}`, returnsError: true},
+		{document: `{"id": 1, "name": "abc", "tags": ["x", "y", "z"]}`, returnsError: true},
+		{document: `{"id": 1, "name": "abc", "tags": [1]}`, returnsError: true},
+		{document: `{"id": 1, "name": "abc", "extra": true}`, returnsError: true},
+		{document: `[1, 2]`, returnsError: true},
+	}
+
+	for i, testCase := range testCases {
+		var document interface{}
+		err = json.Unmarshal([]byte(testCase.document), &document)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not parse document: %s", i, err.Error())
+		}
+		err = schema.Validate(document)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		}
+	}
+}
+
+func TestRunValidation(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "shnorky-validation-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dataDir)
+
+	schemaPath := filepath.Join(dataDir, "schema.json")
+	err = ioutil.WriteFile(schemaPath, []byte(`{"type": "object", "required": ["id"]}`), 0644)
+	if err != nil {
+		t.Fatalf("Could not write schema: %s", err.Error())
+	}
+
+	type validationTest struct {
+		specification ValidationSpecification
+		files         map[string]string
+		returnsError  bool
+	}
+
+	testCases := []validationTest{
+		{
+			specification: ValidationSpecification{Format: "ndjson", Schema: schemaPath},
+			files:         map[string]string{"a.jsonl": "{\"id\": 1}\n{\"id\": 2}\n"},
+			returnsError:  false,
+		},
+		{
+			specification: ValidationSpecification{Format: "jsonlines", Schema: schemaPath},
+			files:         map[string]string{"a.jsonl": "{\"id\": 1}\n", "b.jsonl": "{\"name\": \"b\"}\n"},
+			returnsError:  true,
+		},
+		{
+			specification: ValidationSpecification{Format: "json", Schema: schemaPath},
+			files:         map[string]string{"a.json": "{\"id\": 1}"},
+			returnsError:  false,
+		},
+		{
+			specification: ValidationSpecification{Format: "json"},
+			files:         map[string]string{"a.json": "{\"id\": "},
+			returnsError:  true,
+		},
+		{
+			specification: ValidationSpecification{Format: "csv", Columns: []string{"id", "name"}},
+			files:         map[string]string{"a.csv": "id,name\n1,a\n"},
+			returnsError:  false,
+		},
+		{
+			specification: ValidationSpecification{Format: "csv", Columns: []string{"id", "name"}},
+			files:         map[string]string{"a.csv": "id\n1\n"},
+			returnsError:  true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		inputDir := filepath.Join(dataDir, "{{run_id}}")
+		renderedDir := filepath.Join(dataDir, "run")
+		err = os.MkdirAll(renderedDir, 0755)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not create input directory: %s", i, err.Error())
+		}
+		for name, contents := range testCase.files {
+			err = ioutil.WriteFile(filepath.Join(renderedDir, name), []byte(contents), 0644)
+			if err != nil {
+				t.Fatalf("[Test %d] Could not write input file: %s", i, err.Error())
+			}
+		}
+
+		testCase.specification.Path = inputDir
+		specification, err := MaterializeValidationSpecification(testCase.specification)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not materialize validation specification: %s", i, err.Error())
+		}
+		err = RunValidation(specification, map[string]string{"run_id": "run"})
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		}
+		os.RemoveAll(renderedDir)
+	}
+}
+
+func TestMaterializeValidations(t *testing.T) {
+	type validationsTest struct {
+		specification FlowSpecification
+		returnsError  bool
+	}
+
+	testCases := []validationsTest{
+		{
+			specification: FlowSpecification{
+				Steps:       map[string]string{"check": ValidateComponentID},
+				Validations: map[string]ValidationSpecification{"check": {Path: "/tmp/data.csv", Format: "csv"}},
+			},
+			returnsError: false,
+		},
+		{
+			specification: FlowSpecification{
+				Steps: map[string]string{"check": ValidateComponentID},
+			},
+			returnsError: true,
+		},
+		{
+			specification: FlowSpecification{
+				Steps:       map[string]string{"check": "validator"},
+				Validations: map[string]ValidationSpecification{"check": {Path: "/tmp/data.csv", Format: "csv"}},
+			},
+			returnsError: true,
+		},
+		{
+			specification: FlowSpecification{
+				Steps:       map[string]string{"check": ValidateComponentID},
+				Validations: map[string]ValidationSpecification{"check": {Path: "/tmp/data.csv", Format: "xml"}},
+			},
+			returnsError: true,
+		},
+		{
+			specification: FlowSpecification{
+				Steps:       map[string]string{"check": ValidateComponentID},
+				Validations: map[string]ValidationSpecification{"check": {Path: "/tmp/data.csv", Format: "csv", Schema: "/tmp/schema.json"}},
+			},
+			returnsError: true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		_, err := MaterializeFlowSpecification(testCase.specification)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+		}
+	}
+}
+
+func TestRunValidationStep(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-validation-step-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatalf("Error opening state database file (%s): %s", stateDBPath, err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	dataPath := filepath.Join(stateDir, "data.csv")
+	err = ioutil.WriteFile(dataPath, []byte("id\n1\n"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write input file: %s", err.Error())
+	}
+
+	run := FlowRunMetadata{ID: "run", FlowID: "flow"}
+	specification := FlowSpecification{
+		Steps: map[string]string{"good": ValidateComponentID, "bad": ValidateComponentID},
+		Validations: map[string]ValidationSpecification{
+			"good": {Path: dataPath, Format: DataFormatCSV, Columns: []string{"id"}},
+			"bad":  {Path: dataPath, Format: DataFormatCSV, Columns: []string{"name"}},
+		},
+	}
+
+	expectedExitCodes := map[string]int{"good": 0, "bad": 1}
+	for step, expectedExitCode := range expectedExitCodes {
+		executionMetadata, err := runValidationStep(store, run, specification, step)
+		if err != nil {
+			t.Fatalf("[%s] Unexpected error running validation step: %s", step, err.Error())
+		}
+		storedExecution, err := components.SelectExecutionByID(store, executionMetadata.ID)
+		if err != nil {
+			t.Fatalf("[%s] Could not select execution: %s", step, err.Error())
+		}
+		if storedExecution.ExitCode == nil || *storedExecution.ExitCode != expectedExitCode {
+			t.Errorf("[%s] Unexpected exit code: expected=%d, actual=%v", step, expectedExitCode, storedExecution.ExitCode)
+		}
+		if storedExecution.FlowRunID != run.ID || storedExecution.Step != step || storedExecution.ComponentID != ValidateComponentID {
+			t.Errorf("[%s] Unexpected execution metadata: %v", step, storedExecution)
+		}
+	}
+}
@@ -0,0 +1,171 @@
+package flows
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// RunStatusSubmitted is the status of a flow run which has been submitted for asynchronous
+// execution and is waiting for a worker to pick it up
+var RunStatusSubmitted = "submitted"
+
+// WorkerPollInterval is how often idle workers check the state database for submitted flow runs
+var WorkerPollInterval = time.Second
+
+// Submit records a run of the flow with the given ID in the state database without executing it.
+// The run is executed by the next available worker (see RunWorkers) once it reaches the head of
+// the queue and its flow has fewer unfinished runs than it allows (see
+// FlowSpecification.MaxConcurrentRuns). If priority is 0, the run gets the priority from the flow
+// specification.
+// This is the handler for `shn flows submit`
+func Submit(store state.Store, flowID string, priority int) (FlowRunMetadata, error) {
+	flow, err := SelectFlowByID(store, flowID)
+	if err != nil {
+		return FlowRunMetadata{}, err
+	}
+	specification, err := ReadRegisteredSpecification(flow)
+	if err != nil {
+		return FlowRunMetadata{}, err
+	}
+
+	run, err := GenerateFlowRunMetadata(flowID)
+	if err != nil {
+		return run, err
+	}
+	run.Status = RunStatusSubmitted
+	run.Priority = priority
+	if run.Priority == 0 {
+		run.Priority = specification.Priority
+	}
+
+	err = InsertFlowRun(store, run)
+	if err != nil {
+		return run, fmt.Errorf("Error inserting flow run into state database: %w", err)
+	}
+	return run, nil
+}
+
+// RunWorkers executes submitted flow runs using the given number of workers, each of which
+// executes one run at a time, until the given context is cancelled. Runs are picked up in queue
+// order (see QueuedRuns), subject to the limit on concurrent runs in the state configuration and
+// to the quotas of their flows. Progress and errors are written to outstream (if it is not nil).
+// RunWorkers returns once all the workers have stopped.
+func RunWorkers(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, stateDir string, workers int) {
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			runWorker(ctx, store, dockerClient, outstream, stateDir)
+		}()
+	}
+	wg.Wait()
+}
+
+// runWorker claims and executes submitted flow runs one at a time until the given context is
+// cancelled
+func runWorker(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, stateDir string) {
+	for {
+		run, claimed, err := claimNextRun(store, stateDir)
+		if err != nil && outstream != nil {
+			fmt.Fprintf(outstream, "Worker could not claim a submitted flow run: %s\n", err.Error())
+		}
+		if claimed {
+			executeClaimedRun(ctx, store, dockerClient, outstream, stateDir, run)
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(WorkerPollInterval):
+		}
+	}
+}
+
+// claimNextRun starts the flow run at the head of the queue if it was submitted (rather than queued
+// by a process which is waiting to execute it) and both the limit on concurrent runs and the quota
+// of its flow allow it. The boolean return value indicates whether a run was claimed.
+func claimNextRun(store state.Store, stateDir string) (FlowRunMetadata, bool, error) {
+	queue, err := QueuedRuns(store)
+	if err != nil || len(queue) == 0 || queue[0].Status != RunStatusSubmitted {
+		return FlowRunMetadata{}, false, err
+	}
+	config, err := state.ReadConfig(stateDir)
+	if err != nil {
+		return FlowRunMetadata{}, false, err
+	}
+
+	run := queue[0]
+	maxRuns, err := flowQuota(store, run.FlowID)
+	if err != nil {
+		return run, false, err
+	}
+
+	// Since the run must still be submitted, only one worker can claim it. Its flow's quota counts
+	// the runs which processes are executing (or waiting to execute), but not the other submitted
+	// runs, which have yet to be claimed.
+	claimed, err := store.StartFlowRunWithinQuota(run.ID, RunStatusSubmitted, RunStatusRunning, activeRunStatuses, config.Runs.MaxConcurrent, executingRunStatuses, maxRuns)
+	if err != nil {
+		return run, false, err
+	}
+	run.Status = RunStatusRunning
+	return run, claimed, nil
+}
+
+// flowQuota returns the number of runs of the flow with the given ID which may be unfinished at
+// once. If the flow (or its specification) cannot be read, the default quota applies, so that its
+// runs are still claimed and then fail as they are executed.
+func flowQuota(store state.Store, flowID string) (int, error) {
+	flow, err := SelectFlowByID(store, flowID)
+	if err == ErrFlowNotFound {
+		return DefaultMaxConcurrentRuns, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	specification, err := ReadRegisteredSpecification(flow)
+	if err != nil {
+		return DefaultMaxConcurrentRuns, nil
+	}
+	return maxConcurrentRuns(specification), nil
+}
+
+// executeClaimedRun executes the given flow run, which a worker has claimed. If the run fails
+// before it gets going (e.g. because one of its inputs is missing), it is marked as failed so that
+// it does not count towards the limit on concurrent runs.
+func executeClaimedRun(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, stateDir string, run FlowRunMetadata) {
+	if outstream != nil {
+		fmt.Fprintf(outstream, "Worker started run (%s) of flow (%s)\n", run.ID, run.FlowID)
+	}
+	executedRun, _, err := executeRun(ctx, store, dockerClient, outstream, stateDir, run, true)
+	if executedRun.ID != "" {
+		run = executedRun
+	}
+	if err == nil {
+		if outstream != nil {
+			fmt.Fprintf(outstream, "Run (%s) of flow (%s) finished with status: %s\n", run.ID, run.FlowID, run.Status)
+		}
+		return
+	}
+
+	if outstream != nil {
+		fmt.Fprintf(outstream, "Run (%s) of flow (%s) failed: %s\n", run.ID, run.FlowID, err.Error())
+	}
+	if run.FinishedAt == nil {
+		finishedAt := time.Now()
+		run.Status = RunStatusFailed
+		run.FinishedAt = &finishedAt
+		updateErr := UpdateFlowRunStatus(store, run)
+		if updateErr != nil && outstream != nil {
+			fmt.Fprintf(outstream, "Error updating status of flow run (%s): %s\n", run.ID, updateErr.Error())
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package flows
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestSubmitAndClaimRuns(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-worker-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatalf("Error opening state database file (%s): %s", stateDBPath, err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	err = ioutil.WriteFile(path.Join(stateDir, state.ConfigFileName), []byte(`{"runs": {"max_concurrent": 1}}`), 0644)
+	if err != nil {
+		t.Fatalf("Could not write state configuration: %s", err.Error())
+	}
+	specificationPath := path.Join(stateDir, "flow.json")
+	err = ioutil.WriteFile(specificationPath, []byte(`{"steps": {}, "priority": 3}`), 0644)
+	if err != nil {
+		t.Fatalf("Could not write flow specification: %s", err.Error())
+	}
+	_, err = AddFlow(store, "flow", specificationPath)
+	if err != nil {
+		t.Fatalf("Could not add flow: %s", err.Error())
+	}
+
+	_, err = Submit(store, "nonexistent", 0)
+	if err != ErrFlowNotFound {
+		t.Errorf("Unexpected error submitting nonexistent flow: expected=%v, actual=%v", ErrFlowNotFound, err)
+	}
+	defaultPriorityRun, err := Submit(store, "flow", 0)
+	if err != nil {
+		t.Fatalf("Could not submit flow: %s", err.Error())
+	}
+	if defaultPriorityRun.Status != RunStatusSubmitted || defaultPriorityRun.Priority != 3 {
+		t.Errorf("Unexpected run for submission with default priority: %v", defaultPriorityRun)
+	}
+	highPriorityRun, err := Submit(store, "flow", 7)
+	if err != nil {
+		t.Fatalf("Could not submit flow: %s", err.Error())
+	}
+
+	running := FlowRunMetadata{ID: "running", FlowID: "flow", Status: RunStatusRunning, CreatedAt: time.Now()}
+	err = InsertFlowRun(store, running)
+	if err != nil {
+		t.Fatalf("Could not insert flow run: %s", err.Error())
+	}
+	_, claimed, err := claimNextRun(store, stateDir)
+	if err != nil {
+		t.Fatalf("Unexpected error claiming run: %s", err.Error())
+	}
+	if claimed {
+		t.Error("Claimed a run while the maximum number of runs were in progress")
+	}
+
+	finishedAt := time.Now()
+	running.Status = RunStatusSucceeded
+	running.FinishedAt = &finishedAt
+	err = UpdateFlowRunStatus(store, running)
+	if err != nil {
+		t.Fatalf("Could not finish flow run: %s", err.Error())
+	}
+	claimedRun, claimed, err := claimNextRun(store, stateDir)
+	if err != nil {
+		t.Fatalf("Unexpected error claiming run: %s", err.Error())
+	}
+	if !claimed || claimedRun.ID != highPriorityRun.ID {
+		t.Errorf("Did not claim the highest priority run: claimed=%t, run=%s", claimed, claimedRun.ID)
+	}
+	storedRun, err := SelectFlowRunByID(store, highPriorityRun.ID)
+	if err != nil {
+		t.Fatalf("Could not select flow run: %s", err.Error())
+	}
+	if storedRun.Status != RunStatusRunning {
+		t.Errorf("Unexpected status for claimed run: %s", storedRun.Status)
+	}
+
+	// Runs queued by the processes executing them are not claimed by workers
+	queued := FlowRunMetadata{ID: "queued", FlowID: "flow", Status: RunStatusQueued, CreatedAt: time.Now(), Priority: 10}
+	err = InsertFlowRun(store, queued)
+	if err != nil {
+		t.Fatalf("Could not insert flow run: %s", err.Error())
+	}
+	err = UpdateFlowRunStatus(store, FlowRunMetadata{ID: highPriorityRun.ID, Status: RunStatusSucceeded, FinishedAt: &finishedAt})
+	if err != nil {
+		t.Fatalf("Could not finish flow run: %s", err.Error())
+	}
+	_, claimed, err = claimNextRun(store, stateDir)
+	if err != nil {
+		t.Fatalf("Unexpected error claiming run: %s", err.Error())
+	}
+	if claimed {
+		t.Error("Claimed a run which was queued by another process")
+	}
+
+	// Claimed runs which fail before they get going are marked as failed
+	orphan := FlowRunMetadata{ID: "orphan", FlowID: "nonexistent", Status: RunStatusRunning, CreatedAt: time.Now()}
+	err = InsertFlowRun(store, orphan)
+	if err != nil {
+		t.Fatalf("Could not insert flow run: %s", err.Error())
+	}
+	executeClaimedRun(context.Background(), store, nil, nil, stateDir, orphan)
+	storedRun, err = SelectFlowRunByID(store, orphan.ID)
+	if err != nil {
+		t.Fatalf("Could not select flow run: %s", err.Error())
+	}
+	if storedRun.Status != RunStatusFailed || storedRun.FinishedAt == nil {
+		t.Errorf("Claimed run which could not be executed was not marked as failed: %v", storedRun)
+	}
+}
+
+func TestClaimRunsWithinFlowQuota(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-worker-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatalf("Error opening state database file (%s): %s", stateDBPath, err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	specificationPath := path.Join(stateDir, "flow.json")
+	err = ioutil.WriteFile(specificationPath, []byte(`{"steps": {}, "max_concurrent_runs": 1}`), 0644)
+	if err != nil {
+		t.Fatalf("Could not write flow specification: %s", err.Error())
+	}
+	_, err = AddFlow(store, "flow", specificationPath)
+	if err != nil {
+		t.Fatalf("Could not add flow: %s", err.Error())
+	}
+
+	// Both runs are accepted, as submitted runs wait in the queue until their flow has a free slot
+	firstRun, err := Submit(store, "flow", 0)
+	if err != nil {
+		t.Fatalf("Could not submit flow: %s", err.Error())
+	}
+	secondRun, err := Submit(store, "flow", 0)
+	if err != nil {
+		t.Fatalf("Could not submit flow: %s", err.Error())
+	}
+
+	claimedRun, claimed, err := claimNextRun(store, stateDir)
+	if err != nil {
+		t.Fatalf("Unexpected error claiming run: %s", err.Error())
+	}
+	if !claimed || claimedRun.ID != firstRun.ID {
+		t.Fatalf("Did not claim the first submitted run: claimed=%t, run=%s", claimed, claimedRun.ID)
+	}
+	_, claimed, err = claimNextRun(store, stateDir)
+	if err != nil {
+		t.Fatalf("Unexpected error claiming run: %s", err.Error())
+	}
+	if claimed {
+		t.Error("Claimed a second run of a flow which allows only one unfinished run")
+	}
+	storedRun, err := SelectFlowRunByID(store, secondRun.ID)
+	if err != nil {
+		t.Fatalf("Could not select flow run: %s", err.Error())
+	}
+	if storedRun.Status != RunStatusSubmitted {
+		t.Errorf("Unexpected status for run beyond its flow's quota: %s", storedRun.Status)
+	}
+
+	finishedAt := time.Now()
+	err = UpdateFlowRunStatus(store, FlowRunMetadata{ID: firstRun.ID, Status: RunStatusSucceeded, FinishedAt: &finishedAt})
+	if err != nil {
+		t.Fatalf("Could not finish flow run: %s", err.Error())
+	}
+	claimedRun, claimed, err = claimNextRun(store, stateDir)
+	if err != nil {
+		t.Fatalf("Unexpected error claiming run: %s", err.Error())
+	}
+	if !claimed || claimedRun.ID != secondRun.ID {
+		t.Errorf("Did not claim the second run once a slot freed up: claimed=%t, run=%s", claimed, claimedRun.ID)
+	}
+}
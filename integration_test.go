@@ -42,6 +42,7 @@ func TestSingleComponent(t *testing.T) {
 		t.Fatal("Error opening state database file")
 	}
 	defer db.Close()
+	store := state.NewSQLiteStore(db)
 
 	componentID := "test-component"
 	componentPath := "examples/components/single-task"
@@ -54,7 +55,7 @@ func TestSingleComponent(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not resolve absolute path for file: %s - %s", specificationPath, err.Error())
 	}
-	component, err := components.AddComponent(db, componentID, components.Task, componentPath, specificationPath)
+	component, err := components.AddComponent(store, componentID, components.Task, componentPath, specificationPath)
 	if err != nil {
 		t.Fatalf("Error registering component: %s", err.Error())
 	}
@@ -75,13 +76,18 @@ func TestSingleComponent(t *testing.T) {
 	dockerClient := internal.GenerateDockerClient(log)
 	ctx := context.Background()
 
-	build, err := components.CreateBuild(ctx, db, dockerClient, ioutil.Discard, component.ID)
+	build, err := components.CreateBuild(ctx, store, dockerClient, ioutil.Discard, path.Join(stateDir, state.BuildLogsDirName), component.ID, components.BuildOptions{})
 	if err != nil {
 		t.Fatalf("Error building image for component: %s", err.Error())
 	}
 	if build.ComponentID != component.ID {
 		t.Fatalf("Unexpected component ID on build: expected=%s, actual=%s", component.ID, build.ComponentID)
 	}
+	buildLog, err := components.OpenBuildLog(path.Join(stateDir, state.BuildLogsDirName), build.ID)
+	if err != nil {
+		t.Fatalf("Could not open log for build (%s): %s", build.ID, err.Error())
+	}
+	buildLog.Close()
 
 	imageInfo, _, err := dockerClient.ImageInspectWithRaw(ctx, build.ID)
 	if err != nil {
@@ -136,7 +142,7 @@ func TestSingleComponent(t *testing.T) {
 		},
 	}
 
-	execution, err := components.Execute(ctx, db, dockerClient, build.ID, "", mounts, map[string]string{})
+	execution, err := components.Execute(ctx, store, dockerClient, build.ID, "", "", "", mounts, map[string]string{}, "", "", nil)
 	if err != nil {
 		t.Fatalf("Error executing build (%s): %s", build.ID, err.Error())
 	}
@@ -222,6 +228,7 @@ func TestFlowSingleTaskTwice(t *testing.T) {
 		t.Fatal("Error opening state database file")
 	}
 	defer db.Close()
+	store := state.NewSQLiteStore(db)
 
 	componentID := "single-task"
 	componentPath := "examples/components/single-task"
@@ -234,7 +241,7 @@ func TestFlowSingleTaskTwice(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not resolve absolute path for file: %s - %s", specificationPath, err.Error())
 	}
-	component, err := components.AddComponent(db, componentID, components.Task, componentPath, specificationPath)
+	component, err := components.AddComponent(store, componentID, components.Task, componentPath, specificationPath)
 	if err != nil {
 		t.Fatalf("Error registering component: %s", err.Error())
 	}
@@ -258,7 +265,7 @@ func TestFlowSingleTaskTwice(t *testing.T) {
 	if err != nil {
 		t.Fatalf("Could not resolve absolute path for file: %s - %s", flowSpecificationPath, err.Error())
 	}
-	flow, err := flows.AddFlow(db, flowID, flowSpecificationPath)
+	flow, err := flows.AddFlow(store, flowID, flowSpecificationPath)
 	if err != nil {
 		t.Fatalf("Error registering flow: %s", err.Error())
 	}
@@ -273,7 +280,7 @@ func TestFlowSingleTaskTwice(t *testing.T) {
 	dockerClient := internal.GenerateDockerClient(log)
 	ctx := context.Background()
 
-	flowBuilds, err := flows.Build(ctx, db, dockerClient, ioutil.Discard, flow.ID)
+	flowBuilds, err := flows.Build(ctx, store, dockerClient, ioutil.Discard, stateDir, flow.ID, components.BuildOptions{})
 	if err != nil {
 		t.Fatalf("Error building images for flow: %s", err.Error())
 	}
@@ -344,13 +351,16 @@ func TestFlowSingleTaskTwice(t *testing.T) {
 		t.Fatal("Could not set SHNORKY_TEST_OUTPUT environment variable")
 	}
 
-	flowExecutions, err := flows.Execute(ctx, db, dockerClient, flow.ID)
+	flowRun, flowExecutions, err := flows.Execute(ctx, store, dockerClient, ioutil.Discard, stateDir, flow.ID)
 	for _, stepExecution := range flowExecutions {
 		defer dockerClient.ContainerRemove(ctx, stepExecution.ID, dockerTypes.ContainerRemoveOptions{})
 	}
 	if err != nil {
 		t.Fatalf("Error in flow execution: %s", err.Error())
 	}
+	if flowRun.Status != flows.RunStatusSucceeded {
+		t.Fatalf("Unexpected flow run status: expected=%s, actual=%s", flows.RunStatusSucceeded, flowRun.Status)
+	}
 
 	// expectedLine is the value for the MY_ENV variable in the component specification in:
 	// examples/components/single-task/component.json
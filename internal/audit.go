@@ -0,0 +1,17 @@
+package internal
+
+import (
+	"github.com/simiotics/shnorky/audit"
+	"github.com/simiotics/shnorky/state"
+	"github.com/sirupsen/logrus"
+)
+
+// RecordAudit records the given action (performed by the current user) in the audit log of the
+// given state store. The result of the action is determined by actionErr. Failures to record
+// the action are logged as warnings rather than interrupting the command.
+func RecordAudit(store state.Store, log *logrus.Logger, action string, arguments map[string]string, actionErr error) {
+	_, err := audit.Record(store, action, state.CurrentUser(), arguments, actionErr)
+	if err != nil {
+		log.WithFields(logrus.Fields{"action": action, "error": err}).Warn("Could not record action in audit log")
+	}
+}
@@ -8,9 +8,17 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
+// EphemeralStateDB is the in-memory state database (see state.InitEphemeral) used by shn
+// --ephemeral. If it is set, OpenStateDB returns it instead of opening the database in the state
+// directory.
+var EphemeralStateDB *sql.DB
+
 // OpenStateDB opens a connection to the state database in the given state directory.
 // If there is an error opening the database, fatally errors out.
 func OpenStateDB(stateDir string, log *logrus.Logger) *sql.DB {
+	if EphemeralStateDB != nil {
+		return EphemeralStateDB
+	}
 	stateDBPath := path.Join(stateDir, state.DBFileName)
 	db, err := sql.Open("sqlite3", stateDBPath)
 	if err != nil {
@@ -0,0 +1,170 @@
+// Package diskusage reports the disk space used by shnorky: the docker images built for its
+// components, and the build logs, artifacts, scratch directories, and state database in its state
+// directory. It helps users decide what to prune when disk space runs low.
+// This package implements `shn system df`.
+package diskusage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"text/tabwriter"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	dockerFilters "github.com/docker/docker/api/types/filters"
+	docker "github.com/docker/docker/client"
+	units "github.com/docker/go-units"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// ComponentImages - the disk space used by the images built for a single component. Images share
+// layers (e.g. their base images), so Bytes counts shared layers once for each image that uses them.
+type ComponentImages struct {
+	ComponentID string `json:"component_id"`
+	Images      int    `json:"images"`
+	Bytes       int64  `json:"bytes"`
+}
+
+// StateUsage - the disk space used by the parts of a state directory which grow with use
+type StateUsage struct {
+	BuildLogsBytes int64 `json:"build_logs_bytes"`
+	ArtifactsBytes int64 `json:"artifacts_bytes"`
+	ScratchBytes   int64 `json:"scratch_bytes"`
+	// DatabaseBytes includes the journal files of the state database
+	DatabaseBytes int64 `json:"database_bytes"`
+}
+
+// Usage - the disk space used by shnorky. Images is sorted by decreasing size.
+type Usage struct {
+	Images      []ComponentImages `json:"images"`
+	ImagesBytes int64             `json:"images_bytes"`
+	State       StateUsage        `json:"state"`
+	TotalBytes  int64             `json:"total_bytes"`
+}
+
+// NewUsage combines the given image and state directory usage into a Usage, ordering the images by
+// decreasing size and totalling their sizes
+func NewUsage(images []ComponentImages, stateUsage StateUsage) Usage {
+	sort.Slice(images, func(i, j int) bool {
+		if images[i].Bytes != images[j].Bytes {
+			return images[i].Bytes > images[j].Bytes
+		}
+		return images[i].ComponentID < images[j].ComponentID
+	})
+	usage := Usage{Images: images, State: stateUsage}
+	for _, componentImages := range images {
+		usage.ImagesBytes += componentImages.Bytes
+	}
+	usage.TotalBytes = usage.ImagesBytes + stateUsage.BuildLogsBytes + stateUsage.ArtifactsBytes + stateUsage.ScratchBytes + stateUsage.DatabaseBytes
+	return usage
+}
+
+// Images returns the disk space used by the docker images built by shnorky, grouped by the
+// component that they were built for
+func Images(ctx context.Context, dockerClient *docker.Client) ([]ComponentImages, error) {
+	filters := dockerFilters.NewArgs()
+	filters.Add("label", components.ComponentIDLabel)
+	summaries, err := dockerClient.ImageList(ctx, dockerTypes.ImageListOptions{Filters: filters})
+	if err != nil {
+		return []ComponentImages{}, fmt.Errorf("Error listing images: %w", err)
+	}
+
+	byComponent := map[string]*ComponentImages{}
+	for _, summary := range summaries {
+		componentID := summary.Labels[components.ComponentIDLabel]
+		componentImages, ok := byComponent[componentID]
+		if !ok {
+			componentImages = &ComponentImages{ComponentID: componentID}
+			byComponent[componentID] = componentImages
+		}
+		componentImages.Images++
+		componentImages.Bytes += summary.Size
+	}
+
+	images := make([]ComponentImages, 0, len(byComponent))
+	for _, componentImages := range byComponent {
+		images = append(images, *componentImages)
+	}
+	return images, nil
+}
+
+// State returns the disk space used by the build logs, artifacts, scratch directories, and state
+// database in the given state directory. Parts which do not exist use no space.
+func State(stateDir string) (StateUsage, error) {
+	var usage StateUsage
+	var err error
+	usage.BuildLogsBytes, err = dirBytes(filepath.Join(stateDir, state.BuildLogsDirName))
+	if err != nil {
+		return usage, err
+	}
+	usage.ArtifactsBytes, err = dirBytes(filepath.Join(stateDir, state.ArtifactsDirName))
+	if err != nil {
+		return usage, err
+	}
+	usage.ScratchBytes, err = dirBytes(filepath.Join(stateDir, state.ScratchDirName))
+	if err != nil {
+		return usage, err
+	}
+
+	// SQLite keeps its journal (and, in WAL mode, its shared memory index) next to the database
+	databasePaths, err := filepath.Glob(filepath.Join(stateDir, state.DBFileName+"*"))
+	if err != nil {
+		return usage, err
+	}
+	for _, databasePath := range databasePaths {
+		info, err := os.Stat(databasePath)
+		if err != nil {
+			return usage, err
+		}
+		usage.DatabaseBytes += info.Size()
+	}
+	return usage, nil
+}
+
+// dirBytes returns the total size of the regular files under the given directory, which is 0 if it
+// does not exist
+func dirBytes(dir string) (int64, error) {
+	var total int64
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && path == dir {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if info.Mode().IsRegular() {
+			total += info.Size()
+		}
+		return nil
+	})
+	return total, err
+}
+
+// WriteUsageTable writes the given usage to the given writer as a human-readable table, with a row
+// for the images of each component followed by a row for each part of the state directory
+func WriteUsageTable(w io.Writer, usage Usage) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TYPE\tNAME\tCOUNT\tSIZE")
+	for _, componentImages := range usage.Images {
+		fmt.Fprintf(tw, "images\t%s\t%d\t%s\n", componentImages.ComponentID, componentImages.Images, units.BytesSize(float64(componentImages.Bytes)))
+	}
+	parts := []struct {
+		name  string
+		bytes int64
+	}{
+		{state.BuildLogsDirName, usage.State.BuildLogsBytes},
+		{state.ArtifactsDirName, usage.State.ArtifactsBytes},
+		{state.ScratchDirName, usage.State.ScratchBytes},
+		{state.DBFileName, usage.State.DatabaseBytes},
+	}
+	for _, part := range parts {
+		fmt.Fprintf(tw, "state\t%s\t\t%s\n", part.name, units.BytesSize(float64(part.bytes)))
+	}
+	fmt.Fprintf(tw, "TOTAL\t\t\t%s\n", units.BytesSize(float64(usage.TotalBytes)))
+	return tw.Flush()
+}
@@ -0,0 +1,80 @@
+package diskusage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestState(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-diskusage-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+
+	files := map[string]int{
+		filepath.Join(state.BuildLogsDirName, "build-1.log"):            10,
+		filepath.Join(state.ArtifactsDirName, "execution", "out.txt"):   20,
+		filepath.Join(state.ArtifactsDirName, "execution", "other.txt"): 5,
+		state.DBFileName:          100,
+		state.DBFileName + "-wal": 50,
+	}
+	for name, size := range files {
+		filePath := filepath.Join(stateDir, name)
+		err = os.MkdirAll(filepath.Dir(filePath), 0755)
+		if err != nil {
+			t.Fatalf("Could not create directory for file (%s): %s", name, err.Error())
+		}
+		err = ioutil.WriteFile(filePath, make([]byte, size), 0644)
+		if err != nil {
+			t.Fatalf("Could not write file (%s): %s", name, err.Error())
+		}
+	}
+
+	// The scratch directory does not exist, so it uses no space
+	usage, err := State(stateDir)
+	if err != nil {
+		t.Fatalf("Unexpected error measuring state directory: %s", err.Error())
+	}
+	expectedUsage := StateUsage{BuildLogsBytes: 10, ArtifactsBytes: 25, DatabaseBytes: 150}
+	if usage != expectedUsage {
+		t.Errorf("Unexpected state usage: expected=%v, actual=%v", expectedUsage, usage)
+	}
+}
+
+func TestNewUsage(t *testing.T) {
+	images := []ComponentImages{
+		{ComponentID: "small", Images: 1, Bytes: 100},
+		{ComponentID: "large", Images: 3, Bytes: 1000},
+	}
+	usage := NewUsage(images, StateUsage{BuildLogsBytes: 1, ArtifactsBytes: 2, ScratchBytes: 3, DatabaseBytes: 4})
+
+	expectedOrder := []string{"large", "small"}
+	actualOrder := []string{}
+	for _, componentImages := range usage.Images {
+		actualOrder = append(actualOrder, componentImages.ComponentID)
+	}
+	if !reflect.DeepEqual(actualOrder, expectedOrder) {
+		t.Errorf("Unexpected order of images: expected=%v, actual=%v", expectedOrder, actualOrder)
+	}
+	if usage.ImagesBytes != 1100 || usage.TotalBytes != 1110 {
+		t.Errorf("Unexpected totals: images=%d, total=%d", usage.ImagesBytes, usage.TotalBytes)
+	}
+
+	var buffer bytes.Buffer
+	err := WriteUsageTable(&buffer, usage)
+	if err != nil {
+		t.Fatalf("Unexpected error writing usage table: %s", err.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != 8 || !strings.HasPrefix(lines[1], "images  large") || !strings.HasPrefix(lines[7], "TOTAL") {
+		t.Errorf("Unexpected usage table:\n%s", buffer.String())
+	}
+}
@@ -2,21 +2,66 @@ package internal
 
 import (
 	"context"
+	"fmt"
+	"time"
 
+	dockerTypes "github.com/docker/docker/api/types"
 	docker "github.com/docker/docker/client"
 	"github.com/sirupsen/logrus"
+
+	"github.com/simiotics/shnorky/components"
 )
 
-// GenerateDockerClient returns a docker client configured to talk to the API specified by the
-// environment of the executing process
-func GenerateDockerClient(log *logrus.Logger) *docker.Client {
-	client, err := docker.NewEnvClient()
+// DockerConnectAttempts is the number of times NewDockerClient tries to reach the docker daemon
+// before giving up, as long as the errors it encounters are transient (e.g. because the daemon is
+// still starting up)
+var DockerConnectAttempts = 3
+
+// DockerRetryInterval is how long NewDockerClient waits between attempts to reach the docker daemon
+var DockerRetryInterval = time.Second
+
+// NewDockerClient returns a docker client configured by the environment of the executing process
+// (DOCKER_HOST, DOCKER_API_VERSION, DOCKER_CERT_PATH, and DOCKER_TLS_VERIFY). Unless
+// DOCKER_API_VERSION pins the API version, the client negotiates the API version with the daemon
+// so that it works against daemons which are older than the client library. Reaching the daemon is
+// retried on transient errors. If the daemon cannot be reached, the (unnegotiated) client is
+// returned along with the error.
+func NewDockerClient(ctx context.Context) (*docker.Client, error) {
+	client, err := docker.NewClientWithOpts(docker.FromEnv, docker.WithAPIVersionNegotiation())
 	if err != nil {
-		log.WithField("error", err).Fatal("Error creating docker client")
+		return nil, fmt.Errorf("Error creating docker client: %w", err)
 	}
 
-	ctx := context.Background()
-	client.NegotiateAPIVersion(ctx)
+	var ping dockerTypes.Ping
+	for attempt := 1; ; attempt++ {
+		ping, err = client.Ping(ctx)
+		if err == nil || attempt >= DockerConnectAttempts || !components.IsTransientDockerError(err) {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return client, ctx.Err()
+		case <-time.After(DockerRetryInterval):
+		}
+	}
+	if err != nil {
+		return client, fmt.Errorf("Could not reach docker daemon (%s): %w", client.DaemonHost(), err)
+	}
+	client.NegotiateAPIVersionPing(ping)
+	return client, nil
+}
 
+// GenerateDockerClient returns a docker client created by NewDockerClient. If the client cannot be
+// created, fatally errors out. If the docker daemon cannot be reached, a warning is logged and the
+// client is returned anyway, so that commands fail (with more specific errors) only if they
+// actually need the daemon.
+func GenerateDockerClient(log *logrus.Logger) *docker.Client {
+	client, err := NewDockerClient(context.Background())
+	if client == nil {
+		log.WithField("error", err).Fatal("Error creating docker client")
+	}
+	if err != nil {
+		log.WithField("error", err).Warn("Could not negotiate docker API version")
+	}
 	return client
 }
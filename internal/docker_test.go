@@ -0,0 +1,37 @@
+package internal
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestNewDockerClientUnreachableDaemon(t *testing.T) {
+	originalHost, hostSet := os.LookupEnv("DOCKER_HOST")
+	os.Setenv("DOCKER_HOST", "tcp://127.0.0.1:1")
+	defer func() {
+		if hostSet {
+			os.Setenv("DOCKER_HOST", originalHost)
+		} else {
+			os.Unsetenv("DOCKER_HOST")
+		}
+	}()
+
+	originalRetryInterval := DockerRetryInterval
+	DockerRetryInterval = 50 * time.Millisecond
+	defer func() { DockerRetryInterval = originalRetryInterval }()
+
+	start := time.Now()
+	client, err := NewDockerClient(context.Background())
+	if client == nil {
+		t.Fatalf("No client was returned for unreachable daemon: %v", err)
+	}
+	if err == nil {
+		t.Fatal("No error was returned for unreachable daemon")
+	}
+	minimumElapsed := time.Duration(DockerConnectAttempts-1) * DockerRetryInterval
+	if elapsed := time.Since(start); elapsed < minimumElapsed {
+		t.Errorf("Connection was not retried: elapsed=%s, expected at least %s", elapsed, minimumElapsed)
+	}
+}
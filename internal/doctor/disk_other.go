@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package doctor
+
+import (
+	"errors"
+	"runtime"
+)
+
+func freeBytes(path string) (uint64, error) {
+	return 0, errors.New("Checking free disk space is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,299 @@
+// Package doctor diagnoses problems with the environment that shn runs in: the docker daemon, the
+// state directory and database, and the state configuration. Each check reports what it found along
+// with a hint on how to fix any problem.
+// This package implements `shn doctor`.
+package doctor
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/flows"
+	"github.com/simiotics/shnorky/internal"
+	"github.com/simiotics/shnorky/server"
+	"github.com/simiotics/shnorky/staging"
+	"github.com/simiotics/shnorky/state"
+)
+
+// Statuses of checks
+var (
+	StatusOK      = "ok"
+	StatusWarning = "warning"
+	StatusError   = "error"
+)
+
+// MinimumDockerAPIVersion is the oldest docker API version that shn is known to work with
+var MinimumDockerAPIVersion = "1.25"
+
+// MinimumFreeBytes is the amount of free disk space in the state directory below which the disk
+// space check fails
+var MinimumFreeBytes uint64 = 1 << 30
+
+// LowFreeBytes is the amount of free disk space in the state directory below which the disk space
+// check warns
+var LowFreeBytes uint64 = 5 << 30
+
+// Check - the result of a single diagnostic check
+type Check struct {
+	Name    string `json:"name"`
+	Status  string `json:"status"`
+	Message string `json:"message"`
+	// Hint suggests how to fix the problem that the check found (if any)
+	Hint string `json:"hint,omitempty"`
+}
+
+// Run runs all the diagnostic checks against the given state directory and the docker daemon
+// configured by the environment, and returns their results in order
+func Run(ctx context.Context, stateDir string) []Check {
+	checks := []Check{checkDocker(ctx)}
+
+	info, err := os.Stat(stateDir)
+	if err != nil || !info.IsDir() {
+		message := fmt.Sprintf("State directory (%s) does not exist", stateDir)
+		if err == nil {
+			message = fmt.Sprintf("State directory (%s) is not a directory", stateDir)
+		} else if !os.IsNotExist(err) {
+			message = fmt.Sprintf("Could not access state directory (%s): %s", stateDir, err.Error())
+		}
+		return append(checks, Check{
+			Name:    "state directory",
+			Status:  StatusError,
+			Message: message,
+			Hint:    "Initialize it with \"shn state init\", or point shn at an existing state directory with --statedir",
+		})
+	}
+	checks = append(checks, Check{Name: "state directory", Status: StatusOK, Message: stateDir})
+	checks = append(checks, checkDiskSpace(stateDir))
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	if _, err := os.Stat(stateDBPath); err != nil {
+		return append(checks, Check{
+			Name:    "state database",
+			Status:  StatusError,
+			Message: fmt.Sprintf("Could not access state database (%s): %s", stateDBPath, err.Error()),
+			Hint:    "The state directory may not have been initialized with \"shn state init\"",
+		})
+	}
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		return append(checks, Check{Name: "state database", Status: StatusError, Message: err.Error()})
+	}
+	defer db.Close()
+	checks = append(checks, checkDatabase(db, stateDBPath)...)
+
+	config, err := state.ReadConfig(stateDir)
+	if err != nil {
+		return append(checks, Check{
+			Name:    "state configuration",
+			Status:  StatusError,
+			Message: err.Error(),
+			Hint:    fmt.Sprintf("Fix or remove %s", path.Join(stateDir, state.ConfigFileName)),
+		})
+	}
+	checks = append(checks, checkConfiguration(config)...)
+	checks = append(checks, checkRegistrations(state.NewSQLiteStore(db))...)
+	return checks
+}
+
+// Failed returns true if any of the given checks has the error status
+func Failed(checks []Check) bool {
+	for _, check := range checks {
+		if check.Status == StatusError {
+			return true
+		}
+	}
+	return false
+}
+
+// checkDocker checks that the docker daemon is reachable and supports a recent enough API version
+func checkDocker(ctx context.Context) Check {
+	check := Check{Name: "docker"}
+	dockerClient, err := internal.NewDockerClient(ctx)
+	if dockerClient == nil {
+		check.Status = StatusError
+		check.Message = err.Error()
+		check.Hint = "Check the DOCKER_HOST, DOCKER_API_VERSION, DOCKER_CERT_PATH, and DOCKER_TLS_VERIFY environment variables"
+		return check
+	}
+	defer dockerClient.Close()
+
+	version, err := dockerClient.ServerVersion(ctx)
+	if err != nil {
+		check.Status = StatusError
+		check.Message = fmt.Sprintf("Could not reach docker daemon: %s", err.Error())
+		check.Hint = "Make sure that the docker daemon is running and that your user may access it (e.g. by being in the docker group)"
+		return check
+	}
+
+	check.Status = StatusOK
+	check.Message = fmt.Sprintf("Docker %s (API version %s, client API version %s)", version.Version, version.APIVersion, dockerClient.ClientVersion())
+	if compareVersions(version.APIVersion, MinimumDockerAPIVersion) < 0 {
+		check.Status = StatusError
+		check.Hint = fmt.Sprintf("Upgrade docker to a version which supports API version %s or later", MinimumDockerAPIVersion)
+	}
+	return check
+}
+
+// checkDiskSpace checks that there is enough free disk space in the given state directory for
+// builds, artifacts, and scratch directories
+func checkDiskSpace(stateDir string) Check {
+	check := Check{Name: "disk space"}
+	free, err := freeBytes(stateDir)
+	if err != nil {
+		check.Status = StatusWarning
+		check.Message = fmt.Sprintf("Could not determine free disk space: %s", err.Error())
+		return check
+	}
+
+	check.Status = StatusOK
+	check.Message = fmt.Sprintf("%.1f GiB free in %s", float64(free)/(1<<30), stateDir)
+	hint := fmt.Sprintf("Free up space, e.g. by removing old scratch directories under %s (or setting scratch.max_age in the state configuration) and pruning docker images", path.Join(stateDir, state.ScratchDirName))
+	if free < MinimumFreeBytes {
+		check.Status = StatusError
+		check.Hint = hint
+	} else if free < LowFreeBytes {
+		check.Status = StatusWarning
+		check.Hint = hint
+	}
+	return check
+}
+
+// checkDatabase checks that the given state database is accessible and that its schema is up to
+// date
+func checkDatabase(db *sql.DB, stateDBPath string) []Check {
+	var sqliteVersion string
+	err := db.QueryRow("SELECT sqlite_version();").Scan(&sqliteVersion)
+	if err != nil {
+		return []Check{{
+			Name:    "state database",
+			Status:  StatusError,
+			Message: fmt.Sprintf("Could not query state database (%s): %s", stateDBPath, err.Error()),
+			Hint:    "Check the permissions of the state database file, and that it is not corrupted",
+		}}
+	}
+	checks := []Check{{Name: "state database", Status: StatusOK, Message: fmt.Sprintf("%s (SQLite %s)", stateDBPath, sqliteVersion)}}
+
+	differences, err := state.CheckSchema(db)
+	if err != nil {
+		return append(checks, Check{Name: "schema", Status: StatusError, Message: fmt.Sprintf("Could not check schema: %s", err.Error())})
+	}
+	if len(differences) > 0 {
+		return append(checks, Check{
+			Name:    "schema",
+			Status:  StatusError,
+			Message: strings.Join(differences, "; "),
+			Hint:    "The state directory was created by an older version of shn - bring it up to date with \"shn state migrate\"",
+		})
+	}
+	return append(checks, Check{Name: "schema", Status: StatusOK, Message: "Up to date"})
+}
+
+// checkConfiguration checks for common misconfigurations in the given state configuration
+func checkConfiguration(config state.Config) []Check {
+	checks := []Check{}
+
+	if config.Scratch.Retention == state.ScratchRetentionKeep && config.Scratch.MaxAge == "" {
+		checks = append(checks, Check{
+			Name:    "scratch retention",
+			Status:  StatusWarning,
+			Message: "Scratch directories are kept forever",
+			Hint:    "Set scratch.max_age in the state configuration (e.g. \"168h\") so that old scratch directories get pruned",
+		})
+	}
+
+	_, err := server.NewConfigAuthenticator(config.Server)
+	if err != nil {
+		checks = append(checks, Check{
+			Name:    "server tokens",
+			Status:  StatusError,
+			Message: err.Error(),
+			Hint:    "Make sure each token in the server section of the state configuration has a valid role and that any environment variables it refers to are set",
+		})
+	}
+
+	_, err = staging.Backends(config.Staging)
+	if err != nil {
+		checks = append(checks, Check{
+			Name:    "staging",
+			Status:  StatusError,
+			Message: err.Error(),
+			Hint:    "Fix the staging section of the state configuration",
+		})
+	}
+
+	if len(checks) == 0 {
+		checks = append(checks, Check{Name: "state configuration", Status: StatusOK, Message: "No problems found"})
+	}
+	return checks
+}
+
+// checkRegistrations checks that the specifications of the registered components and flows can
+// still be read
+func checkRegistrations(store state.Store) []Check {
+	problems := []string{}
+
+	componentsChan := make(chan components.ComponentMetadata)
+	listErrChan := make(chan error, 1)
+	go func() {
+		listErrChan <- components.ListComponents(context.Background(), store, componentsChan, components.ComponentFilter{}, components.Page{})
+	}()
+	for component := range componentsChan {
+		if _, err := os.Stat(component.SpecificationPath); err != nil {
+			problems = append(problems, fmt.Sprintf("component %s (%s)", component.ID, err.Error()))
+		}
+	}
+	if listErr := <-listErrChan; listErr != nil {
+		return []Check{{Name: "registrations", Status: StatusError, Message: fmt.Sprintf("Could not list components: %s", listErr.Error())}}
+	}
+
+	flowsChan := make(chan flows.FlowMetadata)
+	go func() {
+		listErrChan <- flows.ListFlows(context.Background(), store, flowsChan, "", nil)
+	}()
+	registeredFlows := 0
+	for flow := range flowsChan {
+		registeredFlows++
+		if _, err := flows.ReadSpecificationFile(flow.SpecificationPath); err != nil {
+			problems = append(problems, fmt.Sprintf("flow %s (%s)", flow.ID, err.Error()))
+		}
+	}
+	if listErr := <-listErrChan; listErr != nil {
+		return []Check{{Name: "registrations", Status: StatusError, Message: fmt.Sprintf("Could not list flows: %s", listErr.Error())}}
+	}
+
+	if len(problems) > 0 {
+		return []Check{{
+			Name:    "registrations",
+			Status:  StatusWarning,
+			Message: fmt.Sprintf("Unreadable specifications: %s", strings.Join(problems, "; ")),
+			Hint:    "Restore the specification files, or remove the affected components (shn components remove)",
+		}}
+	}
+	return []Check{{Name: "registrations", Status: StatusOK, Message: fmt.Sprintf("%d flows registered", registeredFlows)}}
+}
+
+// compareVersions compares two dotted version strings (e.g. "1.40" and "1.25") numerically,
+// returning a negative number, zero, or a positive number if a is less than, equal to, or greater
+// than b
+func compareVersions(a, b string) int {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var aPart, bPart int
+		if i < len(aParts) {
+			fmt.Sscanf(aParts[i], "%d", &aPart)
+		}
+		if i < len(bParts) {
+			fmt.Sscanf(bParts[i], "%d", &bPart)
+		}
+		if aPart != bPart {
+			return aPart - bPart
+		}
+	}
+	return 0
+}
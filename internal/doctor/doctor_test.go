@@ -0,0 +1,111 @@
+package doctor
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/internal"
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestCompareVersions(t *testing.T) {
+	type compareTest struct {
+		a, b     string
+		expected int
+	}
+
+	testCases := []compareTest{
+		{"1.40", "1.25", 1},
+		{"1.25", "1.25", 0},
+		{"1.9", "1.25", -1},
+		{"1.25.1", "1.25", 1},
+		{"2", "1.40", 1},
+	}
+
+	for i, testCase := range testCases {
+		actual := compareVersions(testCase.a, testCase.b)
+		if (actual > 0) != (testCase.expected > 0) || (actual < 0) != (testCase.expected < 0) {
+			t.Errorf("[Test %d] Unexpected comparison of %s and %s: expected sign of %d, actual=%d", i, testCase.a, testCase.b, testCase.expected, actual)
+		}
+	}
+}
+
+func TestCheckConfiguration(t *testing.T) {
+	type configurationTest struct {
+		config         state.Config
+		expectedName   string
+		expectedStatus string
+	}
+
+	testCases := []configurationTest{
+		{
+			config:         state.Config{Scratch: state.ScratchConfiguration{Retention: state.ScratchRetentionKeepFailed}},
+			expectedName:   "state configuration",
+			expectedStatus: StatusOK,
+		},
+		{
+			config:         state.Config{Scratch: state.ScratchConfiguration{Retention: state.ScratchRetentionKeep}},
+			expectedName:   "scratch retention",
+			expectedStatus: StatusWarning,
+		},
+		{
+			config: state.Config{
+				Scratch: state.ScratchConfiguration{Retention: state.ScratchRetentionKeepFailed},
+				Server:  state.ServerConfiguration{Tokens: []state.TokenConfiguration{{Token: "env:SHNORKY_DOCTOR_TEST_UNSET_TOKEN", Role: "admin"}}},
+			},
+			expectedName:   "server tokens",
+			expectedStatus: StatusError,
+		},
+	}
+
+	for i, testCase := range testCases {
+		checks := checkConfiguration(testCase.config)
+		if len(checks) != 1 {
+			t.Fatalf("[Test %d] Unexpected number of checks: expected=1, actual=%d (%v)", i, len(checks), checks)
+		}
+		if checks[0].Name != testCase.expectedName || checks[0].Status != testCase.expectedStatus {
+			t.Errorf("[Test %d] Unexpected check: expected=%s/%s, actual=%s/%s", i, testCase.expectedName, testCase.expectedStatus, checks[0].Name, checks[0].Status)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "shnorky-doctor-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+
+	originalRetryInterval := internal.DockerRetryInterval
+	internal.DockerRetryInterval = time.Millisecond
+	defer func() { internal.DockerRetryInterval = originalRetryInterval }()
+
+	stateDir := path.Join(tempDir, "state")
+	checks := Run(context.Background(), stateDir)
+	last := checks[len(checks)-1]
+	if last.Name != "state directory" || last.Status != StatusError || last.Hint == "" {
+		t.Errorf("Unexpected result for missing state directory: %v", last)
+	}
+	if _, err := os.Stat(stateDir); !os.IsNotExist(err) {
+		t.Errorf("Checking a missing state directory created it")
+	}
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", err.Error())
+	}
+	checks = Run(context.Background(), stateDir)
+	statuses := map[string]string{}
+	for _, check := range checks {
+		statuses[check.Name] = check.Status
+	}
+	for _, name := range []string{"state directory", "state database", "schema", "state configuration", "registrations"} {
+		if statuses[name] != StatusOK {
+			t.Errorf("Unexpected status for check (%s) on fresh state directory: %s", name, statuses[name])
+		}
+	}
+}
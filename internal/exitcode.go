@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+// Exit codes of the shn CLI, which distinguish between the ways in which commands can fail so that
+// CI systems wrapping shnorky can branch on the type of failure
+const (
+	// ExitCodeFailure is returned for failures which do not fall into any of the other categories
+	ExitCodeFailure = 1
+	// ExitCodeUsage is returned when a command is invoked with unknown commands, flags, or arguments
+	ExitCodeUsage = 2
+	// ExitCodeValidation is returned when a component or flow specification is invalid
+	ExitCodeValidation = 3
+	// ExitCodeBuildFailure is returned when the docker daemon fails to build the image for a
+	// component
+	ExitCodeBuildFailure = 4
+	// ExitCodeStepFailure is returned when the container of a component execution (or of a step or
+	// hook of a flow run) exits with a non-zero code
+	ExitCodeStepFailure = 5
+	// ExitCodeTimeout is returned when an operation does not finish within the time it is allowed
+	ExitCodeTimeout = 6
+	// ExitCodeState is returned when the state database cannot be read from or written to
+	ExitCodeState = 7
+)
+
+// ExitCode returns the exit code which describes the given error (ExitCodeFailure if it does not
+// fall into any more specific category). Errors are classified by the errors they wrap.
+func ExitCode(err error) int {
+	var buildErr *components.BuildFailedError
+	var executionErr *components.ExecutionFailedError
+	var specificationErr *components.InvalidSpecificationError
+	var sqliteErr sqlite3.Error
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &buildErr):
+		return ExitCodeBuildFailure
+	case errors.As(err, &executionErr):
+		return ExitCodeStepFailure
+	case errors.As(err, &specificationErr):
+		return ExitCodeValidation
+	case errors.Is(err, context.DeadlineExceeded):
+		return ExitCodeTimeout
+	case errors.As(err, &sqliteErr), errors.Is(err, sql.ErrConnDone), errors.Is(err, sql.ErrTxDone):
+		return ExitCodeState
+	}
+	return ExitCodeFailure
+}
+
+// ExitCodeHook - logrus hook which selects the code that the logger exits with after a fatal log
+// entry, based on the error in the entry's "error" field (see ExitCode). Loggers only exit with the
+// selected code if their ExitFunc is that of the hook.
+type ExitCodeHook struct {
+	code int
+}
+
+// NewExitCodeHook creates an ExitCodeHook which selects ExitCodeFailure unless a fatal entry's error
+// is more specific
+func NewExitCodeHook() *ExitCodeHook {
+	return &ExitCodeHook{code: ExitCodeFailure}
+}
+
+// Levels returns the levels of the log entries that the hook applies to (only fatal entries)
+func (hook *ExitCodeHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.FatalLevel}
+}
+
+// Fire selects the exit code for the error in the given entry's "error" field, if it has one
+func (hook *ExitCodeHook) Fire(entry *logrus.Entry) error {
+	hook.code = ExitCodeFailure
+	if err, ok := entry.Data[logrus.ErrorKey].(error); ok {
+		hook.code = ExitCode(err)
+	}
+	return nil
+}
+
+// ExitFunc exits the process with the code selected by the most recent fatal entry. The code that
+// logrus passes to it is ignored.
+func (hook *ExitCodeHook) ExitFunc(int) {
+	os.Exit(hook.code)
+}
@@ -0,0 +1,57 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"github.com/mattn/go-sqlite3"
+	"github.com/sirupsen/logrus"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+func TestExitCode(t *testing.T) {
+	type ExitCodeTest struct {
+		err      error
+		expected int
+	}
+
+	tests := []ExitCodeTest{
+		{err: nil, expected: 0},
+		{err: errors.New("something went wrong"), expected: ExitCodeFailure},
+		{err: &components.InvalidSpecificationError{Err: components.ErrInvalidMountType}, expected: ExitCodeValidation},
+		{err: fmt.Errorf("Could not build flow: %w", &components.BuildFailedError{ComponentID: "component"}), expected: ExitCodeBuildFailure},
+		{err: fmt.Errorf("Could not execute flow: %w", &components.ExecutionFailedError{ExitCode: 1}), expected: ExitCodeStepFailure},
+		{err: fmt.Errorf("Service did not start: %w", context.DeadlineExceeded), expected: ExitCodeTimeout},
+		{err: fmt.Errorf("Could not insert run: %w", sqlite3.Error{Code: sqlite3.ErrLocked}), expected: ExitCodeState},
+	}
+
+	for i, test := range tests {
+		exitCode := ExitCode(test.err)
+		if exitCode != test.expected {
+			t.Errorf("[Test %d] Unexpected exit code: expected=%d, actual=%d", i, test.expected, exitCode)
+		}
+	}
+}
+
+func TestExitCodeHook(t *testing.T) {
+	log := logrus.New()
+	log.SetOutput(ioutil.Discard)
+	hook := NewExitCodeHook()
+	log.AddHook(hook)
+	exitCode := 0
+	log.ExitFunc = func(int) { exitCode = hook.code }
+
+	log.WithField("error", &components.ExecutionFailedError{ExitCode: 1}).Fatal("Could not execute flow")
+	if exitCode != ExitCodeStepFailure {
+		t.Errorf("Unexpected exit code for fatal entry with error: expected=%d, actual=%d", ExitCodeStepFailure, exitCode)
+	}
+
+	log.Fatal("Could not execute flow")
+	if exitCode != ExitCodeFailure {
+		t.Errorf("Unexpected exit code for fatal entry without error: expected=%d, actual=%d", ExitCodeFailure, exitCode)
+	}
+}
@@ -1,9 +1,14 @@
 package internal
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"strings"
 
 	"github.com/sirupsen/logrus"
+
+	"github.com/simiotics/shnorky/components"
 )
 
 // LogLevels - mapping between log level specification strings and logrus Level values
@@ -17,20 +22,104 @@ var LogLevels = map[string]logrus.Level{
 	"PANIC": logrus.PanicLevel,
 }
 
+// LogFormats - mapping between log format specification strings and the logrus formatters which
+// write log entries in those formats
+var LogFormats = map[string]logrus.Formatter{
+	"text": &logrus.TextFormatter{},
+	"json": &logrus.JSONFormatter{},
+}
+
+// DefaultLogLevel is the log level used if neither the LOG_LEVEL environment variable nor the
+// --log-level flag is set
+var DefaultLogLevel = "WARN"
+
+// DefaultLogFormat is the log format used if neither the LOG_FORMAT environment variable nor the
+// --log-format flag is set
+var DefaultLogFormat = "text"
+
 // Accepts the following environment variables:
 // + LOG_LEVEL (value should be one of TRACE, DEBUG, INFO, WARN, ERROR, FATAL, PANIC)
+// + LOG_FORMAT (value should be one of text, json)
+//
+// The logger exits with the code (see ExitCode) describing the error of any fatal entry it logs.
 func GenerateLogger() *logrus.Logger {
 	log := logrus.New()
+	// The exit code hook precedes the redaction hook, which may replace errors with redacted copies
+	exitCodeHook := NewExitCodeHook()
+	log.AddHook(exitCodeHook)
+	log.ExitFunc = exitCodeHook.ExitFunc
+	log.AddHook(RedactionHook{})
+
+	err := ConfigureLogger(log, EnvironmentLogLevel(), EnvironmentLogFormat())
+	if err != nil {
+		log.Fatal(err.Error())
+	}
+
+	return log
+}
 
-	rawLevel := os.Getenv("LOG_LEVEL")
-	if rawLevel == "" {
-		rawLevel = "WARN"
+// EnvironmentLogLevel returns the log level specified by the LOG_LEVEL environment variable, or
+// DefaultLogLevel if it is not set
+func EnvironmentLogLevel() string {
+	if rawLevel := os.Getenv("LOG_LEVEL"); rawLevel != "" {
+		return rawLevel
 	}
-	level, ok := LogLevels[rawLevel]
+	return DefaultLogLevel
+}
+
+// EnvironmentLogFormat returns the log format specified by the LOG_FORMAT environment variable, or
+// DefaultLogFormat if it is not set
+func EnvironmentLogFormat() string {
+	if rawFormat := os.Getenv("LOG_FORMAT"); rawFormat != "" {
+		return rawFormat
+	}
+	return DefaultLogFormat
+}
+
+// ConfigureLogger sets the level (one of the keys of LogLevels) and format (one of the keys of
+// LogFormats) of the given logger. Both are case-insensitive.
+func ConfigureLogger(log *logrus.Logger, rawLevel, rawFormat string) error {
+	level, ok := LogLevels[strings.ToUpper(rawLevel)]
 	if !ok {
-		log.Fatalf("Invalid value for LOG_LEVEL environment variable: %s. Choose one of TRACE, DEBUG, INFO, WARN, ERROR, FATAL, PANIC", rawLevel)
+		return fmt.Errorf("Invalid log level: %s. Choose one of TRACE, DEBUG, INFO, WARN, ERROR, FATAL, PANIC", rawLevel)
+	}
+	formatter, ok := LogFormats[strings.ToLower(rawFormat)]
+	if !ok {
+		return fmt.Errorf("Invalid log format: %s. Choose one of text, json", rawFormat)
 	}
 	log.SetLevel(level)
+	log.SetFormatter(formatter)
+	return nil
+}
 
-	return log
+// RedactionHook - logrus hook which masks sensitive values (see components.Redact) in the messages
+// and fields of log entries before they are written
+type RedactionHook struct{}
+
+// Levels returns the levels of the log entries that the hook applies to (all of them)
+func (hook RedactionHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire masks sensitive values in the message of the given log entry, and in those of its fields
+// which are strings or errors. The fields are copied rather than modified in place, since entries
+// share them with the loggers they were created from.
+func (hook RedactionHook) Fire(entry *logrus.Entry) error {
+	entry.Message = components.Redact(entry.Message)
+	data := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch typedValue := value.(type) {
+		case string:
+			data[key] = components.Redact(typedValue)
+		case error:
+			data[key] = typedValue
+			if redacted := components.Redact(typedValue.Error()); redacted != typedValue.Error() {
+				data[key] = errors.New(redacted)
+			}
+		default:
+			data[key] = value
+		}
+	}
+	entry.Data = data
+	return nil
 }
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+func TestRedactionHook(t *testing.T) {
+	components.MarkSensitive("shnorky-test-logged-secret")
+
+	var buffer bytes.Buffer
+	log := logrus.New()
+	log.SetOutput(&buffer)
+	log.AddHook(RedactionHook{})
+
+	logger := log.WithField("value", "shnorky-test-logged-secret")
+	logger.WithField("error", errors.New("bad shnorky-test-logged-secret")).Warn("Using shnorky-test-logged-secret")
+
+	output := buffer.String()
+	if strings.Contains(output, "shnorky-test-logged-secret") {
+		t.Errorf("Sensitive value was not redacted from log output: %s", output)
+	}
+	if strings.Count(output, components.RedactedValue) != 3 {
+		t.Errorf("Unexpected log output: %s", output)
+	}
+	if logger.Data["value"] != "shnorky-test-logged-secret" {
+		t.Errorf("Hook modified the fields of the logger the entry was created from")
+	}
+}
+
+func TestConfigureLogger(t *testing.T) {
+	type configureTest struct {
+		level             string
+		format            string
+		returnsError      bool
+		expectedLevel     logrus.Level
+		expectedFormatter logrus.Formatter
+	}
+
+	testCases := []configureTest{
+		{level: "DEBUG", format: "text", expectedLevel: logrus.DebugLevel, expectedFormatter: LogFormats["text"]},
+		{level: "info", format: "JSON", expectedLevel: logrus.InfoLevel, expectedFormatter: LogFormats["json"]},
+		{level: "verbose", format: "text", returnsError: true},
+		{level: "WARN", format: "xml", returnsError: true},
+	}
+
+	for i, testCase := range testCases {
+		log := logrus.New()
+		err := ConfigureLogger(log, testCase.level, testCase.format)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+			continue
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+			continue
+		}
+		if testCase.returnsError {
+			continue
+		}
+		if log.GetLevel() != testCase.expectedLevel {
+			t.Errorf("[Test %d] Unexpected level: expected=%s, actual=%s", i, testCase.expectedLevel, log.GetLevel())
+		}
+		if log.Formatter != testCase.expectedFormatter {
+			t.Errorf("[Test %d] Unexpected formatter: %T", i, log.Formatter)
+		}
+	}
+}
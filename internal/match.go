@@ -0,0 +1,61 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+	"github.com/sirupsen/logrus"
+)
+
+// Confirm writes the given prompt to out and reads the answer from in. It returns true if the
+// answer is "y" or "yes" (in any case), and false otherwise.
+func Confirm(in io.Reader, out io.Writer, prompt string) bool {
+	fmt.Fprintf(out, "%s [y/N] ", prompt)
+	answer, err := bufio.NewReader(in).ReadString('\n')
+	if err != nil && answer == "" {
+		return false
+	}
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
+}
+
+// ResolveComponentIDs returns the IDs of the components which the given --id value refers to. A
+// literal ID is returned as is. If the value is a pattern (see components.IsIDPattern), the IDs of
+// the matching components are written to out and, unless assumeYes is true, the user is asked (on
+// in) to confirm that the given action should be applied to all of them. Fatally errors out if no
+// components match the pattern or the user does not confirm.
+func ResolveComponentIDs(store state.Store, log *logrus.Logger, id, action string, assumeYes bool, in io.Reader, out io.Writer) []string {
+	if !components.IsIDPattern(id) {
+		return []string{id}
+	}
+
+	componentsChan := make(chan components.ComponentMetadata)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- components.ListComponents(context.Background(), store, componentsChan, components.ComponentFilter{IDPattern: id}, components.Page{})
+	}()
+	componentIDs := []string{}
+	for component := range componentsChan {
+		componentIDs = append(componentIDs, component.ID)
+	}
+	if err := <-errChan; err != nil {
+		log.WithFields(logrus.Fields{"pattern": id, "error": err}).Fatal("Could not list components matching pattern")
+	}
+	if len(componentIDs) == 0 {
+		log.WithField("pattern", id).Fatal("No components match pattern")
+	}
+
+	fmt.Fprintf(out, "Components matching %s:\n", id)
+	for _, componentID := range componentIDs {
+		fmt.Fprintf(out, "  %s\n", componentID)
+	}
+	if !assumeYes && !Confirm(in, out, fmt.Sprintf("%s %d components?", action, len(componentIDs))) {
+		log.Fatal("Aborted")
+	}
+	return componentIDs
+}
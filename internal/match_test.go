@@ -0,0 +1,35 @@
+package internal
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestConfirm(t *testing.T) {
+	type confirmTest struct {
+		input    string
+		expected bool
+	}
+
+	tests := []confirmTest{
+		{input: "y\n", expected: true},
+		{input: "YES\n", expected: true},
+		{input: " yes ", expected: true},
+		{input: "n\n", expected: false},
+		{input: "\n", expected: false},
+		{input: "", expected: false},
+		{input: "yesterday\n", expected: false},
+	}
+
+	for i, test := range tests {
+		var out bytes.Buffer
+		actual := Confirm(strings.NewReader(test.input), &out, "Remove 2 components?")
+		if actual != test.expected {
+			t.Errorf("[Test %d] Unexpected answer for input (%q): expected=%t, actual=%t", i, test.input, test.expected, actual)
+		}
+		if out.String() != "Remove 2 components? [y/N] " {
+			t.Errorf("[Test %d] Unexpected prompt: %q", i, out.String())
+		}
+	}
+}
@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"context"
+
+	docker "github.com/docker/docker/client"
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/flows"
+	"github.com/sirupsen/logrus"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// ReconcileExecutions reconciles the executions in the given state database with the containers
+// known to the docker daemon (see components.ReconcileExecutions), logging what it changed and any
+// containers unknown to the state database, and then records the flow runs which were abandoned by
+// the processes executing them as failed (see flows.ReconcileRuns). Failures to reconcile are logged
+// as warnings rather than interrupting the command.
+func ReconcileExecutions(store state.Store, dockerClient *docker.Client, log *logrus.Logger) components.Reconciliation {
+	reconciliation, err := components.ReconcileExecutions(context.Background(), store, dockerClient)
+	if err != nil {
+		log.WithField("error", err).Warn("Could not reconcile executions with docker")
+		return reconciliation
+	}
+	for _, execution := range reconciliation.Updated {
+		log.WithFields(logrus.Fields{"execution": execution.ID, "exit_code": *execution.ExitCode}).Info("Recorded result of execution which finished while shnorky was not watching it")
+	}
+	for _, execution := range reconciliation.Missing {
+		log.WithField("execution", execution.ID).Warn("Container for unfinished execution no longer exists; recorded execution as failed")
+	}
+	for _, container := range reconciliation.Unknown {
+		log.WithFields(logrus.Fields{"container": container.ContainerID, "execution": container.ExecutionID}).Warn("Container labelled by shnorky does not correspond to any execution in the state database")
+	}
+
+	abandonedRuns, err := flows.ReconcileRuns(store)
+	if err != nil {
+		log.WithField("error", err).Warn("Could not reconcile flow runs")
+	}
+	for _, run := range abandonedRuns {
+		log.WithFields(logrus.Fields{"flow": run.FlowID, "run": run.ID}).Warn("Flow run was abandoned by the process executing it; recorded run as failed")
+	}
+	return reconciliation
+}
@@ -0,0 +1,393 @@
+// Package tui implements "shn ui", a terminal dashboard which shows the registered flows, their
+// recent runs, the status of each step in a run, and the logs of a step's execution.
+package tui
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/simiotics/shnorky/flows"
+)
+
+// Panes of the dashboard, in the order that tab cycles through them
+const (
+	PaneFlows = iota
+	PaneRuns
+	PaneSteps
+	PaneLogs
+)
+
+// Model - the state of the dashboard. A Model only changes in response to Refresh, HandleKey, and
+// Resize, so it can be driven by a terminal (see Run) or by tests.
+type Model struct {
+	source Source
+	width  int
+	height int
+	pane   int
+
+	flows []flows.FlowMetadata
+	runs  []flows.FlowRunMetadata
+	steps []flows.StepStatus
+	logs  []string
+
+	flowIndex int
+	runIndex  int
+	stepIndex int
+	// logOffset is the index of the first log line on screen. followLogs is true if the view should
+	// stay at the end of the logs as new lines arrive.
+	logOffset  int
+	followLogs bool
+
+	err error
+}
+
+// NewModel creates a Model which displays data from the given source on a screen of the given
+// dimensions
+func NewModel(source Source, width, height int) *Model {
+	return &Model{source: source, width: width, height: height, followLogs: true}
+}
+
+// Resize changes the dimensions of the screen that the model is rendered to
+func (model *Model) Resize(width, height int) {
+	model.width = width
+	model.height = height
+	model.clampLogOffset()
+}
+
+// Pane returns the pane which currently has focus
+func (model *Model) Pane() int {
+	return model.pane
+}
+
+// Refresh reloads the flows, runs, steps, and (if the logs pane is open) logs from the model's
+// source. The selected flow, run, and step are preserved if they still exist.
+func (model *Model) Refresh() {
+	model.err = nil
+
+	selectedFlow := ""
+	if model.flowIndex < len(model.flows) {
+		selectedFlow = model.flows[model.flowIndex].ID
+	}
+	flowList, err := model.source.Flows()
+	if err != nil {
+		model.err = err
+		return
+	}
+	model.flows = flowList
+	model.flowIndex = 0
+	for i, flow := range model.flows {
+		if flow.ID == selectedFlow {
+			model.flowIndex = i
+		}
+	}
+
+	model.loadRuns()
+}
+
+// loadRuns reloads the runs of the selected flow (and everything below them)
+func (model *Model) loadRuns() {
+	selectedRun := ""
+	if model.runIndex < len(model.runs) {
+		selectedRun = model.runs[model.runIndex].ID
+	}
+	model.runs = []flows.FlowRunMetadata{}
+	model.runIndex = 0
+	if model.flowIndex < len(model.flows) {
+		runs, err := model.source.Runs(model.flows[model.flowIndex].ID)
+		if err != nil {
+			model.err = err
+		}
+		model.runs = runs
+	}
+	for i, run := range model.runs {
+		if run.ID == selectedRun {
+			model.runIndex = i
+		}
+	}
+
+	model.loadSteps()
+}
+
+// loadSteps reloads the steps of the selected run (and the logs of the selected step)
+func (model *Model) loadSteps() {
+	selectedStep := ""
+	if model.stepIndex < len(model.steps) {
+		selectedStep = model.steps[model.stepIndex].Step
+	}
+	model.steps = []flows.StepStatus{}
+	model.stepIndex = 0
+	if model.runIndex < len(model.runs) {
+		steps, err := model.source.Steps(model.runs[model.runIndex])
+		if err != nil {
+			model.err = err
+		}
+		model.steps = steps
+	}
+	for i, step := range model.steps {
+		if step.Step == selectedStep {
+			model.stepIndex = i
+		}
+	}
+
+	if model.pane == PaneLogs {
+		model.loadLogs()
+	}
+}
+
+// loadLogs reloads the logs of the selected step
+func (model *Model) loadLogs() {
+	model.logs = []string{}
+	if model.stepIndex < len(model.steps) && model.steps[model.stepIndex].ExecutionID != "" {
+		logs, err := model.source.Logs(model.steps[model.stepIndex].ExecutionID)
+		if err != nil {
+			model.err = err
+		}
+		model.logs = logs
+	}
+	model.clampLogOffset()
+}
+
+// HandleKey updates the model in response to the given key press. Keys are named as by ReadKey
+// (e.g. "up", "tab", "q"). The return value is true if the key asks the dashboard to exit.
+func (model *Model) HandleKey(key string) bool {
+	switch key {
+	case "q", "ctrl+c":
+		return true
+	case "tab":
+		if model.pane < PaneSteps {
+			model.pane++
+		} else if model.pane == PaneSteps {
+			model.pane = PaneFlows
+		}
+	case "shift+tab":
+		if model.pane > PaneFlows && model.pane <= PaneSteps {
+			model.pane--
+		} else if model.pane == PaneFlows {
+			model.pane = PaneSteps
+		}
+	case "enter":
+		if model.pane == PaneSteps {
+			model.pane = PaneLogs
+			model.followLogs = true
+			model.loadLogs()
+		} else if model.pane < PaneSteps {
+			model.pane++
+		}
+	case "esc":
+		if model.pane == PaneLogs {
+			model.pane = PaneSteps
+		}
+	case "up", "k":
+		model.move(-1)
+	case "down", "j":
+		model.move(1)
+	case "pgup":
+		model.move(-model.listHeight())
+	case "pgdown":
+		model.move(model.listHeight())
+	case "home", "g":
+		model.move(-len(model.logs) - len(model.flows) - len(model.runs) - len(model.steps))
+	case "end", "G":
+		model.move(len(model.logs) + len(model.flows) + len(model.runs) + len(model.steps))
+	}
+	return false
+}
+
+// move moves the selection in the focused pane (or scrolls the logs) by the given number of rows
+func (model *Model) move(delta int) {
+	switch model.pane {
+	case PaneFlows:
+		model.flowIndex = clamp(model.flowIndex+delta, len(model.flows))
+		model.runIndex = 0
+		model.stepIndex = 0
+		model.loadRuns()
+	case PaneRuns:
+		model.runIndex = clamp(model.runIndex+delta, len(model.runs))
+		model.stepIndex = 0
+		model.loadSteps()
+	case PaneSteps:
+		model.stepIndex = clamp(model.stepIndex+delta, len(model.steps))
+	case PaneLogs:
+		model.logOffset += delta
+		model.followLogs = false
+		model.clampLogOffset()
+	}
+}
+
+// clamp restricts index to the range [0, length)
+func clamp(index, length int) int {
+	if index >= length {
+		index = length - 1
+	}
+	if index < 0 {
+		index = 0
+	}
+	return index
+}
+
+// listHeight is the number of rows available to list items (or log lines) in a pane
+func (model *Model) listHeight() int {
+	// One row each for the header, the pane titles, and the status line
+	height := model.height - 3
+	if height < 1 {
+		height = 1
+	}
+	return height
+}
+
+func (model *Model) clampLogOffset() {
+	maxOffset := len(model.logs) - model.listHeight()
+	if maxOffset < 0 {
+		maxOffset = 0
+	}
+	if model.followLogs || model.logOffset > maxOffset {
+		model.logOffset = maxOffset
+	}
+	if model.logOffset < 0 {
+		model.logOffset = 0
+	}
+	if model.logOffset == maxOffset {
+		model.followLogs = true
+	}
+}
+
+// View renders the model as a screen of text (without any terminal control sequences) with at most
+// the model's height in lines, each of which is at most the model's width in characters
+func (model *Model) View() string {
+	lines := []string{
+		fit("shn ui - tab: switch pane, enter: open, esc: back, arrows/pgup/pgdown: move, q: quit", model.width),
+	}
+	if model.pane == PaneLogs {
+		lines = append(lines, model.logsView()...)
+	} else {
+		lines = append(lines, model.listsView()...)
+	}
+
+	status := fmt.Sprintf("%d flows", len(model.flows))
+	if model.err != nil {
+		status = "Error: " + strings.Replace(model.err.Error(), "\n", " ", -1)
+	}
+	lines = append(lines, fit(status, model.width))
+	return strings.Join(lines, "\n")
+}
+
+// listsView renders the flows, runs, and steps panes side by side
+func (model *Model) listsView() []string {
+	flowRows := make([]string, len(model.flows))
+	for i, flow := range model.flows {
+		flowRows[i] = flow.ID
+	}
+	runRows := make([]string, len(model.runs))
+	for i, run := range model.runs {
+		runRows[i] = fmt.Sprintf("%s %s %s", run.CreatedAt.Local().Format("2006-01-02 15:04:05"), run.Status, run.ID)
+	}
+	stepRows := make([]string, len(model.steps))
+	for i, step := range model.steps {
+		status := step.Status
+		if step.Status == flows.StepStatusFailed && step.ExitCode != nil {
+			status = fmt.Sprintf("%s (exit %d)", status, *step.ExitCode)
+		}
+		stepRows[i] = fmt.Sprintf("%s [%s] %s", step.Step, status, step.ComponentID)
+	}
+
+	columnWidth := (model.width - 2) / 3
+	if columnWidth < 1 {
+		columnWidth = 1
+	}
+	columns := [][]string{
+		model.column("Flows", flowRows, model.flowIndex, PaneFlows, columnWidth),
+		model.column("Runs", runRows, model.runIndex, PaneRuns, columnWidth),
+		model.column("Steps", stepRows, model.stepIndex, PaneSteps, columnWidth),
+	}
+	lines := make([]string, len(columns[0]))
+	for i := range lines {
+		lines[i] = strings.TrimRight(strings.Join([]string{columns[0][i], columns[1][i], columns[2][i]}, "|"), " ")
+	}
+	return lines
+}
+
+// column renders a single pane with the given title and rows, scrolled so that the selected row is
+// visible. The selected row is marked with ">" if the pane has focus and with "*" otherwise.
+func (model *Model) column(title string, rows []string, selected, pane, width int) []string {
+	height := model.listHeight()
+	offset := 0
+	if selected >= height {
+		offset = selected - height + 1
+	}
+
+	if model.pane == pane {
+		title = "[" + title + "]"
+	}
+	lines := []string{pad(fit(" "+title, width), width)}
+	for i := offset; i < offset+height; i++ {
+		line := ""
+		if i < len(rows) {
+			marker := " "
+			if i == selected {
+				marker = "*"
+				if model.pane == pane {
+					marker = ">"
+				}
+			}
+			line = marker + rows[i]
+		}
+		lines = append(lines, pad(fit(line, width), width))
+	}
+	return lines
+}
+
+// logsView renders the logs of the selected step
+func (model *Model) logsView() []string {
+	title := "Logs"
+	if model.stepIndex < len(model.steps) {
+		step := model.steps[model.stepIndex]
+		title = fmt.Sprintf("Logs: %s (%s)", step.Step, step.Status)
+		if step.ExecutionID == "" {
+			title += " - not started"
+		}
+	}
+	lines := []string{fit(title, model.width)}
+	for i := model.logOffset; i < model.logOffset+model.listHeight(); i++ {
+		line := ""
+		if i < len(model.logs) {
+			line = printable(model.logs[i])
+		}
+		lines = append(lines, fit(line, model.width))
+	}
+	return lines
+}
+
+// controlSequence matches the ANSI control sequences (e.g. colors) that containers may write to
+// their logs
+var controlSequence = regexp.MustCompile("\x1b\\[[0-9;?]*[ -/]*[@-~]")
+
+// printable replaces tabs in the given string with spaces and drops control sequences and any other
+// control characters, which would corrupt the screen
+func printable(value string) string {
+	value = controlSequence.ReplaceAllString(strings.Replace(value, "\t", "    ", -1), "")
+	return strings.Map(func(r rune) rune {
+		if r < ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, value)
+}
+
+// fit truncates the given string to at most width characters
+func fit(value string, width int) string {
+	runes := []rune(value)
+	if len(runes) > width {
+		return string(runes[:width])
+	}
+	return value
+}
+
+// pad pads the given string with spaces to width characters
+func pad(value string, width int) string {
+	length := len([]rune(value))
+	if length < width {
+		return value + strings.Repeat(" ", width-length)
+	}
+	return value
+}
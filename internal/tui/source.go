@@ -0,0 +1,67 @@
+package tui
+
+import (
+	"context"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/flows"
+	"github.com/simiotics/shnorky/state"
+)
+
+// Source - the data that the dashboard displays
+type Source interface {
+	// Flows returns all registered flows
+	Flows() ([]flows.FlowMetadata, error)
+	// Runs returns the most recent runs of the given flow, most recent first
+	Runs(flowID string) ([]flows.FlowRunMetadata, error)
+	// Steps returns the status of each step in the given flow run, in execution order
+	Steps(run flows.FlowRunMetadata) ([]flows.StepStatus, error)
+	// Logs returns the most recent lines of the logs of the given execution
+	Logs(executionID string) ([]string, error)
+}
+
+// DefaultRunsLimit is the number of recent runs of each flow that the dashboard displays
+var DefaultRunsLimit = 50
+
+// DefaultLogLines is the number of lines of logs that the dashboard retrieves for an execution
+var DefaultLogLines = 1000
+
+// stateSource - a Source backed by a state database and a docker daemon
+type stateSource struct {
+	ctx          context.Context
+	store        state.Store
+	dockerClient *docker.Client
+}
+
+// NewStateSource creates a Source which reads flows, runs, and executions from the given state
+// database and logs from the given docker client
+func NewStateSource(ctx context.Context, store state.Store, dockerClient *docker.Client) Source {
+	return &stateSource{ctx: ctx, store: store, dockerClient: dockerClient}
+}
+
+func (source *stateSource) Flows() ([]flows.FlowMetadata, error) {
+	flowsChan := make(chan flows.FlowMetadata)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- flows.ListFlows(source.ctx, source.store, flowsChan, "", nil)
+	}()
+	flowList := []flows.FlowMetadata{}
+	for flow := range flowsChan {
+		flowList = append(flowList, flow)
+	}
+	return flowList, <-errChan
+}
+
+func (source *stateSource) Runs(flowID string) ([]flows.FlowRunMetadata, error) {
+	return flows.SelectFlowRunsByFlowID(source.store, flowID, DefaultRunsLimit)
+}
+
+func (source *stateSource) Steps(run flows.FlowRunMetadata) ([]flows.StepStatus, error) {
+	return flows.RunStepStatuses(source.store, run)
+}
+
+func (source *stateSource) Logs(executionID string) ([]string, error) {
+	return components.ExecutionLogTail(source.ctx, source.dockerClient, executionID, DefaultLogLines)
+}
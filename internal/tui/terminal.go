@@ -0,0 +1,167 @@
+package tui
+
+import (
+	"context"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/filters"
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// RefreshInterval is the interval at which the dashboard reloads its data in the absence of docker
+// events
+var RefreshInterval = time.Second
+
+// escapeSequences maps the escape sequences that terminals send for special keys to key names
+var escapeSequences = map[string]string{
+	"\x1b[A":  "up",
+	"\x1b[B":  "down",
+	"\x1bOA":  "up",
+	"\x1bOB":  "down",
+	"\x1b[5~": "pgup",
+	"\x1b[6~": "pgdown",
+	"\x1b[H":  "home",
+	"\x1b[F":  "end",
+	"\x1b[1~": "home",
+	"\x1b[4~": "end",
+	"\x1b[Z":  "shift+tab",
+}
+
+// ParseKeys converts a chunk of input read from a terminal in raw mode into the names of the keys
+// that were pressed. Printable characters are named by themselves. Unrecognized escape sequences
+// are dropped.
+func ParseKeys(input []byte) []string {
+	keys := []string{}
+	remaining := string(input)
+	for remaining != "" {
+		if remaining[0] == 0x1b {
+			if remaining == "\x1b" {
+				return append(keys, "esc")
+			}
+			matched := false
+			for sequence, key := range escapeSequences {
+				if strings.HasPrefix(remaining, sequence) {
+					keys = append(keys, key)
+					remaining = remaining[len(sequence):]
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				// Skip the rest of the unrecognized sequence (up to and including its final byte)
+				end := 1
+				if len(remaining) > 1 && (remaining[1] == '[' || remaining[1] == 'O') {
+					end = 2
+					for end < len(remaining) && (remaining[end] < 0x40 || remaining[end] > 0x7e) {
+						end++
+					}
+					end++
+				}
+				if end > len(remaining) {
+					end = len(remaining)
+				}
+				remaining = remaining[end:]
+			}
+			continue
+		}
+
+		switch character := remaining[0]; character {
+		case '\t':
+			keys = append(keys, "tab")
+		case '\r', '\n':
+			keys = append(keys, "enter")
+		case 0x03:
+			keys = append(keys, "ctrl+c")
+		default:
+			if character >= ' ' && character < 0x7f {
+				keys = append(keys, string(character))
+			}
+		}
+		remaining = remaining[1:]
+	}
+	return keys
+}
+
+// Run displays the dashboard on the terminal attached to in and out until the user quits or the
+// given context is cancelled. The dashboard shows the flows and runs in the given state database,
+// and is refreshed whenever a container starts or stops on the given docker daemon (as well as
+// every RefreshInterval).
+func Run(ctx context.Context, store state.Store, dockerClient *docker.Client, in *os.File, out io.Writer) error {
+	fd := int(in.Fd())
+	restore, err := makeRaw(fd)
+	if err != nil {
+		return err
+	}
+	defer restore()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Alternate screen buffer, hidden cursor
+	io.WriteString(out, "\x1b[?1049h\x1b[?25l")
+	defer io.WriteString(out, "\x1b[?25h\x1b[?1049l")
+
+	width, height, err := terminalSize(fd)
+	if err != nil {
+		return err
+	}
+	model := NewModel(NewStateSource(ctx, store, dockerClient), width, height)
+	draw := func() {
+		io.WriteString(out, "\x1b[H\x1b[2J"+strings.Replace(model.View(), "\n", "\r\n", -1))
+	}
+	model.Refresh()
+	draw()
+
+	keys := make(chan []string)
+	readErrors := make(chan error, 1)
+	go func() {
+		buffer := make([]byte, 256)
+		for {
+			n, err := in.Read(buffer)
+			if err != nil {
+				readErrors <- err
+				return
+			}
+			keys <- ParseKeys(buffer[:n])
+		}
+	}()
+
+	eventsOptions := dockerTypes.EventsOptions{Filters: filters.NewArgs(filters.Arg("type", "container"))}
+	events, eventErrors := dockerClient.Events(ctx, eventsOptions)
+
+	ticker := time.NewTicker(RefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case err := <-readErrors:
+			return err
+		case pressedKeys := <-keys:
+			for _, key := range pressedKeys {
+				if model.HandleKey(key) {
+					return nil
+				}
+			}
+		case <-events:
+			model.Refresh()
+		case <-eventErrors:
+			// The dashboard still refreshes periodically if the event stream is unavailable
+			events, eventErrors = nil, nil
+			continue
+		case <-ticker.C:
+			if newWidth, newHeight, err := terminalSize(fd); err == nil {
+				model.Resize(newWidth, newHeight)
+			}
+			model.Refresh()
+		}
+		draw()
+	}
+}
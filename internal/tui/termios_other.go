@@ -0,0 +1,19 @@
+//go:build !linux && !darwin && !dragonfly && !freebsd && !netbsd && !openbsd
+// +build !linux,!darwin,!dragonfly,!freebsd,!netbsd,!openbsd
+
+package tui
+
+import (
+	"errors"
+	"runtime"
+)
+
+var errUnsupportedPlatform = errors.New("shn ui is not supported on " + runtime.GOOS)
+
+func makeRaw(fd int) (func(), error) {
+	return nil, errUnsupportedPlatform
+}
+
+func terminalSize(fd int) (int, int, error) {
+	return 0, 0, errUnsupportedPlatform
+}
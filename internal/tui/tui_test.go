@@ -0,0 +1,131 @@
+package tui
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/simiotics/shnorky/flows"
+)
+
+// fakeSource - a Source backed by in-memory data
+type fakeSource struct {
+	flows []flows.FlowMetadata
+	runs  map[string][]flows.FlowRunMetadata
+	steps map[string][]flows.StepStatus
+	logs  map[string][]string
+}
+
+func (source *fakeSource) Flows() ([]flows.FlowMetadata, error) {
+	return source.flows, nil
+}
+
+func (source *fakeSource) Runs(flowID string) ([]flows.FlowRunMetadata, error) {
+	return source.runs[flowID], nil
+}
+
+func (source *fakeSource) Steps(run flows.FlowRunMetadata) ([]flows.StepStatus, error) {
+	return source.steps[run.ID], nil
+}
+
+func (source *fakeSource) Logs(executionID string) ([]string, error) {
+	return source.logs[executionID], nil
+}
+
+func TestModel(t *testing.T) {
+	exitCode := 3
+	source := &fakeSource{
+		flows: []flows.FlowMetadata{{ID: "etl"}, {ID: "report"}},
+		runs: map[string][]flows.FlowRunMetadata{
+			"etl":    {{ID: "run-2", FlowID: "etl", Status: "failed"}, {ID: "run-1", FlowID: "etl", Status: "succeeded"}},
+			"report": {{ID: "run-3", FlowID: "report", Status: "running"}},
+		},
+		steps: map[string][]flows.StepStatus{
+			"run-2": {
+				{Step: "extract", ComponentID: "extractor", ExecutionID: "execution-1", Status: flows.StepStatusSucceeded},
+				{Step: "load", ComponentID: "loader", ExecutionID: "execution-2", Status: flows.StepStatusFailed, ExitCode: &exitCode},
+			},
+		},
+		logs: map[string][]string{
+			"execution-2": {"line 1", "line 2", "line 3\x1b[0m", "line 4", "line 5"},
+		},
+	}
+
+	model := NewModel(source, 120, 6)
+	model.Refresh()
+	view := model.View()
+	for _, expected := range []string{"[Flows]", ">etl", "failed run-2", "*extract [succeeded] extractor", "load [failed (exit 3)] loader"} {
+		if !strings.Contains(view, expected) {
+			t.Errorf("View does not contain %q:\n%s", expected, view)
+		}
+	}
+	for i, line := range strings.Split(view, "\n") {
+		if len(line) > 120 {
+			t.Errorf("Line %d of view is wider than the screen: %q", i, line)
+		}
+	}
+	if lines := len(strings.Split(view, "\n")); lines != 6 {
+		t.Errorf("Unexpected number of lines in view: expected 6, got %d", lines)
+	}
+
+	// Open the logs of the failed step
+	for _, key := range []string{"tab", "tab", "down", "enter"} {
+		if model.HandleKey(key) {
+			t.Fatalf("Key %s should not have quit", key)
+		}
+	}
+	if model.Pane() != PaneLogs {
+		t.Fatalf("Unexpected pane: expected %d, got %d", PaneLogs, model.Pane())
+	}
+	view = model.View()
+	// The logs view follows the end of the logs, and has room for 3 lines
+	if !strings.Contains(view, "Logs: load (failed)") || !strings.Contains(view, "line 3\nline 4\nline 5") {
+		t.Errorf("Unexpected logs view:\n%s", view)
+	}
+	model.HandleKey("pgup")
+	view = model.View()
+	if !strings.Contains(view, "line 1\nline 2\nline 3\n") {
+		t.Errorf("Unexpected logs view after scrolling up:\n%s", view)
+	}
+
+	// Selection survives refreshes
+	model.HandleKey("esc")
+	model.Refresh()
+	if view = model.View(); !strings.Contains(view, ">load") {
+		t.Errorf("Selection lost on refresh:\n%s", view)
+	}
+
+	// Selecting another flow shows its runs
+	model.HandleKey("tab")
+	model.HandleKey("down")
+	if view = model.View(); !strings.Contains(view, ">report") || !strings.Contains(view, "run-3") || strings.Contains(view, "run-2") {
+		t.Errorf("Unexpected view after selecting another flow:\n%s", view)
+	}
+
+	if !model.HandleKey("q") {
+		t.Error("Key q should have quit")
+	}
+}
+
+func TestParseKeys(t *testing.T) {
+	type parseKeysTest struct {
+		input    string
+		expected []string
+	}
+
+	tests := []parseKeysTest{
+		{"q", []string{"q"}},
+		{"\x1b", []string{"esc"}},
+		{"\x1b[A\x1b[B", []string{"up", "down"}},
+		{"\x1b[5~j\t\r", []string{"pgup", "j", "tab", "enter"}},
+		{"\x1b[Z\x03", []string{"shift+tab", "ctrl+c"}},
+		{"\x1b[1;5Ck", []string{"k"}},
+	}
+
+	for i, test := range tests {
+		keys := ParseKeys([]byte(test.input))
+		if !reflect.DeepEqual(keys, test.expected) {
+			t.Errorf("[Test %d] Unexpected keys for input %q: expected %v, got %v", i, test.input, test.expected, keys)
+		}
+	}
+}
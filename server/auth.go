@@ -0,0 +1,157 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// RoleViewer is the role of API clients which may only view flows, runs, and logs
+var RoleViewer = "viewer"
+
+// RoleOperator is the role of API clients which may also trigger flow runs and decide gate steps
+var RoleOperator = "operator"
+
+// RoleAdmin is the role of API clients which may also register components and flows
+var RoleAdmin = "admin"
+
+// Roles maps each valid role to its rank. A role is granted every permission that the roles ranked
+// below it are granted.
+var Roles = map[string]int{
+	RoleViewer:   1,
+	RoleOperator: 2,
+	RoleAdmin:    3,
+}
+
+// ErrInvalidToken is returned by authenticators when a token is not bound to any role
+var ErrInvalidToken = errors.New("Invalid API token")
+
+// Authenticator - resolves the bearer tokens that API clients present into roles
+type Authenticator interface {
+	// Authenticate returns the role bound to the given token. It returns ErrInvalidToken if no role
+	// is bound to the token.
+	Authenticate(token string) (string, error)
+}
+
+// ConfigAuthenticator - an Authenticator which binds the tokens listed in the server configuration
+// of a state directory to their roles
+type ConfigAuthenticator struct {
+	tokens []state.TokenConfiguration
+}
+
+// NewConfigAuthenticator creates a ConfigAuthenticator from the given server configuration,
+// materializing "env:" tokens. It returns nil (meaning that requests are not authenticated) if the
+// configuration does not list any tokens.
+func NewConfigAuthenticator(configuration state.ServerConfiguration) (Authenticator, error) {
+	if len(configuration.Tokens) == 0 {
+		return nil, nil
+	}
+	tokens := make([]state.TokenConfiguration, len(configuration.Tokens))
+	for i, tokenConfiguration := range configuration.Tokens {
+		if _, ok := Roles[tokenConfiguration.Role]; !ok {
+			return nil, fmt.Errorf("Invalid role for server token %d: %s", i, tokenConfiguration.Role)
+		}
+		token, err := components.MaterializeTrustedEnv(tokenConfiguration.Token)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid server token %d: %w", i, err)
+		}
+		if token == "" {
+			return nil, fmt.Errorf("Invalid server token %d: token must not be empty", i)
+		}
+		tokens[i] = state.TokenConfiguration{Token: token, Role: tokenConfiguration.Role}
+	}
+	return &ConfigAuthenticator{tokens: tokens}, nil
+}
+
+// Authenticate implements Authenticator.Authenticate. Tokens are compared in constant time.
+func (authenticator *ConfigAuthenticator) Authenticate(token string) (string, error) {
+	role := ""
+	for _, tokenConfiguration := range authenticator.tokens {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(tokenConfiguration.Token)) == 1 && role == "" {
+			role = tokenConfiguration.Role
+		}
+	}
+	if role == "" {
+		return "", ErrInvalidToken
+	}
+	return role, nil
+}
+
+// requiredRole returns the role that API clients need in order to make the given request. The
+// dashboard itself is served to anyone, since it authenticates against the API from the browser.
+func requiredRole(r *http.Request) string {
+	if !strings.HasPrefix(r.URL.Path, "/api/") {
+		return ""
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return RoleViewer
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/flows/") && strings.HasSuffix(strings.TrimSuffix(r.URL.Path, "/"), "/runs") {
+		return RoleOperator
+	}
+	if strings.HasPrefix(r.URL.Path, "/api/runs/") {
+		return RoleOperator
+	}
+	return RoleAdmin
+}
+
+// requestToken extracts the bearer token from the Authorization header of the given request. Since
+// browsers cannot set headers on EventSource requests, the token may also be passed in the
+// access_token query parameter.
+func requestToken(r *http.Request) string {
+	authorization := r.Header.Get("Authorization")
+	if strings.HasPrefix(authorization, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(authorization, "Bearer "))
+	}
+	return r.URL.Query().Get("access_token")
+}
+
+// authorize wraps the given handler so that requests are only served if they present a token bound
+// to a role which is at least the role that they require. If the server has no authenticator, every
+// request is served.
+func (server *Server) authorize(handler http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		required := requiredRole(r)
+		if server.authenticator == nil || required == "" {
+			handler.ServeHTTP(w, r)
+			return
+		}
+
+		token := requestToken(r)
+		if token == "" {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, errors.New("API token required"))
+			return
+		}
+		role, err := server.authenticator.Authenticate(token)
+		if err != nil {
+			w.Header().Set("WWW-Authenticate", `Bearer error="invalid_token"`)
+			writeError(w, http.StatusUnauthorized, err)
+			return
+		}
+		if Roles[role] < Roles[required] {
+			writeError(w, http.StatusForbidden, fmt.Errorf("Role (%s) is not permitted to %s %s (requires %s)", role, r.Method, r.URL.Path, required))
+			return
+		}
+		handler.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), roleContextKey{}, role)))
+	})
+}
+
+// roleContextKey - the key under which authorize stores the role of an authenticated request in
+// its context
+type roleContextKey struct{}
+
+// requestActor returns the actor to which the audit log attributes the given request: "api:<role>"
+// if the request was authenticated, and "api" otherwise
+func requestActor(r *http.Request) string {
+	if role, ok := r.Context().Value(roleContextKey{}).(string); ok {
+		return "api:" + role
+	}
+	return "api"
+}
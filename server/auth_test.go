@@ -0,0 +1,133 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/audit"
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/flows"
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestNewConfigAuthenticator(t *testing.T) {
+	authenticator, err := NewConfigAuthenticator(state.ServerConfiguration{})
+	if err != nil {
+		t.Fatalf("Error creating authenticator without tokens: %s", err.Error())
+	}
+	if authenticator != nil {
+		t.Error("Expected no authenticator when no tokens are configured")
+	}
+
+	_, err = NewConfigAuthenticator(state.ServerConfiguration{Tokens: []state.TokenConfiguration{{Token: "secret", Role: "superuser"}}})
+	if err == nil {
+		t.Error("Expected error for invalid role")
+	}
+
+	os.Setenv("SHNORKY_TEST_API_TOKEN", "from-env")
+	defer os.Unsetenv("SHNORKY_TEST_API_TOKEN")
+	authenticator, err = NewConfigAuthenticator(state.ServerConfiguration{Tokens: []state.TokenConfiguration{{Token: "env:SHNORKY_TEST_API_TOKEN", Role: RoleOperator}}})
+	if err != nil {
+		t.Fatalf("Error creating authenticator: %s", err.Error())
+	}
+	role, err := authenticator.Authenticate("from-env")
+	if err != nil || role != RoleOperator {
+		t.Errorf("Unexpected authentication of token from environment: role=%s, err=%v", role, err)
+	}
+	_, err = authenticator.Authenticate("env:SHNORKY_TEST_API_TOKEN")
+	if err != ErrInvalidToken {
+		t.Errorf("Unexpected error for invalid token: expected %v, got %v", ErrInvalidToken, err)
+	}
+}
+
+func TestAuthorize(t *testing.T) {
+	stateDir, store, cleanup := testState(t)
+	defer cleanup()
+
+	authenticator, err := NewConfigAuthenticator(state.ServerConfiguration{
+		Tokens: []state.TokenConfiguration{
+			{Token: "viewer-token", Role: RoleViewer},
+			{Token: "operator-token", Role: RoleOperator},
+			{Token: "admin-token", Role: RoleAdmin},
+		},
+	})
+	if err != nil {
+		t.Fatalf("Error creating authenticator: %s", err.Error())
+	}
+	server := New(store, nil, stateDir, ioutil.Discard, authenticator)
+	server.execute = func(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, stateDir, flowID string) (flows.FlowRunMetadata, map[string]components.ExecutionMetadata, error) {
+		return flows.FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, nil
+	}
+	testServer := httptest.NewServer(server.Handler())
+	defer testServer.Close()
+
+	emptySpecificationPath := path.Join(stateDir, "empty.json")
+	err = ioutil.WriteFile(emptySpecificationPath, []byte(`{"steps": {}}`), 0644)
+	if err != nil {
+		t.Fatalf("Could not write flow specification: %s", err.Error())
+	}
+	registerFlow := fmt.Sprintf(`{"id": "empty", "specification_path": %q}`, emptySpecificationPath)
+
+	type authorizeTest struct {
+		token          string
+		method         string
+		path           string
+		body           string
+		expectedStatus int
+	}
+
+	tests := []authorizeTest{
+		{"", http.MethodGet, "/", "", http.StatusOK},
+		{"", http.MethodGet, "/api/flows", "", http.StatusUnauthorized},
+		{"wrong-token", http.MethodGet, "/api/flows", "", http.StatusUnauthorized},
+		{"viewer-token", http.MethodGet, "/api/flows", "", http.StatusOK},
+		{"viewer-token", http.MethodGet, "/api/runs/run-1?access_token=viewer-token", "", http.StatusOK},
+		{"viewer-token", http.MethodPost, "/api/flows/etl/runs", "", http.StatusForbidden},
+		{"operator-token", http.MethodPost, "/api/flows/etl/runs", "", http.StatusAccepted},
+		{"viewer-token", http.MethodPost, "/api/runs/run-1/steps/review/approve", "", http.StatusForbidden},
+		{"operator-token", http.MethodPost, "/api/runs/run-1/steps/review/approve", `{"comment": "ok"}`, http.StatusNotFound},
+		{"operator-token", http.MethodPost, "/api/flows", registerFlow, http.StatusForbidden},
+		{"operator-token", http.MethodPost, "/api/components", `{}`, http.StatusForbidden},
+		{"admin-token", http.MethodPost, "/api/flows", registerFlow, http.StatusCreated},
+		{"admin-token", http.MethodPost, "/api/components", `{}`, http.StatusBadRequest},
+		{"admin-token", http.MethodGet, "/api/flows/empty", "", http.StatusOK},
+	}
+
+	for i, test := range tests {
+		request, err := http.NewRequest(test.method, testServer.URL+test.path, strings.NewReader(test.body))
+		if err != nil {
+			t.Fatalf("[Test %d] Could not create request: %s", i, err.Error())
+		}
+		// Tokens passed as query parameters are not also sent in the Authorization header
+		if test.token != "" && !strings.Contains(test.path, "access_token=") {
+			request.Header.Set("Authorization", "Bearer "+test.token)
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("[Test %d] Request failed: %s", i, err.Error())
+		}
+		body, _ := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if response.StatusCode != test.expectedStatus {
+			t.Errorf("[Test %d] Unexpected status for %s %s with token %q: expected %d, got %d (%s)", i, test.method, test.path, test.token, test.expectedStatus, response.StatusCode, string(body))
+		}
+	}
+
+	entries, err := audit.List(store, audit.Filter{Action: audit.ActionFlowCreate})
+	if err != nil {
+		t.Fatalf("Could not list audit log entries: %s", err.Error())
+	}
+	if len(entries) != 1 || entries[0].Actor != "api:admin" || entries[0].Arguments["id"] != "empty" {
+		t.Errorf("Unexpected audit log entries for flow registration: %v", entries)
+	}
+}
@@ -0,0 +1,225 @@
+package server
+
+// dashboardHTML is the web dashboard served at "/". It is a single page which talks to the JSON
+// API, and has no dependencies so that it works on machines without internet access.
+var dashboardHTML = `<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<title>shnorky</title>
+<style>
+body { font-family: sans-serif; margin: 0; display: flex; height: 100vh; color: #222; }
+nav { width: 16em; border-right: 1px solid #ccc; overflow-y: auto; padding: 0.5em; }
+main { flex: 1; overflow-y: auto; padding: 0.5em 1em; }
+h1 { font-size: 1.2em; } h2 { font-size: 1.1em; } h3 { font-size: 1em; }
+ul { list-style: none; padding: 0; margin: 0; }
+li { padding: 0.25em 0.5em; cursor: pointer; border-radius: 3px; }
+li:hover { background: #eee; } li.selected { background: #dde7f5; }
+button { margin-left: 1em; }
+.stages { display: flex; align-items: flex-start; gap: 2em; margin: 1em 0; }
+.stage { display: flex; flex-direction: column; gap: 0.5em; }
+.step { border: 2px solid #999; border-radius: 4px; padding: 0.4em 0.6em; cursor: pointer; min-width: 10em; }
+.step small { display: block; color: #555; }
+.step.selected { outline: 2px solid #36c; }
+.pending { border-color: #999; } .running { border-color: #36c; background: #eef3fb; }
+.succeeded { border-color: #393; background: #eff8ef; } .failed { border-color: #c33; background: #fbeeee; }
+.awaiting_approval { border-color: #c90; background: #fdf6e3; } .step button { margin: 0.3em 0.3em 0 0; }
+pre { background: #111; color: #ddd; padding: 0.5em; max-height: 30em; overflow: auto; }
+.error { color: #c33; }
+</style>
+</head>
+<body>
+<nav>
+<h1>shnorky</h1>
+<h2>Flows</h2>
+<ul id="flows"></ul>
+</nav>
+<main>
+<p id="error" class="error"></p>
+<div id="flow"></div>
+<div id="run"></div>
+<div id="logs"></div>
+</main>
+<script>
+"use strict";
+var state = { flow: null, run: null, step: null };
+var tokenKey = "shnorky-api-token";
+
+// withToken appends the API token (if there is one) to URLs requested by EventSource, which cannot
+// set an Authorization header
+function withToken(path) {
+  var token = localStorage.getItem(tokenKey);
+  return token ? path + "?access_token=" + encodeURIComponent(token) : path;
+}
+
+function element(tag, text, className) {
+  var node = document.createElement(tag);
+  if (text !== undefined) { node.textContent = text; }
+  if (className) { node.className = className; }
+  return node;
+}
+
+function api(method, path) {
+  var headers = {};
+  var token = localStorage.getItem(tokenKey);
+  if (token) { headers.Authorization = "Bearer " + token; }
+  return fetch(path, { method: method, headers: headers }).then(function (response) {
+    return response.json().then(function (body) {
+      if (response.status === 401) {
+        var newToken = window.prompt("API token for this shnorky server:");
+        if (newToken) { localStorage.setItem(tokenKey, newToken); return api(method, path); }
+      }
+      if (!response.ok) { throw new Error(body.error || response.statusText); }
+      return body;
+    });
+  });
+}
+
+function showError(error) {
+  document.getElementById("error").textContent = error ? error.message : "";
+}
+
+function loadFlows() {
+  return api("GET", "/api/flows").then(function (flows) {
+    var list = document.getElementById("flows");
+    list.textContent = "";
+    flows.forEach(function (flow) {
+      var item = element("li", flow.id, flow.id === state.flow ? "selected" : "");
+      item.onclick = function () { state.flow = flow.id; state.run = null; state.step = null; refresh(); };
+      list.appendChild(item);
+    });
+  });
+}
+
+function loadFlow() {
+  var container = document.getElementById("flow");
+  if (!state.flow) { container.textContent = ""; return Promise.resolve(); }
+  return api("GET", "/api/flows/" + encodeURIComponent(state.flow) + "/runs").then(function (runs) {
+    container.textContent = "";
+    var title = element("h2", "Flow: " + state.flow);
+    var trigger = element("button", "Run now");
+    trigger.onclick = function () {
+      api("POST", "/api/flows/" + encodeURIComponent(state.flow) + "/runs").then(function () {
+        setTimeout(refresh, 1000);
+      }).catch(showError);
+    };
+    title.appendChild(trigger);
+    container.appendChild(title);
+    container.appendChild(element("h3", "Recent runs"));
+    var list = element("ul");
+    runs.forEach(function (run) {
+      var label = new Date(run.created_at).toLocaleString() + " - " + run.status + " - " + run.id;
+      var item = element("li", label, run.id === state.run ? "selected" : "");
+      item.onclick = function () { state.run = run.id; state.step = null; refresh(); };
+      list.appendChild(item);
+    });
+    if (runs.length === 0) { list.appendChild(element("p", "This flow has not been run yet.")); }
+    container.appendChild(list);
+  });
+}
+
+// The selected run and the logs of the selected step are followed using server-sent events
+var runEvents = null, lastRun = null, logEvents = null, logExecution = null;
+
+function followRun() {
+  if (runEvents && runEvents.runID === state.run) { return; }
+  if (runEvents) { runEvents.close(); runEvents = null; }
+  lastRun = null;
+  renderRun();
+  if (!state.run) { return; }
+  runEvents = new EventSource(withToken("/api/runs/" + encodeURIComponent(state.run) + "/events"));
+  runEvents.runID = state.run;
+  runEvents.addEventListener("run", function (event) {
+    lastRun = JSON.parse(event.data);
+    renderRun();
+  });
+  runEvents.addEventListener("end", function () {
+    runEvents.close();
+  });
+}
+
+function renderRun() {
+  var container = document.getElementById("run");
+  container.textContent = "";
+  if (!lastRun) { followLogs(null); return; }
+  container.appendChild(element("h2", "Run: " + lastRun.run.id + " (" + lastRun.run.status + ")"));
+  var statuses = {};
+  lastRun.steps.forEach(function (step) { statuses[step.step] = step; });
+  var stages = element("div", undefined, "stages");
+  var stageList = lastRun.stages.length > 0 ? lastRun.stages : [lastRun.steps.map(function (step) { return step.step; })];
+  stageList.forEach(function (stage) {
+    var column = element("div", undefined, "stage");
+    stage.slice().sort().forEach(function (name) {
+      var step = statuses[name] || { step: name, status: "pending", component_id: "" };
+      var status = step.status + (step.status === "failed" && step.exit_code !== null ? " (exit " + step.exit_code + ")" : "");
+      var box = element("div", name, "step " + step.status + (name === state.step ? " selected" : ""));
+      box.appendChild(element("small", step.component_id));
+      box.appendChild(element("small", status));
+      var dependencies = lastRun.dependencies[name] || [];
+      if (dependencies.length > 0) { box.appendChild(element("small", "after " + dependencies.join(", "))); }
+      if (step.status === "awaiting_approval") {
+        ["approve", "reject"].forEach(function (decision) {
+          var button = element("button", decision === "approve" ? "Approve" : "Reject");
+          button.onclick = function (event) {
+            event.stopPropagation();
+            var path = "/api/runs/" + encodeURIComponent(lastRun.run.id) + "/steps/" + encodeURIComponent(name) + "/" + decision;
+            api("POST", path).catch(showError);
+          };
+          box.appendChild(button);
+        });
+      }
+      box.onclick = function () { state.step = name; renderRun(); };
+      column.appendChild(box);
+    });
+    stages.appendChild(column);
+  });
+  container.appendChild(stages);
+  followLogs(statuses[state.step] || (state.step ? { step: state.step } : null));
+}
+
+function followLogs(step) {
+  var container = document.getElementById("logs");
+  var executionID = step && step.execution_id ? step.execution_id : null;
+  if (executionID && executionID === logExecution) { return; }
+  if (logEvents) { logEvents.close(); logEvents = null; }
+  logExecution = executionID;
+  container.textContent = "";
+  if (!step) { return; }
+  container.appendChild(element("h3", "Logs: " + step.step));
+  if (!executionID) {
+    container.appendChild(element("p", "This step has not started."));
+    return;
+  }
+  var output = element("pre");
+  container.appendChild(output);
+  logEvents = new EventSource(withToken("/api/executions/" + encodeURIComponent(executionID) + "/logs"));
+  logEvents.addEventListener("log", function (event) {
+    var following = output.scrollTop + output.clientHeight >= output.scrollHeight - 5;
+    output.appendChild(document.createTextNode(JSON.parse(event.data) + "\n"));
+    if (following) { output.scrollTop = output.scrollHeight; }
+  });
+  logEvents.addEventListener("end", function (event) {
+    var data = JSON.parse(event.data);
+    if (data.error) { container.appendChild(element("p", data.error, "error")); }
+    logEvents.close();
+  });
+}
+
+var refreshing = false, refreshAgain = false;
+function refresh() {
+  if (refreshing) { refreshAgain = true; return; }
+  refreshing = true;
+  loadFlows().then(loadFlow).then(followRun).then(function () {
+    showError(null);
+  }).catch(showError).then(function () {
+    refreshing = false;
+    if (refreshAgain) { refreshAgain = false; refresh(); }
+  });
+}
+
+refresh();
+setInterval(refresh, 2000);
+</script>
+</body>
+</html>
+`
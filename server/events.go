@@ -0,0 +1,175 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/flows"
+)
+
+// EventsPollInterval is the interval at which run event streams check the state database for
+// changes to the run
+var EventsPollInterval = time.Second
+
+// Names of the server-sent events in run event streams and log streams
+var (
+	// EventRun carries a RunResponse, and is sent when a stream starts and whenever the run changes
+	EventRun = "run"
+	// EventStep carries a flows.StepStatus, and is sent whenever the status of a step changes
+	EventStep = "step"
+	// EventLog carries a single line of logs (as a JSON string)
+	EventLog = "log"
+	// EventEnd is the last event in a stream. For run event streams, it carries the final status of
+	// the run.
+	EventEnd = "end"
+)
+
+// eventStream - a response which streams server-sent events
+// (https://html.spec.whatwg.org/multipage/server-sent-events.html)
+type eventStream struct {
+	w       http.ResponseWriter
+	flusher http.Flusher
+}
+
+// newEventStream starts a server-sent event stream in response to a request
+func newEventStream(w http.ResponseWriter) (*eventStream, error) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return nil, fmt.Errorf("Streaming is not supported by this connection")
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	return &eventStream{w: w, flusher: flusher}, nil
+}
+
+// send sends an event with the given name whose data is the JSON encoding of the given value
+func (stream *eventStream) send(event string, data interface{}) error {
+	encodedData, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(stream.w, "event: %s\ndata: %s\n\n", event, encodedData)
+	if err != nil {
+		return err
+	}
+	stream.flusher.Flush()
+	return nil
+}
+
+// wantsEventStream returns true if the given request asks for a stream of server-sent events (as
+// browsers' EventSource does) rather than a single JSON response
+func wantsEventStream(r *http.Request) bool {
+	return strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// streamRunEvents streams the progress of the given flow run until it finishes (or the client
+// disconnects). The stream starts with a "run" event describing the current state of the run. After
+// that, each change is described by a "step" event for every step whose status changed, followed by
+// a "run" event. Once the run has finished, an "end" event is sent and the stream is closed.
+func (server *Server) streamRunEvents(w http.ResponseWriter, r *http.Request, run flows.FlowRunMetadata) {
+	stream, err := newEventStream(w)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	var previous *RunResponse
+	for {
+		response, err := server.runResponse(run)
+		if err != nil {
+			stream.send(EventEnd, errorResponse{Error: err.Error()})
+			return
+		}
+
+		if previous == nil || !reflect.DeepEqual(*previous, response) {
+			if previous != nil {
+				previousSteps := map[string]flows.StepStatus{}
+				for _, step := range previous.Steps {
+					previousSteps[step.Step] = step
+				}
+				for _, step := range response.Steps {
+					if previousStep, ok := previousSteps[step.Step]; !ok || !reflect.DeepEqual(previousStep, step) {
+						stream.send(EventStep, step)
+					}
+				}
+			}
+			if stream.send(EventRun, response) != nil {
+				return
+			}
+			previous = &response
+		}
+		if response.Run.FinishedAt != nil {
+			stream.send(EventEnd, map[string]string{"status": response.Run.Status})
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(EventsPollInterval):
+		}
+
+		run, err = flows.SelectFlowRunByID(server.store, run.ID)
+		if err != nil {
+			stream.send(EventEnd, errorResponse{Error: err.Error()})
+			return
+		}
+	}
+}
+
+// streamLogs streams the logs of the given execution, one "log" event per line, until its
+// container stops (or the client disconnects). The stream ends with an "end" event, which carries
+// an error if the logs could not be retrieved.
+func (server *Server) streamLogs(w http.ResponseWriter, r *http.Request, executionID string, tail int) {
+	stream, err := newEventStream(w)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	lines := &lineWriter{emit: func(line string) error {
+		return stream.send(EventLog, line)
+	}}
+	err = components.FollowExecutionLogs(r.Context(), server.dockerClient, executionID, tail, lines)
+	lines.Close()
+	if err != nil {
+		stream.send(EventEnd, errorResponse{Error: err.Error()})
+		return
+	}
+	stream.send(EventEnd, map[string]string{})
+}
+
+// lineWriter - an io.Writer which calls emit with each complete line written to it
+type lineWriter struct {
+	emit    func(line string) error
+	partial string
+}
+
+func (writer *lineWriter) Write(p []byte) (int, error) {
+	lines := strings.Split(writer.partial+string(p), "\n")
+	writer.partial = lines[len(lines)-1]
+	for _, line := range lines[:len(lines)-1] {
+		err := writer.emit(strings.TrimSuffix(line, "\r"))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(p), nil
+}
+
+// Close emits the final line if it was not terminated by a newline
+func (writer *lineWriter) Close() error {
+	if writer.partial == "" {
+		return nil
+	}
+	line := writer.partial
+	writer.partial = ""
+	return writer.emit(line)
+}
@@ -0,0 +1,133 @@
+package server
+
+import (
+	"bufio"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/flows"
+)
+
+// serverSentEvent - an event read from a server-sent event stream
+type serverSentEvent struct {
+	name string
+	data string
+}
+
+// readEvents reads server-sent events from the given stream until it ends
+func readEvents(t *testing.T, scanner *bufio.Scanner) []serverSentEvent {
+	events := []serverSentEvent{}
+	event := serverSentEvent{}
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: "):
+			event.name = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			event.data = strings.TrimPrefix(line, "data: ")
+		case line == "":
+			events = append(events, event)
+			event = serverSentEvent{}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		t.Fatalf("Error reading event stream: %s", err.Error())
+	}
+	return events
+}
+
+func TestRunEvents(t *testing.T) {
+	stateDir, store, cleanup := testState(t)
+	defer cleanup()
+
+	previousInterval := EventsPollInterval
+	EventsPollInterval = 10 * time.Millisecond
+	defer func() { EventsPollInterval = previousInterval }()
+
+	testServer := httptest.NewServer(New(store, nil, stateDir, ioutil.Discard, nil).Handler())
+	defer testServer.Close()
+
+	response, err := http.Get(testServer.URL + "/api/runs/run-1/events")
+	if err != nil {
+		t.Fatalf("Request failed: %s", err.Error())
+	}
+	defer response.Body.Close()
+	if contentType := response.Header.Get("Content-Type"); contentType != "text/event-stream" {
+		t.Fatalf("Unexpected content type: %s", contentType)
+	}
+
+	// Finish the execution and then the run while the stream is open
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		exitCode := 0
+		finishedAt := time.Now()
+		err := components.UpdateExecutionResult(store, components.ExecutionMetadata{ID: "execution-1", ExitCode: &exitCode, FinishedAt: &finishedAt})
+		if err != nil {
+			t.Errorf("Could not update execution: %s", err.Error())
+		}
+		time.Sleep(50 * time.Millisecond)
+		err = flows.UpdateFlowRunStatus(store, flows.FlowRunMetadata{ID: "run-1", Status: flows.RunStatusSucceeded, FinishedAt: &finishedAt})
+		if err != nil {
+			t.Errorf("Could not update run: %s", err.Error())
+		}
+	}()
+
+	events := readEvents(t, bufio.NewScanner(response.Body))
+	if len(events) < 3 {
+		t.Fatalf("Expected at least 3 events, got %d: %v", len(events), events)
+	}
+
+	var initial RunResponse
+	if events[0].name != EventRun || json.Unmarshal([]byte(events[0].data), &initial) != nil {
+		t.Fatalf("Unexpected first event: %v", events[0])
+	}
+	if initial.Run.Status != flows.RunStatusRunning || len(initial.Steps) != 2 || initial.Steps[0].Status != flows.StepStatusRunning {
+		t.Errorf("Unexpected initial state of run: %v", initial)
+	}
+
+	stepEvents := []flows.StepStatus{}
+	for _, event := range events {
+		if event.name == EventStep {
+			var step flows.StepStatus
+			err = json.Unmarshal([]byte(event.data), &step)
+			if err != nil {
+				t.Fatalf("Invalid step event: %s", event.data)
+			}
+			stepEvents = append(stepEvents, step)
+		}
+	}
+	exitCode := 0
+	expectedStepEvents := []flows.StepStatus{{Step: "extract", ComponentID: "extractor", ExecutionID: "execution-1", Status: flows.StepStatusSucceeded, ExitCode: &exitCode}}
+	if !reflect.DeepEqual(stepEvents, expectedStepEvents) {
+		t.Errorf("Unexpected step events: expected %v, got %v", expectedStepEvents, stepEvents)
+	}
+
+	last := events[len(events)-1]
+	if last.name != EventEnd || last.data != `{"status":"succeeded"}` {
+		t.Errorf("Unexpected last event: %v", last)
+	}
+}
+
+func TestLineWriter(t *testing.T) {
+	lines := []string{}
+	writer := &lineWriter{emit: func(line string) error {
+		lines = append(lines, line)
+		return nil
+	}}
+	for _, chunk := range []string{"first li", "ne\nsecond line\r\n", "\nthird", " line"} {
+		writer.Write([]byte(chunk))
+	}
+	writer.Close()
+
+	expected := []string{"first line", "second line", "", "third line"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Unexpected lines: expected %q, got %q", expected, lines)
+	}
+}
@@ -0,0 +1,448 @@
+// Package server implements "shn serve", which exposes the flows registered in a shnorky state
+// directory over HTTP. It serves a JSON API under /api/ along with a minimal web dashboard (at /)
+// which lets users on the same machine browse flows, trigger runs, follow the statuses of the steps
+// in a run, and tail the logs of a step.
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/audit"
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/flows"
+	"github.com/simiotics/shnorky/state"
+)
+
+// DefaultAddress is the address that "shn serve" listens on by default. It is only reachable from
+// the local machine.
+var DefaultAddress = "127.0.0.1:7468"
+
+// DefaultRunsLimit is the number of runs returned by the runs endpoint if no limit is specified
+var DefaultRunsLimit = 20
+
+// DefaultLogLines is the number of lines returned by the logs endpoint if no tail is specified
+var DefaultLogLines = 200
+
+// Server - an HTTP server for the flows registered in a shnorky state directory
+type Server struct {
+	store        state.Store
+	dockerClient *docker.Client
+	stateDir     string
+	// outstream receives the output of the flow runs triggered through the server
+	outstream io.Writer
+	// authenticator resolves API tokens into roles. If it is nil, requests are not authenticated.
+	authenticator Authenticator
+	// execute runs flows (it is flows.Execute outside of tests)
+	execute func(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, stateDir, flowID string) (flows.FlowRunMetadata, map[string]components.ExecutionMetadata, error)
+}
+
+// New creates a Server for the given state directory (and its store). The output of flow runs
+// triggered through the server is written to outstream. API requests are authorized using the
+// given authenticator; if it is nil, every request is served.
+func New(store state.Store, dockerClient *docker.Client, stateDir string, outstream io.Writer, authenticator Authenticator) *Server {
+	return &Server{store: store, dockerClient: dockerClient, stateDir: stateDir, outstream: outstream, authenticator: authenticator, execute: flows.Execute}
+}
+
+// ComponentRequest - the body of requests to register components. Paths refer to the machine that
+// the server runs on.
+type ComponentRequest struct {
+	ID                string `json:"id"`
+	ComponentType     string `json:"component_type"`
+	ComponentPath     string `json:"component_path"`
+	SpecificationPath string `json:"specification_path"`
+}
+
+// DecisionRequest - the (optional) body of requests to approve or reject gate steps
+type DecisionRequest struct {
+	Comment string `json:"comment"`
+}
+
+// FlowRequest - the body of requests to register flows. The path refers to the machine that the
+// server runs on.
+type FlowRequest struct {
+	ID                string `json:"id"`
+	SpecificationPath string `json:"specification_path"`
+}
+
+// FlowResponse - the response to requests for a single flow
+type FlowResponse struct {
+	Flow          flows.FlowMetadata      `json:"flow"`
+	Specification flows.FlowSpecification `json:"specification"`
+}
+
+// RunResponse - the response to requests for a single flow run. Stages and Dependencies are taken
+// from the flow's current specification so that the run can be drawn as a graph.
+type RunResponse struct {
+	Run          flows.FlowRunMetadata `json:"run"`
+	Steps        []flows.StepStatus    `json:"steps"`
+	Stages       [][]string            `json:"stages"`
+	Dependencies map[string][]string   `json:"dependencies"`
+}
+
+// LogsResponse - the response to requests for the logs of an execution
+type LogsResponse struct {
+	ExecutionID string   `json:"execution_id"`
+	Lines       []string `json:"lines"`
+}
+
+// errorResponse - the body of responses to requests which could not be served
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// Handler returns the http.Handler which serves the API and the dashboard:
+//
+//	GET  /                             - the web dashboard
+//	GET  /api/flows                    - all registered flows
+//	POST /api/flows                    - register a flow
+//	POST /api/components               - register a component
+//	GET  /api/flows/{id}               - a flow along with its specification
+//	GET  /api/flows/{id}/runs?limit=N  - the most recent runs of a flow
+//	POST /api/flows/{id}/runs          - start a run of a flow (in the background)
+//	GET  /api/runs/{id}                - a flow run along with the status of each of its steps
+//	GET  /api/runs/{id}/events         - a stream of server-sent events describing a run's progress
+//	GET  /api/runs/{id}/approvals      - the approvals requested by the gate steps in a run
+//	POST /api/runs/{id}/steps/{step}/approve - approve a gate step which is waiting for a decision
+//	POST /api/runs/{id}/steps/{step}/reject  - reject a gate step which is waiting for a decision
+//	GET  /api/executions/{id}/logs?tail=N - the last lines of the logs of an execution
+//
+// Requests for the logs of an execution which accept "text/event-stream" receive a stream of
+// server-sent events which follows the logs until the execution's container stops.
+//
+// If the server has an authenticator, API requests must present a bearer token whose role permits
+// them: viewers may make GET requests, operators may also start flow runs and decide gate steps,
+// and admins may also register components and flows.
+func (server *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", server.handleDashboard)
+	mux.HandleFunc("/api/components", server.handleComponents)
+	mux.HandleFunc("/api/flows", server.handleFlows)
+	mux.HandleFunc("/api/flows/", server.handleFlow)
+	mux.HandleFunc("/api/runs/", server.handleRun)
+	mux.HandleFunc("/api/executions/", server.handleExecution)
+	return server.authorize(mux)
+}
+
+func (server *Server) handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Not found: %s", r.URL.Path))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, dashboardHTML)
+}
+
+func (server *Server) handleComponents(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var request ComponentRequest
+	err := json.NewDecoder(r.Body).Decode(&request)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid component request: %w", err))
+		return
+	}
+	if request.ID == "" || request.ComponentPath == "" {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid component request: id and component_path must be specified"))
+		return
+	}
+	metadata, err := components.AddComponent(server.store, request.ID, request.ComponentType, request.ComponentPath, request.SpecificationPath)
+	server.recordAudit(requestActor(r), audit.ActionComponentCreate, map[string]string{"id": request.ID, "type": request.ComponentType, "component": request.ComponentPath, "spec": request.SpecificationPath}, err)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, metadata)
+}
+
+func (server *Server) handleFlows(w http.ResponseWriter, r *http.Request) {
+	if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+		return
+	}
+	if r.Method == http.MethodPost {
+		var request FlowRequest
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid flow request: %w", err))
+			return
+		}
+		if request.ID == "" || request.SpecificationPath == "" {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid flow request: id and specification_path must be specified"))
+			return
+		}
+		metadata, err := flows.AddFlow(server.store, request.ID, request.SpecificationPath)
+		server.recordAudit(requestActor(r), audit.ActionFlowCreate, map[string]string{"id": request.ID, "spec": request.SpecificationPath}, err)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, metadata)
+		return
+	}
+	flowsChan := make(chan flows.FlowMetadata)
+	errChan := make(chan error, 1)
+	go func() {
+		errChan <- flows.ListFlows(r.Context(), server.store, flowsChan, "", nil)
+	}()
+	flowList := []flows.FlowMetadata{}
+	for flow := range flowsChan {
+		flowList = append(flowList, flow)
+	}
+	if err := <-errChan; err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, flowList)
+}
+
+// handleFlow serves /api/flows/{id} and /api/flows/{id}/runs
+func (server *Server) handleFlow(w http.ResponseWriter, r *http.Request) {
+	flowID, rest := splitPath(strings.TrimPrefix(r.URL.Path, "/api/flows/"))
+	flow, err := flows.SelectFlowByID(server.store, flowID)
+	if err == flows.ErrFlowNotFound {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s: %s", err.Error(), flowID))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	switch rest {
+	case "":
+		if !allowMethods(w, r, http.MethodGet) {
+			return
+		}
+		specification, err := flows.ReadRegisteredSpecification(flow)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, FlowResponse{Flow: flow, Specification: specification})
+	case "runs":
+		if !allowMethods(w, r, http.MethodGet, http.MethodPost) {
+			return
+		}
+		if r.Method == http.MethodPost {
+			server.startRun(flow.ID, requestActor(r))
+			writeJSON(w, http.StatusAccepted, map[string]string{"flow_id": flow.ID})
+			return
+		}
+		limit, err := queryInt(r, "limit", DefaultRunsLimit)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, err)
+			return
+		}
+		runs, err := flows.SelectFlowRunsByFlowID(server.store, flow.ID, limit)
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, runs)
+	default:
+		writeError(w, http.StatusNotFound, fmt.Errorf("Not found: %s", r.URL.Path))
+	}
+}
+
+// startRun executes the given flow in the background (on behalf of the given actor). Since
+// flows.Execute only returns once the run has finished, clients find the new run by listing the
+// flow's runs.
+func (server *Server) startRun(flowID, actor string) {
+	go func() {
+		run, _, err := server.execute(context.Background(), server.store, server.dockerClient, server.outstream, server.stateDir, flowID)
+		server.recordAudit(actor, audit.ActionFlowRun, map[string]string{"id": flowID, "run": run.ID}, err)
+		if err != nil && server.outstream != nil {
+			fmt.Fprintf(server.outstream, "Run (%s) of flow (%s) failed: %s\n", run.ID, flowID, err.Error())
+		}
+	}()
+}
+
+// handleRun serves /api/runs/{id}, /api/runs/{id}/events, /api/runs/{id}/approvals, and
+// /api/runs/{id}/steps/{step}/{approve,reject}
+func (server *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	runID, rest := splitPath(strings.TrimPrefix(r.URL.Path, "/api/runs/"))
+	if strings.HasPrefix(rest, "steps/") {
+		server.handleDecision(w, r, runID, strings.TrimPrefix(rest, "steps/"))
+		return
+	}
+	if rest != "" && rest != "events" && rest != "approvals" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Not found: %s", r.URL.Path))
+		return
+	}
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	run, err := flows.SelectFlowRunByID(server.store, runID)
+	if err == flows.ErrFlowRunNotFound {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s: %s", err.Error(), runID))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if rest == "events" {
+		server.streamRunEvents(w, r, run)
+		return
+	}
+	if rest == "approvals" {
+		approvals, err := flows.ListApprovals(server.store, run.ID, "")
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		writeJSON(w, http.StatusOK, approvals)
+		return
+	}
+	response, err := server.runResponse(run)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, response)
+}
+
+// handleDecision serves /api/runs/{id}/steps/{step}/approve and /api/runs/{id}/steps/{step}/reject,
+// where stepPath is "{step}/approve" or "{step}/reject"
+func (server *Server) handleDecision(w http.ResponseWriter, r *http.Request, runID, stepPath string) {
+	step, decision := splitPath(stepPath)
+	if step == "" || (decision != "approve" && decision != "reject") {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Not found: %s", r.URL.Path))
+		return
+	}
+	if !allowMethods(w, r, http.MethodPost) {
+		return
+	}
+	var request DecisionRequest
+	if r.ContentLength != 0 {
+		err := json.NewDecoder(r.Body).Decode(&request)
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("Invalid decision request: %w", err))
+			return
+		}
+	}
+
+	approved := decision == "approve"
+	err := flows.DecideApproval(server.store, runID, step, approved, requestActor(r), request.Comment)
+	server.recordAudit(requestActor(r), audit.ActionFlowApprove, map[string]string{"run": runID, "step": step, "approved": strconv.FormatBool(approved), "comment": request.Comment}, err)
+	if err == flows.ErrApprovalNotFound {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s: %s (run %s)", err.Error(), step, runID))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"flow_run_id": runID, "step": step, "approved": approved})
+}
+
+// runResponse describes the given flow run along with the status of each of its steps
+func (server *Server) runResponse(run flows.FlowRunMetadata) (RunResponse, error) {
+	steps, err := flows.RunStepStatuses(server.store, run)
+	if err != nil {
+		return RunResponse{}, err
+	}
+	response := RunResponse{Run: run, Steps: steps, Stages: [][]string{}, Dependencies: map[string][]string{}}
+	if specification, err := flows.ReadFlowSpecification(server.store, run.FlowID); err == nil {
+		response.Stages = specification.Stages
+		response.Dependencies = specification.Dependencies
+	}
+	return response, nil
+}
+
+// handleExecution serves /api/executions/{id}/logs
+func (server *Server) handleExecution(w http.ResponseWriter, r *http.Request) {
+	executionID, rest := splitPath(strings.TrimPrefix(r.URL.Path, "/api/executions/"))
+	if rest != "logs" {
+		writeError(w, http.StatusNotFound, fmt.Errorf("Not found: %s", r.URL.Path))
+		return
+	}
+	if !allowMethods(w, r, http.MethodGet) {
+		return
+	}
+	_, err := components.SelectExecutionByID(server.store, executionID)
+	if err == components.ErrExecutionNotFound {
+		writeError(w, http.StatusNotFound, fmt.Errorf("%s: %s", err.Error(), executionID))
+		return
+	} else if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	tail, err := queryInt(r, "tail", DefaultLogLines)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if wantsEventStream(r) {
+		server.streamLogs(w, r, executionID, tail)
+		return
+	}
+	lines, err := components.ExecutionLogTail(r.Context(), server.dockerClient, executionID, tail)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, LogsResponse{ExecutionID: executionID, Lines: lines})
+}
+
+// recordAudit records an action performed through the API in the audit log. Since the action has
+// already been performed, failures to record it are only reported to the server's outstream.
+func (server *Server) recordAudit(actor, action string, arguments map[string]string, actionErr error) {
+	_, err := audit.Record(server.store, action, actor, arguments, actionErr)
+	if err != nil && server.outstream != nil {
+		fmt.Fprintf(server.outstream, "Could not record %s in audit log: %s\n", action, err.Error())
+	}
+}
+
+// splitPath splits a path of the form "<id>[/<rest>]" into its ID and the remainder
+func splitPath(path string) (string, string) {
+	separator := strings.Index(path, "/")
+	if separator < 0 {
+		return path, ""
+	}
+	return path[:separator], strings.TrimSuffix(path[separator+1:], "/")
+}
+
+// queryInt parses the positive integer query parameter with the given name, returning defaultValue
+// if the parameter is not specified
+func queryInt(r *http.Request, name string, defaultValue int) (int, error) {
+	rawValue := r.URL.Query().Get(name)
+	if rawValue == "" {
+		return defaultValue, nil
+	}
+	value, err := strconv.Atoi(rawValue)
+	if err != nil || value <= 0 {
+		return 0, fmt.Errorf("Invalid value for %s (must be a positive integer): %s", name, rawValue)
+	}
+	return value, nil
+}
+
+// allowMethods responds with 405 Method Not Allowed and returns false unless the request uses one of
+// the given methods
+func allowMethods(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	for _, method := range methods {
+		if r.Method == method {
+			return true
+		}
+	}
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	writeError(w, http.StatusMethodNotAllowed, fmt.Errorf("Method not allowed: %s", r.Method))
+	return false
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
@@ -0,0 +1,153 @@
+package server
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/flows"
+	"github.com/simiotics/shnorky/state"
+)
+
+// testState creates a state directory containing a flow ("etl") with two steps ("extract" and
+// "load"), a run of the flow ("run-1"), and an unfinished execution of the extract step in that run
+// ("execution-1"), and returns it along with its store. The returned function removes the state
+// directory.
+func testState(t *testing.T) (string, state.Store, func()) {
+	stateDir, err := ioutil.TempDir("", "shnorky-server-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Error creating state directory: %s", err.Error())
+	}
+
+	stateDBPath := path.Join(stateDir, state.DBFileName)
+	db, err := sql.Open("sqlite3", stateDBPath)
+	if err != nil {
+		t.Fatal("Error opening state database file")
+	}
+	store := state.NewSQLiteStore(db)
+
+	specificationPath := path.Join(stateDir, "flow.json")
+	err = ioutil.WriteFile(specificationPath, []byte(`{"steps": {"extract": "extractor", "load": "loader"}, "dependencies": {"load": ["extract"]}}`), 0644)
+	if err != nil {
+		t.Fatalf("Could not write flow specification: %s", err.Error())
+	}
+	err = flows.InsertFlow(store, flows.FlowMetadata{ID: "etl", SpecificationPath: specificationPath, CreatedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Could not insert flow: %s", err.Error())
+	}
+	run := flows.FlowRunMetadata{ID: "run-1", FlowID: "etl", Status: flows.RunStatusRunning, CreatedAt: time.Now()}
+	err = flows.InsertFlowRun(store, run)
+	if err != nil {
+		t.Fatalf("Could not insert flow run: %s", err.Error())
+	}
+	err = components.InsertExecution(store, components.ExecutionMetadata{ID: "execution-1", BuildID: "build-1", ComponentID: "extractor", CreatedAt: time.Now(), FlowID: "etl", FlowRunID: "run-1", Step: "extract"})
+	if err != nil {
+		t.Fatalf("Could not insert execution: %s", err.Error())
+	}
+
+	return stateDir, store, func() {
+		db.Close()
+		os.RemoveAll(stateDir)
+	}
+}
+
+func TestServer(t *testing.T) {
+	stateDir, store, cleanup := testState(t)
+	defer cleanup()
+
+	server := New(store, nil, stateDir, ioutil.Discard, nil)
+	executed := make(chan string, 1)
+	server.execute = func(ctx context.Context, store state.Store, dockerClient *docker.Client, outstream io.Writer, stateDir, flowID string) (flows.FlowRunMetadata, map[string]components.ExecutionMetadata, error) {
+		executed <- flowID
+		return flows.FlowRunMetadata{}, map[string]components.ExecutionMetadata{}, nil
+	}
+	testServer := httptest.NewServer(server.Handler())
+	defer testServer.Close()
+
+	err := store.InsertApproval(state.ApprovalRecord{ExecutionID: "gate-1", FlowRunID: "run-1", Step: "review", Status: flows.ApprovalStatusPending, RequestedAt: time.Now()})
+	if err != nil {
+		t.Fatalf("Could not insert approval: %s", err.Error())
+	}
+
+	type serverTest struct {
+		method         string
+		path           string
+		expectedStatus int
+		// expectedBody is a substring of the expected response body
+		expectedBody string
+	}
+
+	tests := []serverTest{
+		{http.MethodGet, "/", http.StatusOK, "<title>shnorky</title>"},
+		{http.MethodGet, "/nonexistent", http.StatusNotFound, "Not found"},
+		{http.MethodGet, "/api/flows", http.StatusOK, `"id":"etl"`},
+		{http.MethodPost, "/api/flows", http.StatusBadRequest, "Invalid flow request"},
+		{http.MethodGet, "/api/components", http.StatusMethodNotAllowed, "Method not allowed"},
+		{http.MethodGet, "/api/flows/etl", http.StatusOK, `"stages":[["extract"],["load"]]`},
+		{http.MethodGet, "/api/flows/nonexistent", http.StatusNotFound, "Could not find the specified flow"},
+		{http.MethodGet, "/api/flows/etl/runs", http.StatusOK, `"id":"run-1"`},
+		{http.MethodGet, "/api/flows/etl/runs?limit=0", http.StatusBadRequest, "Invalid value for limit"},
+		{http.MethodGet, "/api/runs/run-1", http.StatusOK, `"steps":[{"step":"extract","component_id":"extractor","execution_id":"execution-1","status":"running","exit_code":null},{"step":"load","component_id":"loader","status":"pending","exit_code":null}]`},
+		{http.MethodGet, "/api/runs/run-2", http.StatusNotFound, "Could not find the specified flow run"},
+		{http.MethodGet, "/api/executions/execution-2/logs", http.StatusNotFound, "Could not find the specified execution"},
+		{http.MethodGet, "/api/executions/execution-1/logs?tail=x", http.StatusBadRequest, "Invalid value for tail"},
+		{http.MethodPost, "/api/flows/etl/runs", http.StatusAccepted, `"flow_id":"etl"`},
+		{http.MethodGet, "/api/runs/run-1/approvals", http.StatusOK, `"step":"review","message":"","status":"pending"`},
+		{http.MethodPost, "/api/runs/run-1/steps/review/approve", http.StatusOK, `"approved":true`},
+		{http.MethodPost, "/api/runs/run-1/steps/review/reject", http.StatusNotFound, "Could not find a pending approval"},
+		{http.MethodPost, "/api/runs/run-1/steps/review/ignore", http.StatusNotFound, "Not found"},
+		{http.MethodGet, "/api/runs/run-1/steps/review/approve", http.StatusMethodNotAllowed, "Method not allowed"},
+	}
+
+	for i, test := range tests {
+		request, err := http.NewRequest(test.method, testServer.URL+test.path, nil)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not create request: %s", i, err.Error())
+		}
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatalf("[Test %d] Request failed: %s", i, err.Error())
+		}
+		body, err := ioutil.ReadAll(response.Body)
+		response.Body.Close()
+		if err != nil {
+			t.Fatalf("[Test %d] Could not read response: %s", i, err.Error())
+		}
+		if response.StatusCode != test.expectedStatus {
+			t.Errorf("[Test %d] Unexpected status for %s %s: expected %d, got %d", i, test.method, test.path, test.expectedStatus, response.StatusCode)
+		}
+		if !strings.Contains(string(body), test.expectedBody) {
+			t.Errorf("[Test %d] Response to %s %s does not contain %q: %s", i, test.method, test.path, test.expectedBody, string(body))
+		}
+		if strings.HasPrefix(test.path, "/api/") && !json.Valid(body) {
+			t.Errorf("[Test %d] Response to %s %s is not valid JSON: %s", i, test.method, test.path, string(body))
+		}
+	}
+
+	select {
+	case flowID := <-executed:
+		if flowID != "etl" {
+			t.Errorf("Unexpected flow executed: expected etl, got %s", flowID)
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("Flow was not executed")
+	}
+}
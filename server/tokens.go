@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// ErrTokenNotFound - signifies that a lookup against the api_tokens table in a state database
+// returned no (unrevoked) rows
+var ErrTokenNotFound = errors.New("Could not find the specified API token")
+
+// TokenPrefix is the prefix of the API tokens created by CreateToken, which makes them easy to
+// recognize (e.g. by secret scanners)
+var TokenPrefix = "shn_"
+
+// TokenMetadata - describes an API token stored in a state database. Only a hash of the token
+// itself is stored, so Token is only populated when the token is created.
+type TokenMetadata struct {
+	ID          string     `json:"id"`
+	Token       string     `json:"token,omitempty"`
+	Role        string     `json:"role"`
+	Description string     `json:"description"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CreatedBy   string     `json:"created_by"`
+	RevokedAt   *time.Time `json:"revoked_at"`
+}
+
+// HashToken returns the (hex-encoded) hash under which the given API token is stored. API tokens
+// are random, so a single round of SHA-256 is enough to keep them from being recovered from the
+// state database.
+func HashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// CreateToken generates a new API token bound to the given role and stores its hash in the given
+// state database. The returned metadata is the only place in which the token itself appears.
+// This is the handler for `shn tokens create`
+func CreateToken(store state.Store, role, description string) (TokenMetadata, error) {
+	if _, ok := Roles[role]; !ok {
+		return TokenMetadata{}, fmt.Errorf("Invalid role: %s", role)
+	}
+	tokenID, err := uuid.NewRandom()
+	if err != nil {
+		return TokenMetadata{}, err
+	}
+	secret := make([]byte, 32)
+	_, err = rand.Read(secret)
+	if err != nil {
+		return TokenMetadata{}, err
+	}
+
+	metadata := TokenMetadata{
+		ID:          tokenID.String(),
+		Token:       TokenPrefix + hex.EncodeToString(secret),
+		Role:        role,
+		Description: description,
+		CreatedAt:   time.Now(),
+		CreatedBy:   state.CurrentUser(),
+	}
+	err = store.InsertToken(state.TokenRecord{
+		ID:          metadata.ID,
+		TokenHash:   HashToken(metadata.Token),
+		Role:        metadata.Role,
+		Description: metadata.Description,
+		CreatedAt:   metadata.CreatedAt,
+		CreatedBy:   metadata.CreatedBy,
+	})
+	if err != nil {
+		return TokenMetadata{}, err
+	}
+	return metadata, nil
+}
+
+// ListTokens returns the API tokens stored in the given state database, oldest first. Revoked
+// tokens are only listed if includeRevoked is true.
+// This is the handler for `shn tokens list`
+func ListTokens(store state.Store, includeRevoked bool) ([]TokenMetadata, error) {
+	records, err := store.SelectTokens()
+	if err != nil {
+		return []TokenMetadata{}, err
+	}
+
+	tokens := []TokenMetadata{}
+	for _, record := range records {
+		if record.RevokedAt != nil && !includeRevoked {
+			continue
+		}
+		tokens = append(tokens, TokenMetadata{
+			ID:          record.ID,
+			Role:        record.Role,
+			Description: record.Description,
+			CreatedAt:   record.CreatedAt,
+			CreatedBy:   record.CreatedBy,
+			RevokedAt:   record.RevokedAt,
+		})
+	}
+	return tokens, nil
+}
+
+// RevokeToken revokes the API token with the given ID, after which it no longer authenticates
+// requests. It returns ErrTokenNotFound if there is no unrevoked token with that ID.
+// This is the handler for `shn tokens revoke`
+func RevokeToken(store state.Store, id string) error {
+	err := store.RevokeToken(id, time.Now())
+	if err == state.ErrNotFound {
+		return ErrTokenNotFound
+	}
+	return err
+}
+
+// DBAuthenticator - an Authenticator which binds the unrevoked API tokens stored in a state
+// database to their roles
+type DBAuthenticator struct {
+	store state.Store
+}
+
+// NewDBAuthenticator creates a DBAuthenticator for the given state store
+func NewDBAuthenticator(store state.Store) *DBAuthenticator {
+	return &DBAuthenticator{store: store}
+}
+
+// Authenticate implements Authenticator.Authenticate
+func (authenticator *DBAuthenticator) Authenticate(token string) (string, error) {
+	role, err := authenticator.store.SelectActiveTokenRole(HashToken(token))
+	if err == state.ErrNotFound {
+		return "", ErrInvalidToken
+	}
+	return role, err
+}
+
+// ChainAuthenticator - an Authenticator which tries each of its (non-nil) authenticators in turn,
+// binding a token to the role given by the first one that recognizes it
+type ChainAuthenticator []Authenticator
+
+// Authenticate implements Authenticator.Authenticate
+func (authenticators ChainAuthenticator) Authenticate(token string) (string, error) {
+	for _, authenticator := range authenticators {
+		if authenticator == nil {
+			continue
+		}
+		role, err := authenticator.Authenticate(token)
+		if err != ErrInvalidToken {
+			return role, err
+		}
+	}
+	return "", ErrInvalidToken
+}
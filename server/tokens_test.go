@@ -0,0 +1,80 @@
+package server
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestTokens(t *testing.T) {
+	_, store, cleanup := testState(t)
+	defer cleanup()
+
+	_, err := CreateToken(store, "superuser", "")
+	if err == nil {
+		t.Error("Expected error creating token with invalid role")
+	}
+
+	viewer, err := CreateToken(store, RoleViewer, "dashboard")
+	if err != nil {
+		t.Fatalf("Could not create viewer token: %s", err.Error())
+	}
+	operator, err := CreateToken(store, RoleOperator, "cron")
+	if err != nil {
+		t.Fatalf("Could not create operator token: %s", err.Error())
+	}
+	if !strings.HasPrefix(viewer.Token, TokenPrefix) || viewer.Token == operator.Token {
+		t.Fatalf("Unexpected tokens: %s, %s", viewer.Token, operator.Token)
+	}
+
+	authenticator := NewDBAuthenticator(store)
+	role, err := authenticator.Authenticate(operator.Token)
+	if err != nil || role != RoleOperator {
+		t.Errorf("Unexpected authentication of operator token: role=%s, err=%v", role, err)
+	}
+	_, err = authenticator.Authenticate(HashToken(operator.Token))
+	if err != ErrInvalidToken {
+		t.Errorf("Expected hash of token to be rejected, got: %v", err)
+	}
+
+	err = RevokeToken(store, operator.ID)
+	if err != nil {
+		t.Fatalf("Could not revoke operator token: %s", err.Error())
+	}
+	err = RevokeToken(store, operator.ID)
+	if err != ErrTokenNotFound {
+		t.Errorf("Unexpected error revoking revoked token: expected %v, got %v", ErrTokenNotFound, err)
+	}
+	_, err = authenticator.Authenticate(operator.Token)
+	if err != ErrInvalidToken {
+		t.Errorf("Expected revoked token to be rejected, got: %v", err)
+	}
+
+	tokens, err := ListTokens(store, false)
+	if err != nil {
+		t.Fatalf("Could not list tokens: %s", err.Error())
+	}
+	if len(tokens) != 1 || tokens[0].ID != viewer.ID || tokens[0].Token != "" || tokens[0].Description != "dashboard" {
+		t.Errorf("Unexpected unrevoked tokens: %v", tokens)
+	}
+	tokens, err = ListTokens(store, true)
+	if err != nil {
+		t.Fatalf("Could not list tokens: %s", err.Error())
+	}
+	if len(tokens) != 2 || tokens[1].RevokedAt == nil {
+		t.Errorf("Unexpected tokens: %v", tokens)
+	}
+
+	configAuthenticator, err := NewConfigAuthenticator(state.ServerConfiguration{Tokens: []state.TokenConfiguration{{Token: "admin-token", Role: RoleAdmin}}})
+	if err != nil {
+		t.Fatalf("Error creating authenticator: %s", err.Error())
+	}
+	chain := ChainAuthenticator{nil, configAuthenticator, authenticator}
+	for token, expectedRole := range map[string]string{"admin-token": RoleAdmin, viewer.Token: RoleViewer, operator.Token: ""} {
+		role, err := chain.Authenticate(token)
+		if role != expectedRole || (expectedRole == "" && err != ErrInvalidToken) {
+			t.Errorf("Unexpected authentication of token %s: expected role %q, got %q (err=%v)", token, expectedRole, role, err)
+		}
+	}
+}
@@ -0,0 +1,360 @@
+// Package shnorkytest provides utilities for testing shnorky components from Go tests. A Harness
+// builds a component and executes it against fixture mounts using a temporary state directory, so
+// that component repositories can write integration tests without setting up shnorky state of
+// their own:
+//
+//	func TestComponent(t *testing.T) {
+//		h := shnorkytest.New(t)
+//		defer h.Close()
+//
+//		input := h.Fixture("testdata/inputs")
+//		output := h.TempDir("outputs")
+//		result := h.Run(".", shnorkytest.Bind(input, "/shnorky/inputs"), shnorkytest.Bind(output, "/shnorky/outputs"))
+//
+//		shnorkytest.AssertExitCode(t, result, 0)
+//		shnorkytest.AssertFileContents(t, filepath.Join(output, "result.txt"), "ok\n")
+//	}
+package shnorkytest
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+
+	dockerTypes "github.com/docker/docker/api/types"
+	docker "github.com/docker/docker/client"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/internal"
+	"github.com/simiotics/shnorky/state"
+)
+
+// Harness - a temporary shnorky state directory (with its state database) and a docker client,
+// against which components can be built and executed
+type Harness struct {
+	StateDir     string
+	DB           *sql.DB
+	Store        state.Store
+	DockerClient *docker.Client
+	// Output receives the output of builds and of execution containers, in addition to the Output
+	// of each Result. If it is nil, that output is not echoed anywhere.
+	Output io.Writer
+
+	t            testing.TB
+	tempDir      string
+	executionIDs []string
+}
+
+// RunOptions - optional configuration for Harness.RunWithOptions. Zero values select the defaults
+// described on each member.
+type RunOptions struct {
+	// ComponentID is the ID under which the component is registered. Defaults to the base name of
+	// the component directory.
+	ComponentID string
+	// ComponentType defaults to components.Task
+	ComponentType string
+	// SpecificationPath defaults to the component.json file in the component directory
+	SpecificationPath string
+	Workdir           string
+	Stdin             io.Reader
+}
+
+// Result - the outcome of executing a component with a Harness
+type Result struct {
+	Execution components.ExecutionMetadata
+	// ExitCode is the exit code of the execution container
+	ExitCode int
+	// Output is the (interleaved) standard output and standard error of the execution container
+	Output string
+}
+
+// New creates a Harness with a fresh state directory. The test fails immediately if the state
+// directory cannot be initialized or if the docker daemon cannot be reached. The Harness should be
+// closed once the test is done with it.
+func New(t testing.TB) *Harness {
+	t.Helper()
+
+	tempDir, err := ioutil.TempDir("", "shnorkytest-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	stateDir := filepath.Join(tempDir, "state")
+	err = state.Init(stateDir)
+	if err != nil {
+		os.RemoveAll(tempDir)
+		t.Fatalf("Could not initialize state directory (%s): %s", stateDir, err.Error())
+	}
+
+	db, err := sql.Open("sqlite3", filepath.Join(stateDir, state.DBFileName))
+	if err != nil {
+		os.RemoveAll(tempDir)
+		t.Fatalf("Could not open state database: %s", err.Error())
+	}
+
+	dockerClient, err := internal.NewDockerClient(context.Background())
+	if err != nil {
+		db.Close()
+		os.RemoveAll(tempDir)
+		t.Fatalf("Could not connect to docker daemon: %s", err.Error())
+	}
+
+	return &Harness{StateDir: stateDir, DB: db, Store: state.NewSQLiteStore(db), DockerClient: dockerClient, t: t, tempDir: tempDir}
+}
+
+// Close removes the containers of the executions that the Harness ran, closes its state database,
+// and removes its state directory (along with any fixtures and temporary directories). The images
+// built for components are kept so that later tests can reuse their layers.
+func (h *Harness) Close() {
+	ctx := context.Background()
+	for _, executionID := range h.executionIDs {
+		h.DockerClient.ContainerRemove(ctx, executionID, dockerTypes.ContainerRemoveOptions{Force: true})
+	}
+	h.DB.Close()
+	os.RemoveAll(h.tempDir)
+}
+
+// Run builds (if necessary) and executes the component in the given directory with the given
+// mounts, using the default RunOptions. The test fails immediately if the component cannot be
+// built or executed - a non-zero exit code is not a failure, and is reported on the Result.
+func (h *Harness) Run(componentPath string, mounts ...components.MountConfiguration) Result {
+	h.t.Helper()
+	return h.RunWithOptions(componentPath, RunOptions{}, mounts...)
+}
+
+// RunWithOptions behaves like Run, but allows the component's ID, type, specification, workdir, and
+// standard input to be configured
+func (h *Harness) RunWithOptions(componentPath string, options RunOptions, mounts ...components.MountConfiguration) Result {
+	h.t.Helper()
+
+	absoluteComponentPath, err := filepath.Abs(componentPath)
+	if err != nil {
+		h.t.Fatalf("Could not resolve component path (%s): %s", componentPath, err.Error())
+	}
+	if options.ComponentID == "" {
+		options.ComponentID = filepath.Base(absoluteComponentPath)
+	}
+	if options.ComponentType == "" {
+		options.ComponentType = components.Task
+	}
+	if options.SpecificationPath == "" {
+		options.SpecificationPath = filepath.Join(absoluteComponentPath, components.DefaultSpecificationFileName)
+	}
+
+	var output bytes.Buffer
+	var outstream io.Writer = &output
+	if h.Output != nil {
+		outstream = io.MultiWriter(&output, h.Output)
+	}
+
+	execution, err := components.Run(
+		context.Background(), h.Store, h.DockerClient,
+		outstream,
+		filepath.Join(h.StateDir, state.BuildLogsDirName),
+		options.ComponentID,
+		options.ComponentType,
+		absoluteComponentPath,
+		options.SpecificationPath,
+		mounts,
+		options.Workdir,
+		options.Stdin,
+	)
+	if execution.ID != "" {
+		h.executionIDs = append(h.executionIDs, execution.ID)
+	}
+	if err != nil {
+		h.t.Fatalf("Could not run component (%s): %s", options.ComponentID, err.Error())
+	}
+
+	result := Result{Execution: execution, Output: output.String()}
+	if execution.ExitCode != nil {
+		result.ExitCode = *execution.ExitCode
+	}
+	return result
+}
+
+// Fixture copies the given file or directory (e.g. from the testdata directory of a component)
+// into a temporary directory owned by the Harness and returns the path of the copy. Mounting the
+// copy rather than the original keeps components from modifying the fixtures checked into their
+// repositories.
+func (h *Harness) Fixture(path string) string {
+	h.t.Helper()
+
+	destination := filepath.Join(h.TempDir("fixtures"), filepath.Base(path))
+	err := copyPath(path, destination)
+	if err != nil {
+		h.t.Fatalf("Could not copy fixture (%s): %s", path, err.Error())
+	}
+	return destination
+}
+
+// TempDir creates an empty directory (with a name starting with the given prefix) owned by the
+// Harness and returns its path. It is useful as the source of output mounts.
+func (h *Harness) TempDir(prefix string) string {
+	h.t.Helper()
+
+	dir, err := ioutil.TempDir(h.tempDir, prefix+"-")
+	if err != nil {
+		h.t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	// Containers may run as users other than the owner of the directory
+	err = os.Chmod(dir, 0777)
+	if err != nil {
+		h.t.Fatalf("Could not set permissions on temporary directory (%s): %s", dir, err.Error())
+	}
+	return dir
+}
+
+// Bind returns the configuration of a bind mount of the given source (on the host) at the given
+// target (in the container)
+func Bind(source, target string) components.MountConfiguration {
+	return components.MountConfiguration{Source: source, Target: target, Method: "bind"}
+}
+
+// AssertExitCode fails the test if the execution container for the given Result did not exit with
+// the expected code. The output of the container is included in the failure message.
+func AssertExitCode(t testing.TB, result Result, expected int) {
+	t.Helper()
+	if result.ExitCode != expected {
+		t.Errorf("Unexpected exit code for execution (%s): expected=%d, actual=%d\n%s", result.Execution.ID, expected, result.ExitCode, result.Output)
+	}
+}
+
+// AssertFileExists fails the test if there is no file at the given path
+func AssertFileExists(t testing.TB, path string) {
+	t.Helper()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Errorf("Expected file (%s) to exist: %s", path, err.Error())
+	} else if info.IsDir() {
+		t.Errorf("Expected file (%s) to exist, but it is a directory", path)
+	}
+}
+
+// AssertFileContents fails the test if the file at the given path does not have exactly the
+// expected contents
+func AssertFileContents(t testing.TB, path, expected string) {
+	t.Helper()
+	contents, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Errorf("Could not read file (%s): %s", path, err.Error())
+		return
+	}
+	if string(contents) != expected {
+		t.Errorf("Unexpected contents of file (%s): expected=%q, actual=%q", path, expected, string(contents))
+	}
+}
+
+// AssertDirMatches fails the test unless the directory at actualDir contains exactly the same files
+// (with the same relative paths and contents) as the directory at expectedDir, e.g. a directory of
+// golden outputs in the testdata directory of a component
+func AssertDirMatches(t testing.TB, actualDir, expectedDir string) {
+	t.Helper()
+	actualFiles, err := readTree(actualDir)
+	if err != nil {
+		t.Errorf("Could not read directory (%s): %s", actualDir, err.Error())
+		return
+	}
+	expectedFiles, err := readTree(expectedDir)
+	if err != nil {
+		t.Errorf("Could not read directory (%s): %s", expectedDir, err.Error())
+		return
+	}
+
+	names := []string{}
+	for name := range expectedFiles {
+		names = append(names, name)
+	}
+	for name := range actualFiles {
+		if _, ok := expectedFiles[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		actual, inActual := actualFiles[name]
+		expected, inExpected := expectedFiles[name]
+		if !inActual {
+			t.Errorf("Missing file (%s) in directory (%s)", name, actualDir)
+		} else if !inExpected {
+			t.Errorf("Unexpected file (%s) in directory (%s)", name, actualDir)
+		} else if actual != expected {
+			t.Errorf("Unexpected contents of file (%s) in directory (%s): expected=%q, actual=%q", name, actualDir, expected, actual)
+		}
+	}
+}
+
+// readTree returns the contents of the regular files under the given directory, keyed by their
+// slash-separated paths relative to it
+func readTree(dir string) (map[string]string, error) {
+	files := map[string]string{}
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relativePath, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		files[filepath.ToSlash(relativePath)] = string(contents)
+		return nil
+	})
+	return files, err
+}
+
+// copyPath copies the file or directory (recursively) at source to destination
+func copyPath(source, destination string) error {
+	info, err := os.Stat(source)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return copyFile(source, destination, info.Mode())
+	}
+
+	return filepath.Walk(source, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relativePath, err := filepath.Rel(source, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(destination, relativePath)
+		if info.IsDir() {
+			return os.MkdirAll(target, 0777)
+		}
+		if !info.Mode().IsRegular() {
+			return fmt.Errorf("Unsupported file type: %s", path)
+		}
+		return copyFile(path, target, info.Mode())
+	})
+}
+
+// copyFile copies the regular file at source to destination, which is made writable by everyone
+// so that components running as other users can modify it
+func copyFile(source, destination string, mode os.FileMode) error {
+	contents, err := ioutil.ReadFile(source)
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(destination, contents, mode.Perm()|0666)
+	if err != nil {
+		return err
+	}
+	return os.Chmod(destination, mode.Perm()|0666)
+}
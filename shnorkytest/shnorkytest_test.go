@@ -0,0 +1,114 @@
+package shnorkytest
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// recordingTB records the failures reported to it instead of failing the test
+type recordingTB struct {
+	testing.TB
+	failures []string
+}
+
+func (r *recordingTB) Helper() {}
+
+func (r *recordingTB) Errorf(format string, args ...interface{}) {
+	r.failures = append(r.failures, fmt.Sprintf(format, args...))
+}
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(contents), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Could not write file (%s): %s", path, err.Error())
+		}
+	}
+}
+
+func TestAssertions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shnorkytest-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, filepath.Join(dir, "expected"), map[string]string{"result.txt": "ok\n", "nested/counts.csv": "a,1\n"})
+	writeFiles(t, filepath.Join(dir, "matching"), map[string]string{"result.txt": "ok\n", "nested/counts.csv": "a,1\n"})
+	writeFiles(t, filepath.Join(dir, "different"), map[string]string{"result.txt": "failed\n", "extra.txt": ""})
+
+	type assertionTest struct {
+		assert           func(tb testing.TB)
+		expectedFailures int
+	}
+
+	tests := []assertionTest{
+		{assert: func(tb testing.TB) { AssertExitCode(tb, Result{ExitCode: 0}, 0) }, expectedFailures: 0},
+		{assert: func(tb testing.TB) { AssertExitCode(tb, Result{ExitCode: 2}, 0) }, expectedFailures: 1},
+		{assert: func(tb testing.TB) { AssertFileExists(tb, filepath.Join(dir, "expected", "result.txt")) }, expectedFailures: 0},
+		{assert: func(tb testing.TB) { AssertFileExists(tb, filepath.Join(dir, "expected", "missing.txt")) }, expectedFailures: 1},
+		{assert: func(tb testing.TB) { AssertFileExists(tb, filepath.Join(dir, "expected", "nested")) }, expectedFailures: 1},
+		{assert: func(tb testing.TB) { AssertFileContents(tb, filepath.Join(dir, "expected", "result.txt"), "ok\n") }, expectedFailures: 0},
+		{assert: func(tb testing.TB) { AssertFileContents(tb, filepath.Join(dir, "expected", "result.txt"), "ok") }, expectedFailures: 1},
+		{assert: func(tb testing.TB) {
+			AssertDirMatches(tb, filepath.Join(dir, "matching"), filepath.Join(dir, "expected"))
+		}, expectedFailures: 0},
+		// result.txt differs, nested/counts.csv is missing, and extra.txt is unexpected
+		{assert: func(tb testing.TB) {
+			AssertDirMatches(tb, filepath.Join(dir, "different"), filepath.Join(dir, "expected"))
+		}, expectedFailures: 3},
+		{assert: func(tb testing.TB) {
+			AssertDirMatches(tb, filepath.Join(dir, "missing"), filepath.Join(dir, "expected"))
+		}, expectedFailures: 1},
+	}
+
+	for i, test := range tests {
+		recorder := &recordingTB{TB: t}
+		test.assert(recorder)
+		if len(recorder.failures) != test.expectedFailures {
+			t.Errorf("[Test %d] Unexpected number of failures: expected=%d, actual=%d (%v)", i, test.expectedFailures, len(recorder.failures), recorder.failures)
+		}
+	}
+}
+
+func TestFixture(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shnorkytest-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	fixtureDir := filepath.Join(dir, "testdata", "inputs")
+	writeFiles(t, fixtureDir, map[string]string{"a.txt": "a", "nested/b.txt": "b"})
+
+	h := &Harness{t: t, tempDir: filepath.Join(dir, "harness")}
+	err = os.Mkdir(h.tempDir, 0755)
+	if err != nil {
+		t.Fatalf("Could not create harness directory: %s", err.Error())
+	}
+
+	copiedDir := h.Fixture(fixtureDir)
+	if filepath.Base(copiedDir) != "inputs" {
+		t.Errorf("Unexpected name for copy of fixture: %s", copiedDir)
+	}
+	AssertDirMatches(t, copiedDir, fixtureDir)
+
+	err = ioutil.WriteFile(filepath.Join(copiedDir, "a.txt"), []byte("modified"), 0644)
+	if err != nil {
+		t.Fatalf("Could not modify copy of fixture: %s", err.Error())
+	}
+	AssertFileContents(t, filepath.Join(fixtureDir, "a.txt"), "a")
+
+	copiedFile := h.Fixture(filepath.Join(fixtureDir, "nested", "b.txt"))
+	AssertFileContents(t, copiedFile, "b")
+	if copiedFile == filepath.Join(copiedDir, "nested", "b.txt") {
+		t.Error("Expected each fixture to be copied into its own directory")
+	}
+}
@@ -0,0 +1,265 @@
+package staging
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// SchemeAzure is the URI scheme of mount sources which refer to blobs in Azure Blob Storage. Such
+// URIs are of the form "az://<account>/<container>/<blob>". Blob URLs of the form
+// "https://<account>.blob.core.windows.net/<container>/<blob>" are also accepted as mount sources
+// and are treated as the equivalent "az://" URIs.
+var SchemeAzure = "az"
+
+// AzureBlobHostSuffix is the suffix of the hosts of Azure Blob Storage accounts
+var AzureBlobHostSuffix = ".blob.core.windows.net"
+
+// azureStorageVersion is the version of the Blob Storage REST API that AzureBackend uses
+var azureStorageVersion = "2019-12-12"
+
+// AzureBackend - a Backend which talks to Azure Blob Storage. Its buckets are storage accounts, and
+// its keys are of the form "<container>/<blob>". Requests are authorized with a SAS token if one is
+// configured, and with the account's shared key otherwise. If neither is configured, requests are
+// made anonymously (which works for public containers).
+type AzureBackend struct {
+	endpoint   string
+	accountKey string
+	sasToken   string
+	client     *http.Client
+	now        func() time.Time
+}
+
+// NewAzureBackend creates an AzureBackend from the given configuration, falling back to the
+// AZURE_STORAGE_KEY and AZURE_STORAGE_SAS_TOKEN environment variables for credentials which are not
+// specified
+func NewAzureBackend(configuration state.AzureConfiguration) (*AzureBackend, error) {
+	materializedValues := make([]string, 3)
+	for i, value := range []string{configuration.Endpoint, configuration.AccountKey, configuration.SASToken} {
+		materializedValue, err := components.MaterializeTrustedEnv(value)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Azure configuration: %w", err)
+		}
+		materializedValues[i] = materializedValue
+	}
+
+	backend := &AzureBackend{
+		endpoint:   strings.TrimSuffix(materializedValues[0], "/"),
+		accountKey: materializedValues[1],
+		sasToken:   strings.TrimPrefix(materializedValues[2], "?"),
+		client:     http.DefaultClient,
+		now:        time.Now,
+	}
+	if backend.accountKey == "" {
+		backend.accountKey = os.Getenv("AZURE_STORAGE_KEY")
+	}
+	if backend.sasToken == "" {
+		backend.sasToken = strings.TrimPrefix(os.Getenv("AZURE_STORAGE_SAS_TOKEN"), "?")
+	}
+	return backend, nil
+}
+
+// azureLocation converts Azure blob URLs into the equivalent "az://" locations
+func azureLocation(uri string) (Location, bool) {
+	blobURL, err := url.Parse(uri)
+	if err != nil || blobURL.Scheme != "https" || !strings.HasSuffix(blobURL.Host, AzureBlobHostSuffix) {
+		return Location{}, false
+	}
+	account := strings.TrimSuffix(blobURL.Host, AzureBlobHostSuffix)
+	return Location{Scheme: SchemeAzure, Bucket: account, Key: strings.TrimPrefix(blobURL.Path, "/")}, true
+}
+
+// splitContainer splits a key of the form "<container>/<blob>" into its container and blob
+func splitContainer(key string) (string, string) {
+	separator := strings.Index(key, "/")
+	if separator < 0 {
+		return key, ""
+	}
+	return key[:separator], key[separator+1:]
+}
+
+// List implements Backend.List using (paginated) List Blobs requests
+func (backend *AzureBackend) List(ctx context.Context, account, prefix string) ([]string, error) {
+	container, blobPrefix := splitContainer(prefix)
+	keys := []string{}
+	marker := ""
+	for {
+		query := url.Values{"restype": {"container"}, "comp": {"list"}, "prefix": {blobPrefix}}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+		response, err := backend.do(ctx, http.MethodGet, account, container, "", query, nil, 0)
+		if err != nil {
+			return keys, err
+		}
+		var result struct {
+			Blobs []struct {
+				Name string `xml:"Name"`
+			} `xml:"Blobs>Blob"`
+			NextMarker string `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return keys, fmt.Errorf("Could not parse listing of az://%s/%s: %w", account, prefix, err)
+		}
+
+		for _, blob := range result.Blobs {
+			keys = append(keys, container+"/"+blob.Name)
+		}
+		if result.NextMarker == "" {
+			return keys, nil
+		}
+		marker = result.NextMarker
+	}
+}
+
+// Get implements Backend.Get
+func (backend *AzureBackend) Get(ctx context.Context, account, key string, w io.Writer) error {
+	container, blob := splitContainer(key)
+	response, err := backend.do(ctx, http.MethodGet, account, container, blob, url.Values{}, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+// Put implements Backend.Put by uploading the object as a block blob
+func (backend *AzureBackend) Put(ctx context.Context, account, key string, r io.Reader, size int64) error {
+	container, blob := splitContainer(key)
+	response, err := backend.do(ctx, http.MethodPut, account, container, blob, url.Values{}, r, size)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// do sends an authorized request for the given blob (or, if blob is empty, container) and returns
+// the response if it was successful. A 404 response results in ErrObjectNotFound.
+func (backend *AzureBackend) do(ctx context.Context, method, account, container, blob string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	endpoint := backend.endpoint
+	if endpoint == "" {
+		endpoint = fmt.Sprintf("https://%s%s", account, AzureBlobHostSuffix)
+	}
+	resourcePath := "/" + url.PathEscape(container)
+	if blob != "" {
+		resourcePath += "/" + strings.Replace(url.PathEscape(blob), "%2F", "/", -1)
+	}
+	requestURL := endpoint + resourcePath
+	encodedQuery := query.Encode()
+	if backend.sasToken != "" {
+		if encodedQuery != "" {
+			encodedQuery += "&"
+		}
+		encodedQuery += backend.sasToken
+	}
+	if encodedQuery != "" {
+		requestURL += "?" + encodedQuery
+	}
+
+	request, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	request.Header.Set("x-ms-version", azureStorageVersion)
+	request.Header.Set("x-ms-date", backend.now().UTC().Format(http.TimeFormat))
+	if body != nil {
+		request.ContentLength = size
+		request.Header.Set("x-ms-blob-type", "BlockBlob")
+	}
+	if backend.sasToken == "" && backend.accountKey != "" {
+		err = backend.sign(request, account, query)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	response, err := backend.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, ErrObjectNotFound
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, fmt.Errorf("Azure Blob Storage request (%s %s) failed with status %d: %s", method, resourcePath, response.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return response, nil
+}
+
+// sign authorizes the given request with the account's shared key
+func (backend *AzureBackend) sign(request *http.Request, account string, query url.Values) error {
+	key, err := base64.StdEncoding.DecodeString(backend.accountKey)
+	if err != nil {
+		return fmt.Errorf("Invalid Azure storage account key: %w", err)
+	}
+	signature := base64.StdEncoding.EncodeToString(hmacSHA256(key, azureStringToSign(request, account, query)))
+	request.Header.Set("Authorization", fmt.Sprintf("SharedKey %s:%s", account, signature))
+	return nil
+}
+
+// azureStringToSign builds the string that is signed to authorize the given request with a shared
+// key
+func azureStringToSign(request *http.Request, account string, query url.Values) string {
+	contentLength := ""
+	if request.ContentLength > 0 {
+		contentLength = fmt.Sprintf("%d", request.ContentLength)
+	}
+
+	msHeaders := []string{}
+	for name := range request.Header {
+		lowerName := strings.ToLower(name)
+		if strings.HasPrefix(lowerName, "x-ms-") {
+			msHeaders = append(msHeaders, fmt.Sprintf("%s:%s", lowerName, strings.TrimSpace(request.Header.Get(name))))
+		}
+	}
+	sort.Strings(msHeaders)
+
+	canonicalizedResource := "/" + account + request.URL.EscapedPath()
+	queryNames := make([]string, 0, len(query))
+	for name := range query {
+		queryNames = append(queryNames, name)
+	}
+	sort.Strings(queryNames)
+	for _, name := range queryNames {
+		values := append([]string{}, query[name]...)
+		sort.Strings(values)
+		canonicalizedResource += fmt.Sprintf("\n%s:%s", strings.ToLower(name), strings.Join(values, ","))
+	}
+
+	return strings.Join([]string{
+		request.Method,
+		request.Header.Get("Content-Encoding"),
+		request.Header.Get("Content-Language"),
+		contentLength,
+		request.Header.Get("Content-MD5"),
+		request.Header.Get("Content-Type"),
+		"", // Date (x-ms-date is used instead)
+		request.Header.Get("If-Modified-Since"),
+		request.Header.Get("If-Match"),
+		request.Header.Get("If-None-Match"),
+		request.Header.Get("If-Unmodified-Since"),
+		request.Header.Get("Range"),
+		strings.Join(msHeaders, "\n"),
+		canonicalizedResource,
+	}, "\n")
+}
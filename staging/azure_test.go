@@ -0,0 +1,123 @@
+package staging
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestAzureLocation(t *testing.T) {
+	location, err := ParseLocation("https://account.blob.core.windows.net/container/path/blob.csv")
+	if err != nil {
+		t.Fatalf("Could not parse blob URL: %s", err.Error())
+	}
+	expected := Location{Scheme: SchemeAzure, Bucket: "account", Key: "container/path/blob.csv"}
+	if location != expected {
+		t.Errorf("Unexpected location: expected=%v, actual=%v", expected, location)
+	}
+
+	if !Supported("az://account/container/blob.csv") || !Supported("https://account.blob.core.windows.net/container/") {
+		t.Errorf("Expected Azure sources to be supported")
+	}
+	location, err = ParseLocation("https://example.com/container/blob.csv")
+	if err != nil || location.Scheme == SchemeAzure {
+		t.Errorf("Expected non-Azure https source not to be parsed as an Azure location: %v", location)
+	}
+}
+
+func TestAzureBackend(t *testing.T) {
+	accountKey := base64.StdEncoding.EncodeToString([]byte("secret"))
+	objects := map[string]string{"container/data/a.txt": "a", "container/data/b.txt": "b"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		signature := base64.StdEncoding.EncodeToString(hmacSHA256([]byte("secret"), azureStringToSign(r, "account", query)))
+		if r.Header.Get("Authorization") != fmt.Sprintf("SharedKey account:%s", signature) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/")
+		switch {
+		case r.Method == http.MethodGet && query.Get("comp") == "list":
+			prefix := query.Get("prefix")
+			if query.Get("marker") == "" {
+				fmt.Fprintf(w, "<EnumerationResults><Blobs><Blob><Name>%sa.txt</Name></Blob></Blobs><NextMarker>next</NextMarker></EnumerationResults>", prefix)
+				return
+			}
+			fmt.Fprintf(w, "<EnumerationResults><Blobs><Blob><Name>%sb.txt</Name></Blob></Blobs><NextMarker /></EnumerationResults>", prefix)
+		case r.Method == http.MethodGet:
+			contents, ok := objects[path]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, contents)
+		case r.Method == http.MethodPut:
+			if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			contents, _ := ioutil.ReadAll(r.Body)
+			objects[path] = string(contents)
+			w.WriteHeader(http.StatusCreated)
+		}
+	}))
+	defer server.Close()
+
+	backend, err := NewAzureBackend(state.AzureConfiguration{AccountKey: accountKey, Endpoint: server.URL})
+	if err != nil {
+		t.Fatalf("Could not create Azure backend: %s", err.Error())
+	}
+	ctx := context.Background()
+
+	keys, err := backend.List(ctx, "account", "container/data/")
+	if err != nil {
+		t.Fatalf("Could not list blobs: %s", err.Error())
+	}
+	if strings.Join(keys, ",") != "container/data/a.txt,container/data/b.txt" {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+
+	var buffer bytes.Buffer
+	err = backend.Get(ctx, "account", "container/data/a.txt", &buffer)
+	if err != nil || buffer.String() != "a" {
+		t.Errorf("Unexpected blob contents: %s (%v)", buffer.String(), err)
+	}
+	err = backend.Get(ctx, "account", "container/data/missing.txt", &buffer)
+	if err != ErrObjectNotFound {
+		t.Errorf("Expected ErrObjectNotFound for missing blob, got: %v", err)
+	}
+
+	err = backend.Put(ctx, "account", "container/data/c.txt", strings.NewReader("c"), 1)
+	if err != nil || objects["container/data/c.txt"] != "c" {
+		t.Errorf("Unexpected result of upload: %v", err)
+	}
+}
+
+func TestAzureBackendSASToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("sig") != "signature" || r.Header.Get("Authorization") != "" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		fmt.Fprint(w, "contents")
+	}))
+	defer server.Close()
+
+	backend, err := NewAzureBackend(state.AzureConfiguration{SASToken: "?sv=2019-12-12&sig=signature", AccountKey: "ignored", Endpoint: server.URL})
+	if err != nil {
+		t.Fatalf("Could not create Azure backend: %s", err.Error())
+	}
+	var buffer bytes.Buffer
+	err = backend.Get(context.Background(), "account", "container/blob.txt", &buffer)
+	if err != nil || buffer.String() != "contents" {
+		t.Errorf("Unexpected blob contents: %s (%v)", buffer.String(), err)
+	}
+}
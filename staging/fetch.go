@@ -0,0 +1,187 @@
+package staging
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// SchemeHTTPS is the URI scheme of mount sources which are fetched from web servers
+var SchemeHTTPS = "https"
+
+// SchemeSFTP is the URI scheme of mount sources which are fetched from SFTP servers. Such URIs are
+// of the form "sftp://[<user>@]<host>[:<port>]/<path>".
+var SchemeSFTP = "sftp"
+
+// ChecksumAlgorithms maps the names of the checksum algorithms that can be used to verify fetched
+// mount sources to their implementations. A checksum is specified in the fragment of the source
+// URI, e.g. "https://example.com/data.csv#sha256=<hex digest>".
+var ChecksumAlgorithms = map[string]func() hash.Hash{
+	"sha256": sha256.New,
+	"sha512": sha512.New,
+}
+
+// Fetcher - a read-only source of files. Unlike objects staged from a Backend, fetched files are
+// never uploaded back.
+type Fetcher interface {
+	// Fetch downloads the file referred to by the given URI (without its fragment) to localPath
+	Fetch(ctx context.Context, source *url.URL, localPath string) error
+}
+
+// Fetchers returns the fetchers that ship with shnorky (keyed by URI scheme)
+func Fetchers() map[string]Fetcher {
+	return map[string]Fetcher{
+		SchemeHTTPS: &HTTPFetcher{client: http.DefaultClient},
+		SchemeSFTP:  &SFTPFetcher{Command: "sftp"},
+	}
+}
+
+// HTTPFetcher - a Fetcher which downloads files with HTTP GET requests. Credentials in the user
+// information of a URI are sent using basic authentication.
+type HTTPFetcher struct {
+	client *http.Client
+}
+
+// Fetch implements Fetcher.Fetch
+func (fetcher *HTTPFetcher) Fetch(ctx context.Context, source *url.URL, localPath string) error {
+	request, err := http.NewRequest(http.MethodGet, source.String(), nil)
+	if err != nil {
+		return err
+	}
+	response, err := fetcher.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("Request (GET %s%s) failed with status %d: %s", source.Host, source.Path, response.StatusCode, strings.TrimSpace(string(message)))
+	}
+
+	localFile, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+	_, err = io.Copy(localFile, response.Body)
+	return err
+}
+
+// SFTPFetcher - a Fetcher which downloads files using the OpenSSH sftp client on the host. The
+// client runs in batch mode, so authentication must not be interactive (e.g. it can use an SSH
+// agent or the identities and known hosts configured for the user running shnorky).
+type SFTPFetcher struct {
+	// Command is the sftp client executable
+	Command string
+}
+
+// Fetch implements Fetcher.Fetch
+func (fetcher *SFTPFetcher) Fetch(ctx context.Context, source *url.URL, localPath string) error {
+	args, err := sftpArgs(source, localPath)
+	if err != nil {
+		return err
+	}
+	output, err := exec.CommandContext(ctx, fetcher.Command, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s: %s", err.Error(), strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// sftpArgs builds the arguments with which the sftp client downloads the given source to localPath
+func sftpArgs(source *url.URL, localPath string) ([]string, error) {
+	if _, hasPassword := source.User.Password(); hasPassword {
+		return nil, fmt.Errorf("Passwords are not supported in SFTP sources: sftp://%s%s", source.Host, source.Path)
+	}
+	if source.Hostname() == "" || source.Path == "" {
+		return nil, fmt.Errorf("SFTP source must specify a host and a path: %s", source.String())
+	}
+
+	args := []string{"-q", "-o", "BatchMode=yes"}
+	if source.Port() != "" {
+		args = append(args, "-P", source.Port())
+	}
+	remote := source.Hostname()
+	if strings.Contains(remote, ":") {
+		remote = "[" + remote + "]"
+	}
+	if source.User != nil {
+		remote = source.User.Username() + "@" + remote
+	}
+	return append(args, remote+":"+source.Path, localPath), nil
+}
+
+// parseChecksum parses a URI fragment of the form "<algorithm>=<hex digest>". An empty fragment
+// results in an empty algorithm and digest.
+func parseChecksum(fragment string) (string, string, error) {
+	if fragment == "" {
+		return "", "", nil
+	}
+	separator := strings.Index(fragment, "=")
+	if separator < 0 {
+		return "", "", fmt.Errorf("Invalid checksum (expected <algorithm>=<digest>): %s", fragment)
+	}
+	algorithm, digest := fragment[:separator], strings.ToLower(fragment[separator+1:])
+	if _, ok := ChecksumAlgorithms[algorithm]; !ok {
+		return "", "", fmt.Errorf("Unsupported checksum algorithm: %s", algorithm)
+	}
+	if _, err := hex.DecodeString(digest); err != nil || digest == "" {
+		return "", "", fmt.Errorf("Invalid %s digest: %s", algorithm, digest)
+	}
+	return algorithm, digest, nil
+}
+
+// fetch downloads the given source into the given directory using the given fetcher, verifies its
+// checksum (if the source specifies one), and returns the path of the downloaded file
+func fetch(ctx context.Context, fetcher Fetcher, source, dir string) (string, error) {
+	sourceURL, err := url.Parse(source)
+	if err != nil {
+		return "", err
+	}
+	algorithm, digest, err := parseChecksum(sourceURL.Fragment)
+	if err != nil {
+		return "", err
+	}
+	sourceURL.Fragment = ""
+
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	localPath := filepath.Join(dir, path.Base(sourceURL.Path))
+	err = fetcher.Fetch(ctx, sourceURL, localPath)
+	if err != nil {
+		return localPath, err
+	}
+	if algorithm == "" {
+		return localPath, nil
+	}
+
+	localFile, err := os.Open(localPath)
+	if err != nil {
+		return localPath, err
+	}
+	defer localFile.Close()
+	hasher := ChecksumAlgorithms[algorithm]()
+	_, err = io.Copy(hasher, localFile)
+	if err != nil {
+		return localPath, err
+	}
+	actualDigest := hex.EncodeToString(hasher.Sum(nil))
+	if actualDigest != digest {
+		return localPath, fmt.Errorf("Checksum mismatch: expected %s=%s, got %s=%s", algorithm, digest, algorithm, actualDigest)
+	}
+	return localPath, nil
+}
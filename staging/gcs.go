@@ -0,0 +1,349 @@
+package staging
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// SchemeGCS is the URI scheme of mount sources which refer to objects in Google Cloud Storage
+var SchemeGCS = "gs"
+
+// GCSScope is the OAuth2 scope requested for access to Google Cloud Storage
+var GCSScope = "https://www.googleapis.com/auth/devstorage.read_write"
+
+// gceMetadataTokenURL is the URL from which access tokens are requested on Google Compute Engine
+// (and other environments with a GCE metadata server)
+var gceMetadataTokenURL = "http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token"
+
+// GCSBackend - a Backend which talks to Google Cloud Storage through its JSON API, authenticating
+// with application default credentials
+type GCSBackend struct {
+	endpoint string
+	tokens   *gcsTokenSource
+	client   *http.Client
+}
+
+// NewGCSBackend creates a GCSBackend from the given configuration. Credentials are loaded lazily
+// (on the first request) following the application default credentials strategy: the credentials
+// file in the configuration (or in GOOGLE_APPLICATION_CREDENTIALS), then the gcloud application
+// default credentials file, then the GCE metadata server.
+func NewGCSBackend(configuration state.GCSConfiguration) (*GCSBackend, error) {
+	endpoint, err := components.MaterializeTrustedEnv(configuration.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid GCS configuration: %w", err)
+	}
+	endpoint = strings.TrimSuffix(endpoint, "/")
+	if endpoint == "" {
+		endpoint = "https://storage.googleapis.com"
+	}
+	credentialsFile, err := components.MaterializeTrustedEnv(configuration.CredentialsFile)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid GCS configuration: %w", err)
+	}
+	return &GCSBackend{
+		endpoint: endpoint,
+		tokens:   &gcsTokenSource{credentialsFile: credentialsFile, client: http.DefaultClient, now: time.Now},
+		client:   http.DefaultClient,
+	}, nil
+}
+
+// List implements Backend.List using (paginated) object listing requests
+func (backend *GCSBackend) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	keys := []string{}
+	pageToken := ""
+	for {
+		query := url.Values{"prefix": {prefix}, "fields": {"items(name),nextPageToken"}}
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+		requestURL := fmt.Sprintf("%s/storage/v1/b/%s/o?%s", backend.endpoint, url.PathEscape(bucket), query.Encode())
+		response, err := backend.do(ctx, http.MethodGet, requestURL, nil, 0)
+		if err != nil {
+			return keys, err
+		}
+		var result struct {
+			Items []struct {
+				Name string `json:"name"`
+			} `json:"items"`
+			NextPageToken string `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return keys, fmt.Errorf("Could not parse listing of gs://%s/%s: %w", bucket, prefix, err)
+		}
+
+		for _, item := range result.Items {
+			keys = append(keys, item.Name)
+		}
+		if result.NextPageToken == "" {
+			return keys, nil
+		}
+		pageToken = result.NextPageToken
+	}
+}
+
+// Get implements Backend.Get
+func (backend *GCSBackend) Get(ctx context.Context, bucket, key string, w io.Writer) error {
+	requestURL := fmt.Sprintf("%s/storage/v1/b/%s/o/%s?alt=media", backend.endpoint, url.PathEscape(bucket), url.PathEscape(key))
+	response, err := backend.do(ctx, http.MethodGet, requestURL, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+// Put implements Backend.Put using a simple media upload
+func (backend *GCSBackend) Put(ctx context.Context, bucket, key string, r io.Reader, size int64) error {
+	query := url.Values{"uploadType": {"media"}, "name": {key}}
+	requestURL := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?%s", backend.endpoint, url.PathEscape(bucket), query.Encode())
+	response, err := backend.do(ctx, http.MethodPost, requestURL, r, size)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// do sends an authenticated request to the given URL and returns the response if it was
+// successful. A 404 response results in ErrObjectNotFound.
+func (backend *GCSBackend) do(ctx context.Context, method, requestURL string, body io.Reader, size int64) (*http.Response, error) {
+	token, err := backend.tokens.token(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("Could not obtain Google Cloud credentials: %w", err)
+	}
+
+	request, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	if body != nil {
+		request.ContentLength = size
+		request.Header.Set("Content-Type", "application/octet-stream")
+	}
+	request.Header.Set("Authorization", "Bearer "+token)
+
+	response, err := backend.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, ErrObjectNotFound
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, fmt.Errorf("GCS request (%s %s) failed with status %d: %s", method, request.URL.Path, response.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return response, nil
+}
+
+// gcsCredentials - the members of a Google Cloud credentials file (of either the "service_account"
+// or the "authorized_user" type) that are used to obtain access tokens
+type gcsCredentials struct {
+	Type         string `json:"type"`
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	TokenURI     string `json:"token_uri"`
+	ClientID     string `json:"client_id"`
+	ClientSecret string `json:"client_secret"`
+	RefreshToken string `json:"refresh_token"`
+}
+
+// gcsTokenSource obtains (and caches) OAuth2 access tokens using application default credentials
+type gcsTokenSource struct {
+	credentialsFile string
+	client          *http.Client
+	now             func() time.Time
+
+	lock        sync.Mutex
+	accessToken string
+	expiresAt   time.Time
+}
+
+func (source *gcsTokenSource) token(ctx context.Context) (string, error) {
+	source.lock.Lock()
+	defer source.lock.Unlock()
+	if source.accessToken != "" && source.now().Add(time.Minute).Before(source.expiresAt) {
+		return source.accessToken, nil
+	}
+
+	credentialsFile, err := source.findCredentialsFile()
+	if err != nil {
+		return "", err
+	}
+
+	var request *http.Request
+	if credentialsFile == "" {
+		request, err = http.NewRequest(http.MethodGet, gceMetadataTokenURL, nil)
+		if err != nil {
+			return "", err
+		}
+		request.Header.Set("Metadata-Flavor", "Google")
+	} else {
+		request, err = source.credentialsRequest(credentialsFile)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	response, err := source.client.Do(request.WithContext(ctx))
+	if err != nil {
+		return "", err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return "", fmt.Errorf("Token request failed with status %d: %s", response.StatusCode, strings.TrimSpace(string(message)))
+	}
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.NewDecoder(response.Body).Decode(&result)
+	if err != nil {
+		return "", err
+	}
+	if result.AccessToken == "" {
+		return "", errors.New("Token response did not contain an access token")
+	}
+
+	source.accessToken = result.AccessToken
+	source.expiresAt = source.now().Add(time.Duration(result.ExpiresIn) * time.Second)
+	return source.accessToken, nil
+}
+
+// findCredentialsFile returns the path of the credentials file to use, or the empty string if
+// credentials should be obtained from the GCE metadata server
+func (source *gcsTokenSource) findCredentialsFile() (string, error) {
+	if source.credentialsFile != "" {
+		return source.credentialsFile, nil
+	}
+	if credentialsFile := os.Getenv("GOOGLE_APPLICATION_CREDENTIALS"); credentialsFile != "" {
+		return credentialsFile, nil
+	}
+	configDir := os.Getenv("CLOUDSDK_CONFIG")
+	if configDir == "" {
+		homeDir, err := os.UserHomeDir()
+		if err == nil {
+			configDir = filepath.Join(homeDir, ".config", "gcloud")
+		}
+	}
+	if configDir != "" {
+		wellKnownFile := filepath.Join(configDir, "application_default_credentials.json")
+		if _, err := os.Stat(wellKnownFile); err == nil {
+			return wellKnownFile, nil
+		}
+	}
+	return "", nil
+}
+
+// credentialsRequest builds the token request for the credentials in the given file
+func (source *gcsTokenSource) credentialsRequest(credentialsFile string) (*http.Request, error) {
+	credentialsBytes, err := ioutil.ReadFile(credentialsFile)
+	if err != nil {
+		return nil, err
+	}
+	var credentials gcsCredentials
+	err = json.Unmarshal(credentialsBytes, &credentials)
+	if err != nil {
+		return nil, fmt.Errorf("Could not parse credentials file (%s): %w", credentialsFile, err)
+	}
+	if credentials.TokenURI == "" {
+		credentials.TokenURI = "https://oauth2.googleapis.com/token"
+	}
+
+	var form url.Values
+	switch credentials.Type {
+	case "service_account":
+		assertion, err := source.serviceAccountAssertion(credentials)
+		if err != nil {
+			return nil, err
+		}
+		form = url.Values{"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"}, "assertion": {assertion}}
+	case "authorized_user":
+		form = url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {credentials.ClientID},
+			"client_secret": {credentials.ClientSecret},
+			"refresh_token": {credentials.RefreshToken},
+		}
+	default:
+		return nil, fmt.Errorf("Unsupported credentials type in %s: %s", credentialsFile, credentials.Type)
+	}
+
+	request, err := http.NewRequest(http.MethodPost, credentials.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return request, nil
+}
+
+// serviceAccountAssertion builds a signed JWT with which the given service account requests an
+// access token
+func (source *gcsTokenSource) serviceAccountAssertion(credentials gcsCredentials) (string, error) {
+	block, _ := pem.Decode([]byte(credentials.PrivateKey))
+	if block == nil {
+		return "", errors.New("Could not decode service account private key")
+	}
+	parsedKey, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		parsedKey, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return "", fmt.Errorf("Could not parse service account private key: %w", err)
+		}
+	}
+	privateKey, ok := parsedKey.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("Service account private key is not an RSA key")
+	}
+
+	now := source.now()
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   credentials.ClientEmail,
+		"scope": GCSScope,
+		"aud":   credentials.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	signingInput := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signingInput))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", err
+	}
+	return signingInput + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
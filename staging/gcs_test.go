@@ -0,0 +1,121 @@
+package staging
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+func TestGCSBackend(t *testing.T) {
+	objects := map[string]string{"data/a.txt": "a", "data/b.txt": "b"}
+	tokenRequests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			tokenRequests++
+			r.ParseForm()
+			if r.Form.Get("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" || len(strings.Split(r.Form.Get("assertion"), ".")) != 3 {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			fmt.Fprint(w, `{"access_token": "token", "expires_in": 3600}`)
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/storage/v1/b/bucket/o":
+			prefix := r.URL.Query().Get("prefix")
+			if r.URL.Query().Get("pageToken") == "" {
+				fmt.Fprintf(w, `{"items": [{"name": "%sa.txt"}], "nextPageToken": "next"}`, prefix)
+				return
+			}
+			fmt.Fprintf(w, `{"items": [{"name": "%sb.txt"}]}`, prefix)
+		case r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/storage/v1/b/bucket/o/"):
+			contents, ok := objects[strings.TrimPrefix(r.URL.Path, "/storage/v1/b/bucket/o/")]
+			if !ok || r.URL.Query().Get("alt") != "media" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, contents)
+		case r.Method == http.MethodPost && r.URL.Path == "/upload/storage/v1/b/bucket/o":
+			contents, _ := ioutil.ReadAll(r.Body)
+			objects[r.URL.Query().Get("name")] = string(contents)
+			fmt.Fprint(w, `{}`)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer server.Close()
+
+	credentialsDir, err := ioutil.TempDir("", "shnorky-gcs-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(credentialsDir)
+
+	privateKey, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("Could not generate private key: %s", err.Error())
+	}
+	privateKeyPEM := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(privateKey)})
+	credentials, _ := json.Marshal(map[string]string{
+		"type":         "service_account",
+		"client_email": "shnorky@example.iam.gserviceaccount.com",
+		"private_key":  string(privateKeyPEM),
+		"token_uri":    server.URL + "/token",
+	})
+	credentialsFile := filepath.Join(credentialsDir, "credentials.json")
+	err = ioutil.WriteFile(credentialsFile, credentials, 0600)
+	if err != nil {
+		t.Fatalf("Could not write credentials file: %s", err.Error())
+	}
+
+	backend, err := NewGCSBackend(state.GCSConfiguration{CredentialsFile: credentialsFile, Endpoint: server.URL})
+	if err != nil {
+		t.Fatalf("Could not create GCS backend: %s", err.Error())
+	}
+	ctx := context.Background()
+
+	keys, err := backend.List(ctx, "bucket", "data/")
+	if err != nil {
+		t.Fatalf("Could not list objects: %s", err.Error())
+	}
+	if strings.Join(keys, ",") != "data/a.txt,data/b.txt" {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+
+	var buffer bytes.Buffer
+	err = backend.Get(ctx, "bucket", "data/a.txt", &buffer)
+	if err != nil || buffer.String() != "a" {
+		t.Errorf("Unexpected object contents: %s (%v)", buffer.String(), err)
+	}
+	err = backend.Get(ctx, "bucket", "data/missing.txt", &buffer)
+	if err != ErrObjectNotFound {
+		t.Errorf("Expected ErrObjectNotFound for missing object, got: %v", err)
+	}
+
+	err = backend.Put(ctx, "bucket", "data/c.txt", strings.NewReader("c"), 1)
+	if err != nil || objects["data/c.txt"] != "c" {
+		t.Errorf("Unexpected result of upload: %v", err)
+	}
+
+	if tokenRequests != 1 {
+		t.Errorf("Expected access token to be cached: token requests=%d", tokenRequests)
+	}
+}
@@ -0,0 +1,273 @@
+package staging
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// SchemeS3 is the URI scheme of mount sources which refer to objects in S3
+var SchemeS3 = "s3"
+
+// S3Backend - a Backend which talks to S3 (or an S3-compatible object store) using requests signed
+// with AWS Signature Version 4
+type S3Backend struct {
+	region          string
+	endpoint        string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	client          *http.Client
+	now             func() time.Time
+}
+
+// NewS3Backend creates an S3Backend from the given configuration, materializing "env:" values and
+// falling back to the standard AWS environment variables for members which are not specified
+func NewS3Backend(configuration state.S3Configuration) (*S3Backend, error) {
+	var materializeErr error
+	valueOrEnv := func(value string, variables ...string) string {
+		if value != "" {
+			materializedValue, err := components.MaterializeTrustedEnv(value)
+			if err != nil && materializeErr == nil {
+				materializeErr = err
+			}
+			return materializedValue
+		}
+		for _, variable := range variables {
+			if envValue := os.Getenv(variable); envValue != "" {
+				return envValue
+			}
+		}
+		return ""
+	}
+
+	backend := &S3Backend{
+		region:          valueOrEnv(configuration.Region, "AWS_REGION", "AWS_DEFAULT_REGION"),
+		endpoint:        strings.TrimSuffix(valueOrEnv(configuration.Endpoint), "/"),
+		accessKeyID:     valueOrEnv(configuration.AccessKeyID, "AWS_ACCESS_KEY_ID"),
+		secretAccessKey: valueOrEnv(configuration.SecretAccessKey, "AWS_SECRET_ACCESS_KEY"),
+		sessionToken:    valueOrEnv(configuration.SessionToken, "AWS_SESSION_TOKEN"),
+		client:          http.DefaultClient,
+		now:             time.Now,
+	}
+	if materializeErr != nil {
+		return nil, fmt.Errorf("Invalid S3 configuration: %w", materializeErr)
+	}
+	if backend.region == "" {
+		backend.region = "us-east-1"
+	}
+	if backend.endpoint == "" {
+		backend.endpoint = fmt.Sprintf("https://s3.%s.amazonaws.com", backend.region)
+	}
+	return backend, nil
+}
+
+// listBucketResult - the parts of the response to a ListObjectsV2 request that S3Backend uses
+type listBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+// List implements Backend.List using (paginated) ListObjectsV2 requests
+func (backend *S3Backend) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	keys := []string{}
+	continuationToken := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if continuationToken != "" {
+			query.Set("continuation-token", continuationToken)
+		}
+		response, err := backend.do(ctx, http.MethodGet, bucket, "", query, nil, 0)
+		if err != nil {
+			return keys, err
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(response.Body).Decode(&result)
+		response.Body.Close()
+		if err != nil {
+			return keys, fmt.Errorf("Could not parse listing of s3://%s/%s: %w", bucket, prefix, err)
+		}
+
+		for _, object := range result.Contents {
+			keys = append(keys, object.Key)
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return keys, nil
+		}
+		continuationToken = result.NextContinuationToken
+	}
+}
+
+// Get implements Backend.Get
+func (backend *S3Backend) Get(ctx context.Context, bucket, key string, w io.Writer) error {
+	response, err := backend.do(ctx, http.MethodGet, bucket, key, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	_, err = io.Copy(w, response.Body)
+	return err
+}
+
+// Put implements Backend.Put
+func (backend *S3Backend) Put(ctx context.Context, bucket, key string, r io.Reader, size int64) error {
+	response, err := backend.do(ctx, http.MethodPut, bucket, key, nil, r, size)
+	if err != nil {
+		return err
+	}
+	response.Body.Close()
+	return nil
+}
+
+// do sends a signed request for the given object (or, if key is empty, bucket) and returns the
+// response if it was successful. A 404 response results in ErrObjectNotFound.
+func (backend *S3Backend) do(ctx context.Context, method, bucket, key string, query url.Values, body io.Reader, size int64) (*http.Response, error) {
+	endpoint, err := url.Parse(backend.endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid S3 endpoint (%s): %w", backend.endpoint, err)
+	}
+	canonicalURI := "/" + awsURIEncode(bucket, false)
+	if key != "" {
+		canonicalURI += "/" + awsURIEncode(key, true)
+	}
+	canonicalURI = strings.TrimSuffix(endpoint.Path, "/") + canonicalURI
+	requestURL := fmt.Sprintf("%s://%s%s", endpoint.Scheme, endpoint.Host, canonicalURI)
+	canonicalQuery := canonicalQueryString(query)
+	if canonicalQuery != "" {
+		requestURL += "?" + canonicalQuery
+	}
+
+	request, err := http.NewRequest(method, requestURL, body)
+	if err != nil {
+		return nil, err
+	}
+	request = request.WithContext(ctx)
+	if body != nil {
+		request.ContentLength = size
+	}
+	backend.sign(request, canonicalURI, canonicalQuery)
+
+	response, err := backend.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	if response.StatusCode == http.StatusNotFound {
+		response.Body.Close()
+		return nil, ErrObjectNotFound
+	}
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		response.Body.Close()
+		return nil, fmt.Errorf("S3 request (%s %s) failed with status %d: %s", method, canonicalURI, response.StatusCode, strings.TrimSpace(string(message)))
+	}
+	return response, nil
+}
+
+// sign adds AWS Signature Version 4 headers to the given request. The payload is not signed, which
+// S3 allows for requests made over HTTPS.
+func (backend *S3Backend) sign(request *http.Request, canonicalURI, canonicalQuery string) {
+	now := backend.now().UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	payloadHash := "UNSIGNED-PAYLOAD"
+
+	request.Header.Set("X-Amz-Date", amzDate)
+	request.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if backend.sessionToken != "" {
+		request.Header.Set("X-Amz-Security-Token", backend.sessionToken)
+	}
+	if backend.accessKeyID == "" {
+		return
+	}
+
+	headers := map[string]string{"host": request.URL.Host}
+	for name := range request.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(request.Header.Get(name))
+	}
+	headerNames := make([]string, 0, len(headers))
+	for name := range headers {
+		headerNames = append(headerNames, name)
+	}
+	sort.Strings(headerNames)
+	canonicalHeaders := ""
+	for _, name := range headerNames {
+		canonicalHeaders += fmt.Sprintf("%s:%s\n", name, headers[name])
+	}
+	signedHeaders := strings.Join(headerNames, ";")
+
+	canonicalRequest := strings.Join([]string{request.Method, canonicalURI, canonicalQuery, canonicalHeaders, signedHeaders, payloadHash}, "\n")
+	scope := fmt.Sprintf("%s/%s/s3/aws4_request", date, backend.region)
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := strings.Join([]string{"AWS4-HMAC-SHA256", amzDate, scope, hex.EncodeToString(canonicalRequestHash[:])}, "\n")
+
+	signingKey := awsSigningKey(backend.secretAccessKey, date, backend.region, "s3")
+	signature := hex.EncodeToString(hmacSHA256(signingKey, stringToSign))
+
+	request.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", backend.accessKeyID, scope, signedHeaders, signature))
+}
+
+// awsSigningKey derives the AWS Signature Version 4 signing key for the given date, region, and
+// service
+func awsSigningKey(secretAccessKey, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4"+secretAccessKey), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// canonicalQueryString renders the given query parameters as AWS expects them in canonical
+// requests: sorted by name, with names and values URI-encoded
+func canonicalQueryString(query url.Values) string {
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	parameters := []string{}
+	for _, name := range names {
+		for _, value := range query[name] {
+			parameters = append(parameters, fmt.Sprintf("%s=%s", awsURIEncode(name, false), awsURIEncode(value, false)))
+		}
+	}
+	return strings.Join(parameters, "&")
+}
+
+// awsURIEncode percent-encodes every byte of the given string except the unreserved characters
+// (and, if keepSlashes is true, "/")
+func awsURIEncode(value string, keepSlashes bool) string {
+	var encoded strings.Builder
+	for _, b := range []byte(value) {
+		switch {
+		case b >= 'A' && b <= 'Z', b >= 'a' && b <= 'z', b >= '0' && b <= '9', b == '-', b == '_', b == '.', b == '~':
+			encoded.WriteByte(b)
+		case b == '/' && keepSlashes:
+			encoded.WriteByte(b)
+		default:
+			fmt.Fprintf(&encoded, "%%%02X", b)
+		}
+	}
+	return encoded.String()
+}
@@ -0,0 +1,104 @@
+package staging
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/state"
+)
+
+// TestAWSSigningKey checks signing key derivation against the example in the AWS Signature Version
+// 4 documentation
+func TestAWSSigningKey(t *testing.T) {
+	signingKey := awsSigningKey("wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", "20120215", "us-east-1", "iam")
+	expected := "f4780e2d9f65fa895f9c67b32ce1baf0b0d8a43505a000a1a9e090d414db404d"
+	if hex.EncodeToString(signingKey) != expected {
+		t.Errorf("Unexpected signing key: expected=%s, actual=%s", expected, hex.EncodeToString(signingKey))
+	}
+}
+
+func TestAWSURIEncode(t *testing.T) {
+	if encoded := awsURIEncode("path/to my+file~.csv", true); encoded != "path/to%20my%2Bfile~.csv" {
+		t.Errorf("Unexpected encoding: %s", encoded)
+	}
+	if encoded := awsURIEncode("a/b", false); encoded != "a%2Fb" {
+		t.Errorf("Unexpected encoding: %s", encoded)
+	}
+}
+
+func TestS3Backend(t *testing.T) {
+	objects := map[string]string{"data/a.txt": "a", "data/b.txt": "b"}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/20200301/eu-west-1/s3/aws4_request") {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if !strings.HasPrefix(r.URL.Path, "/bucket") {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		key := strings.TrimPrefix(strings.TrimPrefix(r.URL.Path, "/bucket"), "/")
+		switch {
+		case r.Method == http.MethodGet && key == "":
+			if r.URL.Query().Get("list-type") != "2" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			prefix := r.URL.Query().Get("prefix")
+			if r.URL.Query().Get("continuation-token") == "" {
+				fmt.Fprintf(w, "<ListBucketResult><Contents><Key>%sa.txt</Key></Contents><IsTruncated>true</IsTruncated><NextContinuationToken>next</NextContinuationToken></ListBucketResult>", prefix)
+				return
+			}
+			fmt.Fprintf(w, "<ListBucketResult><Contents><Key>%sb.txt</Key></Contents><IsTruncated>false</IsTruncated></ListBucketResult>", prefix)
+		case r.Method == http.MethodGet:
+			contents, ok := objects[key]
+			if !ok {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			fmt.Fprint(w, contents)
+		case r.Method == http.MethodPut:
+			contents, _ := ioutil.ReadAll(r.Body)
+			objects[key] = string(contents)
+		}
+	}))
+	defer server.Close()
+
+	backend, err := NewS3Backend(state.S3Configuration{Region: "eu-west-1", Endpoint: server.URL, AccessKeyID: "AKID", SecretAccessKey: "secret"})
+	if err != nil {
+		t.Fatalf("Could not create S3 backend: %s", err.Error())
+	}
+	backend.now = func() time.Time { return time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC) }
+	ctx := context.Background()
+
+	keys, err := backend.List(ctx, "bucket", "data/")
+	if err != nil {
+		t.Fatalf("Could not list objects: %s", err.Error())
+	}
+	if strings.Join(keys, ",") != "data/a.txt,data/b.txt" {
+		t.Errorf("Unexpected keys: %v", keys)
+	}
+
+	var buffer bytes.Buffer
+	err = backend.Get(ctx, "bucket", "data/a.txt", &buffer)
+	if err != nil || buffer.String() != "a" {
+		t.Errorf("Unexpected object contents: %s (%v)", buffer.String(), err)
+	}
+	err = backend.Get(ctx, "bucket", "data/missing.txt", &buffer)
+	if err != ErrObjectNotFound {
+		t.Errorf("Expected ErrObjectNotFound for missing object, got: %v", err)
+	}
+
+	err = backend.Put(ctx, "bucket", "data/c.txt", strings.NewReader("c"), 1)
+	if err != nil || objects["data/c.txt"] != "c" {
+		t.Errorf("Unexpected result of upload: %v", err)
+	}
+}
@@ -0,0 +1,334 @@
+// Package staging lets the mounts of flow steps refer to objects in remote object stores (e.g.
+// "s3://bucket/key", "gs://bucket/key", or "az://account/container/blob"). Remote sources are
+// downloaded into a local staging directory before a step runs, the step's container sees the
+// local copies, and any files that the step creates or modifies are uploaded back once it succeeds.
+// Mounts may also refer to read-only files on web or SFTP servers (e.g. "https://host/path" or
+// "sftp://user@host/path"), which are fetched (and checked against any checksum in the fragment of
+// the URI) but never uploaded.
+package staging
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/state"
+)
+
+// ErrObjectNotFound is returned by backends when an object does not exist in the object store
+var ErrObjectNotFound = errors.New("Object not found")
+
+// Backend - an object store that mount sources can be staged from and to
+type Backend interface {
+	// List returns the keys of all the objects in the given bucket whose keys start with prefix
+	List(ctx context.Context, bucket, prefix string) ([]string, error)
+	// Get writes the contents of the given object to w. It returns ErrObjectNotFound if the object
+	// does not exist.
+	Get(ctx context.Context, bucket, key string, w io.Writer) error
+	// Put uploads size bytes from r as the contents of the given object
+	Put(ctx context.Context, bucket, key string, r io.Reader, size int64) error
+}
+
+// Location - the location of an object (or, if Key is empty or ends with "/", a prefix) in an
+// object store
+type Location struct {
+	Scheme string
+	Bucket string
+	Key    string
+}
+
+// IsPrefix returns true if the location refers to a prefix (i.e. a directory) rather than an object
+func (location Location) IsPrefix() bool {
+	return location.Key == "" || strings.HasSuffix(location.Key, "/")
+}
+
+func (location Location) String() string {
+	return fmt.Sprintf("%s://%s/%s", location.Scheme, location.Bucket, location.Key)
+}
+
+// ParseLocation parses a URI of the form "<scheme>://<bucket>/<key>". Azure blob URLs are parsed
+// into the equivalent "az://" locations.
+func ParseLocation(uri string) (Location, error) {
+	if location, ok := azureLocation(uri); ok {
+		return location, nil
+	}
+	scheme, ok := components.RemoteSourceScheme(uri)
+	if !ok {
+		return Location{}, fmt.Errorf("Not an object store URI: %s", uri)
+	}
+	path := strings.TrimPrefix(uri, scheme+"://")
+	separator := strings.Index(path, "/")
+	if separator < 0 {
+		return Location{Scheme: scheme, Bucket: path}, nil
+	}
+	location := Location{Scheme: scheme, Bucket: path[:separator], Key: path[separator+1:]}
+	if location.Bucket == "" {
+		return location, fmt.Errorf("No bucket in object store URI: %s", uri)
+	}
+	return location, nil
+}
+
+// stagedMount - a remote mount source which has been downloaded to a local path, along with the
+// modification times of the files that were downloaded
+type stagedMount struct {
+	location  Location
+	localPath string
+	snapshot  map[string]time.Time
+}
+
+// Schemes is a set (of keys) enumerating the URI schemes that the backends which ship with shnorky
+// understand
+var Schemes = map[string]bool{
+	SchemeS3:    true,
+	SchemeGCS:   true,
+	SchemeAzure: true,
+}
+
+// FetchSchemes is a set (of keys) enumerating the URI schemes of read-only mount sources which are
+// fetched by the fetchers that ship with shnorky
+var FetchSchemes = map[string]bool{
+	SchemeHTTPS: true,
+	SchemeSFTP:  true,
+}
+
+// Supported returns true if the given mount source is a URI that can be staged by the backends
+// (or fetched by the fetchers) which ship with shnorky. Fetched sources must refer to files and may
+// only specify supported checksums.
+func Supported(source string) bool {
+	location, err := ParseLocation(source)
+	if err != nil {
+		return false
+	}
+	if Schemes[location.Scheme] {
+		return true
+	}
+	if !FetchSchemes[location.Scheme] {
+		return false
+	}
+	sourceURL, err := url.Parse(source)
+	if err != nil || sourceURL.Path == "" || strings.HasSuffix(sourceURL.Path, "/") {
+		return false
+	}
+	_, _, err = parseChecksum(sourceURL.Fragment)
+	return err == nil
+}
+
+// Backends returns the backends that ship with shnorky (keyed by URI scheme), configured by the
+// given staging configuration
+func Backends(configuration state.StagingConfiguration) (map[string]Backend, error) {
+	s3Backend, err := NewS3Backend(configuration.S3)
+	if err != nil {
+		return nil, err
+	}
+	gcsBackend, err := NewGCSBackend(configuration.GCS)
+	if err != nil {
+		return nil, err
+	}
+	azureBackend, err := NewAzureBackend(configuration.Azure)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]Backend{
+		SchemeS3:    s3Backend,
+		SchemeGCS:   gcsBackend,
+		SchemeAzure: azureBackend,
+	}, nil
+}
+
+// Stager stages the remote mount sources of the steps in a flow run
+type Stager struct {
+	backends map[string]Backend
+	fetchers map[string]Fetcher
+	lock     sync.Mutex
+	staged   map[string][]stagedMount
+}
+
+// NewStager creates a Stager with the given backends (keyed by URI scheme). Read-only sources are
+// fetched with the fetchers returned by Fetchers.
+func NewStager(backends map[string]Backend) *Stager {
+	return &Stager{backends: backends, fetchers: Fetchers(), staged: map[string][]stagedMount{}}
+}
+
+// Stage downloads the remote sources among the given mounts into stagingDir and returns the mounts
+// with those sources replaced by the paths of the local copies. Sources referring to objects are
+// staged as files, and sources referring to prefixes are staged as directories. Objects which do
+// not exist yet (e.g. outputs) are staged as empty files. Sources with fetcher schemes (e.g.
+// "https://" and "sftp://") are fetched and have their checksums verified, but are never uploaded.
+// The staged mounts are remembered under the given key (replacing anything previously staged under
+// it) so that they can be uploaded by Unstage.
+func (stager *Stager) Stage(ctx context.Context, key string, mounts []components.MountConfiguration, stagingDir string) ([]components.MountConfiguration, error) {
+	stagedMounts := make([]components.MountConfiguration, len(mounts))
+	staged := []stagedMount{}
+	for i, mount := range mounts {
+		stagedMounts[i] = mount
+		if _, ok := components.RemoteSourceScheme(mount.Source); !ok {
+			continue
+		}
+
+		location, err := ParseLocation(mount.Source)
+		if err != nil {
+			return stagedMounts, err
+		}
+		if fetcher, ok := stager.fetchers[location.Scheme]; ok {
+			localPath, err := fetch(ctx, fetcher, mount.Source, filepath.Join(stagingDir, fmt.Sprintf("%d", i)))
+			if err != nil {
+				return stagedMounts, fmt.Errorf("Error fetching %s: %w", mount.Source, err)
+			}
+			stagedMounts[i].Source = localPath
+			continue
+		}
+		backend, err := stager.backend(location.Scheme)
+		if err != nil {
+			return stagedMounts, err
+		}
+
+		localPath := filepath.Join(stagingDir, fmt.Sprintf("%d", i))
+		if !location.IsPrefix() {
+			localPath = filepath.Join(localPath, filepath.Base(location.Key))
+		}
+		err = download(ctx, backend, location, localPath)
+		if err != nil {
+			return stagedMounts, fmt.Errorf("Error staging %s: %w", mount.Source, err)
+		}
+		snapshot, err := snapshotFiles(localPath)
+		if err != nil {
+			return stagedMounts, err
+		}
+
+		stagedMounts[i].Source = localPath
+		staged = append(staged, stagedMount{location: location, localPath: localPath, snapshot: snapshot})
+	}
+
+	stager.lock.Lock()
+	if stager.staged == nil {
+		stager.staged = map[string][]stagedMount{}
+	}
+	stager.staged[key] = staged
+	stager.lock.Unlock()
+	return stagedMounts, nil
+}
+
+// Unstage uploads the files that were created or modified in the local copies of the mounts
+// staged under the given key, and forgets about those mounts
+func (stager *Stager) Unstage(ctx context.Context, key string) error {
+	stager.lock.Lock()
+	staged := stager.staged[key]
+	delete(stager.staged, key)
+	stager.lock.Unlock()
+
+	for _, mount := range staged {
+		backend, err := stager.backend(mount.location.Scheme)
+		if err != nil {
+			return err
+		}
+		err = upload(ctx, backend, mount)
+		if err != nil {
+			return fmt.Errorf("Error uploading %s: %w", mount.location, err)
+		}
+	}
+	return nil
+}
+
+func (stager *Stager) backend(scheme string) (Backend, error) {
+	backend, ok := stager.backends[scheme]
+	if !ok {
+		return nil, fmt.Errorf("No staging backend for scheme: %s", scheme)
+	}
+	return backend, nil
+}
+
+// download copies the object (or every object under the prefix) at the given location to the
+// given local path
+func download(ctx context.Context, backend Backend, location Location, localPath string) error {
+	if !location.IsPrefix() {
+		return downloadObject(ctx, backend, location.Bucket, location.Key, localPath)
+	}
+
+	err := os.MkdirAll(localPath, 0755)
+	if err != nil {
+		return err
+	}
+	keys, err := backend.List(ctx, location.Bucket, location.Key)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		relativePath := strings.TrimPrefix(key, location.Key)
+		if relativePath == "" || strings.HasSuffix(relativePath, "/") {
+			continue
+		}
+		err = downloadObject(ctx, backend, location.Bucket, key, filepath.Join(localPath, filepath.FromSlash(relativePath)))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func downloadObject(ctx context.Context, backend Backend, bucket, key, localPath string) error {
+	err := os.MkdirAll(filepath.Dir(localPath), 0755)
+	if err != nil {
+		return err
+	}
+	localFile, err := os.Create(localPath)
+	if err != nil {
+		return err
+	}
+	defer localFile.Close()
+
+	err = backend.Get(ctx, bucket, key, localFile)
+	if err == ErrObjectNotFound {
+		return localFile.Truncate(0)
+	}
+	return err
+}
+
+// upload uploads the files under the local path of the given staged mount which are not in its
+// snapshot, or which have been modified since the snapshot was taken
+func upload(ctx context.Context, backend Backend, mount stagedMount) error {
+	return filepath.Walk(mount.localPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		if modTime, ok := mount.snapshot[path]; ok && modTime.Equal(info.ModTime()) {
+			return nil
+		}
+
+		key := mount.location.Key
+		if mount.location.IsPrefix() {
+			relativePath, err := filepath.Rel(mount.localPath, path)
+			if err != nil {
+				return err
+			}
+			key = key + filepath.ToSlash(relativePath)
+		}
+
+		localFile, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer localFile.Close()
+		return backend.Put(ctx, mount.location.Bucket, key, localFile, info.Size())
+	})
+}
+
+// snapshotFiles returns the modification times of the files under the given path
+func snapshotFiles(root string) (map[string]time.Time, error) {
+	snapshot := map[string]time.Time{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		snapshot[path] = info.ModTime()
+		return nil
+	})
+	return snapshot, err
+}
@@ -0,0 +1,161 @@
+package staging
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/simiotics/shnorky/components"
+)
+
+// memoryBackend is a Backend which stores objects in memory, keyed by "<bucket>/<key>"
+type memoryBackend struct {
+	objects map[string][]byte
+}
+
+func (backend *memoryBackend) List(ctx context.Context, bucket, prefix string) ([]string, error) {
+	keys := []string{}
+	for path := range backend.objects {
+		if strings.HasPrefix(path, bucket+"/"+prefix) {
+			keys = append(keys, strings.TrimPrefix(path, bucket+"/"))
+		}
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
+
+func (backend *memoryBackend) Get(ctx context.Context, bucket, key string, w io.Writer) error {
+	contents, ok := backend.objects[bucket+"/"+key]
+	if !ok {
+		return ErrObjectNotFound
+	}
+	_, err := w.Write(contents)
+	return err
+}
+
+func (backend *memoryBackend) Put(ctx context.Context, bucket, key string, r io.Reader, size int64) error {
+	var buffer bytes.Buffer
+	_, err := io.Copy(&buffer, r)
+	backend.objects[bucket+"/"+key] = buffer.Bytes()
+	return err
+}
+
+func TestParseLocation(t *testing.T) {
+	type locationTest struct {
+		uri              string
+		expectedLocation Location
+		expectedPrefix   bool
+		returnsError     bool
+	}
+
+	testCases := []locationTest{
+		{uri: "s3://bucket/path/to/key.csv", expectedLocation: Location{Scheme: "s3", Bucket: "bucket", Key: "path/to/key.csv"}},
+		{uri: "s3://bucket/path/", expectedLocation: Location{Scheme: "s3", Bucket: "bucket", Key: "path/"}, expectedPrefix: true},
+		{uri: "s3://bucket", expectedLocation: Location{Scheme: "s3", Bucket: "bucket"}, expectedPrefix: true},
+		{uri: "s3:///key", returnsError: true},
+		{uri: "/tmp/key", returnsError: true},
+	}
+
+	for i, testCase := range testCases {
+		location, err := ParseLocation(testCase.uri)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+			continue
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+			continue
+		}
+		if testCase.returnsError {
+			continue
+		}
+		if location != testCase.expectedLocation || location.IsPrefix() != testCase.expectedPrefix {
+			t.Errorf("[Test %d] Unexpected location: %v", i, location)
+		}
+	}
+}
+
+func TestStageAndUnstage(t *testing.T) {
+	stagingDir, err := ioutil.TempDir("", "shnorky-staging-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(stagingDir)
+
+	backend := &memoryBackend{objects: map[string][]byte{
+		"bucket/inputs/a.txt":     []byte("a"),
+		"bucket/inputs/sub/b.txt": []byte("b"),
+		"bucket/config.json":      []byte("{}"),
+	}}
+	stager := NewStager(map[string]Backend{"s3": backend})
+
+	mounts := []components.MountConfiguration{
+		{Source: "s3://bucket/inputs/", Target: "/shnorky/inputs", Method: "bind"},
+		{Source: "s3://bucket/config.json", Target: "/shnorky/config.json", Method: "bind"},
+		{Source: "s3://bucket/outputs.txt", Target: "/shnorky/outputs.txt", Method: "bind"},
+		{Source: "/tmp/local", Target: "/shnorky/local", Method: "bind"},
+	}
+
+	ctx := context.Background()
+	stagedMounts, err := stager.Stage(ctx, "step", mounts, stagingDir)
+	if err != nil {
+		t.Fatalf("Could not stage mounts: %s", err.Error())
+	}
+	if stagedMounts[3].Source != "/tmp/local" {
+		t.Errorf("Expected local mount source to be unchanged: %s", stagedMounts[3].Source)
+	}
+
+	contents, err := ioutil.ReadFile(filepath.Join(stagedMounts[0].Source, "sub", "b.txt"))
+	if err != nil || string(contents) != "b" {
+		t.Errorf("Unexpected staged prefix contents: %s (%v)", string(contents), err)
+	}
+	contents, err = ioutil.ReadFile(stagedMounts[1].Source)
+	if err != nil || string(contents) != "{}" {
+		t.Errorf("Unexpected staged object contents: %s (%v)", string(contents), err)
+	}
+	contents, err = ioutil.ReadFile(stagedMounts[2].Source)
+	if err != nil || len(contents) != 0 {
+		t.Errorf("Expected missing object to be staged as an empty file: %s (%v)", string(contents), err)
+	}
+
+	// Simulate a step which writes an output and a new file under the prefix
+	later := time.Now().Add(time.Minute)
+	err = ioutil.WriteFile(stagedMounts[2].Source, []byte("outputs"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write output: %s", err.Error())
+	}
+	os.Chtimes(stagedMounts[2].Source, later, later)
+	err = ioutil.WriteFile(filepath.Join(stagedMounts[0].Source, "c.txt"), []byte("c"), 0644)
+	if err != nil {
+		t.Fatalf("Could not write new file: %s", err.Error())
+	}
+
+	// Unchanged objects should not be uploaded again
+	delete(backend.objects, "bucket/config.json")
+
+	err = stager.Unstage(ctx, "step")
+	if err != nil {
+		t.Fatalf("Could not unstage mounts: %s", err.Error())
+	}
+
+	if string(backend.objects["bucket/outputs.txt"]) != "outputs" {
+		t.Errorf("Expected output to be uploaded")
+	}
+	if string(backend.objects["bucket/inputs/c.txt"]) != "c" {
+		t.Errorf("Expected new file under prefix to be uploaded")
+	}
+	if _, ok := backend.objects["bucket/config.json"]; ok {
+		t.Errorf("Expected unchanged object not to be uploaded")
+	}
+
+	_, err = stager.Stage(ctx, "other", []components.MountConfiguration{{Source: "gopher://bucket/key", Method: "bind"}}, stagingDir)
+	if err == nil {
+		t.Errorf("Expected error staging source without a backend")
+	}
+}
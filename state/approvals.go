@@ -0,0 +1,79 @@
+package state
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SQL statements
+var insertApproval = "INSERT INTO approvals (execution_id, flow_run_id, step, message, status, requested_at) VALUES(?, ?, ?, ?, ?, ?);"
+var approvalColumns = "execution_id, flow_run_id, step, IFNULL(message, ''), status, requested_at, decided_at, IFNULL(decided_by, ''), IFNULL(comment, '')"
+var selectApprovalByExecutionID = "SELECT " + approvalColumns + " FROM approvals WHERE execution_id=?;"
+var selectApprovals = "SELECT " + approvalColumns + " FROM approvals WHERE (?='' OR flow_run_id=?) AND (?='' OR status=?) ORDER BY requested_at, step;"
+var decideApproval = "UPDATE approvals SET status=?, decided_at=?, decided_by=?, comment=? WHERE flow_run_id=? AND step=? AND status=?;"
+var expireApproval = "UPDATE approvals SET status=?, decided_at=? WHERE execution_id=? AND status=?;"
+
+// InsertApproval creates a new row in the approvals table with the given approval information
+func (store *SQLiteStore) InsertApproval(approval ApprovalRecord) error {
+	_, err := store.exec(insertApproval, approval.ExecutionID, approval.FlowRunID, approval.Step, approval.Message, approval.Status, approval.RequestedAt.Unix())
+	return err
+}
+
+// scanApproval reads an approval record from a row selected using approvalColumns
+func scanApproval(row rowScanner) (ApprovalRecord, error) {
+	var approval ApprovalRecord
+	var requestedAt int64
+	var decidedAt sql.NullInt64
+	err := row.Scan(&approval.ExecutionID, &approval.FlowRunID, &approval.Step, &approval.Message, &approval.Status, &requestedAt, &decidedAt, &approval.DecidedBy, &approval.Comment)
+	if err != nil {
+		return ApprovalRecord{}, err
+	}
+	approval.RequestedAt = time.Unix(requestedAt, 0)
+	approval.DecidedAt = nullableTime(decidedAt)
+	return approval, nil
+}
+
+// SelectApproval returns the approval for the execution (of a gate step) with the given ID, or
+// ErrNotFound if there is none
+func (store *SQLiteStore) SelectApproval(executionID string) (ApprovalRecord, error) {
+	approval, err := scanApproval(store.db.QueryRow(selectApprovalByExecutionID, executionID))
+	err = checkRowID(err, executionID, approval.ExecutionID)
+	if err != nil {
+		return ApprovalRecord{}, err
+	}
+	return approval, nil
+}
+
+// SelectApprovals returns the approvals for the given flow run (or for all flow runs, if flowRunID
+// is empty) with the given status (or with any status, if status is empty), oldest first
+func (store *SQLiteStore) SelectApprovals(flowRunID, status string) ([]ApprovalRecord, error) {
+	rows, err := store.db.Query(selectApprovals, flowRunID, flowRunID, status, status)
+	if err != nil {
+		return []ApprovalRecord{}, err
+	}
+	defer rows.Close()
+
+	approvals := []ApprovalRecord{}
+	for rows.Next() {
+		approval, err := scanApproval(rows)
+		if err != nil {
+			return approvals, err
+		}
+		approvals = append(approvals, approval)
+	}
+	return approvals, rows.Err()
+}
+
+// DecideApproval stores the status, decision time, decider, and comment of the given approval
+// against the approval for its step of its flow run, as long as that approval still has the given
+// pending status. It returns ErrNotFound if there is no such approval.
+func (store *SQLiteStore) DecideApproval(approval ApprovalRecord, pendingStatus string) error {
+	return store.update(decideApproval, approval.Status, nullableUnix(approval.DecidedAt), approval.DecidedBy, approval.Comment, approval.FlowRunID, approval.Step, pendingStatus)
+}
+
+// ExpireApproval gives the approval for the execution with the given ID the expired status (as of
+// expiredAt) if it still has the given pending status, and leaves it alone otherwise
+func (store *SQLiteStore) ExpireApproval(executionID, pendingStatus, expiredStatus string, expiredAt time.Time) error {
+	_, err := store.exec(expireApproval, expiredStatus, expiredAt.Unix(), executionID, pendingStatus)
+	return err
+}
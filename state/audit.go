@@ -0,0 +1,67 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SQL statements
+var insertAuditEntry = "INSERT INTO audit_log (id, action, actor, arguments, result, error, created_at) VALUES(?, ?, ?, ?, ?, ?, ?);"
+var selectAuditEntries = "SELECT id, action, actor, arguments, result, IFNULL(error, ''), created_at FROM audit_log WHERE (?='' OR actor=?) AND (?='' OR action=?) AND created_at>=? ORDER BY created_at DESC, rowid DESC LIMIT ?;"
+
+// AuditFilter - restricts the audit log entries returned by SelectAuditEntries. Empty members do
+// not restrict the entries.
+type AuditFilter struct {
+	Actor  string
+	Action string
+	Since  time.Time
+	// Limit is the maximum number of entries returned. If it is 0, all matching entries are
+	// returned.
+	Limit int
+}
+
+// InsertAuditEntry creates a new row in the audit_log table with the given entry information
+func (store *SQLiteStore) InsertAuditEntry(entry AuditEntryRecord) error {
+	arguments, err := json.Marshal(entry.Arguments)
+	if err != nil {
+		return err
+	}
+	_, err = store.exec(insertAuditEntry, entry.ID, entry.Action, entry.Actor, string(arguments), entry.Result, entry.Error, entry.CreatedAt.Unix())
+	return err
+}
+
+// SelectAuditEntries returns the audit log entries which match the given filter, most recent first
+func (store *SQLiteStore) SelectAuditEntries(filter AuditFilter) ([]AuditEntryRecord, error) {
+	limit := filter.Limit
+	if limit <= 0 {
+		limit = -1
+	}
+	var since int64
+	if !filter.Since.IsZero() {
+		since = filter.Since.Unix()
+	}
+	rows, err := store.db.Query(selectAuditEntries, filter.Actor, filter.Actor, filter.Action, filter.Action, since, limit)
+	if err != nil {
+		return []AuditEntryRecord{}, err
+	}
+	defer rows.Close()
+
+	entries := []AuditEntryRecord{}
+	for rows.Next() {
+		var entry AuditEntryRecord
+		var arguments string
+		var createdAt int64
+		err = rows.Scan(&entry.ID, &entry.Action, &entry.Actor, &arguments, &entry.Result, &entry.Error, &createdAt)
+		if err != nil {
+			return entries, err
+		}
+		err = json.Unmarshal([]byte(arguments), &entry.Arguments)
+		if err != nil {
+			return entries, fmt.Errorf("Invalid arguments in audit log entry (%s): %w", entry.ID, err)
+		}
+		entry.CreatedAt = time.Unix(createdAt, 0)
+		entries = append(entries, entry)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,241 @@
+package state
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// ConfigFileName - Name of the (optional) JSON file in the state directory which configures the
+// behaviour of shnorky for that state directory
+var ConfigFileName = "config.json"
+
+// DefaultEmailLogLines is the number of log lines from the failing step that are included in
+// failure emails if the SMTP configuration does not specify otherwise
+var DefaultEmailLogLines = 50
+
+// ScratchRetentionDelete specifies that the scratch directory for a flow run should be deleted as
+// soon as the run finishes
+var ScratchRetentionDelete = "delete"
+
+// ScratchRetentionKeepFailed specifies that the scratch directory for a flow run should only be
+// kept if the run fails (for debugging). This is the default retention policy.
+var ScratchRetentionKeepFailed = "keep_failed"
+
+// ScratchRetentionKeep specifies that the scratch directories for flow runs should always be kept
+var ScratchRetentionKeep = "keep"
+
+// ScratchRetentionPolicies is a set (of keys) enumerating the valid scratch retention policies
+var ScratchRetentionPolicies = map[string]bool{
+	ScratchRetentionDelete:     true,
+	ScratchRetentionKeepFailed: true,
+	ScratchRetentionKeep:       true,
+}
+
+// Config - configuration stored alongside the state database in a state directory
+type Config struct {
+	// SMTP configures emails that get sent when flow runs fail. If it is nil, no emails are sent.
+	SMTP *SMTPConfiguration `json:"smtp,omitempty"`
+	// Scratch configures the retention of per-run scratch directories
+	Scratch ScratchConfiguration `json:"scratch"`
+	// Staging configures access to the object stores that mount sources may refer to
+	Staging StagingConfiguration `json:"staging"`
+	// Server configures access to the API served by "shn serve"
+	Server ServerConfiguration `json:"server"`
+	// Runs configures how many flow runs may execute at once
+	Runs RunsConfiguration `json:"runs"`
+	// Environment restricts the environment variables that specifications may read
+	Environment EnvironmentConfiguration `json:"environment"`
+}
+
+// EnvironmentConfiguration - restricts the host environment variables that "env:" values in
+// component and flow specifications may read (and that flow inputs may be taken from), so that
+// specifications cannot silently read secrets like AWS_SECRET_ACCESS_KEY. Patterns use the syntax
+// of path.Match (e.g. "AWS_*"). Values in the state configuration itself are not restricted.
+type EnvironmentConfiguration struct {
+	// Allow lists the patterns of the variables that may be read. If it is empty, any variable
+	// which is not denied may be read.
+	Allow []string `json:"allow,omitempty"`
+	// Deny lists the patterns of the variables that may not be read, even if they are allowed
+	Deny []string `json:"deny,omitempty"`
+}
+
+// Permits returns true if the environment variable with the given name may be read under the
+// policy
+func (policy EnvironmentConfiguration) Permits(name string) bool {
+	for _, pattern := range policy.Deny {
+		if matched, _ := path.Match(pattern, name); matched {
+			return false
+		}
+	}
+	if len(policy.Allow) == 0 {
+		return true
+	}
+	for _, pattern := range policy.Allow {
+		if matched, _ := path.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// RunsConfiguration - limits the number of flow runs which execute at the same time
+type RunsConfiguration struct {
+	// MaxConcurrent is the maximum number of flow runs which may be running (or paused) at once.
+	// Runs started while this many runs are in progress are queued, and start in priority order as
+	// the runs in progress finish. If it is 0, the number of concurrent runs is not limited.
+	MaxConcurrent int `json:"max_concurrent,omitempty"`
+}
+
+// ServerConfiguration - specifies who may access the API served by "shn serve"
+type ServerConfiguration struct {
+	// Tokens binds API tokens to roles, in addition to the tokens created with "shn tokens create"
+	// (which are stored in the state database)
+	Tokens []TokenConfiguration `json:"tokens,omitempty"`
+}
+
+// TokenConfiguration - binds an API token to a role (one of "viewer", "operator", or "admin")
+type TokenConfiguration struct {
+	// Token is the bearer token that API clients present. It supports "env:<VARIABLE_NAME>" values.
+	Token string `json:"token"`
+	Role  string `json:"role"`
+}
+
+// StagingConfiguration - specifies how shnorky accesses the object stores from which mount sources
+// are staged
+type StagingConfiguration struct {
+	S3    S3Configuration    `json:"s3"`
+	GCS   GCSConfiguration   `json:"gcs"`
+	Azure AzureConfiguration `json:"azure"`
+}
+
+// S3Configuration - specifies how shnorky accesses S3 (or an S3-compatible object store). All
+// members support "env:<VARIABLE_NAME>" values. Members which are not specified are read from the
+// standard AWS environment variables (e.g. AWS_ACCESS_KEY_ID).
+type S3Configuration struct {
+	// Region is the region of the buckets that are accessed
+	Region string `json:"region,omitempty"`
+	// Endpoint overrides the URL of the S3 API (e.g. for MinIO). Buckets are accessed using
+	// path-style URLs under it.
+	Endpoint        string `json:"endpoint,omitempty"`
+	AccessKeyID     string `json:"access_key_id,omitempty"`
+	SecretAccessKey string `json:"secret_access_key,omitempty"`
+	SessionToken    string `json:"session_token,omitempty"`
+}
+
+// GCSConfiguration - specifies how shnorky accesses Google Cloud Storage. Both members support
+// "env:<VARIABLE_NAME>" values.
+type GCSConfiguration struct {
+	// CredentialsFile is the path of a service account (or authorized user) credentials file. If it
+	// is empty, application default credentials are used.
+	CredentialsFile string `json:"credentials_file,omitempty"`
+	// Endpoint overrides the URL of the Google Cloud Storage API
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// AzureConfiguration - specifies how shnorky accesses Azure Blob Storage. All members support
+// "env:<VARIABLE_NAME>" values.
+type AzureConfiguration struct {
+	// SASToken is a shared access signature which authorizes requests. If it is empty, the
+	// AZURE_STORAGE_SAS_TOKEN environment variable is used.
+	SASToken string `json:"sas_token,omitempty"`
+	// AccountKey is the (base64-encoded) shared key of the storage account, used if there is no SAS
+	// token. If it is empty, the AZURE_STORAGE_KEY environment variable is used.
+	AccountKey string `json:"account_key,omitempty"`
+	// Endpoint overrides the URL of the Blob Storage API (e.g. for Azurite). Containers are accessed
+	// under it.
+	Endpoint string `json:"endpoint,omitempty"`
+}
+
+// ScratchConfiguration - specifies how long per-run scratch directories are kept for
+type ScratchConfiguration struct {
+	// Retention is one of the keys of ScratchRetentionPolicies. If it is empty,
+	// ScratchRetentionKeepFailed is used.
+	Retention string `json:"retention,omitempty"`
+	// MaxAge is the maximum age (e.g. "72h") of kept scratch directories. Older scratch directories
+	// are removed whenever a flow run starts, unless the runs they belong to have not finished. If it
+	// is empty, kept scratch directories are never removed automatically.
+	MaxAge string `json:"max_age,omitempty"`
+}
+
+// SMTPConfiguration - specifies how (and to whom) failure notification emails should be sent
+type SMTPConfiguration struct {
+	// Host and Port specify the SMTP server through which emails are sent
+	Host string `json:"host"`
+	Port int    `json:"port"`
+	// Username and Password are used to authenticate against the SMTP server (using PLAIN auth). If
+	// Username is empty, no authentication is attempted. Both members support
+	// "env:<VARIABLE_NAME>" values.
+	Username string `json:"username,omitempty"`
+	Password string `json:"password,omitempty"`
+	// From is the address that emails are sent from
+	From string `json:"from"`
+	// To lists the addresses that emails are sent to
+	To []string `json:"to"`
+	// LogLines is the number of lines from the end of the failing step's logs to include in the
+	// email. If it is 0, DefaultEmailLogLines is used.
+	LogLines int `json:"log_lines,omitempty"`
+}
+
+// ReadConfig reads the configuration file in the given state directory, applying defaults where
+// values are not specified. If there is no configuration file, it returns the default
+// configuration.
+func ReadConfig(stateDir string) (Config, error) {
+	configPath := path.Join(stateDir, ConfigFileName)
+	configFile, err := os.Open(configPath)
+	if os.IsNotExist(err) {
+		return Config{Scratch: ScratchConfiguration{Retention: ScratchRetentionKeepFailed}}, nil
+	}
+	if err != nil {
+		return Config{}, err
+	}
+	defer configFile.Close()
+
+	dec := json.NewDecoder(configFile)
+	dec.DisallowUnknownFields()
+
+	var config Config
+	err = dec.Decode(&config)
+	if err != nil {
+		return Config{}, fmt.Errorf("Error decoding state configuration (%s): %w", configPath, err)
+	}
+
+	if config.Scratch.Retention == "" {
+		config.Scratch.Retention = ScratchRetentionKeepFailed
+	}
+	if !ScratchRetentionPolicies[config.Scratch.Retention] {
+		return config, fmt.Errorf("Invalid scratch retention policy in %s: %s", configPath, config.Scratch.Retention)
+	}
+	if config.Scratch.MaxAge != "" {
+		_, err = time.ParseDuration(config.Scratch.MaxAge)
+		if err != nil {
+			return config, fmt.Errorf("Invalid scratch max_age in %s: %w", configPath, err)
+		}
+	}
+
+	if config.Runs.MaxConcurrent < 0 {
+		return config, fmt.Errorf("Invalid runs max_concurrent in %s: %d", configPath, config.Runs.MaxConcurrent)
+	}
+
+	for _, pattern := range append(append([]string{}, config.Environment.Allow...), config.Environment.Deny...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return config, fmt.Errorf("Invalid environment pattern in %s: %s", configPath, pattern)
+		}
+	}
+
+	if config.SMTP != nil {
+		if config.SMTP.Host == "" || config.SMTP.Port == 0 {
+			return config, fmt.Errorf("Invalid SMTP configuration in %s: host and port must be specified", configPath)
+		}
+		if config.SMTP.From == "" || len(config.SMTP.To) == 0 {
+			return config, fmt.Errorf("Invalid SMTP configuration in %s: from and to addresses must be specified", configPath)
+		}
+		if config.SMTP.LogLines == 0 {
+			config.SMTP.LogLines = DefaultEmailLogLines
+		}
+	}
+
+	return config, nil
+}
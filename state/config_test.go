@@ -0,0 +1,149 @@
+package state
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestReadConfig(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-config-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+
+	config, err := ReadConfig(stateDir)
+	if err != nil {
+		t.Fatalf("Unexpected error reading missing configuration file: %s", err.Error())
+	}
+	if config.SMTP != nil {
+		t.Errorf("Expected no SMTP configuration when configuration file is missing")
+	}
+	if config.Scratch.Retention != ScratchRetentionKeepFailed {
+		t.Errorf("Unexpected default scratch retention policy: %s", config.Scratch.Retention)
+	}
+
+	type readConfigTest struct {
+		contents         string
+		returnsError     bool
+		expectedLogLines int
+	}
+
+	testCases := []readConfigTest{
+		{
+			contents:         `{"smtp": {"host": "smtp.example.com", "port": 587, "from": "shn@example.com", "to": ["team@example.com"]}}`,
+			returnsError:     false,
+			expectedLogLines: DefaultEmailLogLines,
+		},
+		{
+			contents:         `{"smtp": {"host": "smtp.example.com", "port": 587, "from": "shn@example.com", "to": ["team@example.com"], "log_lines": 10}}`,
+			returnsError:     false,
+			expectedLogLines: 10,
+		},
+		{
+			contents:     `{"smtp": {"host": "smtp.example.com", "from": "shn@example.com", "to": ["team@example.com"]}}`,
+			returnsError: true,
+		},
+		{
+			contents:     `{"smtp": {"host": "smtp.example.com", "port": 587, "from": "shn@example.com"}}`,
+			returnsError: true,
+		},
+		{
+			contents:     `{"unknown": true}`,
+			returnsError: true,
+		},
+		{
+			contents:     `{"scratch": {"retention": "forever"}}`,
+			returnsError: true,
+		},
+		{
+			contents:     `{"scratch": {"retention": "keep", "max_age": "a while"}}`,
+			returnsError: true,
+		},
+		{
+			contents:     `{"runs": {"max_concurrent": -1}}`,
+			returnsError: true,
+		},
+		{
+			contents:     `{"environment": {"deny": ["AWS_[*"]}}`,
+			returnsError: true,
+		},
+	}
+
+	for i, testCase := range testCases {
+		err = ioutil.WriteFile(path.Join(stateDir, ConfigFileName), []byte(testCase.contents), 0644)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not write configuration file: %s", i, err.Error())
+		}
+
+		config, err := ReadConfig(stateDir)
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+			continue
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+			continue
+		}
+		if testCase.returnsError {
+			continue
+		}
+
+		if config.SMTP == nil {
+			t.Errorf("[Test %d] Expected SMTP configuration", i)
+			continue
+		}
+		if config.SMTP.LogLines != testCase.expectedLogLines {
+			t.Errorf("[Test %d] Unexpected number of log lines: expected=%d, actual=%d", i, testCase.expectedLogLines, config.SMTP.LogLines)
+		}
+	}
+}
+
+func TestEnvironmentPermits(t *testing.T) {
+	type permitsTest struct {
+		policy   EnvironmentConfiguration
+		name     string
+		expected bool
+	}
+
+	testCases := []permitsTest{
+		{
+			policy:   EnvironmentConfiguration{},
+			name:     "AWS_SECRET_ACCESS_KEY",
+			expected: true,
+		},
+		{
+			policy:   EnvironmentConfiguration{Deny: []string{"AWS_*"}},
+			name:     "AWS_SECRET_ACCESS_KEY",
+			expected: false,
+		},
+		{
+			policy:   EnvironmentConfiguration{Deny: []string{"AWS_*"}},
+			name:     "HOME",
+			expected: true,
+		},
+		{
+			policy:   EnvironmentConfiguration{Allow: []string{"SHN_*", "HOME"}},
+			name:     "HOME",
+			expected: true,
+		},
+		{
+			policy:   EnvironmentConfiguration{Allow: []string{"SHN_*", "HOME"}},
+			name:     "PATH",
+			expected: false,
+		},
+		{
+			policy:   EnvironmentConfiguration{Allow: []string{"SHN_*"}, Deny: []string{"SHN_TOKEN"}},
+			name:     "SHN_TOKEN",
+			expected: false,
+		},
+	}
+
+	for i, testCase := range testCases {
+		permitted := testCase.policy.Permits(testCase.name)
+		if permitted != testCase.expected {
+			t.Errorf("[Test %d] Unexpected result for %s: expected=%t, actual=%t", i, testCase.name, testCase.expected, permitted)
+		}
+	}
+}
@@ -0,0 +1,40 @@
+package state
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+)
+
+// EphemeralDBDataSource is the data source name of the in-memory state databases opened by
+// InitEphemeral
+var EphemeralDBDataSource = ":memory:"
+
+// InitEphemeral initializes a state directory under a new temporary directory, along with an
+// in-memory state database, for processes which should not leave any state behind (e.g. to try out
+// a flow). It returns the path of the state directory and the open state database. The database is
+// lost once it is closed, and the caller is responsible for removing the state directory.
+func InitEphemeral() (string, *sql.DB, error) {
+	stateDir, err := ioutil.TempDir("", "shnorky-ephemeral-")
+	if err != nil {
+		return "", nil, err
+	}
+
+	db, err := sql.Open("sqlite3", EphemeralDBDataSource)
+	if err != nil {
+		os.RemoveAll(stateDir)
+		return "", nil, err
+	}
+	// Every connection to an in-memory database gets a database of its own, so all queries must go
+	// through the same connection
+	db.SetMaxOpenConns(1)
+
+	_, err = db.Exec(createTables + createIndices)
+	if err != nil {
+		db.Close()
+		os.RemoveAll(stateDir)
+		return "", nil, err
+	}
+
+	return stateDir, db, nil
+}
@@ -0,0 +1,43 @@
+package state
+
+import (
+	"os"
+	"testing"
+	"time"
+)
+
+func TestInitEphemeral(t *testing.T) {
+	stateDir, db, err := InitEphemeral()
+	if err != nil {
+		t.Fatalf("Could not initialize ephemeral state: %s", err.Error())
+	}
+	defer os.RemoveAll(stateDir)
+	defer db.Close()
+
+	info, err := os.Stat(stateDir)
+	if err != nil || !info.IsDir() {
+		t.Fatalf("Ephemeral state directory (%s) is not a directory (error: %v)", stateDir, err)
+	}
+
+	differences, err := CheckSchema(db)
+	if err != nil {
+		t.Fatalf("Could not check schema of ephemeral state database: %s", err.Error())
+	}
+	if len(differences) > 0 {
+		t.Errorf("Unexpected differences from expected schema: %v", differences)
+	}
+
+	// Rows must be visible to later queries, whichever connection they go through
+	_, err = db.Exec("INSERT INTO components (id, component_type, component_path, specification_path, created_at) VALUES('ephemeral', 'task', '/tmp', '/tmp/component.json', ?);", time.Now().Unix())
+	if err != nil {
+		t.Fatalf("Could not insert component: %s", err.Error())
+	}
+	var count int
+	err = db.QueryRow("SELECT COUNT(*) FROM components;").Scan(&count)
+	if err != nil {
+		t.Fatalf("Could not count components: %s", err.Error())
+	}
+	if count != 1 {
+		t.Errorf("Unexpected number of components: expected=%d, actual=%d", 1, count)
+	}
+}
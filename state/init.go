@@ -13,6 +13,34 @@ import (
 // DBFileName - Name of SQLite database representing state in the state directory
 var DBFileName = "state.sqlite"
 
+// ArtifactsDirName - Name of the directory (in the state directory) under which execution artifacts
+// are stored
+var ArtifactsDirName = "artifacts"
+
+// ScratchDirName - Name of the directory (in the state directory) under which per-run scratch
+// directories are created
+var ScratchDirName = "scratch"
+
+// BuiltinDirName - Name of the directory (in the state directory) into which the implementations
+// of built-in components are written when they are first used
+var BuiltinDirName = "builtin"
+
+// BuildLogsDirName - Name of the directory (in the state directory) under which the output of each
+// component build is stored
+var BuildLogsDirName = "build-logs"
+
+// ImportsDirName - Name of the directory (in the state directory) into which imported bundles are
+// extracted by default
+var ImportsDirName = "imports"
+
+// EmbeddedDirName - Name of the directory (in the state directory) into which the specifications of
+// components embedded in flow specifications are written when they are registered
+var EmbeddedDirName = "embedded"
+
+// GitDirName - Name of the directory (in the state directory) under which the git repositories that
+// components are registered from are cloned and checked out
+var GitDirName = "git"
+
 // ErrStateDirectoryAlreadyExists - Error returned by Init if a filesystem object already exists at
 // the desired state directory path
 var ErrStateDirectoryAlreadyExists = errors.New("The given state directory already exists")
@@ -42,7 +70,7 @@ func Init(stateDir string) error {
 	}
 	defer db.Close()
 
-	_, err = db.Exec(createTables)
+	_, err = db.Exec(createTables + createIndices)
 	if err != nil {
 		return err
 	}
@@ -56,10 +56,21 @@ func TestInit(t *testing.T) {
 	}
 
 	expectedTables := map[string][]string{
-		"components": {"id", "component_type", "component_path", "specification_path", "created_at"},
-		"flows":      {"id", "specification_path", "created_at"},
-		"builds":     {"id", "component_id", "created_at"},
-		"executions": {"id", "build_id", "component_id", "created_at", "flow_id"},
+		"components":               {"id", "component_type", "component_path", "specification_path", "created_at", "created_by", "specification_checksum", "specification_snapshot"},
+		"flows":                    {"id", "specification_path", "created_at", "created_by", "specification_checksum", "specification_snapshot"},
+		"flow_components":          {"flow_id", "step", "component_id"},
+		"builds":                   {"id", "component_id", "created_at", "created_by", "source_hash", "target"},
+		"executions":               {"id", "build_id", "component_id", "created_at", "flow_id", "flow_run_id", "step", "exit_code", "oom_killed", "error", "finished_at", "peak_memory_bytes", "cpu_seconds", "io_read_bytes", "io_write_bytes", "created_by", "attempt", "previous_attempt_id"},
+		"flow_runs":                {"id", "flow_id", "status", "created_at", "finished_at", "priority", "heartbeat_at"},
+		"artifacts":                {"id", "execution_id", "name", "artifact_path", "created_at"},
+		"api_tokens":               {"id", "token_hash", "role", "description", "created_at", "created_by", "revoked_at"},
+		"audit_log":                {"id", "action", "actor", "arguments", "result", "error", "created_at"},
+		"approvals":                {"execution_id", "flow_run_id", "step", "message", "status", "requested_at", "decided_at", "decided_by", "comment"},
+		"run_resources":            {"flow_run_id", "kind", "name"},
+		"labels":                   {"resource_type", "resource_id", "key", "value"},
+		"component_sources":        {"component_id", "url", "ref", "path", "commit_sha", "fetched_at"},
+		"standing_services":        {"flow_id", "step", "execution_id", "network", "started_at"},
+		"execution_configurations": {"execution_id", "image_digest", "env", "mounts"},
 	}
 	for table, expectedColumns := range expectedTables {
 		selection := fmt.Sprintf("SELECT * FROM %s;", table)
@@ -0,0 +1,103 @@
+package state
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Types of resources which can be labelled
+var (
+	LabelledComponent = "component"
+	LabelledFlow      = "flow"
+)
+
+// SQL statements
+var insertLabel = "INSERT INTO labels (resource_type, resource_id, key, value) VALUES(?, ?, ?, ?);"
+var selectLabels = "SELECT key, value FROM labels WHERE resource_type=? AND resource_id=? ORDER BY key;"
+var deleteLabels = "DELETE FROM labels WHERE resource_type=? AND resource_id=?;"
+
+// SetLabels replaces the labels of the resource of the given type with the given ID, in a single
+// transaction
+func (store *SQLiteStore) SetLabels(resourceType, resourceID string, labels map[string]string) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(deleteLabels, resourceType, resourceID)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for key, value := range labels {
+		_, err = tx.Exec(insertLabel, resourceType, resourceID, key, value)
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("Error recording label (%s) of %s (%s): %w", key, resourceType, resourceID, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// SelectLabels returns the labels of the resource of the given type with the given ID
+func (store *SQLiteStore) SelectLabels(resourceType, resourceID string) (map[string]string, error) {
+	rows, err := store.db.Query(selectLabels, resourceType, resourceID)
+	if err != nil {
+		return map[string]string{}, err
+	}
+	defer rows.Close()
+
+	labels := map[string]string{}
+	for rows.Next() {
+		var key, value string
+		err = rows.Scan(&key, &value)
+		if err != nil {
+			return labels, err
+		}
+		labels[key] = value
+	}
+	return labels, rows.Err()
+}
+
+// DeleteLabels removes all the labels of the resource of the given type with the given ID
+func (store *SQLiteStore) DeleteLabels(resourceType, resourceID string) error {
+	_, err := store.exec(deleteLabels, resourceType, resourceID)
+	return err
+}
+
+// labelsColumn returns an expression which selects the labels of the resource of the given type
+// whose ID is in the given column, as newline-separated "key=value" pairs (see parseLabelsColumn)
+func labelsColumn(resourceType, idColumn string) string {
+	return fmt.Sprintf("(SELECT IFNULL(group_concat(key || '=' || value, char(10)), '') FROM labels WHERE resource_type='%s' AND resource_id=%s)", resourceType, idColumn)
+}
+
+// parseLabelsColumn parses the labels selected by an expression returned by labelsColumn
+func parseLabelsColumn(column string) map[string]string {
+	labels := map[string]string{}
+	for _, pair := range strings.Split(column, "\n") {
+		keyValue := strings.SplitN(pair, "=", 2)
+		if len(keyValue) == 2 {
+			labels[keyValue[0]] = keyValue[1]
+		}
+	}
+	return labels
+}
+
+// labelsCondition returns a condition which holds for the resources of the given type (whose IDs
+// are in the given column) that have all the labels of a selector. It takes the arguments returned
+// by labelSelectorArgs.
+func labelsCondition(resourceType, idColumn string) string {
+	return fmt.Sprintf("(?=0 OR (SELECT COUNT(*) FROM labels WHERE resource_type='%s' AND resource_id=%s AND instr(?, char(10) || key || '=' || value || char(10))>0)=?)", resourceType, idColumn)
+}
+
+// labelSelectorArgs returns the arguments for a condition returned by labelsCondition which
+// selects the resources with all the labels in the given selector. Label keys cannot contain "="
+// and label values cannot contain newlines, so the newline-delimited "key=value" pairs are
+// unambiguous.
+func labelSelectorArgs(selector map[string]string) []interface{} {
+	var pairs strings.Builder
+	pairs.WriteString("\n")
+	for key, value := range selector {
+		pairs.WriteString(key + "=" + value + "\n")
+	}
+	return []interface{}{len(selector), pairs.String(), len(selector)}
+}
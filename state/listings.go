@@ -0,0 +1,198 @@
+package state
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrInvalidPage signifies that a caller attempted to list records with a negative limit or offset
+var ErrInvalidPage = errors.New("Limit and offset must be non-negative")
+
+// Page - selects a window of the records which a list method (e.g. ListComponents) would otherwise
+// list in full. Records are listed in the order in which they were created, skipping the first
+// Offset of them. A Limit of 0 means that all the remaining records are listed.
+type Page struct {
+	Limit  int
+	Offset int
+}
+
+// queryArgs returns the LIMIT and OFFSET arguments for a list statement which selects the page
+func (page Page) queryArgs() ([]interface{}, error) {
+	if page.Limit < 0 || page.Offset < 0 {
+		return []interface{}{}, ErrInvalidPage
+	}
+	// SQLite treats negative limits as no limit
+	limit := -1
+	if page.Limit > 0 {
+		limit = page.Limit
+	}
+	return []interface{}{limit, page.Offset}, nil
+}
+
+// ComponentFilter - restricts the components listed by ListComponents. Empty members do not
+// restrict the components.
+type ComponentFilter struct {
+	CreatedBy     string
+	ComponentType string
+	// CreatedAfter restricts the listing to components which were created strictly after it
+	CreatedAfter time.Time
+	IDPrefix     string
+	// IDPattern restricts the listing to components whose IDs match it as a glob pattern
+	IDPattern string
+	// Labels restricts the listing to components which have all of these labels
+	Labels map[string]string
+}
+
+// SQL statements
+var listComponents = "SELECT " + componentColumns + ", " + labelsColumn(LabelledComponent, "components.id") + " FROM components WHERE (?='' OR created_by=?) AND (?='' OR component_type=?) AND (?=0 OR created_at>?) AND instr(id, ?)=1 AND (?='' OR id GLOB ?) AND " + labelsCondition(LabelledComponent, "components.id") + " ORDER BY created_at, id LIMIT ? OFFSET ?;"
+var listBuilds = "SELECT " + buildColumns + " FROM builds WHERE (?='' OR component_id GLOB ?) AND (?='' OR created_by=?) ORDER BY created_at, id LIMIT ? OFFSET ?;"
+var listExecutions = "SELECT " + executionColumns + " FROM executions WHERE (?='' OR component_id=?) AND (?='' OR flow_run_id=?) ORDER BY created_at, id LIMIT ? OFFSET ?;"
+var selectUnfinishedExecutions = "SELECT " + executionColumns + " FROM executions WHERE finished_at IS NULL ORDER BY created_at;"
+var listArtifacts = "SELECT id, execution_id, name, artifact_path, created_at FROM artifacts WHERE (?='' OR execution_id=?);"
+var selectFlows = "SELECT " + flowColumns + " FROM flows WHERE (?='' OR created_by=?) ORDER BY id;"
+
+// ListComponents calls each, in turn, with every component (and its labels) in the given page of
+// the components which match the given filter, in the order in which they were created. It stops at
+// the first error returned by each, and returns it.
+func (store *SQLiteStore) ListComponents(ctx context.Context, filter ComponentFilter, page Page, each func(component ComponentRecord, labels map[string]string) error) error {
+	var createdAfter int64
+	if !filter.CreatedAfter.IsZero() {
+		createdAfter = filter.CreatedAfter.Unix()
+	}
+	pageArgs, err := page.queryArgs()
+	if err != nil {
+		return err
+	}
+	args := []interface{}{filter.CreatedBy, filter.CreatedBy, filter.ComponentType, filter.ComponentType, createdAfter, createdAfter, filter.IDPrefix, filter.IDPattern, filter.IDPattern}
+	args = append(args, labelSelectorArgs(filter.Labels)...)
+	rows, err := store.db.QueryContext(ctx, listComponents, append(args, pageArgs...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var component ComponentRecord
+		var createdAt int64
+		var labels string
+		err = rows.Scan(&component.ID, &component.ComponentType, &component.ComponentPath, &component.SpecificationPath, &createdAt, &component.CreatedBy, &component.SpecificationChecksum, &component.SpecificationSnapshot, &labels)
+		if err != nil {
+			return err
+		}
+		component.CreatedAt = time.Unix(createdAt, 0)
+		err = each(component, parseLabelsColumn(labels))
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ListBuilds calls each, in turn, with every build in the given page of the builds of the
+// components whose IDs match the given glob pattern (or of all components, if it is empty) which
+// were created by the given user (or by anyone, if createdBy is empty), in the order in which they
+// were created. It stops at the first error returned by each, and returns it.
+func (store *SQLiteStore) ListBuilds(ctx context.Context, componentPattern, createdBy string, page Page, each func(build BuildRecord) error) error {
+	pageArgs, err := page.queryArgs()
+	if err != nil {
+		return err
+	}
+	rows, err := store.db.QueryContext(ctx, listBuilds, append([]interface{}{componentPattern, componentPattern, createdBy, createdBy}, pageArgs...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		build, err := scanBuild(rows)
+		if err != nil {
+			return err
+		}
+		err = each(build)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// ListExecutions calls each, in turn, with every execution in the given page of the executions of
+// the given component (or of all components, if componentID is empty) in the given flow run (or in
+// any flow run, or none, if flowRunID is empty), in the order in which they were created. It stops
+// at the first error returned by each, and returns it.
+func (store *SQLiteStore) ListExecutions(ctx context.Context, componentID, flowRunID string, page Page, each func(execution ExecutionRecord) error) error {
+	pageArgs, err := page.queryArgs()
+	if err != nil {
+		return err
+	}
+	rows, err := store.db.QueryContext(ctx, listExecutions, append([]interface{}{componentID, componentID, flowRunID, flowRunID}, pageArgs...)...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		execution, err := scanExecution(rows)
+		if err != nil {
+			return err
+		}
+		err = each(execution)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// SelectUnfinishedExecutions returns all the executions which have not finished, in the order in
+// which they were created
+func (store *SQLiteStore) SelectUnfinishedExecutions() ([]ExecutionRecord, error) {
+	return store.selectExecutions(selectUnfinishedExecutions)
+}
+
+// ListArtifacts calls each, in turn, with every artifact produced by the given execution (or by
+// any execution, if executionID is empty). It stops at the first error returned by each, and
+// returns it.
+func (store *SQLiteStore) ListArtifacts(ctx context.Context, executionID string, each func(artifact ArtifactRecord) error) error {
+	rows, err := store.db.QueryContext(ctx, listArtifacts, executionID, executionID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var artifact ArtifactRecord
+		var createdAt int64
+		err = rows.Scan(&artifact.ID, &artifact.ExecutionID, &artifact.Name, &artifact.ArtifactPath, &createdAt)
+		if err != nil {
+			return err
+		}
+		artifact.CreatedAt = time.Unix(createdAt, 0)
+		err = each(artifact)
+		if err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+// SelectFlows returns the flows registered by the given user (or by anyone, if createdBy is
+// empty), in lexicographic order of their IDs
+func (store *SQLiteStore) SelectFlows(createdBy string) ([]FlowRecord, error) {
+	rows, err := store.db.Query(selectFlows, createdBy, createdBy)
+	if err != nil {
+		return []FlowRecord{}, err
+	}
+	defer rows.Close()
+
+	flows := []FlowRecord{}
+	for rows.Next() {
+		flow, err := scanFlow(rows)
+		if err != nil {
+			return flows, err
+		}
+		flows = append(flows, flow)
+	}
+	return flows, rows.Err()
+}
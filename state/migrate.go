@@ -0,0 +1,269 @@
+package state
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// SQL statements
+var selectTableDefinitions = "SELECT name, sql FROM sqlite_master WHERE type='table' ORDER BY name;"
+var selectColumnDefinitions = "SELECT name, type, \"notnull\", dflt_value FROM pragma_table_info(?) ORDER BY cid;"
+
+// normalizeCreatedAt converts created_at values which were not stored as Unix timestamps - numeric
+// strings and reals are cast to integers, and other strings are parsed as SQLite time strings (e.g.
+// "2020-01-02 03:04:05"). Values which cannot be parsed become NULL and so violate the NOT NULL
+// constraint on the column.
+var normalizeCreatedAt = `UPDATE %s SET created_at = CASE
+	WHEN typeof(created_at) = 'real' OR (created_at != '' AND created_at NOT GLOB '*[^0-9]*') THEN CAST(created_at AS INTEGER)
+	ELSE CAST(strftime('%%s', created_at) AS INTEGER)
+END
+WHERE typeof(created_at) IN ('text', 'real');`
+
+// Migrate brings the schema of the given state database up to date with the schema that Init
+// creates, so that state directories created by older versions of shnorky can be used without being
+// initialized again. It creates missing tables and indices, adds missing columns, rebuilds tables
+// whose columns were declared with outdated types (e.g. created_at as TEXT rather than INTEGER), and
+// normalizes created_at values which were not stored as Unix timestamps. All changes are made in a
+// single transaction - if any of them fails, the database is left as it was. Migrate returns a
+// description of each change that it made; an empty result means that the schema was already up
+// to date.
+func Migrate(db *sql.DB) ([]string, error) {
+	expectedDB, err := expectedDatabase()
+	if err != nil {
+		return []string{}, err
+	}
+	defer expectedDB.Close()
+
+	expectedTables := map[string]string{}
+	tableNames := []string{}
+	rows, err := expectedDB.Query(selectTableDefinitions)
+	if err != nil {
+		return []string{}, err
+	}
+	for rows.Next() {
+		var table, definition string
+		err = rows.Scan(&table, &definition)
+		if err != nil {
+			rows.Close()
+			return []string{}, err
+		}
+		expectedTables[table] = definition
+		tableNames = append(tableNames, table)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return []string{}, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return []string{}, err
+	}
+
+	changes, err := migrate(tx, expectedDB, tableNames, expectedTables)
+	if err != nil {
+		tx.Rollback()
+		return []string{}, err
+	}
+	return changes, tx.Commit()
+}
+
+// migrate makes the changes described by Migrate in the given transaction
+func migrate(tx *sql.Tx, expectedDB *sql.DB, tableNames []string, expectedTables map[string]string) ([]string, error) {
+	changes := []string{}
+
+	actualTables, err := names(tx, selectTables)
+	if err != nil {
+		return changes, err
+	}
+	present := map[string]bool{}
+	for _, table := range actualTables {
+		present[table] = true
+	}
+
+	for _, table := range tableNames {
+		if !present[table] {
+			_, err = tx.Exec(expectedTables[table])
+			if err != nil {
+				return changes, fmt.Errorf("Could not create table (%s): %w", table, err)
+			}
+			changes = append(changes, fmt.Sprintf("Created table: %s", table))
+			continue
+		}
+
+		columnChanges, err := migrateTable(tx, expectedDB, table, expectedTables[table])
+		changes = append(changes, columnChanges...)
+		if err != nil {
+			return changes, err
+		}
+	}
+
+	for _, table := range tableNames {
+		columns, err := names(tx, selectColumns, table)
+		if err != nil {
+			return changes, err
+		}
+		hasCreatedAt := false
+		for _, column := range columns {
+			if column == "created_at" {
+				hasCreatedAt = true
+			}
+		}
+		if !hasCreatedAt {
+			continue
+		}
+
+		result, err := tx.Exec(fmt.Sprintf(normalizeCreatedAt, table))
+		if err != nil {
+			return changes, fmt.Errorf("Could not normalize created_at values in table (%s): %w", table, err)
+		}
+		normalized, err := result.RowsAffected()
+		if err != nil {
+			return changes, err
+		}
+		if normalized > 0 {
+			changes = append(changes, fmt.Sprintf("Normalized created_at values in table (%s): %d", table, normalized))
+		}
+	}
+
+	previousIndices, err := names(tx, selectIndices)
+	if err != nil {
+		return changes, err
+	}
+	_, err = tx.Exec(createIndices)
+	if err != nil {
+		return changes, fmt.Errorf("Could not create indices: %w", err)
+	}
+	indices, err := names(tx, selectIndices)
+	if err != nil {
+		return changes, err
+	}
+	previouslyPresent := map[string]bool{}
+	for _, index := range previousIndices {
+		previouslyPresent[index] = true
+	}
+	for _, index := range indices {
+		if !previouslyPresent[index] {
+			changes = append(changes, fmt.Sprintf("Created index: %s", index))
+		}
+	}
+
+	return changes, nil
+}
+
+// columnDefinition - a column of a table, as described by pragma_table_info
+type columnDefinition struct {
+	name         string
+	columnType   string
+	notNull      bool
+	defaultValue sql.NullString
+}
+
+// columnDefinitions returns the definitions of the columns of the given table
+func columnDefinitions(db queryer, table string) ([]columnDefinition, error) {
+	definitions := []columnDefinition{}
+	rows, err := db.Query(selectColumnDefinitions, table)
+	if err != nil {
+		return definitions, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var definition columnDefinition
+		err = rows.Scan(&definition.name, &definition.columnType, &definition.notNull, &definition.defaultValue)
+		if err != nil {
+			return definitions, err
+		}
+		definitions = append(definitions, definition)
+	}
+	return definitions, rows.Err()
+}
+
+// migrateTable brings the columns of the given existing table up to date in the given transaction.
+// Missing columns are added to the table. SQLite cannot change the types of existing columns, so if
+// any column (e.g. created_at) was declared with a different type than the expected one, the table
+// is instead rebuilt from its expected definition and its rows are copied over.
+func migrateTable(tx *sql.Tx, expectedDB *sql.DB, table, definition string) ([]string, error) {
+	changes := []string{}
+
+	expectedColumns, err := columnDefinitions(expectedDB, table)
+	if err != nil {
+		return changes, err
+	}
+	actualColumns, err := columnDefinitions(tx, table)
+	if err != nil {
+		return changes, err
+	}
+	actualTypes := map[string]string{}
+	for _, column := range actualColumns {
+		actualTypes[column.name] = column.columnType
+	}
+
+	retyped := []string{}
+	missing := []columnDefinition{}
+	common := []string{}
+	for _, column := range expectedColumns {
+		actualType, ok := actualTypes[column.name]
+		if !ok {
+			missing = append(missing, column)
+			continue
+		}
+		common = append(common, column.name)
+		if !strings.EqualFold(actualType, column.columnType) {
+			retyped = append(retyped, column.name)
+		}
+	}
+
+	if len(retyped) > 0 {
+		previousTable := table + "_before_migration"
+		statements := []string{
+			fmt.Sprintf("ALTER TABLE %s RENAME TO %s;", table, previousTable),
+			definition + ";",
+			fmt.Sprintf("INSERT INTO %s (%s) SELECT %s FROM %s;", table, strings.Join(common, ", "), strings.Join(common, ", "), previousTable),
+			fmt.Sprintf("DROP TABLE %s;", previousTable),
+		}
+		for _, statement := range statements {
+			_, err = tx.Exec(statement)
+			if err != nil {
+				return changes, fmt.Errorf("Could not rebuild table (%s): %w", table, err)
+			}
+		}
+		for _, column := range retyped {
+			changes = append(changes, fmt.Sprintf("Changed type of column in table (%s): %s %s -> %s", table, column, actualTypes[column], expectedTypeOf(expectedColumns, column)))
+		}
+		for _, column := range missing {
+			changes = append(changes, fmt.Sprintf("Added column to table (%s): %s", table, column.name))
+		}
+		return changes, nil
+	}
+
+	for _, column := range missing {
+		// SQLite cannot add NOT NULL columns without defaults to existing tables
+		if column.notNull && !column.defaultValue.Valid {
+			return changes, fmt.Errorf("Could not add column (%s) to table (%s): it is NOT NULL and has no default value", column.name, table)
+		}
+		statement := fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column.name, column.columnType)
+		if column.notNull {
+			statement += " NOT NULL"
+		}
+		if column.defaultValue.Valid {
+			statement += " DEFAULT " + column.defaultValue.String
+		}
+		_, err = tx.Exec(statement + ";")
+		if err != nil {
+			return changes, fmt.Errorf("Could not add column (%s) to table (%s): %w", column.name, table, err)
+		}
+		changes = append(changes, fmt.Sprintf("Added column to table (%s): %s", table, column.name))
+	}
+	return changes, nil
+}
+
+// expectedTypeOf returns the type of the named column among the given definitions
+func expectedTypeOf(columns []columnDefinition, name string) string {
+	for _, column := range columns {
+		if column.name == name {
+			return column.columnType
+		}
+	}
+	return ""
+}
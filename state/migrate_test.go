@@ -0,0 +1,122 @@
+package state
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestMigrate(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "shnorky-migrate-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, err := sql.Open("sqlite3", path.Join(tempDir, "old.sqlite"))
+	if err != nil {
+		t.Fatalf("Could not open old state database: %s", err.Error())
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+CREATE TABLE flow_runs (id VARCHAR(36) PRIMARY KEY NOT NULL, flow_id VARCHAR(36) NOT NULL, status VARCHAR(32) NOT NULL, created_at TEXT NOT NULL, finished_at INTEGER);
+CREATE TABLE builds (id VARCHAR(36) PRIMARY KEY NOT NULL, component_id VARCHAR(36) NOT NULL, created_at TEXT NOT NULL);
+INSERT INTO builds (id, component_id, created_at) VALUES ('a', 'c', '1600000000'), ('b', 'c', '2020-09-13 12:26:40'), ('c', 'c', 1600000000);
+`)
+	if err != nil {
+		t.Fatalf("Could not populate old state database: %s", err.Error())
+	}
+
+	changes, err := Migrate(db)
+	if err != nil {
+		t.Fatalf("Unexpected error migrating state database: %s", err.Error())
+	}
+	expectedChanges := map[string]bool{
+		"Created table: approvals":                                                true,
+		"Added column to table (flow_runs): priority":                             true,
+		"Added column to table (builds): created_by":                              true,
+		"Changed type of column in table (builds): created_at TEXT -> INTEGER":    true,
+		"Changed type of column in table (flow_runs): created_at TEXT -> INTEGER": true,
+		"Normalized created_at values in table (builds): 1":                       true,
+		"Created index: builds_component_id":                                      true,
+		"Created index: flow_runs_created_at":                                     true,
+	}
+	found := 0
+	for _, change := range changes {
+		if expectedChanges[change] {
+			found++
+		}
+	}
+	if found != len(expectedChanges) {
+		t.Errorf("Did not find all expected changes: %v", changes)
+	}
+
+	rows, err := db.Query("SELECT id, typeof(created_at), created_at FROM builds ORDER BY id;")
+	if err != nil {
+		t.Fatalf("Could not select builds: %s", err.Error())
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id, createdAtType string
+		var createdAt int64
+		err = rows.Scan(&id, &createdAtType, &createdAt)
+		if err != nil {
+			t.Fatalf("Could not scan build: %s", err.Error())
+		}
+		if createdAtType != "integer" || createdAt != 1600000000 {
+			t.Errorf("Unexpected created_at for build (%s): type=%s, value=%d", id, createdAtType, createdAt)
+		}
+	}
+
+	differences, err := CheckSchema(db)
+	if err != nil {
+		t.Fatalf("Unexpected error checking schema: %s", err.Error())
+	}
+	if len(differences) != 0 {
+		t.Errorf("Unexpected differences after migration: %v", differences)
+	}
+
+	changes, err = Migrate(db)
+	if err != nil {
+		t.Fatalf("Unexpected error migrating up to date state database: %s", err.Error())
+	}
+	if len(changes) != 0 {
+		t.Errorf("Unexpected changes to up to date state database: %v", changes)
+	}
+}
+
+func TestMigrateRollsBackOnError(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "shnorky-migrate-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+
+	db, err := sql.Open("sqlite3", path.Join(tempDir, "old.sqlite"))
+	if err != nil {
+		t.Fatalf("Could not open old state database: %s", err.Error())
+	}
+	defer db.Close()
+	_, err = db.Exec(`
+CREATE TABLE builds (id VARCHAR(36) PRIMARY KEY NOT NULL, component_id VARCHAR(36) NOT NULL, created_at TEXT NOT NULL);
+INSERT INTO builds (id, component_id, created_at) VALUES ('a', 'c', 'yesterday');
+`)
+	if err != nil {
+		t.Fatalf("Could not populate old state database: %s", err.Error())
+	}
+
+	_, err = Migrate(db)
+	if err == nil {
+		t.Fatal("Expected error migrating state database with unparseable created_at value")
+	}
+
+	tables, err := names(db, selectTables)
+	if err != nil {
+		t.Fatalf("Could not select tables: %s", err.Error())
+	}
+	if len(tables) != 1 {
+		t.Errorf("Expected failed migration to be rolled back, but found tables: %v", tables)
+	}
+}
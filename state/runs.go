@@ -0,0 +1,230 @@
+package state
+
+import (
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// SQL statements. Those with "%s" in them are completed with a list of statuses (see inList).
+var selectUnfinishedFlowRunIDs = "SELECT id FROM flow_runs WHERE flow_id=? AND status IN %s AND finished_at IS NULL ORDER BY created_at, rowid;"
+var selectQueuedFlowRuns = "SELECT " + flowRunColumns + " FROM flow_runs WHERE status IN %s AND finished_at IS NULL ORDER BY IFNULL(priority, 0) DESC, created_at, rowid;"
+var countUnfinishedFlowRuns = "SELECT COUNT(*) FROM flow_runs WHERE status IN %s AND finished_at IS NULL;"
+var transitionFlowRun = "UPDATE flow_runs SET status=? WHERE id=? AND status=? AND finished_at IS NULL;"
+var updateFlowRunHeartbeat = "UPDATE flow_runs SET heartbeat_at=? WHERE id=? AND finished_at IS NULL;"
+var insertRunResource = "INSERT INTO run_resources (flow_run_id, kind, name) VALUES(?, ?, ?);"
+var selectRunResourceConflicts = `SELECT other.flow_run_id, other.kind, other.name
+FROM run_resources AS mine
+	JOIN run_resources AS other ON other.kind=mine.kind AND other.name=mine.name AND other.flow_run_id<>mine.flow_run_id
+	JOIN flow_runs ON flow_runs.id=other.flow_run_id
+WHERE mine.flow_run_id=? AND flow_runs.finished_at IS NULL
+ORDER BY other.kind, other.name, other.flow_run_id;`
+var countUnfinishedFlowRunsUsing = "SELECT COUNT(*) FROM flow_runs WHERE finished_at IS NULL AND (id=? OR id IN (SELECT flow_run_id FROM run_resources WHERE kind=? AND name=?));"
+
+// insertFlowRunWithinQuota inserts the given flow run only if fewer than the given number of runs
+// of its flow are unfinished. Checking the quota and inserting the run in a single statement means
+// that two processes cannot both take the last free slot.
+var insertFlowRunWithinQuota = "INSERT INTO flow_runs (id, flow_id, status, created_at, priority) SELECT ?, ?, ?, ?, ? WHERE (SELECT COUNT(*) FROM flow_runs WHERE flow_id=? AND status IN %s AND finished_at IS NULL) < ?;"
+
+// startFlowRun changes the status of the given unfinished flow run only if (when the limit is
+// positive) fewer than the given number of runs are active. Checking the limit and starting the run
+// in a single statement means that two processes cannot both take the last free slot.
+var startFlowRun = "UPDATE flow_runs SET status=? WHERE id=? AND status=? AND finished_at IS NULL AND (? <= 0 OR (SELECT COUNT(*) FROM flow_runs WHERE status IN %s AND finished_at IS NULL) < ?);"
+
+// startFlowRunWithinQuota changes the status of the given unfinished flow run as startFlowRun does,
+// but only if fewer than the given number of runs of its flow also hold slots in its quota
+var startFlowRunWithinQuota = `UPDATE flow_runs SET status=? WHERE id=? AND status=? AND finished_at IS NULL
+	AND (? <= 0 OR (SELECT COUNT(*) FROM flow_runs WHERE status IN %s AND finished_at IS NULL) < ?)
+	AND (SELECT COUNT(*) FROM flow_runs AS flow_run WHERE flow_run.flow_id=flow_runs.flow_id AND flow_run.status IN %s AND flow_run.finished_at IS NULL) < ?;`
+
+// abandonedFlowRunConditions selects the unfinished flow runs (with the given statuses) whose
+// heartbeats are older than a given time and which have no executions whose containers may still
+// be running. Runs which have never recorded a heartbeat are judged by the time they were created.
+var abandonedFlowRunConditions = `status IN %s AND finished_at IS NULL AND IFNULL(heartbeat_at, created_at) < ?
+	AND NOT EXISTS (SELECT 1 FROM executions WHERE executions.flow_run_id=flow_runs.id AND executions.finished_at IS NULL AND executions.build_id<>executions.component_id)`
+var selectAbandonedFlowRuns = "SELECT " + flowRunColumns + " FROM flow_runs WHERE " + abandonedFlowRunConditions + " ORDER BY created_at, rowid;"
+var failAbandonedFlowRun = "UPDATE flow_runs SET status=?, finished_at=? WHERE id=? AND " + abandonedFlowRunConditions + ";"
+
+// InsertFlowRunWithinQuota creates a new row in the flow_runs table with the given flow run
+// information, but only if fewer than maxRuns runs of its flow are unfinished and have one of the
+// given statuses. It returns whether the run was inserted.
+func (store *SQLiteStore) InsertFlowRunWithinQuota(run FlowRunRecord, statuses []string, maxRuns int) (bool, error) {
+	statusList, statusArgs := inList(statuses)
+	args := []interface{}{run.ID, run.FlowID, run.Status, run.CreatedAt.Unix(), run.Priority, run.FlowID}
+	args = append(append(args, statusArgs...), maxRuns)
+	inserted, err := store.exec(fmt.Sprintf(insertFlowRunWithinQuota, statusList), args...)
+	return inserted > 0, err
+}
+
+// SelectUnfinishedFlowRunIDs returns the IDs of the unfinished runs of the flow with the given ID
+// which have one of the given statuses, oldest first
+func (store *SQLiteStore) SelectUnfinishedFlowRunIDs(flowID string, statuses []string) ([]string, error) {
+	statusList, statusArgs := inList(statuses)
+	rows, err := store.db.Query(fmt.Sprintf(selectUnfinishedFlowRunIDs, statusList), append([]interface{}{flowID}, statusArgs...)...)
+	if err != nil {
+		return []string{}, err
+	}
+	defer rows.Close()
+
+	runIDs := []string{}
+	for rows.Next() {
+		var runID string
+		err = rows.Scan(&runID)
+		if err != nil {
+			return runIDs, err
+		}
+		runIDs = append(runIDs, runID)
+	}
+	return runIDs, rows.Err()
+}
+
+// SelectQueuedFlowRuns returns the unfinished flow runs which have one of the given statuses, in
+// queue order: highest priority first and, among runs with the same priority, oldest first
+func (store *SQLiteStore) SelectQueuedFlowRuns(statuses []string) ([]FlowRunRecord, error) {
+	statusList, statusArgs := inList(statuses)
+	rows, err := store.db.Query(fmt.Sprintf(selectQueuedFlowRuns, statusList), statusArgs...)
+	if err != nil {
+		return []FlowRunRecord{}, err
+	}
+	return scanFlowRuns(rows)
+}
+
+// CountUnfinishedFlowRuns returns the number of unfinished flow runs which have one of the given
+// statuses
+func (store *SQLiteStore) CountUnfinishedFlowRuns(statuses []string) (int, error) {
+	statusList, statusArgs := inList(statuses)
+	var count int
+	err := store.db.QueryRow(fmt.Sprintf(countUnfinishedFlowRuns, statusList), statusArgs...).Scan(&count)
+	return count, err
+}
+
+// TransitionFlowRun changes the status of the flow run with the given ID from one status to
+// another, as long as the run has not finished. It returns whether the run was in the former status
+// (and so had its status changed).
+func (store *SQLiteStore) TransitionFlowRun(id, from, to string) (bool, error) {
+	updated, err := store.exec(transitionFlowRun, to, id, from)
+	return updated > 0, err
+}
+
+// StartFlowRun changes the status of the flow run with the given ID from one status to another as
+// TransitionFlowRun does, but only if maxActive is not positive or fewer than maxActive unfinished
+// runs have one of the given active statuses. It returns whether the status of the run was changed.
+func (store *SQLiteStore) StartFlowRun(id, from, to string, activeStatuses []string, maxActive int) (bool, error) {
+	statusList, statusArgs := inList(activeStatuses)
+	args := []interface{}{to, id, from, maxActive}
+	args = append(append(args, statusArgs...), maxActive)
+	started, err := store.exec(fmt.Sprintf(startFlowRun, statusList), args...)
+	return started > 0, err
+}
+
+// StartFlowRunWithinQuota changes the status of the flow run with the given ID as StartFlowRun does,
+// but only if, in addition, fewer than maxFlowRuns unfinished runs of its flow have one of the
+// given flow statuses. It returns whether the status of the run was changed.
+func (store *SQLiteStore) StartFlowRunWithinQuota(id, from, to string, activeStatuses []string, maxActive int, flowStatuses []string, maxFlowRuns int) (bool, error) {
+	activeList, activeArgs := inList(activeStatuses)
+	flowList, flowArgs := inList(flowStatuses)
+	args := []interface{}{to, id, from, maxActive}
+	args = append(append(args, activeArgs...), maxActive)
+	args = append(append(args, flowArgs...), maxFlowRuns)
+	started, err := store.exec(fmt.Sprintf(startFlowRunWithinQuota, activeList, flowList), args...)
+	return started > 0, err
+}
+
+// UpdateFlowRunHeartbeat records the given time as the heartbeat of the flow run with the given ID,
+// unless it has finished
+func (store *SQLiteStore) UpdateFlowRunHeartbeat(id string, heartbeatAt time.Time) error {
+	_, err := store.exec(updateFlowRunHeartbeat, heartbeatAt.Unix(), id)
+	return err
+}
+
+// SelectAbandonedFlowRuns returns the unfinished flow runs which have one of the given statuses,
+// whose last heartbeat (or, if they never recorded one, creation) was before the given cutoff, and
+// none of whose executions may still be running in containers, oldest first
+func (store *SQLiteStore) SelectAbandonedFlowRuns(statuses []string, cutoff time.Time) ([]FlowRunRecord, error) {
+	statusList, statusArgs := inList(statuses)
+	rows, err := store.db.Query(fmt.Sprintf(selectAbandonedFlowRuns, statusList), append(statusArgs, cutoff.Unix())...)
+	if err != nil {
+		return []FlowRunRecord{}, err
+	}
+	return scanFlowRuns(rows)
+}
+
+// FailAbandonedFlowRun stores the status and finish time of the given flow run against its row,
+// but only if it is still abandoned (as SelectAbandonedFlowRuns decides) - e.g. it may have
+// recorded a heartbeat since it was selected. It returns whether the run was updated.
+func (store *SQLiteStore) FailAbandonedFlowRun(run FlowRunRecord, statuses []string, cutoff time.Time) (bool, error) {
+	statusList, statusArgs := inList(statuses)
+	args := []interface{}{run.Status, nullableUnix(run.FinishedAt), run.ID}
+	args = append(append(args, statusArgs...), cutoff.Unix())
+	updated, err := store.exec(fmt.Sprintf(failAbandonedFlowRun, statusList), args...)
+	return updated > 0, err
+}
+
+// ClaimRunResources records the given resources against the flow run with the given ID, in a
+// single transaction. If any of the resources is also used by another unfinished flow run, nothing
+// is recorded and the conflicting resources (of the other runs) are returned.
+func (store *SQLiteStore) ClaimRunResources(flowRunID string, resources []RunResourceRecord) ([]RunResourceRecord, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return []RunResourceRecord{}, err
+	}
+	claimed := map[RunResourceRecord]bool{}
+	for _, resource := range resources {
+		resource.FlowRunID = flowRunID
+		if claimed[resource] {
+			continue
+		}
+		_, err = tx.Exec(insertRunResource, resource.FlowRunID, resource.Kind, resource.Name)
+		if err != nil {
+			tx.Rollback()
+			return []RunResourceRecord{}, fmt.Errorf("Error recording resource (%s %s) of flow run (%s): %w", resource.Kind, resource.Name, flowRunID, err)
+		}
+		claimed[resource] = true
+	}
+
+	rows, err := tx.Query(selectRunResourceConflicts, flowRunID)
+	if err != nil {
+		tx.Rollback()
+		return []RunResourceRecord{}, err
+	}
+	conflicts, err := scanRunResources(rows)
+	if err != nil || len(conflicts) > 0 {
+		tx.Rollback()
+		return conflicts, err
+	}
+	return conflicts, tx.Commit()
+}
+
+// SelectRunResourceConflicts returns the resources of other unfinished flow runs which the flow run
+// with the given ID also uses
+func (store *SQLiteStore) SelectRunResourceConflicts(flowRunID string) ([]RunResourceRecord, error) {
+	rows, err := store.db.Query(selectRunResourceConflicts, flowRunID)
+	if err != nil {
+		return []RunResourceRecord{}, err
+	}
+	return scanRunResources(rows)
+}
+
+// scanRunResources reads run resource records from all the rows of flow run ID, kind, and name in
+// the given result set, and closes the rows
+func scanRunResources(rows *sql.Rows) ([]RunResourceRecord, error) {
+	defer rows.Close()
+	resources := []RunResourceRecord{}
+	for rows.Next() {
+		var resource RunResourceRecord
+		err := rows.Scan(&resource.FlowRunID, &resource.Kind, &resource.Name)
+		if err != nil {
+			return resources, err
+		}
+		resources = append(resources, resource)
+	}
+	return resources, rows.Err()
+}
+
+// CountUnfinishedFlowRunsUsing returns the number of unfinished flow runs which either have the
+// given ID or have claimed the resource of the given kind with the given name
+func (store *SQLiteStore) CountUnfinishedFlowRunsUsing(flowRunID, kind, name string) (int, error) {
+	var count int
+	err := store.db.QueryRow(countUnfinishedFlowRunsUsing, flowRunID, kind, name).Scan(&count)
+	return count, err
+}
@@ -0,0 +1,145 @@
+package state
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+)
+
+// SQL statements
+var selectTables = "SELECT name FROM sqlite_master WHERE type='table' ORDER BY name;"
+var selectColumns = "SELECT name FROM pragma_table_info(?) ORDER BY cid;"
+var selectIndices = "SELECT name FROM sqlite_master WHERE type='index' AND sql IS NOT NULL ORDER BY name;"
+
+// CheckSchema compares the schema of the given state database with the schema that Init creates,
+// and returns a description of each difference (e.g. a missing table, column, or index). State
+// databases created by older versions of shnorky may be missing tables or columns which newer
+// versions rely on. An empty result means that the schema is up to date.
+func CheckSchema(db *sql.DB) ([]string, error) {
+	expectedDB, err := expectedDatabase()
+	if err != nil {
+		return []string{}, err
+	}
+	defer expectedDB.Close()
+
+	expectedSchema, err := schema(expectedDB)
+	if err != nil {
+		return []string{}, err
+	}
+	actualSchema, err := schema(db)
+	if err != nil {
+		return []string{}, err
+	}
+
+	tables := []string{}
+	for table := range expectedSchema {
+		tables = append(tables, table)
+	}
+	sort.Strings(tables)
+
+	differences := []string{}
+	for _, table := range tables {
+		actualColumns, ok := actualSchema[table]
+		if !ok {
+			differences = append(differences, fmt.Sprintf("Missing table: %s", table))
+			continue
+		}
+		present := map[string]bool{}
+		for _, column := range actualColumns {
+			present[column] = true
+		}
+		for _, column := range expectedSchema[table] {
+			if !present[column] {
+				differences = append(differences, fmt.Sprintf("Missing column in table (%s): %s", table, column))
+			}
+		}
+	}
+
+	expectedIndices, err := names(expectedDB, selectIndices)
+	if err != nil {
+		return differences, err
+	}
+	actualIndices, err := names(db, selectIndices)
+	if err != nil {
+		return differences, err
+	}
+	present := map[string]bool{}
+	for _, index := range actualIndices {
+		present[index] = true
+	}
+	for _, index := range expectedIndices {
+		if !present[index] {
+			differences = append(differences, fmt.Sprintf("Missing index: %s", index))
+		}
+	}
+	return differences, nil
+}
+
+// expectedDatabase returns an in-memory database with the schema that Init creates
+func expectedDatabase() (*sql.DB, error) {
+	expectedDB, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		return nil, err
+	}
+	// Each connection to an in-memory database gets its own database
+	expectedDB.SetMaxOpenConns(1)
+	_, err = expectedDB.Exec(createTables + createIndices)
+	if err != nil {
+		expectedDB.Close()
+		return nil, err
+	}
+	return expectedDB, nil
+}
+
+// queryer is implemented by both *sql.DB and *sql.Tx
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// names returns the values of the single column selected by the given query
+func names(db queryer, query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return []string{}, err
+	}
+	defer rows.Close()
+	result := []string{}
+	for rows.Next() {
+		var name string
+		err = rows.Scan(&name)
+		if err != nil {
+			return result, err
+		}
+		result = append(result, name)
+	}
+	return result, rows.Err()
+}
+
+// schema returns the columns of each table in the given database, keyed by table name
+func schema(db *sql.DB) (map[string][]string, error) {
+	tables, err := names(db, selectTables)
+	if err != nil {
+		return map[string][]string{}, err
+	}
+
+	tableColumns := map[string][]string{}
+	for _, table := range tables {
+		columnRows, err := db.Query(selectColumns, table)
+		if err != nil {
+			return tableColumns, err
+		}
+		columns := []string{}
+		for columnRows.Next() {
+			var column string
+			err = columnRows.Scan(&column)
+			if err != nil {
+				columnRows.Close()
+				return tableColumns, err
+			}
+			columns = append(columns, column)
+		}
+		columnRows.Close()
+		tableColumns[table] = columns
+	}
+	return tableColumns, nil
+}
@@ -0,0 +1,68 @@
+package state
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestCheckSchema(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "shnorky-schema-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+
+	stateDir := path.Join(tempDir, "state")
+	err = Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", err.Error())
+	}
+	db, err := sql.Open("sqlite3", path.Join(stateDir, DBFileName))
+	if err != nil {
+		t.Fatalf("Could not open state database: %s", err.Error())
+	}
+	defer db.Close()
+
+	differences, err := CheckSchema(db)
+	if err != nil {
+		t.Fatalf("Unexpected error checking schema: %s", err.Error())
+	}
+	if len(differences) != 0 {
+		t.Errorf("Unexpected differences for fresh state database: %v", differences)
+	}
+
+	oldDB, err := sql.Open("sqlite3", path.Join(tempDir, "old.sqlite"))
+	if err != nil {
+		t.Fatalf("Could not open old state database: %s", err.Error())
+	}
+	defer oldDB.Close()
+	_, err = oldDB.Exec("CREATE TABLE flow_runs (id VARCHAR(36) PRIMARY KEY NOT NULL, flow_id VARCHAR(36) NOT NULL, status VARCHAR(32) NOT NULL, created_at INTEGER NOT NULL, finished_at INTEGER);")
+	if err != nil {
+		t.Fatalf("Could not create table in old state database: %s", err.Error())
+	}
+
+	differences, err = CheckSchema(oldDB)
+	if err != nil {
+		t.Fatalf("Unexpected error checking schema: %s", err.Error())
+	}
+	expectedDifferences := map[string]bool{
+		"Missing table: approvals":                      true,
+		"Missing column in table (flow_runs): priority": true,
+		"Missing index: flow_runs_created_at":           true,
+	}
+	found := 0
+	for _, difference := range differences {
+		if expectedDifferences[difference] {
+			found++
+		}
+		if difference == "Missing table: flow_runs" {
+			t.Errorf("Reported existing table as missing")
+		}
+	}
+	if found != len(expectedDifferences) {
+		t.Errorf("Did not find all expected differences: %v", differences)
+	}
+}
@@ -0,0 +1,45 @@
+package state
+
+import "time"
+
+// SQL statements
+var insertStandingService = "INSERT INTO standing_services (flow_id, step, execution_id, network, started_at) VALUES(?, ?, ?, ?, ?);"
+var selectStandingServices = "SELECT flow_id, step, execution_id, network, started_at FROM standing_services WHERE flow_id=? ORDER BY step;"
+var deleteStandingServices = "DELETE FROM standing_services WHERE flow_id=?;"
+
+// InsertStandingService creates a new row in the standing_services table with the given service
+// information
+func (store *SQLiteStore) InsertStandingService(service StandingServiceRecord) error {
+	_, err := store.exec(insertStandingService, service.FlowID, service.Step, service.ExecutionID, service.Network, service.StartedAt.Unix())
+	return err
+}
+
+// SelectStandingServices returns the standing services of the flow with the given ID, in
+// lexicographic order of their steps
+func (store *SQLiteStore) SelectStandingServices(flowID string) ([]StandingServiceRecord, error) {
+	rows, err := store.db.Query(selectStandingServices, flowID)
+	if err != nil {
+		return []StandingServiceRecord{}, err
+	}
+	defer rows.Close()
+
+	services := []StandingServiceRecord{}
+	for rows.Next() {
+		var service StandingServiceRecord
+		var startedAt int64
+		err = rows.Scan(&service.FlowID, &service.Step, &service.ExecutionID, &service.Network, &startedAt)
+		if err != nil {
+			return services, err
+		}
+		service.StartedAt = time.Unix(startedAt, 0)
+		services = append(services, service)
+	}
+	return services, rows.Err()
+}
+
+// DeleteStandingServices removes the rows for all the standing services of the flow with the given
+// ID
+func (store *SQLiteStore) DeleteStandingServices(flowID string) error {
+	_, err := store.exec(deleteStandingServices, flowID)
+	return err
+}
@@ -0,0 +1,82 @@
+package state
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// SQL statements
+var upsertComponentSource = "INSERT OR REPLACE INTO component_sources (component_id, url, ref, path, commit_sha, fetched_at) VALUES(?, ?, ?, ?, ?, ?);"
+var selectComponentSource = "SELECT component_id, url, IFNULL(ref, ''), IFNULL(path, ''), commit_sha, fetched_at FROM component_sources WHERE component_id=?;"
+var deleteComponentSource = "DELETE FROM component_sources WHERE component_id=?;"
+var upsertExecutionConfiguration = "INSERT OR REPLACE INTO execution_configurations (execution_id, image_digest, env, mounts) VALUES(?, ?, ?, ?);"
+var selectExecutionConfiguration = "SELECT execution_id, IFNULL(image_digest, ''), env, mounts FROM execution_configurations WHERE execution_id=?;"
+
+// UpsertComponentSource records the given source of a component, replacing any source which was
+// previously recorded for it
+func (store *SQLiteStore) UpsertComponentSource(source ComponentSourceRecord) error {
+	_, err := store.exec(upsertComponentSource, source.ComponentID, source.URL, source.Ref, source.Path, source.Commit, source.FetchedAt.Unix())
+	return err
+}
+
+// SelectComponentSource returns the source of the component with the given ID, or ErrNotFound if
+// none was recorded
+func (store *SQLiteStore) SelectComponentSource(componentID string) (ComponentSourceRecord, error) {
+	var source ComponentSourceRecord
+	var fetchedAt int64
+	err := store.db.QueryRow(selectComponentSource, componentID).Scan(&source.ComponentID, &source.URL, &source.Ref, &source.Path, &source.Commit, &fetchedAt)
+	err = checkRowID(err, componentID, source.ComponentID)
+	if err != nil {
+		return ComponentSourceRecord{}, err
+	}
+	source.FetchedAt = time.Unix(fetchedAt, 0)
+	return source, nil
+}
+
+// DeleteComponentSource removes the source recorded for the component with the given ID, if any
+func (store *SQLiteStore) DeleteComponentSource(componentID string) error {
+	_, err := store.exec(deleteComponentSource, componentID)
+	return err
+}
+
+// UpsertExecutionConfiguration records the given execution configuration, replacing any
+// configuration which was previously recorded for its execution. The environment and mounts are
+// stored as JSON documents.
+func (store *SQLiteStore) UpsertExecutionConfiguration(configuration ExecutionConfigurationRecord) error {
+	env, err := json.Marshal(configuration.Env)
+	if err != nil {
+		return err
+	}
+	mounts, err := json.Marshal(configuration.Mounts)
+	if err != nil {
+		return err
+	}
+	_, err = store.exec(upsertExecutionConfiguration, configuration.ExecutionID, configuration.ImageDigest, string(env), string(mounts))
+	return err
+}
+
+// SelectExecutionConfiguration returns the configuration recorded for the execution with the given
+// ID, or ErrNotFound if none was recorded
+func (store *SQLiteStore) SelectExecutionConfiguration(executionID string) (ExecutionConfigurationRecord, error) {
+	var configuration ExecutionConfigurationRecord
+	var env, mounts string
+	err := store.db.QueryRow(selectExecutionConfiguration, executionID).Scan(&configuration.ExecutionID, &configuration.ImageDigest, &env, &mounts)
+	if err == sql.ErrNoRows {
+		return ExecutionConfigurationRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return ExecutionConfigurationRecord{}, err
+	}
+
+	err = json.Unmarshal([]byte(env), &configuration.Env)
+	if err != nil {
+		return configuration, fmt.Errorf("Could not parse recorded environment of execution (%s): %w", executionID, err)
+	}
+	err = json.Unmarshal([]byte(mounts), &configuration.Mounts)
+	if err != nil {
+		return configuration, fmt.Errorf("Could not parse recorded mounts of execution (%s): %w", executionID, err)
+	}
+	return configuration, nil
+}
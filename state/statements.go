@@ -6,19 +6,35 @@ CREATE TABLE components (
 	component_type VARCHAR(32) NOT NULL,
 	component_path TEXT NOT NULL,
 	specification_path TEXT NOT NULL,
-	created_at INTEGER NOT NULL
+	created_at INTEGER NOT NULL,
+	created_by TEXT,
+	specification_checksum TEXT,
+	specification_snapshot TEXT
 );
 
 CREATE TABLE flows (
 	id VARCHAR(36) PRIMARY KEY NOT NULL,
 	specification_path TEXT NOT NULL,
-	created_at INTEGER NOT NULL
+	created_at INTEGER NOT NULL,
+	created_by TEXT,
+	specification_checksum TEXT,
+	specification_snapshot TEXT
+);
+
+CREATE TABLE flow_components (
+	flow_id VARCHAR(36) NOT NULL,
+	step TEXT NOT NULL,
+	component_id VARCHAR(36) NOT NULL,
+	PRIMARY KEY (flow_id, step)
 );
 
 CREATE TABLE builds (
 	id VARCHAR(36) PRIMARY KEY NOT NULL,
 	component_id VARCHAR(36) NOT NULL,
-	created_at INTEGER NOT NULL
+	created_at INTEGER NOT NULL,
+	created_by TEXT,
+	source_hash TEXT,
+	target TEXT
 );
 
 CREATE TABLE executions (
@@ -26,6 +42,122 @@ CREATE TABLE executions (
 	build_id VARCHAR(36) NOT NULL,
 	component_id VARCHAR(36) NOT NULL,
 	created_at INTEGER NOT NULL,
-	flow_id VARCHAR(36)
+	flow_id VARCHAR(36),
+	flow_run_id VARCHAR(36),
+	step TEXT,
+	exit_code INTEGER,
+	oom_killed INTEGER,
+	error TEXT,
+	finished_at INTEGER,
+	peak_memory_bytes INTEGER,
+	cpu_seconds REAL,
+	io_read_bytes INTEGER,
+	io_write_bytes INTEGER,
+	created_by TEXT,
+	attempt INTEGER,
+	previous_attempt_id VARCHAR(36)
+);
+
+CREATE TABLE flow_runs (
+	id VARCHAR(36) PRIMARY KEY NOT NULL,
+	flow_id VARCHAR(36) NOT NULL,
+	status VARCHAR(32) NOT NULL,
+	created_at INTEGER NOT NULL,
+	finished_at INTEGER,
+	priority INTEGER,
+	heartbeat_at INTEGER
+);
+
+CREATE TABLE artifacts (
+	id VARCHAR(36) PRIMARY KEY NOT NULL,
+	execution_id VARCHAR(36) NOT NULL,
+	name TEXT NOT NULL,
+	artifact_path TEXT NOT NULL,
+	created_at INTEGER NOT NULL
 );
+
+CREATE TABLE api_tokens (
+	id VARCHAR(36) PRIMARY KEY NOT NULL,
+	token_hash VARCHAR(64) UNIQUE NOT NULL,
+	role VARCHAR(32) NOT NULL,
+	description TEXT,
+	created_at INTEGER NOT NULL,
+	created_by TEXT,
+	revoked_at INTEGER
+);
+
+CREATE TABLE audit_log (
+	id VARCHAR(36) PRIMARY KEY NOT NULL,
+	action VARCHAR(64) NOT NULL,
+	actor TEXT NOT NULL,
+	arguments TEXT NOT NULL,
+	result VARCHAR(32) NOT NULL,
+	error TEXT,
+	created_at INTEGER NOT NULL
+);
+
+CREATE TABLE approvals (
+	execution_id VARCHAR(36) PRIMARY KEY NOT NULL,
+	flow_run_id VARCHAR(36) NOT NULL,
+	step TEXT NOT NULL,
+	message TEXT,
+	status VARCHAR(32) NOT NULL,
+	requested_at INTEGER NOT NULL,
+	decided_at INTEGER,
+	decided_by TEXT,
+	comment TEXT
+);
+
+CREATE TABLE run_resources (
+	flow_run_id VARCHAR(36) NOT NULL,
+	kind VARCHAR(32) NOT NULL,
+	name TEXT NOT NULL,
+	PRIMARY KEY (flow_run_id, kind, name)
+);
+
+CREATE TABLE labels (
+	resource_type VARCHAR(32) NOT NULL,
+	resource_id VARCHAR(36) NOT NULL,
+	key TEXT NOT NULL,
+	value TEXT NOT NULL,
+	PRIMARY KEY (resource_type, resource_id, key)
+);
+
+CREATE TABLE component_sources (
+	component_id VARCHAR(36) PRIMARY KEY,
+	url TEXT NOT NULL,
+	ref TEXT,
+	path TEXT,
+	commit_sha VARCHAR(40) NOT NULL,
+	fetched_at INTEGER NOT NULL
+);
+
+CREATE TABLE standing_services (
+	flow_id VARCHAR(36) NOT NULL,
+	step TEXT NOT NULL,
+	execution_id VARCHAR(36) NOT NULL,
+	network TEXT NOT NULL,
+	started_at INTEGER NOT NULL,
+	PRIMARY KEY (flow_id, step)
+);
+
+CREATE TABLE execution_configurations (
+	execution_id VARCHAR(36) PRIMARY KEY NOT NULL,
+	image_digest TEXT,
+	env TEXT NOT NULL,
+	mounts TEXT NOT NULL
+);
+`
+
+var createIndices = `
+CREATE INDEX IF NOT EXISTS components_created_at ON components (created_at);
+CREATE INDEX IF NOT EXISTS flows_created_at ON flows (created_at);
+CREATE INDEX IF NOT EXISTS flow_components_component_id ON flow_components (component_id);
+CREATE INDEX IF NOT EXISTS builds_component_id ON builds (component_id);
+CREATE INDEX IF NOT EXISTS builds_created_at ON builds (created_at);
+CREATE INDEX IF NOT EXISTS executions_component_id ON executions (component_id);
+CREATE INDEX IF NOT EXISTS executions_created_at ON executions (created_at);
+CREATE INDEX IF NOT EXISTS flow_runs_created_at ON flow_runs (created_at);
+CREATE INDEX IF NOT EXISTS artifacts_created_at ON artifacts (created_at);
+CREATE INDEX IF NOT EXISTS audit_log_created_at ON audit_log (created_at);
 `
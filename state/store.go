@@ -0,0 +1,803 @@
+package state
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// ErrNotFound - signifies that a single record lookup (or update) against a Store matched no
+// records
+var ErrNotFound = errors.New("Could not find the specified record")
+
+// Store - the operations through which shnorky persists the components, builds, executions,
+// artifacts, flows, flow runs, and the records attached to them (labels, approvals, standing
+// services, and so on) against a state directory, along with the API tokens and the audit log. The
+// packages which read and write these records do so through a Store rather than issuing SQL
+// themselves, so that alternative backends (or mock stores in tests) only need to implement this
+// interface. SQLiteStore is the implementation backed by the state database.
+//
+// The meaning of statuses is left to the callers: methods which treat flow runs differently
+// depending on their statuses take the statuses they should consider.
+type Store interface {
+	InsertComponent(component ComponentRecord) error
+	SelectComponent(id string) (ComponentRecord, error)
+	UpdateComponent(component ComponentRecord) error
+	DeleteComponent(id string) error
+	ListComponents(ctx context.Context, filter ComponentFilter, page Page, each func(component ComponentRecord, labels map[string]string) error) error
+
+	UpsertComponentSource(source ComponentSourceRecord) error
+	SelectComponentSource(componentID string) (ComponentSourceRecord, error)
+	DeleteComponentSource(componentID string) error
+
+	SetLabels(resourceType, resourceID string, labels map[string]string) error
+	SelectLabels(resourceType, resourceID string) (map[string]string, error)
+	DeleteLabels(resourceType, resourceID string) error
+
+	InsertBuild(build BuildRecord) error
+	SelectBuild(id string) (BuildRecord, error)
+	SelectMostRecentBuild(componentID, target string) (BuildRecord, error)
+	ListBuilds(ctx context.Context, componentPattern, createdBy string, page Page, each func(build BuildRecord) error) error
+
+	InsertExecution(execution ExecutionRecord) error
+	SelectExecution(id string) (ExecutionRecord, error)
+	SelectExecutionsByFlowRun(flowRunID string) ([]ExecutionRecord, error)
+	SelectSuccessfulExecutionsByFlow(flowID string) ([]ExecutionRecord, error)
+	SelectUnfinishedExecutions() ([]ExecutionRecord, error)
+	UpdateExecutionResult(execution ExecutionRecord) error
+	ListExecutions(ctx context.Context, componentID, flowRunID string, page Page, each func(execution ExecutionRecord) error) error
+
+	UpsertExecutionConfiguration(configuration ExecutionConfigurationRecord) error
+	SelectExecutionConfiguration(executionID string) (ExecutionConfigurationRecord, error)
+
+	InsertArtifact(artifact ArtifactRecord) error
+	ListArtifacts(ctx context.Context, executionID string, each func(artifact ArtifactRecord) error) error
+
+	InsertFlow(flow FlowRecord) error
+	RegisterFlow(flow FlowRecord, components []FlowComponentRecord) error
+	SelectFlow(id string) (FlowRecord, error)
+	SelectFlows(createdBy string) ([]FlowRecord, error)
+	SelectFlowComponents(flowID string) ([]FlowComponentRecord, error)
+	UpdateFlow(flow FlowRecord, components []FlowComponentRecord) error
+
+	InsertFlowRun(run FlowRunRecord) error
+	InsertFlowRunWithinQuota(run FlowRunRecord, statuses []string, maxRuns int) (bool, error)
+	SelectFlowRun(id string) (FlowRunRecord, error)
+	SelectFlowRunsByFlow(flowID string, limit int) ([]FlowRunRecord, error)
+	SelectUnfinishedFlowRunIDs(flowID string, statuses []string) ([]string, error)
+	SelectQueuedFlowRuns(statuses []string) ([]FlowRunRecord, error)
+	CountUnfinishedFlowRuns(statuses []string) (int, error)
+	UpdateFlowRunStatus(run FlowRunRecord) error
+	TransitionFlowRun(id, from, to string) (bool, error)
+	StartFlowRun(id, from, to string, activeStatuses []string, maxActive int) (bool, error)
+	StartFlowRunWithinQuota(id, from, to string, activeStatuses []string, maxActive int, flowStatuses []string, maxFlowRuns int) (bool, error)
+	UpdateFlowRunHeartbeat(id string, heartbeatAt time.Time) error
+	SelectAbandonedFlowRuns(statuses []string, cutoff time.Time) ([]FlowRunRecord, error)
+	FailAbandonedFlowRun(run FlowRunRecord, statuses []string, cutoff time.Time) (bool, error)
+
+	ClaimRunResources(flowRunID string, resources []RunResourceRecord) ([]RunResourceRecord, error)
+	SelectRunResourceConflicts(flowRunID string) ([]RunResourceRecord, error)
+	CountUnfinishedFlowRunsUsing(flowRunID, kind, name string) (int, error)
+
+	InsertApproval(approval ApprovalRecord) error
+	SelectApproval(executionID string) (ApprovalRecord, error)
+	SelectApprovals(flowRunID, status string) ([]ApprovalRecord, error)
+	DecideApproval(approval ApprovalRecord, pendingStatus string) error
+	ExpireApproval(executionID, pendingStatus, expiredStatus string, expiredAt time.Time) error
+
+	InsertStandingService(service StandingServiceRecord) error
+	SelectStandingServices(flowID string) ([]StandingServiceRecord, error)
+	DeleteStandingServices(flowID string) error
+
+	InsertToken(token TokenRecord) error
+	SelectTokens() ([]TokenRecord, error)
+	SelectActiveTokenRole(tokenHash string) (string, error)
+	RevokeToken(id string, revokedAt time.Time) error
+
+	InsertAuditEntry(entry AuditEntryRecord) error
+	SelectAuditEntries(filter AuditFilter) ([]AuditEntryRecord, error)
+}
+
+// ComponentRecord - a row of the components table. SpecificationChecksum is the hex-encoded SHA256
+// digest of the specification file at the time the component was registered, and
+// SpecificationSnapshot is its contents at that time. Both are empty if the specification file
+// could not be read.
+type ComponentRecord struct {
+	ID                    string
+	ComponentType         string
+	ComponentPath         string
+	SpecificationPath     string
+	CreatedAt             time.Time
+	CreatedBy             string
+	SpecificationChecksum string
+	SpecificationSnapshot string
+}
+
+// BuildRecord - a row of the builds table. Target is empty unless the build overrode the Dockerfile
+// stage given by the component specification.
+type BuildRecord struct {
+	ID          string
+	ComponentID string
+	CreatedAt   time.Time
+	CreatedBy   string
+	SourceHash  string
+	Target      string
+}
+
+// ExecutionRecord - a row of the executions table. FlowID, FlowRunID, and Step are empty for
+// executions which are not part of flow runs. The result members are only populated once the
+// execution has finished. Attempt is the number of the attempt at a flow step that the execution
+// represents (starting at 1), and PreviousAttemptID links retries to the execution they retried;
+// both are empty for executions which are not part of flow runs.
+type ExecutionRecord struct {
+	ID                string
+	BuildID           string
+	ComponentID       string
+	CreatedAt         time.Time
+	CreatedBy         string
+	FlowID            string
+	FlowRunID         string
+	Step              string
+	ExitCode          *int
+	OOMKilled         bool
+	Error             string
+	FinishedAt        *time.Time
+	PeakMemoryBytes   int64
+	CPUSeconds        float64
+	IOReadBytes       int64
+	IOWriteBytes      int64
+	Attempt           int
+	PreviousAttemptID string
+}
+
+// ArtifactRecord - a row of the artifacts table
+type ArtifactRecord struct {
+	ID           string
+	ExecutionID  string
+	Name         string
+	ArtifactPath string
+	CreatedAt    time.Time
+}
+
+// FlowRecord - a row of the flows table. SpecificationChecksum is the hex-encoded SHA256 digest of
+// the specification file at the time the flow was registered, and SpecificationSnapshot is the
+// specification document (with its includes merged in) at that time. Both are empty for flows
+// registered without them.
+type FlowRecord struct {
+	ID                    string
+	SpecificationPath     string
+	CreatedAt             time.Time
+	CreatedBy             string
+	SpecificationChecksum string
+	SpecificationSnapshot string
+}
+
+// FlowComponentRecord - a row of the flow_components table, recording the component that a step of
+// a registered flow uses
+type FlowComponentRecord struct {
+	FlowID      string
+	Step        string
+	ComponentID string
+}
+
+// FlowRunRecord - a row of the flow_runs table
+type FlowRunRecord struct {
+	ID         string
+	FlowID     string
+	Status     string
+	CreatedAt  time.Time
+	FinishedAt *time.Time
+	Priority   int
+}
+
+// ComponentSourceRecord - a row of the component_sources table, recording the git repository (and
+// the commit of it) that a component was registered from
+type ComponentSourceRecord struct {
+	ComponentID string
+	URL         string
+	Ref         string
+	Path        string
+	Commit      string
+	FetchedAt   time.Time
+}
+
+// ExecutionConfigurationRecord - a row of the execution_configurations table. Env maps the
+// environment variables of the execution to digests of their values, and Mounts lists its mounts.
+type ExecutionConfigurationRecord struct {
+	ExecutionID string
+	ImageDigest string
+	Env         map[string]string
+	Mounts      []string
+}
+
+// RunResourceRecord - a row of the run_resources table, recording a resource (of the given kind,
+// with the given name) which a flow run uses
+type RunResourceRecord struct {
+	FlowRunID string
+	Kind      string
+	Name      string
+}
+
+// ApprovalRecord - a row of the approvals table. DecidedAt, DecidedBy, and Comment are empty until
+// the approval is decided.
+type ApprovalRecord struct {
+	ExecutionID string
+	FlowRunID   string
+	Step        string
+	Message     string
+	Status      string
+	RequestedAt time.Time
+	DecidedAt   *time.Time
+	DecidedBy   string
+	Comment     string
+}
+
+// StandingServiceRecord - a row of the standing_services table
+type StandingServiceRecord struct {
+	FlowID      string
+	Step        string
+	ExecutionID string
+	Network     string
+	StartedAt   time.Time
+}
+
+// TokenRecord - a row of the api_tokens table. Only the (hex-encoded) hash of each token is stored.
+type TokenRecord struct {
+	ID          string
+	TokenHash   string
+	Role        string
+	Description string
+	CreatedAt   time.Time
+	CreatedBy   string
+	RevokedAt   *time.Time
+}
+
+// AuditEntryRecord - a row of the audit_log table. Arguments are stored as a JSON document.
+type AuditEntryRecord struct {
+	ID        string
+	Action    string
+	Actor     string
+	Arguments map[string]string
+	Result    string
+	Error     string
+	CreatedAt time.Time
+}
+
+// Columns selected for each type of record, so that the queries selecting them can share the
+// scanners below
+var (
+	componentColumns = "id, component_type, component_path, specification_path, created_at, IFNULL(created_by, ''), IFNULL(specification_checksum, ''), IFNULL(specification_snapshot, '')"
+	buildColumns     = "id, component_id, created_at, IFNULL(created_by, ''), IFNULL(source_hash, ''), IFNULL(target, '')"
+	executionColumns = "id, build_id, component_id, created_at, IFNULL(flow_id, ''), IFNULL(flow_run_id, ''), IFNULL(step, ''), exit_code, IFNULL(oom_killed, 0), IFNULL(error, ''), finished_at, IFNULL(peak_memory_bytes, 0), IFNULL(cpu_seconds, 0), IFNULL(io_read_bytes, 0), IFNULL(io_write_bytes, 0), IFNULL(created_by, ''), IFNULL(attempt, 0), IFNULL(previous_attempt_id, '')"
+	flowColumns      = "id, specification_path, created_at, IFNULL(created_by, ''), IFNULL(specification_checksum, ''), IFNULL(specification_snapshot, '')"
+	flowRunColumns   = "id, flow_id, status, created_at, finished_at, IFNULL(priority, 0)"
+)
+
+// SQL statements
+var insertComponent = "INSERT INTO components (id, component_type, component_path, specification_path, created_at, created_by, specification_checksum, specification_snapshot) VALUES(?, ?, ?, ?, ?, ?, ?, ?);"
+var selectComponentByID = "SELECT " + componentColumns + " FROM components WHERE id=?;"
+var deleteComponentByID = "DELETE FROM components WHERE id=?;"
+var updateComponent = "UPDATE components SET component_type=?, component_path=?, specification_path=?, specification_checksum=?, specification_snapshot=? WHERE id=?;"
+var insertBuild = "INSERT INTO builds (id, component_id, created_at, created_by, source_hash, target) VALUES(?, ?, ?, ?, ?, ?);"
+var selectBuildByID = "SELECT " + buildColumns + " FROM builds WHERE id=?;"
+var selectMostRecentBuildForComponent = "SELECT " + buildColumns + " FROM builds WHERE component_id=? AND IFNULL(target, '')=? ORDER BY created_at DESC LIMIT 1;"
+var insertExecutionWithNoFlowID = "INSERT INTO executions (id, build_id, component_id, created_at, created_by) VALUES(?, ?, ?, ?, ?);"
+var insertExecution = "INSERT INTO executions (id, build_id, component_id, created_at, flow_id, flow_run_id, step, created_by, attempt, previous_attempt_id) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?);"
+var selectExecutionByID = "SELECT " + executionColumns + " FROM executions WHERE id=?;"
+var selectExecutionsByFlowRunID = "SELECT " + executionColumns + " FROM executions WHERE flow_run_id=? ORDER BY created_at;"
+var selectSuccessfulExecutionsByFlowID = "SELECT " + executionColumns + " FROM executions WHERE flow_id=? AND exit_code=0 AND finished_at IS NOT NULL ORDER BY created_at DESC;"
+var updateExecutionResult = "UPDATE executions SET exit_code=?, oom_killed=?, error=?, finished_at=?, peak_memory_bytes=?, cpu_seconds=?, io_read_bytes=?, io_write_bytes=? WHERE id=?;"
+var insertArtifact = "INSERT INTO artifacts (id, execution_id, name, artifact_path, created_at) VALUES(?, ?, ?, ?, ?);"
+var insertFlow = "INSERT INTO flows (id, specification_path, created_at, created_by, specification_checksum, specification_snapshot) VALUES(?, ?, ?, ?, ?, ?);"
+var insertFlowComponent = "INSERT INTO flow_components (flow_id, step, component_id) VALUES(?, ?, ?);"
+var updateFlow = "UPDATE flows SET specification_path=?, specification_checksum=?, specification_snapshot=? WHERE id=?;"
+var deleteFlowComponentsByFlowID = "DELETE FROM flow_components WHERE flow_id=?;"
+var selectFlowComponentsByFlowID = "SELECT flow_id, step, component_id FROM flow_components WHERE flow_id=? ORDER BY step;"
+var selectFlowByID = "SELECT " + flowColumns + " FROM flows WHERE id=?;"
+var insertFlowRun = "INSERT INTO flow_runs (id, flow_id, status, created_at, priority) VALUES(?, ?, ?, ?, ?);"
+var selectFlowRunByID = "SELECT " + flowRunColumns + " FROM flow_runs WHERE id=?;"
+var selectFlowRunsByFlowID = "SELECT " + flowRunColumns + " FROM flow_runs WHERE flow_id=? ORDER BY created_at DESC, id LIMIT ?;"
+var updateFlowRunStatus = "UPDATE flow_runs SET status=?, finished_at=? WHERE id=?;"
+
+// SQLiteStore - the Store backed by a (SQLite) state database
+type SQLiteStore struct {
+	db *sql.DB
+}
+
+var _ Store = (*SQLiteStore)(nil)
+
+// NewSQLiteStore returns a Store which operates on the given state database
+func NewSQLiteStore(db *sql.DB) *SQLiteStore {
+	return &SQLiteStore{db: db}
+}
+
+// rowScanner is satisfied by both *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// exec executes the given statement in its own transaction and returns the number of rows that it
+// affected
+func (store *SQLiteStore) exec(statement string, args ...interface{}) (int64, error) {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	result, err := tx.Exec(statement, args...)
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		return 0, err
+	}
+
+	return rowsAffected, tx.Commit()
+}
+
+// update executes the given statement as exec does, returning ErrNotFound if it affected no rows
+func (store *SQLiteStore) update(statement string, args ...interface{}) error {
+	rowsAffected, err := store.exec(statement, args...)
+	if err != nil {
+		return err
+	}
+	if rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// checkRowID returns ErrNotFound if err signifies that no row was selected, and an error if the ID
+// of the selected row is not the expected one
+func checkRowID(err error, expected, actual string) error {
+	if err == sql.ErrNoRows {
+		return ErrNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return fmt.Errorf("Result had unexpected row ID: expected=%s, actual=%s", expected, actual)
+	}
+	return nil
+}
+
+// inList returns a parenthesized list of placeholders (for use with IN) for the given values, along
+// with the values as arguments for them
+func inList(values []string) (string, []interface{}) {
+	placeholders := make([]string, len(values))
+	args := make([]interface{}, len(values))
+	for i, value := range values {
+		placeholders[i] = "?"
+		args[i] = value
+	}
+	return "(" + strings.Join(placeholders, ", ") + ")", args
+}
+
+// nullableUnix returns the given time as a Unix timestamp, or nil if it is not set
+func nullableUnix(t *time.Time) interface{} {
+	if t == nil {
+		return nil
+	}
+	return t.Unix()
+}
+
+// nullableTime returns the time at the given (nullable) Unix timestamp
+func nullableTime(timestamp sql.NullInt64) *time.Time {
+	if !timestamp.Valid {
+		return nil
+	}
+	t := time.Unix(timestamp.Int64, 0)
+	return &t
+}
+
+// InsertComponent creates a new row in the components table with the given component information
+func (store *SQLiteStore) InsertComponent(component ComponentRecord) error {
+	_, err := store.exec(
+		insertComponent,
+		component.ID,
+		component.ComponentType,
+		component.ComponentPath,
+		component.SpecificationPath,
+		component.CreatedAt.Unix(),
+		component.CreatedBy,
+		component.SpecificationChecksum,
+		component.SpecificationSnapshot,
+	)
+	return err
+}
+
+// scanComponent reads a component record from a row selected using componentColumns
+func scanComponent(row rowScanner) (ComponentRecord, error) {
+	var component ComponentRecord
+	var createdAt int64
+	err := row.Scan(&component.ID, &component.ComponentType, &component.ComponentPath, &component.SpecificationPath, &createdAt, &component.CreatedBy, &component.SpecificationChecksum, &component.SpecificationSnapshot)
+	component.CreatedAt = time.Unix(createdAt, 0)
+	return component, err
+}
+
+// SelectComponent returns the component with the given ID, or ErrNotFound if there is none
+func (store *SQLiteStore) SelectComponent(id string) (ComponentRecord, error) {
+	component, err := scanComponent(store.db.QueryRow(selectComponentByID, id))
+	err = checkRowID(err, id, component.ID)
+	if err != nil {
+		return ComponentRecord{}, err
+	}
+	return component, nil
+}
+
+// UpdateComponent stores the type, directory, and specification path (along with the checksum and
+// snapshot of the specification) of the given component against its row, returning ErrNotFound if
+// there is no such row
+func (store *SQLiteStore) UpdateComponent(component ComponentRecord) error {
+	return store.update(updateComponent, component.ComponentType, component.ComponentPath, component.SpecificationPath, component.SpecificationChecksum, component.SpecificationSnapshot, component.ID)
+}
+
+// DeleteComponent removes the row for the component with the given ID from the components table
+func (store *SQLiteStore) DeleteComponent(id string) error {
+	_, err := store.exec(deleteComponentByID, id)
+	return err
+}
+
+// InsertBuild creates a new row in the builds table with the given build information
+func (store *SQLiteStore) InsertBuild(build BuildRecord) error {
+	_, err := store.exec(insertBuild, build.ID, build.ComponentID, build.CreatedAt.Unix(), build.CreatedBy, build.SourceHash, build.Target)
+	return err
+}
+
+// scanBuild reads a build record from a row selected using buildColumns
+func scanBuild(row rowScanner) (BuildRecord, error) {
+	var build BuildRecord
+	var createdAt int64
+	err := row.Scan(&build.ID, &build.ComponentID, &createdAt, &build.CreatedBy, &build.SourceHash, &build.Target)
+	build.CreatedAt = time.Unix(createdAt, 0)
+	return build, err
+}
+
+// SelectBuild returns the build with the given ID, or ErrNotFound if there is none
+func (store *SQLiteStore) SelectBuild(id string) (BuildRecord, error) {
+	build, err := scanBuild(store.db.QueryRow(selectBuildByID, id))
+	err = checkRowID(err, id, build.ID)
+	if err != nil {
+		return BuildRecord{}, err
+	}
+	return build, nil
+}
+
+// SelectMostRecentBuild returns the most recent build of the component with the given ID for the
+// given target (empty for builds of the stage given by the component specification), or
+// ErrNotFound if it has never been built for that target
+func (store *SQLiteStore) SelectMostRecentBuild(componentID, target string) (BuildRecord, error) {
+	build, err := scanBuild(store.db.QueryRow(selectMostRecentBuildForComponent, componentID, target))
+	if err == sql.ErrNoRows {
+		return BuildRecord{}, ErrNotFound
+	}
+	if err != nil {
+		return BuildRecord{}, err
+	}
+	if build.ComponentID != componentID {
+		return BuildRecord{}, fmt.Errorf("Result had unexpected component ID: expected=%s, actual=%s", componentID, build.ComponentID)
+	}
+	return build, nil
+}
+
+// InsertExecution creates a new row in the executions table with the given execution information
+func (store *SQLiteStore) InsertExecution(execution ExecutionRecord) error {
+	if execution.FlowID == "" {
+		_, err := store.exec(
+			insertExecutionWithNoFlowID,
+			execution.ID,
+			execution.BuildID,
+			execution.ComponentID,
+			execution.CreatedAt.Unix(),
+			execution.CreatedBy,
+		)
+		return err
+	}
+
+	var flowRunID, step, attempt, previousAttemptID interface{}
+	if execution.FlowRunID != "" {
+		flowRunID = execution.FlowRunID
+	}
+	if execution.Step != "" {
+		step = execution.Step
+	}
+	if execution.Attempt != 0 {
+		attempt = execution.Attempt
+	}
+	if execution.PreviousAttemptID != "" {
+		previousAttemptID = execution.PreviousAttemptID
+	}
+	_, err := store.exec(
+		insertExecution,
+		execution.ID,
+		execution.BuildID,
+		execution.ComponentID,
+		execution.CreatedAt.Unix(),
+		execution.FlowID,
+		flowRunID,
+		step,
+		execution.CreatedBy,
+		attempt,
+		previousAttemptID,
+	)
+	return err
+}
+
+// scanExecution reads an execution record from a row selected using executionColumns
+func scanExecution(row rowScanner) (ExecutionRecord, error) {
+	var execution ExecutionRecord
+	var createdAt int64
+	var exitCode, finishedAt sql.NullInt64
+	err := row.Scan(
+		&execution.ID,
+		&execution.BuildID,
+		&execution.ComponentID,
+		&createdAt,
+		&execution.FlowID,
+		&execution.FlowRunID,
+		&execution.Step,
+		&exitCode,
+		&execution.OOMKilled,
+		&execution.Error,
+		&finishedAt,
+		&execution.PeakMemoryBytes,
+		&execution.CPUSeconds,
+		&execution.IOReadBytes,
+		&execution.IOWriteBytes,
+		&execution.CreatedBy,
+		&execution.Attempt,
+		&execution.PreviousAttemptID,
+	)
+	if err != nil {
+		return ExecutionRecord{}, err
+	}
+
+	execution.CreatedAt = time.Unix(createdAt, 0)
+	if exitCode.Valid {
+		rowExitCode := int(exitCode.Int64)
+		execution.ExitCode = &rowExitCode
+	}
+	execution.FinishedAt = nullableTime(finishedAt)
+	return execution, nil
+}
+
+// selectExecutions returns the executions selected by the given query (which must select
+// executionColumns)
+func (store *SQLiteStore) selectExecutions(query string, args ...interface{}) ([]ExecutionRecord, error) {
+	rows, err := store.db.Query(query, args...)
+	if err != nil {
+		return []ExecutionRecord{}, err
+	}
+	defer rows.Close()
+
+	executions := []ExecutionRecord{}
+	for rows.Next() {
+		execution, err := scanExecution(rows)
+		if err != nil {
+			return executions, err
+		}
+		executions = append(executions, execution)
+	}
+	return executions, rows.Err()
+}
+
+// SelectExecution returns the execution with the given ID, or ErrNotFound if there is none
+func (store *SQLiteStore) SelectExecution(id string) (ExecutionRecord, error) {
+	execution, err := scanExecution(store.db.QueryRow(selectExecutionByID, id))
+	err = checkRowID(err, id, execution.ID)
+	if err != nil {
+		return ExecutionRecord{}, err
+	}
+	return execution, nil
+}
+
+// SelectExecutionsByFlowRun returns all the executions belonging to the flow run with the given
+// ID, in the order in which they were created
+func (store *SQLiteStore) SelectExecutionsByFlowRun(flowRunID string) ([]ExecutionRecord, error) {
+	return store.selectExecutions(selectExecutionsByFlowRunID, flowRunID)
+}
+
+// SelectSuccessfulExecutionsByFlow returns all the executions belonging to runs of the flow with
+// the given ID which finished with exit code 0, most recent first
+func (store *SQLiteStore) SelectSuccessfulExecutionsByFlow(flowID string) ([]ExecutionRecord, error) {
+	return store.selectExecutions(selectSuccessfulExecutionsByFlowID, flowID)
+}
+
+// UpdateExecutionResult stores the result members (exit code, OOM-killed flag, error message,
+// finish time, and resource usage) of the given execution against its row, returning ErrNotFound
+// if there is no such row
+func (store *SQLiteStore) UpdateExecutionResult(execution ExecutionRecord) error {
+	var exitCode interface{}
+	if execution.ExitCode != nil {
+		exitCode = *execution.ExitCode
+	}
+	return store.update(
+		updateExecutionResult,
+		exitCode,
+		execution.OOMKilled,
+		execution.Error,
+		nullableUnix(execution.FinishedAt),
+		execution.PeakMemoryBytes,
+		execution.CPUSeconds,
+		execution.IOReadBytes,
+		execution.IOWriteBytes,
+		execution.ID,
+	)
+}
+
+// InsertArtifact creates a new row in the artifacts table with the given artifact information
+func (store *SQLiteStore) InsertArtifact(artifact ArtifactRecord) error {
+	_, err := store.exec(insertArtifact, artifact.ID, artifact.ExecutionID, artifact.Name, artifact.ArtifactPath, artifact.CreatedAt.Unix())
+	return err
+}
+
+// InsertFlow creates a new row in the flows table with the given flow information
+func (store *SQLiteStore) InsertFlow(flow FlowRecord) error {
+	return store.RegisterFlow(flow, nil)
+}
+
+// RegisterFlow creates a new row in the flows table with the given flow information, along with a
+// row in the flow_components table for each of the given components, in a single transaction - if
+// any of the rows cannot be inserted, none of them are
+func (store *SQLiteStore) RegisterFlow(flow FlowRecord, components []FlowComponentRecord) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(insertFlow, flow.ID, flow.SpecificationPath, flow.CreatedAt.Unix(), flow.CreatedBy, flow.SpecificationChecksum, flow.SpecificationSnapshot)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	for _, component := range components {
+		if component.FlowID != flow.ID {
+			tx.Rollback()
+			return fmt.Errorf("Component of step (%s) belongs to a different flow: expected=%s, actual=%s", component.Step, flow.ID, component.FlowID)
+		}
+		_, err = tx.Exec(insertFlowComponent, component.FlowID, component.Step, component.ComponentID)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// SelectFlowComponents returns the components used by the steps of the flow with the given ID, in
+// lexicographic order of the steps
+func (store *SQLiteStore) SelectFlowComponents(flowID string) ([]FlowComponentRecord, error) {
+	rows, err := store.db.Query(selectFlowComponentsByFlowID, flowID)
+	if err != nil {
+		return []FlowComponentRecord{}, err
+	}
+	defer rows.Close()
+
+	flowComponents := []FlowComponentRecord{}
+	for rows.Next() {
+		var component FlowComponentRecord
+		err = rows.Scan(&component.FlowID, &component.Step, &component.ComponentID)
+		if err != nil {
+			return flowComponents, err
+		}
+		flowComponents = append(flowComponents, component)
+	}
+	return flowComponents, rows.Err()
+}
+
+// UpdateFlow stores the specification path, checksum, and snapshot of the given flow against its
+// row, and replaces the rows in the flow_components table for the flow with the given components,
+// in a single transaction. It returns ErrNotFound if there is no row for the flow.
+func (store *SQLiteStore) UpdateFlow(flow FlowRecord, components []FlowComponentRecord) error {
+	tx, err := store.db.Begin()
+	if err != nil {
+		return err
+	}
+	result, err := tx.Exec(updateFlow, flow.SpecificationPath, flow.SpecificationChecksum, flow.SpecificationSnapshot, flow.ID)
+	if err == nil {
+		var rowsAffected int64
+		rowsAffected, err = result.RowsAffected()
+		if err == nil && rowsAffected == 0 {
+			err = ErrNotFound
+		}
+	}
+	if err == nil {
+		_, err = tx.Exec(deleteFlowComponentsByFlowID, flow.ID)
+	}
+	for _, component := range components {
+		if err != nil {
+			break
+		}
+		_, err = tx.Exec(insertFlowComponent, flow.ID, component.Step, component.ComponentID)
+	}
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// scanFlow reads a flow record from a row selected using flowColumns
+func scanFlow(row rowScanner) (FlowRecord, error) {
+	var flow FlowRecord
+	var createdAt int64
+	err := row.Scan(&flow.ID, &flow.SpecificationPath, &createdAt, &flow.CreatedBy, &flow.SpecificationChecksum, &flow.SpecificationSnapshot)
+	flow.CreatedAt = time.Unix(createdAt, 0)
+	return flow, err
+}
+
+// SelectFlow returns the flow with the given ID, or ErrNotFound if there is none
+func (store *SQLiteStore) SelectFlow(id string) (FlowRecord, error) {
+	flow, err := scanFlow(store.db.QueryRow(selectFlowByID, id))
+	err = checkRowID(err, id, flow.ID)
+	if err != nil {
+		return FlowRecord{}, err
+	}
+	return flow, nil
+}
+
+// InsertFlowRun creates a new row in the flow_runs table with the given flow run information
+func (store *SQLiteStore) InsertFlowRun(run FlowRunRecord) error {
+	_, err := store.exec(insertFlowRun, run.ID, run.FlowID, run.Status, run.CreatedAt.Unix(), run.Priority)
+	return err
+}
+
+// scanFlowRun reads a flow run record from a row selected using flowRunColumns
+func scanFlowRun(row rowScanner) (FlowRunRecord, error) {
+	var run FlowRunRecord
+	var createdAt int64
+	var finishedAt sql.NullInt64
+	err := row.Scan(&run.ID, &run.FlowID, &run.Status, &createdAt, &finishedAt, &run.Priority)
+	if err != nil {
+		return FlowRunRecord{}, err
+	}
+	run.CreatedAt = time.Unix(createdAt, 0)
+	run.FinishedAt = nullableTime(finishedAt)
+	return run, nil
+}
+
+// scanFlowRuns reads flow run records from all the rows selected using flowRunColumns, and closes
+// the rows
+func scanFlowRuns(rows *sql.Rows) ([]FlowRunRecord, error) {
+	defer rows.Close()
+	runs := []FlowRunRecord{}
+	for rows.Next() {
+		run, err := scanFlowRun(rows)
+		if err != nil {
+			return runs, err
+		}
+		runs = append(runs, run)
+	}
+	return runs, rows.Err()
+}
+
+// SelectFlowRun returns the flow run with the given ID, or ErrNotFound if there is none
+func (store *SQLiteStore) SelectFlowRun(id string) (FlowRunRecord, error) {
+	run, err := scanFlowRun(store.db.QueryRow(selectFlowRunByID, id))
+	err = checkRowID(err, id, run.ID)
+	if err != nil {
+		return FlowRunRecord{}, err
+	}
+	return run, nil
+}
+
+// SelectFlowRunsByFlow returns (at most limit of) the most recent runs of the flow with the given
+// ID, most recent first
+func (store *SQLiteStore) SelectFlowRunsByFlow(flowID string, limit int) ([]FlowRunRecord, error) {
+	rows, err := store.db.Query(selectFlowRunsByFlowID, flowID, limit)
+	if err != nil {
+		return []FlowRunRecord{}, err
+	}
+	return scanFlowRuns(rows)
+}
+
+// UpdateFlowRunStatus stores the status and finish time of the given flow run against its row,
+// returning ErrNotFound if there is no such row
+func (store *SQLiteStore) UpdateFlowRunStatus(run FlowRunRecord) error {
+	return store.update(updateFlowRunStatus, run.Status, nullableUnix(run.FinishedAt), run.ID)
+}
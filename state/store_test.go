@@ -0,0 +1,273 @@
+package state
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestSQLiteStore(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-store-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	db, err := sql.Open("sqlite3", path.Join(stateDir, DBFileName))
+	if err != nil {
+		t.Fatalf("Error opening state database file: %s", err.Error())
+	}
+	defer db.Close()
+
+	var store Store = NewSQLiteStore(db)
+	createdAt := time.Unix(time.Now().Unix(), 0)
+
+	component := ComponentRecord{ID: "component", ComponentType: "task", ComponentPath: "/components/component", SpecificationPath: "/components/component/component.json", CreatedAt: createdAt, CreatedBy: "tester"}
+	err = store.InsertComponent(component)
+	if err != nil {
+		t.Fatalf("Could not insert component: %s", err.Error())
+	}
+	selectedComponent, err := store.SelectComponent(component.ID)
+	if err != nil || !reflect.DeepEqual(selectedComponent, component) {
+		t.Errorf("Unexpected component: expected=%v, actual=%v, err=%v", component, selectedComponent, err)
+	}
+
+	builds := []BuildRecord{
+		{ID: "build-1", ComponentID: component.ID, CreatedAt: createdAt, CreatedBy: "tester"},
+		{ID: "build-2", ComponentID: component.ID, CreatedAt: createdAt.Add(time.Second), CreatedBy: "tester", SourceHash: "abc123"},
+		{ID: "build-3", ComponentID: component.ID, CreatedAt: createdAt.Add(2 * time.Second), CreatedBy: "tester", Target: "test"},
+	}
+	for _, build := range builds {
+		err = store.InsertBuild(build)
+		if err != nil {
+			t.Fatalf("Could not insert build (%s): %s", build.ID, err.Error())
+		}
+	}
+	mostRecentBuild, err := store.SelectMostRecentBuild(component.ID, "")
+	if err != nil || !reflect.DeepEqual(mostRecentBuild, builds[1]) {
+		t.Errorf("Unexpected most recent build: expected=%v, actual=%v, err=%v", builds[1], mostRecentBuild, err)
+	}
+	mostRecentBuild, err = store.SelectMostRecentBuild(component.ID, "test")
+	if err != nil || !reflect.DeepEqual(mostRecentBuild, builds[2]) {
+		t.Errorf("Unexpected most recent build for target: expected=%v, actual=%v, err=%v", builds[2], mostRecentBuild, err)
+	}
+
+	flow := FlowRecord{ID: "flow", SpecificationPath: "/flows/flow.json", CreatedAt: createdAt, CreatedBy: "tester"}
+	err = store.InsertFlow(flow)
+	if err != nil {
+		t.Fatalf("Could not insert flow: %s", err.Error())
+	}
+	registeredFlow := FlowRecord{ID: "registered", SpecificationPath: "/flows/registered.json", CreatedAt: createdAt, CreatedBy: "tester", SpecificationChecksum: "abc123"}
+	flowComponents := []FlowComponentRecord{{FlowID: registeredFlow.ID, Step: "extract", ComponentID: component.ID}, {FlowID: registeredFlow.ID, Step: "load", ComponentID: component.ID}}
+	err = store.RegisterFlow(registeredFlow, flowComponents)
+	if err != nil {
+		t.Fatalf("Could not register flow: %s", err.Error())
+	}
+	selectedFlow, err := store.SelectFlow(registeredFlow.ID)
+	if err != nil || !reflect.DeepEqual(selectedFlow, registeredFlow) {
+		t.Errorf("Unexpected registered flow: expected=%v, actual=%v, err=%v", registeredFlow, selectedFlow, err)
+	}
+	selectedFlowComponents, err := store.SelectFlowComponents(registeredFlow.ID)
+	if err != nil || !reflect.DeepEqual(selectedFlowComponents, flowComponents) {
+		t.Errorf("Unexpected flow components: expected=%v, actual=%v, err=%v", flowComponents, selectedFlowComponents, err)
+	}
+
+	// A registration which fails part of the way through leaves nothing behind
+	partialFlow := FlowRecord{ID: "partial", SpecificationPath: "/flows/partial.json", CreatedAt: createdAt}
+	err = store.RegisterFlow(partialFlow, []FlowComponentRecord{{FlowID: partialFlow.ID, Step: "extract", ComponentID: component.ID}, {FlowID: partialFlow.ID, Step: "extract", ComponentID: component.ID}})
+	if err == nil {
+		t.Error("Expected error registering flow with duplicate steps")
+	}
+	_, err = store.SelectFlow(partialFlow.ID)
+	if err != ErrNotFound {
+		t.Errorf("Expected partially registered flow to be rolled back, got: %v", err)
+	}
+	partialFlowComponents, err := store.SelectFlowComponents(partialFlow.ID)
+	if err != nil || len(partialFlowComponents) != 0 {
+		t.Errorf("Expected components of partially registered flow to be rolled back: %v, err=%v", partialFlowComponents, err)
+	}
+
+	run := FlowRunRecord{ID: "run", FlowID: flow.ID, Status: "running", CreatedAt: createdAt, Priority: 2}
+	err = store.InsertFlowRun(run)
+	if err != nil {
+		t.Fatalf("Could not insert flow run: %s", err.Error())
+	}
+	finishedAt := createdAt.Add(time.Minute)
+	run.Status = "succeeded"
+	run.FinishedAt = &finishedAt
+	err = store.UpdateFlowRunStatus(run)
+	if err != nil {
+		t.Fatalf("Could not update flow run: %s", err.Error())
+	}
+	runs, err := store.SelectFlowRunsByFlow(flow.ID, 10)
+	if err != nil || !reflect.DeepEqual(runs, []FlowRunRecord{run}) {
+		t.Errorf("Unexpected flow runs: expected=%v, actual=%v, err=%v", []FlowRunRecord{run}, runs, err)
+	}
+
+	execution := ExecutionRecord{ID: "execution", BuildID: builds[1].ID, ComponentID: component.ID, CreatedAt: createdAt, CreatedBy: "tester", FlowID: flow.ID, FlowRunID: run.ID, Step: "step", Attempt: 2, PreviousAttemptID: "failed-execution"}
+	err = store.InsertExecution(execution)
+	if err != nil {
+		t.Fatalf("Could not insert execution: %s", err.Error())
+	}
+	exitCode := 0
+	execution.ExitCode = &exitCode
+	execution.FinishedAt = &finishedAt
+	execution.PeakMemoryBytes = 1024
+	execution.CPUSeconds = 1.5
+	err = store.UpdateExecutionResult(execution)
+	if err != nil {
+		t.Fatalf("Could not update execution result: %s", err.Error())
+	}
+	successfulExecutions, err := store.SelectSuccessfulExecutionsByFlow(flow.ID)
+	if err != nil || !reflect.DeepEqual(successfulExecutions, []ExecutionRecord{execution}) {
+		t.Errorf("Unexpected successful executions: expected=%v, actual=%v, err=%v", []ExecutionRecord{execution}, successfulExecutions, err)
+	}
+
+	err = store.DeleteComponent(component.ID)
+	if err != nil {
+		t.Fatalf("Could not delete component: %s", err.Error())
+	}
+
+	notFoundErrors := []error{}
+	_, err = store.SelectComponent(component.ID)
+	notFoundErrors = append(notFoundErrors, err)
+	_, err = store.SelectBuild("missing")
+	notFoundErrors = append(notFoundErrors, err)
+	_, err = store.SelectMostRecentBuild("missing", "")
+	notFoundErrors = append(notFoundErrors, err)
+	_, err = store.SelectExecution("missing")
+	notFoundErrors = append(notFoundErrors, err)
+	_, err = store.SelectFlow("missing")
+	notFoundErrors = append(notFoundErrors, err)
+	_, err = store.SelectFlowRun("missing")
+	notFoundErrors = append(notFoundErrors, err)
+	notFoundErrors = append(notFoundErrors, store.UpdateExecutionResult(ExecutionRecord{ID: "missing"}))
+	notFoundErrors = append(notFoundErrors, store.UpdateFlowRunStatus(FlowRunRecord{ID: "missing"}))
+	for i, err := range notFoundErrors {
+		if err != ErrNotFound {
+			t.Errorf("[Test %d] Expected ErrNotFound, got: %v", i, err)
+		}
+	}
+}
+
+func TestSQLiteStoreRunCoordination(t *testing.T) {
+	stateDir, err := ioutil.TempDir("", "shnorky-store-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	os.RemoveAll(stateDir)
+
+	err = Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", stateDir)
+	}
+	defer os.RemoveAll(stateDir)
+
+	db, err := sql.Open("sqlite3", path.Join(stateDir, DBFileName))
+	if err != nil {
+		t.Fatalf("Error opening state database file: %s", err.Error())
+	}
+	defer db.Close()
+
+	var store Store = NewSQLiteStore(db)
+	createdAt := time.Unix(time.Now().Unix(), 0)
+	unfinished := []string{"queued", "running"}
+
+	first := FlowRunRecord{ID: "first", FlowID: "flow", Status: "queued", CreatedAt: createdAt}
+	second := FlowRunRecord{ID: "second", FlowID: "flow", Status: "queued", CreatedAt: createdAt.Add(time.Second), Priority: 1}
+	for _, run := range []FlowRunRecord{first, second} {
+		inserted, err := store.InsertFlowRunWithinQuota(run, unfinished, 2)
+		if err != nil || !inserted {
+			t.Fatalf("Could not insert flow run (%s) within quota: inserted=%t, err=%v", run.ID, inserted, err)
+		}
+	}
+	inserted, err := store.InsertFlowRunWithinQuota(FlowRunRecord{ID: "third", FlowID: "flow", Status: "queued", CreatedAt: createdAt}, unfinished, 2)
+	if err != nil || inserted {
+		t.Errorf("Expected flow run beyond quota not to be inserted: inserted=%t, err=%v", inserted, err)
+	}
+
+	queued, err := store.SelectQueuedFlowRuns([]string{"queued"})
+	if err != nil || len(queued) != 2 || queued[0].ID != second.ID {
+		t.Errorf("Unexpected queue (expected the higher priority run first): %v, err=%v", queued, err)
+	}
+
+	started, err := store.StartFlowRun(second.ID, "queued", "running", []string{"running"}, 1)
+	if err != nil || !started {
+		t.Fatalf("Could not start flow run: started=%t, err=%v", started, err)
+	}
+	started, err = store.StartFlowRun(first.ID, "queued", "running", []string{"running"}, 1)
+	if err != nil || started {
+		t.Errorf("Expected flow run not to start while no slot was free: started=%t, err=%v", started, err)
+	}
+	active, err := store.CountUnfinishedFlowRuns([]string{"running"})
+	if err != nil || active != 1 {
+		t.Errorf("Unexpected number of active runs: expected=1, actual=%d, err=%v", active, err)
+	}
+
+	conflicts, err := store.ClaimRunResources(second.ID, []RunResourceRecord{{FlowRunID: second.ID, Kind: "mount", Name: "/data"}})
+	if err != nil || len(conflicts) != 0 {
+		t.Fatalf("Could not claim resources: conflicts=%v, err=%v", conflicts, err)
+	}
+	claim := []RunResourceRecord{{FlowRunID: first.ID, Kind: "mount", Name: "/data"}, {FlowRunID: first.ID, Kind: "mount", Name: "/other"}}
+	conflicts, err = store.ClaimRunResources(first.ID, claim)
+	expectedConflicts := []RunResourceRecord{{FlowRunID: second.ID, Kind: "mount", Name: "/data"}}
+	if err != nil || !reflect.DeepEqual(conflicts, expectedConflicts) {
+		t.Errorf("Unexpected conflicts: expected=%v, actual=%v, err=%v", expectedConflicts, conflicts, err)
+	}
+	using, err := store.CountUnfinishedFlowRunsUsing("", "mount", "/other")
+	if err != nil || using != 0 {
+		t.Errorf("Expected conflicting claim to be rolled back: using=%d, err=%v", using, err)
+	}
+
+	approval := ApprovalRecord{ExecutionID: "gate-execution", FlowRunID: second.ID, Step: "review", Status: "pending", RequestedAt: createdAt}
+	err = store.InsertApproval(approval)
+	if err != nil {
+		t.Fatalf("Could not insert approval: %s", err.Error())
+	}
+	decidedAt := createdAt.Add(time.Minute)
+	decision := ApprovalRecord{FlowRunID: second.ID, Step: "review", Status: "approved", DecidedAt: &decidedAt, DecidedBy: "reviewer", Comment: "Looks good"}
+	err = store.DecideApproval(decision, "pending")
+	if err != nil {
+		t.Fatalf("Could not decide approval: %s", err.Error())
+	}
+	err = store.DecideApproval(decision, "pending")
+	if err != ErrNotFound {
+		t.Errorf("Expected ErrNotFound deciding an approval twice, got: %v", err)
+	}
+	approval.Status = decision.Status
+	approval.DecidedAt = decision.DecidedAt
+	approval.DecidedBy = decision.DecidedBy
+	approval.Comment = decision.Comment
+	selectedApproval, err := store.SelectApproval(approval.ExecutionID)
+	if err != nil || !reflect.DeepEqual(selectedApproval, approval) {
+		t.Errorf("Unexpected approval: expected=%v, actual=%v, err=%v", approval, selectedApproval, err)
+	}
+
+	labels := map[string]string{"team": "data", "tier": "gold"}
+	err = store.SetLabels(LabelledFlow, "flow", labels)
+	if err != nil {
+		t.Fatalf("Could not set labels: %s", err.Error())
+	}
+	selectedLabels, err := store.SelectLabels(LabelledFlow, "flow")
+	if err != nil || !reflect.DeepEqual(selectedLabels, labels) {
+		t.Errorf("Unexpected labels: expected=%v, actual=%v, err=%v", labels, selectedLabels, err)
+	}
+	err = store.DeleteLabels(LabelledFlow, "flow")
+	if err != nil {
+		t.Fatalf("Could not delete labels: %s", err.Error())
+	}
+	selectedLabels, err = store.SelectLabels(LabelledFlow, "flow")
+	if err != nil || len(selectedLabels) != 0 {
+		t.Errorf("Expected labels to be deleted: %v, err=%v", selectedLabels, err)
+	}
+}
@@ -0,0 +1,59 @@
+package state
+
+import (
+	"database/sql"
+	"time"
+)
+
+// SQL statements
+var insertToken = "INSERT INTO api_tokens (id, token_hash, role, description, created_at, created_by) VALUES(?, ?, ?, ?, ?, ?);"
+var selectTokens = "SELECT id, token_hash, role, IFNULL(description, ''), created_at, IFNULL(created_by, ''), revoked_at FROM api_tokens ORDER BY created_at;"
+var selectActiveTokenRoleByHash = "SELECT role FROM api_tokens WHERE token_hash=? AND revoked_at IS NULL;"
+var revokeTokenByID = "UPDATE api_tokens SET revoked_at=? WHERE id=? AND revoked_at IS NULL;"
+
+// InsertToken creates a new row in the api_tokens table with the given token information
+func (store *SQLiteStore) InsertToken(token TokenRecord) error {
+	_, err := store.exec(insertToken, token.ID, token.TokenHash, token.Role, token.Description, token.CreatedAt.Unix(), token.CreatedBy)
+	return err
+}
+
+// SelectTokens returns all the API tokens (including revoked ones), oldest first
+func (store *SQLiteStore) SelectTokens() ([]TokenRecord, error) {
+	rows, err := store.db.Query(selectTokens)
+	if err != nil {
+		return []TokenRecord{}, err
+	}
+	defer rows.Close()
+
+	tokens := []TokenRecord{}
+	for rows.Next() {
+		var token TokenRecord
+		var createdAt int64
+		var revokedAt sql.NullInt64
+		err = rows.Scan(&token.ID, &token.TokenHash, &token.Role, &token.Description, &createdAt, &token.CreatedBy, &revokedAt)
+		if err != nil {
+			return tokens, err
+		}
+		token.CreatedAt = time.Unix(createdAt, 0)
+		token.RevokedAt = nullableTime(revokedAt)
+		tokens = append(tokens, token)
+	}
+	return tokens, rows.Err()
+}
+
+// SelectActiveTokenRole returns the role of the unrevoked API token with the given hash, or
+// ErrNotFound if there is no such token
+func (store *SQLiteStore) SelectActiveTokenRole(tokenHash string) (string, error) {
+	var role string
+	err := store.db.QueryRow(selectActiveTokenRoleByHash, tokenHash).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", ErrNotFound
+	}
+	return role, err
+}
+
+// RevokeToken records the given time as the revocation time of the API token with the given ID. It
+// returns ErrNotFound if there is no unrevoked token with that ID.
+func (store *SQLiteStore) RevokeToken(id string, revokedAt time.Time) error {
+	return store.update(revokeTokenByID, revokedAt.Unix(), id)
+}
@@ -0,0 +1,21 @@
+package state
+
+import (
+	"os"
+	"os/user"
+)
+
+// CurrentUser returns the name of the user running shnorky. Components, builds, flows, and
+// executions record the user who created them so that several people can share a state directory.
+// If the user cannot be determined, CurrentUser falls back to the USER (or, on Windows, USERNAME)
+// environment variable, and returns the empty string if that is not set either.
+func CurrentUser() string {
+	currentUser, err := user.Current()
+	if err == nil && currentUser.Username != "" {
+		return currentUser.Username
+	}
+	if username := os.Getenv("USER"); username != "" {
+		return username
+	}
+	return os.Getenv("USERNAME")
+}
@@ -0,0 +1,243 @@
+package tracing
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultServiceName is the service name that spans are reported under if the OTEL_SERVICE_NAME
+// environment variable is not set
+var DefaultServiceName = "shnorky"
+
+// OTLPProtocolJSON is the only OTLP protocol (OTEL_EXPORTER_OTLP_PROTOCOL) that OTLPExporter
+// supports
+var OTLPProtocolJSON = "http/json"
+
+// OTLPTracesPath is appended to OTEL_EXPORTER_OTLP_ENDPOINT to form the URL spans are exported to
+var OTLPTracesPath = "/v1/traces"
+
+// OTLPExportTimeout is the maximum amount of time that an export request may take
+var OTLPExportTimeout = 10 * time.Second
+
+// OTLPExporter - exports spans to an OpenTelemetry collector (or a backend which accepts OTLP
+// directly, like Jaeger or Tempo) using OTLP over HTTP with JSON encoding
+type OTLPExporter struct {
+	// URL is the URL that spans are posted to (e.g. "http://localhost:4318/v1/traces")
+	URL string
+	// Headers are added to every export request (e.g. for authentication)
+	Headers     map[string]string
+	ServiceName string
+	Client      *http.Client
+}
+
+// NewOTLPExporterFromEnv creates an OTLPExporter configured by the standard OpenTelemetry
+// environment variables:
+// + OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (the URL spans are posted to) or OTEL_EXPORTER_OTLP_ENDPOINT
+// (the base URL of the collector, to which OTLPTracesPath is appended)
+// + OTEL_EXPORTER_OTLP_HEADERS (e.g. "authorization=Bearer%20token,x-scope-orgid=team")
+// + OTEL_EXPORTER_OTLP_PROTOCOL (must be "http/json" if it is set)
+// + OTEL_SERVICE_NAME
+// It returns nil (meaning that tracing stays disabled) if no endpoint is set, if
+// OTEL_SDK_DISABLED is "true", or if OTEL_TRACES_EXPORTER is "none".
+func NewOTLPExporterFromEnv() (*OTLPExporter, error) {
+	if strings.EqualFold(os.Getenv("OTEL_SDK_DISABLED"), "true") || os.Getenv("OTEL_TRACES_EXPORTER") == "none" {
+		return nil, nil
+	}
+
+	exportURL := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if exportURL == "" {
+		endpoint := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if endpoint == "" {
+			return nil, nil
+		}
+		exportURL = strings.TrimSuffix(endpoint, "/") + OTLPTracesPath
+	}
+
+	protocol := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_PROTOCOL")
+	if protocol == "" {
+		protocol = os.Getenv("OTEL_EXPORTER_OTLP_PROTOCOL")
+	}
+	if protocol != "" && protocol != OTLPProtocolJSON {
+		return nil, fmt.Errorf("Unsupported OTLP protocol: %s. Only %s is supported", protocol, OTLPProtocolJSON)
+	}
+
+	headers, err := parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"))
+	if err != nil {
+		return nil, err
+	}
+
+	serviceName := os.Getenv("OTEL_SERVICE_NAME")
+	if serviceName == "" {
+		serviceName = DefaultServiceName
+	}
+
+	return &OTLPExporter{
+		URL:         exportURL,
+		Headers:     headers,
+		ServiceName: serviceName,
+		Client:      &http.Client{Timeout: OTLPExportTimeout},
+	}, nil
+}
+
+// parseOTLPHeaders parses the value of OTEL_EXPORTER_OTLP_HEADERS: a comma-separated list of
+// "key=value" pairs, whose values are URL-encoded
+func parseOTLPHeaders(rawHeaders string) (map[string]string, error) {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(rawHeaders, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		separator := strings.Index(pair, "=")
+		if separator <= 0 {
+			return headers, fmt.Errorf("Invalid OTLP header (%s): must be of the form key=value", pair)
+		}
+		value, err := url.QueryUnescape(strings.TrimSpace(pair[separator+1:]))
+		if err != nil {
+			return headers, fmt.Errorf("Invalid OTLP header (%s): %w", pair, err)
+		}
+		headers[strings.TrimSpace(pair[:separator])] = value
+	}
+	return headers, nil
+}
+
+// ExportSpans posts the given spans to the exporter's URL
+func (exporter *OTLPExporter) ExportSpans(spans []*Span) error {
+	body, err := json.Marshal(otlpRequest(exporter.ServiceName, spans))
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequest(http.MethodPost, exporter.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	for key, value := range exporter.Headers {
+		request.Header.Set(key, value)
+	}
+
+	response, err := exporter.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("Error exporting spans to %s: %w", exporter.URL, err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode >= 300 {
+		message, _ := ioutil.ReadAll(io.LimitReader(response.Body, 1024))
+		return fmt.Errorf("Error exporting spans to %s: %s: %s", exporter.URL, response.Status, strings.TrimSpace(string(message)))
+	}
+	return nil
+}
+
+// The following types mirror the JSON encoding of the OTLP ExportTraceServiceRequest message (in
+// which trace and span IDs are hex-encoded and timestamps are decimal strings)
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpExportRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+// OTLP span kind and status codes
+var (
+	otlpSpanKindInternal = 1
+	otlpStatusCodeOK     = 1
+	otlpStatusCodeError  = 2
+)
+
+// otlpRequest builds the export request for the given spans, reported under the given service name
+func otlpRequest(serviceName string, spans []*Span) otlpExportRequest {
+	otlpSpans := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		span.mutex.Lock()
+		otlpSpans[i] = otlpSpan{
+			TraceID:           span.TraceID,
+			SpanID:            span.SpanID,
+			ParentSpanID:      span.ParentSpanID,
+			Name:              span.Name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(span.StartTime.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.EndTime.UnixNano(), 10),
+			Attributes:        otlpAttributes(span.Attributes),
+			Status:            otlpStatus{Code: otlpStatusCodeOK},
+		}
+		if span.Error != "" {
+			otlpSpans[i].Status = otlpStatus{Code: otlpStatusCodeError, Message: span.Error}
+		}
+		span.mutex.Unlock()
+	}
+
+	return otlpExportRequest{
+		ResourceSpans: []otlpResourceSpans{
+			{
+				Resource:   otlpResource{Attributes: otlpAttributes(map[string]string{"service.name": serviceName})},
+				ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: DefaultServiceName}, Spans: otlpSpans}},
+			},
+		},
+	}
+}
+
+// otlpAttributes converts the given attributes to OTLP key-value pairs, ordered by key
+func otlpAttributes(attributes map[string]string) []otlpKeyValue {
+	keys := make([]string, 0, len(attributes))
+	for key := range attributes {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	keyValues := make([]otlpKeyValue, len(keys))
+	for i, key := range keys {
+		keyValues[i] = otlpKeyValue{Key: key, Value: otlpValue{StringValue: attributes[key]}}
+	}
+	return keyValues
+}
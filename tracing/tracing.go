@@ -0,0 +1,146 @@
+// Package tracing records the builds and flow runs performed by shnorky as trace spans (one per
+// build, flow run, stage, step, and execution) and exports them to OpenTelemetry-compatible
+// backends (e.g. Jaeger or Tempo), so that the performance of pipelines can be analyzed. Tracing is
+// disabled unless an Exporter is set.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// SpanExporter - sends finished spans to a tracing backend
+type SpanExporter interface {
+	ExportSpans(spans []*Span) error
+}
+
+// Exporter is the exporter to which finished spans are sent. If it is nil, tracing is disabled and
+// Start returns nil spans.
+var Exporter SpanExporter
+
+// ErrorHandler is called with the errors returned by Exporter when spans are exported as they
+// finish. If it is nil, those errors are ignored - tracing never causes a build or run to fail.
+var ErrorHandler func(error)
+
+// MaxBatchSize is the number of finished spans which are buffered before they are exported. Spans
+// are also exported as soon as the root span of their trace finishes, and when Flush is called.
+var MaxBatchSize = 64
+
+var pendingSpans []*Span
+var pendingSpansMutex sync.Mutex
+
+// Span - a timed operation within a trace. Methods on a nil span do nothing, so that code can be
+// instrumented whether or not tracing is enabled.
+type Span struct {
+	// TraceID, SpanID, and ParentSpanID are hex-encoded. ParentSpanID is empty for the root span of
+	// a trace.
+	TraceID      string
+	SpanID       string
+	ParentSpanID string
+	Name         string
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]string
+	// Error is the error that the operation failed with, if it failed
+	Error string
+
+	mutex sync.Mutex
+}
+
+type spanKey struct{}
+
+// Start starts a span with the given name and attributes, as a child of the span carried by the
+// given context (if any), and returns a copy of the context which carries the new span. If tracing
+// is disabled, the context is returned unchanged along with a nil span.
+func Start(ctx context.Context, name string, attributes map[string]string) (context.Context, *Span) {
+	if Exporter == nil {
+		return ctx, nil
+	}
+
+	span := &Span{
+		SpanID:     randomID(8),
+		Name:       name,
+		StartTime:  time.Now(),
+		Attributes: map[string]string{},
+	}
+	for key, value := range attributes {
+		span.Attributes[key] = value
+	}
+	if parent := FromContext(ctx); parent != nil {
+		span.TraceID = parent.TraceID
+		span.ParentSpanID = parent.SpanID
+	} else {
+		span.TraceID = randomID(16)
+	}
+
+	return context.WithValue(ctx, spanKey{}, span), span
+}
+
+// FromContext returns the span carried by the given context, or nil if it does not carry one
+func FromContext(ctx context.Context) *Span {
+	span, _ := ctx.Value(spanKey{}).(*Span)
+	return span
+}
+
+// SetAttribute sets an attribute of the span
+func (span *Span) SetAttribute(key, value string) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	defer span.mutex.Unlock()
+	span.Attributes[key] = value
+}
+
+// End finishes the span, recording the given error (if it is not nil) as the reason the operation
+// failed, and queues it for export. Ending a span more than once has no effect.
+func (span *Span) End(err error) {
+	if span == nil {
+		return
+	}
+	span.mutex.Lock()
+	if !span.EndTime.IsZero() {
+		span.mutex.Unlock()
+		return
+	}
+	span.EndTime = time.Now()
+	if err != nil {
+		span.Error = err.Error()
+	}
+	span.mutex.Unlock()
+
+	pendingSpansMutex.Lock()
+	pendingSpans = append(pendingSpans, span)
+	flush := span.ParentSpanID == "" || len(pendingSpans) >= MaxBatchSize
+	pendingSpansMutex.Unlock()
+
+	if flush {
+		err := Flush()
+		if err != nil && ErrorHandler != nil {
+			ErrorHandler(err)
+		}
+	}
+}
+
+// Flush exports the finished spans which have not been exported yet
+func Flush() error {
+	pendingSpansMutex.Lock()
+	spans := pendingSpans
+	pendingSpans = nil
+	pendingSpansMutex.Unlock()
+
+	if len(spans) == 0 || Exporter == nil {
+		return nil
+	}
+	return Exporter.ExportSpans(spans)
+}
+
+// randomID returns a random hex-encoded identifier of the given number of bytes
+func randomID(size int) string {
+	id := make([]byte, size)
+	rand.Read(id)
+	return hex.EncodeToString(id)
+}
@@ -0,0 +1,164 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+type recordingExporter struct {
+	batches [][]*Span
+}
+
+func (exporter *recordingExporter) ExportSpans(spans []*Span) error {
+	exporter.batches = append(exporter.batches, spans)
+	return nil
+}
+
+func TestSpans(t *testing.T) {
+	ctx, span := Start(context.Background(), "disabled", nil)
+	if span != nil || FromContext(ctx) != nil {
+		t.Fatalf("Expected no span when tracing is disabled")
+	}
+	span.SetAttribute("key", "value")
+	span.End(nil)
+
+	exporter := &recordingExporter{}
+	Exporter = exporter
+	defer func() { Exporter = nil }()
+
+	runCtx, runSpan := Start(context.Background(), "flow_run", map[string]string{"flow_id": "flow"})
+	_, stepSpan := Start(runCtx, "step", map[string]string{"step": "a"})
+	stepSpan.End(errors.New("failed"))
+	stepSpan.End(nil)
+	if len(exporter.batches) != 0 {
+		t.Fatalf("Spans were exported before the root span ended")
+	}
+	runSpan.SetAttribute("status", "failed")
+	runSpan.End(nil)
+
+	if len(exporter.batches) != 1 || len(exporter.batches[0]) != 2 {
+		t.Fatalf("Unexpected export batches: %v", exporter.batches)
+	}
+	if stepSpan.TraceID != runSpan.TraceID || stepSpan.ParentSpanID != runSpan.SpanID || runSpan.ParentSpanID != "" {
+		t.Errorf("Step span is not a child of the run span: run=%+v, step=%+v", runSpan, stepSpan)
+	}
+	if len(runSpan.TraceID) != 32 || len(runSpan.SpanID) != 16 {
+		t.Errorf("Unexpected ID lengths: trace=%s, span=%s", runSpan.TraceID, runSpan.SpanID)
+	}
+	if stepSpan.Error != "failed" {
+		t.Errorf("Unexpected step span error: %s", stepSpan.Error)
+	}
+	expectedAttributes := map[string]string{"flow_id": "flow", "status": "failed"}
+	if !reflect.DeepEqual(runSpan.Attributes, expectedAttributes) {
+		t.Errorf("Unexpected run span attributes: expected=%v, actual=%v", expectedAttributes, runSpan.Attributes)
+	}
+}
+
+func TestOTLPExporter(t *testing.T) {
+	var received otlpExportRequest
+	var authorization string
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		body, _ := ioutil.ReadAll(r.Body)
+		if r.URL.Path != OTLPTracesPath || json.Unmarshal(body, &received) != nil {
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer collector.Close()
+
+	os.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL+"/")
+	os.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "Authorization=Bearer%20token")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+	defer os.Unsetenv("OTEL_EXPORTER_OTLP_HEADERS")
+
+	exporter, err := NewOTLPExporterFromEnv()
+	if err != nil {
+		t.Fatalf("Could not create exporter: %s", err.Error())
+	}
+	if exporter == nil {
+		t.Fatalf("Expected an exporter when an endpoint is set")
+	}
+
+	Exporter = exporter
+	defer func() { Exporter = nil }()
+	_, span := Start(context.Background(), "build", map[string]string{"component_id": "component"})
+	span.End(errors.New("build failed"))
+
+	if authorization != "Bearer token" {
+		t.Errorf("Unexpected authorization header: %s", authorization)
+	}
+	if len(received.ResourceSpans) != 1 || len(received.ResourceSpans[0].ScopeSpans) != 1 || len(received.ResourceSpans[0].ScopeSpans[0].Spans) != 1 {
+		t.Fatalf("Unexpected export request: %+v", received)
+	}
+	if received.ResourceSpans[0].Resource.Attributes[0].Value.StringValue != DefaultServiceName {
+		t.Errorf("Unexpected resource attributes: %+v", received.ResourceSpans[0].Resource.Attributes)
+	}
+	exported := received.ResourceSpans[0].ScopeSpans[0].Spans[0]
+	if exported.TraceID != span.TraceID || exported.SpanID != span.SpanID || exported.Name != "build" {
+		t.Errorf("Unexpected exported span: %+v", exported)
+	}
+	if exported.Status.Code != otlpStatusCodeError || exported.Status.Message != "build failed" {
+		t.Errorf("Unexpected exported span status: %+v", exported.Status)
+	}
+	expectedAttributes := []otlpKeyValue{{Key: "component_id", Value: otlpValue{StringValue: "component"}}}
+	if !reflect.DeepEqual(exported.Attributes, expectedAttributes) {
+		t.Errorf("Unexpected exported span attributes: %+v", exported.Attributes)
+	}
+}
+
+func TestNewOTLPExporterFromEnv(t *testing.T) {
+	type envTest struct {
+		env          map[string]string
+		expectedURL  string
+		returnsError bool
+	}
+
+	testCases := []envTest{
+		{env: map[string]string{}, expectedURL: ""},
+		{env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://localhost:4318"}, expectedURL: "http://localhost:4318/v1/traces"},
+		{env: map[string]string{"OTEL_EXPORTER_OTLP_TRACES_ENDPOINT": "http://tempo:4318/traces"}, expectedURL: "http://tempo:4318/traces"},
+		{env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://localhost:4318", "OTEL_TRACES_EXPORTER": "none"}, expectedURL: ""},
+		{env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://localhost:4318", "OTEL_EXPORTER_OTLP_PROTOCOL": "grpc"}, returnsError: true},
+		{env: map[string]string{"OTEL_EXPORTER_OTLP_ENDPOINT": "http://localhost:4318", "OTEL_EXPORTER_OTLP_HEADERS": "invalid"}, returnsError: true},
+	}
+
+	variables := []string{"OTEL_EXPORTER_OTLP_ENDPOINT", "OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "OTEL_TRACES_EXPORTER", "OTEL_EXPORTER_OTLP_PROTOCOL", "OTEL_EXPORTER_OTLP_HEADERS"}
+	for i, testCase := range testCases {
+		for _, variable := range variables {
+			os.Unsetenv(variable)
+		}
+		for variable, value := range testCase.env {
+			os.Setenv(variable, value)
+		}
+
+		exporter, err := NewOTLPExporterFromEnv()
+		if err != nil && !testCase.returnsError {
+			t.Errorf("[Test %d] Received error when none was expected: %s", i, err.Error())
+			continue
+		} else if err == nil && testCase.returnsError {
+			t.Errorf("[Test %d] No error was returned but one was expected", i)
+			continue
+		}
+		if testCase.returnsError {
+			continue
+		}
+
+		url := ""
+		if exporter != nil {
+			url = exporter.URL
+		}
+		if url != testCase.expectedURL {
+			t.Errorf("[Test %d] Unexpected export URL: expected=%s, actual=%s", i, testCase.expectedURL, url)
+		}
+	}
+	for _, variable := range variables {
+		os.Unsetenv(variable)
+	}
+}
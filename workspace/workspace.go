@@ -0,0 +1,377 @@
+// Package workspace registers the components and flows of a project against a shnorky state
+// directory from a manifest - a shnorky.workspace file at the root of the project which lists them
+// by their paths relative to it. Syncing a workspace registers the components and flows which are
+// not registered yet, updates those whose registrations have drifted from the manifest (or whose
+// specifications have changed since they were registered), and reports what it changed.
+// This package implements `shn workspace sync`.
+package workspace
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/flows"
+	"github.com/simiotics/shnorky/state"
+)
+
+// ManifestFileName - name of the workspace manifest at the root of a project
+var ManifestFileName = "shnorky.workspace"
+
+// ErrManifestNotFound - returned by FindManifest if there is no workspace manifest in the given
+// directory or any of its ancestors
+var ErrManifestNotFound = errors.New("Could not find a workspace manifest (" + ManifestFileName + ")")
+
+// Kinds of registrations that a workspace manages
+var (
+	KindComponent = "component"
+	KindFlow      = "flow"
+)
+
+// Actions that Sync takes for each entry in a manifest
+var (
+	ActionAdd    = "add"
+	ActionUpdate = "update"
+	ActionNone   = "none"
+)
+
+// ComponentEntry - a component listed in a workspace manifest. Paths are relative to the directory
+// containing the manifest.
+type ComponentEntry struct {
+	// ID defaults to the name of the component directory
+	ID   string `json:"id,omitempty"`
+	Path string `json:"path"`
+	// Type defaults to components.Task
+	Type string `json:"type,omitempty"`
+	// Specification defaults to the component.json file in the component directory
+	Specification string `json:"specification,omitempty"`
+	// Labels, if set, replace the labels of the component
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// FlowEntry - a flow listed in a workspace manifest. Paths are relative to the directory containing
+// the manifest.
+type FlowEntry struct {
+	// ID defaults to the name of the specification file without its extension
+	ID            string `json:"id,omitempty"`
+	Specification string `json:"specification"`
+	// Labels, if set, replace the labels of the flow
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Manifest - the contents of a workspace manifest
+type Manifest struct {
+	Components []ComponentEntry `json:"components"`
+	Flows      []FlowEntry      `json:"flows"`
+}
+
+// Change - describes what Sync did (or, in a dry run, would do) for an entry of a manifest
+type Change struct {
+	Kind   string `json:"kind"`
+	ID     string `json:"id"`
+	Action string `json:"action"`
+	// Drift describes each difference between the registration and the manifest which made Sync
+	// update the registration
+	Drift   []string `json:"drift,omitempty"`
+	Applied bool     `json:"applied"`
+	Error   string   `json:"error,omitempty"`
+}
+
+// FindManifest returns the path of the workspace manifest in the given directory or in the closest
+// of its ancestors which contains one. It returns ErrManifestNotFound if there is none.
+func FindManifest(dir string) (string, error) {
+	absoluteDir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	for {
+		manifestPath := filepath.Join(absoluteDir, ManifestFileName)
+		info, err := os.Stat(manifestPath)
+		if err == nil && !info.IsDir() {
+			return manifestPath, nil
+		}
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+		parent := filepath.Dir(absoluteDir)
+		if parent == absoluteDir {
+			return "", ErrManifestNotFound
+		}
+		absoluteDir = parent
+	}
+}
+
+// ReadManifest reads the workspace manifest at the given path, applies the defaults of its entries,
+// and resolves their paths relative to the directory containing the manifest. It returns an error
+// if the manifest has unknown fields, entries without paths, invalid component types or labels, or
+// duplicate IDs.
+func ReadManifest(manifestPath string) (Manifest, error) {
+	manifestFile, err := os.Open(manifestPath)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer manifestFile.Close()
+
+	var manifest Manifest
+	dec := json.NewDecoder(manifestFile)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&manifest)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("Could not parse workspace manifest (%s): %w", manifestPath, err)
+	}
+
+	root, err := filepath.Abs(filepath.Dir(manifestPath))
+	if err != nil {
+		return manifest, err
+	}
+	resolve := func(path string) string {
+		if filepath.IsAbs(path) {
+			return filepath.Clean(path)
+		}
+		return filepath.Join(root, path)
+	}
+
+	componentIDs := map[string]bool{}
+	for i, entry := range manifest.Components {
+		if entry.Path == "" {
+			return manifest, fmt.Errorf("Component %d in workspace manifest has no path", i)
+		}
+		entry.Path = resolve(entry.Path)
+		if entry.ID == "" {
+			entry.ID = filepath.Base(entry.Path)
+		}
+		if entry.Type == "" {
+			entry.Type = components.Task
+		}
+		if !components.ComponentTypes[entry.Type] {
+			return manifest, fmt.Errorf("Invalid type for component (%s) in workspace manifest: %s", entry.ID, entry.Type)
+		}
+		if entry.Specification == "" {
+			entry.Specification = filepath.Join(entry.Path, components.DefaultSpecificationFileName)
+		} else {
+			entry.Specification = resolve(entry.Specification)
+		}
+		if err := components.ValidateLabels(entry.Labels); err != nil {
+			return manifest, fmt.Errorf("Invalid labels for component (%s) in workspace manifest: %w", entry.ID, err)
+		}
+		if componentIDs[entry.ID] {
+			return manifest, fmt.Errorf("Duplicate component in workspace manifest: %s", entry.ID)
+		}
+		componentIDs[entry.ID] = true
+		manifest.Components[i] = entry
+	}
+
+	flowIDs := map[string]bool{}
+	for i, entry := range manifest.Flows {
+		if entry.Specification == "" {
+			return manifest, fmt.Errorf("Flow %d in workspace manifest has no specification", i)
+		}
+		entry.Specification = resolve(entry.Specification)
+		if entry.ID == "" {
+			entry.ID = strings.TrimSuffix(filepath.Base(entry.Specification), filepath.Ext(entry.Specification))
+		}
+		if err := components.ValidateLabels(entry.Labels); err != nil {
+			return manifest, fmt.Errorf("Invalid labels for flow (%s) in workspace manifest: %w", entry.ID, err)
+		}
+		if flowIDs[entry.ID] {
+			return manifest, fmt.Errorf("Duplicate flow in workspace manifest: %s", entry.ID)
+		}
+		flowIDs[entry.ID] = true
+		manifest.Flows[i] = entry
+	}
+
+	return manifest, nil
+}
+
+// Sync registers each component and flow in the given manifest against the given state database
+// if it is not registered yet, and updates its registration if it has drifted from the manifest.
+// Components are synced before flows, as flows are validated against their components. Failing to
+// sync an entry does not stop Sync from syncing the others - the failure is reported on its Change.
+// If dryRun is true, Sync only reports what it would do.
+func Sync(store state.Store, manifest Manifest, dryRun bool) []Change {
+	changes := []Change{}
+	for _, entry := range manifest.Components {
+		changes = append(changes, syncComponent(store, entry, dryRun))
+	}
+	for _, entry := range manifest.Flows {
+		changes = append(changes, syncFlow(store, entry, dryRun))
+	}
+	return changes
+}
+
+// syncComponent syncs the registration of the component described by the given manifest entry
+func syncComponent(store state.Store, entry ComponentEntry, dryRun bool) Change {
+	change := Change{Kind: KindComponent, ID: entry.ID, Action: ActionNone}
+
+	registered, err := components.SelectComponentByID(store, entry.ID)
+	if err == components.ErrComponentNotFound {
+		change.Action = ActionAdd
+		if dryRun {
+			return change
+		}
+		_, err = components.AddComponent(store, entry.ID, entry.Type, entry.Path, entry.Specification)
+		if err == nil && entry.Labels != nil {
+			err = components.SetLabels(store, components.LabelledComponent, entry.ID, entry.Labels)
+		}
+		return applied(change, err)
+	}
+	if err != nil {
+		change.Error = err.Error()
+		return change
+	}
+
+	if registered.ComponentType != entry.Type {
+		change.Drift = append(change.Drift, fmt.Sprintf("type: %s -> %s", registered.ComponentType, entry.Type))
+	}
+	if registered.ComponentPath != entry.Path {
+		change.Drift = append(change.Drift, fmt.Sprintf("directory: %s -> %s", registered.ComponentPath, entry.Path))
+	}
+	if registered.SpecificationPath != entry.Specification {
+		change.Drift = append(change.Drift, fmt.Sprintf("specification: %s -> %s", registered.SpecificationPath, entry.Specification))
+	}
+	registrationChanged := len(change.Drift) > 0
+	labelsChanged, err := labelsDrift(store, components.LabelledComponent, entry.ID, entry.Labels, &change)
+	if err != nil {
+		change.Error = err.Error()
+		return change
+	}
+	if len(change.Drift) == 0 {
+		return change
+	}
+
+	change.Action = ActionUpdate
+	if dryRun {
+		return change
+	}
+	if registrationChanged {
+		registered.ComponentType = entry.Type
+		registered.ComponentPath = entry.Path
+		registered.SpecificationPath = entry.Specification
+		registered.SpecificationChecksum, registered.SpecificationSnapshot = components.SnapshotSpecification(entry.Specification)
+		err = components.UpdateComponent(store, registered)
+	}
+	if err == nil && labelsChanged {
+		err = components.SetLabels(store, components.LabelledComponent, entry.ID, entry.Labels)
+	}
+	return applied(change, err)
+}
+
+// syncFlow syncs the registration of the flow described by the given manifest entry
+func syncFlow(store state.Store, entry FlowEntry, dryRun bool) Change {
+	change := Change{Kind: KindFlow, ID: entry.ID, Action: ActionNone}
+
+	registered, err := flows.SelectFlowByID(store, entry.ID)
+	if err == flows.ErrFlowNotFound {
+		change.Action = ActionAdd
+		if dryRun {
+			return change
+		}
+		_, err = flows.AddFlow(store, entry.ID, entry.Specification)
+		if err == nil && entry.Labels != nil {
+			err = components.SetLabels(store, components.LabelledFlow, entry.ID, entry.Labels)
+		}
+		return applied(change, err)
+	}
+	if err != nil {
+		change.Error = err.Error()
+		return change
+	}
+
+	if registered.SpecificationPath != entry.Specification {
+		change.Drift = append(change.Drift, fmt.Sprintf("specification: %s -> %s", registered.SpecificationPath, entry.Specification))
+	} else {
+		checksum, err := flows.SpecificationChecksum(entry.Specification)
+		if err != nil {
+			change.Error = fmt.Sprintf("Could not compute checksum of specification (%s): %s", entry.Specification, err.Error())
+			return change
+		}
+		if registered.SpecificationChecksum == "" {
+			change.Drift = append(change.Drift, "specification: no checksum recorded")
+		} else if registered.SpecificationChecksum != checksum {
+			change.Drift = append(change.Drift, "specification: changed since registration")
+		}
+	}
+	registrationChanged := len(change.Drift) > 0
+	labelsChanged, err := labelsDrift(store, components.LabelledFlow, entry.ID, entry.Labels, &change)
+	if err != nil {
+		change.Error = err.Error()
+		return change
+	}
+	if len(change.Drift) == 0 {
+		return change
+	}
+
+	change.Action = ActionUpdate
+	if dryRun {
+		return change
+	}
+	if registrationChanged {
+		_, err = flows.UpdateFlow(store, entry.ID, entry.Specification)
+	}
+	if err == nil && labelsChanged {
+		err = components.SetLabels(store, components.LabelledFlow, entry.ID, entry.Labels)
+	}
+	return applied(change, err)
+}
+
+// labelsDrift records the drift (if any) between the labels of the given resource and the given
+// labels on the given change, and returns true if there is any. Labels which are not set in the
+// manifest (i.e. are nil) do not drift.
+func labelsDrift(store state.Store, resourceType, resourceID string, labels map[string]string, change *Change) (bool, error) {
+	if labels == nil {
+		return false, nil
+	}
+	registeredLabels, err := components.Labels(store, resourceType, resourceID)
+	if err != nil {
+		return false, err
+	}
+	if components.FormatLabels(registeredLabels) == components.FormatLabels(labels) {
+		return false, nil
+	}
+	change.Drift = append(change.Drift, fmt.Sprintf("labels: %s -> %s", components.FormatLabels(registeredLabels), components.FormatLabels(labels)))
+	return true, nil
+}
+
+// applied records the outcome of applying the given change
+func applied(change Change, err error) Change {
+	if err != nil {
+		change.Error = err.Error()
+		return change
+	}
+	change.Applied = true
+	return change
+}
+
+// Failed returns true if any of the given changes could not be determined or applied
+func Failed(changes []Change) bool {
+	for _, change := range changes {
+		if change.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// WriteSyncTable writes the given changes to w as a human-readable table
+func WriteSyncTable(w io.Writer, changes []Change) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "KIND\tID\tACTION\tRESULT\tDRIFT")
+	for _, change := range changes {
+		result := "-"
+		if change.Error != "" {
+			result = "failed: " + change.Error
+		} else if change.Applied {
+			result = "applied"
+		} else if change.Action != ActionNone {
+			result = "pending"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", change.Kind, change.ID, change.Action, result, strings.Join(change.Drift, "; "))
+	}
+	return tw.Flush()
+}
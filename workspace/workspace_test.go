@@ -0,0 +1,179 @@
+package workspace
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/simiotics/shnorky/components"
+	"github.com/simiotics/shnorky/flows"
+	"github.com/simiotics/shnorky/state"
+)
+
+// writeFiles writes the given files (keyed by their paths relative to dir) under dir
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		err := os.MkdirAll(filepath.Dir(path), 0755)
+		if err == nil {
+			err = ioutil.WriteFile(path, []byte(contents), 0644)
+		}
+		if err != nil {
+			t.Fatalf("Could not write file (%s): %s", path, err.Error())
+		}
+	}
+}
+
+func TestReadManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "shnorky-workspace-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	type manifestTest struct {
+		raw          string
+		returnsError bool
+	}
+
+	tests := []manifestTest{
+		{raw: `{"components": [{"path": "jobs/extract"}, {"id": "api", "path": "services/api", "type": "service", "specification": "services/api/spec.json"}], "flows": [{"specification": "flows/nightly.json"}]}`},
+		{raw: `{"components": [{"id": "extract"}]}`, returnsError: true},
+		{raw: `{"components": [{"path": "jobs/extract", "type": "cron"}]}`, returnsError: true},
+		{raw: `{"components": [{"path": "jobs/extract"}, {"path": "legacy/extract"}]}`, returnsError: true},
+		{raw: `{"components": [{"path": "jobs/extract", "labels": {"bad key": "x"}}]}`, returnsError: true},
+		{raw: `{"flows": [{"id": "nightly"}]}`, returnsError: true},
+		{raw: `{"component": []}`, returnsError: true},
+	}
+
+	for i, test := range tests {
+		manifestPath := filepath.Join(dir, ManifestFileName)
+		err = ioutil.WriteFile(manifestPath, []byte(test.raw), 0644)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not write manifest: %s", i, err.Error())
+		}
+		manifest, err := ReadManifest(manifestPath)
+		if test.returnsError {
+			if err == nil {
+				t.Errorf("[Test %d] Expected error but got none", i)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("[Test %d] Unexpected error: %s", i, err.Error())
+			continue
+		}
+
+		extract := manifest.Components[0]
+		if extract.ID != "extract" || extract.Type != components.Task || extract.Path != filepath.Join(dir, "jobs/extract") || extract.Specification != filepath.Join(dir, "jobs/extract/component.json") {
+			t.Errorf("[Test %d] Defaults were not applied to component: %v", i, extract)
+		}
+		api := manifest.Components[1]
+		if api.Type != components.Service || api.Specification != filepath.Join(dir, "services/api/spec.json") {
+			t.Errorf("[Test %d] Unexpected component: %v", i, api)
+		}
+		if manifest.Flows[0].ID != "nightly" || manifest.Flows[0].Specification != filepath.Join(dir, "flows/nightly.json") {
+			t.Errorf("[Test %d] Defaults were not applied to flow: %v", i, manifest.Flows[0])
+		}
+	}
+
+	nested := filepath.Join(dir, "jobs", "extract")
+	err = os.MkdirAll(nested, 0755)
+	if err != nil {
+		t.Fatalf("Could not create directory: %s", err.Error())
+	}
+	manifestPath, err := FindManifest(nested)
+	if err != nil || manifestPath != filepath.Join(dir, ManifestFileName) {
+		t.Errorf("Unexpected manifest found from nested directory: %s, err=%v", manifestPath, err)
+	}
+}
+
+func TestSync(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "shnorky-workspace-tests-")
+	if err != nil {
+		t.Fatalf("Could not create temporary directory: %s", err.Error())
+	}
+	defer os.RemoveAll(tempDir)
+
+	stateDir := filepath.Join(tempDir, "state")
+	err = state.Init(stateDir)
+	if err != nil {
+		t.Fatalf("Could not initialize state directory: %s", err.Error())
+	}
+	db, err := sql.Open("sqlite3", filepath.Join(stateDir, state.DBFileName))
+	if err != nil {
+		t.Fatalf("Error opening state database: %s", err.Error())
+	}
+	defer db.Close()
+	store := state.NewSQLiteStore(db)
+
+	root := filepath.Join(tempDir, "project")
+	writeFiles(t, root, map[string]string{
+		"jobs/extract/component.json": `{"build": {}, "run": {}}`,
+		"flows/nightly.json":          `{"steps": {"extract": "extract"}}`,
+		ManifestFileName:              `{"components": [{"path": "jobs/extract", "labels": {"team": "data"}}], "flows": [{"specification": "flows/nightly.json"}]}`,
+	})
+	manifestPath := filepath.Join(root, ManifestFileName)
+
+	type syncTest struct {
+		prepare         func()
+		dryRun          bool
+		expectedActions []string
+		expectedApplied bool
+	}
+
+	tests := []syncTest{
+		{dryRun: true, expectedActions: []string{ActionAdd, ActionAdd}},
+		{expectedActions: []string{ActionAdd, ActionAdd}, expectedApplied: true},
+		{expectedActions: []string{ActionNone, ActionNone}},
+		{
+			prepare: func() {
+				writeFiles(t, root, map[string]string{
+					"flows/nightly.json": `{"steps": {"extract": "extract", "again": "extract"}}`,
+					ManifestFileName:     `{"components": [{"path": "jobs/extract", "type": "service", "labels": {"team": "data"}}], "flows": [{"specification": "flows/nightly.json"}]}`,
+				})
+			},
+			dryRun:          true,
+			expectedActions: []string{ActionUpdate, ActionUpdate},
+		},
+		{expectedActions: []string{ActionUpdate, ActionUpdate}, expectedApplied: true},
+		{expectedActions: []string{ActionNone, ActionNone}},
+	}
+
+	for i, test := range tests {
+		if test.prepare != nil {
+			test.prepare()
+		}
+		manifest, err := ReadManifest(manifestPath)
+		if err != nil {
+			t.Fatalf("[Test %d] Could not read manifest: %s", i, err.Error())
+		}
+		changes := Sync(store, manifest, test.dryRun)
+		if Failed(changes) {
+			t.Fatalf("[Test %d] Unexpected failures: %v", i, changes)
+		}
+		if len(changes) != len(test.expectedActions) {
+			t.Fatalf("[Test %d] Unexpected number of changes: %v", i, changes)
+		}
+		for j, change := range changes {
+			if change.Action != test.expectedActions[j] || change.Applied != test.expectedApplied {
+				t.Errorf("[Test %d] Unexpected change (%s): expected action=%s applied=%t, actual=%v", i, change.ID, test.expectedActions[j], test.expectedApplied, change)
+			}
+		}
+	}
+
+	component, err := components.SelectComponentByID(store, "extract")
+	if err != nil || component.ComponentType != components.Service {
+		t.Errorf("Expected component type to be updated: %v, err=%v", component, err)
+	}
+	labels, err := components.Labels(store, components.LabelledComponent, "extract")
+	if err != nil || labels["team"] != "data" {
+		t.Errorf("Unexpected component labels: %v, err=%v", labels, err)
+	}
+	steps, err := flows.SelectFlowComponents(store, "nightly")
+	if err != nil || len(steps) != 2 {
+		t.Errorf("Expected flow components to be updated: %v, err=%v", steps, err)
+	}
+}